@@ -0,0 +1,143 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed with socket activation.
+const listenFDsStart = 3
+
+// readyFDEnv is the environment variable giving the file descriptor the new
+// instance started by Server.Handoff notifies readiness on.
+const readyFDEnv = "SMTP_READY_FD"
+
+// ListenFDs returns the listening sockets passed to the process with the
+// systemd socket activation protocol, see sd_listen_fds(3), or by
+// Server.Handoff. It returns nil if there are none. The environment
+// variables of the protocol are unset, so that they aren't inherited by
+// child processes.
+//
+// LISTEN_PID is optional: if it is set, it must match the process. Listeners
+// are returned in order, their names in LISTEN_FDNAMES are ignored: use
+// their address to tell them apart.
+//
+// A process started by Server.Handoff must call NotifyReady once it serves
+// the listeners.
+func ListenFDs() ([]net.Listener, error) {
+	defer unsetListenEnv()
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	nfds := os.Getenv("LISTEN_FDS")
+	if nfds == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(nfds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("smtp: invalid LISTEN_FDS %q", nfds)
+	}
+
+	ls := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := fileListener(uintptr(listenFDsStart + i))
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// NotifyReady tells the instance which started the process with
+// Server.Handoff that the process accepts connections on the inherited
+// listeners, so that it can shut down. It does nothing if the process wasn't
+// started by Server.Handoff. The environment variable of the protocol is
+// unset, so that it isn't inherited by child processes.
+func NotifyReady() error {
+	v := os.Getenv(readyFDEnv)
+	os.Unsetenv(readyFDEnv)
+	if v == "" {
+		return nil
+	}
+	fd, err := strconv.ParseUint(v, 10, 0)
+	if err != nil {
+		return fmt.Errorf("smtp: invalid %v %q", readyFDEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "fd "+v)
+	if f == nil {
+		return fmt.Errorf("smtp: invalid file descriptor %v", fd)
+	}
+	defer f.Close()
+	if _, err := io.WriteString(f, "READY=1\n"); err != nil {
+		return fmt.Errorf("smtp: failed to notify readiness: %v", err)
+	}
+	return nil
+}
+
+func unsetListenEnv() {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+}
+
+// fileListener returns a listener for a listening socket file descriptor.
+// The file descriptor is closed.
+func fileListener(fd uintptr) (net.Listener, error) {
+	f := os.NewFile(fd, "fd "+strconv.FormatUint(uint64(fd), 10))
+	if f == nil {
+		return nil, fmt.Errorf("smtp: invalid file descriptor %v", fd)
+	}
+	// net.FileListener duplicates the file descriptor
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("smtp: file descriptor %v: %v", fd, err)
+	}
+	return l, nil
+}
+
+// ServeFD accepts incoming connections on the listening socket fd, e.g. a
+// file descriptor inherited from a service manager or from a parent process.
+// The file descriptor is closed once the listener is created. See Serve.
+func (s *Server) ServeFD(fd uintptr) error {
+	l, err := fileListener(fd)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Handoff passes the listening sockets of the server to a new instance, for
+// a restart without refusing connections. It starts cmd, passing the
+// listeners with the socket activation protocol (see ListenFDs), waits for
+// the new instance to call NotifyReady, then shuts the server down as with
+// Shutdown. The sockets stay open throughout: connections are queued by the
+// kernel until one of the instances accepts them.
+//
+// cmd must not have been started. The sockets are passed first in
+// cmd.ExtraFiles, followed by the other files of cmd.ExtraFiles and the
+// readiness pipe. The protocol environment variables are set in cmd.Env, or
+// in a copy of the environment of the process if it's nil. Listeners must
+// have a File method, as *net.TCPListener and *net.UnixListener do: implicit
+// TLS listeners can't be passed, the new instance has to wrap the inherited
+// sockets with TLS instead.
+//
+// If cmd can't be started, the server keeps running and the error is
+// returned. If the new instance exits before notifying readiness, or if ctx
+// is done first, it's killed, the server keeps running and an error is
+// returned.
+//
+// Handoff is only supported on Unix.
+func (s *Server) Handoff(ctx context.Context, cmd *exec.Cmd) error {
+	return s.handoff(ctx, cmd)
+}
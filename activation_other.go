@@ -0,0 +1,14 @@
+//go:build !unix
+
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+func (s *Server) handoff(ctx context.Context, cmd *exec.Cmd) error {
+	return fmt.Errorf("smtp: handoff isn't supported on %v", runtime.GOOS)
+}
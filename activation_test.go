@@ -0,0 +1,116 @@
+//go:build unix
+
+package smtp_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// TestServer_HandoffHelper is the new instance started by
+// TestServer_Handoff.
+func TestServer_HandoffHelper(t *testing.T) {
+	switch os.Getenv("SMTP_TEST_HANDOFF") {
+	case "1":
+	case "exit":
+		// Exit without notifying readiness
+		return
+	default:
+		t.Skip("not started by TestServer_Handoff")
+	}
+
+	ls, err := smtp.ListenFDs()
+	if err != nil {
+		t.Fatal("ListenFDs() =", err)
+	}
+	if len(ls) != 1 {
+		t.Fatal("Invalid number of inherited listeners:", len(ls))
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS not unset")
+	}
+
+	s := smtp.NewServer(new(backend))
+	s.Domain = "new.localhost"
+	go s.Serve(ls[0])
+	if err := smtp.NotifyReady(); err != nil {
+		t.Fatal("NotifyReady() =", err)
+	}
+	if os.Getenv("SMTP_READY_FD") != "" {
+		t.Error("SMTP_READY_FD not unset")
+	}
+	time.Sleep(5 * time.Second)
+	s.Close()
+}
+
+func TestServer_Handoff(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t)
+	defer c.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServer_HandoffHelper$")
+	cmd.Env = append(os.Environ(), "SMTP_TEST_HANDOFF=1")
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Handoff(context.Background(), cmd)
+	}()
+
+	// The open connection is drained
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 4.3.2 ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Handoff() =", err)
+	}
+	defer cmd.Process.Kill()
+
+	// New connections are accepted by the new instance
+	c, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	scanner = bufio.NewScanner(c)
+	scanner.Scan()
+	if scanner.Text() != "220 new.localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+}
+
+func TestServer_HandoffNotReady(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServer_HandoffHelper$")
+	cmd.Env = append(os.Environ(), "SMTP_TEST_HANDOFF=exit")
+	if err := s.Handoff(context.Background(), cmd); err == nil {
+		t.Fatal("Handoff() succeeded without a ready instance")
+	}
+
+	// The server keeps running
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+	c, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	scanner = bufio.NewScanner(c)
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 localhost ") {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+}
@@ -0,0 +1,126 @@
+//go:build unix
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// filer is implemented by listeners whose socket can be passed to
+// another process, e.g. *net.TCPListener and *net.UnixListener.
+type filer interface {
+	File() (*os.File, error)
+}
+
+func (s *Server) handoff(ctx context.Context, cmd *exec.Cmd) error {
+	s.locker.Lock()
+	listeners := append([]net.Listener(nil), s.listeners...)
+	s.locker.Unlock()
+	if len(listeners) == 0 {
+		return errors.New("smtp: no listener to hand off")
+	}
+
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			return fmt.Errorf("smtp: listener %v can't be handed off", l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("smtp: listener %v: %v", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "LISTEN_PID=") || strings.HasPrefix(kv, "LISTEN_FDS=") || strings.HasPrefix(kv, "LISTEN_FDNAMES=") || strings.HasPrefix(kv, readyFDEnv+"=") {
+			continue
+		}
+		cmd.Env = append(cmd.Env, kv)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	extraFiles := append(append([]*os.File(nil), files...), cmd.ExtraFiles...)
+	readyFD := listenFDsStart + len(extraFiles)
+	cmd.ExtraFiles = append(extraFiles, w)
+	cmd.Env = append(cmd.Env, "LISTEN_FDS="+strconv.Itoa(len(files)), readyFDEnv+"="+strconv.Itoa(readyFD))
+
+	err = cmd.Start()
+	// The pipe is closed once the new instance notified readiness or exited
+	w.Close()
+	for _, f := range files {
+		if err := setNonblock(f); err != nil {
+			s.ErrorLog.Printf("failed to restore non-blocking mode of %v: %v", f.Name(), err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := r.Read(b[:])
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err == io.EOF {
+			err = errors.New("smtp: new instance exited before notifying readiness")
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	// Closing a Unix listener removes its socket file by default, which is
+	// now used by the new instance
+	for _, l := range listeners {
+		keepSocketFile(l)
+	}
+
+	return s.Shutdown(ctx)
+}
+
+// setNonblock puts the socket of f back in non-blocking mode. Passing f to a
+// child process puts it in blocking mode, which also applies to the listener
+// sharing the socket.
+func setNonblock(f *os.File) error {
+	return syscall.SetNonblock(int(f.Fd()), true)
+}
+
+// keepSocketFile prevents l from removing its socket file when it's closed,
+// if it's a Unix listener.
+func keepSocketFile(l net.Listener) {
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+}
@@ -0,0 +1,29 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+)
+
+// FormatAddressLiteral returns the address literal of an IP address, as
+// defined in RFC 5321 section 4.1.3, e.g. "[192.0.2.1]" or
+// "[IPv6:2001:db8::1]".
+func FormatAddressLiteral(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "[" + ip4.String() + "]"
+	}
+	return "[IPv6:" + ip.String() + "]"
+}
+
+// ParseAddressLiteral parses an IPv4 or IPv6 address literal, as defined in
+// RFC 5321 section 4.1.3, e.g. the domain of "postmaster@[192.0.2.1]".
+func ParseAddressLiteral(s string) (net.IP, error) {
+	if !validAddressLiteral(s) {
+		return nil, fmt.Errorf("smtp: invalid address literal %q", s)
+	}
+	s = s[1 : len(s)-1]
+	if v6, ok := cutPrefixFold(s, "IPv6:"); ok {
+		s = v6
+	}
+	return net.ParseIP(s), nil
+}
@@ -0,0 +1,173 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// parseATRNDomains parses the ATRN argument, a comma-separated list of
+// domains, as defined in RFC 2645 section 4.1.
+func parseATRNDomains(arg string) ([]string, bool) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return nil, true
+	}
+	domains := strings.Split(arg, ",")
+	for _, domain := range domains {
+		if !validDomain(domain) {
+			return nil, false
+		}
+	}
+	return domains, true
+}
+
+func (c *Conn) handleATRN(arg string) {
+	if !c.server.EnableATRN {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "ATRN command not implemented")
+		return
+	}
+	if c.helo == "" {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "Please introduce yourself first.")
+		return
+	}
+	if !c.didAuth {
+		c.writeResponse(530, EnhancedCode{5, 7, 0}, "Authentication required")
+		return
+	}
+	if c.fromReceived || c.bdatPipe != nil {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "Mail transaction in progress")
+		return
+	}
+
+	domains, ok := parseATRNDomains(arg)
+	if !ok {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed domain list")
+		return
+	}
+	domainsAttr := slog.String(logKeyDomains, strings.Join(domains, ","))
+
+	if _, ok := c.baseSession().(ATRNSession); !ok {
+		c.writeResponse(451, EnhancedCode{4, 3, 0}, "Unable to process ATRN request now")
+		return
+	}
+	session := c.Session().(ATRNSession)
+	queue, err := session.ATRN(domains)
+	if err != nil {
+		c.logResult("atrn", "ATRN", err, domainsAttr)
+		c.writeError(451, EnhancedCode{4, 3, 0}, err)
+		return
+	}
+	msg, err := queue.Next()
+	if err != nil || msg == nil {
+		queue.Close()
+		c.logResult("atrn", "ATRN", err, domainsAttr)
+		if err != nil {
+			c.writeError(451, EnhancedCode{4, 3, 0}, err)
+		} else {
+			c.writeResponse(453, EnhancedCode{4, 3, 0}, "You have no mail")
+		}
+		return
+	}
+
+	c.writeResponse(250, EnhancedCode{2, 0, 0}, "OK now reversing the connection")
+	err = c.relayATRN(queue, msg)
+	c.logResult("atrn", "ATRN", err, domainsAttr)
+	c.Close()
+}
+
+// relayATRN acts as the client on the connection, and relays the messages of
+// queue starting with msg.
+func (c *Conn) relayATRN(queue ATRNQueue, msg *ATRNMessage) error {
+	defer queue.Close()
+
+	// The peer may have sent its greeting with the ATRN command
+	client := NewClient(bufferedReadConn{c.conn, c.text.R})
+	if err := client.Hello(c.server.Domain); err != nil {
+		return err
+	}
+	for msg != nil {
+		rcptErrs, err := relayATRNMessage(client, msg)
+		if err != nil {
+			return err
+		}
+		if err := queue.Done(msg, rcptErrs); err != nil {
+			return err
+		}
+		if msg, err = queue.Next(); err != nil {
+			return err
+		}
+	}
+	return client.Quit()
+}
+
+// bufferedReadConn reads a connection through r, which buffers reads from it.
+type bufferedReadConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bufferedReadConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// relayATRNMessage sends msg with client. Replies from the client are
+// returned in rcptErrs, other errors abort the connection.
+func relayATRNMessage(client *Client, msg *ATRNMessage) (rcptErrs []error, err error) {
+	rcptErrs = make([]error, len(msg.To))
+	failAll := func(err error) ([]error, error) {
+		for i, rcptErr := range rcptErrs {
+			if rcptErr == nil {
+				rcptErrs[i] = err
+			}
+		}
+		return rcptErrs, client.Reset()
+	}
+
+	if err := client.Mail(msg.From, msg.MailOptions); err != nil {
+		if !isSMTPError(err) {
+			return nil, err
+		}
+		return failAll(err)
+	}
+	accepted := false
+	for i, to := range msg.To {
+		if err := client.Rcpt(to, nil); err != nil {
+			if !isSMTPError(err) {
+				return nil, err
+			}
+			rcptErrs[i] = err
+		} else {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return rcptErrs, client.Reset()
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		if !isSMTPError(err) {
+			return nil, err
+		}
+		return failAll(err)
+	}
+	if _, err := io.Copy(w, msg.Data); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		if !isSMTPError(err) {
+			return nil, err
+		}
+		return failAll(err)
+	}
+	return rcptErrs, nil
+}
+
+func isSMTPError(err error) bool {
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr)
+}
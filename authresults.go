@@ -0,0 +1,94 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AuthenticationResults builds an Authentication-Results header field, as
+// defined in RFC 8601, e.g. for a session to prepend to messages once the
+// DKIM and DMARC results are known.
+type AuthenticationResults struct {
+	// Authentication service identifier, usually the host name of the
+	// server. Required.
+	AuthServID string
+
+	// Result of the SPF check, empty if there is none, and the checked
+	// MAIL FROM address. See Conn.SPF.
+	SPF         SPFResult
+	SPFMailFrom string
+
+	// Results of the DKIM signature verification, one per signature.
+	DKIM []DKIMResult
+
+	// Result of the DMARC evaluation, nil if there is none. See Conn.DMARC.
+	DMARC *DMARCResult
+}
+
+// HeaderField formats the header field, including the trailing CRLF. Each
+// result is on its own line. If there is no result, "none" is used.
+func (ar *AuthenticationResults) HeaderField() string {
+	var results []string
+	if ar.SPF != "" {
+		res := "spf=" + string(ar.SPF)
+		if ar.SPFMailFrom != "" {
+			res += " smtp.mailfrom=" + authResultsValue(ar.SPFMailFrom)
+		}
+		results = append(results, res)
+	}
+	for _, dkim := range ar.DKIM {
+		res := "dkim=" + string(dkim.Status)
+		if dkim.Err != nil {
+			res += " reason=" + authResultsQuote(dkim.Err.Error())
+		}
+		if dkim.Domain != "" {
+			res += " header.d=" + authResultsValue(dkim.Domain)
+		}
+		if dkim.Selector != "" {
+			res += " header.s=" + authResultsValue(dkim.Selector)
+		}
+		if dkim.Identifier != "" {
+			res += " header.i=" + authResultsValue(dkim.Identifier)
+		}
+		results = append(results, res)
+	}
+	if dmarc := ar.DMARC; dmarc != nil {
+		res := "dmarc=" + string(dmarc.Status)
+		if dmarc.Policy != "" {
+			res += fmt.Sprintf(" (p=%v dis=%v)", dmarc.Policy, dmarc.Disposition)
+		}
+		if dmarc.Err != nil {
+			res += " reason=" + authResultsQuote(dmarc.Err.Error())
+		}
+		if dmarc.Domain != "" {
+			res += " header.from=" + authResultsValue(dmarc.Domain)
+		}
+		results = append(results, res)
+	}
+	if len(results) == 0 {
+		results = []string{"none"}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Authentication-Results: %v", authResultsValue(ar.AuthServID))
+	for _, res := range results {
+		fmt.Fprintf(&sb, ";\r\n\t%v", res)
+	}
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// authResultsValue quotes s unless it can be used as is as a property value:
+// a token, an addr-spec or a domain name.
+func authResultsValue(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-_+@") == "" {
+		return s
+	}
+	return authResultsQuote(s)
+}
+
+// authResultsQuote formats s as a quoted-string, without line breaks.
+func authResultsQuote(s string) string {
+	s = strings.NewReplacer("\r", "", "\n", " ", `\`, `\\`, `"`, `\"`).Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAuthenticationResults(t *testing.T) {
+	ar := &AuthenticationResults{
+		AuthServID:  "mx.example.org",
+		SPF:         SPFPass,
+		SPFMailFrom: "root@nsa.gov",
+		DKIM: []DKIMResult{
+			{Status: DKIMPass, Domain: "nsa.gov", Selector: "2024", Identifier: "@nsa.gov"},
+			{Status: DKIMFail, Domain: "example.com", Selector: "s1", Err: errors.New(`body hash "mismatch"`)},
+		},
+	}
+	want := "Authentication-Results: mx.example.org;\r\n" +
+		"\tspf=pass smtp.mailfrom=root@nsa.gov;\r\n" +
+		"\tdkim=pass header.d=nsa.gov header.s=2024 header.i=@nsa.gov;\r\n" +
+		"\tdkim=fail reason=\"body hash \\\"mismatch\\\"\" header.d=example.com header.s=s1\r\n"
+	if got := ar.HeaderField(); got != want {
+		t.Errorf("HeaderField() = %q, want %q", got, want)
+	}
+
+	ar = &AuthenticationResults{
+		AuthServID: "mx.example.org",
+		DMARC: &DMARCResult{
+			Status:      DMARCFail,
+			Domain:      "nsa.gov",
+			Policy:      DMARCDispositionReject,
+			Disposition: DMARCDispositionQuarantine,
+		},
+	}
+	want = "Authentication-Results: mx.example.org;\r\n" +
+		"\tdmarc=fail (p=reject dis=quarantine) header.from=nsa.gov\r\n"
+	if got := ar.HeaderField(); got != want {
+		t.Errorf("HeaderField() = %q, want %q", got, want)
+	}
+
+	ar = &AuthenticationResults{AuthServID: "mx.example.org"}
+	want = "Authentication-Results: mx.example.org;\r\n\tnone\r\n"
+	if got := ar.HeaderField(); got != want {
+		t.Errorf("HeaderField() = %q, want %q", got, want)
+	}
+}
@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"context"
 	"io"
 
 	"github.com/emersion/go-sasl"
@@ -86,14 +87,162 @@ type LMTPSession interface {
 	LMTPData(r io.Reader, status StatusCollector) error
 }
 
+// ContextSession is an add-on interface for Session. It can be implemented by
+// backends which need to abort their work when the transaction can't complete.
+//
+// When a Session implements ContextSession, MailContext, RcptContext and
+// DataContext are called instead of Mail, Rcpt and Data. The context is
+// cancelled when the client disconnects, including while MailContext or
+// RcptContext are running, or when the server is closed or its shutdown
+// deadline expires.
+//
+// LMTPData doesn't receive a context.
+type ContextSession interface {
+	Session
+
+	MailContext(ctx context.Context, from string, opts *MailOptions) error
+	RcptContext(ctx context.Context, to string, opts *RcptOptions) error
+	DataContext(ctx context.Context, r io.Reader) error
+}
+
+// DeferredRcptSession is an add-on interface for Session. It can be
+// implemented by backends which validate recipients in bulk, e.g. with a
+// single database query per transaction.
+//
+// Recipients accepted by Rcpt are replied to with 252 instead of 250. Before
+// the message is transferred, ValidateRecipients is called with all of them.
+// Rejected recipients are removed from the transaction: if none is left, the
+// DATA or BDAT command fails with the error of the first one. Otherwise, the
+// message is accepted for the remaining recipients, and the backend is
+// responsible for notifying the sender about rejected ones. With LMTP, the
+// error of each rejected recipient is sent after the message instead.
+type DeferredRcptSession interface {
+	Session
+
+	// ValidateRecipients returns errors for rejected recipients. Recipients
+	// missing from the returned map are valid.
+	ValidateRecipients(rcpts []string) map[string]*SMTPError
+}
+
+// DKIMSession is an add-on interface for Session. It can be implemented by
+// backends which need the DKIM signatures of messages to be verified, see
+// Server.DKIMVerifier.
+//
+// When a Session implements DKIMSession and Server.DKIMVerifier is set,
+// DataDKIM is called instead of Data and DataContext. The message is verified
+// as it is read from r. LMTPData doesn't receive DKIM results.
+type DKIMSession interface {
+	Session
+
+	// DataDKIM receives the message. results reads the rest of r, if any, and
+	// returns the DKIM verification results, one per signature.
+	DataDKIM(ctx context.Context, r io.Reader, results func() []DKIMResult) error
+}
+
+// RcptRequest is a recipient passed to BatchRcptSession.RcptBatch.
+type RcptRequest struct {
+	To   string
+	Opts *RcptOptions
+}
+
+// RcptResult is the result of a RcptRequest.
+type RcptResult struct {
+	// Err is nil if the recipient is accepted.
+	Err error
+}
+
+// BatchRcptSession is an add-on interface for Session. It can be implemented
+// by backends with a high per-call latency.
+//
+// When a Session implements BatchRcptSession, RcptBatch is called instead of
+// Rcpt, with all RCPT commands already received in a pipelined burst.
+// Responses are still sent in order, one per command. Malformed commands are
+// not passed to RcptBatch.
+type BatchRcptSession interface {
+	Session
+
+	// RcptBatch returns one result per request, in the same order.
+	RcptBatch(reqs []RcptRequest) []RcptResult
+}
+
 // StatusCollector allows a backend to provide per-recipient status
 // information.
 type StatusCollector interface {
 	SetStatus(rcptTo string, err error)
 }
 
+// ETRNSession is an add-on interface for Session. It provides support for the
+// ETRN command (RFC 1985), enabled with Server.EnableETRN.
+type ETRNSession interface {
+	Session
+
+	// ETRN starts the delivery of the messages queued for node, which is a
+	// domain name, a domain name prefixed with "@" to include its
+	// subdomains, or a queue name prefixed with "#". It's only called for
+	// clients allowed by Server.ETRNTrustedNets or authenticated ones.
+	//
+	// Returning an *SMTPError allows replying with the other codes defined
+	// by RFC 1985, e.g. 251 if no messages are waiting.
+	ETRN(node string) error
+}
+
+// ATRNSession is an add-on interface for Session. It provides support for the
+// ATRN command (RFC 2645), enabled with Server.EnableATRN.
+type ATRNSession interface {
+	Session
+
+	// ATRN returns the messages queued for domains. If domains is empty, it
+	// returns the messages queued for all the domains of the client. It's
+	// only called for authenticated clients, which must only be given
+	// messages for the domains they own.
+	//
+	// Returning an *SMTPError allows replying with another code, e.g. 450
+	// if the client may not receive messages for one of the domains.
+	ATRN(domains []string) (ATRNQueue, error)
+}
+
+// ATRNQueue iterates over the messages relayed to a client with ATRN.
+type ATRNQueue interface {
+	// Next returns the next message to relay, or nil if there are no more
+	// messages.
+	Next() (*ATRNMessage, error)
+	// Done is called once msg has been relayed. rcptErrs contains the error
+	// returned by the client for each recipient of msg, nil if the message
+	// has been accepted for this recipient. Messages Done isn't called for
+	// should be kept queued.
+	Done(msg *ATRNMessage, rcptErrs []error) error
+	// Close is called once relaying is over.
+	Close() error
+}
+
+// ATRNMessage is a message relayed with ATRN.
+type ATRNMessage struct {
+	From        string
+	MailOptions *MailOptions
+	To          []string
+	Data        io.Reader
+}
+
+// IdleSession is an add-on interface for Session. It's notified when the
+// client hasn't sent a command for Server.IdleTimeout, e.g. to release pooled
+// per-session resources such as database handles while the connection is
+// kept open.
+type IdleSession interface {
+	Session
+
+	// Idle is called when the connection becomes idle, from another
+	// goroutine than the one serving the connection. No other method of the
+	// session is called until Active returns.
+	Idle()
+	// Active is called when the client sends a command after Idle.
+	Active()
+}
+
 // AuthSession is an add-on interface for Session. It provides support for the
 // AUTH extension.
+//
+// Mechanisms enabled with Server.EnableAuth take precedence over the ones
+// returned by AuthMechanisms.
 type AuthSession interface {
 	Session
 
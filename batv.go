@@ -0,0 +1,61 @@
+package smtp
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/emersion/go-smtp/smtplog"
+)
+
+// BATVVerifier checks the recipients of messages against their Bounce
+// Address Tag Validation (BATV) signature, to reject backscatter: bounces of
+// messages which weren't sent by the server's users, but forged with their
+// address. See Server.BATVVerifier and the smtpbatv package.
+//
+// Verifiers implementing Policy may be put in monitor mode.
+type BATVVerifier interface {
+	// VerifyRecipient returns the address to give to the backend for a
+	// recipient, without its signature. bounce is true if the message has a
+	// null reverse-path, in which case recipients without a valid signature
+	// are rejected with an error.
+	VerifyRecipient(addr string, bounce bool) (string, error)
+}
+
+// BATVVerifierFunc is an adapter to allow the use of an ordinary function as
+// a BATVVerifier.
+type BATVVerifierFunc func(addr string, bounce bool) (string, error)
+
+var _ BATVVerifier = (BATVVerifierFunc)(nil)
+
+// VerifyRecipient calls f(addr, bounce).
+func (f BATVVerifierFunc) VerifyRecipient(addr string, bounce bool) (string, error) {
+	return f(addr, bounce)
+}
+
+// verifyBATV runs Server.BATVVerifier for a recipient, and returns the
+// address to give to the backend. Errors are replied to with "550 5.7.1
+// Invalid bounce address", unless they're an *SMTPError.
+func (c *Conn) verifyBATV(recipient string) (string, *SMTPError) {
+	v := c.server.BATVVerifier
+	if v == nil {
+		return recipient, nil
+	}
+	addr, err := v.VerifyRecipient(recipient, c.bounce)
+	if err == nil {
+		return addr, nil
+	}
+
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) {
+		smtpErr = &SMTPError{
+			Code:         550,
+			EnhancedCode: EnhancedCode{5, 7, 1},
+			Message:      "Invalid bounce address",
+		}
+	}
+	if c.monitored(v, "batv", smtpErr.Code, smtpErr.Message) {
+		return recipient, nil
+	}
+	c.log(slog.LevelInfo, "batv", "recipient rejected by BATV", slog.String("rcpt", recipient), slog.String(smtplog.ErrorKey, err.Error()))
+	return "", smtpErr
+}
@@ -0,0 +1,119 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/emersion/go-smtp/smtplog"
+)
+
+// ConnectionChecker checks connections before the greeting is sent, e.g. to
+// look up the client address in DNS blocklists. See Server.ConnectionChecker.
+//
+// Checkers implementing Policy may be put in monitor mode.
+type ConnectionChecker interface {
+	// CheckConnection is called with the connection before the greeting. If
+	// it returns an *SMTPError, the error is sent to the client instead of the
+	// greeting and the connection is closed. Other errors are logged, and the
+	// connection is served.
+	//
+	// Checkers may tag the connection with Conn.AddTag for the backend.
+	CheckConnection(ctx context.Context, conn *Conn) error
+}
+
+// ConnectionCheckerFunc is an adapter to allow the use of an ordinary function
+// as a ConnectionChecker.
+type ConnectionCheckerFunc func(ctx context.Context, conn *Conn) error
+
+var _ ConnectionChecker = (ConnectionCheckerFunc)(nil)
+
+// CheckConnection calls f(ctx, conn).
+func (f ConnectionCheckerFunc) CheckConnection(ctx context.Context, conn *Conn) error {
+	return f(ctx, conn)
+}
+
+// checkConnection runs Server.ConnectionChecker. It returns false if the
+// connection has been rejected.
+func (c *Conn) checkConnection() bool {
+	checker := c.server.ConnectionChecker
+	if checker == nil {
+		return true
+	}
+	err := checker.CheckConnection(c.ctx, c)
+	if err == nil {
+		return true
+	}
+
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) {
+		c.server.ErrorLog.Printf("connection check for %v failed: %v", c.ClientAddr(), err)
+		c.log(slog.LevelWarn, "error", "connection check failed", slog.String(smtplog.ErrorKey, err.Error()))
+		return true
+	}
+	if c.monitored(checker, "reject", smtpErr.Code, smtpErr.Message) {
+		return true
+	}
+	c.log(slog.LevelInfo, "reject", "connection rejected", slog.String(smtplog.ErrorKey, err.Error()))
+	c.Kick(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	return false
+}
+
+// waitGreetingDelay waits for Server.GreetingDelay before the greeting. It
+// returns false if the client sent data in the meantime, and has been
+// rejected, or closed the connection.
+func (c *Conn) waitGreetingDelay() bool {
+	delay := c.server.GreetingDelay
+	if delay <= 0 {
+		return true
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(delay)); err != nil {
+		return false
+	}
+	_, err := c.text.R.Peek(1)
+	c.conn.SetReadDeadline(time.Time{})
+	if isTimeout(err) {
+		return true
+	} else if err != nil {
+		return false
+	}
+
+	reply := c.server.EarlyTalkerError
+	if reply == nil {
+		reply = &SMTPError{
+			Code:         554,
+			EnhancedCode: EnhancedCode{5, 3, 2},
+			Message:      "Data received before the greeting",
+		}
+	}
+	c.log(slog.LevelInfo, "early_talker", "client sent data before the greeting")
+	c.Kick(reply.Code, reply.EnhancedCode, reply.Message)
+	return false
+}
+
+// AddTag tags the connection, e.g. from a ConnectionChecker, for the backend.
+func (c *Conn) AddTag(tag string) {
+	c.tagsLocker.Lock()
+	defer c.tagsLocker.Unlock()
+	c.tags = append(c.tags, tag)
+}
+
+// hasTag reports whether the connection has been tagged with tag.
+func (c *Conn) hasTag(tag string) bool {
+	c.tagsLocker.Lock()
+	defer c.tagsLocker.Unlock()
+	for _, t := range c.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Tags returns the tags added with AddTag.
+func (c *Conn) Tags() []string {
+	c.tagsLocker.Lock()
+	defer c.tagsLocker.Unlock()
+	return append([]string(nil), c.tags...)
+}
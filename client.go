@@ -5,6 +5,8 @@
 package smtp
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -15,6 +17,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-sasl"
@@ -35,6 +38,17 @@ type Client struct {
 	didHello   bool              // whether we've said HELO/EHLO/LHLO
 	helloError error             // the error from the hello
 	rcpts      []string          // recipients accumulated for the current session
+	xclientExt map[string]string // extensions supported before the last XCLIENT
+
+	tlsVerification *TLSVerification // see TLSVerification
+
+	// Buffers reused across commands, to avoid allocations
+	cmdBuf, lineBuf, replyBuf []byte
+
+	// Context of the command in progress, if any. deadlineLocker protects
+	// conn deadlines from concurrent context cancellation.
+	ctx            context.Context
+	deadlineLocker sync.Mutex
 
 	// Time to wait for command responses (this includes 3xx reply to DATA).
 	CommandTimeout time.Duration
@@ -43,6 +57,17 @@ type Client struct {
 
 	// Logger for all network activity.
 	DebugWriter io.Writer
+
+	// Send MAIL and RCPT parameters even if the server doesn't advertise the
+	// corresponding extension, and don't check the message size against the
+	// server limit. This is useful to test server error paths.
+	SkipCapabilityChecks bool
+
+	// How the server certificate is verified after STARTTLS, and the names
+	// it's verified against with TLSVerifyNames. They're ignored if
+	// tls.Config.InsecureSkipVerify is set. See TLSVerifyMode.
+	TLSVerify      TLSVerifyMode
+	TLSVerifyNames []string
 }
 
 // 30 seconds was chosen as it's the same duration as http.DefaultTransport's
@@ -55,7 +80,14 @@ var defaultDialer = net.Dialer{Timeout: 30 * time.Second}
 // This function returns a plaintext connection. To enable TLS, use
 // DialStartTLS.
 func Dial(addr string) (*Client, error) {
-	conn, err := defaultDialer.Dial("tcp", addr)
+	return DialContext(context.Background(), addr)
+}
+
+// DialContext is like Dial, but uses the provided context to connect. Once
+// the connection is established, the context has no effect on the returned
+// Client.
+func DialContext(ctx context.Context, addr string) (*Client, error) {
+	conn, err := defaultDialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -87,11 +119,20 @@ func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
 //
 // A nil tlsConfig is equivalent to a zero tls.Config.
 func DialStartTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
-	c, err := Dial(addr)
+	return DialStartTLSContext(context.Background(), addr, tlsConfig)
+}
+
+// DialStartTLSContext is like DialStartTLS, but uses the provided context to
+// connect and to perform the STARTTLS command.
+func DialStartTLSContext(ctx context.Context, addr string, tlsConfig *tls.Config) (*Client, error) {
+	c, err := DialContext(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
-	if err := initStartTLS(c, tlsConfig); err != nil {
+	err = c.withContext(ctx, func() error {
+		return initStartTLS(c, tlsConfig)
+	})
+	if err != nil {
 		c.Close()
 		return nil, err
 	}
@@ -127,12 +168,16 @@ func NewClientStartTLS(conn net.Conn, tlsConfig *tls.Config) (*Client, error) {
 	return c, nil
 }
 
+// ErrStartTLSUnsupported is returned by DialStartTLS and NewClientStartTLS
+// when the server doesn't advertise STARTTLS.
+var ErrStartTLSUnsupported = errors.New("smtp: server doesn't support STARTTLS")
+
 func initStartTLS(c *Client, tlsConfig *tls.Config) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
 	if ok, _ := c.Extension("STARTTLS"); !ok {
-		return errors.New("smtp: server doesn't support STARTTLS")
+		return ErrStartTLSUnsupported
 	}
 	if err := c.startTLS(tlsConfig); err != nil {
 		return err
@@ -150,7 +195,9 @@ func NewClientLMTP(conn net.Conn) *Client {
 
 // setConn sets the underlying network connection for the client.
 func (c *Client) setConn(conn net.Conn) {
+	c.deadlineLocker.Lock()
 	c.conn = conn
+	c.deadlineLocker.Unlock()
 
 	var r io.Reader = conn
 	var w io.Writer = conn
@@ -181,14 +228,75 @@ func (c *Client) Close() error {
 	return c.text.Close()
 }
 
+// aLongTimeAgo is a non-zero time, far in the past, used to interrupt
+// blocked I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// setDeadline sets the connection deadline, capped by the deadline of the
+// context of the command in progress, if any.
+func (c *Client) setDeadline(t time.Time) {
+	c.deadlineLocker.Lock()
+	defer c.deadlineLocker.Unlock()
+
+	if c.ctx != nil {
+		if c.ctx.Err() != nil {
+			t = aLongTimeAgo
+		} else if d, ok := c.ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+			t = d
+		}
+	}
+	c.conn.SetDeadline(t)
+}
+
+// withContext runs f, interrupting any network I/O when ctx is done. If f
+// fails because of ctx, the connection is closed, since its state is
+// unknown, and the context error is returned.
+func (c *Client) withContext(ctx context.Context, f func() error) error {
+	if ctx == nil || ctx.Done() == nil {
+		return f()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.ctx = ctx
+	c.setDeadline(time.Time{})
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(cancelled)
+		c.deadlineLocker.Lock()
+		defer c.deadlineLocker.Unlock()
+		c.conn.SetDeadline(aLongTimeAgo)
+	})
+
+	err := f()
+
+	c.ctx = nil
+	if !stop() {
+		<-cancelled
+	}
+	if err != nil {
+		// The connection deadline may expire slightly before the context
+		if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+			<-ctx.Done()
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			c.Close()
+			return ctxErr
+		}
+	}
+	c.setDeadline(time.Time{})
+	return err
+}
+
 func (c *Client) greet() error {
 	if c.didGreet {
 		return c.greetError
 	}
 
 	// Initial greeting timeout. RFC 5321 recommends 5 minutes.
-	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
-	defer c.conn.SetDeadline(time.Time{})
+	c.setDeadline(time.Now().Add(c.CommandTimeout))
+	defer c.setDeadline(time.Time{})
 
 	c.didGreet = true
 	_, _, err := c.readResponse(220)
@@ -229,6 +337,9 @@ func (c *Client) hello() error {
 // automatically otherwise. If Hello is called, it must be called before
 // any of the other methods.
 //
+// A bare IP address is sent as an address literal, e.g. "[192.0.2.1]", as
+// required by RFC 5321 section 4.1.1.1.
+//
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Hello(localName string) error {
 	if err := validateLine(localName); err != nil {
@@ -237,25 +348,130 @@ func (c *Client) Hello(localName string) error {
 	if c.didHello {
 		return errors.New("smtp: Hello called after other methods")
 	}
+	if ip := net.ParseIP(localName); ip != nil {
+		localName = FormatAddressLiteral(ip)
+	}
 	c.localName = localName
 	return c.hello()
 }
 
+// HelloContext is like Hello, but interrupts the command when ctx is done.
+// In this case, the connection is closed and the context error is returned.
+func (c *Client) HelloContext(ctx context.Context, localName string) error {
+	return c.withContext(ctx, func() error {
+		return c.Hello(localName)
+	})
+}
+
+// readResponse reads a reply like textproto.Reader.ReadResponse, converting
+// errors into SMTPError.
+//
+// Lines are parsed in place in the read buffer, and the lines of multi-line
+// replies are joined in a reused buffer: the returned message is the only
+// allocation, unless the reply is an error.
 func (c *Client) readResponse(expectCode int) (int, string, error) {
-	code, msg, err := c.text.ReadResponse(expectCode)
-	if protoErr, ok := err.(*textproto.Error); ok {
-		err = toSMTPErr(protoErr)
+	line, err := c.readLine()
+	if err != nil {
+		return 0, "", err
+	}
+	code, continued, err := parseReplyLine(line)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var msg string
+	if !continued {
+		msg = string(line[4:])
+	} else {
+		buf := append(c.replyBuf[:0], line[4:]...)
+		for continued {
+			if line, err = c.readLine(); err != nil {
+				return 0, "", err
+			}
+			buf = append(buf, '\n')
+			code2, continued2, err := parseReplyLine(line)
+			if err != nil || code2 != code {
+				// Keep malformed lines, as textproto does
+				buf = append(buf, line...)
+				continue
+			}
+			buf = append(buf, line[4:]...)
+			continued = continued2
+		}
+		c.replyBuf = buf
+		msg = string(buf)
+	}
+
+	if 1 <= expectCode && expectCode < 10 && code/100 != expectCode ||
+		10 <= expectCode && expectCode < 100 && code/10 != expectCode ||
+		100 <= expectCode && expectCode < 1000 && code != expectCode {
+		return code, msg, toSMTPErr(&textproto.Error{Code: code, Msg: msg})
+	}
+	return code, msg, nil
+}
+
+// readLine reads a line without its line ending. The returned slice is only
+// valid until the next read.
+func (c *Client) readLine() ([]byte, error) {
+	line, err := c.text.R.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		buf := append(c.lineBuf[:0], line...)
+		for err == bufio.ErrBufferFull {
+			line, err = c.text.R.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		c.lineBuf = buf
+		line = buf
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+// parseReplyLine parses the code of a reply line, and whether the reply is
+// continued on the next line.
+func parseReplyLine(line []byte) (code int, continued bool, err error) {
+	if len(line) < 4 || line[3] != ' ' && line[3] != '-' {
+		return 0, false, textproto.ProtocolError("short response: " + string(line))
 	}
-	return code, msg, err
+	for _, ch := range line[:3] {
+		if ch < '0' || ch > '9' {
+			return 0, false, textproto.ProtocolError("invalid response code: " + string(line))
+		}
+		code = code*10 + int(ch-'0')
+	}
+	if code < 100 {
+		return 0, false, textproto.ProtocolError("invalid response code: " + string(line))
+	}
+	return code, line[3] == '-', nil
 }
 
 // cmd is a convenience function that sends a command and returns the response
 // textproto.Error returned by c.text.ReadResponse is converted into SMTPError.
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
-	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
-	defer c.conn.SetDeadline(time.Time{})
+	c.cmdBuf = append(c.cmdBuf[:0], fmt.Sprintf(format, args...)...)
+	return c.cmdLine(expectCode, c.cmdBuf)
+}
 
-	id, err := c.text.Cmd(format, args...)
+// cmdLine is like cmd, but sends line as is, which avoids formatting it.
+func (c *Client) cmdLine(expectCode int, line []byte) (int, string, error) {
+	c.setDeadline(time.Now().Add(c.CommandTimeout))
+	defer c.setDeadline(time.Time{})
+
+	id := c.text.Next()
+	c.text.StartRequest(id)
+	c.text.W.Write(line)
+	c.text.W.WriteString("\r\n")
+	err := c.text.W.Flush()
+	c.text.EndRequest(id)
 	if err != nil {
 		return 0, "", err
 	}
@@ -324,6 +540,7 @@ func (c *Client) startTLS(config *tls.Config) error {
 		config = config.Clone()
 		config.ServerName = c.serverName
 	}
+	config = c.verifyingConfig(config)
 	if testHookStartTLS != nil {
 		testHookStartTLS(config)
 	}
@@ -332,6 +549,28 @@ func (c *Client) startTLS(config *tls.Config) error {
 	return nil
 }
 
+// StartTLS sends the STARTTLS command and encrypts all further
+// communication. This can be used to upgrade a connection created with
+// NewClient once the server is known to advertise STARTTLS, see Extension.
+// DialStartTLS and NewClientStartTLS should be preferred when TLS is
+// required.
+//
+// A nil config is equivalent to a zero tls.Config.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) StartTLS(config *tls.Config) error {
+	return c.startTLS(config)
+}
+
+// StartTLSContext is like StartTLS, but interrupts the command when ctx is
+// done. In this case, the connection is closed and the context error is
+// returned. The TLS handshake happens with the next command.
+func (c *Client) StartTLSContext(ctx context.Context, config *tls.Config) error {
+	return c.withContext(ctx, func() error {
+		return c.startTLS(config)
+	})
+}
+
 // TLSConnectionState returns the client's TLS connection state.
 // The return values are their zero values if STARTTLS did
 // not succeed.
@@ -360,14 +599,157 @@ func (c *Client) Verify(addr string) error {
 	return err
 }
 
+// XCLIENT overrides the client attributes seen by the server, such as "ADDR"
+// or "HELO", as defined in https://www.postfix.org/XCLIENT_README.html. This
+// is used by SMTP proxies, which must be trusted by the server. Empty values
+// are sent as "[UNAVAILABLE]".
+//
+// If an attribute isn't advertised by the server, an
+// *UnsupportedExtensionError is returned, unless SkipCapabilityChecks is set.
+// On success, the session starts over and the next command is preceded by
+// EHLO. The extensions advertised by the server may change, see
+// XCLIENTChanges.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) XCLIENT(attrs map[string]string) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+
+	cmd, err := c.attrsCmd("XCLIENT", attrs, c.XCLIENTAttributes())
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(220, "%s", cmd); err != nil {
+		return err
+	}
+	c.xclientExt = c.ext
+	if c.xclientExt == nil {
+		c.xclientExt = map[string]string{}
+	}
+	c.didHello = false
+	c.rcpts = nil
+	return nil
+}
+
+// ExtensionChange describes an extension whose advertisement changed, see
+// Client.XCLIENTChanges.
+type ExtensionChange struct {
+	// Extension keyword, upper-cased, e.g. "AUTH".
+	Extension string
+	// Whether the extension was added or removed. If neither is set, its
+	// parameters changed.
+	Added, Removed bool
+	// Parameters before and after the change.
+	OldParams, NewParams string
+}
+
+// XCLIENTChanges returns the extensions whose advertisement changed with the
+// last successful XCLIENT command, sorted by keyword, e.g. a different AUTH
+// mechanism list once the client identity is trusted. It sends EHLO if
+// needed. If XCLIENT hasn't been sent, nil is returned.
+func (c *Client) XCLIENTChanges() ([]ExtensionChange, error) {
+	if c.xclientExt == nil {
+		return nil, nil
+	}
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+
+	var changes []ExtensionChange
+	for name, params := range c.ext {
+		oldParams, ok := c.xclientExt[name]
+		if !ok {
+			changes = append(changes, ExtensionChange{Extension: name, Added: true, NewParams: params})
+		} else if params != oldParams {
+			changes = append(changes, ExtensionChange{Extension: name, OldParams: oldParams, NewParams: params})
+		}
+	}
+	for name, params := range c.xclientExt {
+		if _, ok := c.ext[name]; !ok {
+			changes = append(changes, ExtensionChange{Extension: name, Removed: true, OldParams: params})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Extension < changes[j].Extension
+	})
+	return changes, nil
+}
+
+// XFORWARD sends the client attributes of the next mail transaction to the
+// server, such as "ADDR" or "HELO", as defined in
+// https://www.postfix.org/XFORWARD_README.html. This is used by content
+// filters and proxies, which must be trusted by the server. Unlike XCLIENT,
+// the session isn't reset, and the attributes only apply to the next
+// transaction. Empty values are sent as "[UNAVAILABLE]".
+//
+// If an attribute isn't advertised by the server, an
+// *UnsupportedExtensionError is returned, unless SkipCapabilityChecks is set.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) XFORWARD(attrs map[string]string) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	cmd, err := c.attrsCmd("XFORWARD", attrs, c.XFORWARDAttributes())
+	if err != nil {
+		return err
+	}
+	_, _, err = c.cmd(250, "%s", cmd)
+	return err
+}
+
+// attrsCmd formats a XCLIENT or XFORWARD command, checking that the
+// attributes are supported.
+func (c *Client) attrsCmd(verb string, attrs map[string]string, supported []string) (string, error) {
+	values := make(map[string]string, len(attrs))
+	names := make([]string, 0, len(attrs))
+	for name, value := range attrs {
+		name = strings.ToUpper(name)
+		values[name] = value
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(verb)
+	for _, name := range names {
+		ok := c.SkipCapabilityChecks
+		for _, attr := range supported {
+			ok = ok || attr == name
+		}
+		if !ok {
+			return "", &UnsupportedExtensionError{Extension: verb + " " + name}
+		}
+
+		value := values[name]
+		if value == "" {
+			value = "[UNAVAILABLE]"
+		} else {
+			value = EncodeXtext(value)
+		}
+		fmt.Fprintf(&sb, " %s=%s", name, value)
+	}
+	return sb.String(), nil
+}
+
 // Auth authenticates a client using the provided authentication mechanism.
 // Only servers that advertise the AUTH extension support this function.
 //
-// If server returns an error, it will be of type *SMTPError.
+// If server returns an error, it will be of type *SMTPError, or
+// *OAuth2Error for the clients returned by NewOAuthBearerClient and
+// NewXOAuth2Client.
 func (c *Client) Auth(a sasl.Client) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	if cc, ok := a.(connClient); ok {
+		var tlsState *tls.ConnectionState
+		if state, ok := c.TLSConnectionState(); ok {
+			tlsState = &state
+		}
+		cc.init(tlsState, c.extParams("AUTH"))
+	}
 	encoding := base64.StdEncoding
 	mech, resp, err := a.Start()
 	if err != nil {
@@ -380,7 +762,7 @@ func (c *Client) Auth(a sasl.Client) error {
 	} else if resp != nil {
 		resp64 = []byte{'='}
 	}
-	code, msg64, err := c.cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
+	code, msg64, err := c.cmd(0, "%s", strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
 	for err == nil {
 		var msg []byte
 		switch code {
@@ -409,18 +791,72 @@ func (c *Client) Auth(a sasl.Client) error {
 		}
 		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
 		encoding.Encode(resp64, resp)
-		code, msg64, err = c.cmd(0, string(resp64))
+		code, msg64, err = c.cmd(0, "%s", string(resp64))
+	}
+	if fc, ok := a.(failureClient); ok && err != nil {
+		if failure := fc.failure(); failure != nil {
+			failure.SMTPError, _ = err.(*SMTPError)
+			return failure
+		}
 	}
 	return err
 }
 
+// UnsupportedExtensionError is returned by the client when an option requires
+// an extension the server doesn't offer. No command is sent to the server in
+// this case.
+type UnsupportedExtensionError struct {
+	// Name of the missing extension, e.g. "REQUIRETLS".
+	Extension string
+}
+
+// Error implements error.
+func (err *UnsupportedExtensionError) Error() string {
+	return "smtp: server does not support " + err.Extension
+}
+
+// MessageTooLargeError is returned by the client when the message size given
+// in MailOptions exceeds the limit advertised by the server with the SIZE
+// extension. No command is sent to the server in this case.
+type MessageTooLargeError struct {
+	Size    int64
+	MaxSize int64
+}
+
+// Error implements error.
+func (err *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("smtp: message size %v exceeds server limit of %v", err.Size, err.MaxSize)
+}
+
+// checkExtension returns an *UnsupportedExtensionError if the server doesn't
+// advertise ext, unless capability checks are disabled.
+func (c *Client) checkExtension(ext string) error {
+	if _, ok := c.ext[ext]; ok || c.SkipCapabilityChecks {
+		return nil
+	}
+	return &UnsupportedExtensionError{Extension: ext}
+}
+
 // Mail issues a MAIL command to the server using the provided email address.
-// If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
-// parameter.
+// If the server supports the 8BITMIME extension and opts.Body is empty, Mail
+// adds the BODY=8BITMIME parameter.
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
 //
 // If opts is not nil, MAIL arguments provided in the structure will be added
-// to the command. Handling of unsupported options depends on the extension.
+// to the command. If an option requires an extension the server doesn't
+// advertise, an *UnsupportedExtensionError is returned. If opts.Size exceeds
+// the limit advertised by the server, a *MessageTooLargeError is returned.
+// These checks can be disabled with SkipCapabilityChecks. The AUTH parameter
+// is silently discarded if the server doesn't support it, and the SIZE
+// parameter if the server doesn't support it either.
+//
+// If opts.RequireTLS is set and the server doesn't advertise REQUIRETLS over
+// a TLS connection, an *UnsupportedExtensionError is returned: the message
+// must then not be relayed to this server (RFC 8689 section 4.1).
+//
+// The parameters in opts.Extensions are sent sorted by name, without checking
+// the server capabilities. An error is returned if they are malformed, or if
+// they make the command longer than 512 bytes (RFC 5321 section 4.5.3.1.4).
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Mail(from string, opts *MailOptions) error {
@@ -430,32 +866,63 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	if opts == nil {
+		opts = &MailOptions{}
+	}
 
 	var sb strings.Builder
 	// A high enough power of 2 than 510+14+26+11+9+9+39+500
 	sb.Grow(2048)
 	fmt.Fprintf(&sb, "MAIL FROM:<%s>", from)
-	if _, ok := c.ext["8BITMIME"]; ok {
+	switch opts.Body {
+	case "":
+		if _, ok := c.ext["8BITMIME"]; ok {
+			sb.WriteString(" BODY=8BITMIME")
+		}
+	case Body7Bit:
+		// The BODY parameter is defined by 8BITMIME, and 7BIT is the default
+		if _, ok := c.ext["8BITMIME"]; ok || c.SkipCapabilityChecks {
+			sb.WriteString(" BODY=7BIT")
+		}
+	case Body8BitMIME:
+		if err := c.checkExtension("8BITMIME"); err != nil {
+			return err
+		}
 		sb.WriteString(" BODY=8BITMIME")
+	case BodyBinaryMIME:
+		if err := c.checkExtension("BINARYMIME"); err != nil {
+			return err
+		}
+		sb.WriteString(" BODY=BINARYMIME")
+	default:
+		return errors.New("smtp: Unknown BODY parameter value")
 	}
-	if _, ok := c.ext["SIZE"]; ok && opts != nil && opts.Size != 0 {
-		fmt.Fprintf(&sb, " SIZE=%v", opts.Size)
+	if opts.Size != 0 {
+		if max, ok := c.MaxMessageSize(); ok && max > 0 && opts.Size > max && !c.SkipCapabilityChecks {
+			return &MessageTooLargeError{Size: opts.Size, MaxSize: max}
+		}
+		if _, ok := c.ext["SIZE"]; ok || c.SkipCapabilityChecks {
+			fmt.Fprintf(&sb, " SIZE=%v", opts.Size)
+		}
 	}
-	if opts != nil && opts.RequireTLS {
-		if _, ok := c.ext["REQUIRETLS"]; ok {
-			sb.WriteString(" REQUIRETLS")
-		} else {
-			return errors.New("smtp: server does not support REQUIRETLS")
+	if opts.RequireTLS {
+		// RFC 8689 section 4.1: REQUIRETLS must only be used over TLS
+		_, isTLS := c.TLSConnectionState()
+		if _, ok := c.ext["REQUIRETLS"]; (!ok || !isTLS) && !c.SkipCapabilityChecks {
+			return &UnsupportedExtensionError{Extension: "REQUIRETLS"}
 		}
+		sb.WriteString(" REQUIRETLS")
 	}
-	if opts != nil && opts.UTF8 {
-		if _, ok := c.ext["SMTPUTF8"]; ok {
-			sb.WriteString(" SMTPUTF8")
-		} else {
-			return errors.New("smtp: server does not support SMTPUTF8")
+	if opts.UTF8 {
+		if err := c.checkExtension("SMTPUTF8"); err != nil {
+			return err
 		}
+		sb.WriteString(" SMTPUTF8")
 	}
-	if _, ok := c.ext["DSN"]; ok && opts != nil {
+	if opts.Return != "" || opts.EnvelopeID != "" {
+		if err := c.checkExtension("DSN"); err != nil {
+			return err
+		}
 		switch opts.Return {
 		case DSNReturnFull, DSNReturnHeaders:
 			fmt.Fprintf(&sb, " RET=%s", string(opts.Return))
@@ -468,100 +935,238 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 			if !isPrintableASCII(opts.EnvelopeID) {
 				return errors.New("smtp: Malformed ENVID parameter value")
 			}
-			fmt.Fprintf(&sb, " ENVID=%s", encodeXtext(opts.EnvelopeID))
+			fmt.Fprintf(&sb, " ENVID=%s", EncodeXtext(opts.EnvelopeID))
+		}
+	}
+	if opts.HoldFor != 0 || !opts.HoldUntil.IsZero() {
+		if err := c.checkExtension("FUTURERELEASE"); err != nil {
+			return err
+		}
+		if opts.HoldFor != 0 && !opts.HoldUntil.IsZero() {
+			return errors.New("smtp: HOLDFOR and HOLDUNTIL are mutually exclusive")
+		}
+		if opts.HoldFor != 0 {
+			fmt.Fprintf(&sb, " HOLDFOR=%d", int64(opts.HoldFor.Seconds()))
+		} else {
+			fmt.Fprintf(&sb, " HOLDUNTIL=%s", opts.HoldUntil.UTC().Format(time.RFC3339))
+		}
+	}
+	if opts.DeliverBy != nil {
+		if err := c.checkExtension("DELIVERBY"); err != nil {
+			return err
+		}
+		arg, err := formatDeliverBy(opts.DeliverBy)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sb, " BY=%s", arg)
+	}
+	if opts.MTPriority != nil {
+		if err := c.checkExtension("MT-PRIORITY"); err != nil {
+			return err
 		}
+		if *opts.MTPriority < -9 || *opts.MTPriority > 9 {
+			return errors.New("smtp: MT-PRIORITY must be between -9 and 9")
+		}
+		fmt.Fprintf(&sb, " MT-PRIORITY=%d", *opts.MTPriority)
 	}
-	if opts != nil && opts.Auth != nil {
-		if _, ok := c.ext["AUTH"]; ok {
-			fmt.Fprintf(&sb, " AUTH=%s", encodeXtext(*opts.Auth))
+	if opts.Auth != nil {
+		if _, ok := c.ext["AUTH"]; ok || c.SkipCapabilityChecks {
+			fmt.Fprintf(&sb, " AUTH=%s", EncodeXtext(*opts.Auth))
 		}
 		// We can safely discard parameter if server does not support AUTH.
 	}
-	_, _, err := c.cmd(250, "%s", sb.String())
+	line := sb.String()
+	if len(opts.Extensions) != 0 {
+		b, err := appendParams([]byte(line), opts.Extensions)
+		if err != nil {
+			return err
+		}
+		line = string(b)
+	}
+	_, _, err := c.cmd(250, "%s", line)
 	return err
 }
 
+// MailContext is like Mail, but interrupts the command when ctx is done. In
+// this case, the connection is closed and the context error is returned.
+func (c *Client) MailContext(ctx context.Context, from string, opts *MailOptions) error {
+	return c.withContext(ctx, func() error {
+		return c.Mail(from, opts)
+	})
+}
+
+// formatDeliverBy formats the BY parameter value, as defined in RFC 2852
+// section 4.
+func formatDeliverBy(opts *DeliverByOptions) (string, error) {
+	if opts.Mode == DeliverByReturn && opts.Time < time.Second {
+		return "", errors.New("smtp: DELIVERBY mode must be greater than zero with return mode")
+	}
+	arg := strconv.Itoa(int(opts.Time.Seconds())) + ";" + string(opts.Mode)
+	if opts.Trace {
+		arg += "T"
+	}
+	return arg, nil
+}
+
+// maxParamsCommandLength is the maximum length of a MAIL or RCPT command with
+// custom parameters, including the trailing CRLF, as defined in RFC 5321
+// section 4.5.3.1.4.
+const maxParamsCommandLength = 512
+
+// appendParams appends custom MAIL or RCPT parameters to the command b,
+// sorted by name.
+func appendParams(b []byte, params map[string]string) ([]byte, error) {
+	if len(params) == 0 {
+		return b, nil
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := params[name]
+		if !isESMTPKeyword(name) {
+			return b, fmt.Errorf("smtp: Malformed parameter name %q", name)
+		}
+		b = append(b, ' ')
+		b = append(b, name...)
+		if value != "" {
+			if !isESMTPValue(value) {
+				return b, fmt.Errorf("smtp: Malformed %v parameter value", name)
+			}
+			b = append(b, '=')
+			b = append(b, value...)
+		}
+	}
+	if len(b)+len("\r\n") > maxParamsCommandLength {
+		return b, errors.New("smtp: Command line with parameters too long")
+	}
+	return b, nil
+}
+
+// defaultRcptOptions is used by Rcpt when opts is nil. It must not be
+// modified.
+var defaultRcptOptions RcptOptions
+
 // Rcpt issues a RCPT command to the server using the provided email address.
 // A call to Rcpt must be preceded by a call to Mail and may be followed by
 // a Data call or another Rcpt call.
 //
 // If opts is not nil, RCPT arguments provided in the structure will be added
-// to the command. Handling of unsupported options depends on the extension.
+// to the command. If an option requires an extension the server doesn't
+// advertise, an *UnsupportedExtensionError is returned, unless
+// SkipCapabilityChecks is set. The parameters in opts.Extensions are sent like
+// with Mail.
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 	if err := validateLine(to); err != nil {
 		return err
 	}
+	if opts == nil {
+		opts = &defaultRcptOptions
+	}
 
-	var sb strings.Builder
-	// A high enough power of 2 than 510+29+501
-	sb.Grow(2048)
-	fmt.Fprintf(&sb, "RCPT TO:<%s>", to)
-	if _, ok := c.ext["DSN"]; ok && opts != nil {
-		if len(opts.Notify) != 0 {
-			sb.WriteString(" NOTIFY=")
-			if err := checkNotifySet(opts.Notify); err != nil {
-				return errors.New("smtp: Malformed NOTIFY parameter value")
-			}
-			for i, v := range opts.Notify {
-				if i != 0 {
-					sb.WriteString(",")
-				}
-				sb.WriteString(string(v))
+	// The command is built in a reused buffer: for recipients without
+	// parameters, Rcpt only allocates the reply
+	b := append(c.cmdBuf[:0], "RCPT TO:<"...)
+	b = append(b, to...)
+	b = append(b, '>')
+	if len(opts.Notify) != 0 || opts.OriginalRecipient != "" {
+		if err := c.checkExtension("DSN"); err != nil {
+			return err
+		}
+	}
+	if len(opts.Notify) != 0 {
+		b = append(b, " NOTIFY="...)
+		if err := checkNotifySet(opts.Notify); err != nil {
+			return errors.New("smtp: Malformed NOTIFY parameter value")
+		}
+		for i, v := range opts.Notify {
+			if i != 0 {
+				b = append(b, ',')
 			}
+			b = append(b, v...)
 		}
-		if opts.OriginalRecipient != "" {
-			var enc string
-			switch opts.OriginalRecipientType {
-			case DSNAddressTypeRFC822:
-				if !isPrintableASCII(opts.OriginalRecipient) {
-					return errors.New("smtp: Illegal address")
-				}
-				enc = encodeXtext(opts.OriginalRecipient)
-			case DSNAddressTypeUTF8:
-				if _, ok := c.ext["SMTPUTF8"]; ok {
-					enc = encodeUTF8AddrUnitext(opts.OriginalRecipient)
-				} else {
-					enc = encodeUTF8AddrXtext(opts.OriginalRecipient)
-				}
-			default:
-				return errors.New("smtp: Unknown address type")
+	}
+	if opts.OriginalRecipient != "" {
+		var enc string
+		switch opts.OriginalRecipientType {
+		case DSNAddressTypeRFC822:
+			if !isPrintableASCII(opts.OriginalRecipient) {
+				return errors.New("smtp: Illegal address")
+			}
+			enc = EncodeXtext(opts.OriginalRecipient)
+		case DSNAddressTypeUTF8:
+			if _, ok := c.ext["SMTPUTF8"]; ok {
+				enc = EncodeUTF8AddrUnitext(opts.OriginalRecipient)
+			} else {
+				enc = EncodeUTF8AddrXtext(opts.OriginalRecipient)
 			}
-			fmt.Fprintf(&sb, " ORCPT=%s;%s", string(opts.OriginalRecipientType), enc)
+		default:
+			return errors.New("smtp: Unknown address type")
 		}
+		b = append(b, " ORCPT="...)
+		b = append(b, opts.OriginalRecipientType...)
+		b = append(b, ';')
+		b = append(b, enc...)
 	}
-	if _, ok := c.ext["RRVS"]; ok && opts != nil && !opts.RequireRecipientValidSince.IsZero() {
-		sb.WriteString(fmt.Sprintf(" RRVS=%s", opts.RequireRecipientValidSince.Format(time.RFC3339)))
+	if !opts.RequireRecipientValidSince.IsZero() {
+		if err := c.checkExtension("RRVS"); err != nil {
+			return err
+		}
+		b = append(b, " RRVS="...)
+		b = opts.RequireRecipientValidSince.AppendFormat(b, time.RFC3339)
 	}
-	if _, ok := c.ext["DELIVERBY"]; ok && opts != nil && opts.DeliverBy != nil {
-		if opts.DeliverBy.Mode == DeliverByReturn && opts.DeliverBy.Time < 1 {
-			return errors.New("smtp: DELIVERBY mode must be greater than zero with return mode")
+	if opts.DeliverBy != nil {
+		if err := c.checkExtension("DELIVERBY"); err != nil {
+			return err
 		}
-		arg := fmt.Sprintf(" BY=%d;%s", int(opts.DeliverBy.Time.Seconds()), opts.DeliverBy.Mode)
-		if opts.DeliverBy.Trace {
-			arg += "T"
+		arg, err := formatDeliverBy(opts.DeliverBy)
+		if err != nil {
+			return err
 		}
-		sb.WriteString(arg)
+		b = append(b, " BY="...)
+		b = append(b, arg...)
 	}
-	if _, ok := c.ext["MT-PRIORITY"]; ok && opts != nil && opts.MTPriority != nil {
+	if opts.MTPriority != nil {
+		if err := c.checkExtension("MT-PRIORITY"); err != nil {
+			return err
+		}
 		if *opts.MTPriority < -9 || *opts.MTPriority > 9 {
 			return errors.New("smtp: MT-PRIORITY must be between -9 and 9")
 		}
-		sb.WriteString(fmt.Sprintf(" MT-PRIORITY=%d", *opts.MTPriority))
+		b = append(b, " MT-PRIORITY="...)
+		b = strconv.AppendInt(b, int64(*opts.MTPriority), 10)
+	}
+	b, err := appendParams(b, opts.Extensions)
+	if err != nil {
+		return err
 	}
-	if _, _, err := c.cmd(25, "%s", sb.String()); err != nil {
+	c.cmdBuf = b
+	if _, _, err := c.cmdLine(25, b); err != nil {
 		return err
 	}
 	c.rcpts = append(c.rcpts, to)
 	return nil
 }
 
+// RcptContext is like Rcpt, but interrupts the command when ctx is done. In
+// this case, the connection is closed and the context error is returned.
+func (c *Client) RcptContext(ctx context.Context, to string, opts *RcptOptions) error {
+	return c.withContext(ctx, func() error {
+		return c.Rcpt(to, opts)
+	})
+}
+
 // DataCommand is a pending DATA command. DataCommand is an io.WriteCloser.
 // See Client.Data.
 type DataCommand struct {
 	client *Client
 	wc     io.WriteCloser
+	ctx    context.Context // set by DataContext
 
 	closeErr error
 }
@@ -570,7 +1175,13 @@ var _ io.WriteCloser = (*DataCommand)(nil)
 
 // Write implements io.Writer.
 func (cmd *DataCommand) Write(b []byte) (int, error) {
-	return cmd.wc.Write(b)
+	var n int
+	err := cmd.client.withContext(cmd.ctx, func() error {
+		var err error
+		n, err = cmd.wc.Write(b)
+		return err
+	})
+	return n, err
 }
 
 // Close implements io.Closer.
@@ -593,20 +1204,25 @@ func (cmd *DataCommand) CloseWithResponse() (*DataResponse, error) {
 		return nil, errors.New("smtp: CloseWithResponse used with an LMTP client")
 	}
 
-	if err := cmd.close(); err != nil {
-		return nil, err
-	}
+	var resp *DataResponse
+	err := cmd.client.withContext(cmd.ctx, func() error {
+		if err := cmd.close(); err != nil {
+			return err
+		}
 
-	cmd.client.conn.SetDeadline(time.Now().Add(cmd.client.SubmissionTimeout))
-	defer cmd.client.conn.SetDeadline(time.Time{})
+		cmd.client.setDeadline(time.Now().Add(cmd.client.SubmissionTimeout))
+		defer cmd.client.setDeadline(time.Time{})
 
-	_, msg, err := cmd.client.readResponse(250)
-	if err != nil {
-		cmd.closeErr = err
-		return nil, err
-	}
+		_, msg, err := cmd.client.readResponse(250)
+		if err != nil {
+			cmd.closeErr = err
+			return err
+		}
 
-	return &DataResponse{StatusText: msg}, nil
+		resp = &DataResponse{StatusText: msg}
+		return nil
+	})
+	return resp, err
 }
 
 // CloseWithLMTPResponse is equivalent to Close, but also returns per-recipient
@@ -618,12 +1234,31 @@ func (cmd *DataCommand) CloseWithLMTPResponse() (map[string]*DataResponse, error
 		return nil, errors.New("smtp: CloseWithLMTPResponse used without an LMTP client")
 	}
 
+	var (
+		resp map[string]*DataResponse
+		err  error
+	)
+	ctxErr := cmd.client.withContext(cmd.ctx, func() error {
+		resp, err = cmd.closeWithLMTPResponse()
+		// Only network errors interrupted by the context matter here
+		if _, ok := err.(LMTPDataError); ok {
+			return nil
+		}
+		return err
+	})
+	if ctxErr != nil && err != nil {
+		return resp, ctxErr
+	}
+	return resp, err
+}
+
+func (cmd *DataCommand) closeWithLMTPResponse() (map[string]*DataResponse, error) {
 	if err := cmd.close(); err != nil {
 		return nil, err
 	}
 
-	cmd.client.conn.SetDeadline(time.Now().Add(cmd.client.SubmissionTimeout))
-	defer cmd.client.conn.SetDeadline(time.Time{})
+	cmd.client.setDeadline(time.Now().Add(cmd.client.SubmissionTimeout))
+	defer cmd.client.setDeadline(time.Time{})
 
 	resp := make(map[string]*DataResponse, len(cmd.client.rcpts))
 	lmtpErr := make(LMTPDataError, len(cmd.client.rcpts))
@@ -705,6 +1340,23 @@ func (c *Client) Data() (*DataCommand, error) {
 	return &DataCommand{client: c, wc: c.text.DotWriter()}, nil
 }
 
+// DataContext is like Data, but interrupts the command when ctx is done,
+// including while the message is written and the server response is read.
+// In this case, the connection is closed and the context error is returned.
+func (c *Client) DataContext(ctx context.Context) (*DataCommand, error) {
+	var cmd *DataCommand
+	err := c.withContext(ctx, func() error {
+		var err error
+		cmd, err = c.Data()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cmd.ctx = ctx
+	return cmd, nil
+}
+
 // SendMail will use an existing connection to send an email from
 // address from, to addresses to, with message r.
 //
@@ -819,14 +1471,7 @@ func (c *Client) Extension(ext string) (bool, string) {
 
 // SupportsAuth checks whether an authentication mechanism is supported.
 func (c *Client) SupportsAuth(mech string) bool {
-	if err := c.hello(); err != nil {
-		return false
-	}
-	mechs, ok := c.ext["AUTH"]
-	if !ok {
-		return false
-	}
-	for _, m := range strings.Split(mechs, " ") {
+	for _, m := range c.AuthMechanisms() {
 		if strings.EqualFold(m, mech) {
 			return true
 		}
@@ -834,11 +1479,54 @@ func (c *Client) SupportsAuth(mech string) bool {
 	return false
 }
 
+// AuthMechanisms returns the SASL mechanisms advertised by the server with the
+// AUTH extension, upper-cased. If the server doesn't support authentication,
+// nil is returned.
+func (c *Client) AuthMechanisms() []string {
+	if err := c.hello(); err != nil {
+		return nil
+	}
+	return c.extParams("AUTH")
+}
+
+// XCLIENTAttributes returns the attribute names advertised by the server with
+// the XCLIENT extension, upper-cased, e.g. "ADDR" or "LOGIN". If the server
+// doesn't support XCLIENT, nil is returned.
+func (c *Client) XCLIENTAttributes() []string {
+	if err := c.hello(); err != nil {
+		return nil
+	}
+	return c.extParams("XCLIENT")
+}
+
+// XFORWARDAttributes returns the attribute names advertised by the server
+// with the XFORWARD extension, upper-cased, e.g. "ADDR" or "HELO". If the
+// server doesn't support XFORWARD, nil is returned.
+func (c *Client) XFORWARDAttributes() []string {
+	if err := c.hello(); err != nil {
+		return nil
+	}
+	return c.extParams("XFORWARD")
+}
+
+// extParams returns the space-separated parameters of an extension keyword.
+func (c *Client) extParams(ext string) []string {
+	param, ok := c.ext[ext]
+	if !ok {
+		return nil
+	}
+	params := strings.Fields(strings.ToUpper(param))
+	if params == nil {
+		params = []string{}
+	}
+	return params
+}
+
 // MaxMessageSize returns the maximum message size accepted by the server.
 // 0 means unlimited.
 //
 // If the server doesn't convey this information, ok = false is returned.
-func (c *Client) MaxMessageSize() (size int, ok bool) {
+func (c *Client) MaxMessageSize() (size int64, ok bool) {
 	if err := c.hello(); err != nil {
 		return 0, false
 	}
@@ -846,7 +1534,7 @@ func (c *Client) MaxMessageSize() (size int, ok bool) {
 	if v == "" {
 		return 0, false
 	}
-	size, err := strconv.Atoi(v)
+	size, err := strconv.ParseInt(v, 10, 64)
 	if err != nil || size < 0 {
 		return 0, false
 	}
@@ -896,21 +1584,10 @@ func (c *Client) Quit() error {
 	return c.Close()
 }
 
-func parseEnhancedCode(s string) (EnhancedCode, error) {
-	parts := strings.Split(s, ".")
-	if len(parts) != 3 {
-		return EnhancedCode{}, fmt.Errorf("wrong amount of enhanced code parts")
-	}
-
-	code := EnhancedCode{}
-	for i, part := range parts {
-		num, err := strconv.Atoi(part)
-		if err != nil {
-			return code, err
-		}
-		code[i] = num
-	}
-	return code, nil
+// QuitContext is like Quit, but interrupts the command when ctx is done. In
+// this case, the connection is closed and the context error is returned.
+func (c *Client) QuitContext(ctx context.Context) error {
+	return c.withContext(ctx, c.Quit)
 }
 
 // toSMTPErr converts textproto.Error into SMTPError, parsing
@@ -926,7 +1603,7 @@ func toSMTPErr(protoErr *textproto.Error) *SMTPError {
 		return smtpErr
 	}
 
-	enchCode, err := parseEnhancedCode(parts[0])
+	enchCode, err := ParseEnhancedCode(parts[0])
 	if err != nil {
 		return smtpErr
 	}
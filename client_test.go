@@ -7,10 +7,13 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
 	"reflect"
@@ -104,6 +107,12 @@ func TestBasic(t *testing.T) {
 	} else if size != 35651584 {
 		t.Errorf("Expected SIZE=35651584, got %v", size)
 	}
+	if mechs := c.AuthMechanisms(); !reflect.DeepEqual(mechs, []string{"LOGIN", "PLAIN"}) {
+		t.Errorf("Expected AUTH mechanisms [LOGIN PLAIN], got %v", mechs)
+	}
+	if attrs := c.XCLIENTAttributes(); attrs != nil {
+		t.Errorf("Expected XCLIENT not supported, got %v", attrs)
+	}
 
 	if err := c.Mail("user@gmail.com", nil); err == nil {
 		t.Fatalf("MAIL should require authentication")
@@ -512,6 +521,31 @@ var helloClient = []string{
 	"NOOP\n",
 }
 
+func TestHello_addressLiteral(t *testing.T) {
+	for _, tc := range []struct {
+		localName, want string
+	}{
+		{"192.0.2.1", "EHLO [192.0.2.1]\r\n"},
+		{"2001:db8::1", "EHLO [IPv6:2001:db8::1]\r\n"},
+		{"[192.0.2.1]", "EHLO [192.0.2.1]\r\n"},
+	} {
+		server := "220 hello world\r\n250 mx.example.org\r\n"
+		var cmdbuf bytes.Buffer
+		bcmdbuf := bufio.NewWriter(&cmdbuf)
+		var fake faker
+		fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+		c := NewClient(fake)
+		if err := c.Hello(tc.localName); err != nil {
+			t.Errorf("Hello(%q) = %v", tc.localName, err)
+		}
+		bcmdbuf.Flush()
+		if got := cmdbuf.String(); got != tc.want {
+			t.Errorf("Hello(%q) sent %q, want %q", tc.localName, got, tc.want)
+		}
+		c.Close()
+	}
+}
+
 var shuttingDownServerHello = `220 hello world
 421 Service not available, closing transmission channel
 `
@@ -672,6 +706,64 @@ func TestTLSConnState(t *testing.T) {
 	<-serverDone
 }
 
+func TestClientTLSVerify(t *testing.T) {
+	tests := []struct {
+		mode       TLSVerifyMode
+		serverName string
+		names      []string
+		name       string
+		fail       bool
+	}{
+		{mode: TLSVerifyHostname, serverName: "example.com", name: "example.com"},
+		{mode: TLSVerifyHostname, serverName: "mx.example.org", fail: true},
+		{mode: TLSVerifyNames, serverName: "mx.example.org", names: []string{"example.org", "example.com"}, name: "example.com"},
+		{mode: TLSVerifyNames, serverName: "mx.example.org", names: []string{"*.com"}, name: "*.com"},
+		{mode: TLSVerifyNames, serverName: "example.com", names: []string{"*.example.com"}, fail: true},
+		{mode: TLSVerifyInsecure, serverName: "mx.example.org", fail: true},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%v %v %v", tc.mode, tc.serverName, tc.names), func(t *testing.T) {
+			ln := newLocalListener(t)
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				serverHandle(conn, t)
+			}()
+
+			c, err := Dial(ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() = %v", err)
+			}
+			defer c.Close()
+			c.TLSVerify = tc.mode
+			c.TLSVerifyNames = tc.names
+			if err := c.StartTLS(&tls.Config{ServerName: tc.serverName}); err != nil {
+				t.Fatalf("StartTLS() = %v", err)
+			}
+			err = c.Hello("localhost")
+			if tc.fail && tc.mode != TLSVerifyInsecure {
+				if err == nil {
+					t.Errorf("Hello() = nil, want verification error")
+				}
+			} else if err != nil {
+				t.Fatalf("Hello() = %v", err)
+			}
+
+			v := c.TLSVerification()
+			if v == nil {
+				t.Fatalf("TLSVerification() = nil")
+			}
+			if v.Mode != tc.mode || v.Name != tc.name || (v.Err != nil) != tc.fail {
+				t.Errorf("TLSVerification() = %+v, want mode %v, name %q, failure %v", v, tc.mode, tc.name, tc.fail)
+			}
+		})
+	}
+}
+
 func newLocalListener(t *testing.T) net.Listener {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -1080,6 +1172,44 @@ func TestClientRRVS(t *testing.T) {
 	}
 }
 
+var futureReleaseServer = `220 hello world
+250 ok
+250 ok
+`
+
+var futureReleaseClient = `MAIL FROM:<root@nsa.gov> HOLDFOR=3600
+MAIL FROM:<root@nsa.gov> HOLDUNTIL=2014-04-03T23:01:00Z
+`
+
+func TestClientFUTURERELEASE(t *testing.T) {
+	server := strings.Join(strings.Split(futureReleaseServer, "\n"), "\r\n")
+	client := strings.Join(strings.Split(futureReleaseClient, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"FUTURERELEASE": "604800 2014-04-10T23:01:00Z"}
+	c.Mail("root@nsa.gov", &MailOptions{HoldFor: time.Hour})
+	c.Mail("root@nsa.gov", &MailOptions{
+		HoldUntil: time.Date(2014, time.April, 4, 1, 1, 0, 0, time.FixedZone("CEST", 2*60*60)),
+	})
+	if err := c.Mail("root@nsa.gov", &MailOptions{HoldFor: time.Hour, HoldUntil: time.Now()}); err == nil {
+		t.Error("Mail with both HOLDFOR and HOLDUNTIL succeeded")
+	}
+	c.Close()
+	if actualcmds := wrote.String(); client != actualcmds {
+		t.Errorf("wrote %q; want %q", actualcmds, client)
+	}
+}
+
 var deliverByServer = `220 hello world
 250 ok
 `
@@ -1116,6 +1246,37 @@ func TestClientDELIVERBY(t *testing.T) {
 	}
 }
 
+func TestClientDELIVERBYMail(t *testing.T) {
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("250 ok\r\n"),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"DELIVERBY": "60"}
+
+	err := c.Mail("root@nsa.gov", &MailOptions{
+		DeliverBy: &DeliverByOptions{Time: 500 * time.Millisecond, Mode: DeliverByReturn},
+	})
+	if err == nil {
+		t.Errorf("Mail() succeeded with a return mode by-time below a second")
+	}
+	err = c.Mail("root@nsa.gov", &MailOptions{
+		DeliverBy: &DeliverByOptions{Time: 2 * time.Hour, Mode: DeliverByNotify, Trace: true},
+	})
+	if err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if want := "MAIL FROM:<root@nsa.gov> BY=7200;NT\r\n"; wrote.String() != want {
+		t.Errorf("wrote %q; want %q", wrote.String(), want)
+	}
+}
+
 var mtPriorityServer = `220 hello world
 250 ok
 `
@@ -1148,3 +1309,486 @@ func TestClientMTPRIORITY(t *testing.T) {
 		t.Errorf("wrote %q; want %q", actualcmds, client)
 	}
 }
+
+func TestClientMTPRIORITYMail(t *testing.T) {
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("250 ok\r\n"),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"MT-PRIORITY": "MIXER"}
+
+	priority := 10
+	if err := c.Mail("root@nsa.gov", &MailOptions{MTPriority: &priority}); err == nil {
+		t.Errorf("Mail() succeeded with an out of range MT-PRIORITY")
+	}
+	priority = -3
+	if err := c.Mail("root@nsa.gov", &MailOptions{MTPriority: &priority}); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if want := "MAIL FROM:<root@nsa.gov> MT-PRIORITY=-3\r\n"; wrote.String() != want {
+		t.Errorf("wrote %q; want %q", wrote.String(), want)
+	}
+}
+
+func TestClientParams(t *testing.T) {
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("250 ok\r\n250 ok\r\n"),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+
+	for _, params := range []map[string]string{
+		{"X_BAD": "1"},
+		{"XTAG": "a=b"},
+		{"XTAG": "a b"},
+		{"XTAG": strings.Repeat("a", 512)},
+	} {
+		if err := c.Mail("root@nsa.gov", &MailOptions{Extensions: params}); err == nil {
+			t.Errorf("Mail() succeeded with params %v", params)
+		}
+		if err := c.Rcpt("root@gchq.gov.uk", &RcptOptions{Extensions: params}); err == nil {
+			t.Errorf("Rcpt() succeeded with params %v", params)
+		}
+	}
+	if wrote.Len() != 0 {
+		t.Fatalf("wrote %q for invalid params", wrote.String())
+	}
+
+	if err := c.Mail("root@nsa.gov", &MailOptions{Extensions: map[string]string{"XRELAY": "mx1", "XFLAG": ""}}); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk", &RcptOptions{Extensions: map[string]string{"XRCPTFORWARD": "dXNlcg"}}); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	want := "MAIL FROM:<root@nsa.gov> XFLAG XRELAY=mx1\r\n" +
+		"RCPT TO:<root@gchq.gov.uk> XRCPTFORWARD=dXNlcg\r\n"
+	if wrote.String() != want {
+		t.Errorf("wrote %q; want %q", wrote.String(), want)
+	}
+}
+
+func TestClientREQUIRETLS(t *testing.T) {
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("220 hello world\r\n"),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+
+	// Not advertised, and not over TLS
+	for _, ext := range []map[string]string{{}, {"REQUIRETLS": ""}} {
+		c.ext = ext
+		err := c.Mail("root@nsa.gov", &MailOptions{RequireTLS: true})
+		var extErr *UnsupportedExtensionError
+		if !errors.As(err, &extErr) || extErr.Extension != "REQUIRETLS" {
+			t.Errorf("Mail() = %v, want UnsupportedExtensionError for REQUIRETLS", err)
+		}
+	}
+	if wrote.Len() != 0 {
+		t.Errorf("wrote %q, want nothing", wrote.String())
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	done := make(chan error, 1)
+	go func() {
+		keypair, err := tls.X509KeyPair(localhostCert, localhostKey)
+		if err != nil {
+			done <- err
+			return
+		}
+		tlsConn := tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{keypair}})
+		send := smtpSender{tlsConn}.send
+		send("220 hello world")
+		s := bufio.NewScanner(tlsConn)
+		for s.Scan() {
+			switch s.Text() {
+			case "EHLO localhost":
+				send("250-hello world")
+				send("250 REQUIRETLS")
+			case "MAIL FROM:<root@nsa.gov> REQUIRETLS":
+				send("250 ok")
+				done <- nil
+				return
+			default:
+				done <- fmt.Errorf("unexpected command: %q", s.Text())
+				return
+			}
+		}
+		done <- s.Err()
+	}()
+
+	cfg := &tls.Config{ServerName: "example.com"}
+	testHookStartTLS(cfg)
+	c = NewClient(tls.Client(clientConn, cfg))
+	if err := c.Mail("root@nsa.gov", &MailOptions{RequireTLS: true}); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		send := smtpSender{serverConn}.send
+		send("220 hello world")
+		s := bufio.NewScanner(serverConn)
+		for s.Scan() {
+			switch {
+			case strings.HasPrefix(s.Text(), "EHLO"):
+				send("250 hello world")
+			case strings.HasPrefix(s.Text(), "MAIL FROM:"):
+				send("250 ok")
+			case strings.HasPrefix(s.Text(), "RCPT TO:"):
+				// Never reply
+			}
+		}
+	}()
+
+	c := NewClient(clientConn)
+	if err := c.MailContext(context.Background(), "root@nsa.gov", nil); err != nil {
+		t.Fatalf("MailContext() = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.RcptContext(ctx, "root@gchq.gov.uk", nil); err != context.DeadlineExceeded {
+		t.Fatalf("RcptContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := c.Noop(); err == nil {
+		t.Errorf("Noop() = nil after interrupted command, want connection closed")
+	}
+}
+
+func TestClientDataContext(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		send := smtpSender{serverConn}.send
+		send("220 hello world")
+		s := bufio.NewScanner(serverConn)
+		for s.Scan() {
+			switch {
+			case strings.HasPrefix(s.Text(), "EHLO"):
+				send("250 hello world")
+			case strings.HasPrefix(s.Text(), "MAIL FROM:"), strings.HasPrefix(s.Text(), "RCPT TO:"):
+				send("250 ok")
+			case s.Text() == "DATA":
+				send("354 go ahead")
+				// Stop reading: writes from the client block
+				return
+			}
+		}
+	}()
+
+	c := NewClient(clientConn)
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk", nil); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err := c.DataContext(ctx)
+	if err != nil {
+		t.Fatalf("DataContext() = %v", err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = io.Copy(w, strings.NewReader(strings.Repeat("Hello world!\r\n", 100000)))
+	if err != context.Canceled {
+		t.Fatalf("Write() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestClientExtensionParams(t *testing.T) {
+	c := &Client{didHello: true, ext: map[string]string{
+		"SIZE":    "8589934592",
+		"AUTH":    "plain  SCRAM-SHA-256",
+		"XCLIENT": "NAME ADDR PROTO HELO login",
+	}}
+
+	if size, ok := c.MaxMessageSize(); !ok || size != 8589934592 {
+		t.Errorf("MaxMessageSize() = %v, %v, want 8589934592, true", size, ok)
+	}
+	if mechs := c.AuthMechanisms(); !reflect.DeepEqual(mechs, []string{"PLAIN", "SCRAM-SHA-256"}) {
+		t.Errorf("AuthMechanisms() = %v", mechs)
+	}
+	if attrs := c.XCLIENTAttributes(); !reflect.DeepEqual(attrs, []string{"NAME", "ADDR", "PROTO", "HELO", "LOGIN"}) {
+		t.Errorf("XCLIENTAttributes() = %v", attrs)
+	}
+
+	c.ext = map[string]string{"SIZE": "-1", "AUTH": ""}
+	if _, ok := c.MaxMessageSize(); ok {
+		t.Errorf("MaxMessageSize() succeeded with a negative size")
+	}
+	if mechs := c.AuthMechanisms(); mechs == nil || len(mechs) != 0 {
+		t.Errorf("AuthMechanisms() = %#v, want an empty list", mechs)
+	}
+}
+
+func TestClientCapabilityChecks(t *testing.T) {
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("250 ok\r\n250 ok\r\n"),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"SIZE": "1000"}
+
+	priority := 1
+	unsupported := []struct {
+		ext  string
+		mail *MailOptions
+		rcpt *RcptOptions
+	}{
+		{ext: "SMTPUTF8", mail: &MailOptions{UTF8: true}},
+		{ext: "DSN", mail: &MailOptions{Return: DSNReturnFull}},
+		{ext: "BINARYMIME", mail: &MailOptions{Body: BodyBinaryMIME}},
+		{ext: "DSN", rcpt: &RcptOptions{Notify: []DSNNotify{DSNNotifyNever}}},
+		{ext: "RRVS", rcpt: &RcptOptions{RequireRecipientValidSince: time.Now()}},
+		{ext: "MT-PRIORITY", rcpt: &RcptOptions{MTPriority: &priority}},
+		{ext: "MT-PRIORITY", mail: &MailOptions{MTPriority: &priority}},
+		{ext: "DELIVERBY", mail: &MailOptions{DeliverBy: &DeliverByOptions{Time: time.Hour, Mode: DeliverByNotify}}},
+	}
+	for _, tc := range unsupported {
+		var err error
+		if tc.mail != nil {
+			err = c.Mail("root@nsa.gov", tc.mail)
+		} else {
+			err = c.Rcpt("root@gchq.gov.uk", tc.rcpt)
+		}
+		var extErr *UnsupportedExtensionError
+		if !errors.As(err, &extErr) || extErr.Extension != tc.ext {
+			t.Errorf("got %v, want UnsupportedExtensionError for %v", err, tc.ext)
+		}
+	}
+
+	err := c.Mail("root@nsa.gov", &MailOptions{Size: 1001})
+	var sizeErr *MessageTooLargeError
+	if !errors.As(err, &sizeErr) || sizeErr.Size != 1001 || sizeErr.MaxSize != 1000 {
+		t.Errorf("Mail() = %v, want MessageTooLargeError", err)
+	}
+	if err := c.Mail("root@nsa.gov", &MailOptions{Body: "QUOTED-PRINTABLE"}); err == nil {
+		t.Errorf("Mail() succeeded with an unknown BODY value")
+	}
+	if wrote.Len() != 0 {
+		t.Errorf("wrote %q, want nothing", wrote.String())
+	}
+
+	c.SkipCapabilityChecks = true
+	if err := c.Mail("root@nsa.gov", &MailOptions{Size: 1001, UTF8: true}); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk", &RcptOptions{MTPriority: &priority}); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	want := "MAIL FROM:<root@nsa.gov> SIZE=1001 SMTPUTF8\r\nRCPT TO:<root@gchq.gov.uk> MT-PRIORITY=1\r\n"
+	if wrote.String() != want {
+		t.Errorf("wrote %q, want %q", wrote.String(), want)
+	}
+}
+
+func TestClientXCLIENT(t *testing.T) {
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("220 mx.example.org ESMTP Service Ready\r\n"),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"XCLIENT": "NAME ADDR PORT HELO"}
+
+	err := c.XCLIENT(map[string]string{"addr": "192.0.2.1", "LOGIN": "alice"})
+	var extErr *UnsupportedExtensionError
+	if !errors.As(err, &extErr) || extErr.Extension != "XCLIENT LOGIN" {
+		t.Errorf("XCLIENT() = %v, want UnsupportedExtensionError for LOGIN", err)
+	}
+	if wrote.Len() != 0 {
+		t.Errorf("wrote %q, want nothing", wrote.String())
+	}
+
+	if err := c.XCLIENT(map[string]string{"ADDR": "192.0.2.1", "HELO": "a b", "NAME": ""}); err != nil {
+		t.Fatalf("XCLIENT() = %v", err)
+	}
+	if want := "XCLIENT ADDR=192.0.2.1 HELO=a+20b NAME=[UNAVAILABLE]\r\n"; wrote.String() != want {
+		t.Errorf("wrote %q, want %q", wrote.String(), want)
+	}
+	if c.didHello {
+		t.Errorf("EHLO not required after XCLIENT")
+	}
+}
+
+func TestClientXCLIENTChanges(t *testing.T) {
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("220 2.0.0 Ok\r\n" +
+			"250-mx.example.org\r\n" +
+			"250-AUTH PLAIN LOGIN\r\n" +
+			"250-SIZE 1000\r\n" +
+			"250 XCLIENT ADDR NAME\r\n"),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didGreet = true
+	c.didHello = true
+	c.ext = map[string]string{"AUTH": "PLAIN", "PIPELINING": "", "XCLIENT": "ADDR NAME"}
+
+	if changes, err := c.XCLIENTChanges(); err != nil || changes != nil {
+		t.Errorf("XCLIENTChanges() = %v, %v, want nil before XCLIENT", changes, err)
+	}
+
+	if err := c.XCLIENT(map[string]string{"ADDR": "192.0.2.1"}); err != nil {
+		t.Fatalf("XCLIENT() = %v", err)
+	}
+	changes, err := c.XCLIENTChanges()
+	if err != nil {
+		t.Fatalf("XCLIENTChanges() = %v", err)
+	}
+	want := []ExtensionChange{
+		{Extension: "AUTH", OldParams: "PLAIN", NewParams: "PLAIN LOGIN"},
+		{Extension: "PIPELINING", Removed: true},
+		{Extension: "SIZE", Added: true, NewParams: "1000"},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("XCLIENTChanges() = %+v, want %+v", changes, want)
+	}
+	if !strings.HasSuffix(wrote.String(), "EHLO localhost\r\n") {
+		t.Errorf("EHLO not sent after XCLIENT, wrote %q", wrote.String())
+	}
+}
+
+func TestClientXFORWARD(t *testing.T) {
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("250 Ok\r\n"),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"XFORWARD": "NAME ADDR PORT HELO SOURCE"}
+
+	err := c.XFORWARD(map[string]string{"ADDR": "192.0.2.1", "LOGIN": "alice"})
+	var extErr *UnsupportedExtensionError
+	if !errors.As(err, &extErr) || extErr.Extension != "XFORWARD LOGIN" {
+		t.Errorf("XFORWARD() = %v, want UnsupportedExtensionError for LOGIN", err)
+	}
+	if wrote.Len() != 0 {
+		t.Errorf("wrote %q, want nothing", wrote.String())
+	}
+
+	if err := c.XFORWARD(map[string]string{"addr": "192.0.2.1", "SOURCE": "REMOTE", "NAME": ""}); err != nil {
+		t.Fatalf("XFORWARD() = %v", err)
+	}
+	if want := "XFORWARD ADDR=192.0.2.1 NAME=[UNAVAILABLE] SOURCE=REMOTE\r\n"; wrote.String() != want {
+		t.Errorf("wrote %q, want %q", wrote.String(), want)
+	}
+	if !c.didHello {
+		t.Errorf("EHLO required after XFORWARD")
+	}
+}
+
+// benchmarkTransaction sends a message to nrcpts recipients, with the replies
+// of the server already received as with pipelining.
+func benchmarkTransaction(b *testing.B, nrcpts int) {
+	var sb strings.Builder
+	sb.WriteString("250 2.1.0 Sender OK\r\n")
+	to := make([]string, nrcpts)
+	for i := range to {
+		to[i] = fmt.Sprintf("user%v@example.org", i)
+		sb.WriteString("250 2.1.5 Recipient OK\r\n")
+	}
+	sb.WriteString("354 Go ahead\r\n250 2.0.0 OK: queued\r\n")
+	server := sb.String()
+	body := "Subject: Hey\r\n\r\nHey <3\r\n"
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var fake faker
+		fake.ReadWriter = struct {
+			io.Reader
+			io.Writer
+		}{
+			strings.NewReader(server),
+			ioutil.Discard,
+		}
+		c := NewClient(fake)
+		c.didHello = true
+		c.ext = map[string]string{"PIPELINING": "", "8BITMIME": "", "ENHANCEDSTATUSCODES": ""}
+		if err := c.SendMail("root@nsa.gov", to, strings.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Sending a message allocates about 35 times, mostly in NewClient and the
+// DATA writer. Each additional recipient allocates once, for its reply.
+func BenchmarkClientTransaction(b *testing.B) {
+	benchmarkTransaction(b, 1)
+}
+
+func BenchmarkClientTransaction1kRecipients(b *testing.B) {
+	benchmarkTransaction(b, 1000)
+}
+
+// NewClient allocates 14 times. Parsing the reply allocates the message, and
+// grows the buffer of the new Client: once grown, the buffer is reused by
+// later replies.
+func BenchmarkClientEhloReply(b *testing.B) {
+	server := "250-mx.example.org Hello\r\n250-PIPELINING\r\n250-8BITMIME\r\n250-ENHANCEDSTATUSCODES\r\n" +
+		"250-CHUNKING\r\n250-SIZE 10240000\r\n250-SMTPUTF8\r\n250 STARTTLS\r\n"
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var fake faker
+		fake.ReadWriter = struct {
+			io.Reader
+			io.Writer
+		}{
+			strings.NewReader(server),
+			ioutil.Discard,
+		}
+		c := NewClient(fake)
+		if _, _, err := c.readResponse(250); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
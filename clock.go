@@ -0,0 +1,65 @@
+package smtp
+
+import (
+	"time"
+)
+
+// Clock provides the current time and timers, to make time-dependent
+// behavior deterministic in tests, e.g. with smtptest.FakeClock.
+//
+// Network deadlines, such as Server.ReadTimeout, always use the system clock.
+type Clock interface {
+	Now() time.Time
+	// NewTimer creates a timer sending the current time on its channel after
+	// at least d.
+	NewTimer(d time.Duration) Timer
+	// AfterFunc calls f in its own goroutine after at least d. The returned
+	// timer has no channel.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by a Clock.
+type Timer interface {
+	// C returns the channel on which the time is sent when the timer fires.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if the timer has
+	// already fired or been stopped.
+	Stop() bool
+}
+
+// SystemClock is the Clock of the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (s *Server) clock() Clock {
+	return clockOrSystem(s.Clock)
+}
+
+// clockOrSystem returns clock, or SystemClock if it's nil.
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return SystemClock
+	}
+	return clock
+}
@@ -0,0 +1,135 @@
+package smtp_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// upstreamBackend only uses the API of upstream go-smtp releases. It must
+// keep compiling unmodified, see the Compatibility section of the README.
+type upstreamBackend struct {
+	msgs chan<- string
+}
+
+func (be upstreamBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &upstreamSession{msgs: be.msgs}, nil
+}
+
+type upstreamSession struct {
+	from string
+	to   []string
+	msgs chan<- string
+}
+
+var (
+	_ smtp.Backend     = upstreamBackend{}
+	_ smtp.Session     = (*upstreamSession)(nil)
+	_ smtp.AuthSession = (*upstreamSession)(nil)
+	_ smtp.LMTPSession = (*upstreamSession)(nil)
+)
+
+func (s *upstreamSession) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+func (s *upstreamSession) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if username != "username" || password != "password" {
+			return errors.New("Invalid username or password")
+		}
+		return nil
+	}), nil
+}
+
+func (s *upstreamSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *upstreamSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *upstreamSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if s.msgs != nil {
+		s.msgs <- string(b)
+	}
+	return nil
+}
+
+func (s *upstreamSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	if err := s.Data(r); err != nil {
+		return err
+	}
+	for _, rcpt := range s.to {
+		status.SetStatus(rcpt, nil)
+	}
+	return nil
+}
+
+func (s *upstreamSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *upstreamSession) Logout() error {
+	return nil
+}
+
+// newUpstreamServer configures a server like upstream users do.
+func newUpstreamServer(be smtp.Backend) *smtp.Server {
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.WriteTimeout = 10 * time.Second
+	s.ReadTimeout = 10 * time.Second
+	s.MaxMessageBytes = 1024 * 1024
+	s.MaxRecipients = 50
+	s.AllowInsecureAuth = true
+	return s
+}
+
+func TestServer_upstreamBackend(t *testing.T) {
+	msgs := make(chan string, 1)
+	s := newUpstreamServer(upstreamBackend{msgs: msgs})
+	// Features of this fork are opt-in
+	trusted, err := smtp.ParseTrustedNets("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.XCLIENTTrustedNets = trusted
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Serve(l)
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.XCLIENT(map[string]string{"ADDR": "192.0.2.1"}); err != nil {
+		t.Fatal("XCLIENT failed:", err)
+	}
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatal("SendMail failed:", err)
+	}
+	if msg := <-msgs; msg != "Hey <3\r\n" {
+		t.Errorf("Data = %q, want %q", msg, "Hey <3\r\n")
+	}
+}
@@ -1,12 +1,15 @@
 package smtp
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/textproto"
 	"regexp"
@@ -17,23 +20,28 @@ import (
 	"time"
 
 	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp/smtplog"
 )
 
-// Number of errors we'll tolerate per connection before closing. Defaults to 3.
-const errThreshold = 3
-
 type Conn struct {
 	conn   net.Conn
 	text   *textproto.Conn
 	server *Server
 	helo   string
+	esmtp  bool // greeted with EHLO or LHLO
 
-	// Number of errors witnessed on this connection
-	errCount int
+	// Number of errors counted towards each limit, see replyError
+	errorCounts map[ErrorLimit]int
+	// Number of errors counted by Server.Tarpit
+	tarpitErrors int
 
 	session    Session
 	locker     sync.Mutex
 	binarymime bool
+	smtputf8   bool // whether the transaction uses SMTPUTF8
+
+	// Serializes writes, so that responses can be sent from other goroutines
+	writeLocker sync.Mutex
 
 	lineLimitReader *lineLimitReader
 	bdatPipe        *io.PipeWriter
@@ -42,23 +50,103 @@ type Conn struct {
 	bytesReceived   int64 // counts total size of chunks when BDAT is used
 
 	fromReceived bool
+	bounce       bool // whether the reverse-path is null
 	recipients   []string
+	spf          SPFResult
+	spfFrom      string                // MAIL FROM address checked with SPF
+	spfHeader    string                // Received-SPF header field, see checkSPF
+	dmarc        *DMARCResult          // see DMARC
+	rcptErrors   map[string]*SMTPError // set by deferred recipient validation
+	verdicts     []*SMTPError          // see Server.DeferPolicyRejections
+	mailRejected bool                  // whether verdicts include the MAIL one
 	didAuth      bool
+
+	// Set while a message is being received, when the server aborts it, and
+	// when the client exceeds Server.DataTimeout
+	readingData bool
+	aborted     bool
+	timedOut    bool
+	// Set while the next command is awaited, see Server.Shutdown
+	awaitingCommand bool
+
+	// Cancelled when the connection is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	history *history // nil if disabled
+	id      string
+
+	timingLocker sync.Mutex
+	timing       Timing // see Timing
+
+	tagsLocker sync.Mutex
+	tags       []string // see AddTag
+
+	// Client address given with a PROXY header
+	proxyAddr net.Addr
+	// Client attributes overridden with XCLIENT
+	xclient *XCLIENTData
+
+	// Set if Server.EnableProfilerLabels is set, see setProfilerState
+	listenerAddr  net.Addr
+	profilerState string
+	profilerCtxs  map[string]context.Context
+
+	// Recorded if Server.EnableFingerprinting is set
+	fingerprintLocker sync.Mutex
+	fingerprint       Fingerprint
+	greeted           time.Time
+	// Client attributes forwarded with XFORWARD for the transaction
+	xforward *XFORWARDData
+
+	// Set if the connection is counted against the connection limits
+	connLimited bool
+	connKey     string
+
+	// Counted only if Server.Metrics is set
+	bytesIn, bytesOut int64
+
+	// Bytes reserved with ReserveMemory, and the part released with the
+	// current message, guarded by Server.memoryLocker
+	memoryUsed, messageMemory int64
 }
 
 func newConn(c net.Conn, s *Server) *Conn {
 	sc := &Conn{
-		server: s,
-		conn:   c,
+		server:  s,
+		conn:    c,
+		history: newHistory(s.CommandHistory, s.clock()),
+		id:      newConnID(s.Rand),
 	}
+	sc.timing.Connected = s.clock().Now()
+
+	parent := s.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	sc.ctx, sc.cancel = context.WithCancel(parent)
 
 	sc.init()
 	return sc
 }
 
+// newListenerConn returns a connection accepted on l.
+func newListenerConn(c net.Conn, s *Server, l net.Listener) *Conn {
+	conn := newConn(c, s)
+	conn.listenerAddr = l.Addr()
+	return conn
+}
+
 func (c *Conn) init() {
+	var r io.Reader = c.conn
+	var w io.Writer = c.conn
+	if c.server.Metrics != nil {
+		r = countingReader{R: r, N: &c.bytesIn}
+		w = countingWriter{W: w, N: &c.bytesOut}
+	}
+
 	c.lineLimitReader = &lineLimitReader{
-		R:         c.conn,
+		R:         r,
 		LineLimit: c.server.MaxLineLength,
 	}
 	rwc := struct {
@@ -67,7 +155,7 @@ func (c *Conn) init() {
 		io.Closer
 	}{
 		Reader: c.lineLimitReader,
-		Writer: c.conn,
+		Writer: w,
 		Closer: c.conn,
 	}
 
@@ -86,7 +174,8 @@ func (c *Conn) init() {
 	c.text = textproto.NewConn(rwc)
 }
 
-// Commands are dispatched to the appropriate handler functions.
+// Commands are passed through middlewares, if any, and then dispatched to the
+// appropriate handler functions.
 func (c *Conn) handle(cmd string, arg string) {
 	// If panic happens during command handling - send 421 response
 	// and close connection.
@@ -95,19 +184,59 @@ func (c *Conn) handle(cmd string, arg string) {
 			c.writeResponse(421, EnhancedCode{4, 0, 0}, "Internal server error")
 			c.Close()
 
-			stack := debug.Stack()
-			c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.conn.RemoteAddr(), err, stack)
+			c.logPanic(err)
 		}
 	}()
 
+	cmd = strings.ToUpper(cmd)
+	c.commandStarted(cmd, arg)
+	if rl := c.server.RateLimiter; rl != nil && cmd != "QUIT" && !rl.AllowCommand(c.ClientAddr()) &&
+		!c.monitored(rl, "rate_limit", 450, "Command rate limit exceeded, try again later") {
+		c.log(slog.LevelWarn, "rate_limit", "command rate limit exceeded", slog.String(logKeyCommand, cmd))
+		c.writeResponse(450, EnhancedCode{4, 7, 0}, "Command rate limit exceeded, try again later")
+		return
+	}
+	if c.server.handler != nil {
+		c.server.handler.HandleCommand(c, cmd, arg)
+	} else {
+		c.dispatch(cmd, arg)
+	}
+}
+
+// commandStarted records a command about to be handled, in upper case.
+func (c *Conn) commandStarted(cmd, arg string) {
+	c.setProfilerState(profilerState(cmd))
+	c.history.add(false, historyCommand(cmd, arg))
+	c.fingerprintCommand(cmd, arg)
+	if c.server.Metrics != nil {
+		c.server.Metrics.Command(cmd)
+	}
+	if c.logEnabled(slog.LevelDebug) {
+		c.log(slog.LevelDebug, "command", "command received", slog.String(logKeyCommand, historyCommand(cmd, arg)))
+	}
+}
+
+func (c *Conn) dispatch(cmd string, arg string) {
 	if cmd == "" {
-		c.protocolError(500, EnhancedCode{5, 5, 2}, "Error: bad syntax")
+		c.protocolError(LimitSyntaxErrors, 500, EnhancedCode{5, 5, 2}, "Error: bad syntax")
 		return
 	}
 
 	cmd = strings.ToUpper(cmd)
+	if c.server.commandDisabled(cmd) {
+		c.handleDisabled(cmd)
+		return
+	}
+	if c.tlsRequired() {
+		switch cmd {
+		case "HELO", "EHLO", "LHLO", "STARTTLS", "NOOP", "RSET", "QUIT":
+		default:
+			c.writeResponse(530, EnhancedCode{5, 7, 0}, "Must issue a STARTTLS command first")
+			return
+		}
+	}
 	switch cmd {
-	case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
+	case "SEND", "SOML", "SAML", "EXPN", "HELP":
 		// These commands are not implemented in any state
 		c.writeResponse(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%v command not implemented", cmd))
 	case "HELO", "EHLO", "LHLO":
@@ -144,9 +273,31 @@ func (c *Conn) handle(cmd string, arg string) {
 		c.handleAuth(arg)
 	case "STARTTLS":
 		c.handleStartTLS()
+	case "XCLIENT":
+		c.handleXCLIENT(arg)
+	case "XFORWARD":
+		c.handleXFORWARD(arg)
+	case "ETRN":
+		c.handleETRN(arg)
+	case "ATRN":
+		c.handleATRN(arg)
 	default:
+		if ext := c.commandExtension(cmd); ext != nil {
+			ext.HandleCommand(c, cmd, arg)
+			return
+		}
+		if f, ok := c.server.commands[cmd]; ok {
+			if err := f(c, arg); err != nil {
+				c.writeError(451, EnhancedCode{4, 3, 0}, err)
+			}
+			return
+		}
+		if c.unofferedCommand(cmd) {
+			c.writeResponse(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%v command not implemented", cmd))
+			return
+		}
 		msg := fmt.Sprintf("Syntax errors, %v command unrecognized", cmd)
-		c.protocolError(500, EnhancedCode{5, 5, 2}, msg)
+		c.protocolError(LimitUnknownCommands, 500, EnhancedCode{5, 5, 2}, msg)
 	}
 }
 
@@ -170,6 +321,8 @@ func (c *Conn) Close() error {
 	c.locker.Lock()
 	defer c.locker.Unlock()
 
+	c.cancel()
+
 	if c.bdatPipe != nil {
 		c.bdatPipe.CloseWithError(ErrDataReset)
 		c.bdatPipe = nil
@@ -180,6 +333,12 @@ func (c *Conn) Close() error {
 		c.session = nil
 	}
 
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		// Closing writes a close_notify alert. Discard what the client sends
+		// meanwhile, e.g. its own alert, so that synchronous connections
+		// such as net.Pipe don't block until the alert times out.
+		go io.Copy(ioutil.Discard, tc.NetConn())
+	}
 	return c.conn.Close()
 }
 
@@ -193,29 +352,119 @@ func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 	return tc.ConnectionState(), true
 }
 
+// Hostname returns the name the client introduced itself with, or the one
+// given by a trusted proxy with XCLIENT.
 func (c *Conn) Hostname() string {
+	if c.xclient != nil && c.xclient.HELO != "" {
+		return c.xclient.HELO
+	}
 	return c.helo
 }
 
+// Conn returns the underlying connection. If Server.XCLIENTRewritesRemoteAddr
+// is set and a trusted proxy has given the client address with XCLIENT, the
+// connection is wrapped to report that address as the remote one. This only
+// changes what's reported: policies keyed by the client address use
+// ClientAddr in any case.
 func (c *Conn) Conn() net.Conn {
+	if c.rewritesRemoteAddr() {
+		return clientAddrConn{c.conn, c.xclient.Addr}
+	}
 	return c.conn
 }
 
-func (c *Conn) authAllowed() bool {
-	_, isTLS := c.TLSConnectionState()
-	return isTLS || c.server.AllowInsecureAuth
+// rewritesRemoteAddr reports whether the client address given with XCLIENT
+// replaces the remote address of the connection, see
+// Server.XCLIENTRewritesRemoteAddr.
+func (c *Conn) rewritesRemoteAddr() bool {
+	return c.server.XCLIENTRewritesRemoteAddr && c.xclient != nil && c.xclient.Addr != nil
 }
 
-// protocolError writes errors responses and closes the connection once too many
-// have occurred.
-func (c *Conn) protocolError(code int, ec EnhancedCode, msg string) {
-	c.writeResponse(code, ec, msg)
+// remoteAddr returns the remote address of the connection, for logs and error
+// reports.
+func (c *Conn) remoteAddr() net.Addr {
+	if c.rewritesRemoteAddr() {
+		return c.xclient.Addr
+	}
+	return c.conn.RemoteAddr()
+}
 
-	c.errCount++
-	if c.errCount > errThreshold {
-		c.writeResponse(500, EnhancedCode{5, 5, 1}, "Too many errors. Quiting now")
-		c.Close()
+// clientAddrConn overrides the remote address of a connection.
+type clientAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c clientAddrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// ClientAddr returns the network address of the SMTP client, used to key
+// per-client policies such as Server.RateLimiter. This is the remote address
+// of the underlying connection, unless overridden by a trusted proxy with a
+// PROXY header or XCLIENT, regardless of Server.XCLIENTRewritesRemoteAddr. See
+// ProxyChain.
+func (c *Conn) ClientAddr() net.Addr {
+	if c.xclient != nil && c.xclient.Addr != nil {
+		return c.xclient.Addr
+	}
+	return c.proxyPeerAddr()
+}
+
+// ClientName returns the host name of the SMTP client given by a trusted proxy
+// with XCLIENT, if any.
+func (c *Conn) ClientName() string {
+	if c.xclient == nil {
+		return ""
+	}
+	return c.xclient.Name
+}
+
+// ClientLogin returns the user name the SMTP client authenticated as with a
+// trusted proxy, as given with XCLIENT, if any.
+func (c *Conn) ClientLogin() string {
+	if c.xclient == nil {
+		return ""
+	}
+	return c.xclient.Login
+}
+
+// authAllowed reports whether the mechanism can be used on this connection.
+func (c *Conn) authAllowed(mech string) bool {
+	if _, isTLS := c.TLSConnectionState(); isTLS || c.server.AllowInsecureAuth {
+		return true
+	}
+	for _, name := range c.server.InsecureAuthMechanisms {
+		if strings.EqualFold(name, mech) {
+			return true
+		}
 	}
+	return false
+}
+
+// startTLSAllowed reports whether STARTTLS is offered on this connection.
+func (c *Conn) startTLSAllowed() bool {
+	if _, isTLS := c.TLSConnectionState(); isTLS || c.server.tlsConfig() == nil {
+		return false
+	}
+	return c.server.STARTTLSNets == nil || c.server.STARTTLSNets.Contains(c.conn.RemoteAddr())
+}
+
+// tlsRequired reports whether the client must issue STARTTLS before using
+// the server.
+func (c *Conn) tlsRequired() bool {
+	if _, isTLS := c.TLSConnectionState(); isTLS {
+		return false
+	}
+	return c.server.TLSRequiredNets.Contains(c.conn.RemoteAddr())
+}
+
+// protocolError writes an error response counted towards limit, unless the
+// connection is closed because of too many errors.
+func (c *Conn) protocolError(limit ErrorLimit, code int, ec EnhancedCode, msg string) {
+	c.replyError(limit, func() {
+		c.writeResponse(code, ec, msg)
+	})
 }
 
 // GREET state -> waiting for HELO
@@ -225,6 +474,14 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for HELO")
 		return
 	}
+	if c.server.StrictSyntax && (domain != arg || !validDomain(domain) && !validAddressLiteral(domain)) {
+		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Invalid domain/address argument")
+		return
+	}
+	if err := c.server.checkHELO(domain); err != nil && !c.monitored(c.server.Validation, "validation", err.Code, err.Message) {
+		c.writeResponse(err.Code, err.EnhancedCode, err.Message)
+		return
+	}
 	// c.helo is populated before NewSession so
 	// NewSession can access it via Conn.Hostname.
 	c.helo = domain
@@ -244,32 +501,40 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 
 		c.setSession(sess)
 	}
+	c.esmtp = enhanced
 
 	if !enhanced {
 		c.writeResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Hello %s", domain))
 		return
 	}
 
+	if c.tlsRequired() {
+		// Hide other extensions until the session is secured
+		caps := []string{"Hello " + domain, "PIPELINING", "ENHANCEDSTATUSCODES"}
+		if c.startTLSAllowed() {
+			caps = append(caps, "STARTTLS")
+		}
+		c.writeResponse(250, NoEnhancedCode, caps...)
+		return
+	}
+
 	caps := []string{
 		"PIPELINING",
 		"8BITMIME",
 		"ENHANCEDSTATUSCODES",
 		"CHUNKING",
 	}
-	if _, isTLS := c.TLSConnectionState(); c.server.TLSConfig != nil && !isTLS {
+	if c.startTLSAllowed() {
 		caps = append(caps, "STARTTLS")
 	}
-	if c.authAllowed() {
-		mechs := c.authMechanisms()
-
-		authCap := "AUTH"
-		for _, name := range mechs {
+	authCap := "AUTH"
+	for _, name := range c.authMechanisms() {
+		if c.authAllowed(name) {
 			authCap += " " + name
 		}
-
-		if len(mechs) > 0 {
-			caps = append(caps, authCap)
-		}
+	}
+	if authCap != "AUTH" {
+		caps = append(caps, authCap)
 	}
 	if c.server.EnableSMTPUTF8 {
 		caps = append(caps, "SMTPUTF8")
@@ -283,17 +548,32 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	if c.server.EnableDSN {
 		caps = append(caps, "DSN")
 	}
-	if c.server.MaxMessageBytes > 0 {
-		caps = append(caps, fmt.Sprintf("SIZE %v", c.server.MaxMessageBytes))
+	if max := c.server.maxMessageBytes(); max > 0 {
+		caps = append(caps, fmt.Sprintf("SIZE %v", max))
 	} else {
 		caps = append(caps, "SIZE")
 	}
-	if c.server.MaxRecipients > 0 {
-		caps = append(caps, fmt.Sprintf("LIMITS RCPTMAX=%v", c.server.MaxRecipients))
+	if max := c.server.maxRecipients(); max > 0 {
+		caps = append(caps, fmt.Sprintf("LIMITS RCPTMAX=%v", max))
+	}
+	if c.xclientAllowed() {
+		caps = append(caps, "XCLIENT "+strings.Join(xclientAttrs, " "))
+	}
+	if c.xforwardAllowed() {
+		caps = append(caps, "XFORWARD "+strings.Join(xforwardAttrs, " "))
+	}
+	if c.xrcptforwardAllowed() {
+		caps = append(caps, xrcptforwardParam)
 	}
 	if c.server.EnableRRVS {
 		caps = append(caps, "RRVS")
 	}
+	if c.server.EnableETRN {
+		caps = append(caps, "ETRN")
+	}
+	if c.server.EnableATRN {
+		caps = append(caps, "ATRN")
+	}
 	if c.server.EnableDELIVERBY {
 		if c.server.MinimumDeliverByTime == 0 {
 			caps = append(caps, "DELIVERBY")
@@ -301,6 +581,10 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 			caps = append(caps, fmt.Sprintf("DELIVERBY %d", int(c.server.MinimumDeliverByTime.Seconds())))
 		}
 	}
+	if c.server.EnableFUTURERELEASE {
+		max := c.server.maxFutureRelease()
+		caps = append(caps, fmt.Sprintf("FUTURERELEASE %d %s", int64(max.Seconds()), c.server.clock().Now().Add(max).UTC().Format(time.RFC3339)))
+	}
 	if c.server.EnableMTPRIORITY {
 		if c.server.MtPriorityProfile == PriorityUnspecified {
 			caps = append(caps, "MT-PRIORITY")
@@ -308,6 +592,7 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 			caps = append(caps, fmt.Sprintf("MT-PRIORITY %s", c.server.MtPriorityProfile))
 		}
 	}
+	caps = append(caps, c.extensionCaps()...)
 
 	args := []string{"Hello " + domain}
 	args = append(args, caps...)
@@ -331,15 +616,24 @@ func (c *Conn) handleMail(arg string) {
 		return
 	}
 
-	p := parser{s: strings.TrimSpace(arg)}
+	p := c.newParser(arg)
 	from, err := p.parseReversePath()
 	if err != nil {
-		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
+		if c.server.StrictSyntax {
+			c.writeResponse(501, EnhancedCode{5, 1, 7}, fmt.Sprintf("Invalid sender address syntax: %v", err))
+		} else {
+			c.writeResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
+		}
 		return
 	}
-	args, err := parseArgs(p.s)
+	if from != "" && c.server.strictAddresses() && !validMailbox(from) &&
+		!c.monitored(c.server.Validation, "validation", 501, "Invalid sender address") {
+		c.writeResponse(501, EnhancedCode{5, 1, 7}, "Invalid sender address")
+		return
+	}
+	args, err := p.parseArgs()
 	if err != nil {
-		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse MAIL ESMTP parameters")
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, c.scrub(fmt.Sprintf("Unable to parse MAIL ESMTP parameters: %v", err)))
 		return
 	}
 
@@ -357,7 +651,7 @@ func (c *Conn) handleMail(arg string) {
 				return
 			}
 
-			if c.server.MaxMessageBytes > 0 && int64(size) > c.server.MaxMessageBytes {
+			if max := c.server.maxMessageBytes(); max > 0 && int64(size) > max {
 				c.writeResponse(552, EnhancedCode{5, 3, 4}, "Max message size exceeded")
 				return
 			}
@@ -374,6 +668,15 @@ func (c *Conn) handleMail(arg string) {
 				c.writeResponse(504, EnhancedCode{5, 5, 4}, "REQUIRETLS is not implemented")
 				return
 			}
+			if value != "" {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "REQUIRETLS does not take a value")
+				return
+			}
+			// RFC 8689 section 4.1: REQUIRETLS is only valid over TLS
+			if _, isTLS := c.TLSConnectionState(); !isTLS {
+				c.writeResponse(530, EnhancedCode{5, 7, 10}, "REQUIRETLS needs a TLS session")
+				return
+			}
 			opts.RequireTLS = true
 		case "BODY":
 			value = strings.ToUpper(value)
@@ -410,14 +713,14 @@ func (c *Conn) handleMail(arg string) {
 				c.writeResponse(504, EnhancedCode{5, 5, 4}, "ENVID is not implemented")
 				return
 			}
-			value, err := decodeXtext(value)
+			value, err := DecodeXtext(value)
 			if err != nil || value == "" || !isPrintableASCII(value) {
 				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed ENVID parameter value")
 				return
 			}
 			opts.EnvelopeID = value
 		case "AUTH":
-			value, err := decodeXtext(value)
+			value, err := DecodeXtext(value)
 			if err != nil || value == "" {
 				c.writeResponse(500, EnhancedCode{5, 5, 4}, "Malformed AUTH parameter value")
 				return
@@ -425,7 +728,7 @@ func (c *Conn) handleMail(arg string) {
 			if value == "<>" {
 				value = ""
 			} else {
-				p := parser{s: value}
+				p := parser{s: value, strict: c.server.StrictSyntax}
 				value, err = p.parseMailbox()
 				if err != nil || p.s != "" {
 					c.writeResponse(500, EnhancedCode{5, 5, 4}, "Malformed AUTH parameter mailbox")
@@ -433,51 +736,146 @@ func (c *Conn) handleMail(arg string) {
 				}
 			}
 			opts.Auth = &value
+		case "HOLDFOR":
+			if !c.server.EnableFUTURERELEASE {
+				c.writeResponse(504, EnhancedCode{5, 5, 4}, "FUTURERELEASE is not implemented")
+				return
+			}
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed HOLDFOR parameter value")
+				return
+			}
+			opts.HoldFor = time.Duration(seconds) * time.Second
+			if opts.HoldFor > c.server.maxFutureRelease() {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "HOLDFOR exceeds the maximum future release interval")
+				return
+			}
+		case "HOLDUNTIL":
+			if !c.server.EnableFUTURERELEASE {
+				c.writeResponse(504, EnhancedCode{5, 5, 4}, "FUTURERELEASE is not implemented")
+				return
+			}
+			holdUntil, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed HOLDUNTIL parameter value")
+				return
+			}
+			if holdUntil.After(c.server.clock().Now().Add(c.server.maxFutureRelease())) {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "HOLDUNTIL exceeds the maximum future release date-time")
+				return
+			}
+			opts.HoldUntil = holdUntil
+		case "BY":
+			if !c.server.EnableDELIVERBY {
+				c.writeResponse(504, EnhancedCode{5, 5, 4}, "DELIVERBY is not implemented")
+				return
+			}
+			deliverBy, err := c.parseDeliverBy(value)
+			if err != nil {
+				c.writeResponse(err.Code, err.EnhancedCode, err.Message)
+				return
+			}
+			opts.DeliverBy = deliverBy
+		case "MT-PRIORITY":
+			if !c.server.EnableMTPRIORITY {
+				c.writeResponse(504, EnhancedCode{5, 5, 4}, "MT-PRIORITY is not implemented")
+				return
+			}
+			mtPriority, err := strconv.Atoi(value)
+			if err != nil {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed MT-PRIORITY parameter value")
+				return
+			}
+			if mtPriority < -9 || mtPriority > 9 {
+				c.writeResponse(501, EnhancedCode{5, 5, 4}, "MT-PRIORITY is outside valid range")
+				return
+			}
+			opts.MTPriority = &mtPriority
 		default:
-			c.writeResponse(500, EnhancedCode{5, 5, 4}, "Unknown MAIL FROM argument")
-			return
+			ext := c.mailParamExtension(key)
+			if ext == nil && !c.server.EnableMAILExtensions && c.unofferedMailParam(key) {
+				c.writeResponse(504, EnhancedCode{5, 5, 4}, fmt.Sprintf("%v is not implemented", key))
+				return
+			}
+			if ext == nil && !c.server.EnableMAILExtensions {
+				c.writeResponse(500, EnhancedCode{5, 5, 4}, "Unknown MAIL FROM argument")
+				return
+			}
+			if ext != nil {
+				if err := ext.CheckMailParam(c, key, value); err != nil {
+					smtpErr := paramError(key, err)
+					c.writeResponse(smtpErr.Code, smtpErr.EnhancedCode, c.scrub(smtpErr.Message))
+					return
+				}
+			}
+			if opts.Extensions == nil {
+				opts.Extensions = make(map[string]string)
+			}
+			opts.Extensions[key] = value
 		}
 	}
 
-	if err := c.Session().Mail(from, opts); err != nil {
-		c.writeError(451, EnhancedCode{4, 0, 0}, err)
+	if err := c.checkSMTPUTF8(arg, opts.UTF8); err != nil {
+		c.writeResponse(err.Code, err.EnhancedCode, err.Message)
+		return
+	}
+
+	_, holdFor := args["HOLDFOR"]
+	_, holdUntil := args["HOLDUNTIL"]
+	if holdFor && holdUntil {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "HOLDFOR and HOLDUNTIL are mutually exclusive")
 		return
 	}
 
+	opts.SPF = c.checkSPF(from)
+
+	err = c.sessionMail(from, opts)
+	c.logResult("mail", "sender", err, slog.String("from", from))
+	if err != nil {
+		if !c.deferRejection(err) {
+			c.spf, c.spfFrom, c.spfHeader = "", "", ""
+			c.writeError(451, EnhancedCode{4, 0, 0}, err)
+			return
+		}
+		c.mailRejected = true
+	}
+	c.startTransactionTiming()
+
 	c.writeResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Roger, accepting mail from <%v>", from))
 	c.fromReceived = true
+	c.bounce = from == ""
+	c.smtputf8 = opts.UTF8
 }
 
-// This regexp matches 'hexchar' token defined in
-// https://tools.ietf.org/html/rfc4954#section-8 however it is intentionally
-// relaxed by requiring only '+' to be present.  It allows us to detect
-// malformed values such as +A or +HH and report them appropriately.
-var hexcharRe = regexp.MustCompile(`\+[0-9A-F]?[0-9A-F]?`)
-
-func decodeXtext(val string) (string, error) {
+// DecodeXtext decodes an xtext value, as defined in RFC 3461 section 4, e.g.
+// the ORCPT, ENVID and AUTH parameter values. Each hexchar, "+" followed by
+// two upper case hexadecimal digits, is decoded to the byte it encodes.
+func DecodeXtext(val string) (string, error) {
 	if !strings.Contains(val, "+") {
 		return val, nil
 	}
 
-	var replaceErr error
-	decoded := hexcharRe.ReplaceAllStringFunc(val, func(match string) string {
-		if len(match) != 3 {
-			replaceErr = errors.New("incomplete hexchar")
-			return ""
+	var sb strings.Builder
+	sb.Grow(len(val))
+	for i := 0; i < len(val); i++ {
+		ch := val[i]
+		if ch != '+' {
+			sb.WriteByte(ch)
+			continue
 		}
-		char, err := strconv.ParseInt(match, 16, 8)
-		if err != nil {
-			replaceErr = err
-			return ""
+		if i+2 >= len(val) || !isUpperHex(val[i+1]) || !isUpperHex(val[i+2]) {
+			return "", errors.New("incomplete hexchar")
 		}
-
-		return string(rune(char))
-	})
-	if replaceErr != nil {
-		return "", replaceErr
+		b, _ := strconv.ParseUint(val[i+1:i+3], 16, 8)
+		sb.WriteByte(byte(b))
+		i += 2
 	}
+	return sb.String(), nil
+}
 
-	return decoded, nil
+func isUpperHex(ch byte) bool {
+	return '0' <= ch && ch <= '9' || 'A' <= ch && ch <= 'F'
 }
 
 // This regexp matches 'EmbeddedUnicodeChar' token defined in
@@ -488,8 +886,11 @@ func decodeXtext(val string) (string, error) {
 // So it allows us to detect malformed values and report them appropriately.
 var eUOrDCharRe = regexp.MustCompile(`\\x[{][0-9A-F]+[}]|[[:cntrl:] \\+=]`)
 
-// Decodes the utf-8-addr-xtext or the utf-8-addr-unitext form.
-func decodeUTF8AddrXtext(val string) (string, error) {
+// DecodeUTF8AddrXtext decodes an address of the "utf-8" type, in the
+// utf-8-addr-xtext or the utf-8-addr-unitext form defined in RFC 6533
+// section 3, e.g. the ORCPT parameter value. Each EmbeddedUnicodeChar,
+// "\x{HEXPOINT}", is decoded to the character it encodes.
+func DecodeUTF8AddrXtext(val string) (string, error) {
 	var replaceErr error
 	decoded := eUOrDCharRe.ReplaceAllStringFunc(val, func(match string) string {
 		if len(match) == 1 {
@@ -580,12 +981,12 @@ func decodeTypedAddress(val string) (DSNAddressType, string, error) {
 	var err error
 	switch DSNAddressType(aType) {
 	case DSNAddressTypeRFC822:
-		aAddr, err = decodeXtext(aAddr)
+		aAddr, err = DecodeXtext(aAddr)
 		if err == nil && !isPrintableASCII(aAddr) {
 			err = errors.New("illegal address:" + aAddr)
 		}
 	case DSNAddressTypeUTF8:
-		aAddr, err = decodeUTF8AddrXtext(aAddr)
+		aAddr, err = DecodeUTF8AddrXtext(aAddr)
 	default:
 		err = errors.New("unknown address type:" + aType)
 	}
@@ -596,25 +997,32 @@ func decodeTypedAddress(val string) (DSNAddressType, string, error) {
 	return DSNAddressType(aType), aAddr, nil
 }
 
-func encodeXtext(raw string) string {
+// EncodeXtext encodes a value to xtext, as defined in RFC 3461 section 4.
+// Bytes other than printable US-ASCII characters, "+" and "=" are encoded as
+// hexchars. DecodeXtext reverses it.
+func EncodeXtext(raw string) string {
 	var out strings.Builder
 	out.Grow(len(raw))
 
-	for _, ch := range raw {
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
 		switch {
 		case ch >= '!' && ch <= '~' && ch != '+' && ch != '=':
 			// printable non-space US-ASCII except '+' and '='
-			out.WriteRune(ch)
+			out.WriteByte(ch)
 		default:
-			out.WriteRune('+')
-			out.WriteString(strings.ToUpper(strconv.FormatInt(int64(ch), 16)))
+			fmt.Fprintf(&out, "+%02X", ch)
 		}
 	}
 	return out.String()
 }
 
-// Encodes raw string to the utf-8-addr-xtext form in RFC 6533.
-func encodeUTF8AddrXtext(raw string) string {
+// EncodeUTF8AddrXtext encodes an address to the utf-8-addr-xtext form
+// defined in RFC 6533 section 3, e.g. for ORCPT parameters sent to servers
+// without SMTPUTF8, or message/delivery-status fields. Characters other than
+// printable US-ASCII characters, "+" and "=" are encoded as
+// EmbeddedUnicodeChar.
+func EncodeUTF8AddrXtext(raw string) string {
 	var out strings.Builder
 	out.Grow(len(raw))
 
@@ -634,8 +1042,11 @@ func encodeUTF8AddrXtext(raw string) string {
 	return out.String()
 }
 
-// Encodes raw string to the utf-8-addr-unitext form in RFC 6533.
-func encodeUTF8AddrUnitext(raw string) string {
+// EncodeUTF8AddrUnitext encodes an address to the utf-8-addr-unitext form
+// defined in RFC 6533 section 3, e.g. for ORCPT parameters sent to servers
+// with SMTPUTF8. Unlike EncodeUTF8AddrXtext, non-ASCII characters are left
+// as is.
+func EncodeUTF8AddrUnitext(raw string) string {
 	var out strings.Builder
 	out.Grow(len(raw))
 
@@ -679,118 +1090,355 @@ func (c *Conn) handleRcpt(arg string) {
 		return
 	}
 
+	if _, ok := c.baseSession().(BatchRcptSession); ok && !c.mailRejected {
+		c.handleRcptBatch(c.Session().(BatchRcptSession), arg)
+		return
+	}
+
+	recipient, opts, smtpErr := c.parseRcpt(arg, len(c.recipients))
+	if smtpErr != nil {
+		c.replyError(LimitFailedRecipients, func() {
+			c.writeError(0, EnhancedCode{}, smtpErr)
+		})
+		return
+	}
+
+	// The session doesn't have a transaction if MAIL has been rejected
+	if c.mailRejected {
+		c.acceptRcpt(recipient)
+		return
+	}
+
+	err := c.sessionRcpt(recipient, opts)
+	c.logResult("rcpt", "recipient", err, slog.String("rcpt", recipient))
+	if err != nil && !c.deferRejection(err) {
+		c.replyError(LimitFailedRecipients, func() {
+			c.writeError(451, EnhancedCode{4, 0, 0}, err)
+		})
+		return
+	}
+	c.acceptRcpt(recipient)
+}
+
+// handleRcptBatch handles a RCPT command, along with the following ones
+// already received in a pipelined burst, with a single backend call.
+func (c *Conn) handleRcptBatch(session BatchRcptSession, arg string) {
+	args := []string{arg}
+	var reserved int64
+	for c.canBatchRcpt() {
+		arg, n, ok := c.nextPipelinedRcpt()
+		if !ok {
+			break
+		}
+		args = append(args, arg)
+		reserved += n
+	}
+	// Pipelined lines are accounted for until the batch is handled
+	defer c.ReleaseMemory(reserved)
+
+	// Parsing errors are replied to in order with the backend results
+	var reqs []RcptRequest
+	parseErrs := make([]*SMTPError, len(args))
+	for i, arg := range args {
+		recipient, opts, smtpErr := c.parseRcpt(arg, len(c.recipients)+len(reqs))
+		if smtpErr != nil {
+			parseErrs[i] = smtpErr
+			continue
+		}
+		reqs = append(reqs, RcptRequest{To: recipient, Opts: opts})
+	}
+
+	var results []RcptResult
+	if len(reqs) > 0 {
+		results = session.RcptBatch(reqs)
+	}
+
+	j := 0
+	for i := range args {
+		if parseErrs[i] != nil {
+			smtpErr := parseErrs[i]
+			if !c.replyError(LimitFailedRecipients, func() {
+				c.writeError(0, EnhancedCode{}, smtpErr)
+			}) {
+				return
+			}
+			continue
+		}
+		req := reqs[j]
+		var err error
+		if j < len(results) {
+			err = results[j].Err
+		} else {
+			err = errors.New("Missing recipient status")
+		}
+		j++
+
+		c.logResult("rcpt", "recipient", err, slog.String("rcpt", req.To))
+		if err != nil && !c.deferRejection(err) {
+			if !c.replyError(LimitFailedRecipients, func() {
+				c.writeError(451, EnhancedCode{4, 0, 0}, err)
+			}) {
+				return
+			}
+			continue
+		}
+		c.acceptRcpt(req.To)
+	}
+}
+
+// canBatchRcpt reports whether pipelined RCPT commands can be batched. They
+// must go through the same checks as the other commands: batching stops when
+// a check applies to each command individually, such as middlewares, the rate
+// limiter and the tarpit, which delays the handling of the commands following
+// an error.
+func (c *Conn) canBatchRcpt() bool {
+	s := c.server
+	return s.handler == nil && s.RateLimiter == nil && s.Tarpit == nil &&
+		!s.commandDisabled("RCPT") && !c.tlsRequired()
+}
+
+// nextPipelinedRcpt consumes the next command if it's a RCPT command already
+// fully received, and returns its argument and the number of bytes of memory
+// reserved for it. Commands which the command loop would reject are left to
+// it.
+func (c *Conn) nextPipelinedRcpt() (arg string, reserved int64, ok bool) {
+	n := c.text.R.Buffered()
+	if n == 0 {
+		return "", 0, false
+	}
+	buf, _ := c.text.R.Peek(n)
+	i := bytes.IndexByte(buf, '\n')
+	if i < 0 {
+		return "", 0, false
+	}
+	peeked := string(buf[:i])
+	cmd, _, err := parseCmd(strings.TrimSuffix(peeked, "\r"))
+	if err != nil || !strings.EqualFold(cmd, "RCPT") {
+		return "", 0, false
+	}
+	if c.server.StrictSyntax && !strings.HasSuffix(peeked, "\r") {
+		// Left to the command loop, which rejects bare LF line endings
+		return "", 0, false
+	}
+	if c.server.EightBitCommands != EightBitAccept && has8Bit(peeked) {
+		// Left to the command loop, which applies Server.EightBitCommands
+		return "", 0, false
+	}
+	line := strings.TrimSuffix(peeked, "\r")
+	if c.ReserveMemory(int64(len(line))) != nil {
+		// Left to the command loop, which replies with the error
+		return "", 0, false
+	}
+
+	line, err = c.readLine()
+	if err == nil {
+		cmd, arg, err = parseCmd(line)
+	}
+	if err != nil {
+		c.ReleaseMemory(int64(len(line)))
+		return "", 0, false
+	}
+	c.commandStarted("RCPT", arg)
+	return arg, int64(len(line)), true
+}
+
+// parseRcpt parses the argument of a RCPT command. nrcpts is the number of
+// recipients already accepted.
+func (c *Conn) parseRcpt(arg string, nrcpts int) (recipient string, opts *RcptOptions, smtpErr *SMTPError) {
 	arg, ok := cutPrefixFold(arg, "TO:")
 	if !ok {
-		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
-		return
+		return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 2}, Message: "Was expecting RCPT arg syntax of TO:<address>"}
 	}
 
-	p := parser{s: strings.TrimSpace(arg)}
+	p := c.newParser(arg)
 	recipient, err := p.parsePath()
 	if err != nil {
-		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
-		return
+		if c.server.StrictSyntax {
+			return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 1, 3}, Message: fmt.Sprintf("Invalid recipient address syntax: %v", err)}
+		}
+		return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 2}, Message: "Was expecting RCPT arg syntax of TO:<address>"}
+	}
+	if err := c.checkSMTPUTF8(arg, c.smtputf8); err != nil {
+		return "", nil, err
+	}
+	if c.server.strictAddresses() && !validMailbox(recipient) &&
+		!c.monitored(c.server.Validation, "validation", 501, "Invalid recipient address") {
+		return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 1, 3}, Message: "Invalid recipient address"}
+	}
+	recipient, smtpErr = c.verifyBATV(recipient)
+	if smtpErr != nil {
+		return "", nil, smtpErr
 	}
 
-	if c.server.MaxRecipients > 0 && len(c.recipients) >= c.server.MaxRecipients {
-		c.writeResponse(452, EnhancedCode{4, 5, 3}, fmt.Sprintf("Maximum limit of %v recipients reached", c.server.MaxRecipients))
-		return
+	if max := c.server.maxRecipients(); max > 0 && nrcpts >= max {
+		return "", nil, &SMTPError{Code: 452, EnhancedCode: EnhancedCode{4, 5, 3}, Message: fmt.Sprintf("Maximum limit of %v recipients reached", max)}
 	}
 
-	args, err := parseArgs(p.s)
+	args, err := p.parseArgs()
 	if err != nil {
-		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse RCPT ESMTP parameters")
-		return
+		return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: c.scrub(fmt.Sprintf("Unable to parse RCPT ESMTP parameters: %v", err))}
 	}
 
-	opts := &RcptOptions{}
+	opts = &RcptOptions{}
 
 	for key, value := range args {
 		switch key {
+		case xrcptforwardParam:
+			if !c.xrcptforwardAllowed() {
+				return "", nil, &SMTPError{Code: 500, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Unknown RCPT TO argument"}
+			}
+			if err := c.checkXRCPTFORWARD(value); err != nil {
+				return "", nil, err
+			}
+			if opts.Extensions == nil {
+				opts.Extensions = make(map[string]string)
+			}
+			opts.Extensions[key] = value
 		case "NOTIFY":
 			if !c.server.EnableDSN {
-				c.writeResponse(504, EnhancedCode{5, 5, 4}, "NOTIFY is not implemented")
-				return
+				return "", nil, &SMTPError{Code: 504, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "NOTIFY is not implemented"}
 			}
 			notify := []DSNNotify{}
 			for _, val := range strings.Split(value, ",") {
 				notify = append(notify, DSNNotify(strings.ToUpper(val)))
 			}
 			if err := checkNotifySet(notify); err != nil {
-				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed NOTIFY parameter value")
-				return
+				return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Malformed NOTIFY parameter value"}
 			}
 			opts.Notify = notify
 		case "ORCPT":
 			if !c.server.EnableDSN {
-				c.writeResponse(504, EnhancedCode{5, 5, 4}, "ORCPT is not implemented")
-				return
+				return "", nil, &SMTPError{Code: 504, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "ORCPT is not implemented"}
 			}
 			aType, aAddr, err := decodeTypedAddress(value)
 			if err != nil || aAddr == "" {
-				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed ORCPT parameter value")
-				return
+				return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Malformed ORCPT parameter value"}
 			}
 			opts.OriginalRecipientType = aType
 			opts.OriginalRecipient = aAddr
 		case "RRVS":
 			if !c.server.EnableRRVS {
-				c.writeResponse(504, EnhancedCode{5, 5, 4}, "RRVS is not implemented")
-				return
+				return "", nil, &SMTPError{Code: 504, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "RRVS is not implemented"}
 			}
 			value, _, _ = strings.Cut(value, ";") // discard the no-support action
 			rrvsTime, err := time.Parse(time.RFC3339, value)
 			if err != nil {
-				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed RRVS parameter value")
-				return
+				return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Malformed RRVS parameter value"}
 			}
 			opts.RequireRecipientValidSince = rrvsTime
 		case "BY":
 			if !c.server.EnableDELIVERBY {
-				c.writeResponse(504, EnhancedCode{5, 5, 4}, "DELIVERBY is not implemented")
-				return
-			}
-			deliverBy := parseDeliverByArgument(value)
-			if deliverBy == nil {
-				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed BY parameter value")
-				return
+				return "", nil, &SMTPError{Code: 504, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "DELIVERBY is not implemented"}
 			}
-			if c.server.MinimumDeliverByTime != 0 &&
-				deliverBy.Mode == DeliverByReturn &&
-				deliverBy.Time < c.server.MinimumDeliverByTime {
-				c.writeResponse(501, EnhancedCode{5, 5, 4}, "BY parameter is below server minimum")
-				return
+			deliverBy, err := c.parseDeliverBy(value)
+			if err != nil {
+				return "", nil, err
 			}
 			opts.DeliverBy = deliverBy
 		case "MT-PRIORITY":
 			if !c.server.EnableMTPRIORITY {
-				c.writeResponse(504, EnhancedCode{5, 5, 4}, "MT-PRIORITY is not implemented")
-				return
+				return "", nil, &SMTPError{Code: 504, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "MT-PRIORITY is not implemented"}
 			}
 			mtPriority, err := strconv.Atoi(value)
 			if err != nil {
-				c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed MT-PRIORITY parameter value")
-				return
+				return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Malformed MT-PRIORITY parameter value"}
 			}
 			if mtPriority < -9 || mtPriority > 9 {
-				c.writeResponse(501, EnhancedCode{5, 5, 4}, "MT-PRIORITY is outside valid range")
-				return
+				return "", nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "MT-PRIORITY is outside valid range"}
 			}
 			opts.MTPriority = &mtPriority
 		default:
-			c.writeResponse(500, EnhancedCode{5, 5, 4}, "Unknown RCPT TO argument")
-			return
+			ext := c.rcptParamExtension(key)
+			if ext == nil && c.unofferedRcptParam(key) {
+				return "", nil, &SMTPError{Code: 504, EnhancedCode: EnhancedCode{5, 5, 4}, Message: fmt.Sprintf("%v is not implemented", key)}
+			}
+			if ext == nil {
+				return "", nil, &SMTPError{Code: 500, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Unknown RCPT TO argument"}
+			}
+			if err := ext.CheckRcptParam(c, key, value); err != nil {
+				smtpErr := paramError(key, err)
+				return "", nil, &SMTPError{Code: smtpErr.Code, EnhancedCode: smtpErr.EnhancedCode, Message: c.scrub(smtpErr.Message)}
+			}
+			if opts.Extensions == nil {
+				opts.Extensions = make(map[string]string)
+			}
+			opts.Extensions[key] = value
 		}
 	}
 
-	if err := c.Session().Rcpt(recipient, opts); err != nil {
-		c.writeError(451, EnhancedCode{4, 0, 0}, err)
+	return recipient, opts, nil
+}
+
+func (c *Conn) acceptRcpt(recipient string) {
+	c.recipients = append(c.recipients, recipient)
+	if _, ok := c.baseSession().(DeferredRcptSession); ok {
+		c.writeResponse(252, EnhancedCode{2, 1, 5}, fmt.Sprintf("Cannot verify <%v> yet, will attempt delivery", recipient))
 		return
 	}
-	c.recipients = append(c.recipients, recipient)
 	c.writeResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("I'll make sure <%v> gets this", recipient))
 }
 
+// validateRecipients performs deferred recipient validation, if the session
+// implements DeferredRcptSession. It returns an error if all recipients are
+// rejected.
+func (c *Conn) validateRecipients() error {
+	if _, ok := c.baseSession().(DeferredRcptSession); !ok {
+		return nil
+	}
+	session := c.Session().(DeferredRcptSession)
+
+	rcpts := make([]string, len(c.recipients))
+	copy(rcpts, c.recipients)
+	errs := session.ValidateRecipients(rcpts)
+
+	var valid []string
+	var firstErr *SMTPError
+	c.rcptErrors = make(map[string]*SMTPError)
+	for _, rcpt := range c.recipients {
+		if err := errs[rcpt]; err != nil {
+			c.rcptErrors[rcpt] = err
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			valid = append(valid, rcpt)
+		}
+	}
+	if len(valid) == 0 {
+		return firstErr
+	}
+	// LMTP sends one reply per recipient after the message, including
+	// rejected ones
+	if !c.server.LMTP {
+		c.recipients = valid
+	}
+	return nil
+}
+
+// rcptStatus returns the status to send for a recipient after an LMTP
+// message.
+func (c *Conn) rcptStatus(rcpt string, err error) error {
+	if rcptErr := c.rcptErrors[rcpt]; rcptErr != nil {
+		return rcptErr
+	}
+	return err
+}
+
+// parseDeliverBy parses a BY parameter value, and checks it against
+// Server.MinimumDeliverByTime.
+func (c *Conn) parseDeliverBy(value string) (*DeliverByOptions, *SMTPError) {
+	deliverBy := parseDeliverByArgument(value)
+	if deliverBy == nil {
+		return nil, &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Malformed BY parameter value"}
+	}
+	if c.server.MinimumDeliverByTime != 0 &&
+		deliverBy.Mode == DeliverByReturn &&
+		deliverBy.Time < c.server.MinimumDeliverByTime {
+		return nil, &SMTPError{Code: 455, EnhancedCode: EnhancedCode{4, 5, 4}, Message: "BY parameter is below server minimum"}
+	}
+	return deliverBy, nil
+}
+
 func checkNotifySet(values []DSNNotify) error {
 	if len(values) == 0 {
 		return errors.New("Malformed NOTIFY parameter value")
@@ -831,20 +1479,38 @@ func (c *Conn) handleAuth(arg string) {
 		return
 	}
 
-	if !c.authAllowed() {
+	mechanism := strings.ToUpper(parts[0])
+
+	if !c.authAllowed(mechanism) {
 		c.writeResponse(523, EnhancedCode{5, 7, 10}, "TLS is required")
 		return
 	}
 
-	mechanism := strings.ToUpper(parts[0])
+	// Decoded responses are accounted for until the exchange is over
+	var decoded int64
+	defer func() {
+		c.ReleaseMemory(decoded)
+	}()
+	decode := func(s string) ([]byte, bool) {
+		n := int64(base64.StdEncoding.DecodedLen(len(s)))
+		if err := c.ReserveMemory(n); err != nil {
+			c.writeError(0, EnhancedCode{}, err)
+			return nil, false
+		}
+		decoded += n
+		b, err := decodeSASLResponse(s)
+		if err != nil {
+			c.writeResponse(454, EnhancedCode{4, 7, 0}, "Invalid base64 data")
+			return nil, false
+		}
+		return b, true
+	}
 
 	// Parse client initial response if there is one
 	var ir []byte
 	if len(parts) > 1 {
-		var err error
-		ir, err = decodeSASLResponse(parts[1])
-		if err != nil {
-			c.writeResponse(454, EnhancedCode{4, 7, 0}, "Invalid base64 data")
+		var ok bool
+		if ir, ok = decode(parts[1]); !ok {
 			return
 		}
 	}
@@ -859,6 +1525,10 @@ func (c *Conn) handleAuth(arg string) {
 	for {
 		challenge, done, err := sasl.Next(response)
 		if err != nil {
+			c.logResult("auth", "authentication", err, slog.String(logKeyMechanism, mechanism))
+			if c.server.Metrics != nil {
+				c.server.Metrics.AuthFailed(mechanism)
+			}
 			c.writeError(454, EnhancedCode{4, 7, 0}, err)
 			return
 		}
@@ -884,13 +1554,13 @@ func (c *Conn) handleAuth(arg string) {
 			return
 		}
 
-		response, err = decodeSASLResponse(encoded)
-		if err != nil {
-			c.writeResponse(454, EnhancedCode{4, 7, 0}, "Invalid base64 data")
+		var ok bool
+		if response, ok = decode(encoded); !ok {
 			return
 		}
 	}
 
+	c.logResult("auth", "authentication", nil, slog.String(logKeyMechanism, mechanism))
 	c.writeResponse(235, EnhancedCode{2, 0, 0}, "Authentication succeeded")
 	c.didAuth = true
 }
@@ -902,16 +1572,26 @@ func decodeSASLResponse(s string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(s)
 }
 
+// authMechanisms returns the mechanisms registered with Server.EnableAuth,
+// followed by the ones provided by the session.
 func (c *Conn) authMechanisms() []string {
-	if authSession, ok := c.Session().(AuthSession); ok {
-		return authSession.AuthMechanisms()
+	mechs := append([]string(nil), c.server.authMechs...)
+	if _, ok := c.baseSession().(AuthSession); ok {
+		for _, name := range c.Session().(AuthSession).AuthMechanisms() {
+			if _, ok := c.server.auths[strings.ToUpper(name)]; !ok {
+				mechs = append(mechs, name)
+			}
+		}
 	}
-	return nil
+	return mechs
 }
 
 func (c *Conn) auth(mech string) (sasl.Server, error) {
-	if authSession, ok := c.Session().(AuthSession); ok {
-		return authSession.Auth(mech)
+	if f, ok := c.server.auths[mech]; ok {
+		return f(c), nil
+	}
+	if _, ok := c.baseSession().(AuthSession); ok {
+		return c.Session().(AuthSession).Auth(mech)
 	}
 	return nil, ErrAuthUnknownMechanism
 }
@@ -922,23 +1602,37 @@ func (c *Conn) handleStartTLS() {
 		return
 	}
 
-	if c.server.TLSConfig == nil {
+	if !c.startTLSAllowed() {
 		c.writeResponse(502, EnhancedCode{5, 5, 1}, "TLS not supported")
 		return
 	}
 
 	c.writeResponse(220, EnhancedCode{2, 0, 0}, "Ready to start TLS")
 
-	// Upgrade to TLS
-	tlsConn := tls.Server(c.conn, c.server.TLSConfig)
+	// Upgrade to TLS. Out-of-band responses are held until the handshake is
+	// over, since they'd corrupt it.
+	c.writeLocker.Lock()
+	tlsConn := tls.Server(c.conn, c.startTLSConfig())
+	err := c.handshake(tlsConn)
+	if c.server.Metrics != nil {
+		c.server.Metrics.TLSHandshake(err)
+	}
+	if err == nil {
+		c.locker.Lock()
+		c.conn = tlsConn
+		c.locker.Unlock()
+		c.init()
+	}
+	c.writeLocker.Unlock()
 
-	if err := tlsConn.Handshake(); err != nil {
+	if err != nil {
 		c.writeResponse(550, EnhancedCode{5, 0, 0}, "Handshake error")
 		return
 	}
-
-	c.conn = tlsConn
-	c.init()
+	if err := c.checkTLSHandshake(); err != nil {
+		c.writeTLSRejection(454, EnhancedCode{4, 7, 0}, err)
+		return
+	}
 
 	// Reset all state and close the previous Session.
 	// This is different from just calling reset() since we want the Backend to
@@ -973,21 +1667,54 @@ func (c *Conn) handleData(arg string) {
 		return
 	}
 
+	if verdict := c.verdict(); verdict != nil {
+		c.handleDataVerdict(verdict)
+		return
+	}
+
+	if err := c.validateRecipients(); err != nil {
+		c.writeError(554, EnhancedCode{5, 5, 1}, err)
+		c.reset()
+		return
+	}
+
 	// We have recipients, go to accept data
 	c.writeResponse(354, NoEnhancedCode, "Go ahead. End your data with <CR><LF>.<CR><LF>")
+	c.startDataTiming()
+	c.setDataDeadline()
 
 	defer c.reset()
 
+	c.setReadingData(true)
+	defer c.closeIfAborted()
+
 	if c.server.LMTP {
 		c.handleDataLMTP()
 		return
 	}
 
 	r := newDataReader(c)
-	code, enhancedCode, msg := dataErrorToStatus(c.Session().Data(r))
-	r.limited = false
-	io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
-	c.writeResponse(code, enhancedCode, msg)
+	r.rejectBareLineEndings = c.server.rejectBareLineEndings()
+	err := c.sessionData(r)
+	r.drain() // Make sure all the data has been consumed
+	c.setReadingData(false)
+	if c.dataAborted() {
+		err = ErrServerShutdown
+	} else if c.dataTimedOut() {
+		err = ErrDataTimeout
+	}
+	c.logResult("data", "message", err, c.timingAttrs()...)
+	c.messageResult(err)
+	c.writeResponse(c.dataErrorToStatus(err))
+}
+
+// discardChunk reads and discards a chunk of size bytes sent with a BDAT
+// command which is rejected.
+func (c *Conn) discardChunk(size uint64) {
+	c.lineLimitReader.LineLimit = 0
+	c.setDataDeadline()
+	io.Copy(ioutil.Discard, io.LimitReader(c.text.R, int64(size)))
+	c.lineLimitReader.LineLimit = c.server.MaxLineLength
 }
 
 func (c *Conn) handleBdat(arg string) {
@@ -996,47 +1723,79 @@ func (c *Conn) handleBdat(arg string) {
 		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Missing chunk size argument")
 		return
 	}
-	if len(args) > 2 {
-		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Too many arguments")
+
+	// ParseUint instead of Atoi so we will not accept negative values.
+	size, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed size argument")
 		return
 	}
 
-	if !c.fromReceived || len(c.recipients) == 0 {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "Missing RCPT TO command.")
+	// From now on, the chunk must be consumed before replying to a rejected
+	// command, otherwise it would be interpreted as commands.
+	reject := func(code int, enhCode EnhancedCode, text string) {
+		c.discardChunk(size)
+		c.writeResponse(code, enhCode, text)
+	}
+
+	// CHUNKING is only advertised in EHLO and LHLO replies
+	if !c.esmtp {
+		reject(502, EnhancedCode{5, 5, 1}, "BDAT command not implemented, use EHLO")
+		return
+	}
+
+	if len(args) > 2 {
+		reject(501, EnhancedCode{5, 5, 4}, "Too many arguments")
 		return
 	}
 
 	last := false
 	if len(args) == 2 {
 		if !strings.EqualFold(args[1], "LAST") {
-			c.writeResponse(501, EnhancedCode{5, 5, 4}, "Unknown BDAT argument")
+			reject(501, EnhancedCode{5, 5, 4}, "Unknown BDAT argument")
 			return
 		}
 		last = true
 	}
 
-	// ParseUint instead of Atoi so we will not accept negative values.
-	size, err := strconv.ParseUint(args[0], 10, 32)
-	if err != nil {
-		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed size argument")
+	if !c.fromReceived || len(c.recipients) == 0 {
+		reject(502, EnhancedCode{5, 5, 1}, "Missing RCPT TO command.")
 		return
 	}
 
-	if c.server.MaxMessageBytes != 0 && c.bytesReceived+int64(size) > c.server.MaxMessageBytes {
+	if max := c.server.maxMessageBytes(); max != 0 && c.bytesReceived+int64(size) > max {
 		c.writeResponse(552, EnhancedCode{5, 3, 4}, "Max message size exceeded")
 
 		// Discard chunk itself without passing it to backend.
-		io.Copy(ioutil.Discard, io.LimitReader(c.text.R, int64(size)))
+		c.discardChunk(size)
 
 		c.reset()
 		return
 	}
 
+	if verdict := c.verdict(); verdict != nil {
+		c.handleBdatVerdict(verdict, size, last)
+		return
+	}
+
+	if c.bdatPipe == nil {
+		if err := c.validateRecipients(); err != nil {
+			// Discard chunk itself without passing it to backend.
+			c.discardChunk(size)
+
+			c.writeError(554, EnhancedCode{5, 5, 1}, err)
+			c.reset()
+			return
+		}
+	}
+
 	if c.bdatStatus == nil && c.server.LMTP {
 		c.bdatStatus = c.createStatusCollector()
 	}
 
 	if c.bdatPipe == nil {
+		c.startDataTiming()
+
 		var r *io.PipeReader
 		r, c.bdatPipe = io.Pipe()
 
@@ -1054,16 +1813,15 @@ func (c *Conn) handleBdat(arg string) {
 
 			var err error
 			if !c.server.LMTP {
-				err = c.Session().Data(r)
+				err = c.sessionData(r)
 			} else {
-				lmtpSession, ok := c.Session().(LMTPSession)
-				if !ok {
-					err = c.Session().Data(r)
+				if _, ok := c.baseSession().(LMTPSession); !ok {
+					err = c.sessionData(r)
 					for _, rcpt := range c.recipients {
 						c.bdatStatus.SetStatus(rcpt, err)
 					}
 				} else {
-					err = lmtpSession.LMTPData(r, c.bdatStatus)
+					err = c.Session().(LMTPSession).LMTPData(c.withReceivedSPF(c.newDataMemoryReader(r)), c.bdatStatus)
 				}
 			}
 
@@ -1074,14 +1832,28 @@ func (c *Conn) handleBdat(arg string) {
 
 	c.lineLimitReader.LineLimit = 0
 
-	chunk := io.LimitReader(c.text.R, int64(size))
+	c.setReadingData(true)
+	defer c.closeIfAborted()
+
+	c.setDataDeadline()
+	chunk := &timeoutReader{c: c, r: io.LimitReader(c.text.R, int64(size))}
 	_, err = io.Copy(c.bdatPipe, chunk)
 	if err != nil {
 		// Backend might return an error early using CloseWithError without consuming
 		// the whole chunk.
 		io.Copy(ioutil.Discard, chunk)
+		c.setReadingData(false)
+
+		if c.dataAborted() {
+			err = ErrServerShutdown
+			c.bdatPipe.CloseWithError(err)
+		} else if c.dataTimedOut() {
+			err = ErrDataTimeout
+			c.bdatPipe.CloseWithError(err)
+		}
 
-		c.writeResponse(dataErrorToStatus(err))
+		c.messageResult(err)
+		c.writeResponse(c.dataErrorToStatus(err))
 
 		if err == errPanic {
 			c.Close()
@@ -1092,11 +1864,13 @@ func (c *Conn) handleBdat(arg string) {
 		return
 	}
 
+	c.setReadingData(false)
 	c.bytesReceived += int64(size)
 
 	if last {
 		c.lineLimitReader.LineLimit = c.server.MaxLineLength
 
+		c.endDataTiming(c.bytesReceived)
 		c.bdatPipe.Close()
 
 		err := <-c.dataResult
@@ -1104,11 +1878,15 @@ func (c *Conn) handleBdat(arg string) {
 		if c.server.LMTP {
 			c.bdatStatus.fillRemaining(err)
 			for i, rcpt := range c.recipients {
-				code, enchCode, msg := dataErrorToStatus(<-c.bdatStatus.status[i])
+				err := c.rcptStatus(rcpt, <-c.bdatStatus.status[i])
+				c.messageResult(err)
+				code, enchCode, msg := c.dataErrorToStatus(err)
 				c.writeResponse(code, enchCode, "<"+rcpt+"> "+msg)
 			}
 		} else {
-			c.writeResponse(dataErrorToStatus(err))
+			c.logResult("data", "message", err, c.timingAttrs()...)
+			c.messageResult(err)
+			c.writeResponse(c.dataErrorToStatus(err))
 		}
 
 		if err == errPanic {
@@ -1137,8 +1915,23 @@ func (c *Conn) handlePanic(err interface{}, status *statusCollector) {
 		status.fillRemaining(errPanic)
 	}
 
+	c.logPanic(err)
+}
+
+func (c *Conn) logPanic(err interface{}) {
 	stack := debug.Stack()
-	c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.conn.RemoteAddr(), err, stack)
+	c.log(slog.LevelError, "panic", "panic serving connection", slog.Any(smtplog.ErrorKey, err), slog.String("stack", string(stack)))
+	if c.history != nil {
+		c.server.ErrorLog.Printf("panic serving %v: %v\nhistory:\n%v%s", c.remoteAddr(), err, c.history, stack)
+	} else {
+		c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.remoteAddr(), err, stack)
+	}
+}
+
+// History returns the last commands and responses of the connection, oldest
+// first. It returns nil if Server.CommandHistory is zero.
+func (c *Conn) History() []HistoryEntry {
+	return c.history.list()
 }
 
 func (c *Conn) createStatusCollector() *statusCollector {
@@ -1207,20 +2000,21 @@ func (s *statusCollector) SetStatus(rcptTo string, err error) {
 
 func (c *Conn) handleDataLMTP() {
 	r := newDataReader(c)
+	r.rejectBareLineEndings = c.server.rejectBareLineEndings()
 	status := c.createStatusCollector()
 
 	done := make(chan bool, 1)
 
-	lmtpSession, ok := c.Session().(LMTPSession)
-	if !ok {
+	if _, ok := c.baseSession().(LMTPSession); !ok {
 		// Fallback to using a single status for all recipients.
-		err := c.Session().Data(r)
-		io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
+		err := c.sessionData(r)
+		r.drain() // Make sure all the data has been consumed
 		for _, rcpt := range c.recipients {
 			status.SetStatus(rcpt, err)
 		}
 		done <- true
 	} else {
+		lmtpSession := c.Session().(LMTPSession)
 		go func() {
 			defer func() {
 				if err := recover(); err != nil {
@@ -1230,20 +2024,28 @@ func (c *Conn) handleDataLMTP() {
 						Message:      "Internal server error",
 					})
 
-					stack := debug.Stack()
-					c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.conn.RemoteAddr(), err, stack)
+					c.logPanic(err)
 					done <- false
 				}
 			}()
 
-			status.fillRemaining(lmtpSession.LMTPData(r, status))
-			io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
+			status.fillRemaining(lmtpSession.LMTPData(c.withReceivedSPF(c.newDataMemoryReader(r)), status))
+			r.drain() // Make sure all the data has been consumed
 			done <- true
 		}()
 	}
 
 	for i, rcpt := range c.recipients {
-		code, enchCode, msg := dataErrorToStatus(<-status.status[i])
+		err := <-status.status[i]
+		if i == 0 {
+			c.setReadingData(false)
+		}
+		if c.dataAborted() {
+			err = ErrServerShutdown
+		}
+		err = c.rcptStatus(rcpt, err)
+		c.messageResult(err)
+		code, enchCode, msg := c.dataErrorToStatus(err)
 		c.writeResponse(code, enchCode, "<"+rcpt+"> "+msg)
 	}
 
@@ -1254,12 +2056,15 @@ func (c *Conn) handleDataLMTP() {
 	}
 }
 
-func dataErrorToStatus(err error) (code int, enchCode EnhancedCode, msg string) {
+func (c *Conn) dataErrorToStatus(err error) (code int, enchCode EnhancedCode, msg string) {
 	if err != nil {
-		if smtperr, ok := err.(*SMTPError); ok {
-			return smtperr.Code, smtperr.EnhancedCode, smtperr.Message
+		var smtpErr *SMTPError
+		if errors.As(err, &smtpErr) {
+			return smtpErr.Code, smtpErr.EnhancedCode, c.scrub(smtpErr.Message)
+		} else if c.server.ExposeErrors {
+			return 554, EnhancedCode{5, 0, 0}, "Error: transaction failed: " + c.scrub(err.Error())
 		} else {
-			return 554, EnhancedCode{5, 0, 0}, "Error: transaction failed: " + err.Error()
+			return 451, EnhancedCode{4, 3, 0}, hiddenErrorMessage(451)
 		}
 	}
 
@@ -1267,67 +2072,291 @@ func dataErrorToStatus(err error) (code int, enchCode EnhancedCode, msg string)
 }
 
 func (c *Conn) Reject() {
-	c.writeResponse(421, EnhancedCode{4, 4, 5}, "Too busy. Try again later.")
+	c.Kick(421, EnhancedCode{4, 4, 5}, "Too busy. Try again later.")
+}
+
+// Kick sends a final response to the client and closes the connection.
+//
+// Kick is safe to call from any goroutine, including while the connection is
+// waiting for the next command. It is intended for out-of-band responses such
+// as "421 4.3.0 Server shutting down". If a response is being written, Kick
+// waits for it to be complete.
+func (c *Conn) Kick(code int, enhCode EnhancedCode, text ...string) {
+	c.writeResponse(code, enhCode, text...)
 	c.Close()
 }
 
+func (c *Conn) sessionMail(from string, opts *MailOptions) error {
+	if _, ok := c.baseSession().(ContextSession); ok {
+		s := c.Session().(ContextSession)
+		return c.watchPeer(func(ctx context.Context) error {
+			return s.MailContext(ctx, from, opts)
+		})
+	}
+	return c.Session().Mail(from, opts)
+}
+
+func (c *Conn) sessionRcpt(to string, opts *RcptOptions) error {
+	if _, ok := c.baseSession().(ContextSession); ok {
+		s := c.Session().(ContextSession)
+		return c.watchPeer(func(ctx context.Context) error {
+			return s.RcptContext(ctx, to, opts)
+		})
+	}
+	return c.Session().Rcpt(to, opts)
+}
+
+func (c *Conn) sessionData(r io.Reader) error {
+	mr := c.newDataMemoryReader(r)
+	err := c.passData(mr)
+	if mr.err != nil {
+		// The message may have been truncated
+		return mr.err
+	}
+	return err
+}
+
+// passData passes the message read from r to the session.
+func (c *Conn) passData(r io.Reader) error {
+	c.dmarc = nil
+	var results func() []DKIMResult
+	if c.server.DKIMVerifier != nil {
+		if _, ok := c.baseSession().(DKIMSession); ok {
+			s := c.Session().(DKIMSession)
+			r, results = c.verifyDKIM(r)
+			if c.server.DMARCEvaluator != nil {
+				r = c.evaluateDMARC(r, results)
+			}
+			return s.DataDKIM(c.ctx, c.withReceivedSPF(r), results)
+		}
+		if c.server.DKIMPolicy != nil || c.server.DMARCEvaluator != nil {
+			r, results = c.verifyDKIM(r)
+		}
+	}
+	if c.server.DMARCEvaluator != nil {
+		r = c.evaluateDMARC(r, results)
+	}
+	r = c.withReceivedSPF(r)
+	if _, ok := c.baseSession().(ContextSession); ok {
+		return c.Session().(ContextSession).DataContext(c.ctx, r)
+	}
+	return c.Session().Data(r)
+}
+
+// watchPeer calls f with a context which is cancelled if the client
+// disconnects while f is running. The connection must not be read from
+// concurrently.
+func (c *Conn) watchPeer(f func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Pipelined commands are left in the buffer
+		_, err := c.text.R.Peek(1)
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			cancel()
+		}
+	}()
+
+	err := f(ctx)
+
+	// Unblock the pending read, the next command resets the deadline
+	c.conn.SetReadDeadline(time.Now())
+	<-done
+	c.conn.SetReadDeadline(time.Time{})
+	return err
+}
+
+func (c *Conn) setReadingData(reading bool) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.readingData = reading
+}
+
+// abortData interrupts the message being received, if any. The Reader passed
+// to Session.Data returns ErrServerShutdown, the client is sent this error
+// and the connection is closed. It reports whether a message was being
+// received.
+func (c *Conn) abortData() bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if !c.readingData {
+		return false
+	}
+	c.aborted = true
+	// Unblock the pending read
+	c.conn.SetReadDeadline(time.Now())
+	return true
+}
+
+// awaitCommand prepares to read the next command, within timeout if not
+// zero. It returns false if the server is shutting down and no BDAT
+// transaction is in flight, in which case the connection must be closed.
+func (c *Conn) awaitCommand(timeout time.Duration) bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if c.server.shuttingDown() && c.bdatPipe == nil {
+		return false
+	}
+	if timeout != 0 {
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	c.awaitingCommand = true
+	return true
+}
+
+func (c *Conn) commandReceived() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.awaitingCommand = false
+}
+
+// interruptIdle interrupts the wait for the next command, unless a BDAT
+// transaction is in flight, so that the connection is closed by
+// awaitCommand.
+func (c *Conn) interruptIdle() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if c.awaitingCommand && c.bdatPipe == nil {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (c *Conn) dataAborted() bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.aborted
+}
+
+// setDataTimedOut records that the client didn't send the message within
+// Server.DataTimeout. The connection is closed once the reply is sent.
+func (c *Conn) setDataTimedOut() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.timedOut = true
+}
+
+func (c *Conn) dataTimedOut() bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.timedOut
+}
+
+func (c *Conn) closeIfAborted() {
+	if c.dataAborted() || c.dataTimedOut() {
+		c.Close()
+	}
+}
+
 func (c *Conn) greet() {
 	protocol := "ESMTP"
 	if c.server.LMTP {
 		protocol = "LMTP"
 	}
 	c.writeResponse(220, NoEnhancedCode, fmt.Sprintf("%v %s Service Ready", c.server.Domain, protocol))
+	c.fingerprintGreeted()
+}
+
+// WriteResponse sends a response to the client. It is safe to call from any
+// goroutine. See WriteResponse for the formatting rules.
+func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
+	c.writeResponse(code, enhCode, text...)
 }
 
 func (c *Conn) writeResponse(code int, enhCode EnhancedCode, text ...string) {
+	c.writeLocker.Lock()
+	defer c.writeLocker.Unlock()
+
 	// TODO: error handling
 	if c.server.WriteTimeout != 0 {
 		c.conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
 	}
 
-	// All responses must include an enhanced code, if it is missing - use
-	// a generic code X.0.0.
-	if enhCode == EnhancedCodeNotSet {
-		cat := code / 100
-		switch cat {
-		case 2, 4, 5:
-			enhCode = EnhancedCode{cat, 0, 0}
-		default:
-			enhCode = NoEnhancedCode
-		}
+	resp := formatResponse(code, enhCode, text)
+	c.history.add(true, strings.ReplaceAll(strings.TrimSuffix(string(resp), "\r\n"), "\r\n", "\n"))
+	if c.logEnabled(slog.LevelDebug) {
+		c.log(slog.LevelDebug, "response", "response sent", slog.Int(logKeyCode, code))
 	}
+	c.text.W.Write(resp)
+	c.text.W.Flush()
+}
 
-	// transform each single line with \n, into separate lines
-	text = strings.Split(strings.Join(text, "\n"), "\n")
-
-	lastLineIndex := len(text) - 1
-	for i := 0; i < lastLineIndex; i++ {
-		c.text.PrintfLine("%d-%v", code, text[i])
-	}
-	if enhCode == NoEnhancedCode {
-		c.text.PrintfLine("%d %v", code, text[lastLineIndex])
+// writeError sends an error to the client. Errors which aren't an *SMTPError
+// are sent with code and enhCode, and their text is only sent if
+// Server.ExposeErrors is set.
+func (c *Conn) writeError(code int, enhCode EnhancedCode, err error) {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		c.writeResponse(smtpErr.Code, smtpErr.EnhancedCode, c.scrub(smtpErr.Message))
+	} else if c.server.ExposeErrors {
+		c.writeResponse(code, enhCode, c.scrub(err.Error()))
 	} else {
-		c.text.PrintfLine("%d %v.%v.%v %v", code, enhCode[0], enhCode[1], enhCode[2], text[lastLineIndex])
+		c.writeResponse(code, enhCode, hiddenErrorMessage(code))
 	}
 }
 
-func (c *Conn) writeError(code int, enhCode EnhancedCode, err error) {
-	if smtpErr, ok := err.(*SMTPError); ok {
-		c.writeResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
-	} else {
-		c.writeResponse(code, enhCode, err.Error())
+// hiddenErrorMessage returns the message sent instead of the text of an
+// error not meant for clients.
+func hiddenErrorMessage(code int) string {
+	if code == 454 {
+		return "Temporary authentication failure"
+	}
+	return "Requested action aborted: local error in processing"
+}
+
+// handshake runs a TLS handshake within Server.TLSHandshakeTimeout.
+func (c *Conn) handshake(tlsConn *tls.Conn) error {
+	if d := c.server.timeout(c.server.TLSHandshakeTimeout); d != 0 {
+		tlsConn.SetDeadline(time.Now().Add(d))
+	} else if d := c.server.WriteTimeout; d != 0 {
+		tlsConn.SetWriteDeadline(time.Now().Add(d))
+	}
+	err := tlsConn.Handshake()
+	// Further reads and writes set their own deadline
+	tlsConn.SetDeadline(time.Time{})
+	return err
+}
+
+// setDataDeadline sets the deadline for receiving the content of a message,
+// or a BDAT chunk, see Server.DataTimeout.
+func (c *Conn) setDataDeadline() {
+	if d := c.server.timeout(c.server.DataTimeout); d != 0 {
+		c.conn.SetReadDeadline(time.Now().Add(d))
 	}
 }
 
 // Reads a line of input
 func (c *Conn) readLine() (string, error) {
-	if c.server.ReadTimeout != 0 {
-		if err := c.conn.SetReadDeadline(time.Now().Add(c.server.ReadTimeout)); err != nil {
-			return "", err
+	line, _, err := c.readLineEnding(c.server.timeout(c.server.CommandTimeout))
+	return line, err
+}
+
+// readLineEnding is like readLine, but also reports whether the line ends
+// with a bare LF. The line must be received within timeout, unless it's
+// zero.
+func (c *Conn) readLineEnding(timeout time.Duration) (line string, bareLF bool, err error) {
+	if timeout != 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return "", false, err
 		}
 	}
 
-	return c.text.ReadLine()
+	return readLimitedLineEnding(c.text.R, c.server.MaxLineLength)
+}
+
+// newParser returns a parser for the path argument of MAIL or RCPT, after
+// the colon.
+func (c *Conn) newParser(arg string) *parser {
+	if c.server.StrictSyntax {
+		// No space is allowed before the path
+		return &parser{s: strings.TrimRight(arg, " "), strict: true}
+	}
+	return &parser{s: strings.TrimSpace(arg)}
 }
 
 func (c *Conn) reset() {
@@ -1346,5 +2375,14 @@ func (c *Conn) reset() {
 	}
 
 	c.fromReceived = false
+	c.bounce = false
+	c.smtputf8 = false
+	c.xforward = nil
 	c.recipients = nil
+	c.rcptErrors = nil
+	c.verdicts = nil
+	c.mailRejected = false
+	c.spf, c.spfFrom, c.spfHeader = "", "", ""
+	c.dmarc = nil
+	c.releaseMessageMemory()
 }
@@ -0,0 +1,99 @@
+package smtp
+
+import (
+	"net"
+)
+
+// connLimitKey returns the key used to count connections from addr against
+// Server.MaxConnectionsPerIP.
+func (s *Server) connLimitKey(addr net.Addr) string {
+	if s.ConnectionLimitKey != nil {
+		return s.ConnectionLimitKey(addr)
+	}
+	if ip := addrIP(addr); ip != nil {
+		return NormalizeIP(ip).String()
+	}
+	return ""
+}
+
+// acquireConnLimit counts c against the connection limits. It returns false
+// if a limit is reached.
+func (s *Server) acquireConnLimit(c *Conn) bool {
+	if s.MaxConnections <= 0 && s.MaxConnectionsPerIP <= 0 {
+		return true
+	}
+	key := s.connLimitKey(c.ClientAddr())
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.MaxConnections > 0 && s.limitedConns >= s.MaxConnections {
+		return false
+	}
+	if s.MaxConnectionsPerIP > 0 && key != "" && s.connsPerKey[key] >= s.MaxConnectionsPerIP {
+		return false
+	}
+	s.limitedConns++
+	if key != "" {
+		if s.connsPerKey == nil {
+			s.connsPerKey = make(map[string]int)
+		}
+		s.connsPerKey[key]++
+	}
+	c.connLimited = true
+	c.connKey = key
+	return true
+}
+
+// releaseConnLimit stops counting c against the connection limits.
+func (s *Server) releaseConnLimit(c *Conn) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if !c.connLimited {
+		return
+	}
+	c.connLimited = false
+	s.limitedConns--
+	if c.connKey != "" {
+		if s.connsPerKey[c.connKey]--; s.connsPerKey[c.connKey] <= 0 {
+			delete(s.connsPerKey, c.connKey)
+		}
+	}
+}
+
+// rekeyConnLimit counts c against the connection limits with its current
+// client address, e.g. after XCLIENT. It returns false if a limit is reached,
+// in which case c is no longer counted.
+func (s *Server) rekeyConnLimit(c *Conn) bool {
+	if !c.connLimited {
+		return true
+	}
+	key := s.connLimitKey(c.ClientAddr())
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if key == c.connKey {
+		return true
+	}
+	if c.connKey != "" {
+		if s.connsPerKey[c.connKey]--; s.connsPerKey[c.connKey] <= 0 {
+			delete(s.connsPerKey, c.connKey)
+		}
+	}
+	c.connKey = ""
+	if s.MaxConnectionsPerIP > 0 && key != "" && s.connsPerKey[key] >= s.MaxConnectionsPerIP {
+		c.connLimited = false
+		s.limitedConns--
+		return false
+	}
+	if key != "" {
+		if s.connsPerKey == nil {
+			s.connsPerKey = make(map[string]int)
+		}
+		s.connsPerKey[key]++
+	}
+	c.connKey = key
+	return true
+}
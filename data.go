@@ -2,10 +2,15 @@ package smtp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 )
 
+// EnhancedCode is an enhanced status code, as defined in RFC 3463. It holds
+// the class, subject and detail sub-codes.
 type EnhancedCode [3]int
 
 // SMTPError specifies the error code, enhanced error code (if any) and
@@ -14,6 +19,9 @@ type SMTPError struct {
 	Code         int
 	EnhancedCode EnhancedCode
 	Message      string
+
+	// Err is the underlying error, if any. It isn't sent to clients.
+	Err error
 }
 
 // NoEnhancedCode is used to indicate that enhanced error code should not be
@@ -34,35 +42,101 @@ func (err *SMTPError) Error() string {
 	if err.Message != "" {
 		s += ": " + err.Message
 	}
+	if err.Err != nil {
+		s += ": " + err.Err.Error()
+	}
 	return s
 }
 
+// Unwrap returns the underlying error.
+func (err *SMTPError) Unwrap() error {
+	return err.Err
+}
+
 func (err *SMTPError) Temporary() bool {
 	return err.Code/100 == 4
 }
 
+// TempError wraps err into a transient error with a 451 code, the enhanced
+// code class.subject.detail and message. Only the code, enhanced code and
+// message are sent to the client.
+func TempError(err error, class, subject, detail int, message string) *SMTPError {
+	return &SMTPError{
+		Code:         451,
+		EnhancedCode: EnhancedCode{class, subject, detail},
+		Message:      message,
+		Err:          err,
+	}
+}
+
+// PermError wraps err into a permanent error with a 550 code, the enhanced
+// code class.subject.detail and message. Only the code, enhanced code and
+// message are sent to the client.
+func PermError(err error, class, subject, detail int, message string) *SMTPError {
+	return &SMTPError{
+		Code:         550,
+		EnhancedCode: EnhancedCode{class, subject, detail},
+		Message:      message,
+		Err:          err,
+	}
+}
+
 var ErrDataTooLarge = &SMTPError{
 	Code:         552,
 	EnhancedCode: EnhancedCode{5, 3, 4},
 	Message:      "Maximum message size exceeded",
 }
 
+// ErrServerShutdown is returned by the Reader passed to Session.Data when the
+// server is shut down while a message is being received. The client is sent
+// this error.
+var ErrServerShutdown = &SMTPError{
+	Code:         451,
+	EnhancedCode: EnhancedCode{4, 3, 0},
+	Message:      "Server shutting down",
+}
+
+// errShuttingDown is sent to clients waiting for a command when the server
+// is shut down.
+var errShuttingDown = &SMTPError{
+	Code:         421,
+	EnhancedCode: EnhancedCode{4, 3, 2},
+	Message:      "Server shutting down",
+}
+
+// ErrDataTimeout is returned by the Reader passed to Session.Data when the
+// client doesn't send the message within Server.DataTimeout. The client is
+// sent this error and the connection is closed.
+var ErrDataTimeout = &SMTPError{
+	Code:         421,
+	EnhancedCode: EnhancedCode{4, 4, 2},
+	Message:      "Timeout exceeded while receiving the message",
+}
+
 type dataReader struct {
+	c     *Conn
 	r     *bufio.Reader
 	state int
 
 	limited bool
 	n       int64 // Maximum bytes remaining
+
+	rejectBareLineEndings bool
+	prev                  byte // Last byte read
+
+	size  int64 // Bytes read so far
+	ended bool  // Whether the end of the message has been recorded
 }
 
 func newDataReader(c *Conn) *dataReader {
 	dr := &dataReader{
+		c: c,
 		r: c.text.R,
 	}
 
-	if c.server.MaxMessageBytes > 0 {
+	if max := c.server.maxMessageBytes(); max > 0 {
 		dr.limited = true
-		dr.n = int64(c.server.MaxMessageBytes)
+		dr.n = max
 	}
 
 	return dr
@@ -97,9 +171,23 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 		if err != nil {
 			if err == io.EOF {
 				err = io.ErrUnexpectedEOF
+			} else if r.c.dataAborted() {
+				err = ErrServerShutdown
+			} else if isTimeout(err) {
+				r.c.setDataTimedOut()
+				err = ErrDataTimeout
 			}
 			break
 		}
+		if r.rejectBareLineEndings && isBareLineEnding(r.prev, c) {
+			if !r.c.monitored(r.c.server.Validation, "validation", ErrBareLineEnding.Code, ErrBareLineEnding.Message) {
+				r.r.UnreadByte()
+				err = ErrBareLineEnding
+				break
+			}
+			r.rejectBareLineEndings = false // only log the first one
+		}
+		r.prev = c
 		switch r.state {
 		case stateBeginLine:
 			if c == '.' {
@@ -137,7 +225,12 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 		b[n] = c
 		n++
 	}
+	r.size += int64(n)
 	if err == nil && r.state == stateEOF {
+		if !r.ended {
+			r.c.endDataTiming(r.size)
+			r.ended = true
+		}
 		err = io.EOF
 	}
 
@@ -146,3 +239,32 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 	}
 	return
 }
+
+// timeoutReader records read timeouts of BDAT chunks, see
+// Server.DataTimeout.
+type timeoutReader struct {
+	c *Conn
+	r io.Reader
+}
+
+func (r *timeoutReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if isTimeout(err) && !r.c.dataAborted() {
+		r.c.setDataTimedOut()
+		err = ErrDataTimeout
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// drain consumes the rest of the message, ignoring the size limit and line
+// ending policy.
+func (r *dataReader) drain() {
+	r.limited = false
+	r.rejectBareLineEndings = false
+	io.Copy(ioutil.Discard, r)
+}
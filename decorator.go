@@ -0,0 +1,298 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/emersion/go-sasl"
+
+	"github.com/emersion/go-smtp/smtplog"
+)
+
+// SessionDecorator wraps a call to a Session method, e.g. to log it or
+// measure its latency. The method name is the one of the Session interface
+// or add-on interface, e.g. "Mail" or "ETRN", with "Context" variants
+// reported under the plain name. Backend.NewSession is reported as
+// "NewSession".
+//
+// A decorator must call next at most once, and return its error, or an error
+// of its own. Methods without an error result, such as Reset, ignore the
+// returned error. See WrapBackend.
+type SessionDecorator func(c *Conn, method string, next func() error) error
+
+// WrapBackend returns a Backend whose sessions are wrapped by the decorators,
+// the first one being the outermost. The decorators are applied to
+// Backend.NewSession too.
+//
+// Wrapped sessions implement all add-on interfaces, but the server only uses
+// the ones implemented by the sessions of be.
+func WrapBackend(be Backend, decorators ...SessionDecorator) Backend {
+	return BackendFunc(func(c *Conn) (Session, error) {
+		d := &decoratedSession{c: c, decorators: decorators}
+		err := d.call("NewSession", func() error {
+			var err error
+			d.Session, err = be.NewSession(c)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if d.Session == nil {
+			return nil, errors.New("smtp: NewSession returned a nil session")
+		}
+		return d, nil
+	})
+}
+
+// LogSessionCalls returns a SessionDecorator sending a record to
+// Server.Logger for each call, with its duration and error. Successful calls
+// are logged at the debug level, failed ones at the info level.
+func LogSessionCalls() SessionDecorator {
+	return func(c *Conn, method string, next func() error) error {
+		start := c.server.clock().Now()
+		err := next()
+		d := c.server.clock().Now().Sub(start)
+		if err != nil {
+			c.log(slog.LevelInfo, "session_call", "session call failed", slog.String("method", method), slog.Duration("duration", d), slog.Any(smtplog.ErrorKey, err))
+		} else {
+			c.log(slog.LevelDebug, "session_call", "session call", slog.String("method", method), slog.Duration("duration", d))
+		}
+		return err
+	}
+}
+
+// ObserveSessionCalls returns a SessionDecorator calling observe after each
+// call, with its duration and error, e.g. to export latency metrics. observe
+// may be called concurrently and must not block.
+func ObserveSessionCalls(observe func(method string, d time.Duration, err error)) SessionDecorator {
+	return func(c *Conn, method string, next func() error) error {
+		start := c.server.clock().Now()
+		err := next()
+		observe(method, c.server.clock().Now().Sub(start), err)
+		return err
+	}
+}
+
+// RecoverSessionPanics returns a SessionDecorator recovering from panics in
+// session calls. The panic is logged, and the call fails with a temporary
+// error instead of closing the connection.
+func RecoverSessionPanics() SessionDecorator {
+	return func(c *Conn, method string, next func() error) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				c.logPanic(fmt.Sprintf("%v: %v", method, v))
+				err = errSessionPanic
+			}
+		}()
+		return next()
+	}
+}
+
+var errSessionPanic = &SMTPError{
+	Code:         451,
+	EnhancedCode: EnhancedCode{4, 3, 0},
+	Message:      "Internal server error",
+}
+
+// decoratedSession is a Session returned by WrapBackend.
+type decoratedSession struct {
+	Session
+	c          *Conn
+	decorators []SessionDecorator
+}
+
+func (d *decoratedSession) call(method string, f func() error) error {
+	for i := len(d.decorators) - 1; i >= 0; i-- {
+		dec, next := d.decorators[i], f
+		f = func() error {
+			return dec(d.c, method, next)
+		}
+	}
+	return f()
+}
+
+func (d *decoratedSession) Reset() {
+	d.call("Reset", func() error {
+		d.Session.Reset()
+		return nil
+	})
+}
+
+func (d *decoratedSession) Logout() error {
+	return d.call("Logout", d.Session.Logout)
+}
+
+func (d *decoratedSession) Mail(from string, opts *MailOptions) error {
+	return d.call("Mail", func() error {
+		return d.Session.Mail(from, opts)
+	})
+}
+
+func (d *decoratedSession) Rcpt(to string, opts *RcptOptions) error {
+	return d.call("Rcpt", func() error {
+		return d.Session.Rcpt(to, opts)
+	})
+}
+
+func (d *decoratedSession) Data(r io.Reader) error {
+	return d.call("Data", func() error {
+		return d.Session.Data(r)
+	})
+}
+
+func (d *decoratedSession) MailContext(ctx context.Context, from string, opts *MailOptions) error {
+	return d.call("Mail", func() error {
+		if s, ok := d.Session.(ContextSession); ok {
+			return s.MailContext(ctx, from, opts)
+		}
+		return d.Session.Mail(from, opts)
+	})
+}
+
+func (d *decoratedSession) RcptContext(ctx context.Context, to string, opts *RcptOptions) error {
+	return d.call("Rcpt", func() error {
+		if s, ok := d.Session.(ContextSession); ok {
+			return s.RcptContext(ctx, to, opts)
+		}
+		return d.Session.Rcpt(to, opts)
+	})
+}
+
+func (d *decoratedSession) DataContext(ctx context.Context, r io.Reader) error {
+	return d.call("Data", func() error {
+		if s, ok := d.Session.(ContextSession); ok {
+			return s.DataContext(ctx, r)
+		}
+		return d.Session.Data(r)
+	})
+}
+
+func (d *decoratedSession) LMTPData(r io.Reader, status StatusCollector) error {
+	return d.call("LMTPData", func() error {
+		return d.Session.(LMTPSession).LMTPData(r, status)
+	})
+}
+
+func (d *decoratedSession) ValidateRecipients(rcpts []string) map[string]*SMTPError {
+	var errs map[string]*SMTPError
+	err := d.call("ValidateRecipients", func() error {
+		errs = d.Session.(DeferredRcptSession).ValidateRecipients(rcpts)
+		return nil
+	})
+	if err != nil {
+		smtpErr := sessionCallError(err)
+		errs = make(map[string]*SMTPError, len(rcpts))
+		for _, rcpt := range rcpts {
+			errs[rcpt] = smtpErr
+		}
+	}
+	return errs
+}
+
+func (d *decoratedSession) DataDKIM(ctx context.Context, r io.Reader, results func() []DKIMResult) error {
+	return d.call("DataDKIM", func() error {
+		return d.Session.(DKIMSession).DataDKIM(ctx, r, results)
+	})
+}
+
+func (d *decoratedSession) RcptBatch(reqs []RcptRequest) []RcptResult {
+	var results []RcptResult
+	err := d.call("RcptBatch", func() error {
+		results = d.Session.(BatchRcptSession).RcptBatch(reqs)
+		return nil
+	})
+	if err != nil {
+		results = make([]RcptResult, len(reqs))
+		for i := range results {
+			results[i].Err = err
+		}
+	}
+	return results
+}
+
+func (d *decoratedSession) ETRN(node string) error {
+	return d.call("ETRN", func() error {
+		return d.Session.(ETRNSession).ETRN(node)
+	})
+}
+
+func (d *decoratedSession) ATRN(domains []string) (ATRNQueue, error) {
+	var queue ATRNQueue
+	err := d.call("ATRN", func() error {
+		var err error
+		queue, err = d.Session.(ATRNSession).ATRN(domains)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+func (d *decoratedSession) Idle() {
+	d.call("Idle", func() error {
+		d.Session.(IdleSession).Idle()
+		return nil
+	})
+}
+
+func (d *decoratedSession) Active() {
+	d.call("Active", func() error {
+		d.Session.(IdleSession).Active()
+		return nil
+	})
+}
+
+func (d *decoratedSession) AuthMechanisms() []string {
+	var mechs []string
+	d.call("AuthMechanisms", func() error {
+		mechs = d.Session.(AuthSession).AuthMechanisms()
+		return nil
+	})
+	return mechs
+}
+
+func (d *decoratedSession) Auth(mech string) (sasl.Server, error) {
+	var server sasl.Server
+	err := d.call("Auth", func() error {
+		var err error
+		server, err = d.Session.(AuthSession).Auth(mech)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// sessionCallError converts an error returned by a decorator to an
+// SMTPError.
+func sessionCallError(err error) *SMTPError {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	return &SMTPError{
+		Code:         451,
+		EnhancedCode: EnhancedCode{4, 0, 0},
+		Message:      err.Error(),
+	}
+}
+
+// baseSession returns the session created by the backend, unwrapped from the
+// decorators added by WrapBackend. Add-on interfaces are checked on it, since
+// decorated sessions implement all of them.
+func (c *Conn) baseSession() Session {
+	s := c.Session()
+	for {
+		d, ok := s.(*decoratedSession)
+		if !ok {
+			return s
+		}
+		s = d.Session
+	}
+}
@@ -0,0 +1,45 @@
+package smtp
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// commandDisabled reports whether cmd is rejected in any state, see
+// Server.DisabledCommands.
+func (s *Server) commandDisabled(cmd string) bool {
+	if cmd == "TURN" {
+		return true
+	}
+	for _, verb := range s.DisabledCommands {
+		if strings.EqualFold(verb, cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDisabled rejects a disabled command, and tags the connection.
+func (c *Conn) handleDisabled(cmd string) {
+	tag := "disabled:" + cmd
+	if !c.hasTag(tag) {
+		c.AddTag(tag)
+	}
+	c.log(slog.LevelInfo, "disabled_command", "disabled command received", slog.String(logKeyCommand, cmd))
+
+	msg := cmd + " command not implemented"
+	if cmd == "TURN" {
+		// TURN lets any client receive the mail of a domain, replacements
+		// require the client to be authenticated or to only trigger a
+		// delivery
+		switch {
+		case c.server.EnableATRN && c.server.EnableETRN:
+			msg += ", use ATRN or ETRN"
+		case c.server.EnableATRN:
+			msg += ", use ATRN"
+		case c.server.EnableETRN:
+			msg += ", use ETRN"
+		}
+	}
+	c.writeResponse(502, EnhancedCode{5, 5, 1}, msg)
+}
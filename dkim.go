@@ -0,0 +1,109 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+
+	"github.com/emersion/go-smtp/smtplog"
+)
+
+// DKIMStatus is the result of a DKIM signature verification, as defined in
+// RFC 8601 section 2.7.1.
+type DKIMStatus string
+
+const (
+	DKIMPass      DKIMStatus = "pass"
+	DKIMFail      DKIMStatus = "fail"
+	DKIMNeutral   DKIMStatus = "neutral"
+	DKIMTempError DKIMStatus = "temperror"
+	DKIMPermError DKIMStatus = "permerror"
+)
+
+// DKIMResult is the result of the verification of a DKIM signature.
+type DKIMResult struct {
+	Status DKIMStatus
+	// Value of the d=, s= and i= tags of the signature, if any.
+	Domain     string
+	Selector   string
+	Identifier string
+	// Reason the signature doesn't pass, nil if it does.
+	Err error
+}
+
+// DKIMVerifier verifies the DKIM signatures of messages. See
+// Server.DKIMVerifier and the smtpdkim package.
+type DKIMVerifier interface {
+	// NewDKIMVerification starts the verification of a message. The message
+	// is written to the returned DKIMVerification as it is received.
+	NewDKIMVerification(ctx context.Context) DKIMVerification
+}
+
+// DKIMVerification verifies the signatures of a message. Writes must not
+// fail: malformed messages are reported in the results.
+type DKIMVerification interface {
+	io.Writer
+
+	// Results returns the results once the whole message has been written.
+	Results() []DKIMResult
+}
+
+// ErrDKIMPolicy is the default rejection of messages by Server.DKIMPolicy.
+var ErrDKIMPolicy = &SMTPError{
+	Code:         550,
+	EnhancedCode: EnhancedCode{5, 7, 20},
+	Message:      "No passing DKIM signature found",
+}
+
+// verifyDKIM returns a reader verifying the DKIM signatures of the message
+// read from r with Server.DKIMVerifier, and a function returning the results.
+// The reader enforces Server.DKIMPolicy, if any.
+func (c *Conn) verifyDKIM(r io.Reader) (io.Reader, func() []DKIMResult) {
+	v := c.server.DKIMVerifier.NewDKIMVerification(c.ctx)
+	r = io.TeeReader(r, &headerMemoryWriter{c: c, W: v, newlines: 1})
+
+	var results []DKIMResult
+	done := false
+	getResults := func() []DKIMResult {
+		if done {
+			return results
+		}
+		io.Copy(ioutil.Discard, r)
+		results, done = v.Results(), true
+		for _, res := range results {
+			attrs := []slog.Attr{
+				slog.String("result", string(res.Status)),
+				slog.String("domain", res.Domain),
+				slog.String("selector", res.Selector),
+			}
+			if res.Err != nil {
+				attrs = append(attrs, slog.String(smtplog.ErrorKey, res.Err.Error()))
+			}
+			c.log(slog.LevelInfo, "dkim", "DKIM verification", attrs...)
+		}
+		return results
+	}
+	if c.server.DKIMPolicy == nil {
+		return r, getResults
+	}
+	return &endOfMessageReader{r: r, check: func() error {
+		return c.checkDKIMPolicy(getResults())
+	}}, getResults
+}
+
+// checkDKIMPolicy runs Server.DKIMPolicy. It returns the rejection of the
+// message, if any.
+func (c *Conn) checkDKIMPolicy(results []DKIMResult) error {
+	err := c.server.DKIMPolicy(c, results)
+	if err == nil {
+		return nil
+	}
+	c.log(slog.LevelInfo, "dkim", "message rejected by DKIM policy", slog.String(smtplog.ErrorKey, err.Error()))
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	return ErrDKIMPolicy
+}
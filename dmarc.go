@@ -0,0 +1,238 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-smtp/smtplog"
+)
+
+// Maximum size of the header section parsed to find the RFC5322.From domain
+// of messages.
+const maxDMARCHeaderBytes = 1024 * 1024
+
+// DMARCStatus is the result of a DMARC evaluation, as defined in RFC 7489
+// section 11.2.
+type DMARCStatus string
+
+const (
+	DMARCPass      DMARCStatus = "pass"
+	DMARCFail      DMARCStatus = "fail"
+	DMARCNone      DMARCStatus = "none"
+	DMARCTempError DMARCStatus = "temperror"
+	DMARCPermError DMARCStatus = "permerror"
+)
+
+// DMARCDisposition is a DMARC policy, as requested by domain owners for
+// messages failing DMARC, or as applied to a message.
+type DMARCDisposition string
+
+const (
+	DMARCDispositionNone       DMARCDisposition = "none"
+	DMARCDispositionQuarantine DMARCDisposition = "quarantine"
+	DMARCDispositionReject     DMARCDisposition = "reject"
+)
+
+// DMARCMessage holds the identifiers and authentication results of a message
+// a DMARC policy is evaluated for.
+type DMARCMessage struct {
+	// IP address of the client.
+	ClientIP net.IP
+	// Domain of the RFC5322.From address. Empty if the message has no From
+	// header field, or addresses in several domains.
+	HeaderFrom string
+	// Domain checked with SPF: the domain of the MAIL FROM address, or the
+	// HELO domain for the null reverse-path. Empty if SPF wasn't checked.
+	MailFrom string
+	// Result of the SPF check, empty if there is none. See Conn.SPF.
+	SPF SPFResult
+	// Results of the DKIM signature verification, nil if
+	// Server.DKIMVerifier isn't set.
+	DKIM []DKIMResult
+}
+
+// DMARCResult is the result of the DMARC evaluation of a message.
+type DMARCResult struct {
+	Status DMARCStatus
+	// Domain of the RFC5322.From address.
+	Domain string
+	// Policy published by the domain owner, empty if there is none.
+	Policy DMARCDisposition
+	// Policy applied to the message, after sampling. It's
+	// DMARCDispositionNone unless the status is fail.
+	Disposition DMARCDisposition
+	// Reason for temperror and permerror results.
+	Err error
+}
+
+// DMARCEvaluator evaluates the DMARC policy of messages, combining the SPF
+// and DKIM results. See Server.DMARCEvaluator and the smtpdmarc package.
+type DMARCEvaluator interface {
+	EvaluateDMARC(ctx context.Context, msg *DMARCMessage) *DMARCResult
+}
+
+// DMARC returns the result of the DMARC evaluation of the current message, or
+// nil if there is none. It's set once the session has read the whole
+// message. See Server.DMARCEvaluator.
+func (c *Conn) DMARC() *DMARCResult {
+	return c.dmarc
+}
+
+// evaluateDMARC returns a reader evaluating the DMARC policy of the message
+// read from r with Server.DMARCEvaluator once the end of the message is
+// read, and rejecting the message if the policy asks for it. dkim returns the
+// DKIM results, it may be nil.
+func (c *Conn) evaluateDMARC(r io.Reader, dkim func() []DKIMResult) io.Reader {
+	from := &headerFromParser{c: c}
+	r = io.TeeReader(r, from)
+	return &endOfMessageReader{r: r, check: func() error {
+		msg := &DMARCMessage{
+			ClientIP:   clientIP(c.ClientAddr()),
+			HeaderFrom: from.domain(),
+			SPF:        c.spf,
+		}
+		if c.spf != "" {
+			msg.MailFrom = c.helo
+			if i := strings.LastIndexByte(c.spfFrom, '@'); i >= 0 {
+				msg.MailFrom = c.spfFrom[i+1:]
+			}
+		}
+		if dkim != nil {
+			msg.DKIM = dkim()
+		}
+		return c.checkDMARC(msg)
+	}}
+}
+
+// checkDMARC runs Server.DMARCEvaluator. It returns the rejection of the
+// message, if any.
+func (c *Conn) checkDMARC(msg *DMARCMessage) error {
+	evaluator := c.server.DMARCEvaluator
+	res := evaluator.EvaluateDMARC(c.ctx, msg)
+	if res == nil {
+		return nil
+	}
+	c.dmarc = res
+
+	attrs := []slog.Attr{
+		slog.String("result", string(res.Status)),
+		slog.String("domain", res.Domain),
+		slog.String("disposition", string(res.Disposition)),
+	}
+	if res.Err != nil {
+		attrs = append(attrs, slog.String(smtplog.ErrorKey, res.Err.Error()))
+	}
+	c.log(slog.LevelInfo, "dmarc", "DMARC evaluation", attrs...)
+
+	if res.Status != DMARCFail || res.Disposition != DMARCDispositionReject {
+		return nil
+	}
+	text := "Rejected by DMARC policy for " + res.Domain
+	if c.monitored(evaluator, "dmarc", 550, text) {
+		return nil
+	}
+	return &SMTPError{
+		Code:         550,
+		EnhancedCode: EnhancedCode{5, 7, 1},
+		Message:      text,
+	}
+}
+
+func clientIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// headerFromParser collects the header section of a message written to it,
+// to find the RFC5322.From domain.
+type headerFromParser struct {
+	c      *Conn // the buffer is accounted for by c, if set
+	header []byte
+	done   bool
+}
+
+func (p *headerFromParser) Write(b []byte) (int, error) {
+	if p.done {
+		return len(b), nil
+	}
+	if p.c != nil {
+		if err := p.c.reserveMemory(int64(len(b)), true); err != nil {
+			return 0, err
+		}
+	}
+	prev := len(p.header)
+	p.header = append(p.header, b...)
+	from := prev - 3
+	if from < 0 {
+		from = 0
+	}
+	if i := bytes.Index(p.header[from:], []byte("\n\r\n")); i >= 0 {
+		p.header, p.done = p.header[:from+i+1], true
+	} else if i := bytes.Index(p.header[from:], []byte("\n\n")); i >= 0 {
+		p.header, p.done = p.header[:from+i+1], true
+	} else if len(p.header) > maxDMARCHeaderBytes {
+		p.header, p.done = nil, true
+	}
+	return len(b), nil
+}
+
+// domain returns the domain of the From addresses, or an empty string if
+// there isn't exactly one.
+func (p *headerFromParser) domain() string {
+	msg, err := mail.ReadMessage(bytes.NewReader(append(p.header, "\r\n"...)))
+	if err != nil {
+		return ""
+	}
+	var domain string
+	for _, v := range msg.Header["From"] {
+		addrs, err := mail.ParseAddressList(v)
+		if err != nil {
+			return ""
+		}
+		for _, addr := range addrs {
+			i := strings.LastIndexByte(addr.Address, '@')
+			if i < 0 {
+				return ""
+			}
+			d := strings.ToLower(addr.Address[i+1:])
+			if domain != "" && d != domain {
+				return ""
+			}
+			domain = d
+		}
+	}
+	return domain
+}
+
+// endOfMessageReader runs a check when the end of the message is read. The
+// error returned by the check, if any, is returned instead of io.EOF.
+type endOfMessageReader struct {
+	r     io.Reader
+	check func() error
+	err   error
+}
+
+func (r *endOfMessageReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(b)
+	if err == io.EOF {
+		err = r.check()
+		if err == nil {
+			err = io.EOF
+		}
+		r.err = err
+	}
+	return n, err
+}
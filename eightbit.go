@@ -0,0 +1,88 @@
+package smtp
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// EightBitCommands is the handling of command lines containing 8-bit bytes.
+// See Server.EightBitCommands.
+type EightBitCommands int
+
+const (
+	// Pass command lines to the session as is.
+	EightBitAccept EightBitCommands = iota
+	// Reject command lines containing 8-bit bytes.
+	EightBitReject
+	// Only accept UTF-8 in MAIL and RCPT commands of transactions using
+	// SMTPUTF8, as defined in RFC 6531. Server.EnableSMTPUTF8 must be set
+	// for them to be accepted.
+	EightBitSMTPUTF8
+	// Accept command lines which are valid UTF-8 as is, and decode others as
+	// Latin-1 (ISO 8859-1). Sessions always receive UTF-8.
+	EightBitLatin1
+)
+
+// has8Bit reports whether s contains bytes outside of the ASCII range.
+func has8Bit(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeLatin1 converts a Latin-1 string to UTF-8.
+func decodeLatin1(s string) string {
+	var sb strings.Builder
+	sb.Grow(len(s) * 2)
+	for i := 0; i < len(s); i++ {
+		sb.WriteRune(rune(s[i]))
+	}
+	return sb.String()
+}
+
+// checkEightBit applies Server.EightBitCommands to a command line. It returns
+// the line to handle, or false if the command has been rejected.
+func (c *Conn) checkEightBit(line string) (string, bool) {
+	if !has8Bit(line) {
+		return line, true
+	}
+	switch c.server.EightBitCommands {
+	case EightBitReject:
+		c.protocolError(LimitSyntaxErrors, 500, EnhancedCode{5, 5, 2}, "Non-ASCII characters not allowed in commands")
+		return "", false
+	case EightBitSMTPUTF8:
+		verb, _, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		// MAIL and RCPT are checked once their parameters are parsed
+		if !c.server.EnableSMTPUTF8 || (verb != "MAIL" && verb != "RCPT") {
+			c.protocolError(LimitSyntaxErrors, 500, EnhancedCode{5, 5, 2}, "Non-ASCII characters not allowed in commands")
+			return "", false
+		}
+		if !utf8.ValidString(line) {
+			c.protocolError(LimitSyntaxErrors, 500, EnhancedCode{5, 5, 2}, "Invalid UTF-8 in command")
+			return "", false
+		}
+	case EightBitLatin1:
+		if !utf8.ValidString(line) {
+			line = decodeLatin1(line)
+		}
+	}
+	return line, true
+}
+
+// checkSMTPUTF8 returns an error if the argument of a MAIL or RCPT command
+// contains 8-bit bytes, but the transaction doesn't use SMTPUTF8 while
+// Server.EightBitCommands requires it.
+func (c *Conn) checkSMTPUTF8(arg string, smtputf8 bool) *SMTPError {
+	if c.server.EightBitCommands != EightBitSMTPUTF8 || smtputf8 || !has8Bit(arg) {
+		return nil
+	}
+	return &SMTPError{
+		Code:         553,
+		EnhancedCode: EnhancedCode{5, 6, 7},
+		Message:      "Non-ASCII addresses require SMTPUTF8",
+	}
+}
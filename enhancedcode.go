@@ -0,0 +1,130 @@
+package smtp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EnhancedCodeSubject is the subject sub-code of an enhanced status code, as
+// defined in RFC 3463 section 2.
+type EnhancedCodeSubject int
+
+const (
+	SubjectOther      EnhancedCodeSubject = 0 // Other or undefined status
+	SubjectAddressing EnhancedCodeSubject = 1 // Addressing status
+	SubjectMailbox    EnhancedCodeSubject = 2 // Mailbox status
+	SubjectMailSystem EnhancedCodeSubject = 3 // Mail system status
+	SubjectNetwork    EnhancedCodeSubject = 4 // Network and routing status
+	SubjectProtocol   EnhancedCodeSubject = 5 // Mail delivery protocol status
+	SubjectContent    EnhancedCodeSubject = 6 // Message content or media status
+	SubjectSecurity   EnhancedCodeSubject = 7 // Security or policy status
+)
+
+var subjectNames = map[EnhancedCodeSubject]string{
+	SubjectOther:      "other",
+	SubjectAddressing: "addressing",
+	SubjectMailbox:    "mailbox",
+	SubjectMailSystem: "mail system",
+	SubjectNetwork:    "network",
+	SubjectProtocol:   "protocol",
+	SubjectContent:    "content",
+	SubjectSecurity:   "security",
+}
+
+func (s EnhancedCodeSubject) String() string {
+	if name, ok := subjectNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("subject %d", int(s))
+}
+
+// Commonly used enhanced status codes, from the IANA registry.
+var (
+	EnhancedCodeSuccess               = EnhancedCode{2, 0, 0} // Other undefined status
+	EnhancedCodeDestinationValid      = EnhancedCode{2, 1, 5} // Destination address valid
+	EnhancedCodeBadDestinationMailbox = EnhancedCode{5, 1, 1} // Bad destination mailbox address
+	EnhancedCodeBadDestinationSyntax  = EnhancedCode{5, 1, 3} // Bad destination mailbox address syntax
+	EnhancedCodeBadSenderSyntax       = EnhancedCode{5, 1, 7} // Bad sender's mailbox address syntax
+	EnhancedCodeMailboxFull           = EnhancedCode{4, 2, 2} // Mailbox full
+	EnhancedCodeTempMailSystem        = EnhancedCode{4, 3, 0} // Other or undefined mail system status
+	EnhancedCodeMessageTooBig         = EnhancedCode{5, 3, 4} // Message too big for system
+	EnhancedCodeInvalidCommand        = EnhancedCode{5, 5, 1} // Invalid command
+	EnhancedCodeSyntaxError           = EnhancedCode{5, 5, 2} // Syntax error
+	EnhancedCodeInvalidArguments      = EnhancedCode{5, 5, 4} // Invalid command arguments
+	EnhancedCodeTempPolicy            = EnhancedCode{4, 7, 0} // Other or undefined security status
+	EnhancedCodePolicy                = EnhancedCode{5, 7, 0} // Other or undefined security status
+	EnhancedCodeNotAuthorized         = EnhancedCode{5, 7, 1} // Delivery not authorized, message refused
+	EnhancedCodeAuthFailed            = EnhancedCode{5, 7, 8} // Authentication credentials invalid
+)
+
+// ParseEnhancedCode parses an enhanced status code in the class.subject.detail
+// form defined in RFC 3463. The class must be 2, 4 or 5, and the subject and
+// detail must have one to three digits.
+func ParseEnhancedCode(s string) (EnhancedCode, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return EnhancedCode{}, fmt.Errorf("smtp: wrong amount of enhanced code parts in %q", s)
+	}
+
+	var code EnhancedCode
+	for i, part := range parts {
+		if len(part) == 0 || len(part) > 3 || strings.Trim(part, "0123456789") != "" {
+			return EnhancedCode{}, fmt.Errorf("smtp: malformed enhanced code %q", s)
+		}
+		code[i], _ = strconv.Atoi(part)
+	}
+	switch code[0] {
+	case 2, 4, 5:
+		// ok
+	default:
+		return EnhancedCode{}, fmt.Errorf("smtp: invalid enhanced code class in %q", s)
+	}
+	return code, nil
+}
+
+// String formats the enhanced code as class.subject.detail.
+func (code EnhancedCode) String() string {
+	return strconv.Itoa(code[0]) + "." + strconv.Itoa(code[1]) + "." + strconv.Itoa(code[2])
+}
+
+// Class returns the class of the enhanced code: 2 for success, 4 for
+// persistent transient failure and 5 for permanent failure.
+func (code EnhancedCode) Class() int {
+	return code[0]
+}
+
+// Subject returns the subject of the enhanced code.
+func (code EnhancedCode) Subject() EnhancedCodeSubject {
+	return EnhancedCodeSubject(code[1])
+}
+
+// Detail returns the detail of the enhanced code.
+func (code EnhancedCode) Detail() int {
+	return code[2]
+}
+
+// IsSuccess reports whether the enhanced code indicates success.
+func (code EnhancedCode) IsSuccess() bool {
+	return code[0] == 2
+}
+
+// IsTransient reports whether the enhanced code indicates a transient
+// failure, which may succeed if the same message is sent again later.
+func (code EnhancedCode) IsTransient() bool {
+	return code[0] == 4
+}
+
+// IsPermanent reports whether the enhanced code indicates a permanent
+// failure, which won't succeed if the message is resent in its current form.
+func (code EnhancedCode) IsPermanent() bool {
+	return code[0] == 5
+}
+
+// WithClass returns a copy of the enhanced code with the class replaced. This
+// is useful to turn a transient failure into a permanent one, and vice versa:
+// the subject and detail don't depend on the class.
+func (code EnhancedCode) WithClass(class int) EnhancedCode {
+	code[0] = class
+	return code
+}
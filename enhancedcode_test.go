@@ -0,0 +1,44 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestParseEnhancedCode(t *testing.T) {
+	valid := map[string]EnhancedCode{
+		"2.0.0":     {2, 0, 0},
+		"4.7.1":     {4, 7, 1},
+		"5.1.10":    {5, 1, 10},
+		"5.999.999": {5, 999, 999},
+	}
+	for s, want := range valid {
+		code, err := ParseEnhancedCode(s)
+		if err != nil {
+			t.Errorf("ParseEnhancedCode(%q) = %v", s, err)
+		} else if code != want {
+			t.Errorf("ParseEnhancedCode(%q) = %v, want %v", s, code, want)
+		}
+		if code.String() != s {
+			t.Errorf("%q.String() = %q", s, code.String())
+		}
+	}
+
+	for _, s := range []string{"", "5.0", "5.0.0.0", "3.0.0", "5.1000.0", "5.+1.0", "5.-1.0", "5..0", "x.y.z"} {
+		if code, err := ParseEnhancedCode(s); err == nil {
+			t.Errorf("ParseEnhancedCode(%q) = %v, want an error", s, code)
+		}
+	}
+}
+
+func TestEnhancedCode_class(t *testing.T) {
+	code := EnhancedCode{4, 2, 2}
+	if !code.IsTransient() || code.IsPermanent() || code.IsSuccess() {
+		t.Errorf("%v: wrong class", code)
+	}
+	if code.Subject() != SubjectMailbox || code.Detail() != 2 {
+		t.Errorf("%v: got subject %v and detail %v", code, code.Subject(), code.Detail())
+	}
+	if perm := code.WithClass(5); perm != (EnhancedCode{5, 2, 2}) || !perm.IsPermanent() {
+		t.Errorf("%v.WithClass(5) = %v", code, perm)
+	}
+}
@@ -0,0 +1,122 @@
+package smtp
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultMaxUnknownCommands = 3
+	defaultMaxSyntaxErrors    = 3
+	defaultErrorLimitDelay    = 5 * time.Second
+)
+
+// ErrorLimit is a limit of errors per connection, see
+// Server.ErrorLimitPolicy.
+type ErrorLimit string
+
+const (
+	// Server.MaxUnknownCommands: unrecognized commands.
+	LimitUnknownCommands ErrorLimit = "unknown-commands"
+	// Server.MaxSyntaxErrors: malformed command lines, e.g. with bare LF
+	// line endings or non-ASCII characters.
+	LimitSyntaxErrors ErrorLimit = "syntax-errors"
+	// Server.MaxFailedRecipients: rejected RCPT commands.
+	LimitFailedRecipients ErrorLimit = "failed-recipients"
+)
+
+// ErrorLimitAction is the action taken for an error above a limit, see
+// Server.ErrorLimitPolicy.
+type ErrorLimitAction int
+
+const (
+	// Reply to the command, then send "500 5.5.1 Too many errors. Quiting
+	// now" and close the connection.
+	ErrorLimitDisconnect ErrorLimitAction = iota
+	// Reply to the command with "421 4.7.0 Too many errors, closing
+	// connection" instead, and close the connection.
+	ErrorLimitReject
+	// Close the connection without a reply.
+	ErrorLimitDrop
+	// Reply to the command after Server.ErrorLimitDelay, and keep the
+	// connection open.
+	ErrorLimitSlowDown
+	// Reply to the command as usual.
+	ErrorLimitIgnore
+)
+
+// max returns the maximum number of errors counted towards l. Zero means
+// unlimited.
+func (l ErrorLimit) max(s *Server) int {
+	var max, def int
+	switch l {
+	case LimitUnknownCommands:
+		max, def = s.MaxUnknownCommands, defaultMaxUnknownCommands
+	case LimitSyntaxErrors:
+		max, def = s.MaxSyntaxErrors, defaultMaxSyntaxErrors
+	case LimitFailedRecipients:
+		max = s.MaxFailedRecipients
+	}
+	if max == 0 {
+		return def
+	} else if max < 0 {
+		return 0
+	}
+	return max
+}
+
+// replyError records an error counted towards limit, and applies
+// Server.Tarpit and the error limits to its reply, sent with reply. It
+// returns false if the connection has been closed.
+func (c *Conn) replyError(limit ErrorLimit, reply func()) bool {
+	if !c.tarpit() {
+		return false
+	}
+
+	if c.errorCounts == nil {
+		c.errorCounts = make(map[ErrorLimit]int)
+	}
+	c.errorCounts[limit]++
+	n := c.errorCounts[limit]
+	max := limit.max(c.server)
+	if max == 0 || n <= max {
+		reply()
+		return true
+	}
+
+	action := ErrorLimitDisconnect
+	if c.server.ErrorLimitPolicy != nil {
+		action = c.server.ErrorLimitPolicy(c, limit, n)
+	}
+	attrs := []slog.Attr{slog.String("limit", string(limit)), slog.Int("errors", n)}
+	switch action {
+	case ErrorLimitReject:
+		c.log(slog.LevelWarn, "error_limit", "too many errors, closing connection", attrs...)
+		c.Kick(421, EnhancedCode{4, 7, 0}, "Too many errors, closing connection")
+		return false
+	case ErrorLimitDrop:
+		c.log(slog.LevelWarn, "error_limit", "too many errors, dropping connection", attrs...)
+		c.Close()
+		return false
+	case ErrorLimitSlowDown:
+		d := c.server.ErrorLimitDelay
+		if d <= 0 {
+			d = defaultErrorLimitDelay
+		}
+		attrs = append(attrs, slog.Duration("delay", d))
+		c.log(slog.LevelDebug, "error_limit", "too many errors, delaying reply", attrs...)
+		if !c.sleep(d) {
+			return false
+		}
+		reply()
+		return true
+	case ErrorLimitIgnore:
+		reply()
+		return true
+	default:
+		c.log(slog.LevelWarn, "error_limit", "too many errors, closing connection", attrs...)
+		reply()
+		c.Kick(500, EnhancedCode{5, 5, 1}, "Too many errors. Quiting now")
+		return false
+	}
+}
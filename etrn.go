@@ -0,0 +1,74 @@
+package smtp
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// etrnAllowed reports whether the client may use ETRN: it must be
+// authenticated, or part of Server.ETRNTrustedNets.
+func (c *Conn) etrnAllowed() bool {
+	return c.didAuth || c.server.ETRNTrustedNets.Contains(c.ClientAddr())
+}
+
+// validETRNNode reports whether node is a valid ETRN argument: a domain, a
+// domain and its subdomains prefixed with "@", or a queue name prefixed with
+// "#", as defined in RFC 1985 section 5.
+func validETRNNode(node string) bool {
+	if strings.HasPrefix(node, "#") {
+		return len(node) > 1 && !strings.ContainsAny(node, " \t")
+	}
+	node = strings.TrimPrefix(node, "@")
+	if node == "" || strings.HasPrefix(node, ".") || strings.HasSuffix(node, ".") {
+		return false
+	}
+	for _, ch := range node {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Conn) handleETRN(arg string) {
+	if !c.server.EnableETRN {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "ETRN command not implemented")
+		return
+	}
+	if c.helo == "" {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "Please introduce yourself first.")
+		return
+	}
+	if c.fromReceived || c.bdatPipe != nil {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "Mail transaction in progress")
+		return
+	}
+
+	node := strings.TrimSpace(arg)
+	if node == "" {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Missing node argument")
+		return
+	}
+	if !validETRNNode(node) {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed node argument")
+		return
+	}
+	if !c.etrnAllowed() {
+		c.log(slog.LevelWarn, "etrn", "ETRN not allowed", slog.String(logKeyNode, node))
+		c.writeResponse(459, EnhancedCode{4, 7, 1}, "Node "+node+" not allowed")
+		return
+	}
+
+	if _, ok := c.baseSession().(ETRNSession); !ok {
+		c.writeResponse(458, EnhancedCode{4, 3, 0}, "Unable to queue messages for node "+node)
+		return
+	}
+	session := c.Session().(ETRNSession)
+	err := session.ETRN(node)
+	c.logResult("etrn", "ETRN", err, slog.String(logKeyNode, node))
+	if err != nil {
+		c.writeError(458, EnhancedCode{4, 3, 0}, err)
+		return
+	}
+	c.writeResponse(250, EnhancedCode{2, 0, 0}, "Queuing for node "+node+" started")
+}
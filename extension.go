@@ -0,0 +1,269 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+)
+
+// Extension is a site-specific SMTP extension, registered with
+// Server.RegisterExtension. It may implement CommandExtension,
+// MailParamExtension and RcptParamExtension.
+type Extension interface {
+	// Advertise returns the parameters of the EHLO keyword of the extension,
+	// e.g. "FOO BAR", and whether the extension is offered to conn.
+	// Commands and parameters of extensions which aren't offered are
+	// rejected as not implemented.
+	Advertise(conn *Conn) (params string, ok bool)
+}
+
+// CommandExtension is an add-on interface for Extension. It handles new
+// command verbs.
+type CommandExtension interface {
+	Extension
+
+	// Commands returns the verbs handled by the extension, upper-cased.
+	Commands() []string
+	// HandleCommand handles a command, and is responsible for sending a
+	// reply to the client. The verb is upper-cased.
+	HandleCommand(conn *Conn, verb, arg string)
+}
+
+// MailParamExtension is an add-on interface for Extension. It handles new
+// MAIL parameters, whose values are given to the session in
+// MailOptions.Extensions.
+type MailParamExtension interface {
+	Extension
+
+	// MailParams returns the names of the MAIL parameters handled by the
+	// extension, upper-cased.
+	MailParams() []string
+	// CheckMailParam checks the value of a MAIL parameter, empty if it has
+	// none. Returning an error rejects the command with a 501 reply, or the
+	// error if it's an *SMTPError.
+	CheckMailParam(conn *Conn, name, value string) error
+}
+
+// RcptParamExtension is an add-on interface for Extension. It handles new
+// RCPT parameters, whose values are given to the session in
+// RcptOptions.Extensions.
+type RcptParamExtension interface {
+	Extension
+
+	// RcptParams returns the names of the RCPT parameters handled by the
+	// extension, upper-cased.
+	RcptParams() []string
+	// CheckRcptParam checks the value of a RCPT parameter, empty if it has
+	// none. Returning an error rejects the command with a 501 reply, or the
+	// error if it's an *SMTPError.
+	CheckRcptParam(conn *Conn, name, value string) error
+}
+
+type registeredExtension struct {
+	name string
+	ext  Extension
+}
+
+// RegisterExtension registers a site-specific SMTP extension, advertised in
+// EHLO replies with the keyword name after the built-in extensions.
+//
+// Extensions can't override built-in commands and parameters. Registering an
+// extension twice replaces it. RegisterExtension must not be called while the
+// server is running.
+func (s *Server) RegisterExtension(name string, ext Extension) {
+	name = strings.ToUpper(name)
+	for i, re := range s.extensions {
+		if re.name == name {
+			s.extensions[i].ext = ext
+			return
+		}
+	}
+	s.extensions = append(s.extensions, registeredExtension{name, ext})
+}
+
+// parseExtensionCmd parses a command line whose verb is handled by a
+// registered extension, or a handler registered with HandleCommand. Unlike
+// built-in verbs, these may not have four letters.
+func (s *Server) parseExtensionCmd(line string) (cmd, arg string, ok bool) {
+	for _, re := range s.extensions {
+		ext, isCmd := re.ext.(CommandExtension)
+		if !isCmd {
+			continue
+		}
+		for _, verb := range ext.Commands() {
+			if arg, ok := cutVerb(line, verb); ok {
+				return verb, arg, true
+			}
+		}
+	}
+	for verb := range s.commands {
+		if arg, ok := cutVerb(line, verb); ok {
+			return verb, arg, true
+		}
+	}
+	return "", "", false
+}
+
+// cutVerb returns the argument of a command line if it starts with verb.
+func cutVerb(line, verb string) (arg string, ok bool) {
+	l := len(verb)
+	if len(line) < l || !strings.EqualFold(line[:l], verb) || (len(line) > l && line[l] != ' ') {
+		return "", false
+	}
+	return strings.TrimSpace(line[l:]), true
+}
+
+// extensionCaps returns the EHLO capabilities of the extensions offered to
+// the client.
+func (c *Conn) extensionCaps() []string {
+	var caps []string
+	for _, re := range c.server.extensions {
+		params, ok := re.ext.Advertise(c)
+		if !ok {
+			continue
+		}
+		if params != "" {
+			caps = append(caps, re.name+" "+params)
+		} else {
+			caps = append(caps, re.name)
+		}
+	}
+	return caps
+}
+
+// commandExtension returns the extension offered to the client handling verb,
+// if any.
+func (c *Conn) commandExtension(verb string) CommandExtension {
+	for _, re := range c.server.extensions {
+		ext, ok := re.ext.(CommandExtension)
+		if ok && contains(ext.Commands(), verb) && c.offered(ext) {
+			return ext
+		}
+	}
+	return nil
+}
+
+// mailParamExtension returns the extension offered to the client handling
+// the MAIL parameter name, if any.
+func (c *Conn) mailParamExtension(name string) MailParamExtension {
+	for _, re := range c.server.extensions {
+		ext, ok := re.ext.(MailParamExtension)
+		if ok && contains(ext.MailParams(), name) && c.offered(ext) {
+			return ext
+		}
+	}
+	return nil
+}
+
+// rcptParamExtension returns the extension offered to the client handling
+// the RCPT parameter name, if any.
+func (c *Conn) rcptParamExtension(name string) RcptParamExtension {
+	for _, re := range c.server.extensions {
+		ext, ok := re.ext.(RcptParamExtension)
+		if ok && contains(ext.RcptParams(), name) && c.offered(ext) {
+			return ext
+		}
+	}
+	return nil
+}
+
+func (c *Conn) offered(ext Extension) bool {
+	_, ok := ext.Advertise(c)
+	return ok
+}
+
+// unsupportedExtension is a standard extension the server doesn't
+// implement. It's never offered, but its commands and parameters are
+// rejected as not implemented rather than unrecognized.
+type unsupportedExtension struct {
+	commands, mailParams, rcptParams []string
+}
+
+func (ext unsupportedExtension) Advertise(conn *Conn) (string, bool) { return "", false }
+func (ext unsupportedExtension) Commands() []string                  { return ext.commands }
+func (ext unsupportedExtension) MailParams() []string                { return ext.mailParams }
+func (ext unsupportedExtension) RcptParams() []string                { return ext.rcptParams }
+
+func (ext unsupportedExtension) HandleCommand(conn *Conn, verb, arg string) {}
+
+func (ext unsupportedExtension) CheckMailParam(conn *Conn, name, value string) error {
+	return nil
+}
+
+func (ext unsupportedExtension) CheckRcptParam(conn *Conn, name, value string) error {
+	return nil
+}
+
+var unsupportedExtensions = []registeredExtension{
+	{"BURL", unsupportedExtension{commands: []string{"BURL"}}},               // RFC 4468
+	{"MTRK", unsupportedExtension{mailParams: []string{"MTRK"}}},             // RFC 3885
+	{"NO-SOLICITING", unsupportedExtension{mailParams: []string{"SOLICIT"}}}, // RFC 3865
+	{"SUBMITTER", unsupportedExtension{mailParams: []string{"SUBMITTER"}}},   // RFC 4405
+}
+
+// unofferedExtensions returns the known extensions which aren't offered to
+// the client: the standard ones the server doesn't implement, followed by the
+// registered ones.
+func (c *Conn) unofferedExtensions() []Extension {
+	var exts []Extension
+	for _, re := range unsupportedExtensions {
+		exts = append(exts, re.ext)
+	}
+	for _, re := range c.server.extensions {
+		if !c.offered(re.ext) {
+			exts = append(exts, re.ext)
+		}
+	}
+	return exts
+}
+
+// unofferedCommand reports whether verb belongs to a known extension which
+// isn't offered to the client.
+func (c *Conn) unofferedCommand(verb string) bool {
+	for _, ext := range c.unofferedExtensions() {
+		if ext, ok := ext.(CommandExtension); ok && contains(ext.Commands(), verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// unofferedMailParam reports whether the MAIL parameter name belongs to a
+// known extension which isn't offered to the client.
+func (c *Conn) unofferedMailParam(name string) bool {
+	for _, ext := range c.unofferedExtensions() {
+		if ext, ok := ext.(MailParamExtension); ok && contains(ext.MailParams(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// unofferedRcptParam reports whether the RCPT parameter name belongs to a
+// known extension which isn't offered to the client.
+func (c *Conn) unofferedRcptParam(name string) bool {
+	for _, ext := range c.unofferedExtensions() {
+		if ext, ok := ext.(RcptParamExtension); ok && contains(ext.RcptParams(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// paramError converts an error returned by an extension checking the
+// parameter name into an *SMTPError.
+func paramError(name string, err error) *SMTPError {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	return &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Invalid " + name + " parameter value"}
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package smtp
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum number of commands recorded in Fingerprint.Commands.
+const maxFingerprintCommands = 32
+
+// HELOShape classifies the name a client introduced itself with.
+type HELOShape string
+
+const (
+	// A fully-qualified domain name, e.g. "mx.example.org".
+	HELOShapeFQDN HELOShape = "fqdn"
+	// A domain name with a single label, e.g. "localhost" or "DESKTOP-1234".
+	HELOShapeBareName HELOShape = "bare"
+	// An address literal, e.g. "[192.0.2.1]".
+	HELOShapeAddressLiteral HELOShape = "address-literal"
+	// Anything else, e.g. an IP address without brackets.
+	HELOShapeInvalid HELOShape = "invalid"
+)
+
+// heloShape returns the shape of a HELO or EHLO argument.
+func heloShape(domain string) HELOShape {
+	switch {
+	case validAddressLiteral(domain):
+		return HELOShapeAddressLiteral
+	case !validDomain(domain):
+		return HELOShapeInvalid
+	case strings.Contains(strings.TrimSuffix(domain, "."), "."):
+		return HELOShapeFQDN
+	default:
+		return HELOShapeBareName
+	}
+}
+
+// Fingerprint describes how a client speaks SMTP, which can help telling
+// client software and bots apart. It's recorded if
+// Server.EnableFingerprinting is set, see Conn.Fingerprint.
+type Fingerprint struct {
+	// Greeting command, "EHLO" or "HELO", empty until then.
+	Greeting string
+	// Shape of the name given with the last greeting.
+	HELOShape HELOShape
+	// Verbs of the commands sent by the client, upper-cased, in order. Only
+	// the first 32 commands are recorded.
+	Commands []string
+	// Extensions and MAIL or RCPT parameters used by the client, in the
+	// order they were first used, e.g. "STARTTLS", "AUTH", "CHUNKING",
+	// "SIZE" or "BODY".
+	Extensions []string
+	// Time between the greeting and the first command.
+	FirstCommandDelay time.Duration
+	// Whether the client sent commands without waiting for the replies.
+	Pipelined bool
+	// JA3-style hash of the TLS ClientHello of STARTTLS, hex-encoded. It's
+	// the MD5 sum of the highest supported version, cipher suites,
+	// extensions, curves and point formats, GREASE values excluded. Empty if
+	// STARTTLS wasn't used.
+	TLSHash string
+}
+
+// Fingerprint returns the fingerprint of the client. It's empty unless
+// Server.EnableFingerprinting is set. It's reset by XCLIENT, since the
+// previous commands were sent by the proxy.
+func (c *Conn) Fingerprint() Fingerprint {
+	c.fingerprintLocker.Lock()
+	defer c.fingerprintLocker.Unlock()
+	fp := c.fingerprint
+	fp.Commands = append([]string(nil), fp.Commands...)
+	fp.Extensions = append([]string(nil), fp.Extensions...)
+	return fp
+}
+
+// fingerprintGreeted records the time the greeting was sent.
+func (c *Conn) fingerprintGreeted() {
+	if !c.server.EnableFingerprinting {
+		return
+	}
+	c.fingerprintLocker.Lock()
+	defer c.fingerprintLocker.Unlock()
+	c.greeted = c.server.clock().Now()
+}
+
+// fingerprintCommand records a command read from the client.
+func (c *Conn) fingerprintCommand(cmd, arg string) {
+	if !c.server.EnableFingerprinting {
+		return
+	}
+	c.fingerprintLocker.Lock()
+	defer c.fingerprintLocker.Unlock()
+
+	fp := &c.fingerprint
+	if len(fp.Commands) == 0 && !c.greeted.IsZero() {
+		fp.FirstCommandDelay = c.server.clock().Now().Sub(c.greeted)
+	}
+	if len(fp.Commands) < maxFingerprintCommands {
+		fp.Commands = append(fp.Commands, cmd)
+	}
+	if c.text.R.Buffered() > 0 {
+		fp.Pipelined = true
+	}
+
+	switch cmd {
+	case "HELO", "EHLO":
+		fp.Greeting = cmd
+		if domain, err := parseHelloArgument(arg); err == nil {
+			fp.HELOShape = heloShape(domain)
+		}
+	case "STARTTLS", "AUTH":
+		fp.addExtension(cmd)
+	case "BDAT":
+		fp.addExtension("CHUNKING")
+	case "MAIL", "RCPT":
+		fields := strings.Fields(arg)
+		for i, field := range fields {
+			// Skip the path, which may be separated from the colon
+			if i == 0 || strings.HasPrefix(field, "<") {
+				continue
+			}
+			if j := strings.IndexByte(field, '='); j >= 0 {
+				field = field[:j]
+			}
+			fp.addExtension(strings.ToUpper(field))
+		}
+	}
+}
+
+// fingerprintTLS records the TLS ClientHello of STARTTLS.
+func (c *Conn) fingerprintTLS(hello *tls.ClientHelloInfo) {
+	hash := tlsHash(hello)
+	c.fingerprintLocker.Lock()
+	defer c.fingerprintLocker.Unlock()
+	c.fingerprint.TLSHash = hash
+}
+
+// resetFingerprint forgets the recorded fingerprint.
+func (c *Conn) resetFingerprint() {
+	c.fingerprintLocker.Lock()
+	defer c.fingerprintLocker.Unlock()
+	c.fingerprint = Fingerprint{}
+	c.greeted = time.Time{}
+}
+
+func (fp *Fingerprint) addExtension(name string) {
+	for _, ext := range fp.Extensions {
+		if ext == name {
+			return
+		}
+	}
+	fp.Extensions = append(fp.Extensions, name)
+}
+
+// tlsHash returns the JA3-style hash of a ClientHello, see
+// Fingerprint.TLSHash.
+func tlsHash(hello *tls.ClientHelloInfo) string {
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, curve := range hello.SupportedCurves {
+		curves[i] = uint16(curve)
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, point := range hello.SupportedPoints {
+		points[i] = uint16(point)
+	}
+
+	s := strconv.Itoa(int(version)) + "," +
+		joinTLSValues(hello.CipherSuites) + "," +
+		joinTLSValues(hello.Extensions) + "," +
+		joinTLSValues(curves) + "," +
+		joinTLSValues(points)
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// joinTLSValues formats TLS values separated by dashes, GREASE values
+// excluded.
+func joinTLSValues(values []uint16) string {
+	var sb strings.Builder
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteString(strconv.Itoa(int(v)))
+	}
+	return sb.String()
+}
+
+// isGREASE reports whether v is a GREASE value, as defined in RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
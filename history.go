@@ -0,0 +1,101 @@
+package smtp
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryEntry is a command or a response recorded in a connection history.
+// See Server.CommandHistory.
+type HistoryEntry struct {
+	Time time.Time
+	// Response is true for responses sent by the server, false for commands
+	// sent by the client.
+	Response bool
+	Line     string
+}
+
+// String formats the entry, with a "C: " prefix for commands and a "S: "
+// prefix for responses.
+func (e HistoryEntry) String() string {
+	if e.Response {
+		return "S: " + e.Line
+	}
+	return "C: " + e.Line
+}
+
+// history is a ring buffer of the last commands and responses of a
+// connection.
+type history struct {
+	clock   Clock
+	locker  sync.Mutex
+	entries []HistoryEntry
+	next    int
+	full    bool
+}
+
+func newHistory(size int, clock Clock) *history {
+	if size <= 0 {
+		return nil
+	}
+	return &history{clock: clock, entries: make([]HistoryEntry, size)}
+}
+
+func (h *history) add(response bool, line string) {
+	if h == nil {
+		return
+	}
+
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	h.entries[h.next] = HistoryEntry{
+		Time:     h.clock.Now(),
+		Response: response,
+		Line:     line,
+	}
+	h.next++
+	if h.next == len(h.entries) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// list returns the entries, oldest first.
+func (h *history) list() []HistoryEntry {
+	if h == nil {
+		return nil
+	}
+
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	var l []HistoryEntry
+	if h.full {
+		l = append(l, h.entries[h.next:]...)
+	}
+	return append(l, h.entries[:h.next]...)
+}
+
+func (h *history) String() string {
+	var sb strings.Builder
+	for _, e := range h.list() {
+		sb.WriteString(e.String())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// historyCommand returns the line recorded for a command, without
+// credentials.
+func historyCommand(cmd, arg string) string {
+	if cmd == "AUTH" {
+		// Drop the initial response
+		arg, _, _ = strings.Cut(arg, " ")
+	}
+	if arg == "" {
+		return cmd
+	}
+	return cmd + " " + arg
+}
@@ -0,0 +1,64 @@
+package smtp
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// watchIdle starts watching for the client to become idle while the next
+// command is read, as configured by Server.IdleTimeout. The returned function
+// stops watching, and must be called once the command has been read.
+func (c *Conn) watchIdle() (stop func()) {
+	d := c.server.IdleTimeout
+	if d == 0 {
+		return func() {}
+	}
+
+	done := make(chan bool, 1)
+	timer := c.server.clock().AfterFunc(d, func() {
+		done <- c.idle()
+	})
+	return func() {
+		if timer.Stop() {
+			return
+		}
+		if notified := <-done; notified {
+			c.active()
+		}
+	}
+}
+
+// idle is called when the client hasn't sent a command for
+// Server.IdleTimeout. It reports whether the session has been notified and
+// the connection kept open.
+func (c *Conn) idle() bool {
+	c.log(slog.LevelDebug, "idle", "connection idle")
+
+	var session IdleSession
+	if _, ok := c.baseSession().(IdleSession); ok {
+		session = c.Session().(IdleSession)
+		session.Idle()
+	}
+
+	if hook := c.server.OnIdle; hook != nil {
+		if err := hook(c); err != nil {
+			c.log(slog.LevelInfo, "idle", "idle connection closed")
+			var smtpErr *SMTPError
+			if errors.As(err, &smtpErr) {
+				c.Kick(smtpErr.Code, smtpErr.EnhancedCode, c.scrub(smtpErr.Message))
+			} else {
+				c.Kick(421, EnhancedCode{4, 4, 2}, "Idle timeout, bye bye")
+			}
+			return false
+		}
+	}
+	return session != nil
+}
+
+// active is called when the client sends a command after the session has
+// been notified that the connection is idle.
+func (c *Conn) active() {
+	if _, ok := c.baseSession().(IdleSession); ok {
+		c.Session().(IdleSession).Active()
+	}
+}
@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"context"
+	"runtime/pprof"
+)
+
+// pprof label keys set on the goroutines serving connections, see
+// Server.EnableProfilerLabels.
+const (
+	// Address of the listener the connection was accepted on.
+	ProfilerLabelListener = "smtp.listener"
+	// Protocol phase: "connect" until the greeting, then "command", "auth",
+	// "starttls" or "data" depending on the command being handled.
+	ProfilerLabelState = "smtp.state"
+)
+
+// profilerState returns the ProfilerLabelState value for a command verb.
+func profilerState(cmd string) string {
+	switch cmd {
+	case "DATA", "BDAT":
+		return "data"
+	case "AUTH":
+		return "auth"
+	case "STARTTLS":
+		return "starttls"
+	default:
+		return "command"
+	}
+}
+
+// setProfilerState labels the current goroutine, which must be the one
+// serving the connection, with the protocol phase state.
+func (c *Conn) setProfilerState(state string) {
+	if !c.server.EnableProfilerLabels || state == c.profilerState {
+		return
+	}
+	c.profilerState = state
+
+	ctx, ok := c.profilerCtxs[state]
+	if !ok {
+		if c.profilerCtxs == nil {
+			c.profilerCtxs = make(map[string]context.Context)
+		}
+		labels := []string{ProfilerLabelState, state}
+		if c.listenerAddr != nil {
+			labels = append(labels, ProfilerLabelListener, c.listenerAddr.String())
+		}
+		if f := c.server.ProfilerLabels; f != nil {
+			labels = append(labels, f(c)...)
+		}
+		ctx = pprof.WithLabels(context.Background(), pprof.Labels(labels...))
+		c.profilerCtxs[state] = ctx
+	}
+	pprof.SetGoroutineLabels(ctx)
+}
@@ -1,16 +1,24 @@
 package smtp
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"io"
 )
 
-var ErrTooLongLine = errors.New("smtp: too long a line in input stream")
+// ErrLineTooLong is returned when a line exceeds the maximum line length.
+var ErrLineTooLong = errors.New("smtp: too long a line in input stream")
+
+// ErrTooLongLine is an alias for ErrLineTooLong.
+//
+// Deprecated: use ErrLineTooLong.
+var ErrTooLongLine = ErrLineTooLong
 
 // lineLimitReader reads from the underlying Reader but restricts
 // line length of lines in input stream to a certain length.
 //
-// If line length exceeds the limit - Read returns ErrTooLongLine
+// If line length exceeds the limit - Read returns ErrLineTooLong
 type lineLimitReader struct {
 	R         io.Reader
 	LineLimit int
@@ -20,7 +28,7 @@ type lineLimitReader struct {
 
 func (r *lineLimitReader) Read(b []byte) (int, error) {
 	if r.curLineLength > r.LineLimit && r.LineLimit > 0 {
-		return 0, ErrTooLongLine
+		return 0, ErrLineTooLong
 	}
 
 	n, err := r.R.Read(b)
@@ -39,9 +47,73 @@ func (r *lineLimitReader) Read(b []byte) (int, error) {
 		r.curLineLength++
 
 		if r.curLineLength > r.LineLimit {
-			return 0, ErrTooLongLine
+			return 0, ErrLineTooLong
 		}
 	}
 
 	return n, nil
 }
+
+// readLimitedLine reads a line from r, without its line ending. Lines are
+// read from the buffer of r, which is only copied once a full line is
+// received.
+//
+// If the line, including its line ending, exceeds limit bytes, ErrLineTooLong
+// is returned as soon as the limit is reached, without reading the rest of the
+// line. A zero limit means unlimited.
+func readLimitedLine(r *bufio.Reader, limit int) (string, error) {
+	line, _, err := readLimitedLineEnding(r, limit)
+	return line, err
+}
+
+// readLimitedLineEnding is like readLimitedLine, but also reports whether the
+// line ends with a bare LF instead of CRLF.
+func readLimitedLineEnding(r *bufio.Reader, limit int) (string, bool, error) {
+	line, bareLF, _, err := readLimitedLineRest(r, limit)
+	return line, bareLF, err
+}
+
+// readLimitedLineRest is like readLimitedLineEnding, but if the line is too
+// long, also returns the number of bytes read, or -1 if the whole line was
+// read.
+func readLimitedLineRest(r *bufio.Reader, limit int) (string, bool, int, error) {
+	var line []byte // only used for lines longer than the buffer of r
+	for {
+		frag, err := r.ReadSlice('\n')
+		if limit > 0 && len(line)+len(frag) > limit {
+			if err == nil {
+				return "", false, -1, ErrLineTooLong
+			}
+			return "", false, len(line) + len(frag), ErrLineTooLong
+		}
+		if err == bufio.ErrBufferFull {
+			line = append(line, frag...)
+			continue
+		} else if err != nil {
+			return "", false, 0, err
+		}
+		if line != nil {
+			frag = append(line, frag...)
+		}
+		frag = bytes.TrimSuffix(frag, []byte("\n"))
+		bareLF := !bytes.HasSuffix(frag, []byte("\r"))
+		frag = bytes.TrimSuffix(frag, []byte("\r"))
+		return string(frag), bareLF, 0, nil
+	}
+}
+
+// skipLine discards the rest of a line, of which n bytes were read. If the
+// line, including its line ending, exceeds limit bytes, ErrLineTooLong is
+// returned. A zero limit means unlimited.
+func skipLine(r *bufio.Reader, n, limit int) error {
+	for {
+		frag, err := r.ReadSlice('\n')
+		n += len(frag)
+		if limit > 0 && n > limit {
+			return ErrLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package smtp
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadLimitedLine(t *testing.T) {
+	long := strings.Repeat("a", 30)
+	input := "HELO localhost\r\n" + long + "\n" + strings.Repeat("b", 50) + "\r\n"
+	// A buffer smaller than the lines, to exercise fragment concatenation
+	r := bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	for _, want := range []string{"HELO localhost", long} {
+		line, err := readLimitedLine(r, 40)
+		if err != nil {
+			t.Fatalf("readLimitedLine() = %v", err)
+		} else if line != want {
+			t.Errorf("readLimitedLine() = %q, want %q", line, want)
+		}
+	}
+
+	if _, err := readLimitedLine(r, 40); err != ErrLineTooLong {
+		t.Fatalf("readLimitedLine() = %v, want ErrLineTooLong", err)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if !strings.HasSuffix(string(rest), "b\r\n") || len(rest) >= 50 {
+		t.Errorf("Long line consumed up to %q, want it left partially unread", rest)
+	}
+}
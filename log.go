@@ -0,0 +1,86 @@
+package smtp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+
+	"github.com/emersion/go-smtp/smtplog"
+)
+
+// Attribute keys of records sent to Server.Logger, in addition to the ones
+// defined by the smtplog package.
+const (
+	logKeyRemoteAddr = "remote_addr"
+	logKeyClientAddr = "client_addr" // set with XCLIENT
+	logKeyHelo       = "helo"
+	logKeyCommand    = "command"
+	logKeyCode       = "code"
+	logKeyReply      = "reply"
+	logKeyMonitor    = "monitor" // rejection not enforced, see PolicyMonitor
+	logKeyMechanism  = "mechanism"
+	logKeyNode       = "node"    // ETRN argument
+	logKeyDomains    = "domains" // ATRN argument
+
+	logKeyTLSVersion     = "tls_version"
+	logKeyTLSCipherSuite = "tls_cipher_suite"
+	logKeyTLSServerName  = "tls_server_name"
+)
+
+func newConnID(r io.Reader) string {
+	if r == nil {
+		r = rand.Reader
+	}
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// ID returns a random identifier for the connection, suitable to correlate
+// log records.
+func (c *Conn) ID() string {
+	return c.id
+}
+
+func (c *Conn) logEnabled(level slog.Level) bool {
+	return c.server.Logger != nil && c.server.Logger.Enabled(context.Background(), level)
+}
+
+// log sends a record to Server.Logger, with the connection attributes.
+func (c *Conn) log(level slog.Level, event, msg string, attrs ...slog.Attr) {
+	if !c.logEnabled(level) {
+		return
+	}
+
+	l := make([]slog.Attr, 0, 4+len(attrs))
+	l = append(l,
+		slog.String(smtplog.EventKey, event),
+		slog.String(smtplog.SessionKey, c.id),
+		slog.String(logKeyRemoteAddr, c.remoteAddr().String()))
+	if c.rewritesRemoteAddr() {
+		// The client address is already logged as the remote one
+	} else if c.xclient != nil && c.xclient.Addr != nil {
+		l = append(l, slog.String(logKeyClientAddr, c.xclient.Addr.String()))
+	} else if c.proxyAddr != nil {
+		l = append(l, slog.String(logKeyClientAddr, c.proxyAddr.String()))
+	}
+	if c.helo != "" {
+		l = append(l, slog.String(logKeyHelo, c.helo))
+	}
+	l = append(l, attrs...)
+	c.server.Logger.LogAttrs(context.Background(), level, msg, l...)
+}
+
+// logResult logs the outcome of a command: failures are logged with the
+// warning level.
+func (c *Conn) logResult(event, msg string, err error, attrs ...slog.Attr) {
+	if err != nil {
+		c.log(slog.LevelWarn, event, msg+" rejected", append(attrs, slog.String(smtplog.ErrorKey, err.Error()))...)
+	} else {
+		c.log(slog.LevelInfo, event, msg+" accepted", attrs...)
+	}
+}
@@ -0,0 +1,266 @@
+package smtp
+
+import (
+	"io"
+	"log/slog"
+)
+
+var errInsufficientMemory = &SMTPError{
+	Code:         451,
+	EnhancedCode: EnhancedCode{4, 3, 1},
+	Message:      "Insufficient system resources, try again later",
+}
+
+// minCommandMemory is the length of the command lines read when the memory
+// budget is exhausted, enough for QUIT and RSET, which aren't accounted for.
+const minCommandMemory = len("QUIT\r\n")
+
+// MemoryMetrics is an add-on interface for ServerMetrics, receiving the
+// memory accounted for by the server, see Server.MaxMemory.
+type MemoryMetrics interface {
+	ServerMetrics
+
+	// MemoryUsed is called when the number of bytes reserved by all
+	// connections changes, with the new total. It's called with a lock held,
+	// so that updates are received in order: it must not block.
+	MemoryUsed(bytes int64)
+	// MemoryRejected is called when a reservation is rejected, global
+	// being set if Server.MaxMemory is exceeded rather than
+	// Server.MaxConnectionMemory.
+	MemoryRejected(global bool)
+}
+
+// ReserveMemory accounts for n bytes buffered for the connection, e.g. by the
+// backend, against Server.MaxConnectionMemory and Server.MaxMemory. If a
+// budget would be exceeded, nothing is reserved and an *SMTPError deferring
+// the command or message is returned. Reservations must be released with
+// ReleaseMemory, those left are released when the connection is closed.
+func (c *Conn) ReserveMemory(n int64) error {
+	return c.reserveMemory(n, false)
+}
+
+// ReleaseMemory releases n bytes reserved with ReserveMemory.
+func (c *Conn) ReleaseMemory(n int64) {
+	c.releaseMemory(n, false)
+}
+
+// reserveMemory reserves n bytes, released with the current message by
+// releaseMessageMemory if message is set.
+func (c *Conn) reserveMemory(n int64, message bool) error {
+	_, err := c.reserveMemoryUpTo(n, n, message)
+	return err
+}
+
+// reserveMemoryUpTo reserves as many bytes as available up to atMost, and at
+// least atLeast, and returns the number of bytes reserved. See reserveMemory.
+func (c *Conn) reserveMemoryUpTo(atLeast, atMost int64, message bool) (int64, error) {
+	s := c.server
+	s.memoryLocker.Lock()
+	avail, global := c.availableMemoryLocked()
+	if avail < 0 || avail > atMost {
+		avail = atMost
+	}
+	if avail < atLeast {
+		s.memoryLocker.Unlock()
+		return 0, c.memoryRejected(atLeast, global)
+	}
+	c.memoryUsed += avail
+	s.memoryUsed += avail
+	if message {
+		c.messageMemory += avail
+	}
+	s.memoryUsedChanged(avail)
+	s.memoryLocker.Unlock()
+	return avail, nil
+}
+
+// releaseMemory releases n bytes reserved with reserveMemory.
+func (c *Conn) releaseMemory(n int64, message bool) {
+	s := c.server
+	s.memoryLocker.Lock()
+	c.memoryUsed -= n
+	s.memoryUsed -= n
+	if message {
+		c.messageMemory -= n
+	}
+	s.memoryUsedChanged(-n)
+	s.memoryLocker.Unlock()
+}
+
+// releaseMessageMemory releases the bytes reserved for the current message.
+func (c *Conn) releaseMessageMemory() {
+	s := c.server
+	s.memoryLocker.Lock()
+	n := c.messageMemory
+	c.messageMemory = 0
+	c.memoryUsed -= n
+	s.memoryUsed -= n
+	s.memoryUsedChanged(-n)
+	s.memoryLocker.Unlock()
+}
+
+// releaseAllMemory releases the bytes left reserved by a closed connection.
+func (c *Conn) releaseAllMemory() {
+	s := c.server
+	s.memoryLocker.Lock()
+	n := c.memoryUsed
+	c.memoryUsed, c.messageMemory = 0, 0
+	s.memoryUsed -= n
+	s.memoryUsedChanged(-n)
+	s.memoryLocker.Unlock()
+}
+
+// availableMemoryLocked returns the number of bytes the connection can
+// reserve, or -1 if it's unlimited, and whether Server.MaxMemory is the
+// limiting budget. The caller must hold Server.memoryLocker.
+func (c *Conn) availableMemoryLocked() (avail int64, global bool) {
+	s := c.server
+	avail = -1
+	if s.MaxConnectionMemory > 0 {
+		avail = s.MaxConnectionMemory - c.memoryUsed
+	}
+	if s.MaxMemory > 0 {
+		if n := s.MaxMemory - s.memoryUsed; avail < 0 || n < avail {
+			avail, global = n, true
+		}
+	}
+	if avail < 0 && (s.MaxConnectionMemory > 0 || s.MaxMemory > 0) {
+		avail = 0
+	}
+	return avail, global
+}
+
+// memoryRejected reports a reservation of n bytes exceeding a budget, and
+// returns the error to reply with.
+func (c *Conn) memoryRejected(n int64, global bool) error {
+	c.log(slog.LevelWarn, "memory_limit", "memory budget exceeded",
+		slog.Int64("bytes", n), slog.Bool("global", global))
+	if m, ok := c.server.Metrics.(MemoryMetrics); ok {
+		m.MemoryRejected(global)
+	}
+	return errInsufficientMemory
+}
+
+// memoryUsedChanged reports a change of delta bytes of the memory used. The
+// caller must hold s.memoryLocker.
+func (s *Server) memoryUsedChanged(delta int64) {
+	if delta == 0 {
+		return
+	}
+	if m, ok := s.Metrics.(MemoryMetrics); ok {
+		m.MemoryUsed(s.memoryUsed)
+	}
+}
+
+// readCommandLine reads a command line, no longer than the memory the
+// connection can reserve. If it's longer, the line is discarded and
+// errInsufficientMemory is returned.
+func (c *Conn) readCommandLine() (line string, bareLF bool, err error) {
+	s := c.server
+	limit := s.MaxLineLength
+
+	s.memoryLocker.Lock()
+	avail, global := c.availableMemoryLocked()
+	s.memoryLocker.Unlock()
+	capped := avail >= 0 && (limit <= 0 || avail < int64(limit))
+	if capped {
+		limit = int(avail)
+		if limit < minCommandMemory {
+			limit = minCommandMemory
+		}
+	}
+
+	line, bareLF, n, err := readLimitedLineRest(c.text.R, limit)
+	if err != ErrLineTooLong || !capped {
+		return line, bareLF, err
+	}
+	if n >= 0 {
+		if err := skipLine(c.text.R, n, s.MaxLineLength); err != nil {
+			return "", false, err
+		}
+	}
+	return "", false, c.memoryRejected(int64(limit)+1, global)
+}
+
+// dataMemoryReader accounts for the message read from R against the memory
+// budgets, up to Server.DataSpoolThreshold bytes, as it's read.
+type dataMemoryReader struct {
+	c    *Conn
+	R    io.Reader
+	left int64 // bytes left to account for, or -1 for all
+	err  error // set when a budget is exceeded
+}
+
+func (c *Conn) newDataMemoryReader(r io.Reader) *dataMemoryReader {
+	left := c.server.DataSpoolThreshold
+	if left == 0 {
+		left = -1
+	} else if left < 0 {
+		left = 0
+	}
+	return &dataMemoryReader{c: c, R: r, left: left}
+}
+
+func (mr *dataMemoryReader) Read(b []byte) (int, error) {
+	if mr.err != nil {
+		return 0, mr.err
+	}
+	if mr.left == 0 || len(b) == 0 {
+		return mr.R.Read(b)
+	}
+
+	// Read no more than what can be reserved
+	size := int64(len(b))
+	if mr.left > 0 && size > mr.left {
+		size = mr.left
+	}
+	reserved, err := mr.c.reserveMemoryUpTo(1, size, true)
+	if err != nil {
+		mr.err = err
+		return 0, err
+	}
+	n, err := mr.R.Read(b[:reserved])
+	if unused := reserved - int64(n); unused > 0 {
+		mr.c.releaseMemory(unused, true)
+	}
+	if mr.left > 0 {
+		mr.left -= int64(n)
+	}
+	return n, err
+}
+
+// headerMemoryWriter reserves memory for the header section of a message
+// written to it, as it's buffered by W, e.g. a DKIMVerification, and passes
+// the message to W.
+type headerMemoryWriter struct {
+	c *Conn
+	W io.Writer
+
+	newlines int // "\n", then "\n\r" seen at the end of the data written
+	done     bool
+}
+
+func (hw *headerMemoryWriter) Write(b []byte) (int, error) {
+	if !hw.done {
+		n := len(b)
+		for i, ch := range b {
+			switch {
+			case ch == '\n' && hw.newlines > 0:
+				n, hw.done = i+1, true
+			case ch == '\n':
+				hw.newlines = 1
+			case ch == '\r' && hw.newlines == 1:
+				hw.newlines = 2
+			default:
+				hw.newlines = 0
+			}
+			if hw.done {
+				break
+			}
+		}
+		if err := hw.c.reserveMemory(int64(n), true); err != nil {
+			return 0, err
+		}
+	}
+	return hw.W.Write(b)
+}
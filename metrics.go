@@ -0,0 +1,68 @@
+package smtp
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// ServerMetrics receives events from a Server, e.g. to export metrics. See
+// Server.Metrics.
+//
+// Methods are called synchronously from connection goroutines, and may be
+// called concurrently: they must not block.
+type ServerMetrics interface {
+	// ConnectionOpened is called when a connection is accepted.
+	ConnectionOpened()
+	// ConnectionClosed is called when a connection is closed, with the
+	// number of bytes received and sent, after TLS decryption.
+	ConnectionClosed(bytesIn, bytesOut int64)
+	// Command is called for each command received. The verb is upper-cased
+	// and may be anything sent by the client.
+	Command(verb string)
+	// AuthFailed is called when an authentication attempt fails.
+	AuthFailed(mech string)
+	// MessageAccepted is called when a message is accepted. With LMTP, it is
+	// called once per recipient.
+	MessageAccepted()
+	// MessageRejected is called when a message is rejected by the backend or
+	// aborted. With LMTP, it is called once per recipient.
+	MessageRejected()
+	// TLSHandshake is called after a TLS handshake, implicit or after
+	// STARTTLS, with its error.
+	TLSHandshake(err error)
+}
+
+// countingReader counts the bytes read from R.
+type countingReader struct {
+	R io.Reader
+	N *int64
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.R.Read(b)
+	atomic.AddInt64(r.N, int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written to W.
+type countingWriter struct {
+	W io.Writer
+	N *int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.W.Write(b)
+	atomic.AddInt64(w.N, int64(n))
+	return n, err
+}
+
+func (c *Conn) messageResult(err error) {
+	if c.server.Metrics == nil {
+		return
+	}
+	if err != nil {
+		c.server.Metrics.MessageRejected()
+	} else {
+		c.server.Metrics.MessageAccepted()
+	}
+}
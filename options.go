@@ -0,0 +1,135 @@
+package smtp
+
+// Clone returns a deep copy of opts. It returns nil if opts is nil.
+func (opts *MailOptions) Clone() *MailOptions {
+	if opts == nil {
+		return nil
+	}
+	out := *opts
+	if opts.Auth != nil {
+		auth := *opts.Auth
+		out.Auth = &auth
+	}
+	out.DeliverBy = cloneDeliverBy(opts.DeliverBy)
+	out.MTPriority = cloneInt(opts.MTPriority)
+	out.Extensions = cloneParams(opts.Extensions)
+	return &out
+}
+
+// Equal reports whether opts and other hold the same parameters. Nil and
+// empty Extensions maps are equal.
+func (opts *MailOptions) Equal(other *MailOptions) bool {
+	if opts == nil || other == nil {
+		return opts == other
+	}
+	return opts.Body == other.Body &&
+		opts.Size == other.Size &&
+		opts.RequireTLS == other.RequireTLS &&
+		opts.UTF8 == other.UTF8 &&
+		opts.Return == other.Return &&
+		opts.EnvelopeID == other.EnvelopeID &&
+		equalString(opts.Auth, other.Auth) &&
+		opts.HoldFor == other.HoldFor &&
+		opts.HoldUntil.Equal(other.HoldUntil) &&
+		equalDeliverBy(opts.DeliverBy, other.DeliverBy) &&
+		equalInt(opts.MTPriority, other.MTPriority) &&
+		opts.SPF == other.SPF &&
+		equalParams(opts.Extensions, other.Extensions)
+}
+
+// Clone returns a deep copy of opts. It returns nil if opts is nil.
+func (opts *RcptOptions) Clone() *RcptOptions {
+	if opts == nil {
+		return nil
+	}
+	out := *opts
+	if opts.Notify != nil {
+		out.Notify = append([]DSNNotify(nil), opts.Notify...)
+	}
+	out.DeliverBy = cloneDeliverBy(opts.DeliverBy)
+	out.MTPriority = cloneInt(opts.MTPriority)
+	out.Extensions = cloneParams(opts.Extensions)
+	return &out
+}
+
+// Equal reports whether opts and other hold the same parameters. Nil and
+// empty Notify slices and Extensions maps are equal.
+func (opts *RcptOptions) Equal(other *RcptOptions) bool {
+	if opts == nil || other == nil {
+		return opts == other
+	}
+	if len(opts.Notify) != len(other.Notify) {
+		return false
+	}
+	for i := range opts.Notify {
+		if opts.Notify[i] != other.Notify[i] {
+			return false
+		}
+	}
+	return opts.OriginalRecipientType == other.OriginalRecipientType &&
+		opts.OriginalRecipient == other.OriginalRecipient &&
+		opts.RequireRecipientValidSince.Equal(other.RequireRecipientValidSince) &&
+		equalDeliverBy(opts.DeliverBy, other.DeliverBy) &&
+		equalInt(opts.MTPriority, other.MTPriority) &&
+		equalParams(opts.Extensions, other.Extensions)
+}
+
+func cloneDeliverBy(opts *DeliverByOptions) *DeliverByOptions {
+	if opts == nil {
+		return nil
+	}
+	out := *opts
+	return &out
+}
+
+func cloneInt(v *int) *int {
+	if v == nil {
+		return nil
+	}
+	out := *v
+	return &out
+}
+
+func cloneParams(params map[string]string) map[string]string {
+	if params == nil {
+		return nil
+	}
+	out := make(map[string]string, len(params))
+	for k, v := range params {
+		out[k] = v
+	}
+	return out
+}
+
+func equalString(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalDeliverBy(a, b *DeliverByOptions) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalInt(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalParams(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package smtp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fillValue sets v to a non-zero value, different for each seed.
+func fillValue(t *testing.T, v reflect.Value, seed int) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("value" + string(rune('a'+seed)))
+	case reflect.Bool:
+		v.SetBool(seed%2 == 0)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(int64(seed + 1))
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		fillValue(t, p.Elem(), seed)
+		v.Set(p)
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 1, 1)
+		fillValue(t, s.Index(0), seed)
+		v.Set(s)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		key := reflect.New(v.Type().Key()).Elem()
+		fillValue(t, key, seed)
+		val := reflect.New(v.Type().Elem()).Elem()
+		fillValue(t, val, seed)
+		m.SetMapIndex(key, val)
+		v.Set(m)
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Unix(int64(seed+1)*3600, 0)))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			fillValue(t, v.Field(i), seed)
+		}
+	default:
+		t.Fatalf("Unsupported field kind %v", v.Kind())
+	}
+}
+
+// testOptionsCloneEqual checks that clone and equal handle all the fields of
+// the struct pointed to by newOpts.
+func testOptionsCloneEqual(t *testing.T, newOpts func() interface{}, clone func(interface{}) interface{}, equal func(a, b interface{}) bool) {
+	opts := newOpts()
+	fillValue(t, reflect.ValueOf(opts).Elem(), 0)
+	if !equal(opts, clone(opts)) {
+		t.Fatalf("Clone(%+v) isn't equal to the original", opts)
+	}
+
+	typ := reflect.TypeOf(opts).Elem()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+
+		other := clone(opts)
+		fillValue(t, reflect.ValueOf(other).Elem().Field(i), 1)
+		if equal(opts, other) {
+			t.Errorf("Equal() ignores field %v", field.Name)
+		}
+
+		// Modifying the value pointed to by the clone must not modify the
+		// original
+		other = clone(opts)
+		v := reflect.ValueOf(other).Elem().Field(i)
+		switch v.Kind() {
+		case reflect.Ptr:
+			fillValue(t, v.Elem(), 1)
+		case reflect.Slice:
+			fillValue(t, v.Index(0), 1)
+		case reflect.Map:
+			for _, k := range v.MapKeys() {
+				val := reflect.New(v.Type().Elem()).Elem()
+				fillValue(t, val, 1)
+				v.SetMapIndex(k, val)
+			}
+		default:
+			continue
+		}
+		if equal(opts, other) {
+			t.Errorf("Clone() doesn't deep copy field %v", field.Name)
+		}
+	}
+}
+
+func TestMailOptions_CloneEqual(t *testing.T) {
+	testOptionsCloneEqual(t, func() interface{} {
+		return &MailOptions{}
+	}, func(opts interface{}) interface{} {
+		return opts.(*MailOptions).Clone()
+	}, func(a, b interface{}) bool {
+		return a.(*MailOptions).Equal(b.(*MailOptions))
+	})
+
+	var nilOpts *MailOptions
+	if nilOpts.Clone() != nil || !nilOpts.Equal(nil) || nilOpts.Equal(&MailOptions{}) {
+		t.Error("Invalid handling of nil options")
+	}
+}
+
+func TestRcptOptions_CloneEqual(t *testing.T) {
+	testOptionsCloneEqual(t, func() interface{} {
+		return &RcptOptions{}
+	}, func(opts interface{}) interface{} {
+		return opts.(*RcptOptions).Clone()
+	}, func(a, b interface{}) bool {
+		return a.(*RcptOptions).Equal(b.(*RcptOptions))
+	})
+
+	empty := &RcptOptions{Notify: []DSNNotify{}, Extensions: map[string]string{}}
+	if !empty.Equal(&RcptOptions{}) {
+		t.Error("Empty and nil fields aren't equal")
+	}
+}
@@ -22,6 +22,10 @@ func parseCmd(line string) (cmd string, arg string, err error) {
 	switch {
 	case strings.HasPrefix(strings.ToUpper(line), "STARTTLS"):
 		return "STARTTLS", "", nil
+	case l >= 7 && strings.EqualFold(line[:7], "XCLIENT") && (l == 7 || line[7] == ' '):
+		return "XCLIENT", strings.TrimSpace(line[7:]), nil
+	case l >= 8 && strings.EqualFold(line[:8], "XFORWARD") && (l == 8 || line[8] == ' '):
+		return "XFORWARD", strings.TrimSpace(line[8:]), nil
 	case l == 0:
 		return "", "", nil
 	case l < 4:
@@ -42,29 +46,74 @@ func parseCmd(line string) (cmd string, arg string, err error) {
 	return strings.ToUpper(line[0:4]), strings.TrimSpace(line[5:]), nil
 }
 
-// Takes the arguments proceeding a command and files them
-// into a map[string]string after uppercasing each key.  Sample arg
-// string:
+// parseArgs parses the remaining parameters of a MAIL or RCPT command,
+// following the esmtp-param grammar of RFC 5321 section 4.1.2, into a map
+// by upper-cased keyword. Parameters without a value have an empty one.
+// Sample arg string:
 //
 //	" BODY=8BITMIME SIZE=1024 SMTPUTF8"
 //
-// The leading space is mandatory.
-func parseArgs(s string) (map[string]string, error) {
-	argMap := map[string]string{}
-	for _, arg := range strings.Fields(s) {
-		m := strings.Split(arg, "=")
-		switch len(m) {
-		case 2:
-			argMap[strings.ToUpper(m[0])] = m[1]
-		case 1:
-			argMap[strings.ToUpper(m[0])] = ""
-		default:
-			return nil, fmt.Errorf("failed to parse arg string: %q", arg)
+// Values end at the next space and may contain "=", as sent by some clients
+// in ENVID and ORCPT values, unless p.strict is set. In strict mode, the
+// leading space is mandatory and parameters are separated by a single one.
+func (p *parser) parseArgs() (map[string]string, error) {
+	var args []string
+	if !p.strict {
+		args = strings.Fields(p.s)
+	} else if p.s != "" {
+		if p.s[0] != ' ' {
+			return nil, fmt.Errorf("expected ' ' before parameters, got '%v'", string(p.s[0]))
 		}
+		args = strings.Split(p.s[1:], " ")
+	}
+	p.s = ""
+
+	argMap := make(map[string]string, len(args))
+	for _, arg := range args {
+		key, value, hasValue := strings.Cut(arg, "=")
+		if !isESMTPKeyword(key) {
+			return nil, fmt.Errorf("malformed parameter %q", arg)
+		}
+		if hasValue && !isESMTPValue(value) && (p.strict || !isESMTPValue(strings.ReplaceAll(value, "=", ""))) {
+			return nil, fmt.Errorf("malformed value for parameter %v", key)
+		}
+		key = strings.ToUpper(key)
+		if _, ok := argMap[key]; ok {
+			return nil, fmt.Errorf("duplicate parameter %v", key)
+		}
+		argMap[key] = value
 	}
 	return argMap, nil
 }
 
+// isESMTPKeyword reports whether s is a valid esmtp-keyword, as defined in
+// RFC 5321 section 4.1.2.
+func isESMTPKeyword(s string) bool {
+	if s == "" || s[0] == '-' {
+		return false
+	}
+	for _, ch := range s {
+		if !(ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || ch == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isESMTPValue reports whether s is a valid esmtp-value, as defined in RFC
+// 5321 section 4.1.2.
+func isESMTPValue(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, ch := range s {
+		if ch <= ' ' || ch == '=' || ch == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 func parseHelloArgument(arg string) (string, error) {
 	domain := arg
 	if idx := strings.IndexRune(arg, ' '); idx >= 0 {
@@ -102,6 +151,8 @@ func parseDeliverByArgument(arg string) *DeliverByOptions {
 // parser parses command arguments defined in RFC 5321 section 4.1.2.
 type parser struct {
 	s string
+	// Enforce the RFC 5321 grammar for paths, see Server.StrictSyntax
+	strict bool
 }
 
 func (p *parser) peekByte() (byte, bool) {
@@ -149,11 +200,17 @@ func (p *parser) parseReversePath() (string, error) {
 
 func (p *parser) parsePath() (string, error) {
 	hasBracket := p.acceptByte('<')
+	if p.strict && !hasBracket {
+		return "", fmt.Errorf("expected '<'")
+	}
 	if p.acceptByte('@') {
 		i := strings.IndexByte(p.s, ':')
 		if i < 0 {
 			return "", fmt.Errorf("malformed a-d-l")
 		}
+		if p.strict && !validADL(p.s[:i]) {
+			return "", fmt.Errorf("malformed a-d-l")
+		}
 		p.s = p.s[i+1:]
 	}
 	mbox, err := p.parseMailbox()
@@ -199,10 +256,36 @@ func (p *parser) parseMailbox() (string, error) {
 	if strings.HasSuffix(sb.String(), "@") {
 		return "", fmt.Errorf("domain is empty")
 	}
+	if p.strict {
+		domain := sb.String()[len(localPart)+1:]
+		if !validDomain(domain) && !validAddressLiteral(domain) {
+			return "", fmt.Errorf("invalid domain")
+		}
+	}
 
 	return sb.String(), nil
 }
 
+// validADL reports whether s is an a-d-l (source route) without its leading
+// "@", as defined in RFC 5321 section 4.1.2.
+func validADL(s string) bool {
+	for _, domain := range strings.Split(s, ",@") {
+		if !validDomain(domain) && !validAddressLiteral(domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAtext reports whether ch is an atext character, as defined in RFC 5322
+// section 3.2.3. UTF-8 is allowed, as defined in RFC 6531 section 3.3.
+func isAtext(ch byte) bool {
+	if ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch >= 0x80 {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-/=?^_`{|}~", ch) >= 0
+}
+
 func (p *parser) parseLocalPart() (string, error) {
 	var sb strings.Builder
 
@@ -218,20 +301,29 @@ func (p *parser) parseLocalPart() (string, error) {
 			if !ok {
 				return "", fmt.Errorf("malformed quoted-string")
 			}
+			if p.strict && (ch < ' ' || ch == 0x7f) {
+				// Not in qtextSMTP nor quoted-pairSMTP
+				return "", fmt.Errorf("malformed quoted-string")
+			}
 			sb.WriteByte(ch)
 		}
 	} else { // dot-string
 		for {
 			ch, ok := p.peekByte()
-			if !ok {
-				return sb.String(), nil
+			if !ok || ch == '@' {
+				s := sb.String()
+				if p.strict && (strings.HasPrefix(s, ".") || strings.HasSuffix(s, ".") || strings.Contains(s, "..")) {
+					return "", fmt.Errorf("malformed dot-string")
+				}
+				return s, nil
 			}
 			switch ch {
-			case '@':
-				return sb.String(), nil
 			case '(', ')', '<', '>', '[', ']', ':', ';', '\\', ',', '"', ' ', '\t':
 				return "", fmt.Errorf("malformed dot-string")
 			}
+			if p.strict && ch != '.' && !isAtext(ch) {
+				return "", fmt.Errorf("malformed dot-string")
+			}
 			p.readByte()
 			sb.WriteByte(ch)
 		}
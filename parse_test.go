@@ -1,6 +1,8 @@
 package smtp
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -15,7 +17,7 @@ func TestParser(t *testing.T) {
 		{"root@nsa.gov AUTH=asdf@example.org", "root@nsa.gov", " AUTH=asdf@example.org"},
 	}
 	for _, tc := range validReversePaths {
-		p := parser{tc.raw}
+		p := parser{s: tc.raw}
 		path, err := p.parseReversePath()
 		if err != nil {
 			t.Errorf("parser.parseReversePath(%q) = %v", tc.raw, err)
@@ -36,9 +38,152 @@ func TestParser(t *testing.T) {
 		"<root@nsa.gov",
 	}
 	for _, tc := range invalidReversePaths {
-		p := parser{tc}
+		p := parser{s: tc}
 		if path, err := p.parseReversePath(); err == nil {
 			t.Errorf("parser.parseReversePath(%q) = %q, want error", tc, path)
 		}
 	}
 }
+
+func TestParser_strict(t *testing.T) {
+	valid := []struct {
+		raw, path string
+	}{
+		{"<root@nsa.gov>", "root@nsa.gov"},
+		{"<first.last+tag@mail.example.org>", "first.last+tag@mail.example.org"},
+		{"<\"john doe\"@example.org>", "john doe@example.org"},
+		{"<root@[192.0.2.1]>", "root@[192.0.2.1]"},
+		{"<root@[IPv6:2001:db8::1]>", "root@[IPv6:2001:db8::1]"},
+		{"<@relay.example.org,@[192.0.2.1]:root@nsa.gov>", "root@nsa.gov"},
+		{"<résumé@exämple.org>", "résumé@exämple.org"},
+	}
+	for _, tc := range valid {
+		p := parser{s: tc.raw, strict: true}
+		path, err := p.parsePath()
+		if err != nil {
+			t.Errorf("parser.parsePath(%q) = %v", tc.raw, err)
+		} else if path != tc.path {
+			t.Errorf("parser.parsePath(%q) = %q, want %q", tc.raw, path, tc.path)
+		}
+	}
+
+	invalid := []string{
+		"root@nsa.gov",
+		" <root@nsa.gov>",
+		"<.root@nsa.gov>",
+		"<root.@nsa.gov>",
+		"<ro..ot@nsa.gov>",
+		"<ro\x7fot@nsa.gov>",
+		"<ro\x01ot@nsa.gov>",
+		"<\"ro\x01ot\"@nsa.gov>",
+		"<root@-nsa.gov>",
+		"<root@nsa_gov>",
+		"<root@nsa..gov>",
+		"<root@[192.0.2.300]>",
+		"<root@[2001:db8::1]>",
+		"<@relay_example.org:root@nsa.gov>",
+	}
+	for _, tc := range invalid {
+		p := parser{s: tc, strict: true}
+		if _, err := p.parsePath(); err == nil {
+			t.Errorf("parser.parsePath(%q) = nil error", tc)
+		}
+	}
+}
+
+func TestParser_parseArgs(t *testing.T) {
+	tests := []struct {
+		raw    string
+		strict bool
+		want   map[string]string
+	}{
+		{"", false, map[string]string{}},
+		{" BODY=8BITMIME SIZE=1024 SMTPUTF8", false, map[string]string{"BODY": "8BITMIME", "SIZE": "1024", "SMTPUTF8": ""}},
+		{" body=8BITMIME  size=1024\t", false, map[string]string{"BODY": "8BITMIME", "SIZE": "1024"}},
+		{" ORCPT=rfc822;root+40nsa.gov NOTIFY=SUCCESS,FAILURE", false, map[string]string{"ORCPT": "rfc822;root+40nsa.gov", "NOTIFY": "SUCCESS,FAILURE"}},
+		{" ENVID=YWJj==", false, map[string]string{"ENVID": "YWJj=="}},
+		{" X-ÉTÉ=été", false, nil},
+		{" X=été", false, map[string]string{"X": "été"}},
+		{" SIZE=", false, nil},
+		{" =1024", false, nil},
+		{" -SIZE=1024", false, nil},
+		{" X_Y=1", false, nil},
+		{" SIZE=1 size=2", false, nil},
+		{" ENVID==", false, nil},
+		{" BODY=8BITMIME SIZE=1024", true, map[string]string{"BODY": "8BITMIME", "SIZE": "1024"}},
+		{"", true, map[string]string{}},
+		{" ENVID=YWJj==", true, nil},
+		{" BODY=8BITMIME  SIZE=1024", true, nil},
+		{" SIZE=1024 ", true, nil},
+		{"SIZE=1024", true, nil},
+	}
+	for _, tc := range tests {
+		p := parser{s: tc.raw, strict: tc.strict}
+		args, err := p.parseArgs()
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("parser{strict: %v}.parseArgs(%q) = %v, want error", tc.strict, tc.raw, args)
+			}
+		} else if err != nil {
+			t.Errorf("parser{strict: %v}.parseArgs(%q) = %v", tc.strict, tc.raw, err)
+		} else if !reflect.DeepEqual(args, tc.want) {
+			t.Errorf("parser{strict: %v}.parseArgs(%q) = %v, want %v", tc.strict, tc.raw, args, tc.want)
+		}
+	}
+}
+
+func TestXtext(t *testing.T) {
+	for _, tc := range []struct {
+		raw, enc string
+	}{
+		{"root@nsa.gov", "root@nsa.gov"},
+		{"e=mc2+1@example.com", "e+3Dmc2+2B1@example.com"},
+		{"John Doe\t", "John+20Doe+09"},
+		{"caf\u00e9", "caf+C3+A9"},
+	} {
+		if enc := EncodeXtext(tc.raw); enc != tc.enc {
+			t.Errorf("EncodeXtext(%q) = %q, want %q", tc.raw, enc, tc.enc)
+		}
+		if raw, err := DecodeXtext(tc.enc); err != nil {
+			t.Errorf("DecodeXtext(%q) = %v", tc.enc, err)
+		} else if raw != tc.raw {
+			t.Errorf("DecodeXtext(%q) = %q, want %q", tc.enc, raw, tc.raw)
+		}
+	}
+
+	for _, enc := range []string{"+", "+4", "a+4g", "+2b", "tag+"} {
+		if _, err := DecodeXtext(enc); err == nil {
+			t.Errorf("DecodeXtext(%q) = nil error", enc)
+		}
+	}
+}
+
+func TestParseAddressLiteral(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want string // empty if invalid
+	}{
+		{"[192.0.2.1]", "192.0.2.1"},
+		{"[IPv6:2001:db8::1]", "2001:db8::1"},
+		{"[ipv6:2001:db8::1]", "2001:db8::1"},
+		{"192.0.2.1", ""},
+		{"[2001:db8::1]", ""},
+		{"[IPv6:192.0.2.1]", ""},
+		{"[example.org]", ""},
+	} {
+		ip, err := ParseAddressLiteral(tc.s)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("ParseAddressLiteral(%q) = %v, want an error", tc.s, ip)
+			}
+			continue
+		}
+		if err != nil || ip.String() != tc.want {
+			t.Errorf("ParseAddressLiteral(%q) = %v, %v, want %v", tc.s, ip, err, tc.want)
+			continue
+		}
+		if s := FormatAddressLiteral(ip); !strings.EqualFold(s, tc.s) {
+			t.Errorf("FormatAddressLiteral(%v) = %q, want %q", ip, s, tc.s)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package smtp
+
+import (
+	"log/slog"
+)
+
+// PolicyMode is the enforcement mode of a policy module.
+type PolicyMode int
+
+const (
+	// Rejections are sent to the client.
+	PolicyEnforce PolicyMode = iota
+	// Rejections are only logged to Server.Logger, and the client is served
+	// as if the policy allowed it. This allows rolling out a policy safely.
+	PolicyMonitor
+)
+
+// Policy is implemented by policy modules supporting a monitor mode. It's
+// checked for ConnectionChecker and RateLimiter implementations, and is
+// implemented by TarpitPolicy and ValidationProfile. Policy modules which
+// don't implement it are enforced.
+type Policy interface {
+	PolicyMode() PolicyMode
+}
+
+// policyMode returns the mode of the policy module p.
+func policyMode(p interface{}) PolicyMode {
+	if p, ok := p.(Policy); ok {
+		return p.PolicyMode()
+	}
+	return PolicyEnforce
+}
+
+// monitored reports whether the policy module p is in monitor mode. If so,
+// the rejection it asked for is logged, and mustn't be sent to the client.
+func (c *Conn) monitored(p interface{}, event string, code int, text string) bool {
+	if policyMode(p) != PolicyMonitor {
+		return false
+	}
+	c.log(slog.LevelInfo, event, "rejection not enforced in monitor mode",
+		slog.Bool(logKeyMonitor, true),
+		slog.Int(logKeyCode, code),
+		slog.String(logKeyReply, text))
+	return true
+}
@@ -0,0 +1,134 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum length of a PROXY protocol version 1 header, line ending included.
+const maxProxyHeaderLen = 107
+
+// ProxyHop is a hop of the chain of proxies between the original client and
+// the server, see Conn.ProxyChain.
+type ProxyHop struct {
+	// Network address of the hop.
+	Addr net.Addr
+	// How the address was asserted by the next hop: "PROXY" for a PROXY
+	// protocol header, "XCLIENT" or "XFORWARD" for the commands of the same
+	// name. Empty for the peer of the connection.
+	Via string
+}
+
+// ProxyChain returns the hops between the original client and the server,
+// starting with the original client and ending with the peer of the
+// connection.
+//
+// Each hop was asserted by the next one, which was itself trusted to do so:
+// the peer must be in Server.PROXYTrustedNets to assert a hop with a PROXY
+// header, and the client as known before XCLIENT or XFORWARD must be in
+// Server.XCLIENTTrustedNets or Server.XFORWARDTrustedNets. A trusted load
+// balancer can't let its own clients issue XCLIENT this way.
+//
+// An XCLIENT command replaces the hop asserted by a previous one, since it's
+// issued by the same proxy. The XFORWARD hop is only included during the
+// transaction it was given for. A hop asserted without an address repeats
+// the address of the previous one.
+func (c *Conn) ProxyChain() []ProxyHop {
+	hops := make([]ProxyHop, 0, 4)
+	if c.xforward != nil && c.xforward.Addr != nil {
+		hops = append(hops, ProxyHop{Addr: c.xforward.Addr, Via: "XFORWARD"})
+	}
+	if c.xclient != nil && c.xclient.Addr != nil {
+		hops = append(hops, ProxyHop{Addr: c.xclient.Addr, Via: "XCLIENT"})
+	}
+	if c.proxyAddr != nil {
+		hops = append(hops, ProxyHop{Addr: c.proxyAddr, Via: "PROXY"})
+	}
+	return append(hops, ProxyHop{Addr: c.conn.RemoteAddr()})
+}
+
+// proxyPeerAddr returns the address of the hop connected to the server: the
+// one given with a PROXY header if any, or the one of the peer.
+func (c *Conn) proxyPeerAddr() net.Addr {
+	if c.proxyAddr != nil {
+		return c.proxyAddr
+	}
+	return c.conn.RemoteAddr()
+}
+
+// readProxyHeader reads the PROXY protocol version 1 header sent by a trusted
+// peer before anything else, including the TLS handshake of implicit TLS
+// connections.
+func (c *Conn) readProxyHeader() error {
+	nc := c.conn
+	if tc, ok := nc.(*tls.Conn); ok {
+		nc = tc.NetConn()
+	}
+
+	if d := c.server.timeout(c.server.CommandTimeout); d != 0 {
+		nc.SetReadDeadline(time.Now().Add(d))
+		defer nc.SetReadDeadline(time.Time{})
+	}
+
+	// Read byte by byte, the rest of the stream isn't ours to buffer
+	var line []byte
+	b := make([]byte, 1)
+	for !strings.HasSuffix(string(line), "\r\n") {
+		if len(line) >= maxProxyHeaderLen {
+			return errors.New("header too long")
+		}
+		if _, err := io.ReadFull(nc, b); err != nil {
+			return err
+		}
+		line = append(line, b[0])
+	}
+
+	addr, err := parseProxyHeader(strings.TrimSuffix(string(line), "\r\n"))
+	if err != nil {
+		return err
+	}
+	c.proxyAddr = addr
+	if addr != nil {
+		c.log(slog.LevelDebug, "proxy", "client address given with PROXY header")
+	}
+	return nil
+}
+
+// parseProxyHeader parses a PROXY protocol version 1 header, without its line
+// ending, and returns the source address. The address is nil for the UNKNOWN
+// protocol.
+func parseProxyHeader(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, errors.New("malformed header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed source address %q", fields[2])
+	}
+	if dst := net.ParseIP(fields[3]); dst == nil {
+		return nil, fmt.Errorf("malformed destination address %q", fields[3])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed source port %q", fields[4])
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("malformed destination port %q", fields[5])
+	}
+	return &net.TCPAddr{IP: NormalizeIP(ip), Port: int(port)}, nil
+}
@@ -0,0 +1,145 @@
+package smtp
+
+import (
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// RateLimiter throttles clients. See Server.RateLimiter.
+//
+// Limiters implementing Policy may be put in monitor mode.
+//
+// The address passed to its methods is the one of the SMTP client, as
+// returned by Conn.ClientAddr. Implementations must be safe for concurrent
+// use.
+type RateLimiter interface {
+	// AllowConnection reports whether a new connection from addr may be
+	// served. Refused connections are replied to with 421 and closed.
+	AllowConnection(addr net.Addr) bool
+	// AllowCommand reports whether a command from addr may be processed.
+	// Refused commands are replied to with 450.
+	AllowCommand(addr net.Addr) bool
+}
+
+// TokenBucketLimiter is a RateLimiter using a token bucket per client IP
+// address. Clients without an IP address, e.g. on Unix sockets, are never
+// throttled.
+//
+// The zero value doesn't limit anything. Fields must not be modified once the
+// limiter is in use.
+type TokenBucketLimiter struct {
+	// Connections allowed per minute and per IP address. Zero means
+	// unlimited.
+	ConnectionsPerMinute float64
+	// Connections allowed in a burst. If zero, ConnectionsPerMinute is used.
+	ConnectionBurst int
+
+	// Commands allowed per second and per IP address. Zero means unlimited.
+	CommandsPerSecond float64
+	// Commands allowed in a burst. If zero, CommandsPerSecond is used.
+	CommandBurst int
+
+	// Mode is PolicyMonitor to only log refused connections and commands.
+	Mode PolicyMode
+
+	// Source of the current time, to refill buckets. If nil, SystemClock is
+	// used.
+	Clock Clock
+
+	mu        sync.Mutex
+	conns     map[netip.Addr]*tokenBucket
+	cmds      map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+}
+
+var (
+	_ RateLimiter = (*TokenBucketLimiter)(nil)
+	_ Policy      = (*TokenBucketLimiter)(nil)
+)
+
+// PolicyMode implements Policy.
+func (l *TokenBucketLimiter) PolicyMode() PolicyMode {
+	return l.Mode
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket and takes a token from it, if any is available.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// AllowConnection implements RateLimiter.
+func (l *TokenBucketLimiter) AllowConnection(addr net.Addr) bool {
+	return l.allow(&l.conns, addr, l.ConnectionsPerMinute/60, burstSize(l.ConnectionBurst, l.ConnectionsPerMinute))
+}
+
+// AllowCommand implements RateLimiter.
+func (l *TokenBucketLimiter) AllowCommand(addr net.Addr) bool {
+	return l.allow(&l.cmds, addr, l.CommandsPerSecond, burstSize(l.CommandBurst, l.CommandsPerSecond))
+}
+
+func burstSize(burst int, rate float64) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return math.Max(1, math.Ceil(rate))
+}
+
+func (l *TokenBucketLimiter) allow(buckets *map[netip.Addr]*tokenBucket, addr net.Addr, rate, burst float64) bool {
+	if rate <= 0 {
+		return true
+	}
+	ip, ok := netip.AddrFromSlice(addrIP(addr))
+	if !ok {
+		return true
+	}
+	ip = ip.Unmap()
+
+	now := clockOrSystem(l.Clock).Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	if *buckets == nil {
+		*buckets = make(map[netip.Addr]*tokenBucket)
+	}
+	b, ok := (*buckets)[ip]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		(*buckets)[ip] = b
+	}
+	return b.take(now, rate, burst)
+}
+
+// sweep forgets clients whose buckets are full again, at most once per
+// minute.
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	sweepBuckets(l.conns, now, l.ConnectionsPerMinute/60, burstSize(l.ConnectionBurst, l.ConnectionsPerMinute))
+	sweepBuckets(l.cmds, now, l.CommandsPerSecond, burstSize(l.CommandBurst, l.CommandsPerSecond))
+}
+
+func sweepBuckets(buckets map[netip.Addr]*tokenBucket, now time.Time, rate, burst float64) {
+	for ip, b := range buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+			delete(buckets, ip)
+		}
+	}
+}
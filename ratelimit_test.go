@@ -0,0 +1,68 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// testClock is a Clock whose time only changes when now is modified.
+type testClock struct {
+	Clock
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	clock := &testClock{Clock: SystemClock, now: time.Now()}
+	l := &TokenBucketLimiter{
+		ConnectionsPerMinute: 2,
+		CommandsPerSecond:    1,
+		CommandBurst:         3,
+		Clock:                clock,
+	}
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	b := &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.2"), Port: 1234}
+
+	for i := 0; i < 2; i++ {
+		if !l.AllowConnection(a) {
+			t.Fatalf("connection %v refused", i)
+		}
+	}
+	if l.AllowConnection(a) {
+		t.Errorf("connection above the burst allowed")
+	}
+	if !l.AllowConnection(b) {
+		t.Errorf("connection from another address refused")
+	}
+	clock.now = clock.now.Add(30 * time.Second)
+	if !l.AllowConnection(a) {
+		t.Errorf("connection refused after refill")
+	}
+
+	for i := 0; i < 3; i++ {
+		if !l.AllowCommand(a) {
+			t.Fatalf("command %v refused", i)
+		}
+	}
+	if l.AllowCommand(a) {
+		t.Errorf("command above the burst allowed")
+	}
+	clock.now = clock.now.Add(time.Second)
+	if !l.AllowCommand(a) {
+		t.Errorf("command refused after refill")
+	}
+
+	if !l.AllowCommand(&net.UnixAddr{Name: "/run/smtp.sock", Net: "unix"}) {
+		t.Errorf("command from a Unix socket refused")
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	l.AllowCommand(b)
+	if len(l.conns) != 0 || len(l.cmds) != 1 {
+		t.Errorf("idle clients not forgotten: %v connection and %v command buckets", len(l.conns), len(l.cmds))
+	}
+}
@@ -0,0 +1,88 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MaxReplyLineLength is the maximum length of a reply line, including the
+// trailing CRLF, as defined in RFC 5321 section 4.5.3.1.5.
+const MaxReplyLineLength = 512
+
+// WriteResponse writes an SMTP reply to w, in the wire format.
+//
+// Each line of text, separated by "\n", is sent on its own reply line, with a
+// "<code>-" prefix for all but the last one. Lines too long to fit in
+// MaxReplyLineLength are wrapped, on spaces when possible.
+//
+// The enhanced code is added to the last line. If it is EnhancedCodeNotSet,
+// X.0.0 is used for 2xx, 4xx and 5xx replies, where X is the code class. If it
+// is NoEnhancedCode, it is omitted.
+func WriteResponse(w io.Writer, code int, enhCode EnhancedCode, text ...string) error {
+	_, err := w.Write(formatResponse(code, enhCode, text))
+	return err
+}
+
+func formatResponse(code int, enhCode EnhancedCode, text []string) []byte {
+	// All responses must include an enhanced code, if it is missing - use
+	// a generic code X.0.0.
+	if enhCode == EnhancedCodeNotSet {
+		cat := code / 100
+		switch cat {
+		case 2, 4, 5:
+			enhCode = EnhancedCode{cat, 0, 0}
+		default:
+			enhCode = NoEnhancedCode
+		}
+	}
+
+	prefix := strconv.Itoa(code)
+	var enh string
+	if enhCode != NoEnhancedCode {
+		enh = enhCode.String() + " "
+	}
+
+	// "<code>-" and CRLF
+	maxLen := MaxReplyLineLength - len(prefix) - 3
+
+	var lines []string
+	for _, l := range strings.Split(strings.Join(text, "\n"), "\n") {
+		lines = append(lines, wrapReplyLine(l, maxLen)...)
+	}
+	// The enhanced code must fit on the last line as well
+	if last := lines[len(lines)-1]; len(enh)+len(last) > maxLen {
+		lines = append(lines[:len(lines)-1], wrapReplyLine(last, maxLen-len(enh))...)
+	}
+
+	var buf bytes.Buffer
+	for i, l := range lines {
+		buf.WriteString(prefix)
+		if i < len(lines)-1 {
+			buf.WriteByte('-')
+		} else {
+			buf.WriteByte(' ')
+			buf.WriteString(enh)
+		}
+		buf.WriteString(l)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// wrapReplyLine splits s into lines no longer than maxLen.
+func wrapReplyLine(s string, maxLen int) []string {
+	var lines []string
+	for len(s) > maxLen {
+		i := strings.LastIndexByte(s[:maxLen+1], ' ')
+		if i <= 0 {
+			lines = append(lines, s[:maxLen])
+			s = s[maxLen:]
+		} else {
+			lines = append(lines, s[:i])
+			s = s[i+1:]
+		}
+	}
+	return append(lines, s)
+}
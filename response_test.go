@@ -0,0 +1,61 @@
+package smtp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteResponse(t *testing.T) {
+	tests := []struct {
+		code    int
+		enhCode EnhancedCode
+		text    []string
+		want    string
+	}{
+		{250, EnhancedCode{2, 1, 0}, []string{"OK"}, "250 2.1.0 OK\r\n"},
+		{250, EnhancedCodeNotSet, []string{"OK"}, "250 2.0.0 OK\r\n"},
+		{354, EnhancedCodeNotSet, []string{"Go ahead"}, "354 Go ahead\r\n"},
+		{220, NoEnhancedCode, []string{"localhost ESMTP"}, "220 localhost ESMTP\r\n"},
+		{250, NoEnhancedCode, []string{"localhost", "PIPELINING", "8BITMIME"}, "250-localhost\r\n250-PIPELINING\r\n250 8BITMIME\r\n"},
+		{451, EnhancedCode{4, 3, 0}, []string{"Try again\nlater"}, "451-Try again\r\n451 4.3.0 later\r\n"},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		if err := WriteResponse(&buf, tc.code, tc.enhCode, tc.text...); err != nil {
+			t.Fatalf("WriteResponse() = %v", err)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("WriteResponse(%v, %v, %q) = %q, want %q", tc.code, tc.enhCode, tc.text, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestWriteResponse_longLine(t *testing.T) {
+	words := strings.Repeat("lorem ipsum ", 100)
+	var buf bytes.Buffer
+	WriteResponse(&buf, 550, EnhancedCode{5, 7, 1}, words, strings.Repeat("x", 1000))
+
+	lines := strings.SplitAfter(buf.String(), "\r\n")
+	lines = lines[:len(lines)-1]
+	var text string
+	for i, l := range lines {
+		if len(l) > MaxReplyLineLength {
+			t.Errorf("Line %v is %v bytes long", i, len(l))
+		}
+		if !strings.HasSuffix(l, "\r\n") {
+			t.Errorf("Line %v doesn't end with CRLF: %q", i, l)
+		}
+		prefix := "550-"
+		if i == len(lines)-1 {
+			prefix = "550 5.7.1 "
+		}
+		if !strings.HasPrefix(l, prefix) {
+			t.Errorf("Line %v = %q, want prefix %q", i, l, prefix)
+		}
+		text += strings.TrimSuffix(strings.TrimPrefix(l, prefix), "\r\n")
+	}
+	if want := strings.ReplaceAll(words, " ", "") + strings.Repeat("x", 1000); strings.ReplaceAll(text, " ", "") != want {
+		t.Errorf("Text was altered by wrapping")
+	}
+}
@@ -0,0 +1,333 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// The XOAUTH2 mechanism name.
+const XOAuth2 = "XOAUTH2"
+
+// OAuth2Error is returned by Client.Auth when the server rejects an OAuth 2.0
+// bearer token, with the OAUTHBEARER or XOAUTH2 mechanism.
+//
+// It holds the JSON error sent by the server in the failure challenge, as
+// defined in RFC 7628 section 3.2.2.
+type OAuth2Error struct {
+	Status              string `json:"status"`
+	Schemes             string `json:"schemes,omitempty"`
+	Scope               string `json:"scope,omitempty"`
+	OpenIDConfiguration string `json:"openid-configuration,omitempty"`
+
+	// The final error returned by the server, if any.
+	SMTPError *SMTPError `json:"-"`
+}
+
+// Error implements error.
+func (err *OAuth2Error) Error() string {
+	s := fmt.Sprintf("smtp: OAuth 2.0 authentication failed (status %v)", err.Status)
+	if err.Scope != "" {
+		s += fmt.Sprintf(", scope %q required", err.Scope)
+	}
+	return s
+}
+
+// Unwrap returns the final SMTP error.
+func (err *OAuth2Error) Unwrap() error {
+	if err.SMTPError == nil {
+		return nil
+	}
+	return err.SMTPError
+}
+
+// failureClient is implemented by SASL clients which receive a structured
+// failure challenge before the final server error.
+type failureClient interface {
+	sasl.Client
+
+	failure() *OAuth2Error
+}
+
+// oauth2Client implements the client side of OAUTHBEARER and XOAUTH2.
+type oauth2Client struct {
+	mech string
+	ir   []byte
+	// The response to send after a failure challenge
+	abort []byte
+
+	err *OAuth2Error
+}
+
+func (a *oauth2Client) Start() (mech string, ir []byte, err error) {
+	return a.mech, a.ir, nil
+}
+
+func (a *oauth2Client) Next(challenge []byte) ([]byte, error) {
+	if a.err != nil {
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+
+	a.err = &OAuth2Error{}
+	if err := json.Unmarshal(challenge, a.err); err != nil {
+		return nil, fmt.Errorf("smtp: malformed OAuth 2.0 error challenge: %v", err)
+	}
+	return a.abort, nil
+}
+
+func (a *oauth2Client) failure() *OAuth2Error {
+	return a.err
+}
+
+// NewOAuthBearerClient returns a client for the OAUTHBEARER mechanism, as
+// defined in RFC 7628.
+//
+// Unlike sasl.NewOAuthBearerClient, the failure challenge is acknowledged as
+// required by the RFC and the authentication error is returned by Client.Auth
+// as an *OAuth2Error.
+func NewOAuthBearerClient(opts *sasl.OAuthBearerOptions) sasl.Client {
+	mech, ir, _ := sasl.NewOAuthBearerClient(opts).Start()
+	return &oauth2Client{
+		mech:  mech,
+		ir:    ir,
+		abort: []byte{0x01},
+	}
+}
+
+// NewXOAuth2Client returns a client for the XOAUTH2 mechanism, used by Gmail
+// and Microsoft 365.
+//
+// Authentication errors are returned by Client.Auth as an *OAuth2Error.
+func NewXOAuth2Client(username, token string) sasl.Client {
+	return &oauth2Client{
+		mech:  XOAuth2,
+		ir:    []byte("user=" + username + "\x01auth=Bearer " + token + "\x01\x01"),
+		abort: []byte{},
+	}
+}
+
+// SCRAM mechanism names.
+const (
+	ScramSHA256     = "SCRAM-SHA-256"
+	ScramSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// Channel binding types, as defined in RFC 5929 and RFC 9266.
+const (
+	channelBindingTLSUnique   = "tls-unique"
+	channelBindingTLSExporter = "tls-exporter"
+)
+
+// connClient is implemented by SASL clients which depend on the connection
+// state, e.g. for channel binding.
+type connClient interface {
+	sasl.Client
+
+	// init is called by Client.Auth before Start, with the TLS connection
+	// state (nil if TLS isn't used) and the mechanisms advertised by the
+	// server.
+	init(tlsState *tls.ConnectionState, mechs []string)
+}
+
+// scramClient implements the client side of SCRAM-SHA-256 and
+// SCRAM-SHA-256-PLUS, as defined in RFC 5802 and RFC 7677.
+type scramClient struct {
+	username, password string
+	nonce              string
+
+	mech        string
+	gs2Header   string
+	cbData      []byte
+	cbErr       error
+	clientFirst string // client-first-message-bare
+	serverSig   []byte
+	step        int
+}
+
+// NewScramSHA256Client returns a client for the SCRAM-SHA-256 mechanism, as
+// defined in RFC 7677.
+//
+// When the connection uses TLS and the server advertises SCRAM-SHA-256-PLUS,
+// the client binds the authentication to the TLS channel, with tls-exporter
+// for TLS 1.3 and tls-unique for older versions. The server signature is
+// checked before the final response is sent.
+//
+// The username and password must be valid UTF-8 and already prepared as per
+// SASLprep: no normalization is performed.
+func NewScramSHA256Client(username, password string) sasl.Client {
+	return &scramClient{
+		username: username,
+		password: password,
+		mech:     ScramSHA256,
+		// Not using channel binding, and no TLS
+		gs2Header: "n,,",
+	}
+}
+
+func (a *scramClient) init(tlsState *tls.ConnectionState, mechs []string) {
+	if tlsState == nil {
+		return
+	}
+
+	plus := false
+	for _, mech := range mechs {
+		if strings.EqualFold(mech, ScramSHA256Plus) {
+			plus = true
+		}
+	}
+	if !plus {
+		// We support channel binding, but the server doesn't: tell it so
+		// that a downgrade attack can be detected
+		a.gs2Header = "y,,"
+		return
+	}
+
+	var cbType string
+	if tlsState.Version >= tls.VersionTLS13 {
+		cbType = channelBindingTLSExporter
+		// RFC 9266 section 2
+		a.cbData, a.cbErr = tlsState.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	} else {
+		cbType = channelBindingTLSUnique
+		a.cbData = tlsState.TLSUnique
+		if len(a.cbData) == 0 {
+			a.cbErr = errors.New("smtp: tls-unique channel binding unavailable")
+		}
+	}
+	a.mech = ScramSHA256Plus
+	a.gs2Header = "p=" + cbType + ",,"
+}
+
+func (a *scramClient) Start() (mech string, ir []byte, err error) {
+	if a.cbErr != nil {
+		return "", nil, a.cbErr
+	}
+	if a.nonce == "" {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return "", nil, err
+		}
+		a.nonce = base64.StdEncoding.EncodeToString(b)
+	}
+
+	a.clientFirst = "n=" + scramEscape(a.username) + ",r=" + a.nonce
+	return a.mech, []byte(a.gs2Header + a.clientFirst), nil
+}
+
+func (a *scramClient) Next(challenge []byte) ([]byte, error) {
+	a.step++
+	switch a.step {
+	case 1:
+		return a.clientFinal(string(challenge))
+	case 2:
+		return a.verifyServerFinal(string(challenge))
+	default:
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+}
+
+func (a *scramClient) clientFinal(serverFirst string) ([]byte, error) {
+	attrs, err := parseScramAttrs(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := attrs['m']; ok {
+		return nil, errors.New("smtp: unsupported SCRAM mandatory extension")
+	}
+	nonce := attrs['r']
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, errors.New("smtp: invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs['s'])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("smtp: invalid SCRAM salt")
+	}
+	iter, err := strconv.Atoi(attrs['i'])
+	if err != nil || iter <= 0 {
+		return nil, errors.New("smtp: invalid SCRAM iteration count")
+	}
+
+	cb := append([]byte(a.gs2Header), a.cbData...)
+	clientFinal := "c=" + base64.StdEncoding.EncodeToString(cb) + ",r=" + nonce
+	authMessage := []byte(a.clientFirst + "," + serverFirst + "," + clientFinal)
+
+	saltedPassword := scramHi([]byte(a.password), salt, iter)
+	clientKey := scramHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSig := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSig[i]
+	}
+	serverKey := scramHMAC(saltedPassword, []byte("Server Key"))
+	a.serverSig = scramHMAC(serverKey, authMessage)
+
+	clientFinal += ",p=" + base64.StdEncoding.EncodeToString(proof)
+	return []byte(clientFinal), nil
+}
+
+func (a *scramClient) verifyServerFinal(serverFinal string) ([]byte, error) {
+	attrs, err := parseScramAttrs(serverFinal)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := attrs['e']; ok {
+		return nil, fmt.Errorf("smtp: SCRAM authentication failed: %v", e)
+	}
+	sig, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || !hmac.Equal(sig, a.serverSig) {
+		return nil, errors.New("smtp: invalid SCRAM server signature")
+	}
+	return []byte{}, nil
+}
+
+// parseScramAttrs parses a comma-separated list of SCRAM attributes.
+func parseScramAttrs(s string) (map[byte]string, error) {
+	attrs := make(map[byte]string)
+	for _, kv := range strings.Split(s, ",") {
+		if len(kv) < 2 || kv[1] != '=' {
+			return nil, fmt.Errorf("smtp: malformed SCRAM message: %q", s)
+		}
+		attrs[kv[0]] = kv[2:]
+	}
+	return attrs, nil
+}
+
+// scramEscape encodes a username as a SCRAM saslname.
+func scramEscape(s string) string {
+	s = strings.ReplaceAll(s, "=", "=3D")
+	return strings.ReplaceAll(s, ",", "=2C")
+}
+
+func scramHMAC(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// scramHi is PBKDF2 with HMAC-SHA-256, producing a single block.
+func scramHi(password, salt []byte, iter int) []byte {
+	h := hmac.New(sha256.New, password)
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
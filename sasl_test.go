@@ -0,0 +1,198 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+)
+
+const oauth2FailureChallenge = "eyJzdGF0dXMiOiI0MDEiLCJzY2hlbWVzIjoiQmVhcmVyIiwic2NvcGUiOiJodHRwczovL21haWwuZ29vZ2xlLmNvbS8ifQ=="
+
+func testOAuth2Client(t *testing.T, a sasl.Client, server, client string) error {
+	server = strings.Join(strings.Split(server, "\n"), "\r\n")
+	client = strings.Join(strings.Split(client, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := NewClient(fake)
+	defer c.Close()
+
+	err := c.Auth(a)
+
+	bcmdbuf.Flush()
+	if actualcmds := cmdbuf.String(); client != actualcmds {
+		t.Errorf("Got:\n%s\nExpected:\n%s", actualcmds, client)
+	}
+	return err
+}
+
+func TestOAuthBearerClient(t *testing.T) {
+	a := NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+		Username: "user@example.com",
+		Token:    "tok",
+		Host:     "mx.example.com",
+		Port:     587,
+	})
+	server := `220 hello world
+250-mx.example.com at your service
+250 AUTH OAUTHBEARER
+235 2.7.0 Accepted
+`
+	client := `EHLO localhost
+AUTH OAUTHBEARER bixhPXVzZXJAZXhhbXBsZS5jb20sAWhvc3Q9bXguZXhhbXBsZS5jb20BcG9ydD01ODcBYXV0aD1CZWFyZXIgdG9rAQE=
+`
+	if err := testOAuth2Client(t, a, server, client); err != nil {
+		t.Fatalf("Auth() = %v", err)
+	}
+}
+
+func TestOAuthBearerClient_failure(t *testing.T) {
+	a := NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+		Username: "user@example.com",
+		Token:    "tok",
+		Host:     "mx.example.com",
+		Port:     587,
+	})
+	server := `220 hello world
+250-mx.example.com at your service
+250 AUTH OAUTHBEARER
+334 ` + oauth2FailureChallenge + `
+535 5.7.8 Authentication failed
+`
+	client := `EHLO localhost
+AUTH OAUTHBEARER bixhPXVzZXJAZXhhbXBsZS5jb20sAWhvc3Q9bXguZXhhbXBsZS5jb20BcG9ydD01ODcBYXV0aD1CZWFyZXIgdG9rAQE=
+AQ==
+*
+`
+	err := testOAuth2Client(t, a, server, client)
+
+	var oauthErr *OAuth2Error
+	if !errors.As(err, &oauthErr) {
+		t.Fatalf("Auth() = %v, want OAuth2Error", err)
+	}
+	if oauthErr.Status != "401" || oauthErr.Schemes != "Bearer" || oauthErr.Scope != "https://mail.google.com/" {
+		t.Errorf("Auth() returned %#v", oauthErr)
+	}
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 535 || smtpErr.EnhancedCode != (EnhancedCode{5, 7, 8}) {
+		t.Errorf("Auth() = %v, want wrapped 535 5.7.8 SMTPError", err)
+	}
+}
+
+func TestXOAuth2Client_failure(t *testing.T) {
+	a := NewXOAuth2Client("user@example.com", "tok")
+	server := `220 hello world
+250-mx.example.com at your service
+250 AUTH XOAUTH2
+334 ` + oauth2FailureChallenge + `
+535 5.7.8 Username and Password not accepted
+`
+	client := `EHLO localhost
+AUTH XOAUTH2 dXNlcj11c2VyQGV4YW1wbGUuY29tAWF1dGg9QmVhcmVyIHRvawEB
+
+*
+`
+	err := testOAuth2Client(t, a, server, client)
+
+	var oauthErr *OAuth2Error
+	if !errors.As(err, &oauthErr) || oauthErr.Status != "401" {
+		t.Fatalf("Auth() = %v, want OAuth2Error with status 401", err)
+	}
+	if oauthErr.SMTPError == nil || oauthErr.SMTPError.Code != 535 {
+		t.Errorf("Auth() returned SMTP error %v, want 535", oauthErr.SMTPError)
+	}
+}
+
+func TestScramSHA256Client(t *testing.T) {
+	// Example from RFC 7677 section 3
+	a := NewScramSHA256Client("user", "pencil")
+	a.(*scramClient).nonce = "rOprNGfwEbeRWgbNEkqO"
+	server := `220 hello world
+250-mx.example.com at your service
+250 AUTH PLAIN SCRAM-SHA-256
+334 cj1yT3ByTkdmd0ViZVJXZ2JORWtxTyVodllEcFdVYTJSYVRDQWZ1eEZJbGopaE5sRiRrMCxzPVcyMlphSjBTTlk3c29Fc1VFamI2Z1E9PSxpPTQwOTY=
+334 dj02cnJpVFJCaTIzV3BSUi93dHVwK21NaFVaVW4vZEI1bkxUSlJzamw5NUc0PQ==
+235 2.7.0 Accepted
+`
+	client := `EHLO localhost
+AUTH SCRAM-SHA-256 biwsbj11c2VyLHI9ck9wck5HZndFYmVSV2diTkVrcU8=
+Yz1iaXdzLHI9ck9wck5HZndFYmVSV2diTkVrcU8laHZZRHBXVWEyUmFUQ0FmdXhGSWxqKWhObEYkazAscD1kSHpiWmFwV0lrNGpVaE4rVXRlOXl0YWc5empmTUhnc3FtbWl6N0FuZFZRPQ==
+
+`
+	if err := testOAuth2Client(t, a, server, client); err != nil {
+		t.Fatalf("Auth() = %v", err)
+	}
+}
+
+func TestScramSHA256Client_badServerSignature(t *testing.T) {
+	a := NewScramSHA256Client("user", "pencil")
+	a.(*scramClient).nonce = "rOprNGfwEbeRWgbNEkqO"
+	server := `220 hello world
+250-mx.example.com at your service
+250 AUTH SCRAM-SHA-256
+334 cj1yT3ByTkdmd0ViZVJXZ2JORWtxTyVodllEcFdVYTJSYVRDQWZ1eEZJbGopaE5sRiRrMCxzPVcyMlphSjBTTlk3c29Fc1VFamI2Z1E9PSxpPTQwOTY=
+334 dj1BQUFBVFJCaTIzV3BSUi93dHVwK21NaFVaVW4vZEI1bkxUSlJzamw5NUc0PQ==
+501 5.7.0 Authentication aborted
+`
+	client := `EHLO localhost
+AUTH SCRAM-SHA-256 biwsbj11c2VyLHI9ck9wck5HZndFYmVSV2diTkVrcU8=
+Yz1iaXdzLHI9ck9wck5HZndFYmVSV2diTkVrcU8laHZZRHBXVWEyUmFUQ0FmdXhGSWxqKWhObEYkazAscD1kSHpiWmFwV0lrNGpVaE4rVXRlOXl0YWc5empmTUhnc3FtbWl6N0FuZFZRPQ==
+*
+`
+	if err := testOAuth2Client(t, a, server, client); err == nil {
+		t.Fatal("Auth() = nil, want server signature error")
+	}
+}
+
+func TestScramSHA256Client_channelBinding(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     *tls.ConnectionState
+		mechs     []string
+		mech      string
+		gs2Header string
+	}{
+		{"no TLS", nil, []string{ScramSHA256, ScramSHA256Plus}, ScramSHA256, "n,,"},
+		{"no PLUS", &tls.ConnectionState{Version: tls.VersionTLS12, TLSUnique: []byte("unique")}, []string{ScramSHA256}, ScramSHA256, "y,,"},
+		{"tls-unique", &tls.ConnectionState{Version: tls.VersionTLS12, TLSUnique: []byte("unique")}, []string{ScramSHA256, ScramSHA256Plus}, ScramSHA256Plus, "p=tls-unique,,"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := NewScramSHA256Client("user", "pencil").(*scramClient)
+			a.nonce = "rOprNGfwEbeRWgbNEkqO"
+			a.init(tc.state, tc.mechs)
+			mech, ir, err := a.Start()
+			if err != nil {
+				t.Fatalf("Start() = %v", err)
+			}
+			if mech != tc.mech {
+				t.Errorf("Start() mech = %v, want %v", mech, tc.mech)
+			}
+			if want := tc.gs2Header + "n=user,r=rOprNGfwEbeRWgbNEkqO"; string(ir) != want {
+				t.Errorf("Start() ir = %q, want %q", ir, want)
+			}
+
+			serverFirst := "r=rOprNGfwEbeRWgbNEkqOserver,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+			resp, err := a.Next([]byte(serverFirst))
+			if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			cb := tc.gs2Header
+			if tc.mech == ScramSHA256Plus {
+				cb += string(tc.state.TLSUnique)
+			}
+			want := "c=" + base64.StdEncoding.EncodeToString([]byte(cb)) + ",r="
+			if !strings.HasPrefix(string(resp), want) {
+				t.Errorf("Next() = %q, want prefix %q", resp, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package smtp
+
+import (
+	"log/slog"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// Scrubber removes internal details from response text supplied by the
+// backend. Its Scrub method can be used as Server.ScrubResponse.
+type Scrubber struct {
+	// Drop lines which look like stack trace frames.
+	StackTraces bool
+	// Replace absolute file paths with "[path]".
+	Paths bool
+	// Replace private, loopback and link-local IP addresses with "[addr]".
+	PrivateAddrs bool
+	// Replace these host names, and their subdomains, with "[host]".
+	InternalHosts []string
+}
+
+var (
+	stackFrameRegexps = []*regexp.Regexp{
+		regexp.MustCompile(`^goroutine \d+ \[`),
+		regexp.MustCompile(`^panic: `),
+		regexp.MustCompile(`^\s*[\w./*()\[\]-]+\(.*\)$`),                // Go function
+		regexp.MustCompile(`^\s*\S+\.(go|py|java|js|rb|c|cc|rs):\d+\b`), // file:line
+		regexp.MustCompile(`^\s*at \S+`),                                // Java, JavaScript
+		regexp.MustCompile(`^Traceback \(most recent call last\)`),
+		regexp.MustCompile(`^\s*File ".*", line \d+`), // Python
+	}
+	unixPathRegexp    = regexp.MustCompile(`(^|[\s("'=:])(/[\w.@+-]+){2,}/?(:\d+)*`)
+	windowsPathRegexp = regexp.MustCompile(`\b[A-Za-z]:\\[\w\\.@+ -]*[\w.]`)
+	ipv4Regexp        = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}\b`)
+	ipv6Regexp        = regexp.MustCompile(`[0-9A-Fa-f]{0,4}(:[0-9A-Fa-f]{0,4}){2,7}`)
+)
+
+// Scrub returns text without the internal details selected by s.
+func (s *Scrubber) Scrub(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if s.StackTraces && isStackFrame(line) {
+			continue
+		}
+		if s.Paths {
+			line = unixPathRegexp.ReplaceAllString(line, "$1[path]")
+			line = windowsPathRegexp.ReplaceAllString(line, "[path]")
+		}
+		if s.PrivateAddrs {
+			line = ipv4Regexp.ReplaceAllStringFunc(line, scrubAddr)
+			line = ipv6Regexp.ReplaceAllStringFunc(line, scrubAddr)
+		}
+		for _, host := range s.InternalHosts {
+			line = scrubHost(line, host)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "[redacted]"
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isStackFrame(line string) bool {
+	for _, re := range stackFrameRegexps {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func scrubAddr(s string) string {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return s
+	}
+	addr = addr.Unmap()
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return "[addr]"
+	}
+	return s
+}
+
+// scrubHost replaces host and its subdomains in s, case-insensitively.
+func scrubHost(s, host string) string {
+	host = strings.Trim(host, ".")
+	if host == "" {
+		return s
+	}
+	re := regexp.MustCompile(`(?i)(^|[^\w.-])([\w-]+\.)*` + regexp.QuoteMeta(host) + `\b`)
+	return re.ReplaceAllString(s, "$1[host]")
+}
+
+// scrub passes response text supplied by the backend through
+// Server.ScrubResponse, if any. The original text is logged when modified.
+func (c *Conn) scrub(text string) string {
+	if c.server.ScrubResponse == nil {
+		return text
+	}
+	scrubbed := c.server.ScrubResponse(text)
+	if scrubbed != text {
+		c.log(slog.LevelWarn, "scrub", "response text scrubbed", slog.String("original", text))
+	}
+	return scrubbed
+}
@@ -0,0 +1,33 @@
+package smtp
+
+import (
+	"testing"
+)
+
+func TestScrubber(t *testing.T) {
+	s := &Scrubber{
+		StackTraces:   true,
+		Paths:         true,
+		PrivateAddrs:  true,
+		InternalHosts: []string{"corp.example"},
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"User unknown", "User unknown"},
+		{"open /srv/mail/queue/42: permission denied", "open [path]: permission denied"},
+		{`open C:\mail\queue\42: denied`, "open [path]: denied"},
+		{"dial tcp 10.0.0.5:5432: connection refused", "dial tcp [addr]:5432: connection refused"},
+		{"dial tcp 192.0.2.1:25: timeout", "dial tcp 192.0.2.1:25: timeout"},
+		{"dial [fd00::1]:25 failed", "dial [[addr]]:25 failed"},
+		{"db1.Corp.Example is down", "[host] is down"},
+		{"notcorp.example is fine", "notcorp.example is fine"},
+		{"panic: oops\ngoroutine 1 [running]:\nmain.main()\n\t/src/main.go:12 +0x1d\nTry later", "Try later"},
+		{"Traceback (most recent call last):\n  File \"app.py\", line 3, in <module>", "[redacted]"},
+	}
+	for _, tc := range tests {
+		if got := s.Scrub(tc.in); got != tc.want {
+			t.Errorf("Scrub(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -4,12 +4,19 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp/smtplog"
 )
 
 var ErrServerClosed = errors.New("smtp: server already closed")
@@ -26,8 +33,30 @@ type Server struct {
 	Network string
 	// TCP or Unix address to listen on.
 	Addr string
-	// The server TLS configuration.
+	// Options of the Unix socket created by ListenAndServe, see ListenUnix.
+	UnixSocket *UnixSocketOptions
+	// The server TLS configuration, for STARTTLS and ListenAndServeTLS. Its
+	// GetCertificate and GetConfigForClient callbacks are called for each
+	// handshake. To replace it while the server is running, see ReloadTLS.
 	TLSConfig *tls.Config
+	// Clients STARTTLS is offered to, by address of the underlying
+	// connection. If nil, it's offered to all clients when TLSConfig is set.
+	STARTTLSNets *TrustedNets
+	// Clients required to use TLS, by address of the underlying connection.
+	// Until they issue STARTTLS, AUTH and other extensions aren't advertised,
+	// and commands other than EHLO, HELO, STARTTLS, NOOP, RSET and QUIT are
+	// rejected. These clients must be offered STARTTLS, see STARTTLSNets.
+	TLSRequiredNets *TrustedNets
+	// Called with the ClientHello of STARTTLS handshakes. Returning an error
+	// aborts the handshake. The hook must not write to the connection. For
+	// implicit TLS, see tls.Config.GetConfigForClient.
+	OnTLSClientHello func(c *Conn, hello *tls.ClientHelloInfo) error
+	// Called after TLS handshakes, with the negotiated version, cipher
+	// suite, server name and client certificates, e.g. to reject weak
+	// handshakes. Returning an error closes the connection, after a 454 reply
+	// for STARTTLS, or a 554 reply for implicit TLS. If the error is an
+	// *SMTPError, it's used as the reply instead.
+	OnTLSHandshake func(c *Conn, state tls.ConnectionState) error
 	// Enable LMTP mode, as defined in RFC 2033.
 	LMTP bool
 
@@ -41,12 +70,279 @@ type Server struct {
 	ReadTimeout       time.Duration
 	WriteTimeout      time.Duration
 
+	// Maximum durations of the phases of a session, as recommended by
+	// RFC 5321 section 4.5.3.2: waiting for the first command after the
+	// greeting, waiting for each other command, receiving the content of a
+	// message, from the 354 reply to the final dot or for each BDAT chunk,
+	// and TLS handshakes. Unlike ReadTimeout, DataTimeout limits the total
+	// duration of the transfer, so that clients can't keep a connection
+	// busy by sending a message slowly: the client is then sent
+	// ErrDataTimeout and the connection is closed. If zero, ReadTimeout is
+	// used.
+	GreetingTimeout     time.Duration
+	CommandTimeout      time.Duration
+	DataTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+
+	// Duration without commands after which a connection is idle. Unlike
+	// ReadTimeout, the connection is kept open: sessions implementing
+	// IdleSession are notified, e.g. to release pooled resources, and OnIdle
+	// is called. Zero disables idle notifications.
+	IdleTimeout time.Duration
+	// Called when a connection becomes idle, from another goroutine than the
+	// one serving the connection, while it waits for the next command.
+	// Returning an error closes the connection, after a "421 4.4.2 Idle
+	// timeout" reply. If the error is an *SMTPError, it's used as the reply
+	// instead.
+	OnIdle func(c *Conn) error
+
+	// Structured logger. Records carry the connection identifier, remote
+	// address and HELO name, with the attribute keys of the smtplog package.
+	// Protocol events are logged with the debug level. If nil, only ErrorLog
+	// is used.
+	Logger *slog.Logger
+
+	// Send the text of backend errors which aren't an *SMTPError to clients.
+	// By default, such errors are replied to with a generic message, to
+	// avoid leaking internal details. See TempError and PermError.
+	ExposeErrors bool
+
+	// Rewrites the text of backend errors before it is sent to clients, e.g.
+	// to strip stack traces, file paths and internal host names. The original
+	// text is logged when modified. See Scrubber.
+	ScrubResponse func(text string) string
+
+	// Peers which must send a PROXY protocol version 1 header before
+	// anything else, e.g. load balancers. The source address of the header
+	// replaces the one of the peer as the client address, and must itself
+	// be trusted to use XCLIENT or XFORWARD. Headers aren't expected from
+	// other peers. See Conn.ProxyChain and
+	// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+	PROXYTrustedNets *TrustedNets
+	// Clients allowed to override the client attributes, such as the
+	// address, with the XCLIENT command, e.g. SMTP proxies. The address
+	// given with a PROXY header is checked if any. If nil, XCLIENT is not
+	// supported. See https://www.postfix.org/XCLIENT_README.html.
+	XCLIENTTrustedNets *TrustedNets
+	// Report the client address given with XCLIENT as the remote address of
+	// the connection: Conn.Conn().RemoteAddr(), and the remote address of
+	// logs and error reports. Nothing else depends on it: rate limits,
+	// connection limits, connection checkers, SPF and DMARC checks use the
+	// client address given with XCLIENT whether it's set or not, see
+	// Conn.ClientAddr. Trusted networks such as XCLIENTTrustedNets are
+	// matched against the hop issuing the command, see Conn.ProxyChain.
+	XCLIENTRewritesRemoteAddr bool
+	// Called with the attributes of valid XCLIENT commands before they're
+	// applied, e.g. to deny LOGIN while allowing ADDR and HELO. Attribute
+	// names are upper-cased, and values are decoded, "[UNAVAILABLE]"
+	// included. The map must not be retained. Returning an error rejects the
+	// command with a 550 reply, or the error if it's an *SMTPError.
+	XCLIENTPolicy func(conn *Conn, attrs map[string]string) error
+	// Clients allowed to forward the attributes of their own clients with
+	// the XFORWARD command, e.g. Postfix before-queue content filters. The
+	// client address given with a PROXY header or XCLIENT is checked if any.
+	// If nil, XFORWARD is not supported. See Conn.XFORWARDData and
+	// https://www.postfix.org/XFORWARD_README.html.
+	XFORWARDTrustedNets *TrustedNets
+	// Validation of the XRCPTFORWARD RCPT parameter, used by Dovecot proxies
+	// to forward recipient fields. Accepted values are passed to the session
+	// in RcptOptions.Extensions, see ParseXRCPTFORWARD. If nil, XRCPTFORWARD is
+	// not supported.
+	XRCPTFORWARDPolicy *XRCPTFORWARDPolicy
+
+	// Defer the rejections of MAIL and RCPT commands by the session with a
+	// security or policy enhanced status code (X.7.X) to the end of the
+	// message, to reveal less to probing clients. These commands are
+	// accepted, and the message is rejected with the first permanent
+	// deferred rejection, or else the first temporary one.
+	DeferPolicyRejections bool
+
+	// Advertise the ETRN (RFC 1985) capability, handled by sessions
+	// implementing ETRNSession.
+	EnableETRN bool
+	// Clients allowed to use ETRN without authenticating, by client
+	// address. If nil, only authenticated clients may use ETRN.
+	ETRNTrustedNets *TrustedNets
+
+	// Advertise the ATRN (RFC 2645) capability, handled by sessions
+	// implementing ATRNSession. Only authenticated clients may use ATRN.
+	EnableATRN bool
+
+	// Verbs rejected with 502 in any state, e.g. "VRFY" or "EXPN", including
+	// custom ones. The obsolete TURN (RFC 821) is always rejected. Clients
+	// sending a disabled verb are tagged with "disabled:" followed by the
+	// verb, see Conn.Tags, to identify scanners.
+	DisabledCommands []string
+
+	// Maximum number of concurrent connections, globally and per client IP
+	// address. Excess connections are replied to with 421 and closed. Zero
+	// means unlimited.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	// Maximum number of concurrent sessions, enforced before connections are
+	// handled: beyond this, new connections wait up to MaxSessionsWait for a
+	// session to end, without being read from, then are replied to with "421
+	// 4.3.2 Service not available" and closed. Unlike MaxConnections, this
+	// bounds the number of goroutines under connection floods. Zero means
+	// unlimited. MaxSessions must not be changed while the server is
+	// running.
+	MaxSessions     int
+	MaxSessionsWait time.Duration
+	// Maximum number of bytes buffered by a connection, and by all
+	// connections: command lines, header sections collected for
+	// DKIMVerifier and DMARCEvaluator, decoded AUTH responses and messages
+	// up to DataSpoolThreshold. Command lines are read no further than the
+	// remaining budget, QUIT and RSET excepted. Backends can account their
+	// own buffers with Conn.ReserveMemory. A command or message exceeding a
+	// budget is deferred with "451 4.3.1 Insufficient system resources".
+	// Zero means unlimited. See also MemoryMetrics.
+	MaxConnectionMemory int64
+	MaxMemory           int64
+	// Number of bytes of each message accounted for against
+	// MaxConnectionMemory and MaxMemory as the backend reads it, for
+	// backends holding messages in memory up to this threshold before
+	// spooling them to disk. The bytes are released at the end of the
+	// transaction. Zero accounts for whole messages, a negative value for
+	// none.
+	DataSpoolThreshold int64
+	// Returns the key connections are counted by for MaxConnectionsPerIP,
+	// given Conn.ClientAddr. An empty key is never limited. If nil, the IP
+	// address is used.
+	ConnectionLimitKey func(addr net.Addr) string
+
+	// Checks connections before the greeting, and may reject them or tag
+	// them for the backend. See ConnectionChecker.
+	ConnectionChecker ConnectionChecker
+	// Time to wait before sending the greeting, after the connection checks.
+	// Clients must wait for the greeting before sending commands, as
+	// required by RFC 5321 section 4.3.1: clients sending data in the
+	// meantime, which is typical of spam bots, are replied to with
+	// EarlyTalkerError and disconnected. Zero disables the delay.
+	GreetingDelay time.Duration
+	// Reply to clients sending data before the greeting. If nil, "554 5.3.2
+	// Data received before the greeting" is used.
+	EarlyTalkerError *SMTPError
+
+	// Checks the sender of each transaction with SPF. The result is given to
+	// the backend in MailOptions.SPF and Conn.SPF. See the smtpspf package.
+	SPFChecker SPFChecker
+	// Prepend a Received-SPF header field with the SPFChecker result to
+	// messages.
+	ReceivedSPFHeader bool
+
+	// Verifies the DKIM signatures of messages received by sessions
+	// implementing DKIMSession, or by all sessions if DKIMPolicy is set. See
+	// the smtpdkim package.
+	DKIMVerifier DKIMVerifier
+	// Called with the DKIM verification results when the session reads the
+	// end of a message, e.g. to reject messages without a passing signature
+	// from some domains. Returning an error rejects the message: the session
+	// reads the error instead of io.EOF, and the message is replied to with
+	// "550 5.7.20 No passing DKIM signature found", or the error if it's an
+	// *SMTPError, unless the session returns another error. LMTPData isn't
+	// subject to the policy.
+	DKIMPolicy func(conn *Conn, results []DKIMResult) error
+	// Verifies the BATV signature of recipients, to reject bounces to
+	// addresses which didn't send the bounced message. Valid signatures are
+	// removed from the addresses given to the backend. See the smtpbatv
+	// package.
+	BATVVerifier BATVVerifier
+	// Evaluates the DMARC policy of the RFC5322.From domain of messages,
+	// with the SPFChecker and DKIMVerifier results, when the session reads
+	// the end of a message. Messages failing DMARC with a reject disposition
+	// are rejected like with DKIMPolicy, with "550 5.7.1 Rejected by DMARC
+	// policy for <domain>", unless the evaluator implements Policy and is in
+	// monitor mode. Other dispositions, such as quarantine, are left to the
+	// session, see Conn.DMARC and AuthenticationResults. See the smtpdmarc
+	// package.
+	DMARCEvaluator DMARCEvaluator
+
+	// Delays replies to clients accumulating errors, and disconnects them
+	// past a threshold. If nil, errors are replied to immediately.
+	Tarpit *TarpitPolicy
+
+	// Maximum numbers of unknown commands, syntax errors and rejected
+	// recipients per connection. Errors above a limit are handled according
+	// to ErrorLimitPolicy. Zero means 3 unknown commands, 3 syntax errors
+	// and unlimited recipient failures. A negative value means unlimited.
+	MaxUnknownCommands  int
+	MaxSyntaxErrors     int
+	MaxFailedRecipients int
+	// Decides what to do with the n-th error counted towards limit, for each
+	// error above the limit, e.g. to slow down clients before disconnecting
+	// them. If nil, ErrorLimitDisconnect is used.
+	ErrorLimitPolicy func(c *Conn, limit ErrorLimit, n int) ErrorLimitAction
+	// Delay before the reply to errors with ErrorLimitSlowDown. If zero, 5
+	// seconds is used.
+	ErrorLimitDelay time.Duration
+
+	// Envelope validation profile, bundling address syntax strictness, HELO
+	// checks, line ending policy and default size limits. If nil, only the
+	// command syntax is checked. See ValidationStrictRFC,
+	// ValidationPermissiveInternet and ValidationInternalOnly.
+	Validation *ValidationProfile
+	// Parse commands following the RFC 5321 grammar strictly: command lines
+	// must end with CRLF, HELO and EHLO take a single domain or address
+	// literal, and paths must be enclosed in angle brackets right after the
+	// colon, with a dot-string or quoted-string local-part and a domain made
+	// of LDH labels or an IPv4 or IPv6 address literal. Malformed senders and
+	// recipients are replied to with 501 5.1.7 and 501 5.1.3 explaining the
+	// error.
+	StrictSyntax bool
+
+	// Throttles connections and commands per client. Excess connections are
+	// replied to with 421 and closed, excess commands with 450. See
+	// TokenBucketLimiter.
+	RateLimiter RateLimiter
+
+	// Receives connection, command, authentication, message and TLS events,
+	// e.g. to export metrics. If nil, no events are reported.
+	Metrics ServerMetrics
+
+	// Source of the current time and of the timers of idle timeouts and
+	// tarpit delays, e.g. to test them deterministically. If nil,
+	// SystemClock is used.
+	Clock Clock
+	// Source of the random connection identifiers. If nil, crypto/rand is
+	// used.
+	Rand io.Reader
+
+	// Number of commands and responses kept per connection for diagnostics,
+	// see Conn.History. The history is included in panic reports. Zero
+	// disables it.
+	CommandHistory int
+
+	// Label the goroutines serving connections for the pprof profiler, with
+	// the listener address and the protocol phase, so that CPU profiles of
+	// busy servers attribute time to protocol phases. See
+	// ProfilerLabelListener and ProfilerLabelState.
+	EnableProfilerLabels bool
+	// Returns additional pprof labels for a connection, as key-value pairs,
+	// e.g. the autonomous system of the client. It's called before the
+	// greeting and at the first command of each protocol phase.
+	ProfilerLabels func(conn *Conn) []string
+
+	// Record how clients speak SMTP, e.g. for bot detection. See
+	// Conn.Fingerprint.
+	EnableFingerprinting bool
+
+	// SASL mechanisms allowed on connections without TLS even if
+	// AllowInsecureAuth is false. This is useful for mechanisms which don't
+	// expose credentials, such as SCRAM-SHA-256.
+	InsecureAuthMechanisms []string
+
 	// Advertise SMTPUTF8 (RFC 6531) capability.
 	// Should be used only if backend supports it.
 	EnableSMTPUTF8 bool
+	// Handling of command lines containing 8-bit bytes. The default is to
+	// pass them to the session as is.
+	EightBitCommands EightBitCommands
 
 	// Advertise REQUIRETLS (RFC 8689) capability.
 	// Should be used only if backend supports it.
+	//
+	// The capability is only advertised and the MAIL parameter is only
+	// accepted on TLS sessions.
 	EnableREQUIRETLS bool
 
 	// Advertise BINARYMIME (RFC 3030) capability.
@@ -57,6 +353,11 @@ type Server struct {
 	// Should be used only if backend supports it.
 	EnableDSN bool
 
+	// Accept unknown MAIL FROM parameters instead of rejecting them with
+	// 500, and pass them to the session in MailOptions.Extensions, e.g.
+	// X-parameters added by an upstream relay.
+	EnableMAILExtensions bool
+
 	// Advertise RRVS (RFC 7293) capability.
 	// Should be used only if backend supports it.
 	EnableRRVS bool
@@ -70,6 +371,14 @@ type Server struct {
 	// Only use if DELIVERBY is enabled.
 	MinimumDeliverByTime time.Duration
 
+	// Advertise FUTURERELEASE (RFC 4865) capability.
+	// Should only be used if backend supports it.
+	EnableFUTURERELEASE bool
+	// The maximum time, with seconds precision, a client may ask the release
+	// of a message to be delayed by. If zero, a week is used.
+	// Only use if FUTURERELEASE is enabled.
+	MaxFutureRelease time.Duration
+
 	// Advertise MT-PRIORITY (RFC 6710) capability.
 	// Should only be used if backend supports it.
 	EnableMTPRIORITY bool
@@ -85,13 +394,41 @@ type Server struct {
 	wg   sync.WaitGroup
 	done chan struct{}
 
+	// Parent of connection contexts, cancelled when the server is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	locker    sync.Mutex
 	listeners []net.Listener
 	conns     map[*Conn]struct{}
+
+	// Connections counted against MaxConnections and MaxConnectionsPerIP
+	limitedConns int
+	connsPerKey  map[string]int
+	// Semaphore of MaxSessions, see sessionSlots
+	sessions chan struct{}
+	// TLS configuration set by ReloadTLS, a tlsConfigValue
+	reloadedTLS atomic.Value
+	// Bytes reserved by connections, see ReserveMemory
+	memoryLocker sync.Mutex
+	memoryUsed   int64
+
+	auths     map[string]SASLServerFactory
+	authMechs []string // registered mechanisms, in order
+
+	extensions []registeredExtension  // see RegisterExtension
+	commands   map[string]CommandFunc // see HandleCommand
+
+	middlewares []func(next CommandHandler) CommandHandler
+	handler     CommandHandler // middlewares applied to the default handler
 }
 
+// SASLServerFactory creates a SASL server for a connection.
+type SASLServerFactory func(conn *Conn) sasl.Server
+
 // New creates a new SMTP server.
 func NewServer(be Backend) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		// Doubled maximum line length per RFC 5321 (Section 4.5.3.1.6)
 		MaxLineLength: 2000,
@@ -100,7 +437,93 @@ func NewServer(be Backend) *Server {
 		done:     make(chan struct{}, 1),
 		ErrorLog: log.New(os.Stderr, "smtp/server ", log.LstdFlags),
 		conns:    make(map[*Conn]struct{}),
+		auths:    make(map[string]SASLServerFactory),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+const defaultMaxFutureRelease = 7 * 24 * time.Hour
+
+func (s *Server) maxFutureRelease() time.Duration {
+	if s.MaxFutureRelease == 0 {
+		return defaultMaxFutureRelease
+	}
+	return s.MaxFutureRelease
+}
+
+// EnableAuth enables a SASL authentication mechanism on the server.
+//
+// Mechanisms are advertised in the order they are enabled, before the
+// mechanisms provided by sessions implementing AuthSession. A mechanism
+// enabled on the server takes precedence over the AuthSession one with the
+// same name. Enabling a mechanism twice replaces its factory.
+//
+// EnableAuth must not be called while the server is running.
+func (s *Server) EnableAuth(name string, f SASLServerFactory) {
+	name = strings.ToUpper(name)
+	if s.auths == nil {
+		s.auths = make(map[string]SASLServerFactory)
+	}
+	if _, ok := s.auths[name]; !ok {
+		s.authMechs = append(s.authMechs, name)
+	}
+	s.auths[name] = f
+}
+
+// CommandHandler handles a command sent by a client.
+type CommandHandler interface {
+	// HandleCommand handles a command. The verb is upper-cased. The handler
+	// is responsible for sending a response to the client.
+	HandleCommand(conn *Conn, verb, arg string)
+}
+
+// CommandHandlerFunc is an adapter to use an ordinary function as a
+// CommandHandler.
+type CommandHandlerFunc func(conn *Conn, verb, arg string)
+
+// HandleCommand calls f(conn, verb, arg).
+func (f CommandHandlerFunc) HandleCommand(conn *Conn, verb, arg string) {
+	f(conn, verb, arg)
+}
+
+// Use adds a middleware to the command handling chain. It is invoked for
+// every command sent by clients, and can reply directly, e.g. to reject a
+// command, or call next, optionally with a rewritten command.
+//
+// Middlewares are called in the order they are added. Use must not be called
+// while the server is running.
+//
+// When a middleware is registered, pipelined RCPT commands are passed one at a
+// time to BatchRcptSession.RcptBatch.
+func (s *Server) Use(mw func(next CommandHandler) CommandHandler) {
+	s.middlewares = append(s.middlewares, mw)
+
+	var h CommandHandler = CommandHandlerFunc(func(conn *Conn, verb, arg string) {
+		conn.dispatch(verb, arg)
+	})
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	s.handler = h
+}
+
+// CommandFunc handles a command with a custom verb, see Server.HandleCommand.
+// It's responsible for sending a reply to the client, unless it returns an
+// error: an *SMTPError is sent as is, other errors result in a 451 reply.
+type CommandFunc func(conn *Conn, arg string) error
+
+// HandleCommand registers a handler for a custom command verb, e.g. an
+// operational command such as "XSTATUS". The verb isn't advertised in EHLO
+// replies, see RegisterExtension for this.
+//
+// Built-in verbs can't be overridden. Registering a verb twice replaces its
+// handler. HandleCommand must not be called while the server is running.
+func (s *Server) HandleCommand(verb string, f CommandFunc) {
+	if s.commands == nil {
+		s.commands = make(map[string]CommandFunc)
 	}
+	s.commands[strings.ToUpper(verb)] = f
 }
 
 // Serve accepts incoming connections on the Listener l.
@@ -136,13 +559,28 @@ func (s *Server) Serve(l net.Listener) error {
 			return err
 		}
 
+		if !s.acquireSession() {
+			// Reply in the background, the TLS handshake of implicit TLS
+			// listeners could hold up the accept loop
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.rejectSession(newListenerConn(c, s, l))
+			}()
+			continue
+		}
+
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
+			defer s.releaseSession()
 
-			err := s.handleConn(newConn(c, s))
+			conn := newListenerConn(c, s, l)
+			conn.setProfilerState("connect")
+			err := s.handleConn(conn)
 			if err != nil {
-				s.ErrorLog.Printf("error handling %v: %s", c.RemoteAddr(), err)
+				s.ErrorLog.Printf("error handling %v: %s", conn.remoteAddr(), err)
+				conn.log(slog.LevelError, "error", "connection error", slog.String(smtplog.ErrorKey, err.Error()))
 			}
 		}()
 	}
@@ -153,48 +591,120 @@ func (s *Server) handleConn(c *Conn) error {
 	s.conns[c] = struct{}{}
 	s.locker.Unlock()
 
+	c.log(slog.LevelInfo, "connect", "connection opened")
+	if s.Metrics != nil {
+		s.Metrics.ConnectionOpened()
+	}
 	defer func() {
 		c.Close()
+		c.log(slog.LevelInfo, "disconnect", "connection closed", slog.Duration("duration", s.clock().Now().Sub(c.Timing().Connected)))
+		if s.Metrics != nil {
+			s.Metrics.ConnectionClosed(atomic.LoadInt64(&c.bytesIn), atomic.LoadInt64(&c.bytesOut))
+		}
 
 		s.locker.Lock()
 		delete(s.conns, c)
 		s.locker.Unlock()
+		c.releaseAllMemory()
 	}()
 
-	if tlsConn, ok := c.conn.(*tls.Conn); ok {
-		if d := s.ReadTimeout; d != 0 {
-			c.conn.SetReadDeadline(time.Now().Add(d))
+	if s.PROXYTrustedNets.Contains(c.conn.RemoteAddr()) {
+		if err := c.readProxyHeader(); err != nil {
+			return fmt.Errorf("smtp: invalid PROXY header: %v", err)
 		}
-		if d := s.WriteTimeout; d != 0 {
-			c.conn.SetWriteDeadline(time.Now().Add(d))
+	}
+
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		err := c.handshake(tlsConn)
+		if s.Metrics != nil {
+			s.Metrics.TLSHandshake(err)
 		}
-		if err := tlsConn.Handshake(); err != nil {
+		if err != nil {
 			return err
 		}
+		if err := c.checkTLSHandshake(); err != nil {
+			c.writeTLSRejection(554, EnhancedCode{5, 7, 0}, err)
+			return nil
+		}
+	}
+
+	if rl := s.RateLimiter; rl != nil && !rl.AllowConnection(c.ClientAddr()) &&
+		!c.monitored(rl, "rate_limit", 421, "Too many connections, try again later") {
+		c.log(slog.LevelWarn, "rate_limit", "connection rate limit exceeded")
+		c.Kick(421, EnhancedCode{4, 7, 0}, "Too many connections, try again later")
+		return nil
+	}
+	if !s.acquireConnLimit(c) {
+		c.log(slog.LevelWarn, "conn_limit", "connection limit reached")
+		c.Kick(421, EnhancedCode{4, 7, 0}, "Too many connections, try again later")
+		return nil
+	}
+	defer s.releaseConnLimit(c)
+
+	if !c.checkConnection() || !c.waitGreetingDelay() {
+		return nil
 	}
 
 	c.greet()
 
+	timeout := s.timeout(s.GreetingTimeout)
 	for {
-		line, err := c.readLine()
+		if !c.awaitCommand(timeout) {
+			c.writeResponse(errShuttingDown.Code, errShuttingDown.EnhancedCode, errShuttingDown.Message)
+			return nil
+		}
+		stopIdle := c.watchIdle()
+		line, bareLF, err := c.readCommandLine()
+		c.commandReceived()
+		stopIdle()
+		timeout = s.timeout(s.CommandTimeout)
 		if err == nil {
-			cmd, arg, err := parseCmd(line)
+			if bareLF && s.StrictSyntax {
+				c.protocolError(LimitSyntaxErrors, 500, EnhancedCode{5, 5, 2}, "Bare LF line endings are not allowed")
+				continue
+			}
+			line, ok := c.checkEightBit(line)
+			if !ok {
+				continue
+			}
+			cmd, arg, ok := s.parseExtensionCmd(line)
+			if !ok {
+				cmd, arg, err = parseCmd(line)
+			}
 			if err != nil {
-				c.protocolError(501, EnhancedCode{5, 5, 2}, "Bad command")
+				c.protocolError(LimitSyntaxErrors, 501, EnhancedCode{5, 5, 2}, "Bad command")
 				continue
 			}
 
+			// The line is accounted for while the command is handled. QUIT
+			// and RSET free memory, they're always allowed.
+			var reserved int64
+			if cmd := strings.ToUpper(cmd); cmd != "QUIT" && cmd != "RSET" {
+				reserved = int64(len(line))
+			}
+			if err := c.ReserveMemory(reserved); err != nil {
+				c.writeError(0, EnhancedCode{}, err)
+				continue
+			}
 			c.handle(cmd, arg)
+			c.ReleaseMemory(reserved)
 		} else {
 			if err == io.EOF || errors.Is(err, net.ErrClosed) {
 				return nil
 			}
-			if err == ErrTooLongLine {
+			if err == errInsufficientMemory {
+				c.writeError(0, EnhancedCode{}, err)
+				continue
+			}
+			if err == ErrLineTooLong {
 				c.writeResponse(500, EnhancedCode{5, 4, 0}, "Too long line, closing connection")
 				return nil
 			}
 
-			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() && s.shuttingDown() {
+				c.writeResponse(errShuttingDown.Code, errShuttingDown.EnhancedCode, errShuttingDown.Message)
+				return nil
+			} else if ok && neterr.Timeout() {
 				c.writeResponse(421, EnhancedCode{4, 4, 2}, "Idle timeout, bye bye")
 				return nil
 			}
@@ -205,6 +715,25 @@ func (s *Server) handleConn(c *Conn) error {
 	}
 }
 
+// timeout returns the timeout of a phase of sessions, falling back to
+// ReadTimeout.
+func (s *Server) timeout(d time.Duration) time.Duration {
+	if d == 0 {
+		return s.ReadTimeout
+	}
+	return d
+}
+
+// shuttingDown reports whether Shutdown or Close has been called.
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Server) network() string {
 	if s.Network != "" {
 		return s.Network
@@ -227,7 +756,13 @@ func (s *Server) ListenAndServe() error {
 		addr = ":smtp"
 	}
 
-	l, err := net.Listen(network, addr)
+	var l net.Listener
+	var err error
+	if network == "unix" {
+		l, err = ListenUnix(addr, s.UnixSocket)
+	} else {
+		l, err = net.Listen(network, addr)
+	}
 	if err != nil {
 		return err
 	}
@@ -247,12 +782,16 @@ func (s *Server) ListenAndServeTLS() error {
 		addr = ":smtps"
 	}
 
-	l, err := tls.Listen(network, addr, s.TLSConfig)
+	if s.tlsConfig() == nil {
+		return errors.New("smtp: missing TLS configuration")
+	}
+
+	l, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
 
-	return s.Serve(l)
+	return s.Serve(tls.NewListener(l, s.implicitTLSConfig()))
 }
 
 // Close immediately closes all active listeners and connections.
@@ -280,16 +819,26 @@ func (s *Server) Close() error {
 	}
 	s.locker.Unlock()
 
+	if s.cancel != nil {
+		s.cancel()
+	}
+
 	return err
 }
 
 // Shutdown gracefully shuts down the server without interrupting any
-// active connections. Shutdown works by first closing all open
-// listeners and then waiting indefinitely for connections to return to
-// idle and then shut down.
+// message being received. Shutdown works by first closing all open
+// listeners, then sending "421 4.3.2 Server shutting down" to connections
+// waiting for a command and closing them. Connections receiving a message,
+// with DATA or BDAT, are closed the same way once it's received.
 // If the provided context expires before the shutdown is complete,
 // Shutdown returns the context's error, otherwise it returns any
 // error returned from closing the Server's underlying Listener(s).
+//
+// When the context expires, messages still being received are aborted: the
+// Reader passed to Session.Data returns ErrServerShutdown, the client is sent
+// a 451 4.3.0 response and the connection is closed, after Session.Logout is
+// called. Other connections are closed.
 func (s *Server) Shutdown(ctx context.Context) error {
 	select {
 	case <-s.done:
@@ -305,6 +854,9 @@ func (s *Server) Shutdown(ctx context.Context) error {
 			err = lerr
 		}
 	}
+	for conn := range s.conns {
+		conn.interruptIdle()
+	}
 	s.locker.Unlock()
 
 	connDone := make(chan struct{})
@@ -315,6 +867,16 @@ func (s *Server) Shutdown(ctx context.Context) error {
 
 	select {
 	case <-ctx.Done():
+		s.locker.Lock()
+		for conn := range s.conns {
+			if !conn.abortData() {
+				conn.Close()
+			}
+		}
+		s.locker.Unlock()
+		if s.cancel != nil {
+			s.cancel()
+		}
 		return ctx.Err()
 	case <-connDone:
 		return err
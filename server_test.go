@@ -4,12 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
+	"reflect"
+	"runtime/pprof"
 	"strings"
 	"sync"
 	"testing"
@@ -17,6 +21,7 @@ import (
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtptest"
 )
 
 type message struct {
@@ -51,6 +56,9 @@ type backend struct {
 
 	panicOnMail bool
 	userErr     error
+
+	// Notified when a session is logged out.
+	logouts chan struct{}
 }
 
 func (be *backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
@@ -102,6 +110,9 @@ func (s *session) Reset() {
 }
 
 func (s *session) Logout() error {
+	if s.backend.logouts != nil {
+		s.backend.logouts <- struct{}{}
+	}
 	return nil
 }
 
@@ -311,6 +322,48 @@ func testServerEhlo(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *sm
 	return
 }
 
+// testTLSConfig returns a server TLS configuration with a freshly generated
+// self-signed certificate for "localhost".
+func testTLSConfig(t *testing.T) *tls.Config {
+	config, _, err := smtptest.NewTLSConfig("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// startTLS issues STARTTLS on c and returns the upgraded connection.
+func startTLS(t *testing.T, c net.Conn, scanner *bufio.Scanner) (net.Conn, *bufio.Scanner) {
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+
+	tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return tlsConn, bufio.NewScanner(tlsConn)
+}
+
+// readCaps reads an EHLO response and returns the advertised capabilities.
+func readCaps(t *testing.T, scanner *bufio.Scanner) map[string]bool {
+	caps := make(map[string]bool)
+	for scanner.Scan() {
+		s := scanner.Text()
+		if strings.HasPrefix(s, "250 ") {
+			caps[strings.TrimPrefix(s, "250 ")] = true
+			break
+		}
+		if !strings.HasPrefix(s, "250-") {
+			t.Fatal("Invalid capability response:", s)
+		}
+		caps[strings.TrimPrefix(s, "250-")] = true
+	}
+	return caps
+}
+
 func TestServerAcceptErrorHandling(t *testing.T) {
 	errorLog := bytes.NewBuffer(nil)
 	be := new(backend)
@@ -355,8 +408,8 @@ func TestServer_helo(t *testing.T) {
 	}
 }
 
-func testServerAuthenticated(t *testing.T) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
-	be, s, c, scanner, caps := testServerEhlo(t)
+func testServerAuthenticated(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	be, s, c, scanner, caps := testServerEhlo(t, fn...)
 
 	if _, ok := caps["AUTH PLAIN"]; !ok {
 		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
@@ -494,6 +547,73 @@ func TestServerSMTPUTF8_Disabled(t *testing.T) {
 	}
 }
 
+func TestServerEightBitCommands(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mode    smtp.EightBitCommands
+		replies []string // to MAIL, RCPT with SMTPUTF8, and NOOP
+	}{
+		{"accept", smtp.EightBitAccept, []string{"250 ", "250 ", "250 "}},
+		{"reject", smtp.EightBitReject, []string{"500 5.5.2 ", "500 5.5.2 ", "500 5.5.2 "}},
+		{"smtputf8", smtp.EightBitSMTPUTF8, []string{"553 5.6.7 ", "250 ", "500 5.5.2 "}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+				s.EnableSMTPUTF8 = true
+				s.EightBitCommands = tc.mode
+			})
+			defer s.Close()
+			defer c.Close()
+
+			for i, cmd := range []string{
+				"MAIL FROM:<alice@wonderland.book>\r\nRCPT TO:<андрей@example.org>",
+				"RSET\r\nMAIL FROM:<alice@wonderland.book> SMTPUTF8\r\nRCPT TO:<андрей@example.org>",
+				"NOOP ü",
+			} {
+				io.WriteString(c, cmd+"\r\n")
+				for n := strings.Count(cmd, "\r\n"); n > 0; n-- {
+					scanner.Scan()
+				}
+				scanner.Scan()
+				if !strings.HasPrefix(scanner.Text(), tc.replies[i]) {
+					t.Errorf("Invalid response to %q: %v", cmd, scanner.Text())
+				}
+			}
+		})
+	}
+}
+
+func TestServerEightBitCommands_Latin1(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.EightBitCommands = smtp.EightBitLatin1
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<j\xfcrgen@example.org>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<zoë@example.org>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.messages))
+	}
+	msg := be.messages[0]
+	if msg.From != "jürgen@example.org" {
+		t.Errorf("From = %q, want the Latin-1 address decoded", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "zoë@example.org" {
+		t.Errorf("To = %q, want the UTF-8 address as is", msg.To)
+	}
+}
+
 func TestServer8BITMIME(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -776,6 +896,92 @@ func TestServer_tooManyInvalidCommands(t *testing.T) {
 	}
 }
 
+func TestServer_ErrorLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config func(s *smtp.Server)
+		cmds   []string
+		want   []string
+		closed bool
+	}{
+		{
+			name: "reject",
+			config: func(s *smtp.Server) {
+				s.MaxUnknownCommands = 1
+				s.ErrorLimitPolicy = func(c *smtp.Conn, limit smtp.ErrorLimit, n int) smtp.ErrorLimitAction {
+					return smtp.ErrorLimitReject
+				}
+			},
+			cmds:   []string{"XXXX", "XXXX"},
+			want:   []string{"500 5.5.2 Syntax errors, XXXX command unrecognized", "421 4.7.0 Too many errors, closing connection"},
+			closed: true,
+		},
+		{
+			name: "unlimited",
+			config: func(s *smtp.Server) {
+				s.MaxUnknownCommands = -1
+			},
+			cmds: []string{"XXXX", "XXXX", "XXXX", "XXXX", "XXXX", "NOOP"},
+			want: []string{"500 ", "500 ", "500 ", "500 ", "500 ", "250 "},
+		},
+		{
+			name: "separate limits",
+			cmds: []string{"XXXX", "XXXX", "XXXX", "\xff", "\xff", "NOOP"},
+			want: []string{"500 ", "500 ", "500 ", "501 ", "501 ", "250 "},
+		},
+		{
+			name: "failed recipients",
+			config: func(s *smtp.Server) {
+				s.MaxFailedRecipients = 2
+				s.ErrorLimitPolicy = func(c *smtp.Conn, limit smtp.ErrorLimit, n int) smtp.ErrorLimitAction {
+					if limit != smtp.LimitFailedRecipients || n < 4 {
+						return smtp.ErrorLimitIgnore
+					}
+					return smtp.ErrorLimitDrop
+				}
+			},
+			cmds:   []string{"MAIL FROM:<root@nsa.gov>", "RCPT TO:bad", "RCPT TO:bad", "RCPT TO:bad", "RCPT TO:bad"},
+			want:   []string{"250 ", "501 ", "501 ", "501 "},
+			closed: true,
+		},
+		{
+			name: "slow down",
+			config: func(s *smtp.Server) {
+				s.MaxSyntaxErrors = 1
+				s.ErrorLimitDelay = 50 * time.Millisecond
+				s.ErrorLimitPolicy = func(c *smtp.Conn, limit smtp.ErrorLimit, n int) smtp.ErrorLimitAction {
+					return smtp.ErrorLimitSlowDown
+				}
+			},
+			cmds: []string{"\xff", "\xff", "NOOP"},
+			want: []string{"501 ", "501 ", "250 "},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var fns []serverConfigureFunc
+			if tc.config != nil {
+				fns = append(fns, tc.config)
+			}
+			_, s, c, scanner := testServerAuthenticated(t, fns...)
+			defer s.Close()
+			defer c.Close()
+
+			for _, cmd := range tc.cmds {
+				io.WriteString(c, cmd+"\r\n")
+			}
+			for _, want := range tc.want {
+				scanner.Scan()
+				if !strings.HasPrefix(scanner.Text(), want) {
+					t.Fatalf("Invalid response: %q, want %q", scanner.Text(), want)
+				}
+			}
+			if tc.closed && scanner.Scan() {
+				t.Errorf("Connection not closed, got %q", scanner.Text())
+			}
+		})
+	}
+}
+
 func TestServer_tooLongMessage(t *testing.T) {
 	be, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -1289,7 +1495,8 @@ func TestServer_TooLongCommand(t *testing.T) {
 }
 
 func TestServerShutdown(t *testing.T) {
-	_, s, c, _ := testServerGreeted(t)
+	_, s, c, scanner := testServerGreeted(t)
+	defer c.Close()
 
 	ctx := context.Background()
 	errChan := make(chan error)
@@ -1300,11 +1507,13 @@ func TestServerShutdown(t *testing.T) {
 		errChan <- s.Shutdown(ctx)
 	}()
 
-	select {
-	case err := <-errChan:
-		t.Fatal("Expected no err because conn is open:", err)
-	default:
-		c.Close()
+	// Idle connections are closed
+	scanner.Scan()
+	if scanner.Text() != "421 4.3.2 Server shutting down" {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
 	}
 
 	errOne := <-errChan
@@ -1517,6 +1726,52 @@ func TestServerDSNwithSMTPUTF8(t *testing.T) {
 	}
 }
 
+func TestServerDSN_ORCPTXtext(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableDSN = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+
+	for _, tc := range []struct {
+		orcpt, want string
+	}{
+		{`rfc822;"John+20Doe"@example.com`, `"John Doe"@example.com`},
+		{"rfc822;john+2Btag@example.com", "john+tag@example.com"},
+		{"rfc822;john+2B2B@example.com", "john+2B@example.com"},
+		{"rfc822;john+2btag@example.com", ""},
+		{"rfc822;john+tag@example.com", ""},
+		{"rfc822;john+E9@example.com", ""},
+	} {
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> ORCPT="+tc.orcpt+"\r\n")
+		scanner.Scan()
+		if tc.want == "" {
+			if want := "501 5.5.4 Malformed ORCPT parameter value"; scanner.Text() != want {
+				t.Errorf("RCPT response for %q = %q, want %q", tc.orcpt, scanner.Text(), want)
+			}
+		} else if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Errorf("Invalid RCPT response for %q: %v", tc.orcpt, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	opts := be.anonmsgs[0].RcptOpts
+	for i, want := range []string{`"John Doe"@example.com`, "john+tag@example.com", "john+2B@example.com"} {
+		if i >= len(opts) || opts[i].OriginalRecipient != want {
+			t.Errorf("Invalid ORCPT address %v, want %q", i, want)
+		}
+	}
+}
+
 func TestServerRRVS(t *testing.T) {
 	be, s, c, scanner, caps := testServerEhlo(t,
 		func(s *smtp.Server) {
@@ -1581,6 +1836,60 @@ func TestServerRRVS(t *testing.T) {
 	}
 }
 
+func TestServerFUTURERELEASE(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t,
+		func(s *smtp.Server) {
+			s.EnableFUTURERELEASE = true
+			s.MaxFutureRelease = time.Hour
+		})
+	defer s.Close()
+	defer c.Close()
+
+	found := false
+	for cap := range caps {
+		if strings.HasPrefix(cap, "FUTURERELEASE 3600 ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Missing capability: FUTURERELEASE")
+	}
+
+	holdUntil := time.Now().Add(30 * time.Minute).UTC().Truncate(time.Second)
+	for _, tc := range []struct {
+		args, resp string
+	}{
+		{"HOLDFOR=soon", "501 5.5.4 "},
+		{"HOLDFOR=3601", "501 5.5.4 "},
+		{"HOLDUNTIL=tomorrow", "501 5.5.4 "},
+		{"HOLDUNTIL=" + time.Now().Add(2*time.Hour).UTC().Format(time.RFC3339), "501 5.5.4 "},
+		{"HOLDFOR=60 HOLDUNTIL=" + holdUntil.Format(time.RFC3339), "501 5.5.4 "},
+		{"HOLDFOR=60", "250 "},
+		{"HOLDUNTIL=" + holdUntil.Format(time.RFC3339), "250 "},
+	} {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov> "+tc.args+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.resp) {
+			t.Fatalf("Invalid response to MAIL with %v: %v", tc.args, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatalf("Got %v messages, want 1", len(be.anonmsgs))
+	}
+	opts := be.anonmsgs[0].Opts
+	if opts.HoldFor != 0 || !opts.HoldUntil.Equal(holdUntil) {
+		t.Errorf("HoldFor = %v, HoldUntil = %v, want %v", opts.HoldFor, opts.HoldUntil, holdUntil)
+	}
+}
+
 func TestServerDELIVERBY(t *testing.T) {
 	be, s, c, scanner, caps := testServerEhlo(t,
 		func(s *smtp.Server) {
@@ -1602,7 +1911,6 @@ func TestServerDELIVERBY(t *testing.T) {
 		"RCPT TO:<root@gchq.gov.uk> BY=1234",
 		"RCPT TO:<root@gchq.gov.uk> BY=123;RT;",
 		"RCPT TO:<root@gchq.gov.uk> BY=0;R",
-		"RCPT TO:<root@gchq.gov.uk> BY=49;RT",
 	}
 
 	for _, msg := range malformedMsgs {
@@ -1613,6 +1921,12 @@ func TestServerDELIVERBY(t *testing.T) {
 		}
 	}
 
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> BY=49;RT\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "455 4.5.4") {
+		t.Fatal("Unexpected res on BY parameter below the minimum:", scanner.Text())
+	}
+
 	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> BY=100;NT\r\n")
 	scanner.Scan()
 
@@ -1651,6 +1965,59 @@ func TestServerDELIVERBY(t *testing.T) {
 	}
 }
 
+func TestServerDELIVERBYMail(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t,
+		func(s *smtp.Server) {
+			s.EnableDELIVERBY = true
+			s.MinimumDeliverByTime = 60 * time.Second
+		})
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["DELIVERBY 60"]; !ok {
+		t.Fatal("Missing capability: DELIVERBY 60")
+	}
+
+	replies := map[string]string{
+		"BY=":      "501 5.5.4 ",
+		"BY=10":    "501 5.5.4 ",
+		"BY=0;R":   "501 5.5.4 ",
+		"BY=59;R":  "455 4.5.4 ",
+		"BY=-10;N": "250 ",
+	}
+	for param, want := range replies {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov> "+param+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), want) {
+			t.Fatalf("Invalid MAIL response with %v: %v", param, scanner.Text())
+		}
+		if want == "250 " {
+			io.WriteString(c, "RSET\r\n")
+			scanner.Scan()
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BY=3600;RT\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	want := smtp.DeliverByOptions{Time: time.Hour, Mode: smtp.DeliverByReturn, Trace: true}
+	if by := be.anonmsgs[0].Opts.DeliverBy; by == nil || *by != want {
+		t.Fatalf("Invalid BY parameter: %#v", by)
+	}
+}
+
 func TestServerMTPRIORITY(t *testing.T) {
 	be, s, c, scanner, caps := testServerEhlo(t,
 		func(s *smtp.Server) {
@@ -1712,3 +2079,3533 @@ func TestServerMTPRIORITY(t *testing.T) {
 		t.Fatal("Incorrect MtPriority parameter value:", fmt.Sprintf("expected %d, got %d", expectedPriority, *priority))
 	}
 }
+
+func TestServerMTPRIORITYMail(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t,
+		func(s *smtp.Server) {
+			s.EnableMTPRIORITY = true
+			s.MtPriorityProfile = smtp.PriorityMIXER
+		})
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["MT-PRIORITY MIXER"]; !ok {
+		t.Fatal("Missing capability: MT-PRIORITY MIXER")
+	}
+
+	for _, value := range []string{"", "foo", "-10", "10"} {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov> MT-PRIORITY="+value+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
+			t.Fatal("Unexpected res on malformed MT-PRIORITY parameter value:", scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> MT-PRIORITY=4\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	if priority := be.anonmsgs[0].Opts.MTPriority; priority == nil || *priority != 4 {
+		t.Fatalf("Invalid MT-PRIORITY: %v", priority)
+	}
+}
+
+func TestServerMTPRIORITYDisabled(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["MT-PRIORITY"]; ok {
+		t.Fatal("MT-PRIORITY advertised while disabled")
+	}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> MT-PRIORITY=4\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 5.5.4 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_Fingerprint(t *testing.T) {
+	conns := make(chan *smtp.Conn, 2)
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+		s.EnableFingerprinting = true
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conns <- c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+	<-conns
+
+	tlsConn, scanner := startTLS(t, c, scanner)
+	io.WriteString(tlsConn, "EHLO mx.example.org\r\n")
+	readCaps(t, scanner)
+	conn := <-conns
+
+	io.WriteString(tlsConn, "MAIL FROM:<root@nsa.gov> SIZE=42 BODY=8BITMIME\r\nRCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	scanner.Scan()
+
+	fp := conn.Fingerprint()
+	if fp.Greeting != "EHLO" || fp.HELOShape != smtp.HELOShapeFQDN {
+		t.Errorf("Fingerprint() greeting = %v %v, want EHLO fqdn", fp.Greeting, fp.HELOShape)
+	}
+	if got, want := strings.Join(fp.Commands, " "), "EHLO STARTTLS EHLO MAIL RCPT"; got != want {
+		t.Errorf("Fingerprint().Commands = %v, want %v", got, want)
+	}
+	if got, want := strings.Join(fp.Extensions, " "), "STARTTLS SIZE BODY"; got != want {
+		t.Errorf("Fingerprint().Extensions = %v, want %v", got, want)
+	}
+	if !fp.Pipelined {
+		t.Errorf("Fingerprint().Pipelined = false, want true")
+	}
+	if fp.FirstCommandDelay <= 0 {
+		t.Errorf("Fingerprint().FirstCommandDelay = %v, want a positive delay", fp.FirstCommandDelay)
+	}
+	if len(fp.TLSHash) != 32 {
+		t.Errorf("Fingerprint().TLSHash = %q, want a MD5 sum", fp.TLSHash)
+	}
+}
+
+// testExtension is a site-specific extension, only offered to clients which
+// introduced themselves as "mx.example.org".
+type testExtension struct{}
+
+func (testExtension) Advertise(conn *smtp.Conn) (string, bool) {
+	return "PING", conn.Hostname() == "mx.example.org"
+}
+
+func (testExtension) Commands() []string {
+	return []string{"XPING"}
+}
+
+func (testExtension) HandleCommand(conn *smtp.Conn, verb, arg string) {
+	conn.WriteResponse(250, smtp.EnhancedCode{2, 0, 0}, "PONG "+arg)
+}
+
+func (testExtension) MailParams() []string {
+	return []string{"XPRIORITY"}
+}
+
+func (testExtension) CheckMailParam(conn *smtp.Conn, name, value string) error {
+	if value != "low" && value != "high" {
+		return errors.New("invalid priority")
+	}
+	return nil
+}
+
+func (testExtension) RcptParams() []string {
+	return []string{"XTAG"}
+}
+
+func (testExtension) CheckRcptParam(conn *smtp.Conn, name, value string) error {
+	if value == "" {
+		return &smtp.SMTPError{Code: 555, EnhancedCode: smtp.EnhancedCode{5, 5, 4}, Message: "XTAG requires a value"}
+	}
+	return nil
+}
+
+func TestServer_RegisterExtension(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.RegisterExtension("xexample", testExtension{})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "EHLO mx.example.org\r\n")
+	scanner.Scan()
+	if caps := readCaps(t, scanner); !caps["XEXAMPLE PING"] {
+		t.Errorf("Extension not advertised: %v", caps)
+	}
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"XPING hey", "250 2.0.0 PONG hey"},
+		{"MAIL FROM:<root@nsa.gov> XPRIORITY=urgent", "501 5.5.4 Invalid XPRIORITY parameter value"},
+		{"MAIL FROM:<root@nsa.gov> XPRIORITY=high", "250 2.0.0 Roger, accepting mail from <root@nsa.gov>"},
+		{"RCPT TO:<root@gchq.gov.uk> XTAG", "555 5.5.4 XTAG requires a value"},
+		{"RCPT TO:<root@gchq.gov.uk> XTAG=42", "250 2.0.0 I'll make sure <root@gchq.gov.uk> gets this"},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Response to %q = %q, want %q", tc.cmd, scanner.Text(), tc.want)
+		}
+	}
+
+	io.WriteString(c, "DATA\r\nHey <3\r\n.\r\n")
+	scanner.Scan()
+	scanner.Scan()
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatalf("Invalid number of sent messages: %v", len(be.anonmsgs))
+	}
+	msg := be.anonmsgs[0]
+	if got := msg.Opts.Extensions["XPRIORITY"]; got != "high" {
+		t.Errorf("MailOptions.Extensions[XPRIORITY] = %q, want high", got)
+	}
+	if got := msg.RcptOpts[0].Extensions["XTAG"]; got != "42" {
+		t.Errorf("RcptOptions.Extensions[XTAG] = %q, want 42", got)
+	}
+}
+
+func TestServer_HandleCommand(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.HandleCommand("xstatus", func(conn *smtp.Conn, arg string) error {
+			conn.WriteResponse(250, smtp.EnhancedCode{2, 0, 0}, "Status "+arg)
+			return nil
+		})
+		s.HandleCommand("XFAIL", func(conn *smtp.Conn, arg string) error {
+			if arg == "smtp" {
+				return &smtp.SMTPError{
+					Code:         554,
+					EnhancedCode: smtp.EnhancedCode{5, 3, 0},
+					Message:      "Nope",
+				}
+			}
+			return errors.New("internal failure")
+		})
+		s.HandleCommand("NOOP", func(conn *smtp.Conn, arg string) error {
+			return errors.New("built-in verbs can't be overridden")
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"XSTATUS", "250 2.0.0 Status "},
+		{"xstatus queue", "250 2.0.0 Status queue"},
+		{"XSTATUSES", "501 5.5.2 Bad command"},
+		{"XFAIL smtp", "554 5.3.0 Nope"},
+		{"XFAIL", "451 4.3.0 Requested action aborted: local error in processing"},
+		{"NOOP", "250 2.0.0 I have successfully done nothing"},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Response to %q = %q, want %q", tc.cmd, scanner.Text(), tc.want)
+		}
+	}
+}
+
+func TestServer_DisabledCommands(t *testing.T) {
+	conns := make(chan *smtp.Conn, 1)
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.DisabledCommands = []string{"vrfy"}
+		s.EnableETRN = true
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conns <- c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	conn := <-conns
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"TURN", "502 5.5.1 TURN command not implemented, use ETRN"},
+		{"VRFY root@nsa.gov", "502 5.5.1 VRFY command not implemented"},
+		{"turn", "502 5.5.1 TURN command not implemented, use ETRN"},
+		{"NOOP", "250 2.0.0 I have successfully done nothing"},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Response to %q = %q, want %q", tc.cmd, scanner.Text(), tc.want)
+		}
+	}
+
+	want := []string{"disabled:TURN", "disabled:VRFY"}
+	if tags := conn.Tags(); !reflect.DeepEqual(tags, want) {
+		t.Errorf("Conn.Tags() = %v, want %v", tags, want)
+	}
+}
+
+func TestServer_MAILExtensions(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.EnableMAILExtensions = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> X-RELAY-ID=abc123 XFLAG\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\nHey <3\r\n.\r\n")
+	scanner.Scan()
+	scanner.Scan()
+
+	if len(be.messages) != 1 {
+		t.Fatalf("Invalid number of sent messages: %v", len(be.messages))
+	}
+	want := map[string]string{"X-RELAY-ID": "abc123", "XFLAG": ""}
+	if got := be.messages[0].Opts.Extensions; !reflect.DeepEqual(got, want) {
+		t.Errorf("MailOptions.Extensions = %v, want %v", got, want)
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> X_RELAY=abc\r\n")
+	scanner.Scan()
+	if scanner.Text() != `501 5.5.4 Unable to parse MAIL ESMTP parameters: malformed parameter "X_RELAY=abc"` {
+		t.Error("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_RegisterExtensionNotOffered(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.RegisterExtension("XEXAMPLE", testExtension{})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for cap := range caps {
+		if strings.HasPrefix(cap, "XEXAMPLE") {
+			t.Errorf("Extension advertised to a client it isn't offered to")
+		}
+	}
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"XPING", "502 5.5.1 XPING command not implemented"},
+		{"MAIL FROM:<root@nsa.gov> XPRIORITY=high", "504 5.5.4 XPRIORITY is not implemented"},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Response to %q = %q, want %q", tc.cmd, scanner.Text(), tc.want)
+		}
+	}
+}
+
+type profileSession struct {
+	smtp.Session
+	profiles chan<- string
+}
+
+func (s profileSession) Data(r io.Reader) error {
+	var buf bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	s.profiles <- buf.String()
+	return s.Session.Data(r)
+}
+
+func TestServer_ProfilerLabels(t *testing.T) {
+	profiles := make(chan string, 1)
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableProfilerLabels = true
+		s.ProfilerLabels = func(conn *smtp.Conn) []string {
+			return []string{"asn", "64496"}
+		}
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			session, err := be.NewSession(c)
+			return profileSession{session, profiles}, err
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\nRCPT TO:<root@gchq.gov.uk>\r\nDATA\r\n")
+	scanner.Scan()
+	scanner.Scan()
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+
+	profile := <-profiles
+	want := fmt.Sprintf(`# labels: {"asn":"64496", "smtp.listener":"%v", "smtp.state":"data"}`, c.RemoteAddr())
+	if !strings.Contains(profile, want) {
+		t.Errorf("Goroutine profile doesn't contain %v:\n%v", want, profile)
+	}
+}
+
+func TestServer_STARTTLSNets(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+		s.STARTTLSNets, _ = smtp.ParseTrustedNets("192.0.2.0/24")
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if caps["STARTTLS"] {
+		t.Fatal("STARTTLS advertised to a client outside of STARTTLSNets")
+	}
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 5.5.1 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+}
+
+func TestServer_TLSRequiredNets(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+		s.TLSRequiredNets, _ = smtp.ParseTrustedNets("localhost")
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	caps := readCaps(t, scanner)
+	if len(caps) != 4 || !caps["PIPELINING"] || !caps["ENHANCEDSTATUSCODES"] || !caps["STARTTLS"] {
+		t.Fatal("Invalid capabilities before STARTTLS:", caps)
+	}
+
+	for _, cmd := range []string{"AUTH PLAIN", "MAIL FROM:<root@nsa.gov>", "VRFY root"} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "530 5.7.0 ") {
+			t.Fatalf("Invalid %v response on plaintext session: %v", cmd, scanner.Text())
+		}
+	}
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	c, scanner = startTLS(t, c, scanner)
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	if caps := readCaps(t, scanner); !caps["AUTH PLAIN"] || caps["STARTTLS"] {
+		t.Fatal("Invalid capabilities after STARTTLS:", caps)
+	}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_OnTLSHandshake(t *testing.T) {
+	var hello *tls.ClientHelloInfo
+	var state tls.ConnectionState
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+		s.OnTLSClientHello = func(c *smtp.Conn, h *tls.ClientHelloInfo) error {
+			hello = h
+			return nil
+		}
+		s.OnTLSHandshake = func(c *smtp.Conn, cs tls.ConnectionState) error {
+			state = cs
+			if cs.Version < tls.VersionTLS13 {
+				return errors.New("weak TLS version")
+			}
+			return nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+	tlsConn := tls.Client(c, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "mx.example.org",
+		MaxVersion:         tls.VersionTLS12,
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	scanner = bufio.NewScanner(tlsConn)
+	scanner.Scan()
+	if scanner.Text() != "454 4.7.0 TLS not available due to temporary reason" {
+		t.Fatal("Invalid response to a rejected handshake:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+
+	if hello == nil || hello.ServerName != "mx.example.org" {
+		t.Errorf("Invalid ClientHello: %+v", hello)
+	}
+	if state.Version != tls.VersionTLS12 || state.ServerName != "mx.example.org" {
+		t.Errorf("Invalid connection state: version %x, server name %q", state.Version, state.ServerName)
+	}
+}
+
+func TestServer_ReloadTLS(t *testing.T) {
+	oldConfig, _, err := smtptest.NewTLSConfig("old.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newConfig, _, err := smtptest.NewTLSConfig("new.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.TLSConfig = oldConfig
+	})
+	defer s.Close()
+	defer c.Close()
+	addr := c.RemoteAddr().String()
+
+	// startTLS returns the name of the server certificate
+	startTLS := func(c net.Conn, scanner *bufio.Scanner) string {
+		io.WriteString(c, "STARTTLS\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "220 ") {
+			t.Fatal("Invalid STARTTLS response:", scanner.Text())
+		}
+		tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		return tlsConn.ConnectionState().PeerCertificates[0].DNSNames[0]
+	}
+	dial := func() (net.Conn, *bufio.Scanner) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(c)
+		scanner.Scan()
+		return c, scanner
+	}
+
+	if name := startTLS(c, scanner); name != "old.example.org" {
+		t.Errorf("Certificate name = %v, want old.example.org", name)
+	}
+
+	s.ReloadTLS(newConfig)
+	c2, scanner2 := dial()
+	defer c2.Close()
+	if name := startTLS(c2, scanner2); name != "new.example.org" {
+		t.Errorf("Certificate name after reload = %v, want new.example.org", name)
+	}
+
+	s.ReloadTLS(nil)
+	c3, scanner3 := dial()
+	defer c3.Close()
+	io.WriteString(c3, "STARTTLS\r\n")
+	scanner3.Scan()
+	if !strings.HasPrefix(scanner3.Text(), "502 ") {
+		t.Fatal("Invalid STARTTLS response without TLS configuration:", scanner3.Text())
+	}
+}
+
+func TestServer_OnTLSClientHello(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+		s.OnTLSClientHello = func(c *smtp.Conn, hello *tls.ClientHelloInfo) error {
+			return errors.New("unknown server name")
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+	tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err == nil {
+		t.Fatal("Handshake succeeded despite a rejected ClientHello")
+	}
+}
+
+func TestServerREQUIRETLS(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableREQUIRETLS = true
+		s.TLSConfig = testTLSConfig(t)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if caps["REQUIRETLS"] {
+		t.Fatal("REQUIRETLS advertised before STARTTLS")
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> REQUIRETLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "530 5.7.10 ") {
+		t.Fatal("Invalid MAIL response on plaintext session:", scanner.Text())
+	}
+
+	c, scanner = startTLS(t, c, scanner)
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	if caps := readCaps(t, scanner); !caps["REQUIRETLS"] {
+		t.Fatal("REQUIRETLS not advertised after STARTTLS:", caps)
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> REQUIRETLS=yes\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
+		t.Fatal("Invalid MAIL response with a REQUIRETLS value:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> REQUIRETLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 1 || !be.anonmsgs[0].Opts.RequireTLS {
+		t.Fatal("RequireTLS not set in MailOptions")
+	}
+}
+
+func TestServer_EnableAuth(t *testing.T) {
+	var trace string
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.AllowInsecureAuth = false
+		s.InsecureAuthMechanisms = []string{sasl.Anonymous}
+		s.TLSConfig = testTLSConfig(t)
+		s.EnableAuth(sasl.Anonymous, func(c *smtp.Conn) sasl.Server {
+			return sasl.NewAnonymousServer(func(t string) error {
+				trace = t
+				return nil
+			})
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	caps := readCaps(t, scanner)
+	if !caps["AUTH ANONYMOUS"] {
+		t.Fatal("Invalid AUTH capability on plaintext session:", caps)
+	}
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "523 5.7.10 ") {
+		t.Fatal("Invalid AUTH PLAIN response on plaintext session:", scanner.Text())
+	}
+
+	c, scanner = startTLS(t, c, scanner)
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	caps = readCaps(t, scanner)
+	if !caps["AUTH ANONYMOUS PLAIN"] {
+		t.Fatal("Invalid AUTH capability on TLS session:", caps)
+	}
+
+	io.WriteString(c, "AUTH ANONYMOUS dHJhY2U=\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH ANONYMOUS response:", scanner.Text())
+	}
+	if trace != "trace" {
+		t.Fatalf("Invalid ANONYMOUS trace: got %q, want %q", trace, "trace")
+	}
+}
+
+func TestServer_Kick(t *testing.T) {
+	conns := make(chan *smtp.Conn, 1)
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conns <- c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	conn := <-conns
+
+	// The server goroutine is now blocked reading the next command
+	conn.Kick(421, smtp.EnhancedCode{4, 3, 0}, "Server shutting down")
+
+	scanner.Scan()
+	if scanner.Text() != "421 4.3.0 Server shutting down" {
+		t.Fatal("Invalid out-of-band response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed after kick, got:", scanner.Text())
+	}
+}
+
+func testServerShutdownData(t *testing.T, cmd, body string) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+	be.dataErrors = make(chan error, 10)
+	be.logouts = make(chan struct{}, 10)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	if cmd != "DATA" {
+		// Until the transaction is in flight, the connection is idle
+		io.WriteString(c, "BDAT 4\r\nHey ")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid BDAT response:", scanner.Text())
+		}
+	}
+	io.WriteString(c, cmd+"\r\n")
+	if cmd == "DATA" {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "354 ") {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+	}
+	// The client stalls in the middle of the message
+	io.WriteString(c, body)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Shutdown() =", err)
+	}
+
+	if err := <-be.dataErrors; err != smtp.ErrServerShutdown {
+		t.Fatal("Backend received a different error:", err)
+	}
+	scanner.Scan()
+	if scanner.Text() != "451 4.3.0 Server shutting down" {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+	select {
+	case <-be.logouts:
+	case <-time.After(time.Second):
+		t.Fatal("Session not logged out")
+	}
+}
+
+func TestServer_ShutdownDrain(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+	be.dataErrors = make(chan error, 10)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	io.WriteString(c, "Hey <3\r\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- s.Shutdown(ctx)
+	}()
+
+	// The message being received is accepted before the connection is closed
+	select {
+	case err := <-errChan:
+		t.Fatal("Shutdown() returned while a message was being received:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid response to the end of the message:", scanner.Text())
+	}
+	if err := <-be.dataErrors; err != nil {
+		t.Fatal("Backend received an error:", err)
+	}
+	scanner.Scan()
+	if scanner.Text() != "421 4.3.2 Server shutting down" {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal("Shutdown() =", err)
+	}
+}
+
+func TestServer_ShutdownForce(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	// The client stalls between two chunks of the message
+	io.WriteString(c, "BDAT 4\r\nHey ")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Shutdown() =", err)
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_ShutdownData(t *testing.T) {
+	testServerShutdownData(t, "DATA", "Hey <3\r\n")
+}
+
+func TestServer_ShutdownBdat(t *testing.T) {
+	testServerShutdownData(t, "BDAT 100 LAST", "Hey <3\r\n")
+}
+
+type contextSession struct {
+	*session
+
+	rcptStarted chan struct{}
+	rcptErrors  chan error
+}
+
+func (s *contextSession) MailContext(ctx context.Context, from string, opts *smtp.MailOptions) error {
+	return s.Mail(from, opts)
+}
+
+func (s *contextSession) RcptContext(ctx context.Context, to string, opts *smtp.RcptOptions) error {
+	// Simulate a slow lookup, aborted when the client goes away
+	close(s.rcptStarted)
+	<-ctx.Done()
+	s.rcptErrors <- ctx.Err()
+	return ctx.Err()
+}
+
+func (s *contextSession) DataContext(ctx context.Context, r io.Reader) error {
+	return s.Data(r)
+}
+
+func TestServer_ContextSession(t *testing.T) {
+	sess := &contextSession{
+		rcptStarted: make(chan struct{}),
+		rcptErrors:  make(chan error, 1),
+	}
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		be := s.Backend.(*backend)
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			sess.session = &session{backend: be, anonymous: true}
+			return sess, nil
+		})
+	})
+	defer s.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	<-sess.rcptStarted
+	c.Close()
+
+	select {
+	case err := <-sess.rcptErrors:
+		if err != context.Canceled {
+			t.Fatal("Unexpected context error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Context not cancelled after client disconnected")
+	}
+}
+
+type deferredRcptSession struct {
+	*session
+
+	validated [][]string
+}
+
+func (s *deferredRcptSession) ValidateRecipients(rcpts []string) map[string]*smtp.SMTPError {
+	s.validated = append(s.validated, rcpts)
+	errs := make(map[string]*smtp.SMTPError)
+	for _, rcpt := range rcpts {
+		if strings.HasPrefix(rcpt, "nobody@") {
+			errs[rcpt] = &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				Message:      "No such user",
+			}
+		}
+	}
+	return errs
+}
+
+func testServerDeferredRcpt(t *testing.T) (*deferredRcptSession, *smtp.Server, net.Conn, *bufio.Scanner) {
+	sess := &deferredRcptSession{}
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		be := s.Backend.(*backend)
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			sess.session = &session{backend: be, anonymous: true}
+			return sess, nil
+		})
+	})
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	scanner.Scan()
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+	return sess, s, c, scanner
+}
+
+func TestServer_DeferredRcpt(t *testing.T) {
+	sess, s, c, scanner := testServerDeferredRcpt(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	for _, rcpt := range []string{"root@gchq.gov.uk", "nobody@gchq.gov.uk"} {
+		io.WriteString(c, "RCPT TO:<"+rcpt+">\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "252 2.1.5 ") {
+			t.Fatal("Invalid RCPT response:", scanner.Text())
+		}
+	}
+	if len(sess.validated) != 0 {
+		t.Fatal("Recipients validated before DATA")
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(sess.validated) != 1 || len(sess.validated[0]) != 2 {
+		t.Fatal("Invalid validated recipients:", sess.validated)
+	}
+}
+
+func TestServer_DeferredRcpt_allRejected(t *testing.T) {
+	_, s, c, scanner := testServerDeferredRcpt(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<nobody@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.1.1 No such user" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<nobody@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "BDAT 8 LAST\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.1.1 No such user" {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+type batchRcptSession struct {
+	*session
+
+	batches [][]smtp.RcptRequest
+}
+
+func (s *batchRcptSession) RcptBatch(reqs []smtp.RcptRequest) []smtp.RcptResult {
+	s.batches = append(s.batches, reqs)
+	results := make([]smtp.RcptResult, len(reqs))
+	for i, req := range reqs {
+		if strings.HasPrefix(req.To, "nobody@") {
+			results[i].Err = &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				Message:      "No such user",
+			}
+		}
+	}
+	return results
+}
+
+func TestServer_RcptBatch(t *testing.T) {
+	sess := &batchRcptSession{}
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		be := s.Backend.(*backend)
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			sess.session = &session{backend: be, anonymous: true}
+			return sess, nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+
+	// A single pipelined burst
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n"+
+		"RCPT TO:<root@gchq.gov.uk>\r\n"+
+		"RCPT FROM:<root@gchq.gov.uk>\r\n"+
+		"RCPT TO:<nobody@gchq.gov.uk>\r\n"+
+		"RCPT TO:<alice@gchq.gov.uk>\r\n"+
+		"NOOP\r\n")
+
+	want := []string{"250 ", "250 ", "501 5.5.2 ", "550 5.1.1 ", "250 ", "250 "}
+	for i, prefix := range want {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), prefix) {
+			t.Fatalf("Invalid response #%v: %v", i, scanner.Text())
+		}
+	}
+
+	if len(sess.batches) != 1 || len(sess.batches[0]) != 3 {
+		t.Fatalf("Invalid batches: %+v", sess.batches)
+	}
+	if to := sess.batches[0][2].To; to != "alice@gchq.gov.uk" {
+		t.Errorf("Invalid batched recipient: %v", to)
+	}
+}
+
+func TestServer_RcptBatchChecks(t *testing.T) {
+	sess := &batchRcptSession{}
+	conns := make(chan *smtp.Conn, 1)
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.EnableFingerprinting = true
+		be := s.Backend.(*backend)
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conns <- c
+			sess.session = &session{backend: be, anonymous: true}
+			return sess, nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	conn := <-conns
+
+	rcpts := "RCPT TO:<nobody@gchq.gov.uk>\r\n" +
+		"RCPT TO:<root@gchq.gov.uk>\r\n" +
+		"RCPT TO:<alice@gchq.gov.uk>\r\n"
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n"+rcpts)
+	for i := 0; i < 4; i++ {
+		scanner.Scan()
+	}
+	if got, want := strings.Join(conn.Fingerprint().Commands, " "), "HELO MAIL RCPT RCPT RCPT"; got != want {
+		t.Errorf("Fingerprint().Commands = %v, want %v", got, want)
+	}
+	if len(sess.batches) != 1 || len(sess.batches[0]) != 3 {
+		t.Fatalf("Invalid batches: %+v", sess.batches)
+	}
+
+	// The tarpit delays the commands following an error
+	s.Tarpit = &smtp.TarpitPolicy{Delay: time.Millisecond}
+	sess.batches = nil
+	io.WriteString(c, "RSET\r\nMAIL FROM:<root@nsa.gov>\r\n"+rcpts)
+	for i := 0; i < 5; i++ {
+		scanner.Scan()
+	}
+	if len(sess.batches) != 3 {
+		t.Errorf("Batched RCPT commands with a tarpit: %+v", sess.batches)
+	}
+}
+
+func TestServer_Use(t *testing.T) {
+	var verbs []string
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		// Audit log
+		s.Use(func(next smtp.CommandHandler) smtp.CommandHandler {
+			return smtp.CommandHandlerFunc(func(conn *smtp.Conn, verb, arg string) {
+				verbs = append(verbs, verb)
+				next.HandleCommand(conn, verb, arg)
+			})
+		})
+		// Command rewriting and rejection
+		s.Use(func(next smtp.CommandHandler) smtp.CommandHandler {
+			return smtp.CommandHandlerFunc(func(conn *smtp.Conn, verb, arg string) {
+				switch verb {
+				case "VRFY":
+					conn.WriteResponse(502, smtp.EnhancedCode{5, 5, 1}, "VRFY disabled by policy")
+				case "XNOP":
+					next.HandleCommand(conn, "NOOP", arg)
+				default:
+					next.HandleCommand(conn, verb, arg)
+				}
+			})
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid HELO response:", scanner.Text())
+	}
+
+	io.WriteString(c, "vrfy root\r\n")
+	scanner.Scan()
+	if scanner.Text() != "502 5.5.1 VRFY disabled by policy" {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "XNOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid XNOP response:", scanner.Text())
+	}
+
+	if want := []string{"HELO", "VRFY", "XNOP"}; strings.Join(verbs, " ") != strings.Join(want, " ") {
+		t.Errorf("Middleware saw %v, want %v", verbs, want)
+	}
+}
+
+func TestServer_CommandHistory(t *testing.T) {
+	conns := make(chan *smtp.Conn, 1)
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.CommandHistory = 4
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conns <- c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	conn := <-conns
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+
+	history := conn.History()
+	want := []string{
+		"C: AUTH PLAIN",
+		"S: 235 2.0.0 Authentication succeeded",
+		"C: DATA",
+		"S: 502 5.5.1 Missing RCPT TO command.",
+	}
+	if len(history) != len(want) {
+		t.Fatalf("History() = %v, want %v", history, want)
+	}
+	for i, e := range history {
+		if e.String() != want[i] {
+			t.Errorf("History()[%v] = %q, want %q", i, e.String(), want[i])
+		}
+	}
+}
+
+func TestServer_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.Logger = slog.New(slog.NewTextHandler(lockedWriter{&mu, &buf}, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	})
+	defer s.Close()
+
+	io.WriteString(c, "HELO mx.example.org\r\n")
+	scanner.Scan()
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	c.Close()
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	logs := buf.String()
+	for _, want := range []string{
+		"event=connect",
+		"event=command",
+		"command=\"MAIL FROM:<root@nsa.gov>\"",
+		"event=mail",
+		"from=root@nsa.gov",
+		"helo=mx.example.org",
+		"session_id=",
+		"remote_addr=127.0.0.1:",
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Logs don't contain %q:\n%v", want, logs)
+		}
+	}
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w lockedWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
+
+func TestServer_ErrorExposure(t *testing.T) {
+	internalErr := errors.New("pq: connection refused to 10.0.0.5")
+	tests := []struct {
+		name   string
+		err    error
+		expose bool
+		want   string
+	}{
+		{"plain", internalErr, false, "451 4.0.0 Requested action aborted: local error in processing"},
+		{"exposed", internalErr, true, "451 4.0.0 pq: connection refused to 10.0.0.5"},
+		{"temp", smtp.TempError(internalErr, 4, 7, 1, "Try later"), false, "451 4.7.1 Try later"},
+		{"perm", smtp.PermError(internalErr, 5, 7, 1, "Go away"), false, "550 5.7.1 Go away"},
+		{"wrapped", fmt.Errorf("lookup: %w", smtp.PermError(internalErr, 5, 1, 1, "No such user")), false, "550 5.1.1 No such user"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			be, s, c, scanner := testServerAuthenticated(t)
+			defer s.Close()
+			defer c.Close()
+			s.ExposeErrors = tc.expose
+			be.userErr = tc.err
+
+			io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+			scanner.Scan()
+			if scanner.Text() != tc.want {
+				t.Errorf("MAIL response = %q, want %q", scanner.Text(), tc.want)
+			}
+		})
+	}
+
+	if err := smtp.TempError(internalErr, 4, 7, 1, "Try later"); !errors.Is(err, internalErr) {
+		t.Errorf("TempError() doesn't wrap the error")
+	}
+}
+
+func TestServer_ScrubResponse(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	s.Logger = slog.New(slog.NewTextHandler(lockedWriter{&mu, &buf}, nil))
+	s.ScrubResponse = (&smtp.Scrubber{Paths: true, PrivateAddrs: true}).Scrub
+	be.userErr = smtp.PermError(nil, 5, 1, 1, "No mailbox in /var/mail/root on 10.0.0.5")
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if want := "550 5.1.1 No mailbox in [path] on [addr]"; scanner.Text() != want {
+		t.Errorf("MAIL response = %q, want %q", scanner.Text(), want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if logs := buf.String(); !strings.Contains(logs, "/var/mail/root") {
+		t.Errorf("Logs don't contain the original text:\n%v", logs)
+	}
+}
+
+func TestServer_RateLimiter(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.RateLimiter = &smtp.TokenBucketLimiter{
+			ConnectionsPerMinute: 1,
+			CommandsPerSecond:    0.001,
+			CommandBurst:         2,
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "450 4.7.0 ") {
+		t.Errorf("Invalid response to rate-limited command: %v", scanner.Text())
+	}
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "221 ") {
+		t.Errorf("Invalid response to QUIT: %v", scanner.Text())
+	}
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "421 4.7.0 ") {
+		t.Errorf("Invalid greeting on rate-limited connection: %v", scanner2.Text())
+	}
+	if scanner2.Scan() {
+		t.Errorf("Connection not closed, got %v", scanner2.Text())
+	}
+}
+
+func TestServer_MaxConnectionsPerIP(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.MaxConnections = 2
+		s.MaxConnectionsPerIP = 1
+	})
+	defer s.Close()
+	defer c.Close()
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "421 4.7.0 ") {
+		t.Errorf("Invalid greeting on excess connection: %v", scanner2.Text())
+	}
+	if scanner2.Scan() {
+		t.Errorf("Connection not closed, got %v", scanner2.Text())
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	c.Close()
+
+	// The slot is released once the first connection is closed
+	var greeting string
+	for i := 0; i < 50; i++ {
+		c3, err := net.Dial("tcp", c.RemoteAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner3 := bufio.NewScanner(c3)
+		scanner3.Scan()
+		greeting = scanner3.Text()
+		c3.Close()
+		if strings.HasPrefix(greeting, "220 ") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.HasPrefix(greeting, "220 ") {
+		t.Errorf("Invalid greeting after the first connection was closed: %v", greeting)
+	}
+}
+
+func TestServer_MaxSessions(t *testing.T) {
+	_, s, c, _ := testServerGreeted(t, func(s *smtp.Server) {
+		s.MaxSessions = 1
+	})
+	defer s.Close()
+	defer c.Close()
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "421 4.3.2 ") {
+		t.Errorf("Invalid greeting on excess connection: %v", scanner2.Text())
+	}
+	if scanner2.Scan() {
+		t.Errorf("Connection not closed, got %v", scanner2.Text())
+	}
+
+}
+
+func TestServer_MaxSessionsWait(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.MaxSessions = 1
+		s.MaxSessionsWait = 5 * time.Second
+	})
+	defer s.Close()
+	defer c.Close()
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	greeted := make(chan string, 1)
+	go func() {
+		scanner2.Scan()
+		greeted <- scanner2.Text()
+	}()
+
+	select {
+	case greeting := <-greeted:
+		t.Fatalf("Excess connection greeted before the session ended: %v", greeting)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	c.Close()
+
+	select {
+	case greeting := <-greeted:
+		if !strings.HasPrefix(greeting, "220 ") {
+			t.Errorf("Invalid greeting after the session ended: %v", greeting)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Excess connection not greeted after the session ended")
+	}
+}
+
+func TestServer_Tarpit(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	s.Tarpit = &smtp.TarpitPolicy{
+		FreeErrors: 1,
+		Delay:      50 * time.Millisecond,
+		MaxErrors:  3,
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+
+	start := time.Now()
+	io.WriteString(c, "RCPT FROM:<nobody@example.org>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 5.5.2 ") {
+		t.Fatalf("Invalid RCPT response: %v", scanner.Text())
+	}
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Errorf("First error delayed by %v", d)
+	}
+
+	start = time.Now()
+	io.WriteString(c, "XXXX\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 5.5.2 ") {
+		t.Fatalf("Invalid response to unknown command: %v", scanner.Text())
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("Second error delayed by %v, want at least 50ms", d)
+	}
+
+	io.WriteString(c, "RCPT FROM:<nobody@example.org>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 4.7.0 ") {
+		t.Fatalf("Invalid response after too many errors: %v", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Errorf("Connection not closed, got %v", scanner.Text())
+	}
+}
+
+func TestServer_XCLIENT(t *testing.T) {
+	conns := make(chan *smtp.Conn, 2)
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.XCLIENTTrustedNets, _ = smtp.ParseTrustedNets("127.0.0.0/8")
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conns <- c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+	<-conns
+
+	if !caps["XCLIENT NAME ADDR PORT PROTO HELO LOGIN DESTADDR DESTPORT TLS CIPHER"] {
+		t.Errorf("XCLIENT not advertised: %v", caps)
+	}
+
+	for _, cmd := range []string{"XCLIENT ADDR=BOGUS", "XCLIENT DESTPORT=65536"} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
+			t.Fatalf("Invalid response to malformed %q: %v", cmd, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "XCLIENT DESTADDR=192.0.2.25 DESTPORT=587 TLS=TLS+201.3 CIPHER=TLS_AES_128_GCM_SHA256\r\n")
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatalf("Invalid response to XCLIENT: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "XCLIENT ADDR=IPV6:2001:db8::1 PORT=4242 NAME=mx.example.org HELO=mx+2Eexample.org LOGIN=[UNAVAILABLE]\r\n")
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatalf("Invalid response to XCLIENT: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 5.5.1 ") {
+		t.Errorf("MAIL accepted before EHLO after XCLIENT: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "HELO proxy.example.org\r\n")
+	scanner.Scan()
+	conn := <-conns
+	if got := conn.ClientAddr().String(); got != "[2001:db8::1]:4242" {
+		t.Errorf("ClientAddr() = %v, want [2001:db8::1]:4242", got)
+	}
+	if got := conn.Hostname(); got != "mx.example.org" {
+		t.Errorf("Hostname() = %v, want mx.example.org", got)
+	}
+	if got := conn.ClientName(); got != "mx.example.org" {
+		t.Errorf("ClientName() = %v, want mx.example.org", got)
+	}
+	if got := conn.ClientLogin(); got != "" {
+		t.Errorf("ClientLogin() = %v, want empty", got)
+	}
+	if got := conn.Conn().RemoteAddr(); got.String() != c.LocalAddr().String() {
+		t.Errorf("Conn().RemoteAddr() = %v, want the proxy address %v", got, c.LocalAddr())
+	}
+
+	data := conn.XCLIENTData()
+	if data == nil {
+		t.Fatalf("XCLIENTData() = nil")
+	}
+	if data.DestAddr == nil || data.DestAddr.String() != "192.0.2.25:587" {
+		t.Errorf("XCLIENTData().DestAddr = %v, want 192.0.2.25:587", data.DestAddr)
+	}
+	if data.TLSVersion != "TLS 1.3" || data.TLSCipher != "TLS_AES_128_GCM_SHA256" {
+		t.Errorf("XCLIENTData() TLS = %q %q, want %q %q", data.TLSVersion, data.TLSCipher, "TLS 1.3", "TLS_AES_128_GCM_SHA256")
+	}
+}
+
+func TestServer_XCLIENTRewritesRemoteAddr(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	conns := make(chan *smtp.Conn, 1)
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.XCLIENTTrustedNets, _ = smtp.ParseTrustedNets("127.0.0.0/8")
+		s.XCLIENTRewritesRemoteAddr = true
+		s.Logger = slog.New(slog.NewTextHandler(lockedWriter{&mu, &buf}, nil))
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conns <- c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.1 PORT=4242\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatalf("Invalid response to XCLIENT: %v", scanner.Text())
+	}
+	io.WriteString(c, "HELO mx.example.org\r\n")
+	scanner.Scan()
+
+	conn := <-conns
+	if got := conn.Conn().RemoteAddr().String(); got != "192.0.2.1:4242" {
+		t.Errorf("Conn().RemoteAddr() = %v, want 192.0.2.1:4242", got)
+	}
+
+	// The proxy may still issue XCLIENT, its address is checked
+	io.WriteString(c, "XCLIENT NAME=mx.example.org\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatalf("Invalid response to XCLIENT: %v", scanner.Text())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	logs := buf.String()
+	if !strings.Contains(logs, "remote_addr=192.0.2.1:4242") {
+		t.Errorf("Logs don't contain the client address as the remote one:\n%v", logs)
+	}
+	if strings.Contains(logs, "client_addr=") {
+		t.Errorf("Logs contain a separate client address:\n%v", logs)
+	}
+}
+
+func TestServer_XCLIENTPolicy(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.XCLIENTTrustedNets, _ = smtp.ParseTrustedNets("127.0.0.0/8")
+		s.XCLIENTPolicy = func(conn *smtp.Conn, attrs map[string]string) error {
+			if _, ok := attrs["LOGIN"]; ok {
+				return errors.New("LOGIN not allowed")
+			}
+			if attrs["HELO"] == "localhost" {
+				return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Bad HELO"}
+			}
+			return nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"XCLIENT ADDR=192.0.2.1 LOGIN=alice", "550 5.7.0 Insufficient authorization"},
+		{"XCLIENT HELO=localhost", "550 5.7.1 Bad HELO"},
+		{"XCLIENT ADDR=192.0.2.1 HELO=mx.example.org", "220 localhost ESMTP Service Ready"},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Response to %q = %q, want %q", tc.cmd, scanner.Text(), tc.want)
+		}
+	}
+}
+
+func TestServer_XCLIENTUntrusted(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.XCLIENTTrustedNets, _ = smtp.ParseTrustedNets("192.0.2.0/24")
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for cap := range caps {
+		if strings.HasPrefix(cap, "XCLIENT") {
+			t.Errorf("XCLIENT advertised to an untrusted client")
+		}
+	}
+
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "550 5.7.0 ") {
+		t.Errorf("Invalid response to untrusted XCLIENT: %v", scanner.Text())
+	}
+}
+
+type proxyChainSession struct {
+	smtp.Session
+	conn  *smtp.Conn
+	chain chan<- []smtp.ProxyHop
+}
+
+func (s proxyChainSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.chain <- s.conn.ProxyChain()
+	return s.Session.Mail(from, opts)
+}
+
+func TestServer_ProxyChain(t *testing.T) {
+	chain := make(chan []smtp.ProxyHop, 1)
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.PROXYTrustedNets, _ = smtp.ParseTrustedNets("127.0.0.0/8")
+		s.XCLIENTTrustedNets, _ = smtp.ParseTrustedNets("198.51.100.1")
+		s.XFORWARDTrustedNets, _ = smtp.ParseTrustedNets("192.0.2.1")
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			session, err := be.NewSession(c)
+			return proxyChainSession{session, c, chain}, err
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "PROXY TCP4 198.51.100.1 192.0.2.25 4242 25\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatalf("Invalid greeting: %v", scanner.Text())
+	}
+
+	for _, cmd := range []string{
+		"XCLIENT ADDR=192.0.2.1 PORT=2525",
+		"EHLO localhost",
+		"XFORWARD ADDR=203.0.113.1 PORT=25",
+		"MAIL FROM:<root@nsa.gov>",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		for scanner.Scan() {
+			if len(scanner.Text()) < 4 || scanner.Text()[3] != '-' {
+				break
+			}
+		}
+		if !strings.HasPrefix(scanner.Text(), "2") {
+			t.Fatalf("Invalid response to %q: %v", cmd, scanner.Text())
+		}
+	}
+
+	var got []string
+	for _, hop := range <-chain {
+		got = append(got, hop.Via+" "+hop.Addr.String())
+	}
+	want := []string{
+		"XFORWARD 203.0.113.1:25",
+		"XCLIENT 192.0.2.1:2525",
+		"PROXY 198.51.100.1:4242",
+		" " + c.LocalAddr().String(),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ProxyChain() = %q, want %q", got, want)
+	}
+}
+
+func TestServer_ProxyChainUntrustedHop(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.PROXYTrustedNets, _ = smtp.ParseTrustedNets("127.0.0.0/8")
+		s.XCLIENTTrustedNets, _ = smtp.ParseTrustedNets("127.0.0.0/8")
+		s.XFORWARDTrustedNets, _ = smtp.ParseTrustedNets("127.0.0.0/8")
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// The load balancer is trusted, not its clients
+	io.WriteString(c, "PROXY TCP4 203.0.113.1 192.0.2.25 4242 25\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatalf("Invalid greeting: %v", scanner.Text())
+	}
+
+	for _, cmd := range []string{"XCLIENT ADDR=192.0.2.1", "XFORWARD ADDR=192.0.2.1"} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "550 5.7.0 ") {
+			t.Errorf("Invalid response to %q from an untrusted hop: %v", cmd, scanner.Text())
+		}
+	}
+}
+
+func TestServer_ProxyHeaderInvalid(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.PROXYTrustedNets, _ = smtp.ParseTrustedNets("127.0.0.0/8")
+		s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	if scanner.Scan() {
+		t.Errorf("Connection not closed after an invalid PROXY header: %v", scanner.Text())
+	}
+}
+
+type xforwardSession struct {
+	smtp.Session
+	conn *smtp.Conn
+	data chan<- *smtp.XFORWARDData
+}
+
+func (s xforwardSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.data <- s.conn.XFORWARDData()
+	return s.Session.Mail(from, opts)
+}
+
+func TestServer_XFORWARD(t *testing.T) {
+	data := make(chan *smtp.XFORWARDData, 1)
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.XFORWARDTrustedNets, _ = smtp.ParseTrustedNets("127.0.0.0/8")
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			session, err := be.NewSession(c)
+			return xforwardSession{session, c, data}, err
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["XFORWARD NAME ADDR PORT PROTO HELO IDENT SOURCE"] {
+		t.Errorf("XFORWARD not advertised: %v", caps)
+	}
+
+	for _, cmd := range []string{"XFORWARD ADDR=BOGUS", "XFORWARD LOGIN=alice", "XFORWARD"} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
+			t.Fatalf("Invalid response to malformed %q: %v", cmd, scanner.Text())
+		}
+	}
+
+	// Attributes accumulate over several commands
+	for _, cmd := range []string{
+		"XFORWARD NAME=mx.example.org ADDR=192.0.2.1 IDENT=42",
+		"XFORWARD PORT=4242 HELO=mx+2Eexample.org PROTO=ESMTP SOURCE=REMOTE IDENT=[UNAVAILABLE]",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 2.0.0 ") {
+			t.Fatalf("Invalid response to %q: %v", cmd, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	got := <-data
+	want := smtp.XFORWARDData{
+		Name:   "mx.example.org",
+		Addr:   &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 4242},
+		Proto:  "ESMTP",
+		HELO:   "mx.example.org",
+		Source: "REMOTE",
+	}
+	if got == nil || got.Addr == nil || got.Addr.String() != want.Addr.String() {
+		t.Fatalf("XFORWARDData() = %+v, want %+v", got, want)
+	}
+	got.Addr = want.Addr
+	if *got != want {
+		t.Errorf("XFORWARDData() = %+v, want %+v", got, want)
+	}
+
+	io.WriteString(c, "XFORWARD NAME=spoofed.example.org\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "503 5.5.1 ") {
+		t.Errorf("Invalid response to XFORWARD during a transaction: %v", scanner.Text())
+	}
+
+	// Attributes are cleared at the end of the transaction
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\nDATA\r\n")
+	scanner.Scan()
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if got := <-data; got != nil {
+		t.Errorf("XFORWARDData() = %+v for the next transaction, want nil", got)
+	}
+}
+
+func TestServer_XFORWARDUntrusted(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	for cap := range caps {
+		if strings.HasPrefix(cap, "XFORWARD") {
+			t.Errorf("XFORWARD advertised to an untrusted client")
+		}
+	}
+
+	io.WriteString(c, "XFORWARD ADDR=192.0.2.1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "550 5.7.0 ") {
+		t.Errorf("Invalid response to untrusted XFORWARD: %v", scanner.Text())
+	}
+}
+
+func TestServer_XRCPTFORWARD(t *testing.T) {
+	trusted, err := smtp.ParseTrustedNets("127.0.0.0/8", "::1/128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.XRCPTFORWARDPolicy = &smtp.XRCPTFORWARDPolicy{
+			TrustedNets:  trusted,
+			MaxLength:    64,
+			AllowedKeys:  []string{"user", "ip", "quota"},
+			RequiredKeys: []string{"user"},
+			Check: func(conn *smtp.Conn, fields map[string]string) error {
+				if fields["quota"] == "exceeded" {
+					return &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full"}
+				}
+				return nil
+			},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["XRCPTFORWARD"] {
+		t.Errorf("XRCPTFORWARD not advertised: %v", caps)
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+
+	encode := func(fields map[string]string) string {
+		v, err := smtp.EncodeXRCPTFORWARD(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		value, want string
+	}{
+		{"!!!", "501 5.5.4 Malformed XRCPTFORWARD parameter value"},
+		{encode(map[string]string{"ip": "192.0.2.1"}), `501 5.5.4 Missing XRCPTFORWARD field "user"`},
+		{encode(map[string]string{"user": "root", "secret": "x"}), `501 5.5.4 XRCPTFORWARD field "secret" not allowed`},
+		{encode(map[string]string{"user": strings.Repeat("a", 64)}), "501 5.5.4 XRCPTFORWARD parameter value too long"},
+		{encode(map[string]string{"user": "root", "quota": "exceeded"}), "452 4.2.2 Mailbox full"},
+		{encode(map[string]string{"user": "root", "ip": "192.0.2.1"}), "250 2.0.0 I'll make sure <root@gchq.gov.uk> gets this"},
+	} {
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> XRCPTFORWARD="+tc.value+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Response to XRCPTFORWARD=%v = %q, want %q", tc.value, scanner.Text(), tc.want)
+		}
+	}
+}
+
+func TestServer_XRCPTFORWARDUntrusted(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.XRCPTFORWARDPolicy = &smtp.XRCPTFORWARDPolicy{}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if caps["XRCPTFORWARD"] {
+		t.Errorf("XRCPTFORWARD advertised to an untrusted client")
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> XRCPTFORWARD=dXNlcj1yb290\r\n")
+	scanner.Scan()
+	if want := "500 5.5.4 Unknown RCPT TO argument"; scanner.Text() != want {
+		t.Errorf("Invalid response to untrusted XRCPTFORWARD: %q, want %q", scanner.Text(), want)
+	}
+}
+
+type idleSession struct {
+	smtp.Session
+	events chan<- string
+}
+
+func (s idleSession) Idle() {
+	s.events <- "idle"
+}
+
+func (s idleSession) Active() {
+	s.events <- "active"
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	events := make(chan string, 2)
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.IdleTimeout = 50 * time.Millisecond
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			session, err := be.NewSession(c)
+			return idleSession{session, events}, err
+		})
+		s.OnIdle = func(c *smtp.Conn) error {
+			events <- "hook"
+			return nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Before EHLO, there is no session to notify
+	if ev := <-events; ev != "hook" {
+		t.Fatalf("got %q event, want hook", ev)
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() && strings.HasPrefix(scanner.Text(), "250-") {
+	}
+	for _, want := range []string{"idle", "hook"} {
+		if ev := <-events; ev != want {
+			t.Fatalf("got %q event, want %q", ev, want)
+		}
+	}
+
+	// The connection is kept open
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatalf("Invalid NOOP response: %v", scanner.Text())
+	}
+	if ev := <-events; ev != "active" {
+		t.Fatalf("got %q event, want active", ev)
+	}
+}
+
+func TestServer_IdleTimeoutClose(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.IdleTimeout = 50 * time.Millisecond
+		s.OnIdle = func(c *smtp.Conn) error {
+			return errors.New("idle")
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "421 4.4.2 Idle timeout, bye bye" {
+		t.Fatalf("Invalid response to idle connection: %v", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Errorf("Connection not closed, got %q", scanner.Text())
+	}
+}
+
+func TestServer_GreetingTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		greeting time.Duration
+		command  time.Duration
+		cmds     string
+	}{
+		{"greeting", 50 * time.Millisecond, 5 * time.Second, ""},
+		{"command", 5 * time.Second, 50 * time.Millisecond, "EHLO localhost\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+				s.GreetingTimeout = tc.greeting
+				s.CommandTimeout = tc.command
+			})
+			defer s.Close()
+			defer c.Close()
+
+			io.WriteString(c, tc.cmds)
+			for scanner.Scan() && strings.HasPrefix(scanner.Text(), "250") {
+			}
+			if scanner.Text() != "421 4.4.2 Idle timeout, bye bye" {
+				t.Fatalf("Invalid response to idle connection: %v", scanner.Text())
+			}
+			if scanner.Scan() {
+				t.Errorf("Connection not closed, got %q", scanner.Text())
+			}
+		})
+	}
+}
+
+func TestServer_GreetingDelay(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		reply *smtp.SMTPError
+		want  string
+	}{
+		{"default", nil, "554 5.3.2 Data received before the greeting"},
+		{"custom", &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Slow down"}, "421 4.7.0 Slow down"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+				s.GreetingDelay = 5 * time.Second
+				s.EarlyTalkerError = tc.reply
+			})
+			defer s.Close()
+			defer c.Close()
+
+			io.WriteString(c, "EHLO localhost\r\n")
+			scanner.Scan()
+			if scanner.Text() != tc.want {
+				t.Fatalf("Invalid response to early talker: %v", scanner.Text())
+			}
+			if scanner.Scan() {
+				t.Errorf("Connection not closed, got %q", scanner.Text())
+			}
+		})
+	}
+
+	t.Run("patient", func(t *testing.T) {
+		start := time.Now()
+		_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+			s.GreetingDelay = 50 * time.Millisecond
+		})
+		defer s.Close()
+		defer c.Close()
+
+		if d := time.Since(start); d < 50*time.Millisecond {
+			t.Errorf("Greeting sent after %v, want at least 50ms", d)
+		}
+		io.WriteString(c, "NOOP\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Errorf("Invalid response to NOOP: %v", scanner.Text())
+		}
+	})
+}
+
+func TestServer_DataTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name, cmd, want string
+	}{
+		{"DATA", "DATA\r\n", "354 Go ahead. End your data with <CR><LF>.<CR><LF>"},
+		{"BDAT", "BDAT 100 LAST\r\n", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+				s.CommandTimeout = 5 * time.Second
+				s.DataTimeout = 100 * time.Millisecond
+			})
+			defer s.Close()
+			defer c.Close()
+
+			io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+			scanner.Scan()
+			io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+			scanner.Scan()
+			io.WriteString(c, tc.cmd)
+			if tc.want != "" {
+				scanner.Scan()
+				if scanner.Text() != tc.want {
+					t.Fatalf("Invalid %v response: %v", tc.name, scanner.Text())
+				}
+			}
+
+			// Dribble the message
+			for i := 0; i < 5; i++ {
+				io.WriteString(c, "H")
+				time.Sleep(30 * time.Millisecond)
+			}
+			scanner.Scan()
+			if scanner.Text() != "421 4.4.2 Timeout exceeded while receiving the message" {
+				t.Fatalf("Invalid response to slow %v: %v", tc.name, scanner.Text())
+			}
+			if scanner.Scan() {
+				t.Errorf("Connection not closed, got %q", scanner.Text())
+			}
+			if len(be.messages) != 0 {
+				t.Errorf("Received %v messages, want none", len(be.messages))
+			}
+		})
+	}
+}
+
+func TestServer_TLSHandshakeTimeout(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+		s.CommandTimeout = 5 * time.Second
+		s.TLSHandshakeTimeout = 50 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+	// The client never starts the handshake
+	scanner.Scan()
+	if scanner.Text() != "550 5.0.0 Handshake error" {
+		t.Fatal("Invalid response to stalled handshake:", scanner.Text())
+	}
+}
+
+func TestServer_SPF(t *testing.T) {
+	type check struct {
+		ip           net.IP
+		helo, sender string
+	}
+	checks := make(chan check, 1)
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.SPFChecker = smtp.SPFCheckerFunc(func(ctx context.Context, ip net.IP, helo, sender string) (smtp.SPFResult, error) {
+			checks <- check{ip, helo, sender}
+			return smtp.SPFPass, nil
+		})
+		s.ReceivedSPFHeader = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	if got := <-checks; !got.ip.Equal(net.IPv4(127, 0, 0, 1)) || got.helo != "localhost" || got.sender != "root@nsa.gov" {
+		t.Errorf("Invalid SPF check arguments: %+v", got)
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "From: root@nsa.gov\r\n\r\nHey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	msg := be.messages[0]
+	if msg.Opts.SPF != smtp.SPFPass {
+		t.Errorf("MailOptions.SPF = %q, want pass", msg.Opts.SPF)
+	}
+	want := "Received-SPF: pass (localhost: domain of root@nsa.gov designates 127.0.0.1 as permitted sender)\r\n" +
+		"\tclient-ip=127.0.0.1; envelope-from=\"root@nsa.gov\"; helo=localhost; receiver=localhost; identity=mailfrom;\r\n" +
+		"From: root@nsa.gov\r\n\r\nHey <3\r\n"
+	if string(msg.Data) != want {
+		t.Errorf("Invalid mail data:\n%v", string(msg.Data))
+	}
+}
+
+type dkimVerifier struct{}
+
+func (dkimVerifier) NewDKIMVerification(ctx context.Context) smtp.DKIMVerification {
+	return &dkimVerification{}
+}
+
+// dkimVerification passes if the message contains "signed".
+type dkimVerification struct {
+	bytes.Buffer
+}
+
+func (v *dkimVerification) Results() []smtp.DKIMResult {
+	status := smtp.DKIMFail
+	if strings.Contains(v.String(), "signed") {
+		status = smtp.DKIMPass
+	}
+	return []smtp.DKIMResult{{Status: status, Domain: "nsa.gov"}}
+}
+
+type dkimSession struct {
+	*session
+	results chan<- []smtp.DKIMResult
+}
+
+func (s *dkimSession) DataDKIM(ctx context.Context, r io.Reader, results func() []smtp.DKIMResult) error {
+	if err := s.session.Data(io.LimitReader(r, 6)); err != nil {
+		return err
+	}
+	s.results <- results()
+	return nil
+}
+
+func TestServer_BATV(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.BATVVerifier = smtp.BATVVerifierFunc(func(addr string, bounce bool) (string, error) {
+			if orig, ok := strings.CutPrefix(addr, "prvs=0000000000="); ok {
+				return orig, nil
+			} else if bounce {
+				return "", errors.New("unsigned")
+			}
+			return addr, nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"MAIL FROM:<>", "250 "},
+		{"RCPT TO:<root@gchq.gov.uk>", "550 5.7.1 Invalid bounce address"},
+		{"RCPT TO:<prvs=0000000000=root@gchq.gov.uk>", "250 "},
+		{"DATA", "354 "},
+		{"Hey <3\r\n.", "250 "},
+		{"MAIL FROM:<root@nsa.gov>", "250 "},
+		{"RCPT TO:<root@gchq.gov.uk>", "250 "},
+		{"RCPT TO:<prvs=0000000000=alice@gchq.gov.uk>", "250 "},
+		{"RSET", "250 "},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Fatalf("Invalid response to %q: %v", tc.cmd, scanner.Text())
+		}
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatalf("Invalid number of sent messages: %v", len(be.messages))
+	}
+	if to := be.messages[0].To; len(to) != 1 || to[0] != "root@gchq.gov.uk" {
+		t.Errorf("Invalid recipients: %v, want [root@gchq.gov.uk]", to)
+	}
+}
+
+func TestServer_DKIM(t *testing.T) {
+	results := make(chan []smtp.DKIMResult, 1)
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.DKIMVerifier = dkimVerifier{}
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			s, err := be.NewSession(c)
+			if err != nil {
+				return nil, err
+			}
+			return &dkimSession{s.(*session), results}, nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "From: root@nsa.gov\r\n\r\nThis message is signed\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	// The verifier reads the part of the message skipped by the backend
+	if got := <-results; len(got) != 1 || got[0].Status != smtp.DKIMPass {
+		t.Errorf("Invalid DKIM results: %+v", got)
+	}
+	if got := string(be.messages[0].Data); got != "From: " {
+		t.Errorf("Invalid mail data: %q", got)
+	}
+}
+
+func TestServer_DKIMPolicy(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.DKIMVerifier = dkimVerifier{}
+		s.DKIMPolicy = func(conn *smtp.Conn, results []smtp.DKIMResult) error {
+			for _, res := range results {
+				if res.Status == smtp.DKIMPass {
+					return nil
+				}
+			}
+			if strings.HasPrefix(conn.Hostname(), "legacy.") {
+				return errors.New("legacy client")
+			}
+			return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 20}, Message: "Try signing"}
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		helo, body, want string
+	}{
+		{"localhost", "This message is signed", "250 2.0.0 OK: queued"},
+		{"localhost", "This message isn't", "451 4.7.20 Try signing"},
+		{"legacy.example.org", "This message isn't", "550 5.7.20 No passing DKIM signature found"},
+	} {
+		io.WriteString(c, "EHLO "+tc.helo+"\r\n")
+		for scanner.Scan() && strings.HasPrefix(scanner.Text(), "250-") {
+		}
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, "From: root@nsa.gov\r\n\r\n"+tc.body+"\r\n.\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("DATA response for %q = %q, want %q", tc.body, scanner.Text(), tc.want)
+		}
+	}
+	if len(be.messages) != 1 {
+		t.Errorf("Invalid number of sent messages: %v", len(be.messages))
+	}
+}
+
+// dmarcEvaluator fails messages without a passing DKIM signature, and asks
+// for them to be rejected if they're from nsa.gov.
+type dmarcEvaluator struct {
+	msgs chan<- *smtp.DMARCMessage
+}
+
+func (e dmarcEvaluator) EvaluateDMARC(ctx context.Context, msg *smtp.DMARCMessage) *smtp.DMARCResult {
+	e.msgs <- msg
+	res := &smtp.DMARCResult{
+		Status:      smtp.DMARCPass,
+		Domain:      msg.HeaderFrom,
+		Policy:      smtp.DMARCDispositionQuarantine,
+		Disposition: smtp.DMARCDispositionNone,
+	}
+	if msg.HeaderFrom == "nsa.gov" {
+		res.Policy = smtp.DMARCDispositionReject
+	}
+	if len(msg.DKIM) == 0 || msg.DKIM[0].Status != smtp.DKIMPass {
+		res.Status, res.Disposition = smtp.DMARCFail, res.Policy
+	}
+	return res
+}
+
+type dmarcSession struct {
+	*session
+	conn    *smtp.Conn
+	results chan<- *smtp.DMARCResult
+}
+
+func (s *dmarcSession) Data(r io.Reader) error {
+	if err := s.session.Data(r); err != nil {
+		return err
+	}
+	s.results <- s.conn.DMARC()
+	return nil
+}
+
+func TestServer_DMARC(t *testing.T) {
+	msgs := make(chan *smtp.DMARCMessage, 1)
+	results := make(chan *smtp.DMARCResult, 1)
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.SPFChecker = smtp.SPFCheckerFunc(func(ctx context.Context, ip net.IP, helo, sender string) (smtp.SPFResult, error) {
+			return smtp.SPFPass, nil
+		})
+		s.DKIMVerifier = dkimVerifier{}
+		s.DMARCEvaluator = dmarcEvaluator{msgs}
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			s, err := be.NewSession(c)
+			if err != nil {
+				return nil, err
+			}
+			return &dmarcSession{s.(*session), c, results}, nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		from, body, want string
+		disposition      smtp.DMARCDisposition
+	}{
+		{"root@nsa.gov", "This message is signed", "250 2.0.0 OK: queued", smtp.DMARCDispositionNone},
+		{"root@gchq.gov.uk", "This message isn't", "250 2.0.0 OK: queued", smtp.DMARCDispositionQuarantine},
+		{"\"Root\" <root@NSA.gov>", "This message isn't", "550 5.7.1 Rejected by DMARC policy for nsa.gov", ""},
+	} {
+		io.WriteString(c, "MAIL FROM:<root@mail.nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, "Subject: Hey\r\nFrom: "+tc.from+"\r\n\r\n"+tc.body+"\r\n.\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("DATA response for %q = %q, want %q", tc.from, scanner.Text(), tc.want)
+		}
+
+		msg := <-msgs
+		if msg.HeaderFrom == "" || !strings.Contains(strings.ToLower(tc.from), msg.HeaderFrom) {
+			t.Errorf("HeaderFrom = %q for From: %v", msg.HeaderFrom, tc.from)
+		}
+		if msg.MailFrom != "mail.nsa.gov" || msg.SPF != smtp.SPFPass || len(msg.DKIM) != 1 {
+			t.Errorf("Invalid DMARC message: %+v", msg)
+		}
+		if tc.disposition != "" {
+			if res := <-results; res == nil || res.Disposition != tc.disposition {
+				t.Errorf("Conn.DMARC() = %+v, want disposition %v", res, tc.disposition)
+			}
+		}
+	}
+	if len(be.messages) != 2 {
+		t.Errorf("Invalid number of sent messages: %v", len(be.messages))
+	}
+}
+
+type etrnSession struct {
+	*session
+	nodes *[]string
+}
+
+func (s *etrnSession) ETRN(node string) error {
+	if node == "empty.example.org" {
+		return &smtp.SMTPError{Code: 251, EnhancedCode: smtp.EnhancedCode{2, 0, 0}, Message: "No messages waiting"}
+	}
+	*s.nodes = append(*s.nodes, node)
+	return nil
+}
+
+func withETRN(nodes *[]string) serverConfigureFunc {
+	return func(s *smtp.Server) {
+		s.EnableETRN = true
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			s, err := be.NewSession(c)
+			if err != nil {
+				return nil, err
+			}
+			return &etrnSession{s.(*session), nodes}, nil
+		})
+	}
+}
+
+func TestServer_ETRN(t *testing.T) {
+	var nodes []string
+	_, s, c, scanner := testServerAuthenticated(t, withETRN(&nodes))
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		arg, resp string
+	}{
+		{"", "501 "},
+		{"bad domain", "501 5.5.4 "},
+		{"example.org", "250 2.0.0 "},
+		{"@example.org", "250 2.0.0 "},
+		{"#queue", "250 2.0.0 "},
+		{"empty.example.org", "251 2.0.0 "},
+	} {
+		io.WriteString(c, "ETRN "+tc.arg+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.resp) {
+			t.Errorf("Invalid ETRN %v response: %v", tc.arg, scanner.Text())
+		}
+	}
+
+	want := []string{"example.org", "@example.org", "#queue"}
+	if strings.Join(nodes, ",") != strings.Join(want, ",") {
+		t.Errorf("ETRN nodes = %v, want %v", nodes, want)
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "ETRN example.org\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "503 5.5.1 ") {
+		t.Errorf("Invalid ETRN response during a transaction: %v", scanner.Text())
+	}
+}
+
+func TestServer_ETRNTrustedNets(t *testing.T) {
+	for _, tc := range []struct {
+		nets, resp string
+	}{
+		{"192.0.2.0/24", "459 4.7.1 "},
+		{"localhost", "250 2.0.0 "},
+	} {
+		var nodes []string
+		_, s, c, scanner, caps := testServerEhlo(t, withETRN(&nodes), func(s *smtp.Server) {
+			s.ETRNTrustedNets, _ = smtp.ParseTrustedNets(tc.nets)
+		})
+		if !caps["ETRN"] {
+			t.Fatal("ETRN capability is missing")
+		}
+		io.WriteString(c, "ETRN example.org\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.resp) {
+			t.Errorf("Invalid ETRN response with trusted networks %v: %v", tc.nets, scanner.Text())
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_Validation(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.Validation = smtp.ValidationStrictRFC
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 5.5.2 ") {
+		t.Fatalf("Invalid EHLO response for an unqualified domain: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO mx_1.example.org\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 5.5.2 ") {
+		t.Fatalf("Invalid EHLO response for a malformed domain: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO [127.0.0.1]\r\n")
+	caps := readCaps(t, scanner)
+	for _, cap := range []string{"SIZE 26214400", "LIMITS RCPTMAX=100"} {
+		if !caps[cap] {
+			t.Errorf("Capability %q not advertised, got %v", cap, caps)
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa..gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 5.1.7 ") {
+		t.Fatalf("Invalid MAIL response for a malformed address: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatalf("Invalid MAIL response: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@[300.0.0.1]>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 5.1.3 ") {
+		t.Fatalf("Invalid RCPT response for a malformed address: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@[IPv6:::1]>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatalf("Invalid RCPT response: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatalf("Invalid DATA response: %v", scanner.Text())
+	}
+	io.WriteString(c, "Hey\n<3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "550 5.5.2 ") {
+		t.Fatalf("Invalid response for a bare LF: %v", scanner.Text())
+	}
+	if len(be.messages) != 0 {
+		t.Errorf("Message with a bare LF accepted")
+	}
+
+	// The connection is still in sync
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatalf("Invalid NOOP response: %v", scanner.Text())
+	}
+}
+
+func TestServer_StrictSyntax(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.StrictSyntax = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"EHLO localhost\n", "500 5.5.2 Bare LF line endings are not allowed"},
+		{"EHLO mx_1.example.org\r\n", "501 5.5.2 Invalid domain/address argument"},
+		{"EHLO localhost junk\r\n", "501 5.5.2 Invalid domain/address argument"},
+		{"HELO localhost\r\n", "250 2.0.0 Hello localhost"},
+		{"MAIL FROM: <root@nsa.gov>\r\n", "501 5.1.7 Invalid sender address syntax: expected '<'"},
+		{"MAIL FROM:<root..admin@nsa.gov>\r\n", "501 5.1.7 Invalid sender address syntax: in mailbox: in local-part: malformed dot-string"},
+		{"MAIL FROM:<root@nsa_gov>\r\n", "501 5.1.7 Invalid sender address syntax: in mailbox: invalid domain"},
+		{"MAIL FROM:<>\r\n", "250 2.0.0 Roger, accepting mail from <>"},
+		{"RCPT TO:<root@[192.0.2.256]>\r\n", "501 5.1.3 Invalid recipient address syntax: in mailbox: invalid domain"},
+		{"RCPT TO:<\"root admin\"@[IPv6:2001:db8::1]>\r\n", "250 2.0.0 I'll make sure <root admin@[IPv6:2001:db8::1]> gets this"},
+	} {
+		io.WriteString(c, tc.cmd)
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Response to %q = %q, want %q", tc.cmd, scanner.Text(), tc.want)
+		}
+	}
+}
+
+func TestServer_ESMTPParams(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableDSN = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"MAIL FROM:<root@nsa.gov> SIZE=1 size=2\r\n", "501 5.5.4 Unable to parse MAIL ESMTP parameters: duplicate parameter SIZE"},
+		{"MAIL FROM:<root@nsa.gov> SIZE=\r\n", "501 5.5.4 Unable to parse MAIL ESMTP parameters: malformed value for parameter SIZE"},
+		{"MAIL FROM:<root@nsa.gov> ENVID=YWJj== RET=HDRS\r\n", "250 2.0.0 Roger, accepting mail from <root@nsa.gov>"},
+		{"RCPT TO:<root@gchq.gov.uk> NOTIFY=NEVER =x\r\n", `501 5.5.4 Unable to parse RCPT ESMTP parameters: malformed parameter "=x"`},
+		{"RCPT TO:<root@gchq.gov.uk> NOTIFY=NEVER ORCPT=rfc822;root+40gchq.gov.uk\r\n", "250 2.0.0 I'll make sure <root@gchq.gov.uk> gets this"},
+		{"DATA\r\n", "354 Go ahead. End your data with <CR><LF>.<CR><LF>"},
+		{"Hey <3\r\n.\r\n", "250 2.0.0 OK: queued"},
+	} {
+		io.WriteString(c, tc.cmd)
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Response to %q = %q, want %q", tc.cmd, scanner.Text(), tc.want)
+		}
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatalf("Invalid number of sent messages: %v", len(be.anonmsgs))
+	}
+	if envID := be.anonmsgs[0].Opts.EnvelopeID; envID != "YWJj==" {
+		t.Errorf("MailOptions.EnvelopeID = %q, want %q", envID, "YWJj==")
+	}
+}
+
+func TestServer_ValidationLimits(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.Validation = smtp.ValidationPermissiveInternet
+		s.MaxMessageBytes = 1024
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	caps := readCaps(t, scanner)
+	for _, cap := range []string{"SIZE 1024", "LIMITS RCPTMAX=1000"} {
+		if !caps[cap] {
+			t.Errorf("Capability %q not advertised, got %v", cap, caps)
+		}
+	}
+}
+
+type atrnQueue struct {
+	msgs []*smtp.ATRNMessage
+	done map[string][]error
+}
+
+func (q *atrnQueue) Next() (*smtp.ATRNMessage, error) {
+	if len(q.msgs) == 0 {
+		return nil, nil
+	}
+	msg := q.msgs[0]
+	q.msgs = q.msgs[1:]
+	return msg, nil
+}
+
+func (q *atrnQueue) Done(msg *smtp.ATRNMessage, rcptErrs []error) error {
+	q.done[msg.From] = rcptErrs
+	return nil
+}
+
+func (q *atrnQueue) Close() error {
+	return nil
+}
+
+type atrnSession struct {
+	*session
+	queue   *atrnQueue
+	domains *[]string
+}
+
+func (s *atrnSession) ATRN(domains []string) (smtp.ATRNQueue, error) {
+	*s.domains = domains
+	return s.queue, nil
+}
+
+func withATRN(queue *atrnQueue, domains *[]string) serverConfigureFunc {
+	return func(s *smtp.Server) {
+		s.EnableATRN = true
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			s, err := be.NewSession(c)
+			if err != nil {
+				return nil, err
+			}
+			return &atrnSession{s.(*session), queue, domains}, nil
+		})
+	}
+}
+
+func TestServer_ATRN(t *testing.T) {
+	queue := &atrnQueue{
+		msgs: []*smtp.ATRNMessage{
+			{From: "root@nsa.gov", To: []string{"root@example.org", "nobody@example.org"}, Data: strings.NewReader("Hey <3\r\n")},
+			{From: "root@gchq.gov.uk", To: []string{"root@example.org"}, Data: strings.NewReader("Hey again <3\r\n")},
+		},
+		done: make(map[string][]error),
+	}
+	var domains []string
+	_, s, c, scanner := testServerAuthenticated(t, withATRN(queue, &domains))
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "ATRN example.org,bad_domain\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
+		t.Fatalf("Invalid ATRN response for a malformed domain: %v", scanner.Text())
+	}
+
+	io.WriteString(c, "ATRN example.org,example.com\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 2.0.0 ") {
+		t.Fatalf("Invalid ATRN response: %v", scanner.Text())
+	}
+	if strings.Join(domains, ",") != "example.org,example.com" {
+		t.Errorf("ATRN domains = %v, want [example.org example.com]", domains)
+	}
+
+	// Roles are reversed
+	expect := func(cmd, resp string) {
+		t.Helper()
+		scanner.Scan()
+		if scanner.Text() != cmd {
+			t.Fatalf("Got %q, want %q", scanner.Text(), cmd)
+		}
+		if resp != "" {
+			io.WriteString(c, resp+"\r\n")
+		}
+	}
+	io.WriteString(c, "220 example.org ESMTP Service Ready\r\n")
+	expect("EHLO localhost", "250 Hello localhost")
+	expect("MAIL FROM:<root@nsa.gov>", "250 OK")
+	expect("RCPT TO:<root@example.org>", "250 OK")
+	expect("RCPT TO:<nobody@example.org>", "550 5.1.1 No such user")
+	expect("DATA", "354 Go ahead")
+	expect("Hey <3", "")
+	expect(".", "250 OK")
+	expect("MAIL FROM:<root@gchq.gov.uk>", "250 OK")
+	expect("RCPT TO:<root@example.org>", "250 OK")
+	expect("DATA", "354 Go ahead")
+	expect("Hey again <3", "")
+	expect(".", "250 OK")
+	expect("QUIT", "221 Bye")
+
+	if scanner.Scan() {
+		t.Errorf("Connection not closed, got %v", scanner.Text())
+	}
+
+	rcptErrs := queue.done["root@nsa.gov"]
+	if len(rcptErrs) != 2 || rcptErrs[0] != nil || rcptErrs[1] == nil {
+		t.Errorf("Recipient errors = %v, want [<nil> 550]", rcptErrs)
+	}
+	if rcptErrs := queue.done["root@gchq.gov.uk"]; len(rcptErrs) != 1 || rcptErrs[0] != nil {
+		t.Errorf("Recipient errors = %v, want [<nil>]", rcptErrs)
+	}
+}
+
+func TestServer_ATRNEagerGreeting(t *testing.T) {
+	queue := &atrnQueue{
+		msgs: []*smtp.ATRNMessage{
+			{From: "root@nsa.gov", To: []string{"root@example.org"}, Data: strings.NewReader("Hey <3\r\n")},
+		},
+		done: make(map[string][]error),
+	}
+	var domains []string
+	_, s, c, scanner := testServerAuthenticated(t, withATRN(queue, &domains))
+	defer s.Close()
+	defer c.Close()
+
+	// The greeting is sent without waiting for the reply to ATRN
+	io.WriteString(c, "ATRN example.org\r\n220 example.org ESMTP Service Ready\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 2.0.0 ") {
+		t.Fatalf("Invalid ATRN response: %v", scanner.Text())
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner.Scan()
+	if scanner.Text() != "EHLO localhost" {
+		t.Fatalf("Got %q after the greeting, want EHLO", scanner.Text())
+	}
+}
+
+func TestServer_ATRNNoMail(t *testing.T) {
+	queue := &atrnQueue{done: make(map[string][]error)}
+	var domains []string
+	_, s, c, scanner := testServerAuthenticated(t, withATRN(queue, &domains))
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "ATRN\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "453 4.3.0 ") {
+		t.Fatalf("Invalid ATRN response: %v", scanner.Text())
+	}
+	if domains != nil {
+		t.Errorf("ATRN domains = %v, want none", domains)
+	}
+}
+
+func TestServer_ATRNUnauthenticated(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, withATRN(nil, nil))
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["ATRN"] {
+		t.Fatal("ATRN capability is missing")
+	}
+	io.WriteString(c, "ATRN example.org\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "530 5.7.0 ") {
+		t.Fatalf("Invalid ATRN response: %v", scanner.Text())
+	}
+}
+
+type monitoredChecker struct{}
+
+func (monitoredChecker) CheckConnection(ctx context.Context, conn *smtp.Conn) error {
+	return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Go away"}
+}
+
+func (monitoredChecker) PolicyMode() smtp.PolicyMode {
+	return smtp.PolicyMonitor
+}
+
+func TestServer_PolicyMonitor(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	validation := *smtp.ValidationStrictRFC
+	validation.Mode = smtp.PolicyMonitor
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.Logger = slog.New(slog.NewTextHandler(lockedWriter{&mu, &buf}, nil))
+		s.ConnectionChecker = monitoredChecker{}
+		s.RateLimiter = &smtp.TokenBucketLimiter{
+			CommandsPerSecond: 0.001,
+			CommandBurst:      1,
+			Mode:              smtp.PolicyMonitor,
+		}
+		s.Validation = &validation
+	})
+	defer s.Close()
+
+	for _, cmd := range []string{
+		"HELO localhost",
+		"MAIL FROM:<root@nsa..gov>",
+		"RCPT TO:<root@[300.0.0.1]>",
+		"DATA",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") && !strings.HasPrefix(scanner.Text(), "354 ") {
+			t.Fatalf("Invalid response to %v: %v", cmd, scanner.Text())
+		}
+	}
+	io.WriteString(c, "Hey\n<3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatalf("Invalid response for a bare LF: %v", scanner.Text())
+	}
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	c.Close()
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	logs := buf.String()
+	for _, want := range []string{
+		"event=reject",
+		"event=rate_limit",
+		"reply=\"Fully-qualified domain required\"",
+		"reply=\"Invalid sender address\"",
+		"reply=\"Invalid recipient address\"",
+		"reply=\"Message contains a bare CR or LF\"",
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Logs don't contain %q:\n%v", want, logs)
+		}
+	}
+	if n := strings.Count(logs, "monitor=true"); n < 6 {
+		t.Errorf("Got %v monitored rejections, want at least 6:\n%v", n, logs)
+	}
+}
+
+type policySession struct {
+	*session
+}
+
+func (s *policySession) Mail(from string, opts *smtp.MailOptions) error {
+	if from == "spammer@example.org" {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Sender blocked"}
+	}
+	return s.session.Mail(from, opts)
+}
+
+func (s *policySession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	switch to {
+	case "blocked@example.org":
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Recipient blocked"}
+	case "greylisted@example.org":
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Greylisted"}
+	case "unknown@example.org":
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	return s.session.Rcpt(to, opts)
+}
+
+func TestServer_DeferPolicyRejections(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.DeferPolicyRejections = true
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			s, err := be.NewSession(c)
+			if err != nil {
+				return nil, err
+			}
+			return &policySession{s.(*session)}, nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		from  string
+		rcpts []string
+		bdat  bool
+		resp  string
+	}{
+		{"spammer@example.org", []string{"root@gchq.gov.uk"}, false, "550 5.7.1 Sender blocked"},
+		{"root@nsa.gov", []string{"greylisted@example.org", "blocked@example.org", "root@gchq.gov.uk"}, false, "550 5.7.1 Recipient blocked"},
+		{"root@nsa.gov", []string{"root@gchq.gov.uk", "greylisted@example.org"}, true, "451 4.7.1 Greylisted"},
+		{"root@nsa.gov", []string{"root@gchq.gov.uk"}, false, "250 2.0.0 "},
+	} {
+		io.WriteString(c, "MAIL FROM:<"+tc.from+">\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatalf("Invalid MAIL response: %v", scanner.Text())
+		}
+		for _, rcpt := range tc.rcpts {
+			io.WriteString(c, "RCPT TO:<"+rcpt+">\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "250 ") {
+				t.Fatalf("Invalid RCPT response: %v", scanner.Text())
+			}
+		}
+
+		// Other rejections aren't deferred. Recipients aren't checked once
+		// MAIL has been rejected.
+		if tc.from != "spammer@example.org" {
+			io.WriteString(c, "RCPT TO:<unknown@example.org>\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "550 5.1.1 ") {
+				t.Fatalf("Invalid RCPT response: %v", scanner.Text())
+			}
+		}
+
+		if tc.bdat {
+			io.WriteString(c, "BDAT 4\r\nHey ")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "250 ") {
+				t.Fatalf("Invalid BDAT response: %v", scanner.Text())
+			}
+			io.WriteString(c, "BDAT 4 LAST\r\n<3\r\n")
+		} else {
+			io.WriteString(c, "DATA\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "354 ") {
+				t.Fatalf("Invalid DATA response: %v", scanner.Text())
+			}
+			io.WriteString(c, "Hey <3\r\n.\r\n")
+		}
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.resp) {
+			t.Errorf("Invalid response to a message from %v to %v: got %v, want %v", tc.from, tc.rcpts, scanner.Text(), tc.resp)
+		}
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatalf("Got %v messages, want 1", len(be.messages))
+	}
+}
+
+type timingSession struct {
+	*session
+	conn    *smtp.Conn
+	timings chan smtp.Timing
+}
+
+func (s *timingSession) Data(r io.Reader) error {
+	if err := s.session.Data(r); err != nil {
+		return err
+	}
+	s.timings <- s.conn.Timing()
+	return nil
+}
+
+func TestServer_Timing(t *testing.T) {
+	var buf bytes.Buffer
+	var mu sync.Mutex
+	timings := make(chan smtp.Timing, 2)
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Logger = slog.New(slog.NewTextHandler(lockedWriter{&mu, &buf}, nil))
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			s, err := be.NewSession(c)
+			if err != nil {
+				return nil, err
+			}
+			return &timingSession{s.(*session), c, timings}, nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, bdat := range []bool{false, true} {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		time.Sleep(10 * time.Millisecond)
+		if bdat {
+			io.WriteString(c, "BDAT 8 LAST\r\nHey <3\r\n")
+		} else {
+			io.WriteString(c, "DATA\r\n")
+			scanner.Scan()
+			io.WriteString(c, "Hey <3\r\n.\r\n")
+		}
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatalf("Invalid response: %v", scanner.Text())
+		}
+
+		timing := <-timings
+		if timing.Connected.IsZero() || timing.Connected.After(timing.Mail) {
+			t.Errorf("Connected = %v, want before Mail = %v", timing.Connected, timing.Mail)
+		}
+		if d := timing.MailToData(); d < 10*time.Millisecond {
+			t.Errorf("MailToData() = %v, want at least 10ms", d)
+		}
+		if timing.DataEnd.IsZero() || timing.DataBytes != 8 {
+			t.Errorf("DataEnd = %v, DataBytes = %v, want the end of a 8-byte message", timing.DataEnd, timing.DataBytes)
+		}
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	c.Close()
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	logs := buf.String()
+	for _, want := range []string{"size=8", "mail_to_data=", "data_duration=", "duration="} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Logs don't contain %q:\n%v", want, logs)
+		}
+	}
+}
+
+func TestServer_ServeSTDIO(t *testing.T) {
+	be := new(backend)
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	s.ReadTimeout = time.Second
+
+	stdinR, stdinW := io.Pipe()
+	stdoutR, stdoutW := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeSTDIO(ctx, stdinR, stdoutW)
+	}()
+
+	scanner := bufio.NewScanner(stdoutR)
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"HELO localhost", "250 "},
+		{"MAIL FROM:<root@nsa.gov>", "250 "},
+		{"RCPT TO:<root@gchq.gov.uk>", "250 "},
+		{"DATA", "354 "},
+		{"Hey <3\r\n.", "250 "},
+		{"QUIT", "221 "},
+	} {
+		io.WriteString(stdinW, tc.cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Fatalf("Invalid response to %q: %v", tc.cmd, scanner.Text())
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal("ServeSTDIO() =", err)
+	}
+	if len(be.anonmsgs) != 1 || string(be.anonmsgs[0].Data) != "Hey <3\r\n" {
+		t.Fatalf("Invalid messages: %+v", be.anonmsgs)
+	}
+
+	// Timeouts are emulated
+	go func() {
+		done <- s.ServeSTDIO(ctx, stdinR, stdoutW)
+	}()
+	scanner.Scan()
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 4.4.2 ") {
+		t.Fatal("Invalid response to an idle client:", scanner.Text())
+	}
+	if err := <-done; err != nil {
+		t.Fatal("ServeSTDIO() =", err)
+	}
+
+	// The session is interrupted when the context is done
+	go func() {
+		done <- s.ServeSTDIO(ctx, stdinR, stdoutW)
+	}()
+	scanner.Scan()
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatal("ServeSTDIO() =", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeSTDIO() didn't return after the context was cancelled")
+	}
+}
+
+func TestWrapBackend(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		buf     bytes.Buffer
+		methods []string
+	)
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.EnableETRN = true
+		s.ErrorLog = log.New(ioutil.Discard, "", 0)
+		s.Logger = slog.New(slog.NewTextHandler(lockedWriter{&mu, &buf}, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		s.Backend = smtp.WrapBackend(s.Backend,
+			smtp.ObserveSessionCalls(func(method string, d time.Duration, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				methods = append(methods, method)
+			}),
+			smtp.LogSessionCalls(),
+			smtp.RecoverSessionPanics(),
+		)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Add-on interfaces not implemented by the session aren't used
+	io.WriteString(c, "ETRN example.org\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "458 ") {
+		t.Fatal("Invalid ETRN response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.messages))
+	}
+
+	// Panics are recovered, and the connection stays open
+	be.panicOnMail = true
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "451 4.3.0 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"NewSession", "AuthMechanisms", "Auth", "Mail", "Rcpt", "Data", "Reset", "Mail"}
+	if !reflect.DeepEqual(methods, want) {
+		t.Errorf("Session calls = %v, want %v", methods, want)
+	}
+	if !strings.Contains(buf.String(), "event=session_call") || !strings.Contains(buf.String(), "method=Rcpt") {
+		t.Errorf("Session calls not logged:\n%v", buf.String())
+	}
+}
+
+func TestServer_unsupportedExtensions(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"BURL imap://example.org/;UID=1 LAST", "502 5.5.1 BURL command not implemented"},
+		{"ATRN example.org", "502 5.5.1 ATRN command not implemented"},
+		{"XYZY", "500 5.5.2 Syntax errors, XYZY command unrecognized"},
+		{"MAIL FROM:<root@nsa.gov> SUBMITTER=root@nsa.gov", "504 5.5.4 SUBMITTER is not implemented"},
+		{"MAIL FROM:<root@nsa.gov> SOLICIT=org.example", "504 5.5.4 SOLICIT is not implemented"},
+		{"MAIL FROM:<root@nsa.gov> XYZZY", "500 5.5.4 Unknown MAIL FROM argument"},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.want {
+			t.Errorf("Response to %q = %q, want %q", tc.cmd, scanner.Text(), tc.want)
+		}
+	}
+}
+
+func TestServer_BDATWithoutEHLO(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	// CHUNKING isn't offered to clients greeting with HELO. The chunk must
+	// not be interpreted as commands.
+	io.WriteString(c, "BDAT 6 LAST\r\nNOOP\r\n")
+	scanner.Scan()
+	if scanner.Text() != "502 5.5.1 BDAT command not implemented, use EHLO" {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 Session reset" {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+}
+
+func TestServer_BDATRejectedChunk(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	for _, cmd := range []string{
+		"BDAT 6 LAST",
+		"BDAT 6 FIRST",
+		"BDAT 6 LAST MORE",
+	} {
+		io.WriteString(c, cmd+"\r\nNOOP\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "50") {
+			t.Fatalf("Invalid %q response: %v", cmd, scanner.Text())
+		}
+
+		io.WriteString(c, "RSET\r\n")
+		scanner.Scan()
+		if scanner.Text() != "250 2.0.0 Session reset" {
+			t.Fatalf("Invalid RSET response after %q: %v", cmd, scanner.Text())
+		}
+	}
+}
+
+func TestServer_MaxConnectionMemory(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxConnectionMemory = 1000
+		s.DataSpoolThreshold = -1
+		s.DKIMVerifier = dkimVerifier{}
+		s.DKIMPolicy = func(c *smtp.Conn, results []smtp.DKIMResult) error {
+			return nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "NOOP "+strings.Repeat("x", 1000)+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "451 4.3.1 ") {
+		t.Fatal("Invalid response to a long command:", scanner.Text())
+	}
+
+	io.WriteString(c, "AUTH PLAIN "+strings.Repeat("A", 1400)+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "451 4.3.1 ") {
+		t.Fatal("Invalid response to a long AUTH response:", scanner.Text())
+	}
+
+	for _, tc := range []struct {
+		header, want string
+	}{
+		{"Subject: " + strings.Repeat("x", 1000), "451 4.3.1 "},
+		{"Subject: Hey", "250 "},
+		{"Subject: " + strings.Repeat("x", 900), "250 "},
+	} {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		// The body isn't accounted for
+		io.WriteString(c, tc.header+"\r\n\r\n"+strings.Repeat("Hey <3\r\n", 500)+".\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Errorf("DATA response with a %v bytes header = %q, want %q", len(tc.header), scanner.Text(), tc.want)
+		}
+	}
+	if len(be.anonmsgs)+len(be.messages) != 2 {
+		t.Errorf("Invalid number of sent messages: %v", len(be.anonmsgs)+len(be.messages))
+	}
+}
+
+func TestServer_DataSpoolThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		threshold int64
+		want      string
+	}{
+		{0, "451 4.3.1 "},
+		{500, "250 "},
+	} {
+		be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+			s.MaxConnectionMemory = 1000
+			s.DataSpoolThreshold = tc.threshold
+		})
+
+		body := strings.Repeat("Hey <3\r\n", 500)
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, body+".\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Errorf("DATA response with threshold %v = %q, want %q", tc.threshold, scanner.Text(), tc.want)
+		}
+
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, fmt.Sprintf("BDAT %v LAST\r\n", len(body))+body)
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Errorf("BDAT response with threshold %v = %q, want %q", tc.threshold, scanner.Text(), tc.want)
+		}
+
+		want := 0
+		if tc.want == "250 " {
+			want = 2
+		}
+		if len(be.messages) != want {
+			t.Errorf("Invalid number of sent messages with threshold %v: %v", tc.threshold, len(be.messages))
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_MemoryExhausted(t *testing.T) {
+	conns := make(chan *smtp.Conn, 1)
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxConnectionMemory = 1000
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conns <- c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	conn := <-conns
+	if err := conn.ReserveMemory(1000); err != nil {
+		t.Fatalf("ReserveMemory() = %v", err)
+	}
+	if err := conn.ReserveMemory(1); err == nil {
+		t.Fatalf("ReserveMemory() = nil beyond the budget")
+	}
+
+	for _, tc := range []struct {
+		cmd, want string
+	}{
+		{"NOOP", "451 4.3.1 "},
+		{"MAIL FROM:<root@nsa.gov>", "451 4.3.1 "},
+		{"RSET", "250 "},
+		{"QUIT", "221 "},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.want) {
+			t.Errorf("Response to %q = %q, want %q", tc.cmd, scanner.Text(), tc.want)
+		}
+	}
+}
+
+type memorySession struct {
+	*session
+	c *smtp.Conn
+}
+
+func (s *memorySession) Mail(from string, opts *smtp.MailOptions) error {
+	if err := s.c.ReserveMemory(60); err != nil {
+		return err
+	}
+	return s.session.Mail(from, opts)
+}
+
+func TestServer_MaxMemory(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxMemory = 100
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			s, err := be.NewSession(c)
+			if err != nil {
+				return nil, err
+			}
+			return &memorySession{s.(*session), c}, nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	io.WriteString(c2, "HELO localhost\r\n")
+	scanner2.Scan()
+	io.WriteString(c2, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "451 4.3.1 ") {
+		t.Fatal("Invalid MAIL response beyond the server budget:", scanner2.Text())
+	}
+
+	// Reservations are released when the connection is closed
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	for i := 0; ; i++ {
+		io.WriteString(c2, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner2.Scan()
+		if strings.HasPrefix(scanner2.Text(), "250 ") {
+			break
+		} else if i == 100 {
+			t.Fatal("Invalid MAIL response after the connection is closed:", scanner2.Text())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,70 @@
+package smtp
+
+import (
+	"log/slog"
+	"time"
+)
+
+// sessionRejectTimeout bounds the time spent replying to a connection
+// rejected because of Server.MaxSessions.
+const sessionRejectTimeout = 10 * time.Second
+
+// sessionSlots returns the semaphore of Server.MaxSessions, nil if there is
+// no limit.
+func (s *Server) sessionSlots() chan struct{} {
+	if s.MaxSessions <= 0 {
+		return nil
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = make(chan struct{}, s.MaxSessions)
+	}
+	return s.sessions
+}
+
+// acquireSession takes a session slot, waiting up to Server.MaxSessionsWait
+// for one to be released. It returns false if none is available, or if the
+// server is closed in the meantime.
+func (s *Server) acquireSession() bool {
+	slots := s.sessionSlots()
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if s.MaxSessionsWait <= 0 {
+		return false
+	}
+
+	timer := s.clock().NewTimer(s.MaxSessionsWait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C():
+		return false
+	case <-s.done:
+		return false
+	}
+}
+
+// releaseSession releases a session slot taken by acquireSession.
+func (s *Server) releaseSession() {
+	if slots := s.sessionSlots(); slots != nil {
+		<-slots
+	}
+}
+
+// rejectSession replies to a connection for which no session slot is
+// available, and closes it.
+func (s *Server) rejectSession(c *Conn) {
+	c.conn.SetDeadline(time.Now().Add(sessionRejectTimeout))
+	c.log(slog.LevelWarn, "session_limit", "session limit reached", slog.Int("max_sessions", s.MaxSessions))
+	c.Kick(421, EnhancedCode{4, 3, 2}, "Service not available, try again later")
+}
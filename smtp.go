@@ -12,6 +12,7 @@
 //   - DSN (RFC 3461, RFC 6533)
 //   - SMTPUTF8 (RFC 6531)
 //   - MT-PRIORITY (RFC 6710)
+//   - FUTURERELEASE (RFC 4865)
 //   - RRVS (RFC 7293)
 //   - REQUIRETLS (RFC 8689)
 //
@@ -71,6 +72,30 @@ type MailOptions struct {
 	//
 	// Defined in RFC 4954.
 	Auth *string
+
+	// Value of the HOLDFOR= argument, or zero if unset. Defined in RFC 4865.
+	HoldFor time.Duration
+	// Value of the HOLDUNTIL= argument, or the zero time if unset. Defined
+	// in RFC 4865.
+	HoldUntil time.Time
+
+	// Value of the BY= argument, or nil if unset. Defined in RFC 2852.
+	DeliverBy *DeliverByOptions
+
+	// Value of the MT-PRIORITY= argument, between -9 and 9, or nil if unset.
+	// Defined in RFC 6710.
+	MTPriority *int
+
+	// Result of the SPF check of the sender, set by the server if
+	// Server.SPFChecker is set. Ignored by the client.
+	SPF SPFResult
+
+	// Values of the parameters handled by extensions registered with
+	// Server.RegisterExtension, or of unknown parameters if
+	// Server.EnableMAILExtensions is set, by upper-cased name. Parameters
+	// without a value have an empty one. The client sends them as is, after
+	// the other parameters.
+	Extensions map[string]string
 }
 
 type DSNNotify string
@@ -130,4 +155,10 @@ type RcptOptions struct {
 
 	// Value of MT-PRIORITY= or nil if unset.
 	MTPriority *int
+
+	// Values of the parameters handled by extensions registered with
+	// Server.RegisterExtension, by upper-cased name. Parameters without a
+	// value have an empty one. The client sends them as is, after the other
+	// parameters.
+	Extensions map[string]string
 }
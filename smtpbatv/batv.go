@@ -0,0 +1,195 @@
+// Package smtpbatv implements Bounce Address Tag Validation (BATV), as
+// defined in draft-levine-smtp-batv-01, with the prvs signing scheme.
+//
+// The sender addresses of outgoing messages are signed with a secret key
+// and an expiration date, e.g. "prvs=0123abcdef=alice@example.org". Bounces
+// are sent back to the signed address: a Signer implements
+// smtp.BATVVerifier to reject bounces to addresses without a valid
+// signature, which are backscatter:
+//
+//	signer := &smtpbatv.Signer{
+//		Keys:    [][]byte{key},
+//		Domains: []string{"example.org"},
+//	}
+//	q.SignSender = signer.Sign
+//	s.BATVVerifier = signer
+package smtpbatv
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	prefix        = "prvs="
+	defaultMaxAge = 7 * 24 * time.Hour
+	// Day numbers are encoded modulo 1000
+	maxDays = 999
+)
+
+var (
+	// ErrUnsigned is returned by Verify for addresses without a signature.
+	ErrUnsigned = errors.New("smtpbatv: address isn't signed")
+	// ErrExpired is returned by Verify for expired signatures.
+	ErrExpired = errors.New("smtpbatv: signature expired")
+	// ErrInvalidSignature is returned by Verify for malformed signatures, and
+	// signatures not matching the address.
+	ErrInvalidSignature = errors.New("smtpbatv: invalid signature")
+)
+
+// Signer signs and verifies addresses.
+type Signer struct {
+	// Secret keys, numbered by their index, up to 10. The key number is part
+	// of the signature, so that keys can be rotated: all keys are used to
+	// verify signatures. Required.
+	Keys [][]byte
+	// Number of the key used to sign addresses.
+	KeyID int
+	// Domains whose addresses are signed and verified, e.g. the local
+	// domains. If empty, all addresses are.
+	Domains []string
+	// Validity of signatures, rounded up to days, up to 999 days. If zero, 7
+	// days is used.
+	MaxAge time.Duration
+	// Source of the current time. If nil, smtp.SystemClock is used.
+	Clock smtp.Clock
+}
+
+var _ smtp.BATVVerifier = (*Signer)(nil)
+
+func (s *Signer) now() time.Time {
+	if s.Clock == nil {
+		return smtp.SystemClock.Now()
+	}
+	return s.Clock.Now()
+}
+
+// maxDays returns the validity of signatures, in days.
+func (s *Signer) maxDays() int {
+	maxAge := s.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultMaxAge
+	}
+	days := int((maxAge + 24*time.Hour - 1) / (24 * time.Hour))
+	if days > maxDays {
+		days = maxDays
+	}
+	return days
+}
+
+// day returns the number of the current day since the Unix epoch.
+func (s *Signer) day() int {
+	return int(s.now().Unix() / (24 * 60 * 60))
+}
+
+// covers reports whether the addresses of the domain of addr are signed.
+func (s *Signer) covers(addr string) bool {
+	if len(s.Domains) == 0 {
+		return true
+	}
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return false
+	}
+	domain := strings.TrimSuffix(addr[i+1:], ".")
+	for _, d := range s.Domains {
+		if strings.EqualFold(domain, strings.TrimSuffix(d, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// tag returns the hexadecimal signature of addr, for the key number k and
+// the expiration day ddd.
+func tag(key []byte, k int, ddd string, addr string) string {
+	mac := hmac.New(sha1.New, key)
+	fmt.Fprintf(mac, "%d%v%v", k, ddd, addr)
+	return hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+// Sign returns the signed form of an address. The null reverse-path, and
+// addresses outside of Domains, are returned unchanged. Signed addresses are
+// signed again.
+func (s *Signer) Sign(addr string) (string, error) {
+	if addr == "" || !s.covers(addr) {
+		return addr, nil
+	}
+	if s.KeyID < 0 || s.KeyID >= len(s.Keys) || s.KeyID > 9 {
+		return "", fmt.Errorf("smtpbatv: no key %v", s.KeyID)
+	}
+	if orig, _, _, _, ok := parse(addr); ok {
+		addr = orig
+	}
+
+	ddd := fmt.Sprintf("%03d", (s.day()+s.maxDays())%1000)
+	sig := tag(s.Keys[s.KeyID], s.KeyID, ddd, addr)
+	return fmt.Sprintf("%v%d%v%v=%v", prefix, s.KeyID, ddd, sig, addr), nil
+}
+
+// parse splits a signed address into the original address, the key number,
+// the expiration day and the signature.
+func parse(addr string) (orig string, k int, ddd, sig string, ok bool) {
+	if len(addr) < len(prefix) || !strings.EqualFold(addr[:len(prefix)], prefix) {
+		return "", 0, "", "", false
+	}
+	tagVal, orig, ok := strings.Cut(addr[len(prefix):], "=")
+	if !ok || len(tagVal) != 10 || !strings.Contains(orig, "@") {
+		return "", 0, "", "", false
+	}
+	for _, ch := range tagVal[:4] {
+		if ch < '0' || ch > '9' {
+			return "", 0, "", "", false
+		}
+	}
+	return orig, int(tagVal[0] - '0'), tagVal[1:4], tagVal[4:], true
+}
+
+// Verify checks the signature of an address, and returns the original
+// address.
+func (s *Signer) Verify(addr string) (string, error) {
+	if len(addr) < len(prefix) || !strings.EqualFold(addr[:len(prefix)], prefix) {
+		return "", ErrUnsigned
+	}
+	orig, k, ddd, sig, ok := parse(addr)
+	if !ok || k >= len(s.Keys) {
+		return "", ErrInvalidSignature
+	}
+	want := tag(s.Keys[k], k, ddd, orig)
+	if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(want)) {
+		return "", ErrInvalidSignature
+	}
+
+	expires, _ := strconv.Atoi(ddd)
+	// Number of days left, modulo 1000
+	left := ((expires-s.day())%1000 + 1000) % 1000
+	if left > s.maxDays() {
+		return "", ErrExpired
+	}
+	return orig, nil
+}
+
+// VerifyRecipient implements smtp.BATVVerifier. Recipients of bounces
+// within Domains must have a valid signature. Other signed recipients are
+// returned without their signature, even if it isn't valid, e.g. for replies
+// to a signed address.
+func (s *Signer) VerifyRecipient(addr string, bounce bool) (string, error) {
+	if !s.covers(addr) {
+		return addr, nil
+	}
+	if bounce {
+		return s.Verify(addr)
+	}
+	if orig, _, _, _, ok := parse(addr); ok {
+		return orig, nil
+	}
+	return addr, nil
+}
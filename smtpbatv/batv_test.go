@@ -0,0 +1,109 @@
+package smtpbatv
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+func testSigner() (*Signer, *smtptest.FakeClock) {
+	clock := smtptest.NewFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	return &Signer{
+		Keys:    [][]byte{[]byte("old secret"), []byte("secret")},
+		KeyID:   1,
+		Domains: []string{"example.org"},
+		Clock:   clock,
+	}, clock
+}
+
+func TestSigner(t *testing.T) {
+	s, clock := testSigner()
+
+	signed, err := s.Sign("alice@example.org")
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+	if !strings.HasPrefix(signed, "prvs=1") || !strings.HasSuffix(signed, "=alice@example.org") || len(signed) != len("prvs=1DDDSSSSSS=alice@example.org") {
+		t.Fatalf("Sign() = %q, want prvs=1DDDSSSSSS=alice@example.org", signed)
+	}
+	if resigned, err := s.Sign(signed); err != nil || resigned != signed {
+		t.Errorf("Sign(%q) = %q, %v, want unchanged", signed, resigned, err)
+	}
+	for _, addr := range []string{"", "bob@example.com"} {
+		if got, err := s.Sign(addr); err != nil || got != addr {
+			t.Errorf("Sign(%q) = %q, %v, want unchanged", addr, got, err)
+		}
+	}
+
+	if orig, err := s.Verify(signed); err != nil || orig != "alice@example.org" {
+		t.Errorf("Verify() = %q, %v, want alice@example.org", orig, err)
+	}
+	if orig, err := s.Verify(strings.ToUpper(signed[:16]) + signed[16:]); err != nil || orig != "alice@example.org" {
+		t.Errorf("Verify() of upper-case tag = %q, %v, want alice@example.org", orig, err)
+	}
+
+	for _, tc := range []struct {
+		addr string
+		want error
+	}{
+		{"alice@example.org", ErrUnsigned},
+		{strings.Replace(signed, "alice", "bob", 1), ErrInvalidSignature},
+		{signed[:len("prvs=1234")] + "=alice@example.org", ErrInvalidSignature},
+		{"prvs=9" + signed[len("prvs=1"):], ErrInvalidSignature},
+	} {
+		if _, err := s.Verify(tc.addr); err != tc.want {
+			t.Errorf("Verify(%q) = %v, want %v", tc.addr, err, tc.want)
+		}
+	}
+
+	// Signatures made with a previous key remain valid
+	s.KeyID = 0
+	old, err := s.Sign("alice@example.org")
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+	s.KeyID = 1
+	if _, err := s.Verify(old); err != nil {
+		t.Errorf("Verify() of a previous key = %v", err)
+	}
+
+	clock.Advance(7 * 24 * time.Hour)
+	if _, err := s.Verify(signed); err != nil {
+		t.Errorf("Verify() on the last day = %v", err)
+	}
+	clock.Advance(24 * time.Hour)
+	if _, err := s.Verify(signed); err != ErrExpired {
+		t.Errorf("Verify() after expiry = %v, want ErrExpired", err)
+	}
+}
+
+func TestSigner_VerifyRecipient(t *testing.T) {
+	s, _ := testSigner()
+	signed, err := s.Sign("alice@example.org")
+	if err != nil {
+		t.Fatalf("Sign() = %v", err)
+	}
+	forged := strings.Replace(signed, "alice", "bob", 1)
+
+	for _, tc := range []struct {
+		addr   string
+		bounce bool
+		want   string
+		err    error
+	}{
+		{signed, true, "alice@example.org", nil},
+		{signed, false, "alice@example.org", nil},
+		{"alice@example.org", true, "", ErrUnsigned},
+		{"alice@example.org", false, "alice@example.org", nil},
+		{forged, true, "", ErrInvalidSignature},
+		{forged, false, "bob@example.org", nil},
+		{"alice@example.com", true, "alice@example.com", nil},
+	} {
+		got, err := s.VerifyRecipient(tc.addr, tc.bounce)
+		if got != tc.want || err != tc.err {
+			t.Errorf("VerifyRecipient(%q, %v) = %q, %v, want %q, %v", tc.addr, tc.bounce, got, err, tc.want, tc.err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package smtpdkim
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// bodyHasher hashes a canonicalized message body as it is written, as defined
+// in RFC 6376 section 3.4.
+type bodyHasher struct {
+	h       hash.Hash
+	relaxed bool
+	limit   int64 // length of the hashed body, -1 for the whole body
+
+	line       []byte // incomplete line
+	emptyLines int    // empty lines not hashed yet, ignored at the end
+	written    int64  // length of the canonicalized body
+}
+
+func (b *bodyHasher) Write(p []byte) {
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			b.line = append(b.line, p...)
+			return
+		}
+		line := p[:i]
+		if len(b.line) > 0 {
+			b.line = append(b.line, line...)
+			line = b.line
+		}
+		b.writeLine(bytes.TrimSuffix(line, []byte("\r")))
+		b.line = b.line[:0]
+		p = p[i+1:]
+	}
+}
+
+func (b *bodyHasher) writeLine(line []byte) {
+	if b.relaxed {
+		line = relaxLine(line)
+	}
+	if len(line) == 0 {
+		b.emptyLines++
+		return
+	}
+	for ; b.emptyLines > 0; b.emptyLines-- {
+		b.hash([]byte("\r\n"))
+	}
+	b.hash(line)
+	b.hash([]byte("\r\n"))
+}
+
+// relaxLine reduces whitespace sequences to a single space, and removes
+// trailing whitespace.
+func relaxLine(line []byte) []byte {
+	out := make([]byte, 0, len(line))
+	wsp := false
+	for _, c := range line {
+		if c == ' ' || c == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			out = append(out, ' ')
+			wsp = false
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func (b *bodyHasher) hash(p []byte) {
+	if b.limit >= 0 && b.written+int64(len(p)) > b.limit {
+		if n := b.limit - b.written; n > 0 {
+			b.h.Write(p[:n])
+		}
+	} else {
+		b.h.Write(p)
+	}
+	b.written += int64(len(p))
+}
+
+// Sum returns the body hash once the whole body has been written.
+func (b *bodyHasher) Sum() ([]byte, error) {
+	if len(b.line) > 0 {
+		b.writeLine(b.line)
+		b.line = nil
+	}
+	if b.written == 0 && !b.relaxed {
+		b.hash([]byte("\r\n"))
+	}
+	if b.limit > b.written {
+		return nil, errors.New("body shorter than signed length")
+	}
+	return b.h.Sum(nil), nil
+}
@@ -0,0 +1,512 @@
+// Package smtpdkim verifies DKIM signatures of messages received by a go-smtp
+// server, as defined in RFC 6376 and RFC 8463.
+//
+// A Verifier implements smtp.DKIMVerifier:
+//
+//	s.DKIMVerifier = &smtpdkim.Verifier{}
+//
+// Only the header section of messages is buffered: bodies are hashed as they
+// are received. The rsa-sha256 and ed25519-sha256 algorithms are supported.
+//
+// Results are given to sessions implementing smtp.DKIMSession, and to
+// smtp.Server.DKIMPolicy, which may reject messages.
+package smtpdkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// Maximum size of the header section of a message. Signatures of
+	// messages with a larger header section are not verified.
+	maxHeaderBytes = 1024 * 1024
+	// Default maximum number of signatures verified per message.
+	defaultMaxSignatures = 5
+)
+
+// Verifier verifies DKIM signatures.
+type Verifier struct {
+	// Looks up the TXT records of public keys. If nil,
+	// net.DefaultResolver.LookupTXT is used.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	// Timeout for all key lookups of a message. If zero, 20 seconds is used.
+	Timeout time.Duration
+
+	// Maximum number of signatures verified per message. Further signatures
+	// are ignored. If zero, 5 is used.
+	MaxSignatures int
+
+	// Returns the current time, to check signature expiration. If nil,
+	// time.Now is used.
+	Now func() time.Time
+}
+
+var _ smtp.DKIMVerifier = (*Verifier)(nil)
+
+// NewDKIMVerification implements smtp.DKIMVerifier.
+func (v *Verifier) NewDKIMVerification(ctx context.Context) smtp.DKIMVerification {
+	return &verification{verifier: v, ctx: ctx}
+}
+
+type verification struct {
+	verifier *Verifier
+	ctx      context.Context
+
+	header []byte // header section, until inBody
+	inBody bool
+	fields []headerField
+	sigs   []*signature
+}
+
+func (v *verification) Write(p []byte) (int, error) {
+	if v.inBody {
+		v.writeBody(p)
+		return len(p), nil
+	}
+
+	prev := len(v.header)
+	v.header = append(v.header, p...)
+	end, bodyStart := headerEnd(v.header, prev)
+	if end < 0 {
+		if len(v.header) > maxHeaderBytes {
+			// Leave the message unverified
+			v.inBody = true
+			v.header = nil
+		}
+		return len(p), nil
+	}
+
+	body := v.header[bodyStart:]
+	v.fields = parseHeader(v.header[:end])
+	v.header = nil
+	v.inBody = true
+	v.parseSignatures()
+	v.writeBody(body)
+	return len(p), nil
+}
+
+// headerEnd returns the end of the header section in b, and the start of the
+// body. Lines before from are known not to end the header section.
+func headerEnd(b []byte, from int) (end, bodyStart int) {
+	if bytes.HasPrefix(b, []byte("\r\n")) {
+		return 0, 2
+	} else if bytes.HasPrefix(b, []byte("\n")) {
+		return 0, 1
+	}
+	if from -= 3; from < 0 {
+		from = 0
+	}
+	for i := from; i < len(b); i++ {
+		if b[i] != '\n' {
+			continue
+		}
+		if bytes.HasPrefix(b[i+1:], []byte("\r\n")) {
+			return i + 1, i + 3
+		} else if bytes.HasPrefix(b[i+1:], []byte("\n")) {
+			return i + 1, i + 2
+		}
+	}
+	return -1, -1
+}
+
+func (v *verification) writeBody(p []byte) {
+	for _, sig := range v.sigs {
+		if sig.body != nil {
+			sig.body.Write(p)
+		}
+	}
+}
+
+func (v *verification) parseSignatures() {
+	max := v.verifier.MaxSignatures
+	if max == 0 {
+		max = defaultMaxSignatures
+	}
+	for _, f := range v.fields {
+		if f.name != "dkim-signature" {
+			continue
+		}
+		if len(v.sigs) >= max {
+			break
+		}
+		v.sigs = append(v.sigs, parseSignature(f.raw, v.now()))
+	}
+}
+
+func (v *verification) now() time.Time {
+	if v.verifier.Now != nil {
+		return v.verifier.Now()
+	}
+	return time.Now()
+}
+
+// Results implements smtp.DKIMVerification.
+func (v *verification) Results() []smtp.DKIMResult {
+	if !v.inBody {
+		// The message has no body
+		v.Write([]byte("\r\n\r\n"))
+	}
+
+	timeout := v.verifier.Timeout
+	if timeout == 0 {
+		timeout = 20 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(v.ctx, timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, sig := range v.sigs {
+		if sig.result.Status != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(sig *signature) {
+			defer wg.Done()
+			v.verify(ctx, sig)
+		}(sig)
+	}
+	wg.Wait()
+
+	results := make([]smtp.DKIMResult, len(v.sigs))
+	for i, sig := range v.sigs {
+		results[i] = sig.result
+	}
+	return results
+}
+
+func (v *verification) verify(ctx context.Context, sig *signature) {
+	bodyHash, err := sig.body.Sum()
+	if err != nil {
+		sig.fail(smtp.DKIMFail, err)
+		return
+	}
+	if !bytes.Equal(bodyHash, sig.bodyHash) {
+		sig.fail(smtp.DKIMFail, errors.New("body hash mismatch"))
+		return
+	}
+
+	key, err := v.lookupKey(ctx, sig)
+	if err != nil {
+		status := smtp.DKIMPermError
+		if isTemporary(err) {
+			status = smtp.DKIMTempError
+		}
+		sig.fail(status, err)
+		return
+	}
+
+	h := sha256.New()
+	sig.hashHeader(h, v.fields)
+	if err := key.verify(h.Sum(nil), sig.sig); err != nil {
+		sig.fail(smtp.DKIMFail, err)
+		return
+	}
+	sig.result.Status = smtp.DKIMPass
+}
+
+func (v *verification) lookupKey(ctx context.Context, sig *signature) (*publicKey, error) {
+	lookupTXT := v.verifier.LookupTXT
+	if lookupTXT == nil {
+		lookupTXT = net.DefaultResolver.LookupTXT
+	}
+	name := sig.result.Selector + "._domainkey." + sig.result.Domain
+	txts, err := lookupTXT(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up key %v: %w", name, err)
+	} else if len(txts) == 0 {
+		return nil, fmt.Errorf("no key for signature at %v", name)
+	}
+
+	key, err := parsePublicKey(txts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key at %v: %v", name, err)
+	}
+	if key.keyType != sig.keyType {
+		return nil, fmt.Errorf("key type %v doesn't match signature algorithm", key.keyType)
+	}
+	if key.hashes != nil && !key.hashes["sha256"] {
+		return nil, errors.New("key doesn't allow sha256")
+	}
+	if key.strict && !strings.EqualFold(identifierDomain(sig.result.Identifier), sig.result.Domain) {
+		return nil, errors.New("identifier domain must match signing domain")
+	}
+	return key, nil
+}
+
+// isTemporary reports whether a key lookup error is temporary.
+func isTemporary(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+type headerField struct {
+	name string // lower-case
+	raw  string // including the trailing CRLF
+}
+
+// parseHeader splits a header section into fields. Bare LF line endings are
+// converted to CRLF.
+func parseHeader(b []byte) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, "\r\n") {
+			line = strings.TrimSuffix(line, "\n") + "\r\n"
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name := line
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			name = line[:i]
+		}
+		fields = append(fields, headerField{
+			name: strings.ToLower(strings.TrimRight(name, " \t")),
+			raw:  line,
+		})
+	}
+	return fields
+}
+
+// parseTags parses a tag-list, as defined in RFC 6376 section 3.2.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.IndexByte(spec, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		name := strings.TrimSpace(spec[:i])
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(spec[i+1:])
+	}
+	return tags, nil
+}
+
+// stripWhitespace removes folding and whitespace from a tag value.
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+type signature struct {
+	result smtp.DKIMResult
+
+	raw          string // DKIM-Signature header field
+	keyType      string
+	sig          []byte
+	bodyHash     []byte
+	relaxedHead  bool
+	signedFields []string
+	body         *bodyHasher
+}
+
+func (sig *signature) fail(status smtp.DKIMStatus, err error) {
+	sig.result.Status = status
+	sig.result.Err = err
+}
+
+func parseSignature(raw string, now time.Time) *signature {
+	sig := &signature{raw: raw}
+	value := raw[strings.IndexByte(raw, ':')+1:]
+	tags, err := parseTags(value)
+	if err != nil {
+		sig.fail(smtp.DKIMPermError, err)
+		return sig
+	}
+	sig.result.Domain = tags["d"]
+	sig.result.Selector = tags["s"]
+	sig.result.Identifier = tags["i"]
+	if sig.result.Identifier == "" {
+		sig.result.Identifier = "@" + sig.result.Domain
+	}
+
+	if err := sig.parseTags(tags, now); err != nil {
+		sig.fail(smtp.DKIMPermError, err)
+		sig.body = nil
+	}
+	return sig
+}
+
+func (sig *signature) parseTags(tags map[string]string, now time.Time) error {
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[name] == "" {
+			return fmt.Errorf("missing %v= tag", name)
+		}
+	}
+	if tags["v"] != "1" {
+		return fmt.Errorf("unsupported version %q", tags["v"])
+	}
+
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		sig.keyType = "rsa"
+	case "ed25519-sha256":
+		sig.keyType = "ed25519"
+	default:
+		return fmt.Errorf("unsupported algorithm %q", tags["a"])
+	}
+
+	var err error
+	if sig.sig, err = base64.StdEncoding.DecodeString(stripWhitespace(tags["b"])); err != nil {
+		return errors.New("malformed b= tag")
+	}
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"])); err != nil {
+		return errors.New("malformed bh= tag")
+	}
+
+	domain := strings.ToLower(sig.result.Domain)
+	id := strings.ToLower(identifierDomain(sig.result.Identifier))
+	if id != domain && !strings.HasSuffix(id, "."+domain) {
+		return errors.New("identifier domain isn't a subdomain of the signing domain")
+	}
+
+	for _, name := range strings.Split(tags["h"], ":") {
+		sig.signedFields = append(sig.signedFields, strings.ToLower(stripWhitespace(name)))
+	}
+	signsFrom := false
+	for _, name := range sig.signedFields {
+		if name == "from" {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		return errors.New("From header field isn't signed")
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		headerCanon = c
+		if i := strings.IndexByte(c, '/'); i >= 0 {
+			headerCanon, bodyCanon = c[:i], c[i+1:]
+		}
+	}
+	for _, c := range []string{headerCanon, bodyCanon} {
+		if c != "simple" && c != "relaxed" {
+			return fmt.Errorf("unsupported canonicalization %q", c)
+		}
+	}
+	sig.relaxedHead = headerCanon == "relaxed"
+
+	if q, ok := tags["q"]; ok && q != "dns/txt" {
+		return fmt.Errorf("unsupported query method %q", q)
+	}
+
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return errors.New("malformed x= tag")
+		}
+		if t, err := strconv.ParseInt(tags["t"], 10, 64); err == nil && expires < t {
+			return errors.New("signature expires before it was made")
+		}
+		if now.Unix() > expires {
+			return errors.New("signature expired")
+		}
+	}
+
+	limit := int64(-1)
+	if l, ok := tags["l"]; ok {
+		if limit, err = strconv.ParseInt(l, 10, 64); err != nil || limit < 0 {
+			return errors.New("malformed l= tag")
+		}
+	}
+	sig.body = &bodyHasher{
+		h:       sha256.New(),
+		relaxed: bodyCanon == "relaxed",
+		limit:   limit,
+	}
+	return nil
+}
+
+func identifierDomain(id string) string {
+	return id[strings.LastIndexByte(id, '@')+1:]
+}
+
+// hashHeader writes the canonicalized signed header fields to h, followed by
+// the DKIM-Signature header field without its signature.
+func (sig *signature) hashHeader(h hash.Hash, fields []headerField) {
+	used := make(map[int]bool)
+	for _, name := range sig.signedFields {
+		// Fields are signed bottom-up
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || fields[i].name != name {
+				continue
+			}
+			used[i] = true
+			h.Write([]byte(sig.canonicalHeader(fields[i].raw)))
+			break
+		}
+	}
+
+	field := sig.canonicalHeader(removeSignature(sig.raw))
+	h.Write([]byte(strings.TrimSuffix(field, "\r\n")))
+}
+
+func (sig *signature) canonicalHeader(raw string) string {
+	if !sig.relaxedHead {
+		return raw
+	}
+	i := strings.IndexByte(raw, ':')
+	if i < 0 {
+		return raw
+	}
+	name := strings.ToLower(strings.TrimRight(raw[:i], " \t"))
+	value := strings.NewReplacer("\r\n", "", "\n", "").Replace(raw[i+1:])
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// removeSignature empties the value of the b= tag of a DKIM-Signature header
+// field.
+func removeSignature(raw string) string {
+	i := strings.IndexByte(raw, ':') + 1
+	specs := strings.SplitAfter(raw[i:], ";")
+	for j, spec := range specs {
+		eq := strings.IndexByte(spec, '=')
+		if eq < 0 || strings.TrimSpace(spec[:eq]) != "b" {
+			continue
+		}
+		end := ""
+		if strings.HasSuffix(spec, ";") {
+			end = ";"
+		} else if strings.HasSuffix(spec, "\r\n") {
+			end = "\r\n"
+		}
+		specs[j] = spec[:eq+1] + end
+	}
+	return raw[:i] + strings.Join(specs, "")
+}
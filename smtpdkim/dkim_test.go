@@ -0,0 +1,240 @@
+package smtpdkim_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtpdkim"
+)
+
+const testMessage = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+var (
+	edKey  = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rsaKey *rsa.PrivateKey
+)
+
+func init() {
+	var err error
+	if rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+}
+
+// sign signs a message without folded header fields nor trailing whitespace,
+// and returns the signed message.
+func sign(t *testing.T, msg, algo, canon, selector string) string {
+	i := strings.Index(msg, "\r\n\r\n")
+	header, body := msg[:i+2], msg[i+4:]
+
+	if canon == "relaxed" {
+		body = regexp.MustCompile(`[ \t]+`).ReplaceAllString(body, " ")
+	}
+	body = strings.TrimRight(body, "\r\n") + "\r\n"
+	bh := sha256.Sum256([]byte(body))
+
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=%v; c=%v/%v; d=football.example.com; s=%v;\r\n"+
+		" h=From:To:Subject; bh=%v; b=",
+		algo, canon, canon, selector, base64.StdEncoding.EncodeToString(bh[:]))
+
+	canonHeader := func(field string) string {
+		if canon == "simple" {
+			return field
+		}
+		field = strings.Replace(field, "\r\n ", " ", -1)
+		i := strings.IndexByte(field, ':')
+		return strings.ToLower(field[:i]) + ":" + strings.TrimSpace(field[i+1:]) + "\r\n"
+	}
+	h := sha256.New()
+	for _, field := range strings.SplitAfter(header, "\r\n") {
+		if field != "" {
+			h.Write([]byte(canonHeader(field)))
+		}
+	}
+	h.Write([]byte(strings.TrimSuffix(canonHeader(sig+"\r\n"), "\r\n")))
+	digest := h.Sum(nil)
+
+	var b []byte
+	switch algo {
+	case "rsa-sha256":
+		var err error
+		if b, err = rsa.SignPKCS1v15(nil, rsaKey, crypto.SHA256, digest); err != nil {
+			t.Fatal(err)
+		}
+	case "ed25519-sha256":
+		b = ed25519.Sign(edKey, digest)
+	}
+	return sig + base64.StdEncoding.EncodeToString(b) + "\r\n" + msg
+}
+
+func lookupTXT(ctx context.Context, name string) ([]string, error) {
+	switch name {
+	case "ed._domainkey.football.example.com":
+		pub := edKey.Public().(ed25519.PublicKey)
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+	case "rsa._domainkey.football.example.com":
+		pub, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+		if err != nil {
+			return nil, err
+		}
+		return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+	case "revoked._domainkey.football.example.com":
+		return []string{"v=DKIM1; p="}, nil
+	case "broken._domainkey.football.example.com":
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func verify(msg string, chunkSize int) []smtp.DKIMResult {
+	v := &smtpdkim.Verifier{LookupTXT: lookupTXT}
+	verification := v.NewDKIMVerification(context.Background())
+	for len(msg) > 0 {
+		n := chunkSize
+		if n > len(msg) {
+			n = len(msg)
+		}
+		verification.Write([]byte(msg[:n]))
+		msg = msg[n:]
+	}
+	return verification.Results()
+}
+
+func TestVerifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		status smtp.DKIMStatus
+	}{
+		{
+			name:   "ed25519-relaxed",
+			msg:    sign(t, testMessage, "ed25519-sha256", "relaxed", "ed"),
+			status: smtp.DKIMPass,
+		},
+		{
+			name:   "rsa-simple",
+			msg:    sign(t, testMessage, "rsa-sha256", "simple", "rsa"),
+			status: smtp.DKIMPass,
+		},
+		{
+			name:   "relaxed-whitespace",
+			msg:    strings.Replace(sign(t, testMessage, "rsa-sha256", "relaxed", "rsa"), "game.  Are", "game. \t Are", 1) + "\r\n\r\n",
+			status: smtp.DKIMPass,
+		},
+		{
+			name:   "simple-whitespace",
+			msg:    strings.Replace(sign(t, testMessage, "rsa-sha256", "simple", "rsa"), "game.  Are", "game. \t Are", 1),
+			status: smtp.DKIMFail,
+		},
+		{
+			name:   "modified-header",
+			msg:    strings.Replace(sign(t, testMessage, "ed25519-sha256", "relaxed", "ed"), "dinner", "lunch", 1),
+			status: smtp.DKIMFail,
+		},
+		{
+			name:   "wrong-key-type",
+			msg:    sign(t, testMessage, "rsa-sha256", "relaxed", "ed"),
+			status: smtp.DKIMPermError,
+		},
+		{
+			name:   "revoked-key",
+			msg:    sign(t, testMessage, "ed25519-sha256", "relaxed", "revoked"),
+			status: smtp.DKIMPermError,
+		},
+		{
+			name:   "missing-key",
+			msg:    sign(t, testMessage, "ed25519-sha256", "relaxed", "missing"),
+			status: smtp.DKIMPermError,
+		},
+		{
+			name:   "broken-dns",
+			msg:    sign(t, testMessage, "ed25519-sha256", "relaxed", "broken"),
+			status: smtp.DKIMTempError,
+		},
+		{
+			name:   "unsupported-algorithm",
+			msg:    strings.Replace(sign(t, testMessage, "rsa-sha256", "relaxed", "rsa"), "a=rsa-sha256", "a=rsa-sha1", 1),
+			status: smtp.DKIMPermError,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, chunkSize := range []int{1, 7, len(tc.msg)} {
+				results := verify(tc.msg, chunkSize)
+				if len(results) != 1 {
+					t.Fatalf("got %v results, want 1", len(results))
+				}
+				res := results[0]
+				if res.Status != tc.status {
+					t.Errorf("chunk size %v: status = %v (%v), want %v", chunkSize, res.Status, res.Err, tc.status)
+				}
+				if (res.Err == nil) != (tc.status == smtp.DKIMPass) {
+					t.Errorf("chunk size %v: unexpected error %v", chunkSize, res.Err)
+				}
+				if res.Domain != "football.example.com" || res.Identifier != "@football.example.com" {
+					t.Errorf("chunk size %v: invalid result %+v", chunkSize, res)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifier_multipleSignatures(t *testing.T) {
+	msg := sign(t, sign(t, testMessage, "rsa-sha256", "relaxed", "rsa"), "ed25519-sha256", "simple", "missing")
+	results := verify(msg, 4096)
+	if len(results) != 2 {
+		t.Fatalf("got %v results, want 2", len(results))
+	}
+	if results[0].Status != smtp.DKIMPermError || results[0].Selector != "missing" {
+		t.Errorf("invalid first result: %+v", results[0])
+	}
+	if results[1].Status != smtp.DKIMPass || results[1].Selector != "rsa" {
+		t.Errorf("invalid second result: %+v", results[1])
+	}
+}
+
+func TestVerifier_unsigned(t *testing.T) {
+	if results := verify(testMessage, 4096); len(results) != 0 {
+		t.Errorf("got results for an unsigned message: %+v", results)
+	}
+	if results := verify("From: joe@football.example.com\r\n", 4096); len(results) != 0 {
+		t.Errorf("got results for an unsigned message: %+v", results)
+	}
+}
+
+func TestVerifier_timeout(t *testing.T) {
+	v := &smtpdkim.Verifier{
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+		Timeout: 1,
+	}
+	verification := v.NewDKIMVerification(context.Background())
+	verification.Write([]byte(sign(t, testMessage, "ed25519-sha256", "relaxed", "ed")))
+	results := verification.Results()
+	if len(results) != 1 || results[0].Status != smtp.DKIMTempError || !errors.Is(results[0].Err, context.DeadlineExceeded) {
+		t.Errorf("invalid results: %+v", results)
+	}
+}
@@ -0,0 +1,105 @@
+package smtpdkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Minimum size of RSA keys, see RFC 8301 section 3.2.
+const minRSAKeyBits = 1024
+
+// publicKey is a public key record, as defined in RFC 6376 section 3.6.1.
+type publicKey struct {
+	keyType string
+	hashes  map[string]bool // nil if all are allowed
+	strict  bool            // t=s flag
+	rsa     *rsa.PublicKey
+	ed25519 ed25519.PublicKey
+}
+
+func parsePublicKey(s string) (*publicKey, error) {
+	tags, err := parseTags(s)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("unsupported version %q", v)
+	}
+
+	key := &publicKey{keyType: "rsa"}
+	if k, ok := tags["k"]; ok {
+		key.keyType = strings.ToLower(k)
+	}
+	if h, ok := tags["h"]; ok {
+		key.hashes = make(map[string]bool)
+		for _, name := range strings.Split(h, ":") {
+			key.hashes[strings.ToLower(stripWhitespace(name))] = true
+		}
+	}
+	for _, flag := range strings.Split(tags["t"], ":") {
+		if stripWhitespace(flag) == "s" {
+			key.strict = true
+		}
+	}
+
+	p, ok := tags["p"]
+	if !ok {
+		return nil, errors.New("missing p= tag")
+	}
+	p = stripWhitespace(p)
+	if p == "" {
+		return nil, errors.New("key revoked")
+	}
+	b, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("malformed p= tag")
+	}
+
+	switch key.keyType {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(b)
+		if err != nil {
+			// Some records contain a bare RSAPublicKey
+			if pub, err = x509.ParsePKCS1PublicKey(b); err != nil {
+				return nil, errors.New("malformed RSA key")
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("not an RSA key")
+		}
+		if rsaPub.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key too small (%v bits)", rsaPub.N.BitLen())
+		}
+		key.rsa = rsaPub
+	case "ed25519":
+		if len(b) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed Ed25519 key")
+		}
+		key.ed25519 = ed25519.PublicKey(b)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", key.keyType)
+	}
+	return key, nil
+}
+
+// verify verifies a signature of a SHA-256 digest.
+func (key *publicKey) verify(digest, sig []byte) error {
+	switch key.keyType {
+	case "rsa":
+		if err := rsa.VerifyPKCS1v15(key.rsa, crypto.SHA256, digest, sig); err != nil {
+			return errors.New("signature verification failed")
+		}
+	case "ed25519":
+		if !ed25519.Verify(key.ed25519, digest, sig) {
+			return errors.New("signature verification failed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,427 @@
+// Package smtpdmarc evaluates DMARC policies of messages received by a
+// go-smtp server, as defined in RFC 7489.
+//
+// An Evaluator implements smtp.DMARCEvaluator. It combines the SPF and DKIM
+// results, so the server should check both:
+//
+//	s.SPFChecker = &smtpspf.Checker{}
+//	s.DKIMVerifier = &smtpdkim.Verifier{}
+//	s.DMARCEvaluator = &smtpdmarc.Evaluator{}
+//
+// Messages failing DMARC with the reject policy are rejected by the server.
+// The quarantine policy is left to sessions, which find the result with
+// smtp.Conn.DMARC, e.g. to add it to an Authentication-Results header field
+// or to deliver the message to a spam folder.
+//
+// Evaluations can be collected with Evaluator.Report, e.g. by a Reporter
+// sending aggregate reports to domain owners.
+package smtpdmarc
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Maximum number of cached policy lookups.
+const maxCacheEntries = 4096
+
+// Policy is a DMARC policy record, as defined in RFC 7489 section 6.3.
+type Policy struct {
+	// Domain the record was found for: the RFC5322.From domain or its
+	// organizational domain.
+	Domain string
+	// Policy for the domain, and for its subdomains.
+	Policy          smtp.DMARCDisposition
+	SubdomainPolicy smtp.DMARCDisposition
+	// Whether DKIM and SPF identifiers must match the RFC5322.From domain
+	// exactly, instead of sharing its organizational domain.
+	StrictDKIM bool
+	StrictSPF  bool
+	// Percentage of failing messages the policy is applied to.
+	Percent int
+	// Addresses to send aggregate and failure reports to.
+	AggregateReportURIs []string
+	FailureReportURIs   []string
+}
+
+// ParsePolicy parses a DMARC policy record. If it has no valid p= tag but
+// aggregate report addresses, the none policy is used, as required by
+// RFC 7489 section 6.6.3.
+func ParsePolicy(txt string) (*Policy, error) {
+	tags := strings.Split(txt, ";")
+	if strings.TrimSpace(tags[0]) != "v=DMARC1" {
+		return nil, errors.New("smtpdmarc: not a DMARC record")
+	}
+
+	p := &Policy{Percent: 100}
+	var validPolicy bool
+	for _, tag := range tags[1:] {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			if strings.TrimSpace(tag) == "" {
+				continue
+			}
+			return nil, fmt.Errorf("smtpdmarc: malformed tag %q", tag)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		switch k {
+		case "p":
+			p.Policy, validPolicy = parseDisposition(v)
+		case "sp":
+			p.SubdomainPolicy, _ = parseDisposition(v)
+		case "adkim":
+			p.StrictDKIM = v == "s"
+		case "aspf":
+			p.StrictSPF = v == "s"
+		case "pct":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > 100 {
+				return nil, fmt.Errorf("smtpdmarc: invalid pct %q", v)
+			}
+			p.Percent = n
+		case "rua":
+			p.AggregateReportURIs = parseURIs(v)
+		case "ruf":
+			p.FailureReportURIs = parseURIs(v)
+		}
+	}
+	if !validPolicy {
+		if len(p.AggregateReportURIs) == 0 {
+			return nil, errors.New("smtpdmarc: missing or invalid policy")
+		}
+		p.Policy = smtp.DMARCDispositionNone
+	}
+	if p.SubdomainPolicy == "" {
+		p.SubdomainPolicy = p.Policy
+	}
+	return p, nil
+}
+
+func parseDisposition(s string) (smtp.DMARCDisposition, bool) {
+	switch d := smtp.DMARCDisposition(strings.ToLower(s)); d {
+	case smtp.DMARCDispositionNone, smtp.DMARCDispositionQuarantine, smtp.DMARCDispositionReject:
+		return d, true
+	}
+	return "", false
+}
+
+func parseURIs(s string) []string {
+	var uris []string
+	for _, uri := range strings.Split(s, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// Record holds the data of an evaluation needed by aggregate reports, as
+// defined in RFC 7489 appendix C.
+type Record struct {
+	Time time.Time
+	// IP address of the client.
+	SourceIP   net.IP
+	HeaderFrom string
+	// Domain checked with SPF, and the SPF result.
+	EnvelopeFrom string
+	SPF          smtp.SPFResult
+	// DKIM results, one per signature.
+	DKIM []smtp.DKIMResult
+	// Whether the passing SPF and DKIM identifiers are aligned with
+	// HeaderFrom.
+	SPFAligned  bool
+	DKIMAligned bool
+	// Published policy, nil if none was found.
+	Policy *Policy
+	Result *smtp.DMARCResult
+}
+
+// Evaluator evaluates DMARC policies.
+type Evaluator struct {
+	// Looks up the TXT records of policies. If nil,
+	// net.DefaultResolver.LookupTXT is used.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	// Timeout for the policy lookups of a message. If zero, 20 seconds is
+	// used.
+	Timeout time.Duration
+
+	// Duration policy lookups are cached for, including lookups finding no
+	// policy. Temporary lookup failures aren't cached. If zero, 1 hour is
+	// used. If negative, lookups aren't cached.
+	CacheTTL time.Duration
+
+	// Returns the organizational domain of a domain, as defined in RFC 7489
+	// section 3.2, e.g. with golang.org/x/net/publicsuffix.EffectiveTLDPlusOne.
+	// If nil, the last two labels of the domain are used, which is wrong for
+	// public suffixes with several labels, such as "co.uk".
+	OrganizationalDomain func(domain string) string
+
+	// Mode is smtp.PolicyMonitor to only log the rejections of messages.
+	Mode smtp.PolicyMode
+
+	// Called with each evaluation of a message having an RFC5322.From
+	// domain, to collect aggregate report data. It's called synchronously
+	// and must not block.
+	Report func(rec *Record)
+
+	// Source of the current time for the cache and records. If nil,
+	// smtp.SystemClock is used.
+	Clock smtp.Clock
+	// Source of randomness for the sampling of messages with the pct= tag.
+	// If nil, crypto/rand is used.
+	Rand io.Reader
+
+	cacheLocker sync.Mutex
+	cache       map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	txts    []string
+	expires time.Time
+}
+
+var (
+	_ smtp.DMARCEvaluator = (*Evaluator)(nil)
+	_ smtp.Policy         = (*Evaluator)(nil)
+)
+
+// PolicyMode implements smtp.Policy.
+func (e *Evaluator) PolicyMode() smtp.PolicyMode {
+	return e.Mode
+}
+
+func (e *Evaluator) now() time.Time {
+	if e.Clock == nil {
+		return smtp.SystemClock.Now()
+	}
+	return e.Clock.Now()
+}
+
+// EvaluateDMARC implements smtp.DMARCEvaluator.
+func (e *Evaluator) EvaluateDMARC(ctx context.Context, msg *smtp.DMARCMessage) *smtp.DMARCResult {
+	domain := strings.ToLower(strings.TrimSuffix(msg.HeaderFrom, "."))
+	if domain == "" {
+		return &smtp.DMARCResult{
+			Status:      smtp.DMARCPermError,
+			Disposition: smtp.DMARCDispositionNone,
+			Err:         errors.New("no single RFC5322.From domain"),
+		}
+	}
+
+	timeout := e.Timeout
+	if timeout == 0 {
+		timeout = 20 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res := &smtp.DMARCResult{Domain: domain, Disposition: smtp.DMARCDispositionNone}
+	rec := &Record{
+		Time:         e.now(),
+		SourceIP:     msg.ClientIP,
+		HeaderFrom:   domain,
+		EnvelopeFrom: msg.MailFrom,
+		SPF:          msg.SPF,
+		DKIM:         msg.DKIM,
+		Result:       res,
+	}
+	defer func() {
+		if e.Report != nil {
+			e.Report(rec)
+		}
+	}()
+
+	policy, err := e.LookupPolicy(ctx, domain)
+	if err != nil {
+		res.Status, res.Err = smtp.DMARCTempError, err
+		return res
+	} else if policy == nil {
+		res.Status = smtp.DMARCNone
+		return res
+	}
+	rec.Policy = policy
+	res.Policy = policy.Policy
+	if policy.Domain != domain {
+		res.Policy = policy.SubdomainPolicy
+	}
+
+	for _, dkim := range msg.DKIM {
+		if dkim.Status == smtp.DKIMPass && e.aligned(dkim.Domain, domain, policy.StrictDKIM) {
+			rec.DKIMAligned = true
+		}
+	}
+	rec.SPFAligned = msg.SPF == smtp.SPFPass && e.aligned(msg.MailFrom, domain, policy.StrictSPF)
+	if rec.DKIMAligned || rec.SPFAligned {
+		res.Status = smtp.DMARCPass
+		return res
+	}
+
+	res.Status = smtp.DMARCFail
+	res.Disposition = res.Policy
+	if !e.sampled(policy.Percent) {
+		// RFC 7489 section 6.6.4: apply the next less strict policy
+		switch res.Disposition {
+		case smtp.DMARCDispositionReject:
+			res.Disposition = smtp.DMARCDispositionQuarantine
+		case smtp.DMARCDispositionQuarantine:
+			res.Disposition = smtp.DMARCDispositionNone
+		}
+	}
+	return res
+}
+
+// LookupPolicy discovers the DMARC policy of a RFC5322.From domain, as
+// defined in RFC 7489 section 6.6.3: the policy of the domain, or else the
+// one of its organizational domain. It returns nil if there is none, and an
+// error if the lookup failed temporarily.
+func (e *Evaluator) LookupPolicy(ctx context.Context, domain string) (*Policy, error) {
+	p, err := e.lookupPolicy(ctx, domain)
+	if p != nil || err != nil {
+		return p, err
+	}
+	if org := e.orgDomain(domain); org != domain {
+		return e.lookupPolicy(ctx, org)
+	}
+	return nil, nil
+}
+
+func (e *Evaluator) lookupPolicy(ctx context.Context, domain string) (*Policy, error) {
+	txts, err := e.lookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy *Policy
+	for _, txt := range txts {
+		p, err := ParsePolicy(txt)
+		if err != nil {
+			continue
+		}
+		if policy != nil {
+			// Several records: there is no policy
+			return nil, nil
+		}
+		policy = p
+	}
+	if policy != nil {
+		policy.Domain = domain
+	}
+	return policy, nil
+}
+
+// lookupTXT looks up TXT records through the cache. Names without records
+// aren't errors.
+func (e *Evaluator) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	now := e.now()
+	e.cacheLocker.Lock()
+	entry := e.cache[name]
+	e.cacheLocker.Unlock()
+	if entry != nil && now.Before(entry.expires) {
+		return entry.txts, nil
+	}
+
+	lookupTXT := e.LookupTXT
+	if lookupTXT == nil {
+		lookupTXT = net.DefaultResolver.LookupTXT
+	}
+	txts, err := lookupTXT(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		txts, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := e.CacheTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	if ttl > 0 {
+		e.cacheLocker.Lock()
+		e.cacheEntry(name, &cacheEntry{txts: txts, expires: now.Add(ttl)}, now)
+		e.cacheLocker.Unlock()
+	}
+	return txts, nil
+}
+
+// cacheEntry adds an entry to the cache. Expired entries are removed when the
+// cache is full, and if none is, the whole cache is cleared. It's called with
+// the cache mutex held.
+func (e *Evaluator) cacheEntry(name string, entry *cacheEntry, now time.Time) {
+	if len(e.cache) >= maxCacheEntries {
+		for k, v := range e.cache {
+			if !now.Before(v.expires) {
+				delete(e.cache, k)
+			}
+		}
+		if len(e.cache) >= maxCacheEntries {
+			e.cache = nil
+		}
+	}
+	if e.cache == nil {
+		e.cache = make(map[string]*cacheEntry)
+	}
+	e.cache[name] = entry
+}
+
+func (e *Evaluator) orgDomain(domain string) string {
+	if e.OrganizationalDomain != nil {
+		if org := e.OrganizationalDomain(domain); org != "" {
+			return strings.ToLower(org)
+		}
+		return domain
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// aligned reports whether the authenticated identifier id is aligned with
+// the RFC5322.From domain, as defined in RFC 7489 section 3.1.
+func (e *Evaluator) aligned(id, domain string, strict bool) bool {
+	id = strings.ToLower(strings.TrimSuffix(id, "."))
+	if id == "" {
+		return false
+	} else if id == domain {
+		return true
+	}
+	return !strict && e.orgDomain(id) == e.orgDomain(domain)
+}
+
+// sampled reports whether a failing message is part of the percentage of
+// messages the policy is applied to.
+func (e *Evaluator) sampled(percent int) bool {
+	if percent >= 100 {
+		return true
+	} else if percent <= 0 {
+		return false
+	}
+	r := e.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return true
+		}
+		// Reject values above 199 for a uniform distribution
+		if b[0] < 200 {
+			return int(b[0]%100) < percent
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package smtpdmarc_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtpdmarc"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+var records = map[string][]string{
+	"_dmarc.example.org":      {"v=DMARC1; p=reject; sp=quarantine; rua=mailto:dmarc@example.org"},
+	"_dmarc.strict.com":       {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+	"_dmarc.monitor.net":      {"v=DMARC1; p=none"},
+	"_dmarc.sampled.net":      {"v=DMARC1; p=reject; pct=50"},
+	"_dmarc.twice.net":        {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+	"_dmarc.unrelated.net":    {"v=spf1 -all"},
+	"_dmarc.mail.sampled.net": {"v=DMARC1; p=quarantine; pct=0"},
+	"_dmarc.reported.net": {"v=DMARC1; p=quarantine; " +
+		"rua=mailto:dmarc@reported.net,mailto:dmarc@thirdparty.net,mailto:dmarc@unauthorized.net,mailto:big@reported.net!1,https://reported.net"},
+	"reported.net._report._dmarc.thirdparty.net": {"v=DMARC1"},
+}
+
+func lookupTXT(ctx context.Context, name string) ([]string, error) {
+	if name == "_dmarc.broken.net" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if txts, ok := records[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := smtpdmarc.ParsePolicy("v=DMARC1; p=Reject; adkim=s; pct=20; rua=mailto:a@example.org, mailto:b@example.org;")
+	if err != nil {
+		t.Fatalf("ParsePolicy() = %v", err)
+	}
+	want := &smtpdmarc.Policy{
+		Policy:              smtp.DMARCDispositionReject,
+		SubdomainPolicy:     smtp.DMARCDispositionReject,
+		StrictDKIM:          true,
+		Percent:             20,
+		AggregateReportURIs: []string{"mailto:a@example.org", "mailto:b@example.org"},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("ParsePolicy() = %+v, want %+v", p, want)
+	}
+
+	p, err = smtpdmarc.ParsePolicy("v=DMARC1; p=bogus; rua=mailto:a@example.org")
+	if err != nil {
+		t.Fatalf("ParsePolicy() = %v", err)
+	} else if p.Policy != smtp.DMARCDispositionNone {
+		t.Errorf("Policy = %q, want none", p.Policy)
+	}
+
+	for _, txt := range []string{
+		"v=spf1 -all",
+		"p=reject; v=DMARC1",
+		"v=DMARC1; p=bogus",
+		"v=DMARC1; p=reject; pct=200",
+		"v=DMARC1; p=reject; bogus",
+	} {
+		if _, err := smtpdmarc.ParsePolicy(txt); err == nil {
+			t.Errorf("ParsePolicy(%q) = nil error", txt)
+		}
+	}
+}
+
+func TestEvaluator(t *testing.T) {
+	dkimPass := func(domain string) []smtp.DKIMResult {
+		return []smtp.DKIMResult{{Status: smtp.DKIMPass, Domain: domain}}
+	}
+
+	tests := []struct {
+		name        string
+		msg         smtp.DMARCMessage
+		status      smtp.DMARCStatus
+		policy      smtp.DMARCDisposition
+		disposition smtp.DMARCDisposition
+	}{
+		{
+			name:        "dkim aligned",
+			msg:         smtp.DMARCMessage{HeaderFrom: "example.org", DKIM: dkimPass("example.org")},
+			status:      smtp.DMARCPass,
+			policy:      smtp.DMARCDispositionReject,
+			disposition: smtp.DMARCDispositionNone,
+		},
+		{
+			name:        "dkim relaxed alignment",
+			msg:         smtp.DMARCMessage{HeaderFrom: "example.org", DKIM: dkimPass("mail.EXAMPLE.org")},
+			status:      smtp.DMARCPass,
+			policy:      smtp.DMARCDispositionReject,
+			disposition: smtp.DMARCDispositionNone,
+		},
+		{
+			name:        "spf aligned",
+			msg:         smtp.DMARCMessage{HeaderFrom: "example.org", MailFrom: "bounces.example.org", SPF: smtp.SPFPass},
+			status:      smtp.DMARCPass,
+			policy:      smtp.DMARCDispositionReject,
+			disposition: smtp.DMARCDispositionNone,
+		},
+		{
+			name: "unaligned",
+			msg: smtp.DMARCMessage{
+				HeaderFrom: "example.org",
+				MailFrom:   "example.com",
+				SPF:        smtp.SPFPass,
+				DKIM:       dkimPass("example.com"),
+			},
+			status:      smtp.DMARCFail,
+			policy:      smtp.DMARCDispositionReject,
+			disposition: smtp.DMARCDispositionReject,
+		},
+		{
+			name:        "failing dkim",
+			msg:         smtp.DMARCMessage{HeaderFrom: "example.org", DKIM: []smtp.DKIMResult{{Status: smtp.DKIMFail, Domain: "example.org"}}},
+			status:      smtp.DMARCFail,
+			policy:      smtp.DMARCDispositionReject,
+			disposition: smtp.DMARCDispositionReject,
+		},
+		{
+			name:        "subdomain policy",
+			msg:         smtp.DMARCMessage{HeaderFrom: "news.example.org"},
+			status:      smtp.DMARCFail,
+			policy:      smtp.DMARCDispositionQuarantine,
+			disposition: smtp.DMARCDispositionQuarantine,
+		},
+		{
+			name:        "strict alignment",
+			msg:         smtp.DMARCMessage{HeaderFrom: "strict.com", MailFrom: "mail.strict.com", SPF: smtp.SPFPass, DKIM: dkimPass("mail.strict.com")},
+			status:      smtp.DMARCFail,
+			policy:      smtp.DMARCDispositionReject,
+			disposition: smtp.DMARCDispositionReject,
+		},
+		{
+			name:        "none policy",
+			msg:         smtp.DMARCMessage{HeaderFrom: "monitor.net"},
+			status:      smtp.DMARCFail,
+			policy:      smtp.DMARCDispositionNone,
+			disposition: smtp.DMARCDispositionNone,
+		},
+		{
+			name:        "not sampled",
+			msg:         smtp.DMARCMessage{HeaderFrom: "mail.sampled.net"},
+			status:      smtp.DMARCFail,
+			policy:      smtp.DMARCDispositionQuarantine,
+			disposition: smtp.DMARCDispositionNone,
+		},
+		{
+			name:        "no record",
+			msg:         smtp.DMARCMessage{HeaderFrom: "example.com"},
+			status:      smtp.DMARCNone,
+			disposition: smtp.DMARCDispositionNone,
+		},
+		{
+			name:        "several records",
+			msg:         smtp.DMARCMessage{HeaderFrom: "twice.net"},
+			status:      smtp.DMARCNone,
+			disposition: smtp.DMARCDispositionNone,
+		},
+		{
+			name:        "not a DMARC record",
+			msg:         smtp.DMARCMessage{HeaderFrom: "unrelated.net"},
+			status:      smtp.DMARCNone,
+			disposition: smtp.DMARCDispositionNone,
+		},
+		{
+			name:        "lookup failure",
+			msg:         smtp.DMARCMessage{HeaderFrom: "broken.net"},
+			status:      smtp.DMARCTempError,
+			disposition: smtp.DMARCDispositionNone,
+		},
+		{
+			name:        "no From domain",
+			msg:         smtp.DMARCMessage{},
+			status:      smtp.DMARCPermError,
+			disposition: smtp.DMARCDispositionNone,
+		},
+	}
+
+	e := &smtpdmarc.Evaluator{LookupTXT: lookupTXT}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := e.EvaluateDMARC(context.Background(), &tc.msg)
+			if res.Status != tc.status || res.Policy != tc.policy || res.Disposition != tc.disposition {
+				t.Errorf("EvaluateDMARC() = %v (p=%v dis=%v), want %v (p=%v dis=%v)",
+					res.Status, res.Policy, res.Disposition, tc.status, tc.policy, tc.disposition)
+			}
+			if (res.Err != nil) != (tc.status == smtp.DMARCTempError || tc.status == smtp.DMARCPermError) {
+				t.Errorf("Err = %v", res.Err)
+			}
+		})
+	}
+}
+
+func TestEvaluator_sampling(t *testing.T) {
+	msg := &smtp.DMARCMessage{HeaderFrom: "sampled.net"}
+	for _, tc := range []struct {
+		b           byte
+		disposition smtp.DMARCDisposition
+	}{
+		{49, smtp.DMARCDispositionReject},
+		{50, smtp.DMARCDispositionQuarantine},
+		{149, smtp.DMARCDispositionReject},
+		{150, smtp.DMARCDispositionQuarantine},
+	} {
+		e := &smtpdmarc.Evaluator{
+			LookupTXT: lookupTXT,
+			// Values above 199 are skipped
+			Rand: bytes.NewReader([]byte{255, tc.b}),
+		}
+		res := e.EvaluateDMARC(context.Background(), msg)
+		if res.Disposition != tc.disposition {
+			t.Errorf("EvaluateDMARC() with random byte %v: disposition = %v, want %v", tc.b, res.Disposition, tc.disposition)
+		}
+	}
+}
+
+func TestEvaluator_cache(t *testing.T) {
+	lookups := 0
+	clock := smtptest.NewFakeClock(time.Now())
+	e := &smtpdmarc.Evaluator{
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			lookups++
+			return lookupTXT(ctx, name)
+		},
+		CacheTTL: time.Minute,
+		Clock:    clock,
+	}
+	msg := &smtp.DMARCMessage{HeaderFrom: "mail.example.org"}
+
+	e.EvaluateDMARC(context.Background(), msg)
+	if lookups != 2 {
+		t.Fatalf("got %v lookups, want 2", lookups)
+	}
+	e.EvaluateDMARC(context.Background(), msg)
+	if lookups != 2 {
+		t.Errorf("got %v lookups after a cached evaluation, want 2", lookups)
+	}
+	clock.Advance(time.Minute)
+	e.EvaluateDMARC(context.Background(), msg)
+	if lookups != 4 {
+		t.Errorf("got %v lookups after expiration, want 4", lookups)
+	}
+
+	// Temporary failures aren't cached
+	msg = &smtp.DMARCMessage{HeaderFrom: "broken.net"}
+	e.EvaluateDMARC(context.Background(), msg)
+	e.EvaluateDMARC(context.Background(), msg)
+	if lookups != 6 {
+		t.Errorf("got %v lookups, want 6", lookups)
+	}
+}
+
+func TestEvaluator_report(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var recs []*smtpdmarc.Record
+	e := &smtpdmarc.Evaluator{
+		LookupTXT: lookupTXT,
+		Clock:     smtptest.NewFakeClock(now),
+		Report: func(rec *smtpdmarc.Record) {
+			recs = append(recs, rec)
+		},
+	}
+	e.EvaluateDMARC(context.Background(), &smtp.DMARCMessage{
+		ClientIP:   net.IPv4(192, 0, 2, 1),
+		HeaderFrom: "example.org",
+		MailFrom:   "example.org",
+		SPF:        smtp.SPFPass,
+		DKIM:       []smtp.DKIMResult{{Status: smtp.DKIMFail, Domain: "example.org"}},
+	})
+	e.EvaluateDMARC(context.Background(), &smtp.DMARCMessage{})
+	if len(recs) != 1 {
+		t.Fatalf("got %v records, want 1", len(recs))
+	}
+
+	rec := recs[0]
+	if !rec.Time.Equal(now) || !rec.SourceIP.Equal(net.IPv4(192, 0, 2, 1)) || rec.HeaderFrom != "example.org" || rec.EnvelopeFrom != "example.org" {
+		t.Errorf("Record = %+v", rec)
+	}
+	if !rec.SPFAligned || rec.DKIMAligned {
+		t.Errorf("SPFAligned = %v, DKIMAligned = %v, want true, false", rec.SPFAligned, rec.DKIMAligned)
+	}
+	if rec.Policy == nil || rec.Policy.Domain != "example.org" || len(rec.Policy.AggregateReportURIs) != 1 {
+		t.Errorf("Policy = %+v", rec.Policy)
+	}
+	if rec.Result.Status != smtp.DMARCPass {
+		t.Errorf("Result.Status = %v, want pass", rec.Result.Status)
+	}
+}
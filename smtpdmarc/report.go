@@ -0,0 +1,521 @@
+package smtpdmarc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Reporter collects evaluations and periodically sends aggregate reports to
+// the addresses of the rua= tag of policies, as defined in RFC 7489 section
+// 7.2. Its Report method is an Evaluator.Report hook:
+//
+//	r := &smtpdmarc.Reporter{
+//		OrgName: "example.org",
+//		Email:   "dmarc-reports@example.org",
+//		Send: func(ctx context.Context, from string, to []string, msg []byte) error {
+//			var rcpts []*smtpqueue.Recipient
+//			for _, addr := range to {
+//				rcpts = append(rcpts, &smtpqueue.Recipient{Addr: addr})
+//			}
+//			_, err := q.Enqueue(from, nil, rcpts, bytes.NewReader(msg))
+//			return err
+//		},
+//	}
+//	go r.Run(ctx)
+//	s.DMARCEvaluator = &smtpdmarc.Evaluator{Report: r.Report}
+//
+// Only mailto: URIs are supported. Addresses outside of the policy domain
+// are only sent reports if they accept them with a DNS record, as defined
+// in RFC 7489 section 7.1. Collected data is kept in memory: it's lost if
+// the process stops before it's sent.
+type Reporter struct {
+	// Name of the organization sending reports, and contact address, also
+	// used as the sender of reports. Required.
+	OrgName string
+	Email   string
+
+	// Interval between reports. If zero, 24 hours is used.
+	Interval time.Duration
+
+	// Sends a report message to recipients. Required.
+	Send func(ctx context.Context, from string, to []string, msg []byte) error
+
+	// Looks up the TXT records authorizing external report addresses. If
+	// nil, net.DefaultResolver.LookupTXT is used.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	// Logs report failures. If nil, they're not logged.
+	Logger *slog.Logger
+
+	// Source of the current time. If nil, smtp.SystemClock is used.
+	Clock smtp.Clock
+	// Source of randomness for report IDs. If nil, crypto/rand is used.
+	Rand io.Reader
+
+	mu      sync.Mutex
+	begin   time.Time
+	reports map[string]*pendingReport // by policy domain
+}
+
+type pendingReport struct {
+	policy *Policy
+	rows   map[rowKey]*ReportRecord
+}
+
+// rowKey identifies the evaluations counted in a single report record.
+type rowKey struct {
+	sourceIP, headerFrom, envelopeFrom string
+	disposition                        smtp.DMARCDisposition
+	dkimAligned, spfAligned            bool
+	spf                                smtp.SPFResult
+	dkim                               string
+}
+
+func (r *Reporter) now() time.Time {
+	if r.Clock == nil {
+		return smtp.SystemClock.Now()
+	}
+	return r.Clock.Now()
+}
+
+// Report collects an evaluation. Evaluations without a policy requesting
+// aggregate reports are ignored.
+func (r *Reporter) Report(rec *Record) {
+	if rec.Policy == nil || len(rec.Policy.AggregateReportURIs) == 0 {
+		return
+	}
+
+	var dkim []string
+	for _, res := range rec.DKIM {
+		dkim = append(dkim, res.Domain+"/"+res.Selector+"/"+string(res.Status))
+	}
+	key := rowKey{
+		headerFrom:   rec.HeaderFrom,
+		envelopeFrom: rec.EnvelopeFrom,
+		disposition:  rec.Result.Disposition,
+		dkimAligned:  rec.DKIMAligned,
+		spfAligned:   rec.SPFAligned,
+		spf:          rec.SPF,
+		dkim:         strings.Join(dkim, " "),
+	}
+	if rec.SourceIP != nil {
+		key.sourceIP = rec.SourceIP.String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reports == nil {
+		r.reports = make(map[string]*pendingReport)
+	}
+	if r.begin.IsZero() {
+		r.begin = r.now()
+	}
+	report := r.reports[rec.Policy.Domain]
+	if report == nil {
+		report = &pendingReport{rows: make(map[rowKey]*ReportRecord)}
+		r.reports[rec.Policy.Domain] = report
+	}
+	// The latest published policy is reported
+	report.policy = rec.Policy
+
+	row := report.rows[key]
+	if row == nil {
+		row = newReportRecord(rec)
+		report.rows[key] = row
+	}
+	row.Row.Count++
+}
+
+// Run sends reports every Interval until ctx is done. Reports collected
+// since the last interval are then sent.
+func (r *Reporter) Run(ctx context.Context) {
+	interval := r.Interval
+	if interval == 0 {
+		interval = 24 * time.Hour
+	}
+	clock := r.Clock
+	if clock == nil {
+		clock = smtp.SystemClock
+	}
+	for {
+		timer := clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// Don't lose the collected data, but don't wait forever
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			r.flush(ctx)
+			cancel()
+			return
+		case <-timer.C():
+			r.flush(ctx)
+		}
+	}
+}
+
+func (r *Reporter) flush(ctx context.Context) {
+	if err := r.Flush(ctx); err != nil && r.Logger != nil {
+		r.Logger.LogAttrs(ctx, slog.LevelError, "failed to send DMARC aggregate reports", slog.String("error", err.Error()))
+	}
+}
+
+// Flush sends the reports collected so far, and starts a new reporting
+// period. It returns the errors of the reports which couldn't be sent. They
+// aren't retried.
+func (r *Reporter) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	reports, begin := r.reports, r.begin
+	r.reports, r.begin = nil, time.Time{}
+	end := r.now()
+	r.mu.Unlock()
+
+	domains := make([]string, 0, len(reports))
+	for domain := range reports {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	var errs []error
+	for _, domain := range domains {
+		if err := r.send(ctx, reports[domain], begin, end); err != nil {
+			errs = append(errs, fmt.Errorf("report for %v: %v", domain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Reporter) send(ctx context.Context, pending *pendingReport, begin, end time.Time) error {
+	policy := pending.policy
+	id, err := r.newID()
+	if err != nil {
+		return err
+	}
+
+	feedback := &Feedback{
+		Version: "1.0",
+		Metadata: ReportMetadata{
+			OrgName:  r.OrgName,
+			Email:    r.Email,
+			ReportID: id,
+			DateRange: DateRange{
+				Begin: begin.Unix(),
+				End:   end.Unix(),
+			},
+		},
+		Policy: PolicyPublished{
+			Domain:          policy.Domain,
+			DKIMAlignment:   alignmentMode(policy.StrictDKIM),
+			SPFAlignment:    alignmentMode(policy.StrictSPF),
+			Policy:          policy.Policy,
+			SubdomainPolicy: policy.SubdomainPolicy,
+			Percent:         policy.Percent,
+		},
+	}
+	for _, row := range pending.rows {
+		feedback.Records = append(feedback.Records, *row)
+	}
+	sort.Slice(feedback.Records, func(i, j int) bool {
+		a, b := &feedback.Records[i], &feedback.Records[j]
+		if a.Row.SourceIP != b.Row.SourceIP {
+			return a.Row.SourceIP < b.Row.SourceIP
+		}
+		return a.Row.Count > b.Row.Count
+	})
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, xml.Header)
+	enc := xml.NewEncoder(zw)
+	enc.Indent("", "\t")
+	if err := enc.Encode(feedback); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	var to []string
+	for _, uri := range policy.AggregateReportURIs {
+		addr, maxSize, ok := parseMailtoURI(uri)
+		if !ok || (maxSize > 0 && int64(gz.Len()) > maxSize) {
+			continue
+		}
+		if !r.authorized(ctx, policy.Domain, addr) {
+			continue
+		}
+		to = append(to, addr)
+	}
+	if len(to) == 0 {
+		return errors.New("no valid report address")
+	}
+
+	msg := r.formatMessage(feedback, to, gz.Bytes())
+	return r.Send(ctx, r.Email, to, msg)
+}
+
+func (r *Reporter) newID() (string, error) {
+	rnd := r.Rand
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(rnd, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// formatMessage formats a report message, as defined in RFC 7489 section
+// 7.2.1.1.
+func (r *Reporter) formatMessage(feedback *Feedback, to []string, report []byte) []byte {
+	meta := &feedback.Metadata
+	domain := feedback.Policy.Domain
+	filename := fmt.Sprintf("%v!%v!%v!%v.xml.gz", r.OrgName, domain, meta.DateRange.Begin, meta.DateRange.End)
+	emailDomain := r.Email
+	if i := strings.LastIndexByte(emailDomain, '@'); i >= 0 {
+		emailDomain = emailDomain[i+1:]
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: <%v>\r\n", r.Email)
+	fmt.Fprintf(&buf, "To: %v\r\n", "<"+strings.Join(to, ">, <")+">")
+	fmt.Fprintf(&buf, "Subject: Report Domain: %v Submitter: %v Report-ID: <%v>\r\n", domain, r.OrgName, meta.ReportID)
+	fmt.Fprintf(&buf, "Date: %v\r\n", r.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%v@%v>\r\n", meta.ReportID, emailDomain)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprintf(&buf, "\r\n")
+
+	w, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	fmt.Fprintf(w, "This is an aggregate DMARC report for %v from %v.\r\n", domain, r.OrgName)
+
+	w, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/gzip"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", filename)},
+	})
+	b64 := base64.StdEncoding.EncodeToString(report)
+	for len(b64) > 76 {
+		fmt.Fprintf(w, "%v\r\n", b64[:76])
+		b64 = b64[76:]
+	}
+	fmt.Fprintf(w, "%v\r\n", b64)
+	mw.Close()
+	return buf.Bytes()
+}
+
+// authorized reports whether a report address accepts reports for a
+// policy domain, as defined in RFC 7489 section 7.1. Addresses in the policy
+// domain, in its subdomains or its parent domains are always authorized.
+func (r *Reporter) authorized(ctx context.Context, policyDomain, addr string) bool {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return false
+	}
+	addrDomain := strings.ToLower(addr[i+1:])
+	if addrDomain == policyDomain || strings.HasSuffix(addrDomain, "."+policyDomain) || strings.HasSuffix(policyDomain, "."+addrDomain) {
+		return true
+	}
+
+	lookupTXT := r.LookupTXT
+	if lookupTXT == nil {
+		lookupTXT = net.DefaultResolver.LookupTXT
+	}
+	txts, err := lookupTXT(ctx, policyDomain+"._report._dmarc."+addrDomain)
+	if err != nil {
+		return false
+	}
+	for _, txt := range txts {
+		v, _, _ := strings.Cut(txt, ";")
+		if strings.TrimSpace(v) == "v=DMARC1" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMailtoURI parses a report URI, with an optional maximum report size,
+// e.g. "mailto:dmarc@example.org!10m".
+func parseMailtoURI(uri string) (addr string, maxSize int64, ok bool) {
+	if len(uri) < len("mailto:") || !strings.EqualFold(uri[:len("mailto:")], "mailto:") {
+		return "", 0, false
+	}
+	addr = uri[len("mailto:"):]
+	if i := strings.LastIndexByte(addr, '!'); i >= 0 {
+		size := addr[i+1:]
+		addr = addr[:i]
+		unit := int64(1)
+		if n := len(size); n > 0 {
+			switch size[n-1] {
+			case 'k':
+				unit = 1 << 10
+			case 'm':
+				unit = 1 << 20
+			case 'g':
+				unit = 1 << 30
+			case 't':
+				unit = 1 << 40
+			}
+			if unit > 1 {
+				size = size[:n-1]
+			}
+		}
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return "", 0, false
+		}
+		maxSize = n * unit
+	}
+	if !strings.Contains(addr, "@") {
+		return "", 0, false
+	}
+	return addr, maxSize, true
+}
+
+func alignmentMode(strict bool) string {
+	if strict {
+		return "s"
+	}
+	return "r"
+}
+
+// Feedback is an aggregate report, as defined in RFC 7489 appendix C.
+type Feedback struct {
+	XMLName  xml.Name        `xml:"feedback"`
+	Version  string          `xml:"version,omitempty"`
+	Metadata ReportMetadata  `xml:"report_metadata"`
+	Policy   PolicyPublished `xml:"policy_published"`
+	Records  []ReportRecord  `xml:"record"`
+}
+
+// ReportMetadata describes the reporter and the reporting period.
+type ReportMetadata struct {
+	OrgName   string    `xml:"org_name"`
+	Email     string    `xml:"email"`
+	ReportID  string    `xml:"report_id"`
+	DateRange DateRange `xml:"date_range"`
+}
+
+// DateRange is a reporting period, in seconds since the Unix epoch.
+type DateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+// PolicyPublished is the policy of the reported domain.
+type PolicyPublished struct {
+	Domain          string                `xml:"domain"`
+	DKIMAlignment   string                `xml:"adkim"`
+	SPFAlignment    string                `xml:"aspf"`
+	Policy          smtp.DMARCDisposition `xml:"p"`
+	SubdomainPolicy smtp.DMARCDisposition `xml:"sp"`
+	Percent         int                   `xml:"pct"`
+}
+
+// ReportRecord counts the evaluations with the same results.
+type ReportRecord struct {
+	Row         ReportRow         `xml:"row"`
+	Identifiers ReportIdentifiers `xml:"identifiers"`
+	AuthResults ReportAuthResults `xml:"auth_results"`
+}
+
+// ReportRow holds the client address, the number of messages and the
+// evaluated policy.
+type ReportRow struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int             `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+// PolicyEvaluated is the applied disposition and the aligned results.
+type PolicyEvaluated struct {
+	Disposition smtp.DMARCDisposition `xml:"disposition"`
+	DKIM        string                `xml:"dkim"`
+	SPF         string                `xml:"spf"`
+}
+
+// ReportIdentifiers holds the identifiers of the reported messages.
+type ReportIdentifiers struct {
+	HeaderFrom   string `xml:"header_from"`
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+}
+
+// ReportAuthResults holds the SPF and DKIM results, before alignment.
+type ReportAuthResults struct {
+	DKIM []DKIMAuthResult `xml:"dkim"`
+	SPF  SPFAuthResult    `xml:"spf"`
+}
+
+// DKIMAuthResult is the result of the verification of a DKIM signature.
+type DKIMAuthResult struct {
+	Domain   string          `xml:"domain"`
+	Selector string          `xml:"selector,omitempty"`
+	Result   smtp.DKIMStatus `xml:"result"`
+}
+
+// SPFAuthResult is the result of an SPF check.
+type SPFAuthResult struct {
+	Domain string         `xml:"domain"`
+	Result smtp.SPFResult `xml:"result"`
+}
+
+func newReportRecord(rec *Record) *ReportRecord {
+	row := &ReportRecord{
+		Row: ReportRow{
+			PolicyEvaluated: PolicyEvaluated{
+				Disposition: rec.Result.Disposition,
+				DKIM:        passOrFail(rec.DKIMAligned),
+				SPF:         passOrFail(rec.SPFAligned),
+			},
+		},
+		Identifiers: ReportIdentifiers{
+			HeaderFrom:   rec.HeaderFrom,
+			EnvelopeFrom: rec.EnvelopeFrom,
+		},
+		AuthResults: ReportAuthResults{
+			SPF: SPFAuthResult{Domain: rec.EnvelopeFrom, Result: rec.SPF},
+		},
+	}
+	if rec.SourceIP != nil {
+		row.Row.SourceIP = rec.SourceIP.String()
+	}
+	if row.AuthResults.SPF.Result == "" {
+		row.AuthResults.SPF.Result = smtp.SPFNone
+	}
+	for _, res := range rec.DKIM {
+		row.AuthResults.DKIM = append(row.AuthResults.DKIM, DKIMAuthResult{
+			Domain:   res.Domain,
+			Selector: res.Selector,
+			Result:   res.Status,
+		})
+	}
+	return row
+}
+
+func passOrFail(pass bool) string {
+	if pass {
+		return "pass"
+	}
+	return "fail"
+}
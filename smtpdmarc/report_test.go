@@ -0,0 +1,183 @@
+package smtpdmarc_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtpdmarc"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+type sentReport struct {
+	from string
+	to   []string
+	msg  []byte
+}
+
+// parseReport extracts the aggregate report attached to a report message.
+func parseReport(t *testing.T, msg []byte) (*mail.Message, *smtpdmarc.Feedback) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatalf("ReadMessage() = %v", err)
+	}
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("ParseMediaType() = %v", err)
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("NextPart() = %v", err)
+		}
+		if p.Header.Get("Content-Type") != "application/gzip" {
+			continue
+		}
+		zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, p))
+		if err != nil {
+			t.Fatalf("gzip.NewReader() = %v", err)
+		}
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("ReadAll() = %v", err)
+		}
+		var feedback smtpdmarc.Feedback
+		if err := xml.Unmarshal(b, &feedback); err != nil {
+			t.Fatalf("xml.Unmarshal() = %v", err)
+		}
+		return m, &feedback
+	}
+}
+
+func TestReporter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := smtptest.NewFakeClock(start)
+	sent := make(chan sentReport, 10)
+	r := &smtpdmarc.Reporter{
+		OrgName:   "mx.example.com",
+		Email:     "dmarc-reports@example.com",
+		Interval:  time.Hour,
+		LookupTXT: lookupTXT,
+		Clock:     clock,
+		Rand:      bytes.NewReader(bytes.Repeat([]byte{0x2a}, 64)),
+		Send: func(ctx context.Context, from string, to []string, msg []byte) error {
+			sent <- sentReport{from, to, msg}
+			return nil
+		},
+	}
+	e := &smtpdmarc.Evaluator{LookupTXT: lookupTXT, Clock: clock, Report: r.Report}
+
+	ip := net.IPv4(192, 0, 2, 1)
+	for _, msg := range []*smtp.DMARCMessage{
+		{ClientIP: ip, HeaderFrom: "reported.net", MailFrom: "reported.net", SPF: smtp.SPFPass},
+		{ClientIP: ip, HeaderFrom: "reported.net", MailFrom: "reported.net", SPF: smtp.SPFPass},
+		{
+			ClientIP:   net.IPv4(198, 51, 100, 1),
+			HeaderFrom: "reported.net",
+			MailFrom:   "example.com",
+			SPF:        smtp.SPFFail,
+			DKIM:       []smtp.DKIMResult{{Status: smtp.DKIMFail, Domain: "reported.net", Selector: "s1"}},
+		},
+		// Without rua=
+		{ClientIP: ip, HeaderFrom: "strict.com"},
+	} {
+		e.EvaluateDMARC(context.Background(), msg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Hour)
+
+	report := <-sent
+	if report.from != "dmarc-reports@example.com" {
+		t.Errorf("from = %q", report.from)
+	}
+	if want := []string{"dmarc@reported.net", "dmarc@thirdparty.net"}; !reflect.DeepEqual(report.to, want) {
+		t.Errorf("to = %v, want %v", report.to, want)
+	}
+	m, feedback := parseReport(t, report.msg)
+	if want := "Report Domain: reported.net Submitter: mx.example.com Report-ID: <2a2a2a2a2a2a2a2a>"; m.Header.Get("Subject") != want {
+		t.Errorf("Subject = %q, want %q", m.Header.Get("Subject"), want)
+	}
+
+	meta := feedback.Metadata
+	if meta.OrgName != "mx.example.com" || meta.ReportID != "2a2a2a2a2a2a2a2a" || meta.DateRange.Begin != start.Unix() || meta.DateRange.End != start.Add(time.Hour).Unix() {
+		t.Errorf("Metadata = %+v", meta)
+	}
+	if p := feedback.Policy; p.Domain != "reported.net" || p.Policy != smtp.DMARCDispositionQuarantine || p.Percent != 100 || p.DKIMAlignment != "r" {
+		t.Errorf("Policy = %+v", p)
+	}
+	want := []smtpdmarc.ReportRecord{
+		{
+			Row: smtpdmarc.ReportRow{
+				SourceIP: "192.0.2.1",
+				Count:    2,
+				PolicyEvaluated: smtpdmarc.PolicyEvaluated{
+					Disposition: smtp.DMARCDispositionNone,
+					DKIM:        "fail",
+					SPF:         "pass",
+				},
+			},
+			Identifiers: smtpdmarc.ReportIdentifiers{HeaderFrom: "reported.net", EnvelopeFrom: "reported.net"},
+			AuthResults: smtpdmarc.ReportAuthResults{
+				SPF: smtpdmarc.SPFAuthResult{Domain: "reported.net", Result: smtp.SPFPass},
+			},
+		},
+		{
+			Row: smtpdmarc.ReportRow{
+				SourceIP: "198.51.100.1",
+				Count:    1,
+				PolicyEvaluated: smtpdmarc.PolicyEvaluated{
+					Disposition: smtp.DMARCDispositionQuarantine,
+					DKIM:        "fail",
+					SPF:         "fail",
+				},
+			},
+			Identifiers: smtpdmarc.ReportIdentifiers{HeaderFrom: "reported.net", EnvelopeFrom: "example.com"},
+			AuthResults: smtpdmarc.ReportAuthResults{
+				DKIM: []smtpdmarc.DKIMAuthResult{{Domain: "reported.net", Selector: "s1", Result: smtp.DKIMFail}},
+				SPF:  smtpdmarc.SPFAuthResult{Domain: "example.com", Result: smtp.SPFFail},
+			},
+		},
+	}
+	if !reflect.DeepEqual(feedback.Records, want) {
+		t.Errorf("Records = %+v, want %+v", feedback.Records, want)
+	}
+
+	select {
+	case report := <-sent:
+		t.Errorf("unexpected report to %v", report.to)
+	default:
+	}
+
+	// Data collected since the last report is sent when stopping
+	e.EvaluateDMARC(context.Background(), &smtp.DMARCMessage{ClientIP: ip, HeaderFrom: "reported.net"})
+	cancel()
+	<-done
+	report = <-sent
+	if _, feedback := parseReport(t, report.msg); len(feedback.Records) != 1 || feedback.Records[0].Row.Count != 1 {
+		t.Errorf("Records = %+v", feedback.Records)
+	}
+	if err := r.Flush(context.Background()); err != nil {
+		t.Errorf("Flush() = %v without data", err)
+	}
+}
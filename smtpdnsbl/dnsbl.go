@@ -0,0 +1,189 @@
+// Package smtpdnsbl checks go-smtp server connections against DNS blocklists,
+// such as zen.spamhaus.org.
+//
+// A Checker implements smtp.ConnectionChecker:
+//
+//	s.ConnectionChecker = &smtpdnsbl.Checker{
+//		Zones:  []smtpdnsbl.Zone{{Name: "zen.spamhaus.org"}},
+//		Reject: true,
+//	}
+package smtpdnsbl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Zone is a DNS blocklist zone.
+type Zone struct {
+	// Domain name of the zone, e.g. "zen.spamhaus.org".
+	Name string
+	// Return codes meaning the address is listed, e.g. "127.0.0.2". If
+	// empty, any address in 127.0.0.0/8 is a listing, except for
+	// 127.255.255.0/24 which Spamhaus-style zones use to report query
+	// errors.
+	Codes []string
+}
+
+// listed reports whether the addresses returned by a zone lookup are a
+// listing.
+func (z *Zone) listed(addrs []string) bool {
+	for _, s := range addrs {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		if len(z.Codes) == 0 {
+			b := addr.As16()
+			if addr.Is4() && b[12] == 127 && !(b[13] == 255 && b[14] == 255) {
+				return true
+			}
+			continue
+		}
+		for _, code := range z.Codes {
+			if s == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checker looks up the client address of connections in DNS blocklists.
+//
+// Listed connections are tagged with "dnsbl:<zone>" for each zone listing
+// them. Clients without an IP address are never listed. Lookup failures are
+// ignored, so that a broken zone doesn't prevent mail delivery.
+type Checker struct {
+	Zones []Zone
+
+	// Reject listed connections with a 554 reply instead of only tagging
+	// them.
+	Reject bool
+	// Mode is smtp.PolicyMonitor to only log the rejections of listed
+	// connections.
+	Mode smtp.PolicyMode
+	// Text of the rejection reply. "%s" is replaced with the client address
+	// and "%z" with the zone name. If empty, a default message is used.
+	Message string
+
+	// Timeout for all lookups of a connection. If zero, 5 seconds is used.
+	Timeout time.Duration
+
+	// Resolves host names to addresses. If nil, net.DefaultResolver is used.
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+var (
+	_ smtp.ConnectionChecker = (*Checker)(nil)
+	_ smtp.Policy            = (*Checker)(nil)
+)
+
+// PolicyMode implements smtp.Policy.
+func (c *Checker) PolicyMode() smtp.PolicyMode {
+	return c.Mode
+}
+
+// Query returns the DNS name to look up for addr in zone, e.g.
+// "2.0.0.127.zen.spamhaus.org" for 127.0.0.2.
+func Query(addr netip.Addr, zone string) string {
+	addr = addr.Unmap()
+	var sb strings.Builder
+	if addr.Is4() {
+		b := addr.As4()
+		for i := len(b) - 1; i >= 0; i-- {
+			fmt.Fprintf(&sb, "%d.", b[i])
+		}
+	} else {
+		b := addr.As16()
+		for i := len(b) - 1; i >= 0; i-- {
+			fmt.Fprintf(&sb, "%x.%x.", b[i]&0xf, b[i]>>4)
+		}
+	}
+	sb.WriteString(strings.TrimSuffix(zone, "."))
+	return sb.String()
+}
+
+// Lookup returns the zones listing addr. Zones are queried concurrently.
+func (c *Checker) Lookup(ctx context.Context, addr netip.Addr) []string {
+	lookupHost := c.LookupHost
+	if lookupHost == nil {
+		lookupHost = net.DefaultResolver.LookupHost
+	}
+
+	listed := make([]bool, len(c.Zones))
+	var wg sync.WaitGroup
+	for i := range c.Zones {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			zone := &c.Zones[i]
+			addrs, err := lookupHost(ctx, Query(addr, zone.Name))
+			listed[i] = err == nil && zone.listed(addrs)
+		}(i)
+	}
+	wg.Wait()
+
+	var zones []string
+	for i, ok := range listed {
+		if ok {
+			zones = append(zones, c.Zones[i].Name)
+		}
+	}
+	return zones
+}
+
+// CheckConnection implements smtp.ConnectionChecker.
+func (c *Checker) CheckConnection(ctx context.Context, conn *smtp.Conn) error {
+	addr, ok := clientIP(conn.ClientAddr())
+	if !ok {
+		return nil
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	zones := c.Lookup(ctx, addr)
+	for _, zone := range zones {
+		conn.AddTag("dnsbl:" + zone)
+	}
+	if len(zones) == 0 || !c.Reject {
+		return nil
+	}
+
+	msg := c.Message
+	if msg == "" {
+		msg = "Service unavailable; client [%s] blocked using %z"
+	}
+	msg = strings.NewReplacer("%s", addr.String(), "%z", zones[0]).Replace(msg)
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      msg,
+	}
+}
+
+func clientIP(addr net.Addr) (netip.Addr, bool) {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+	}
+	a, ok := netip.AddrFromSlice(ip)
+	return a.Unmap(), ok
+}
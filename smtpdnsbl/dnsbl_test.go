@@ -0,0 +1,136 @@
+package smtpdnsbl_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtpdnsbl"
+)
+
+type session struct{}
+
+func (session) Reset()        {}
+func (session) Logout() error { return nil }
+
+func (session) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (session) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+func (session) Data(r io.Reader) error                         { return nil }
+
+// fakeZones answers queries for the listed names.
+func fakeZones(listed map[string][]string) func(ctx context.Context, host string) ([]string, error) {
+	return func(ctx context.Context, host string) ([]string, error) {
+		if addrs, ok := listed[host]; ok {
+			return addrs, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{"192.0.2.99", "99.2.0.192.zen.example.org"},
+		{"::ffff:192.0.2.99", "99.2.0.192.zen.example.org"},
+		{"2001:db8:1:2:3:4:567:89ab", "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.8.b.d.0.1.0.0.2.zen.example.org"},
+	}
+	for _, tc := range tests {
+		if got := smtpdnsbl.Query(netip.MustParseAddr(tc.addr), "zen.example.org."); got != tc.want {
+			t.Errorf("Query(%v) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestChecker_Lookup(t *testing.T) {
+	c := &smtpdnsbl.Checker{
+		Zones: []smtpdnsbl.Zone{
+			{Name: "zen.example.org"},
+			{Name: "errors.example.org"},
+			{Name: "codes.example.org", Codes: []string{"127.0.0.4"}},
+			{Name: "broken.example.org"},
+		},
+		LookupHost: func(ctx context.Context, host string) ([]string, error) {
+			switch host {
+			case "2.0.0.127.zen.example.org":
+				return []string{"127.0.0.2", "127.0.0.10"}, nil
+			case "2.0.0.127.errors.example.org":
+				return []string{"127.255.255.254"}, nil
+			case "2.0.0.127.codes.example.org":
+				return []string{"127.0.0.3"}, nil
+			}
+			return nil, errors.New("SERVFAIL")
+		},
+	}
+	zones := c.Lookup(context.Background(), netip.MustParseAddr("127.0.0.2"))
+	if want := []string{"zen.example.org"}; !reflect.DeepEqual(zones, want) {
+		t.Errorf("Lookup() = %v, want %v", zones, want)
+	}
+}
+
+func testServer(t *testing.T, checker *smtpdnsbl.Checker, tags chan<- []string) (*smtp.Server, string) {
+	s := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		tags <- c.Tags()
+		return session{}, nil
+	}))
+	s.Domain = "localhost"
+	s.ConnectionChecker = checker
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return s, l.Addr().String()
+}
+
+func TestChecker_reject(t *testing.T) {
+	checker := &smtpdnsbl.Checker{
+		Zones:      []smtpdnsbl.Zone{{Name: "zen.example.org"}},
+		Reject:     true,
+		LookupHost: fakeZones(map[string][]string{"1.0.0.127.zen.example.org": {"127.0.0.2"}}),
+	}
+	s, addr := testServer(t, checker, make(chan []string, 1))
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Hello("localhost")
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 554 {
+		t.Fatalf("Hello() = %v, want a 554 error", err)
+	}
+	if want := "Service unavailable; client [127.0.0.1] blocked using zen.example.org"; smtpErr.Message != want {
+		t.Errorf("Message = %q, want %q", smtpErr.Message, want)
+	}
+}
+
+func TestChecker_tag(t *testing.T) {
+	checker := &smtpdnsbl.Checker{
+		Zones:      []smtpdnsbl.Zone{{Name: "zen.example.org"}, {Name: "other.example.org"}},
+		LookupHost: fakeZones(map[string][]string{"1.0.0.127.zen.example.org": {"127.0.0.2"}}),
+	}
+	tags := make(chan []string, 1)
+	s, addr := testServer(t, checker, tags)
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-tags, []string{"dnsbl:zen.example.org"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tags() = %v, want %v", got, want)
+	}
+}
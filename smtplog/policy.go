@@ -0,0 +1,188 @@
+package smtplog
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+const (
+	// SessionKey is the attribute key holding the connection identifier.
+	SessionKey = "session_id"
+	// ErrorKey is the attribute key holding an error. Records carrying it
+	// are considered failures.
+	ErrorKey = "error"
+)
+
+// DefaultAddressKeys lists the attribute keys holding e-mail addresses.
+var DefaultAddressKeys = []string{"from", "rcpt", "to", "auth_user"}
+
+// RedactMode specifies how e-mail addresses are redacted.
+type RedactMode int
+
+const (
+	// RedactNone leaves addresses untouched.
+	RedactNone RedactMode = iota
+	// RedactLocalPart replaces the local-part of addresses, keeping the
+	// domain.
+	RedactLocalPart
+	// RedactAddress replaces whole addresses.
+	RedactAddress
+)
+
+// Redacted is the replacement text for redacted data.
+const Redacted = "[redacted]"
+
+// Policy contains logging privacy and volume controls.
+type Policy struct {
+	// Fraction of connections, between 0 and 1, for which successful events
+	// are logged. Failures (records with a level of at least slog.LevelWarn
+	// or carrying an ErrorKey attribute) are always logged.
+	//
+	// The decision is made once per connection, based on the SessionKey
+	// attribute, so that sampled connections are logged completely.
+	//
+	// Values outside of the ]0, 1[ range disable sampling.
+	SampleRate float64
+
+	// How e-mail addresses are redacted.
+	Redact RedactMode
+	// Attribute keys holding e-mail addresses. Defaults to
+	// DefaultAddressKeys. Keys are matched regardless of their group.
+	AddressKeys []string
+}
+
+// PolicyHandler is a slog.Handler applying a Policy before handing records
+// over to another handler.
+type PolicyHandler struct {
+	policy  Policy
+	next    slog.Handler
+	session string
+}
+
+var _ slog.Handler = (*PolicyHandler)(nil)
+
+// NewPolicyHandler creates a new handler applying policy to records before
+// passing them to next.
+func NewPolicyHandler(next slog.Handler, policy Policy) *PolicyHandler {
+	if policy.AddressKeys == nil {
+		policy.AddressKeys = DefaultAddressKeys
+	}
+	return &PolicyHandler{policy: policy, next: next}
+}
+
+// Enabled implements slog.Handler.
+func (h *PolicyHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// WithAttrs implements slog.Handler.
+func (h *PolicyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		if a.Key == SessionKey {
+			h2.session = a.Value.String()
+		}
+		redacted[i] = h.redactAttr(a)
+	}
+	h2.next = h.next.WithAttrs(redacted)
+	return &h2
+}
+
+// WithGroup implements slog.Handler.
+func (h *PolicyHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	return &h2
+}
+
+// Handle implements slog.Handler.
+func (h *PolicyHandler) Handle(ctx context.Context, r slog.Record) error {
+	session := h.session
+	failure := r.Level >= slog.LevelWarn
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case SessionKey:
+			session = a.Value.String()
+		case ErrorKey:
+			failure = true
+		}
+		return true
+	})
+
+	if !failure && !h.sampled(session) {
+		return nil
+	}
+
+	if h.policy.Redact == RedactNone {
+		return h.next.Handle(ctx, r)
+	}
+
+	r2 := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		r2.AddAttrs(h.redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, r2)
+}
+
+func (h *PolicyHandler) sampled(session string) bool {
+	rate := h.policy.SampleRate
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+	if session == "" {
+		return rand.Float64() < rate
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(session))
+	return float64(hash.Sum32()) < rate*math.MaxUint32
+}
+
+func (h *PolicyHandler) redactAttr(a slog.Attr) slog.Attr {
+	if h.policy.Redact == RedactNone {
+		return a
+	}
+
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		attrs := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			attrs[i] = h.redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(attrs...)}
+	}
+
+	for _, k := range h.policy.AddressKeys {
+		if a.Key == k {
+			return slog.String(a.Key, RedactAddr(a.Value.String(), h.policy.Redact))
+		}
+	}
+	return a
+}
+
+// RedactAddr redacts an e-mail address according to mode.
+//
+// The null reverse-path (empty address) is never redacted.
+func RedactAddr(addr string, mode RedactMode) string {
+	if addr == "" {
+		return addr
+	}
+
+	switch mode {
+	case RedactLocalPart:
+		if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+			return Redacted + addr[i:]
+		}
+		return Redacted
+	case RedactAddress:
+		return Redacted
+	default:
+		return addr
+	}
+}
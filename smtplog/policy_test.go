@@ -0,0 +1,71 @@
+package smtplog
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestLogger(buf *bytes.Buffer, policy Policy) *slog.Logger {
+	text := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return slog.New(NewPolicyHandler(text, policy))
+}
+
+func TestPolicyHandler_redact(t *testing.T) {
+	tests := []struct {
+		mode RedactMode
+		want string
+	}{
+		{RedactNone, `level=INFO msg=rcpt session_id=1 from=alice@example.org tx.rcpt=bob@example.com helo=mx.example.org` + "\n"},
+		{RedactLocalPart, `level=INFO msg=rcpt session_id=1 from=[redacted]@example.org tx.rcpt=[redacted]@example.com helo=mx.example.org` + "\n"},
+		{RedactAddress, `level=INFO msg=rcpt session_id=1 from=[redacted] tx.rcpt=[redacted] helo=mx.example.org` + "\n"},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		logger := newTestLogger(&buf, Policy{Redact: tc.mode})
+		logger = logger.With(SessionKey, "1", "from", "alice@example.org")
+		logger.Info("rcpt", slog.Group("tx", "rcpt", "bob@example.com"), "helo", "mx.example.org")
+		if got := buf.String(); got != tc.want {
+			t.Errorf("mode %v: got:\n%v\nwant:\n%v", tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyHandler_sample(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(&buf, Policy{SampleRate: 0.5})
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		connLogger := logger.With(SessionKey, strconv.Itoa(i))
+		connLogger.Info("connection opened")
+		connLogger.Info("message accepted")
+		connLogger.Info("data failed", ErrorKey, errors.New("oops"))
+		connLogger.Warn("connection error")
+	}
+
+	opened := strings.Count(buf.String(), "msg=\"connection opened\"")
+	accepted := strings.Count(buf.String(), "msg=\"message accepted\"")
+	if opened != accepted {
+		t.Errorf("sampling isn't consistent per connection: %v opened, %v accepted", opened, accepted)
+	}
+	if opened < n/4 || opened > 3*n/4 {
+		t.Errorf("sampled %v connections out of %v, want about half", opened, n)
+	}
+	if got := strings.Count(buf.String(), "msg=\"data failed\""); got != n {
+		t.Errorf("logged %v records with an error, want %v", got, n)
+	}
+	if got := strings.Count(buf.String(), "msg=\"connection error\""); got != n {
+		t.Errorf("logged %v warnings, want %v", got, n)
+	}
+}
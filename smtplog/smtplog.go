@@ -0,0 +1,191 @@
+// Package smtplog provides log/slog handlers that integrate SMTP server logs
+// with existing system log pipelines.
+//
+// Records may carry an attribute named EventKey describing the event type
+// (for instance "auth" or "data"). Handlers use it to pick a syslog facility
+// and severity, so that e.g. authentication failures end up in the authpriv
+// facility while the rest of the traffic is logged under mail.
+//
+// PolicyHandler can be layered on top of any handler to sample successful
+// connections and redact e-mail addresses.
+package smtplog
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// EventKey is the attribute key holding the event type of a record.
+const EventKey = "event"
+
+// Facility is a syslog facility, as defined in RFC 5424 section 6.2.1.
+type Facility int
+
+const (
+	FacilityKern     Facility = 0
+	FacilityUser     Facility = 1
+	FacilityMail     Facility = 2
+	FacilityDaemon   Facility = 3
+	FacilityAuth     Facility = 4
+	FacilitySyslog   Facility = 5
+	FacilityAuthPriv Facility = 10
+	FacilityLocal0   Facility = 16
+	FacilityLocal1   Facility = 17
+	FacilityLocal2   Facility = 18
+	FacilityLocal3   Facility = 19
+	FacilityLocal4   Facility = 20
+	FacilityLocal5   Facility = 21
+	FacilityLocal6   Facility = 22
+	FacilityLocal7   Facility = 23
+)
+
+// Severity is a syslog severity, as defined in RFC 5424 section 6.2.1.
+type Severity int
+
+const (
+	SeverityEmergency Severity = 0
+	SeverityAlert     Severity = 1
+	SeverityCritical  Severity = 2
+	SeverityError     Severity = 3
+	SeverityWarning   Severity = 4
+	SeverityNotice    Severity = 5
+	SeverityInfo      Severity = 6
+	SeverityDebug     Severity = 7
+)
+
+// LevelSeverity maps a slog level to a syslog severity.
+func LevelSeverity(level slog.Level) Severity {
+	switch {
+	case level > slog.LevelError:
+		return SeverityCritical
+	case level >= slog.LevelError:
+		return SeverityError
+	case level >= slog.LevelWarn:
+		return SeverityWarning
+	case level >= slog.LevelInfo:
+		return SeverityInfo
+	default:
+		return SeverityDebug
+	}
+}
+
+// Mapping selects the facility and severity of a record based on its event
+// type.
+type Mapping struct {
+	// Facility used when the event type has no entry in EventFacility.
+	// Defaults to FacilityMail.
+	Facility Facility
+	// Per-event facility overrides.
+	EventFacility map[string]Facility
+	// Per-event severity overrides. Events without an entry use the
+	// severity derived from the record level.
+	EventSeverity map[string]Severity
+}
+
+// DefaultMapping logs everything under the mail facility, except
+// authentication events which are logged under authpriv.
+var DefaultMapping = &Mapping{
+	Facility: FacilityMail,
+	EventFacility: map[string]Facility{
+		"auth": FacilityAuthPriv,
+	},
+}
+
+func (m *Mapping) resolve(event string, level slog.Level) (Facility, Severity) {
+	if m == nil {
+		m = DefaultMapping
+	}
+
+	facility := m.Facility
+	if f, ok := m.EventFacility[event]; ok {
+		facility = f
+	}
+	severity := LevelSeverity(level)
+	if s, ok := m.EventSeverity[event]; ok {
+		severity = s
+	}
+	return facility, severity
+}
+
+// field is a flattened record attribute.
+type field struct {
+	key, value string
+}
+
+// attrState holds the attributes and groups accumulated via WithAttrs and
+// WithGroup.
+type attrState struct {
+	prefix string
+	fields []field
+	event  string
+}
+
+func (s attrState) withAttrs(attrs []slog.Attr) attrState {
+	fields := make([]field, len(s.fields), len(s.fields)+len(attrs))
+	copy(fields, s.fields)
+	s.fields = fields
+	for _, a := range attrs {
+		s.appendAttr(a, s.prefix)
+	}
+	return s
+}
+
+func (s attrState) withGroup(name string) attrState {
+	if name == "" {
+		return s
+	}
+	s.prefix += name + "."
+	return s
+}
+
+// record flattens the attributes of r on top of the handler state.
+func (s attrState) record(r slog.Record) attrState {
+	fields := make([]field, len(s.fields), len(s.fields)+r.NumAttrs())
+	copy(fields, s.fields)
+	s.fields = fields
+	r.Attrs(func(a slog.Attr) bool {
+		s.appendAttr(a, s.prefix)
+		return true
+	})
+	return s
+}
+
+func (s *attrState) appendAttr(a slog.Attr, prefix string) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			s.appendAttr(ga, prefix)
+		}
+		return
+	}
+	if prefix == "" && a.Key == EventKey {
+		s.event = a.Value.String()
+	}
+	s.fields = append(s.fields, field{key: prefix + a.Key, value: formatValue(a.Value)})
+}
+
+func formatValue(v slog.Value) string {
+	switch v.Kind() {
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+		return fmt.Sprint(v.Any())
+	default:
+		return v.String()
+	}
+}
+
+func trimNewlines(s string) string {
+	return strings.TrimRight(s, "\r\n")
+}
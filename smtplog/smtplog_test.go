@@ -0,0 +1,163 @@
+package smtplog
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2024, 3, 1, 12, 30, 45, 123456000, time.UTC)
+
+func newTestRecord(level slog.Level, msg string, attrs ...slog.Attr) slog.Record {
+	r := slog.NewRecord(testTime, level, msg, 0)
+	r.AddAttrs(attrs...)
+	return r
+}
+
+func TestSyslogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewSyslogHandler(&buf, &SyslogOptions{
+		Hostname: "mx.example.org",
+		ProcID:   "42",
+	})
+
+	tests := []struct {
+		handler slog.Handler
+		record  slog.Record
+		want    string
+	}{
+		{
+			handler: h,
+			record:  newTestRecord(slog.LevelInfo, "connection opened"),
+			want:    `<22>1 2024-03-01T12:30:45.123456Z mx.example.org smtp 42 - - connection opened`,
+		},
+		{
+			handler: h.WithAttrs([]slog.Attr{slog.String("remote_addr", "192.0.2.1:1234")}),
+			record:  newTestRecord(slog.LevelWarn, "authentication failed", slog.String(EventKey, "auth"), slog.String("user", `a"b]c\`)),
+			want:    `<84>1 2024-03-01T12:30:45.123456Z mx.example.org smtp 42 auth [smtp@32473 remote_addr="192.0.2.1:1234" event="auth" user="a\"b\]c\\"] authentication failed`,
+		},
+		{
+			handler: h.WithGroup("tx"),
+			record:  newTestRecord(slog.LevelError, "data failed", slog.Int("size", 12)),
+			want:    `<19>1 2024-03-01T12:30:45.123456Z mx.example.org smtp 42 - [smtp@32473 tx.size="12"] data failed`,
+		},
+	}
+	for _, tc := range tests {
+		buf.Reset()
+		if err := tc.handler.Handle(context.Background(), tc.record); err != nil {
+			t.Fatalf("Handle() = %v", err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("Handle() wrote:\n%v\nwant:\n%v", got, tc.want)
+		}
+	}
+}
+
+func TestSyslogHandler_mapping(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewSyslogHandler(&buf, &SyslogOptions{
+		Hostname: "mx.example.org",
+		ProcID:   "42",
+		Mapping: &Mapping{
+			Facility:      FacilityLocal3,
+			EventSeverity: map[string]Severity{"kick": SeverityNotice},
+		},
+	})
+
+	r := newTestRecord(slog.LevelInfo, "kicked", slog.String(EventKey, "kick"))
+	if err := h.Handle(context.Background(), r); err != nil {
+		t.Fatalf("Handle() = %v", err)
+	}
+	if want := "<157>1 "; !strings.HasPrefix(buf.String(), want) {
+		t.Errorf("Handle() wrote %q, want prefix %q", buf.String(), want)
+	}
+}
+
+func TestDialSyslog_tcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		received <- string(b)
+	}()
+
+	h, err := DialSyslog("tcp", l.Addr().String(), &SyslogOptions{
+		Hostname: "mx.example.org",
+		ProcID:   "42",
+	})
+	if err != nil {
+		t.Fatalf("DialSyslog() = %v", err)
+	}
+	for _, msg := range []string{"connection opened", "connection closed"} {
+		if err := h.Handle(context.Background(), newTestRecord(slog.LevelInfo, msg)); err != nil {
+			t.Fatalf("Handle() = %v", err)
+		}
+	}
+	h.Close()
+
+	want := "78 <22>1 2024-03-01T12:30:45.123456Z mx.example.org smtp 42 - - connection opened" +
+		"78 <22>1 2024-03-01T12:30:45.123456Z mx.example.org smtp 42 - - connection closed"
+	if got := <-received; got != want {
+		t.Errorf("received:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestJournaldHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewJournaldHandler(&buf, nil).WithAttrs([]slog.Attr{
+		slog.String("remote_addr", "192.0.2.1:1234"),
+		slog.String("_hidden", "x"),
+	})
+
+	r := newTestRecord(slog.LevelWarn, "authentication failed",
+		slog.String(EventKey, "auth"),
+		slog.String("message", "spoofed"),
+		slog.String("text", "a\nb"))
+	if err := h.Handle(context.Background(), r); err != nil {
+		t.Fatalf("Handle() = %v", err)
+	}
+
+	want := "MESSAGE=authentication failed\n" +
+		"PRIORITY=4\n" +
+		"SYSLOG_FACILITY=10\n" +
+		"SYSLOG_IDENTIFIER=smtp\n" +
+		"REMOTE_ADDR=192.0.2.1:1234\n" +
+		"HIDDEN=x\n" +
+		"EVENT=auth\n" +
+		"ATTR_MESSAGE=spoofed\n" +
+		"TEXT\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Handle() wrote:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	tests := map[string]string{
+		"remote_addr": "REMOTE_ADDR",
+		"tx.size":     "TX_SIZE",
+		"__x":         "X",
+		"1st":         "F1ST",
+		"":            "F",
+	}
+	for key, want := range tests {
+		if got := journalFieldName(key); got != want {
+			t.Errorf("journalFieldName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
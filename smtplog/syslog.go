@@ -0,0 +1,226 @@
+package smtplog
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogOptions contains options for SyslogHandler.
+type SyslogOptions struct {
+	// Minimum level to log. Defaults to slog.LevelInfo.
+	Level slog.Leveler
+	// Facility and severity mapping. Defaults to DefaultMapping.
+	Mapping *Mapping
+
+	// HOSTNAME header field. Defaults to os.Hostname.
+	Hostname string
+	// APP-NAME header field. Defaults to "smtp".
+	AppName string
+	// PROCID header field. Defaults to the current process ID.
+	ProcID string
+	// SD-ID of the structured data element carrying record attributes.
+	// Defaults to "smtp@32473".
+	StructuredDataID string
+
+	// Prefix each message with its length, with the octet-counting framing
+	// defined in RFC 6587 section 3.4.1, so that messages can be told apart
+	// on stream transports such as TCP. Set by DialSyslog for stream
+	// networks.
+	OctetCounting bool
+}
+
+// SyslogHandler is a slog.Handler writing RFC 5424 messages.
+//
+// The record event type is used as MSGID and attributes are written as
+// structured data parameters.
+type SyslogHandler struct {
+	opts  SyslogOptions
+	state attrState
+
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+var _ slog.Handler = (*SyslogHandler)(nil)
+
+// NewSyslogHandler creates a new syslog handler writing one message per Write
+// call to w.
+//
+// A nil opts is equivalent to a zero SyslogOptions.
+func NewSyslogHandler(w io.Writer, opts *SyslogOptions) *SyslogHandler {
+	h := &SyslogHandler{
+		mu: new(sync.Mutex),
+		w:  w,
+	}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.Hostname == "" {
+		h.opts.Hostname, _ = os.Hostname()
+	}
+	if h.opts.AppName == "" {
+		h.opts.AppName = "smtp"
+	}
+	if h.opts.ProcID == "" {
+		h.opts.ProcID = strconv.Itoa(os.Getpid())
+	}
+	if h.opts.StructuredDataID == "" {
+		h.opts.StructuredDataID = "smtp@32473"
+	}
+	return h
+}
+
+// DialSyslog connects to a syslog daemon and returns a handler writing to it.
+//
+// If network is empty, the local daemon is used via a "unixgram" connection
+// to /dev/log. On stream networks, such as "tcp" and "unix", messages are
+// framed with octet counting, see SyslogOptions.OctetCounting.
+//
+// The returned handler must be closed with Close once it's no longer used.
+func DialSyslog(network, addr string, opts *SyslogOptions) (*SyslogHandler, error) {
+	if network == "" {
+		network, addr = "unixgram", "/dev/log"
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	h := NewSyslogHandler(conn, opts)
+	if !isDatagramNetwork(network) {
+		h.opts.OctetCounting = true
+	}
+	return h, nil
+}
+
+// isDatagramNetwork reports whether network preserves message boundaries.
+func isDatagramNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram", "unixpacket":
+		return true
+	default:
+		return strings.HasPrefix(network, "ip")
+	}
+}
+
+// Close closes the underlying writer if it implements io.Closer.
+func (h *SyslogHandler) Close() error {
+	if c, ok := h.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Enabled implements slog.Handler.
+func (h *SyslogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
+	}
+	return level >= minLevel
+}
+
+// WithAttrs implements slog.Handler.
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.state = h.state.withAttrs(attrs)
+	return &h2
+}
+
+// WithGroup implements slog.Handler.
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.state = h.state.withGroup(name)
+	return &h2
+}
+
+// Handle implements slog.Handler.
+func (h *SyslogHandler) Handle(_ context.Context, r slog.Record) error {
+	state := h.state.record(r)
+	facility, severity := h.opts.Mapping.resolve(state.event, r.Level)
+
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('<')
+	sb.WriteString(strconv.Itoa(int(facility)*8 + int(severity)))
+	sb.WriteString(">1 ")
+	sb.WriteString(t.Format("2006-01-02T15:04:05.000000Z07:00"))
+	sb.WriteByte(' ')
+	sb.WriteString(headerField(h.opts.Hostname, 255))
+	sb.WriteByte(' ')
+	sb.WriteString(headerField(h.opts.AppName, 48))
+	sb.WriteByte(' ')
+	sb.WriteString(headerField(h.opts.ProcID, 128))
+	sb.WriteByte(' ')
+	sb.WriteString(headerField(state.event, 32))
+	sb.WriteByte(' ')
+	if len(state.fields) == 0 {
+		sb.WriteByte('-')
+	} else {
+		sb.WriteByte('[')
+		sb.WriteString(h.opts.StructuredDataID)
+		for _, f := range state.fields {
+			sb.WriteByte(' ')
+			sb.WriteString(sdName(f.key))
+			sb.WriteString(`="`)
+			sb.WriteString(sdValueEscaper.Replace(f.value))
+			sb.WriteByte('"')
+		}
+		sb.WriteByte(']')
+	}
+	if r.Message != "" {
+		sb.WriteByte(' ')
+		sb.WriteString(trimNewlines(r.Message))
+	}
+
+	msg := sb.String()
+	if h.opts.OctetCounting {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, msg)
+	return err
+}
+
+// headerField formats a RFC 5424 header field: printable US-ASCII without
+// spaces, "-" when empty.
+func headerField(s string, limit int) string {
+	var sb strings.Builder
+	for i := 0; i < len(s) && sb.Len() < limit; i++ {
+		if ch := s[i]; ch > ' ' && ch <= '~' {
+			sb.WriteByte(ch)
+		}
+	}
+	if sb.Len() == 0 {
+		return "-"
+	}
+	return sb.String()
+}
+
+// sdName formats a RFC 5424 SD-NAME.
+func sdName(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s) && sb.Len() < 32; i++ {
+		switch ch := s[i]; {
+		case ch <= ' ' || ch > '~', ch == '=', ch == ']', ch == '"':
+			sb.WriteByte('_')
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
+
+var sdValueEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
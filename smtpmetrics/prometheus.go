@@ -0,0 +1,247 @@
+// Package smtpmetrics exports go-smtp server metrics in the Prometheus text
+// exposition format.
+//
+// A Prometheus value implements smtp.ServerMetrics and http.Handler:
+//
+//	metrics := smtpmetrics.NewPrometheus("smtp")
+//	s.Metrics = metrics
+//	http.Handle("/metrics", metrics)
+package smtpmetrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Verbs counted with their own label value. Other verbs are counted as
+// "OTHER", to bound the number of series.
+var knownVerbs = map[string]bool{
+	"HELO": true, "EHLO": true, "LHLO": true, "MAIL": true, "RCPT": true,
+	"DATA": true, "BDAT": true, "RSET": true, "VRFY": true, "NOOP": true,
+	"QUIT": true, "AUTH": true, "STARTTLS": true, "ETRN": true, "ATRN": true,
+	"TURN": true,
+}
+
+// Prometheus collects server metrics. It is safe for concurrent use.
+type Prometheus struct {
+	namespace string
+
+	locker                 sync.Mutex
+	connsOpened            uint64
+	connsActive            int64
+	bytesIn                uint64
+	bytesOut               uint64
+	commands               map[string]uint64
+	authFailures           map[string]uint64
+	accepted               uint64
+	rejected               uint64
+	tlsSuccess             uint64
+	tlsFailure             uint64
+	memoryUsed             int64
+	memoryConnRejections   uint64
+	memoryServerRejections uint64
+}
+
+var (
+	_ smtp.ServerMetrics = (*Prometheus)(nil)
+	_ smtp.MemoryMetrics = (*Prometheus)(nil)
+	_ http.Handler       = (*Prometheus)(nil)
+)
+
+// NewPrometheus creates a new Prometheus collector. Metric names are prefixed
+// with namespace and an underscore, if namespace isn't empty.
+func NewPrometheus(namespace string) *Prometheus {
+	return &Prometheus{
+		namespace:    namespace,
+		commands:     make(map[string]uint64),
+		authFailures: make(map[string]uint64),
+	}
+}
+
+// ConnectionOpened implements smtp.ServerMetrics.
+func (p *Prometheus) ConnectionOpened() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.connsOpened++
+	p.connsActive++
+}
+
+// ConnectionClosed implements smtp.ServerMetrics.
+func (p *Prometheus) ConnectionClosed(bytesIn, bytesOut int64) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.connsActive--
+	p.bytesIn += uint64(bytesIn)
+	p.bytesOut += uint64(bytesOut)
+}
+
+// Command implements smtp.ServerMetrics.
+func (p *Prometheus) Command(verb string) {
+	if !knownVerbs[verb] {
+		verb = "OTHER"
+	}
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.commands[verb]++
+}
+
+// AuthFailed implements smtp.ServerMetrics.
+func (p *Prometheus) AuthFailed(mech string) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.authFailures[mech]++
+}
+
+// MessageAccepted implements smtp.ServerMetrics.
+func (p *Prometheus) MessageAccepted() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.accepted++
+}
+
+// MessageRejected implements smtp.ServerMetrics.
+func (p *Prometheus) MessageRejected() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.rejected++
+}
+
+// TLSHandshake implements smtp.ServerMetrics.
+func (p *Prometheus) TLSHandshake(err error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	if err != nil {
+		p.tlsFailure++
+	} else {
+		p.tlsSuccess++
+	}
+}
+
+// MemoryUsed implements smtp.MemoryMetrics.
+func (p *Prometheus) MemoryUsed(bytes int64) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.memoryUsed = bytes
+}
+
+// MemoryRejected implements smtp.MemoryMetrics.
+func (p *Prometheus) MemoryRejected(global bool) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	if global {
+		p.memoryServerRejections++
+	} else {
+		p.memoryConnRejections++
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (p *Prometheus) WriteTo(w io.Writer) (int64, error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	ew := &expositionWriter{w: w, namespace: p.namespace}
+	ew.metric("connections_total", "counter", "Connections accepted.")
+	ew.sample("connections_total", nil, float64(p.connsOpened))
+	ew.metric("connections_active", "gauge", "Connections currently open.")
+	ew.sample("connections_active", nil, float64(p.connsActive))
+	ew.metric("commands_total", "counter", "Commands received, by verb.")
+	for _, verb := range sortedKeys(p.commands) {
+		ew.sample("commands_total", []string{"verb", verb}, float64(p.commands[verb]))
+	}
+	ew.metric("auth_failures_total", "counter", "Failed authentication attempts, by mechanism.")
+	for _, mech := range sortedKeys(p.authFailures) {
+		ew.sample("auth_failures_total", []string{"mechanism", mech}, float64(p.authFailures[mech]))
+	}
+	ew.metric("messages_total", "counter", "Messages received, by result.")
+	ew.sample("messages_total", []string{"result", "accepted"}, float64(p.accepted))
+	ew.sample("messages_total", []string{"result", "rejected"}, float64(p.rejected))
+	ew.metric("bytes_total", "counter", "Bytes transferred on closed connections, by direction.")
+	ew.sample("bytes_total", []string{"direction", "in"}, float64(p.bytesIn))
+	ew.sample("bytes_total", []string{"direction", "out"}, float64(p.bytesOut))
+	ew.metric("tls_handshakes_total", "counter", "TLS handshakes, by result.")
+	ew.sample("tls_handshakes_total", []string{"result", "success"}, float64(p.tlsSuccess))
+	ew.sample("tls_handshakes_total", []string{"result", "failure"}, float64(p.tlsFailure))
+	ew.metric("memory_bytes", "gauge", "Bytes buffered by connections.")
+	ew.sample("memory_bytes", nil, float64(p.memoryUsed))
+	ew.metric("memory_rejections_total", "counter", "Commands and messages deferred for exceeding a memory budget, by budget.")
+	ew.sample("memory_rejections_total", []string{"budget", "connection"}, float64(p.memoryConnRejections))
+	ew.sample("memory_rejections_total", []string{"budget", "server"}, float64(p.memoryServerRejections))
+	return ew.n, ew.err
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	l := make([]string, 0, len(m))
+	for k := range m {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l
+}
+
+type expositionWriter struct {
+	w         io.Writer
+	namespace string
+	n         int64
+	err       error
+}
+
+func (ew *expositionWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(ew.w, format, args...)
+	ew.n += int64(n)
+	ew.err = err
+}
+
+func (ew *expositionWriter) name(name string) string {
+	if ew.namespace == "" {
+		return name
+	}
+	return ew.namespace + "_" + name
+}
+
+func (ew *expositionWriter) metric(name, typ, help string) {
+	ew.printf("# HELP %s %s\n# TYPE %s %s\n", ew.name(name), help, ew.name(name), typ)
+}
+
+// sample writes a sample. labels is a list of name/value pairs.
+func (ew *expositionWriter) sample(name string, labels []string, value float64) {
+	var sb strings.Builder
+	sb.WriteString(ew.name(name))
+	if len(labels) > 0 {
+		sb.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, "%s=%q", labels[i], escapeLabelValue(labels[i+1]))
+		}
+		sb.WriteByte('}')
+	}
+	ew.printf("%s %v\n", sb.String(), value)
+}
+
+// escapeLabelValue replaces characters which %q would escape differently
+// than the exposition format.
+func escapeLabelValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,91 @@
+package smtpmetrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtpmetrics"
+)
+
+type session struct{}
+
+func (session) Reset()        {}
+func (session) Logout() error { return nil }
+
+func (session) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (session) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+
+func (session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(b), "spam") {
+		return errors.New("spam")
+	}
+	return nil
+}
+
+func TestPrometheus(t *testing.T) {
+	metrics := smtpmetrics.NewPrometheus("smtp")
+
+	s := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return session{}, nil
+	}))
+	s.Domain = "localhost"
+	s.Metrics = metrics
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Serve(l)
+		close(done)
+	}()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"ham", "spam"} {
+		c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(body+"\r\n"))
+	}
+	c.Verify("root@nsa.gov")
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Shutdown(context.Background())
+	<-done
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, want := range []string{
+		"# TYPE smtp_connections_total counter\n",
+		"smtp_connections_total 1\n",
+		"smtp_connections_active 0\n",
+		"smtp_memory_bytes 0\n",
+		"smtp_commands_total{verb=\"EHLO\"} 1\n",
+		"smtp_commands_total{verb=\"MAIL\"} 2\n",
+		"smtp_commands_total{verb=\"VRFY\"} 1\n",
+		"smtp_messages_total{result=\"accepted\"} 1\n",
+		"smtp_messages_total{result=\"rejected\"} 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics don't contain %q:\n%v", want, body)
+		}
+	}
+	if strings.Contains(body, "smtp_bytes_total{direction=\"in\"} 0\n") {
+		t.Errorf("No bytes counted:\n%v", body)
+	}
+}
@@ -0,0 +1,331 @@
+package smtpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold = 3
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// Upstream is an upstream server of a Proxy.
+type Upstream struct {
+	// TCP address of the server, e.g. "mx1.internal:25".
+	Addr string
+	// Relative share of the sessions sent to this server. Zero means 1.
+	Weight int
+	// TLS configuration used with STARTTLS. The server name defaults to the
+	// host of Addr.
+	TLSConfig *tls.Config
+	// Whether STARTTLS is used. If zero, TLSDefault is used.
+	TLSPolicy TLSPolicy
+
+	// Credentials to authenticate with, using the PLAIN mechanism. If
+	// Username is empty, the proxy doesn't authenticate. The password is
+	// sent in plaintext unless STARTTLS is used.
+	Username, Password string
+
+	// Methods used to tell the server about the original client. If zero,
+	// ForwardXCLIENT|ForwardReceived is used.
+	Forward ForwardMethod
+}
+
+// TLSPolicy specifies whether STARTTLS is used with an upstream server.
+type TLSPolicy int
+
+const (
+	// STARTTLS is required if TLSConfig is set. Otherwise, the connection is
+	// in plaintext.
+	TLSDefault TLSPolicy = iota
+	// STARTTLS is used if the server supports it.
+	TLSOpportunistic
+	// STARTTLS is required.
+	TLSRequired
+)
+
+// ForwardMethod is a set of methods telling an upstream server about the
+// original client.
+type ForwardMethod int
+
+const (
+	// The XCLIENT command, if the server supports it. The server must trust
+	// the proxy.
+	ForwardXCLIENT ForwardMethod = 1 << iota
+	// The XFORWARD command, if the server supports it and XCLIENT isn't used.
+	// The attributes are sent before each transaction. The server must trust
+	// the proxy.
+	ForwardXFORWARD
+	// A PROXY protocol version 1 header
+	// (https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt), sent
+	// when connecting. Since the server can't advertise support for it, it
+	// must be configured to expect the header.
+	ForwardPROXY
+	// A Received header added to messages, if the other methods can't be
+	// used. Otherwise, connecting to a server which doesn't accept client
+	// information fails.
+	ForwardReceived
+)
+
+// BreakerState is the state of the circuit breaker of an upstream server.
+type BreakerState int
+
+const (
+	// The upstream server is used.
+	BreakerClosed BreakerState = iota
+	// The upstream server failed too many times in a row, and is not used
+	// until the cooldown period is over.
+	BreakerOpen
+	// The cooldown period is over, and the next attempt decides whether the
+	// upstream server is used again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// StickyKey is the property of sessions upstream servers are selected by. See
+// Proxy.Sticky.
+type StickyKey int
+
+const (
+	// Sessions are spread across upstream servers with weighted round-robin.
+	StickyNone StickyKey = iota
+	// Sessions are forwarded according to the MAIL FROM address. The upstream
+	// server is connected to once the sender is known.
+	StickySender
+	// Sessions are forwarded according to the domain of the first recipient
+	// of each transaction. The upstream server is connected to once the
+	// recipient is known, and the MAIL FROM command is sent to it then.
+	StickyRecipientDomain
+	// Sessions are forwarded according to the user name the client
+	// authenticated as with a trusted proxy, see smtp.Conn.ClientLogin.
+	StickyUser
+)
+
+// UpstreamStats describes the state of an upstream server. See Proxy.Stats.
+type UpstreamStats struct {
+	Addr  string
+	State BreakerState
+	// Number of sessions forwarded to the server.
+	Sessions uint64
+	// Number of failed connection attempts and health checks.
+	Failures uint64
+	// Error of the last failed attempt, if any.
+	LastError error
+	// Time of the last health check, if any.
+	LastCheck time.Time
+}
+
+type upstream struct {
+	Upstream
+
+	// Protected by pool.mu
+	current     int // smooth weighted round-robin state
+	state       BreakerState
+	failures    int // consecutive
+	openedAt    time.Time
+	trialActive bool // an attempt is in progress in the half-open state
+	stats       UpstreamStats
+}
+
+func (u *upstream) weight() int {
+	if u.Weight <= 0 {
+		return 1
+	}
+	return u.Weight
+}
+
+// pool selects upstream servers, and keeps track of their health.
+type pool struct {
+	mu        sync.Mutex
+	upstreams []*upstream
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+}
+
+func newPool(upstreams []Upstream, threshold int, cooldown time.Duration) *pool {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	p := &pool{threshold: threshold, cooldown: cooldown, now: time.Now}
+	for _, up := range upstreams {
+		p.upstreams = append(p.upstreams, &upstream{
+			Upstream: up,
+			stats:    UpstreamStats{Addr: up.Addr},
+		})
+	}
+	return p
+}
+
+// available reports whether u may be tried, and reserves the trial of a
+// half-open breaker. The caller must hold p.mu.
+func (p *pool) available(u *upstream) bool {
+	switch u.state {
+	case BreakerOpen:
+		if p.now().Sub(u.openedAt) < p.cooldown {
+			return false
+		}
+		u.state = BreakerHalfOpen
+		fallthrough
+	case BreakerHalfOpen:
+		if u.trialActive {
+			return false
+		}
+		u.trialActive = true
+	}
+	return true
+}
+
+// next returns the upstream servers to try for a new session, in order: the
+// one selected first, then the other available ones for failover. Servers are
+// selected with weighted round-robin, or by consistent hashing of key if it
+// isn't empty.
+func (p *pool) next(key string) []*upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var candidates []*upstream
+	for _, u := range p.upstreams {
+		if p.available(u) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if key != "" {
+		sortByScore(candidates, key)
+		return candidates
+	}
+
+	total, best := 0, 0
+	for i, u := range candidates {
+		u.current += u.weight()
+		total += u.weight()
+		if u.current > candidates[best].current {
+			best = i
+		}
+	}
+	candidates[best].current -= total
+	return append(candidates[best:], candidates[:best]...)
+}
+
+// sortByScore sorts upstream servers by decreasing weighted rendezvous hash
+// score for key. Each key keeps its order of servers as long as they are
+// available, and the keys of a removed server are spread across the others.
+func sortByScore(upstreams []*upstream, key string) {
+	scores := make(map[*upstream]float64, len(upstreams))
+	for _, u := range upstreams {
+		h := fnv.New64a()
+		h.Write([]byte(u.Addr))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		// Map the hash to (0, 1)
+		x := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		scores[u] = -float64(u.weight()) / math.Log(x)
+	}
+	sort.SliceStable(upstreams, func(i, j int) bool {
+		return scores[upstreams[i]] > scores[upstreams[j]]
+	})
+}
+
+// release records the outcome of an attempt with u.
+func (p *pool) release(u *upstream, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	u.trialActive = false
+	if err == nil {
+		u.state = BreakerClosed
+		u.failures = 0
+		return
+	}
+	u.stats.Failures++
+	u.stats.LastError = err
+	u.failures++
+	if u.state == BreakerHalfOpen || u.failures >= p.threshold {
+		u.state = BreakerOpen
+		u.openedAt = p.now()
+	}
+}
+
+// skip releases the reservations of upstream servers which weren't tried.
+func (p *pool) skip(upstreams []*upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, u := range upstreams {
+		u.trialActive = false
+	}
+}
+
+func (p *pool) stats() []UpstreamStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := make([]UpstreamStats, len(p.upstreams))
+	for i, u := range p.upstreams {
+		// Report half-open breakers as soon as the cooldown is over
+		l[i] = u.stats
+		l[i].State = u.state
+		if u.state == BreakerOpen && p.now().Sub(u.openedAt) >= p.cooldown {
+			l[i].State = BreakerHalfOpen
+		}
+	}
+	return l
+}
+
+// check runs a health check of all upstream servers, with EHLO and NOOP.
+func (p *pool) check(ctx context.Context, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		p.mu.Lock()
+		ok := p.available(u)
+		p.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			c, err := dialUpstream(ctx, u, nil)
+			if err == nil {
+				err = c.Noop()
+				if err == nil {
+					err = c.Quit()
+				}
+				c.Close()
+			}
+
+			p.mu.Lock()
+			u.stats.LastCheck = p.now()
+			p.mu.Unlock()
+			p.release(u, err)
+		}(u)
+	}
+	wg.Wait()
+}
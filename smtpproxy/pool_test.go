@@ -0,0 +1,127 @@
+package smtpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPool_weightedRoundRobin(t *testing.T) {
+	p := newPool([]Upstream{{Addr: "a", Weight: 2}, {Addr: "b"}}, 0, 0)
+
+	counts := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		candidates := p.next("")
+		if len(candidates) != 2 {
+			t.Fatalf("next() returned %v candidates, want 2", len(candidates))
+		}
+		counts[candidates[0].Addr]++
+		p.release(candidates[0], nil)
+		p.skip(candidates[1:])
+	}
+	if counts["a"] != 20 || counts["b"] != 10 {
+		t.Errorf("selection counts = %v, want a:20 b:10", counts)
+	}
+}
+
+func TestPool_breaker(t *testing.T) {
+	now := time.Now()
+	p := newPool([]Upstream{{Addr: "a"}, {Addr: "b"}}, 2, time.Minute)
+	p.now = func() time.Time { return now }
+	a := p.upstreams[0]
+	errDown := errors.New("down")
+
+	p.release(a, errDown)
+	if a.state != BreakerClosed {
+		t.Fatalf("breaker opened before the threshold")
+	}
+	p.release(a, errDown)
+	if a.state != BreakerOpen {
+		t.Fatalf("breaker not opened at the threshold")
+	}
+	for i := 0; i < 3; i++ {
+		if candidates := p.next(""); len(candidates) != 1 || candidates[0].Addr != "b" {
+			t.Fatalf("next() = %v, want only b", candidates)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if stats := p.stats(); stats[0].State != BreakerHalfOpen || stats[0].Failures != 2 || stats[0].LastError != errDown {
+		t.Errorf("stats = %+v", stats[0])
+	}
+	candidates := p.next("")
+	if len(candidates) != 2 {
+		t.Fatalf("next() = %v, want a and b once the cooldown is over", candidates)
+	}
+	// Only a single trial is allowed in the half-open state
+	if candidates := p.next(""); len(candidates) != 1 || candidates[0].Addr != "b" {
+		t.Fatalf("next() = %v, want only b during the trial", candidates)
+	}
+	p.release(a, errDown)
+	if a.state != BreakerOpen {
+		t.Fatalf("breaker not opened again after a failed trial")
+	}
+
+	now = now.Add(time.Minute)
+	p.next("")
+	p.release(a, nil)
+	if a.state != BreakerClosed || a.failures != 0 {
+		t.Errorf("breaker not closed after a successful trial")
+	}
+}
+
+func TestPool_check(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := newPool([]Upstream{{Addr: addr}}, 1, time.Minute)
+	p.check(context.Background(), time.Second)
+
+	stats := p.stats()
+	if stats[0].State != BreakerOpen || stats[0].Failures != 1 || stats[0].LastCheck.IsZero() {
+		t.Errorf("stats after a failed health check = %+v", stats[0])
+	}
+}
+
+func TestPool_sticky(t *testing.T) {
+	p := newPool([]Upstream{{Addr: "a"}, {Addr: "b"}, {Addr: "c", Weight: 2}}, 1, time.Minute)
+
+	selected := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user%v@example.org", i)
+		candidates := p.next(key)
+		if len(candidates) != 3 {
+			t.Fatalf("next(%q) returned %v candidates, want 3", key, len(candidates))
+		}
+		p.skip(candidates)
+		selected[key] = candidates[0].Addr
+		counts[candidates[0].Addr]++
+
+		if again := p.next(key); again[0] != candidates[0] {
+			t.Fatalf("next(%q) selected %v, then %v", key, candidates[0].Addr, again[0].Addr)
+		} else {
+			p.skip(again)
+		}
+	}
+	if counts["a"] < 150 || counts["b"] < 150 || counts["c"] < 400 {
+		t.Errorf("selection counts = %v, want about a:250 b:250 c:500", counts)
+	}
+
+	// Only the keys of a failed server move
+	p.release(p.upstreams[0], errors.New("down"))
+	for key, addr := range selected {
+		candidates := p.next(key)
+		p.skip(candidates)
+		if addr != "a" && candidates[0].Addr != addr {
+			t.Errorf("next(%q) moved from %v to %v", key, addr, candidates[0].Addr)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+// Package smtpproxy implements an SMTP proxy, forwarding mail to an upstream
+// server.
+//
+// The proxy tells the upstream server about the original client with the
+// XCLIENT command (https://www.postfix.org/XCLIENT_README.html), so the
+// upstream server must trust the proxy address, e.g. with Postfix's
+// smtpd_authorized_xclient_hosts or go-smtp's Server.XCLIENTTrustedNets. If
+// the upstream server doesn't accept XCLIENT, a Received header describing
+// the client is added to messages instead. XFORWARD and the PROXY protocol can
+// be enabled per upstream server, see Upstream.Forward.
+// Messages are streamed to the upstream server as they are received, without
+// being buffered.
+//
+// A Proxy can itself be placed behind another trusted proxy or load balancer
+// issuing XCLIENT:
+//
+//	p := &smtpproxy.Proxy{
+//		ListenAddr:   ":25",
+//		UpstreamAddr: "mx.internal:25",
+//		TrustedNets:  trusted,
+//	}
+//	log.Fatal(p.ListenAndServe())
+package smtpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Proxy is an SMTP server forwarding mail to an upstream server.
+type Proxy struct {
+	// TCP address to listen on, e.g. ":25".
+	ListenAddr string
+	// TCP address of the upstream server, e.g. "mx.internal:25". Ignored if
+	// Upstreams is set.
+	UpstreamAddr string
+	// Upstream servers. Sessions are spread across them with weighted
+	// round-robin, and fail over to the next one when a server can't be
+	// reached or rejects the session. If empty, UpstreamAddr is used.
+	Upstreams []Upstream
+	// Selects upstream servers by consistent hashing of a property of
+	// sessions instead of round-robin, so that e.g. downstream per-client
+	// rate limits and reputation are stable across a fleet of proxies.
+	Sticky StickyKey
+	// Clients allowed to use XCLIENT with the proxy. Attributes they provide
+	// are forwarded upstream.
+	TrustedNets *smtp.TrustedNets
+
+	// TLS configuration offered to clients with STARTTLS. If nil, STARTTLS
+	// is not offered.
+	TLSConfig *tls.Config
+	// TLS configuration used with STARTTLS for the upstream connection to
+	// UpstreamAddr. If nil, the upstream connection is in plaintext.
+	UpstreamTLSConfig *tls.Config
+
+	// Number of consecutive failures after which an upstream server isn't
+	// used for BreakerCooldown. If zero, 3 is used.
+	BreakerThreshold int
+	// Time during which an upstream server isn't used once its circuit
+	// breaker is open. If zero, 30 seconds is used.
+	BreakerCooldown time.Duration
+	// Interval between health checks of the upstream servers, with EHLO and
+	// NOOP. Failed checks count towards BreakerThreshold. Zero disables
+	// health checks.
+	HealthCheckInterval time.Duration
+
+	// Advertise DSN (RFC 3461) to clients, and forward DSN parameters to
+	// the upstream servers, which must support DSN: the parameters are
+	// rejected otherwise, instead of being dropped.
+	EnableDSN bool
+
+	// Domain name announced to clients.
+	Domain string
+	// Timeout to connect to the upstream server. If zero, 30 seconds is used.
+	DialTimeout time.Duration
+
+	mu     sync.Mutex
+	server *smtp.Server
+	pool   *pool
+	done   chan struct{} // closed to stop health checks
+}
+
+var _ smtp.Backend = (*Proxy)(nil)
+
+// NewServer returns a server accepting connections for the proxy. It can be
+// customized, e.g. to set a logger, before serving.
+func (p *Proxy) NewServer() *smtp.Server {
+	s := smtp.NewServer(p)
+	s.Addr = p.ListenAddr
+	s.Domain = p.Domain
+	s.TLSConfig = p.TLSConfig
+	s.XCLIENTTrustedNets = p.TrustedNets
+	s.EnableDSN = p.EnableDSN
+	// Errors come from the upstream server, or are about it
+	s.ExposeErrors = true
+	return s
+}
+
+// ListenAndServe listens on ListenAddr and serves connections.
+func (p *Proxy) ListenAndServe() error {
+	return p.newServer().ListenAndServe()
+}
+
+// Serve serves connections accepted on l.
+func (p *Proxy) Serve(l net.Listener) error {
+	return p.newServer().Serve(l)
+}
+
+func (p *Proxy) newServer() *smtp.Server {
+	s := p.NewServer()
+	pool := p.getPool()
+
+	p.mu.Lock()
+	p.server = s
+	if p.HealthCheckInterval > 0 && p.done == nil {
+		p.done = make(chan struct{})
+		go p.healthChecks(pool, p.done)
+	}
+	p.mu.Unlock()
+	return s
+}
+
+// Close stops the server started by ListenAndServe or Serve, closes all
+// connections and stops health checks.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	s := p.server
+	if p.done != nil {
+		close(p.done)
+		p.done = nil
+	}
+	p.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.Close()
+}
+
+func (p *Proxy) getPool() *pool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pool == nil {
+		upstreams := p.Upstreams
+		if len(upstreams) == 0 {
+			upstreams = []Upstream{{Addr: p.UpstreamAddr, TLSConfig: p.UpstreamTLSConfig}}
+		}
+		p.pool = newPool(upstreams, p.BreakerThreshold, p.BreakerCooldown)
+	}
+	return p.pool
+}
+
+func (p *Proxy) domain() string {
+	if p.Domain == "" {
+		return "localhost"
+	}
+	return p.Domain
+}
+
+func (p *Proxy) dialTimeout() time.Duration {
+	if p.DialTimeout == 0 {
+		return 30 * time.Second
+	}
+	return p.DialTimeout
+}
+
+func (p *Proxy) healthChecks(pool *pool, done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	ticker := time.NewTicker(p.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pool.check(ctx, p.dialTimeout())
+		case <-done:
+			return
+		}
+	}
+}
+
+// Stats returns the state of the upstream servers, in the order of
+// Upstreams.
+func (p *Proxy) Stats() []UpstreamStats {
+	return p.getPool().stats()
+}
+
+// dial connects to an upstream server on behalf of conn, failing over to the
+// next server on error. The server is selected by key, see pool.next.
+func (p *Proxy) dial(ctx context.Context, conn *smtp.Conn, key string) (*upstreamConn, error) {
+	pool := p.getPool()
+	candidates := pool.next(key)
+	if len(candidates) == 0 {
+		return nil, errors.New("smtpproxy: no upstream server available")
+	}
+
+	var err error
+	for i, u := range candidates {
+		var c *upstreamConn
+		c, err = p.dialUpstream(ctx, u, conn)
+		pool.release(u, err)
+		if err == nil {
+			pool.skip(candidates[i+1:])
+			pool.mu.Lock()
+			u.stats.Sessions++
+			pool.mu.Unlock()
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *Proxy) dialUpstream(ctx context.Context, u *upstream, conn *smtp.Conn) (*upstreamConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.dialTimeout())
+	defer cancel()
+	return dialUpstream(ctx, u, conn)
+}
+
+// NewSession implements smtp.Backend.
+func (p *Proxy) NewSession(conn *smtp.Conn) (smtp.Session, error) {
+	s := &session{proxy: p, conn: conn}
+	var err error
+	switch p.Sticky {
+	case StickySender, StickyRecipientDomain:
+		// Wait for the key to be known
+	case StickyUser:
+		err = s.connect(strings.ToLower(conn.ClientLogin()))
+	default:
+		err = s.connect("")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// upstreamError converts an error returned by the upstream client into an
+// error suitable for the downstream client.
+func upstreamError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var smtpErr *smtp.SMTPError
+	var extErr *smtp.UnsupportedExtensionError
+	var sizeErr *smtp.MessageTooLargeError
+	switch {
+	case errors.As(err, &smtpErr):
+		return err
+	case errors.As(err, &extErr):
+		return &smtp.SMTPError{
+			Code:         555,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+			Message:      "Parameter not supported by upstream server",
+			Err:          err,
+		}
+	case errors.As(err, &sizeErr):
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Message size exceeds upstream server limit",
+			Err:          err,
+		}
+	default:
+		return smtp.TempError(err, 4, 4, 1, "Upstream server unavailable")
+	}
+}
+
+type session struct {
+	proxy  *Proxy
+	conn   *smtp.Conn
+	client *upstreamConn // nil until connected
+	key    string        // sticky key client was selected by
+	broken bool          // set when the upstream connection is in an unknown state
+
+	// MAIL FROM command waiting for the first recipient, with
+	// StickyRecipientDomain
+	pendingMail bool
+	from        string
+	mailOpts    *smtp.MailOptions
+}
+
+var _ smtp.Session = (*session)(nil)
+
+// connect connects to the upstream server selected by key, unless the
+// current connection was already selected by the same key.
+func (s *session) connect(key string) error {
+	if s.client != nil {
+		if key == s.key && !s.broken {
+			return nil
+		}
+		s.close()
+	}
+
+	c, err := s.proxy.dial(context.Background(), s.conn, key)
+	if err != nil {
+		return upstreamError(err)
+	}
+	s.client, s.key, s.broken = c, key, false
+	return nil
+}
+
+func (s *session) close() error {
+	c := s.client
+	s.client = nil
+	if s.broken {
+		return c.Close()
+	}
+	if err := c.Quit(); err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *session) Reset() {
+	s.pendingMail = false
+	if s.client != nil && !s.broken {
+		s.client.Reset()
+	}
+}
+
+func (s *session) Logout() error {
+	if s.client == nil {
+		return nil
+	}
+	return s.close()
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	switch s.proxy.Sticky {
+	case StickySender:
+		if err := s.connect(strings.ToLower(from)); err != nil {
+			return err
+		}
+	case StickyRecipientDomain:
+		s.pendingMail, s.from, s.mailOpts = true, from, opts
+		return nil
+	}
+	if s.broken {
+		return errUpstreamBroken
+	}
+	return upstreamError(s.client.mail(from, opts))
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if s.pendingMail {
+		domain := to[strings.LastIndexByte(to, '@')+1:]
+		if err := s.connect(strings.ToLower(domain)); err != nil {
+			return err
+		}
+		if err := s.client.mail(s.from, s.mailOpts); err != nil {
+			return upstreamError(err)
+		}
+		s.pendingMail = false
+	}
+	if s.broken {
+		return errUpstreamBroken
+	}
+	return upstreamError(s.client.Rcpt(to, opts))
+}
+
+func (s *session) Data(r io.Reader) error {
+	if s.broken {
+		return errUpstreamBroken
+	}
+	w, err := s.client.Data()
+	if err != nil {
+		return upstreamError(err)
+	}
+	if s.client.received {
+		r = io.MultiReader(strings.NewReader(receivedHeader(s.conn, s.proxy.domain(), time.Now())), r)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		// Closing w would deliver a truncated message
+		s.broken = true
+		s.client.Close()
+		return err
+	}
+	return upstreamError(w.Close())
+}
+
+var errUpstreamBroken = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+	Message:      "Upstream connection lost",
+}
@@ -0,0 +1,560 @@
+package smtpproxy_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtpproxy"
+)
+
+type message struct {
+	clientAddr, helo string
+	user             string
+	xclient          *smtp.XCLIENTData
+	from             string
+	to               []string
+	data             string
+	mailOpts         *smtp.MailOptions
+	rcptOpts         []*smtp.RcptOptions
+}
+
+type session struct {
+	conn *smtp.Conn
+	user string
+	msg  *message
+	msgs chan<- *message
+}
+
+func (s *session) Reset()        {}
+func (s *session) Logout() error { return nil }
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.msg = &message{
+		clientAddr: s.conn.ClientAddr().String(),
+		helo:       s.conn.Hostname(),
+		user:       s.user,
+		xclient:    s.conn.XCLIENTData(),
+		from:       from,
+		mailOpts:   opts,
+	}
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if to == "nobody@example.org" {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	s.msg.to = append(s.msg.to, to)
+	s.msg.rcptOpts = append(s.msg.rcptOpts, opts)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.data = string(b)
+	s.msgs <- s.msg
+	return nil
+}
+
+type authSession struct {
+	*session
+}
+
+func (s authSession) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+func (s authSession) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if username != "proxy" || password != "hunter2" {
+			return errors.New("Invalid credentials")
+		}
+		s.user = username
+		return nil
+	}), nil
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestProxy(t *testing.T) {
+	trusted, err := smtp.ParseTrustedNets("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make(chan *message, 1)
+	upstream := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &session{conn: c, msgs: msgs}, nil
+	}))
+	upstream.Domain = "upstream"
+	upstream.XCLIENTTrustedNets = trusted
+	upstreamListener := listen(t)
+	go upstream.Serve(upstreamListener)
+	defer upstream.Close()
+
+	p := &smtpproxy.Proxy{
+		UpstreamAddr: upstreamListener.Addr().String(),
+		TrustedNets:  trusted,
+		Domain:       "proxy",
+	}
+	proxyListener := listen(t)
+	go p.Serve(proxyListener)
+	defer p.Close()
+
+	c, err := smtp.Dial(proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Act as a trusted load balancer in front of the proxy
+	attrs := map[string]string{
+		"ADDR":     "192.0.2.1",
+		"PORT":     "4242",
+		"HELO":     "mx.example.org",
+		"DESTADDR": "192.0.2.25",
+		"DESTPORT": "465",
+		"TLS":      "TLS 1.3",
+		"CIPHER":   "TLS_AES_128_GCM_SHA256",
+	}
+	if err := c.XCLIENT(attrs); err != nil {
+		t.Fatalf("XCLIENT() = %v", err)
+	}
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	err = c.Rcpt("nobody@example.org", nil)
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 || smtpErr.Message != "No such user" {
+		t.Errorf("Rcpt() = %v, want the upstream error", err)
+	}
+	if err := c.Rcpt("root@gchq.gov.uk", nil); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+	io.WriteString(w, "Hey <3\r\n.dot\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit() = %v", err)
+	}
+
+	msg := <-msgs
+	if msg.clientAddr != "192.0.2.1:4242" {
+		t.Errorf("upstream client address = %v, want 192.0.2.1:4242", msg.clientAddr)
+	}
+	if msg.helo != "mx.example.org" {
+		t.Errorf("upstream HELO = %v, want mx.example.org", msg.helo)
+	}
+	if msg.xclient == nil || msg.xclient.DestAddr == nil || msg.xclient.DestAddr.String() != "192.0.2.25:465" {
+		t.Errorf("upstream XCLIENTData() = %+v, want destination 192.0.2.25:465", msg.xclient)
+	} else if msg.xclient.TLSVersion != "TLS 1.3" || msg.xclient.TLSCipher != "TLS_AES_128_GCM_SHA256" {
+		t.Errorf("upstream XCLIENTData() = %+v, want the TLS attributes", msg.xclient)
+	}
+	if msg.from != "root@nsa.gov" || strings.Join(msg.to, ",") != "root@gchq.gov.uk" {
+		t.Errorf("upstream envelope = %v -> %v", msg.from, msg.to)
+	}
+	if want := "Hey <3\r\n.dot\r\n"; msg.data != want {
+		t.Errorf("upstream data = %q, want %q", msg.data, want)
+	}
+}
+
+func TestProxy_untrustedUpstream(t *testing.T) {
+	upstream := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &session{conn: c}, nil
+	}))
+	upstream.Domain = "upstream"
+	upstreamListener := listen(t)
+	go upstream.Serve(upstreamListener)
+	defer upstream.Close()
+
+	p := &smtpproxy.Proxy{
+		Upstreams: []smtpproxy.Upstream{{
+			Addr:    upstreamListener.Addr().String(),
+			Forward: smtpproxy.ForwardXCLIENT,
+		}},
+		Domain: "proxy",
+	}
+	proxyListener := listen(t)
+	go p.Serve(proxyListener)
+	defer p.Close()
+
+	c, err := smtp.Dial(proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Hello("localhost")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Errorf("Hello() = %v, want a 451 error", err)
+	}
+}
+
+func TestProxy_failover(t *testing.T) {
+	trusted, err := smtp.ParseTrustedNets("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &session{conn: c}, nil
+	}))
+	upstream.Domain = "upstream"
+	upstream.XCLIENTTrustedNets = trusted
+	upstreamListener := listen(t)
+	go upstream.Serve(upstreamListener)
+	defer upstream.Close()
+
+	deadListener := listen(t)
+	deadAddr := deadListener.Addr().String()
+	deadListener.Close()
+
+	p := &smtpproxy.Proxy{
+		Upstreams: []smtpproxy.Upstream{
+			{Addr: deadAddr, Weight: 10},
+			{Addr: upstreamListener.Addr().String()},
+		},
+		BreakerThreshold: 1,
+		Domain:           "proxy",
+	}
+	proxyListener := listen(t)
+	go p.Serve(proxyListener)
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := smtp.Dial(proxyListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello("localhost"); err != nil {
+			t.Fatalf("Hello() = %v", err)
+		}
+		if err := c.Quit(); err != nil {
+			t.Fatalf("Quit() = %v", err)
+		}
+	}
+
+	stats := p.Stats()
+	if stats[0].State != smtpproxy.BreakerOpen || stats[0].Failures != 1 || stats[0].Sessions != 0 {
+		t.Errorf("dead upstream stats = %+v", stats[0])
+	}
+	if stats[1].State != smtpproxy.BreakerClosed || stats[1].Sessions != 2 {
+		t.Errorf("live upstream stats = %+v", stats[1])
+	}
+}
+
+func TestProxy_stickyRecipientDomain(t *testing.T) {
+	trusted, err := smtp.ParseTrustedNets("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var upstreams []smtpproxy.Upstream
+	msgs := make(chan *message, 10)
+	for i := 0; i < 3; i++ {
+		l := listen(t)
+		addr := l.Addr().String()
+		upstream := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			return &session{conn: c, msgs: msgs}, nil
+		}))
+		upstream.Domain = addr
+		upstream.XCLIENTTrustedNets = trusted
+		go upstream.Serve(l)
+		defer upstream.Close()
+		upstreams = append(upstreams, smtpproxy.Upstream{Addr: addr})
+	}
+
+	p := &smtpproxy.Proxy{
+		Upstreams: upstreams,
+		Sticky:    smtpproxy.StickyRecipientDomain,
+		Domain:    "proxy",
+	}
+	proxyListener := listen(t)
+	go p.Serve(proxyListener)
+	defer p.Close()
+
+	for i := 0; i < 5; i++ {
+		from, to := fmt.Sprintf("user%v@example.com", i), "root@example.org"
+		c, err := smtp.Dial(proxyListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SendMail(from, []string{to}, strings.NewReader("Hey <3\r\n")); err != nil {
+			t.Fatalf("SendMail() = %v", err)
+		}
+		c.Quit()
+		msg := <-msgs
+		if msg.from != from || len(msg.to) != 1 || msg.to[0] != to {
+			t.Fatalf("Invalid message: %+v", msg)
+		}
+	}
+
+	var sessions []uint64
+	for _, stats := range p.Stats() {
+		sessions = append(sessions, stats.Sessions)
+		if stats.Sessions == 5 {
+			return
+		}
+	}
+	t.Errorf("Messages to a single domain were spread across upstream servers: %v", sessions)
+}
+
+// sendMail sends a message through the proxy listening on addr.
+func sendMail(t *testing.T, addr string) {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	c.Quit()
+}
+
+func TestProxy_receivedFallback(t *testing.T) {
+	msgs := make(chan *message, 1)
+	upstream := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return authSession{&session{conn: c, msgs: msgs}}, nil
+	}))
+	upstream.Domain = "upstream"
+	upstream.AllowInsecureAuth = true
+	upstreamListener := listen(t)
+	go upstream.Serve(upstreamListener)
+	defer upstream.Close()
+
+	p := &smtpproxy.Proxy{
+		Upstreams: []smtpproxy.Upstream{{
+			Addr:     upstreamListener.Addr().String(),
+			Username: "proxy",
+			Password: "hunter2",
+		}},
+		Domain: "proxy",
+	}
+	proxyListener := listen(t)
+	go p.Serve(proxyListener)
+	defer p.Close()
+
+	sendMail(t, proxyListener.Addr().String())
+
+	msg := <-msgs
+	if msg.user != "proxy" {
+		t.Errorf("upstream user = %q, want %q", msg.user, "proxy")
+	}
+	if want := "Received: from localhost ([127.0.0.1])\r\n\tby proxy with ESMTP;\r\n\t"; !strings.HasPrefix(msg.data, want) {
+		t.Errorf("upstream data = %q, want prefix %q", msg.data, want)
+	}
+	if !strings.HasSuffix(msg.data, "\r\nHey <3\r\n") {
+		t.Errorf("upstream data = %q, want the original message", msg.data)
+	}
+}
+
+func TestProxy_receivedTLS(t *testing.T) {
+	msgs := make(chan *message, 1)
+	upstream := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &session{conn: c, msgs: msgs}, nil
+	}))
+	upstream.Domain = "upstream"
+	upstreamListener := listen(t)
+	go upstream.Serve(upstreamListener)
+	defer upstream.Close()
+
+	trusted, err := smtp.ParseTrustedNets("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &smtpproxy.Proxy{
+		UpstreamAddr: upstreamListener.Addr().String(),
+		TrustedNets:  trusted,
+		Domain:       "proxy",
+	}
+	proxyListener := listen(t)
+	go p.Serve(proxyListener)
+	defer p.Close()
+
+	c, err := smtp.Dial(proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A load balancer terminating TLS in front of the proxy
+	if err := c.XCLIENT(map[string]string{"ADDR": "192.0.2.1", "TLS": "TLS 1.3", "CIPHER": "TLS_AES_128_GCM_SHA256"}); err != nil {
+		t.Fatalf("XCLIENT() = %v", err)
+	}
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	msg := <-msgs
+	want := "Received: from localhost ([192.0.2.1])\r\n\t(via [127.0.0.1])\r\n\t(using TLS 1.3 with cipher TLS_AES_128_GCM_SHA256)\r\n\tby proxy with ESMTPS;\r\n\t"
+	if !strings.HasPrefix(msg.data, want) {
+		t.Errorf("upstream data = %q, want prefix %q", msg.data, want)
+	}
+}
+
+func TestProxy_dsn(t *testing.T) {
+	msgs := make(chan *message, 1)
+	upstream := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &session{conn: c, msgs: msgs}, nil
+	}))
+	upstream.Domain = "upstream"
+	upstream.EnableDSN = true
+	upstreamListener := listen(t)
+	go upstream.Serve(upstreamListener)
+	defer upstream.Close()
+
+	p := &smtpproxy.Proxy{
+		UpstreamAddr: upstreamListener.Addr().String(),
+		EnableDSN:    true,
+		Domain:       "proxy",
+	}
+	proxyListener := listen(t)
+	go p.Serve(proxyListener)
+	defer p.Close()
+
+	c, err := smtp.Dial(proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	mailOpts := &smtp.MailOptions{Return: smtp.DSNReturnHeaders, EnvelopeID: "QQ314159"}
+	if err := c.Mail("root@nsa.gov", mailOpts); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	rcptOpts := &smtp.RcptOptions{
+		Notify:                []smtp.DSNNotify{smtp.DSNNotifyFailure},
+		OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+		OriginalRecipient:     "postmaster@example.org",
+	}
+	if err := c.Rcpt("root@gchq.gov.uk", rcptOpts); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+	io.WriteString(w, "Hey <3\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data().Close() = %v", err)
+	}
+
+	msg := <-msgs
+	if msg.mailOpts.Return != mailOpts.Return || msg.mailOpts.EnvelopeID != mailOpts.EnvelopeID {
+		t.Errorf("upstream MAIL options = %+v, want %+v", msg.mailOpts, mailOpts)
+	}
+	if len(msg.rcptOpts) != 1 || !reflect.DeepEqual(msg.rcptOpts[0], rcptOpts) {
+		t.Errorf("upstream RCPT options = %+v, want %+v", msg.rcptOpts, rcptOpts)
+	}
+}
+
+func TestProxy_dsnUnsupported(t *testing.T) {
+	upstream := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &session{conn: c}, nil
+	}))
+	upstream.Domain = "upstream"
+	upstreamListener := listen(t)
+	go upstream.Serve(upstreamListener)
+	defer upstream.Close()
+
+	p := &smtpproxy.Proxy{
+		UpstreamAddr: upstreamListener.Addr().String(),
+		EnableDSN:    true,
+		Domain:       "proxy",
+	}
+	proxyListener := listen(t)
+	go p.Serve(proxyListener)
+	defer p.Close()
+
+	c, err := smtp.Dial(proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Mail("root@nsa.gov", &smtp.MailOptions{EnvelopeID: "QQ314159"})
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 555 {
+		t.Errorf("Mail() = %v, want a 555 error", err)
+	}
+}
+
+// proxyProtocolListener reads the PROXY protocol header of accepted
+// connections.
+type proxyProtocolListener struct {
+	net.Listener
+	headers chan string
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// Read byte by byte, to leave the rest to the server
+	var header []byte
+	b := make([]byte, 1)
+	for len(header) == 0 || header[len(header)-1] != '\n' {
+		if _, err := conn.Read(b); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		header = append(header, b[0])
+	}
+	l.headers <- string(header)
+	return conn, nil
+}
+
+func TestProxy_proxyProtocol(t *testing.T) {
+	msgs := make(chan *message, 1)
+	upstream := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &session{conn: c, msgs: msgs}, nil
+	}))
+	upstream.Domain = "upstream"
+	upstreamListener := proxyProtocolListener{listen(t), make(chan string, 1)}
+	go upstream.Serve(upstreamListener)
+	defer upstream.Close()
+
+	p := &smtpproxy.Proxy{
+		Upstreams: []smtpproxy.Upstream{{
+			Addr:    upstreamListener.Addr().String(),
+			Forward: smtpproxy.ForwardPROXY,
+		}},
+		Domain: "proxy",
+	}
+	proxyListener := listen(t)
+	go p.Serve(proxyListener)
+	defer p.Close()
+
+	sendMail(t, proxyListener.Addr().String())
+
+	header := <-upstreamListener.headers
+	_, proxyPort, _ := net.SplitHostPort(proxyListener.Addr().String())
+	if !strings.HasPrefix(header, "PROXY TCP4 127.0.0.1 127.0.0.1 ") || !strings.HasSuffix(header, " "+proxyPort+"\r\n") {
+		t.Errorf("PROXY header = %q", header)
+	}
+	if msg := <-msgs; strings.Contains(msg.data, "Received:") {
+		t.Errorf("upstream data = %q, want no Received header", msg.data)
+	}
+}
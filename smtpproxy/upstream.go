@@ -0,0 +1,292 @@
+package smtpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// upstreamConn is a connection to an upstream server.
+type upstreamConn struct {
+	*smtp.Client
+
+	// XFORWARD attributes to send before each transaction, if any
+	xforward map[string]string
+	// Whether to add a Received header to messages
+	received bool
+}
+
+// mail starts a transaction.
+func (uc *upstreamConn) mail(from string, opts *smtp.MailOptions) error {
+	if uc.xforward != nil {
+		if err := uc.XFORWARD(uc.xforward); err != nil {
+			return err
+		}
+	}
+	return uc.Mail(from, opts)
+}
+
+// dialUpstream connects to an upstream server, and tells it about the client
+// of conn. If conn is nil, e.g. for health checks, no client information is
+// forwarded.
+func dialUpstream(ctx context.Context, u *upstream, conn *smtp.Conn) (*upstreamConn, error) {
+	var dialer net.Dialer
+	nc, err := dialer.DialContext(ctx, "tcp", u.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Interrupt the session setup when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		nc.Close()
+	})
+	uc, err := setupUpstream(u, nc, conn)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return uc, nil
+}
+
+func setupUpstream(u *upstream, nc net.Conn, conn *smtp.Conn) (*upstreamConn, error) {
+	methods := u.Forward
+	if methods == 0 {
+		methods = ForwardXCLIENT | ForwardReceived
+	}
+
+	if methods&ForwardPROXY != 0 {
+		if _, err := io.WriteString(nc, proxyHeader(conn)); err != nil {
+			return nil, err
+		}
+	}
+
+	c := smtp.NewClient(nc)
+	if err := c.Hello("localhost"); err != nil {
+		return nil, err
+	}
+	if err := startTLS(c, u); err != nil {
+		return nil, err
+	}
+
+	uc := &upstreamConn{Client: c}
+	if conn != nil {
+		if err := uc.forward(conn, methods); err != nil {
+			return nil, err
+		}
+	}
+
+	// XCLIENT resets the session, so authenticate last
+	if u.Username != "" {
+		if err := c.Auth(sasl.NewPlainClient("", u.Username, u.Password)); err != nil {
+			return nil, err
+		}
+	}
+	return uc, nil
+}
+
+// startTLS upgrades the connection to c according to the TLS policy of u.
+func startTLS(c *smtp.Client, u *upstream) error {
+	policy := u.TLSPolicy
+	if policy == TLSDefault {
+		if u.TLSConfig == nil {
+			return nil
+		}
+		policy = TLSRequired
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if policy == TLSOpportunistic {
+			return nil
+		}
+		return errors.New("smtpproxy: upstream server doesn't support STARTTLS")
+	}
+
+	tlsConfig := u.TLSConfig
+	if tlsConfig == nil || tlsConfig.ServerName == "" {
+		host, _, _ := net.SplitHostPort(u.Addr)
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		tlsConfig.ServerName = host
+	}
+	return c.StartTLS(tlsConfig)
+}
+
+// forward tells the upstream server about the client of conn, with the first
+// of methods it supports.
+func (uc *upstreamConn) forward(conn *smtp.Conn, methods ForwardMethod) error {
+	attrs := clientAttrs(conn)
+	if methods&ForwardXCLIENT != 0 {
+		if xclient := supportedAttrs(attrs, uc.XCLIENTAttributes()); len(xclient) > 0 {
+			return uc.XCLIENT(xclient)
+		}
+	}
+	if methods&ForwardXFORWARD != 0 {
+		if xforward := supportedAttrs(attrs, uc.XFORWARDAttributes()); len(xforward) > 0 {
+			uc.xforward = xforward
+			return nil
+		}
+	}
+	switch {
+	case methods&ForwardPROXY != 0:
+		return nil
+	case methods&ForwardReceived != 0:
+		uc.received = true
+		return nil
+	default:
+		return errors.New("smtpproxy: upstream server doesn't accept client information")
+	}
+}
+
+// clientAttrs returns the XCLIENT and XFORWARD attributes describing the
+// client of conn.
+func clientAttrs(conn *smtp.Conn) map[string]string {
+	attrs := map[string]string{
+		"NAME":   conn.ClientName(),
+		"HELO":   conn.Hostname(),
+		"LOGIN":  conn.ClientLogin(),
+		"SOURCE": "REMOTE",
+	}
+	if addr, ok := conn.ClientAddr().(*net.TCPAddr); ok {
+		attrs["ADDR"], attrs["PORT"] = addrAttrs(addr)
+	}
+	if addr, ok := destAddr(conn).(*net.TCPAddr); ok {
+		attrs["DESTADDR"], attrs["DESTPORT"] = addrAttrs(addr)
+	}
+	if version, cipher := clientTLS(conn); version != "" {
+		attrs["TLS"], attrs["CIPHER"] = version, cipher
+	}
+	return attrs
+}
+
+// addrAttrs formats addr as the values of ADDR and PORT attributes.
+func addrAttrs(addr *net.TCPAddr) (ip, port string) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		ip = ip4.String()
+	} else {
+		ip = "IPV6:" + addr.IP.String()
+	}
+	return ip, strconv.Itoa(addr.Port)
+}
+
+// destAddr returns the address the client of conn connected to, as given by
+// a trusted proxy with XCLIENT if any.
+func destAddr(conn *smtp.Conn) net.Addr {
+	if data := conn.XCLIENTData(); data != nil && data.DestAddr != nil {
+		return data.DestAddr
+	}
+	return conn.Conn().LocalAddr()
+}
+
+// clientTLS returns the TLS version and cipher suite used by the client of
+// conn, as given by a trusted proxy with XCLIENT if any. The version is empty
+// if the client doesn't use TLS.
+func clientTLS(conn *smtp.Conn) (version, cipher string) {
+	if state, ok := conn.TLSConnectionState(); ok {
+		return tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)
+	}
+	if data := conn.XCLIENTData(); data != nil {
+		return data.TLSVersion, data.TLSCipher
+	}
+	return "", ""
+}
+
+// supportedAttrs returns the attributes advertised by the upstream server.
+func supportedAttrs(attrs map[string]string, supported []string) map[string]string {
+	out := make(map[string]string)
+	for _, name := range supported {
+		if value, ok := attrs[name]; ok {
+			out[name] = value
+		}
+	}
+	return out
+}
+
+// proxyHeader returns the PROXY protocol version 1 header describing the
+// connection of conn.
+func proxyHeader(conn *smtp.Conn) string {
+	if conn == nil {
+		return "PROXY UNKNOWN\r\n"
+	}
+	src, ok1 := conn.ClientAddr().(*net.TCPAddr)
+	dst, ok2 := destAddr(conn).(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return "PROXY UNKNOWN\r\n"
+	}
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	proto := "TCP4"
+	if srcIP == nil || dstIP == nil {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		proto = "TCP6"
+	}
+	return fmt.Sprintf("PROXY %v %v %v %v %v\r\n", proto, srcIP, dstIP, src.Port, dst.Port)
+}
+
+// receivedHeader returns a Received header field describing the client of
+// conn, as defined in RFC 5321 section 4.4.
+func receivedHeader(conn *smtp.Conn, domain string, now time.Time) string {
+	var info []string
+	if name := conn.ClientName(); name != "" {
+		info = append(info, name)
+	}
+	if addr, ok := conn.ClientAddr().(*net.TCPAddr); ok {
+		info = append(info, addressLiteral(addr))
+	}
+
+	proto := "ESMTP"
+	version, cipher := clientTLS(conn)
+	if version != "" {
+		proto += "S"
+	}
+	if conn.ClientLogin() != "" {
+		proto += "A"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Received: from %v", conn.Hostname())
+	if len(info) > 0 {
+		fmt.Fprintf(&sb, " (%v)", strings.Join(info, " "))
+	}
+	// Proxies the client went through, the last one being the proxy peer
+	var via []string
+	for _, hop := range conn.ProxyChain()[1:] {
+		if addr, ok := hop.Addr.(*net.TCPAddr); ok {
+			via = append(via, addressLiteral(addr))
+		}
+	}
+	if len(via) > 0 {
+		fmt.Fprintf(&sb, "\r\n\t(via %v)", strings.Join(via, " "))
+	}
+	if version != "" {
+		fmt.Fprintf(&sb, "\r\n\t(using %v", version)
+		if cipher != "" {
+			fmt.Fprintf(&sb, " with cipher %v", cipher)
+		}
+		sb.WriteString(")")
+	}
+	fmt.Fprintf(&sb, "\r\n\tby %v with %v;\r\n\t%v\r\n", domain, proto, now.Format(time.RFC1123Z))
+	return sb.String()
+}
+
+// addressLiteral formats addr as an address literal, as defined in RFC 5321
+// section 4.1.3.
+func addressLiteral(addr *net.TCPAddr) string {
+	if ip := addr.IP.To4(); ip != nil {
+		return "[" + ip.String() + "]"
+	}
+	return "[IPv6:" + addr.IP.String() + "]"
+}
@@ -0,0 +1,244 @@
+package smtpqueue
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	// ErrNotFound is returned when a message isn't in the queue.
+	ErrNotFound = errors.New("smtpqueue: message not found")
+	// ErrDeliveryInProgress is returned by Queue.Cancel when a delivery
+	// attempt of the message is running.
+	ErrDeliveryInProgress = errors.New("smtpqueue: delivery attempt in progress")
+)
+
+// Filter selects queued messages. The zero value selects all messages.
+type Filter struct {
+	// Only select messages with a recipient at this destination, the
+	// recipient domain or Queue.Relay, and with this status.
+	Destination string
+	Status      RecipientStatus
+	// Only select messages queued for at least this long.
+	MinAge time.Duration
+}
+
+func (q *Queue) match(msg *Message, filter *Filter) bool {
+	if filter.MinAge > 0 && q.now().Sub(msg.CreatedAt) < filter.MinAge {
+		return false
+	}
+	if filter.Destination == "" && filter.Status == "" {
+		return true
+	}
+	for _, rcpt := range msg.Recipients {
+		if filter.Destination != "" && !strings.EqualFold(q.destination(rcpt), filter.Destination) {
+			continue
+		}
+		if filter.Status != "" && rcpt.Status != filter.Status {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// copyMessage returns a copy of msg, which isn't modified by the queue.
+func copyMessage(msg *Message) *Message {
+	out := *msg
+	out.Recipients = make([]*Recipient, len(msg.Recipients))
+	for i, rcpt := range msg.Recipients {
+		rcptCopy := *rcpt
+		out.Recipients[i] = &rcptCopy
+	}
+	return &out
+}
+
+// Messages returns a snapshot of the queued messages selected by filter,
+// oldest first. If filter is nil, all messages are returned.
+//
+// Messages stored before Run is called are only listed once Run has loaded
+// them.
+func (q *Queue) Messages(filter *Filter) []*Message {
+	if filter == nil {
+		filter = &Filter{}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.init()
+
+	var msgs []*Message
+	for _, msg := range q.msgs {
+		if q.match(msg, filter) {
+			msgs = append(msgs, copyMessage(msg))
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].CreatedAt.Before(msgs[j].CreatedAt)
+	})
+	return msgs
+}
+
+// Message returns a snapshot of a queued message.
+func (q *Queue) Message(id string) (*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, err := q.get(id)
+	if err != nil {
+		return nil, err
+	}
+	return copyMessage(msg), nil
+}
+
+// get returns a queued message. The caller must hold q.mu.
+func (q *Queue) get(id string) (*Message, error) {
+	q.init()
+	msg, ok := q.msgs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return msg, nil
+}
+
+// update persists a change made by an administrative action to msg. The
+// caller must hold q.mu.
+func (q *Queue) update(msg *Message, action string) error {
+	if err := q.Store.Update(msg); err != nil {
+		return err
+	}
+	q.log(slog.LevelInfo, action, slog.String("id", msg.ID))
+	return nil
+}
+
+// Retry schedules an immediate delivery attempt for the pending recipients
+// of a message. A held message is attempted once released.
+func (q *Queue) Retry(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, err := q.get(id)
+	if err != nil {
+		return err
+	}
+	now := q.now()
+	for _, rcpt := range msg.pending() {
+		rcpt.NextAttempt = now
+	}
+	if err := q.update(msg, "message retry forced"); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Hold suspends the delivery of a message until Release is called. A
+// delivery attempt already running isn't interrupted.
+func (q *Queue) Hold(id string) error {
+	return q.setHeld(id, true, "message held")
+}
+
+// Release resumes the delivery of a message suspended by Hold. Recipients
+// due while the message was held are attempted immediately.
+func (q *Queue) Release(id string) error {
+	return q.setHeld(id, false, "message released")
+}
+
+func (q *Queue) setHeld(id string, held bool, action string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, err := q.get(id)
+	if err != nil {
+		return err
+	}
+	if msg.Held == held {
+		return nil
+	}
+	msg.Held = held
+	if err := q.update(msg, action); err != nil {
+		msg.Held = !held
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// SetPriority changes the priority of a message, from -9 (lowest) to 9
+// (highest). It's sent with the MT-PRIORITY parameter to servers supporting
+// it, as defined in RFC 6710.
+func (q *Queue) SetPriority(id string, priority int) error {
+	if priority < minPriority || priority > maxPriority {
+		return fmt.Errorf("smtpqueue: priority must be between %v and %v", minPriority, maxPriority)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, err := q.get(id)
+	if err != nil {
+		return err
+	}
+	prev := msg.MailOptions
+	// The options may be shared with the session which queued the message
+	opts := &smtp.MailOptions{}
+	if prev != nil {
+		*opts = *prev
+	}
+	opts.MTPriority = &priority
+	msg.MailOptions = opts
+	if err := q.update(msg, "message priority changed"); err != nil {
+		msg.MailOptions = prev
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Cancel fails the pending recipients of a message and removes it from the
+// queue. The sender is notified as for other failures.
+//
+// ErrDeliveryInProgress is returned if a delivery attempt of the message is
+// running: its recipients may be delivered already.
+func (q *Queue) Cancel(id string) error {
+	q.mu.Lock()
+	msg, err := q.get(id)
+	if err != nil {
+		q.mu.Unlock()
+		return err
+	}
+	for key := range q.inflight {
+		if strings.HasPrefix(key, id+"\x00") {
+			q.mu.Unlock()
+			return ErrDeliveryInProgress
+		}
+	}
+
+	failed := msg.pending()
+	for _, rcpt := range failed {
+		rcpt.Status = StatusFailed
+		rcpt.NextAttempt = time.Time{}
+		rcpt.Code, rcpt.EnhancedCode, rcpt.Error = 0, smtp.EnhancedCode{5, 0, 0}, "delivery cancelled"
+		q.recordEvent(&Event{
+			Type:         EventBounced,
+			MessageID:    id,
+			Recipient:    rcpt.Addr,
+			EnhancedCode: rcpt.EnhancedCode,
+			Error:        rcpt.Error,
+		})
+	}
+	q.log(slog.LevelInfo, "message cancelled",
+		slog.String("id", id),
+		slog.Int("recipients", len(failed)))
+	dsn := q.commit(msg, failed)
+	q.mu.Unlock()
+
+	q.sendDSN(msg, dsn)
+	return nil
+}
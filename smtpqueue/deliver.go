@@ -0,0 +1,431 @@
+package smtpqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtptlsrpt"
+)
+
+// outbound is a connection to a destination, reused by the delivery
+// attempts of a session.
+type outbound struct {
+	c    *smtp.Client // nil if not connected
+	host string
+	tls  *smtp.TLSVerification // outcome of the last certificate verification
+	msgs int                   // number of messages sent
+}
+
+// close closes the connection, e.g. after an error leaving it in an unknown
+// state.
+func (o *outbound) close() {
+	if o.c != nil {
+		o.c.Close()
+		o.c = nil
+	}
+}
+
+// quit ends the session.
+func (o *outbound) quit() {
+	if o.c != nil {
+		o.c.Quit()
+		o.close()
+	}
+}
+
+// reset aborts the current mail transaction, to reuse the connection. The
+// connection is closed if err left it unusable.
+func (o *outbound) reset(err error) {
+	var smtpErr *smtp.SMTPError
+	if o.c == nil || !errors.As(err, &smtpErr) || smtpErr.Code == 421 || o.c.Reset() != nil {
+		o.close()
+	}
+}
+
+// send makes a delivery attempt of msg to rcpts, which share a destination,
+// over conn. It connects if conn isn't connected yet. It returns the address
+// of the server connected to, if any, and one error per recipient.
+func (q *Queue) send(ctx context.Context, conn *outbound, msg *Message, rcpts []*Recipient) (host string, errs []error) {
+	errs = make([]error, len(rcpts))
+	fail := func(err error) (string, []error) {
+		conn.reset(err)
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return host, errs
+	}
+
+	reused := conn.c != nil
+	if !reused {
+		c, host, v, err := q.connect(ctx, rcpts[0].Domain())
+		conn.tls = v
+		if err != nil {
+			return fail(err)
+		}
+		conn.c, conn.host = c, host
+	}
+	c, host := conn.c, conn.host
+
+	from := msg.From
+	if q.SignSender != nil && from != "" {
+		var err error
+		if from, err = q.SignSender(from); err != nil {
+			return fail(err)
+		}
+	}
+
+	body, err := q.Store.Open(msg.ID)
+	if err != nil {
+		return fail(err)
+	}
+	defer body.Close()
+
+	err = c.MailContext(ctx, from, mailOptions(c, msg.MailOptions))
+	var smtpErr *smtp.SMTPError
+	if reused && err != nil && (!errors.As(err, &smtpErr) || smtpErr.Code == 421) {
+		// The server may have closed the connection in the meantime, e.g.
+		// because of a limit of messages per connection
+		conn.close()
+		if c, host, conn.tls, err = q.connect(ctx, rcpts[0].Domain()); err != nil {
+			return fail(err)
+		}
+		conn.c, conn.host = c, host
+		err = c.MailContext(ctx, from, mailOptions(c, msg.MailOptions))
+	}
+	if err != nil {
+		return fail(err)
+	}
+	accepted := 0
+	for i, rcpt := range rcpts {
+		if errs[i] = c.RcptContext(ctx, rcpt.Addr, rcptOptions(c, rcpt.Options)); errs[i] == nil {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		conn.reset(errs[len(errs)-1])
+		return host, errs
+	}
+
+	w, err := c.DataContext(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		// Closing w would deliver a truncated message
+		conn.close()
+		return fail(err)
+	}
+	if err := w.Close(); err != nil {
+		return fail(err)
+	}
+	conn.msgs++
+	return host, errs
+}
+
+// connect connects to a mail exchanger of domain, or to the relay, and
+// greets it. Mail exchangers are tried by order of preference. The address
+// connected to is returned, with the outcome of the certificate verification
+// of the last mail exchanger tried, see dial.
+func (q *Queue) connect(ctx context.Context, domain string) (*smtp.Client, string, *smtp.TLSVerification, error) {
+	var addrs []string
+	if q.Relay != "" {
+		addrs = []string{q.Relay}
+	} else {
+		hosts, err := q.lookupHosts(ctx, domain)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		port := q.Port
+		if port == "" {
+			port = "25"
+		}
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, port))
+		}
+	}
+
+	var (
+		v   *smtp.TLSVerification
+		err error
+	)
+	for _, addr := range addrs {
+		var c *smtp.Client
+		if c, v, err = q.dial(ctx, domain, addr); err == nil {
+			return c, addr, v, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", v, err
+}
+
+// dial connects to a mail exchanger of domain at addr, and greets it. With
+// TLSConfig, the outcome of the certificate verification is returned, even if
+// the connection failed.
+func (q *Queue) dial(ctx context.Context, domain, addr string) (*smtp.Client, *smtp.TLSVerification, error) {
+	c, err := smtp.DialContext(ctx, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if q.TLSConfig == nil {
+		if err := c.HelloContext(ctx, q.hostname()); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+		return c, nil, nil
+	}
+
+	tlsConfig := q.TLSConfig
+	host, _, _ := net.SplitHostPort(addr)
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	c.TLSVerify = q.TLSVerify
+	if q.Relay != "" || isAddressLiteral(domain) {
+		c.TLSVerifyNames = []string{host}
+	} else {
+		c.TLSVerifyNames = []string{domain}
+	}
+	if err := c.HelloContext(ctx, q.hostname()); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		c.Close()
+		q.reportTLS(domain, addr, smtp.ErrStartTLSUnsupported)
+		return nil, nil, smtp.ErrStartTLSUnsupported
+	}
+	if err := c.StartTLSContext(ctx, tlsConfig); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	// The TLS handshake happens with the first command after STARTTLS
+	err = c.HelloContext(ctx, q.hostname())
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		q.reportTLS(domain, addr, err)
+	}
+	v := c.TLSVerification()
+	if err != nil {
+		c.Close()
+		return nil, v, err
+	}
+	return c, v, nil
+}
+
+// reportTLS reports the outcome of a STARTTLS negotiation with a mail
+// exchanger of domain to TLSReport. err is nil if it succeeded.
+func (q *Queue) reportTLS(domain, addr string, err error) {
+	if q.TLSReport == nil || q.Relay != "" || isAddressLiteral(domain) {
+		return
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	s := &smtptlsrpt.Session{
+		PolicyDomain:        domain,
+		PolicyType:          smtptlsrpt.PolicyNoPolicyFound,
+		ReceivingMXHostname: host,
+		ReceivingIP:         net.ParseIP(host),
+	}
+	if err != nil {
+		s.Result = smtptlsrpt.ClassifyError(err)
+		s.FailureReason = err.Error()
+	}
+	q.TLSReport(s)
+}
+
+// isAddressLiteral reports whether domain is an address literal, e.g.
+// "[192.0.2.1]", rather than a domain name.
+func isAddressLiteral(domain string) bool {
+	return strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]")
+}
+
+// errNullMX is returned for domains which don't accept mail, see RFC 7505.
+var errNullMX = &smtp.SMTPError{
+	Code:         556,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 10},
+	Message:      "Recipient domain doesn't accept mail",
+}
+
+// errNoSuchDomain is returned for domains without mail exchangers nor
+// addresses.
+var errNoSuchDomain = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 2},
+	Message:      "Recipient domain not found",
+}
+
+// lookupHosts returns the mail exchangers of domain, by order of preference.
+func (q *Queue) lookupHosts(ctx context.Context, domain string) ([]string, error) {
+	if isAddressLiteral(domain) {
+		// No MX lookup, see RFC 5321 section 5.1
+		ip, err := smtp.ParseAddressLiteral(domain)
+		if err != nil {
+			return nil, permanentError{fmt.Errorf("invalid address literal %v", domain)}
+		}
+		return []string{ip.String()}, nil
+	}
+
+	lookupMX := q.LookupMX
+	if lookupMX == nil {
+		lookupMX = net.DefaultResolver.LookupMX
+	}
+	mxs, err := lookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		// Implicit MX, see RFC 5321 section 5.1
+		return q.lookupImplicitMX(ctx, domain)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, errNullMX
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// lookupImplicitMX checks that domain, which has no MX records, has an
+// address. A domain which doesn't exist can't become deliverable by retrying.
+func (q *Queue) lookupImplicitMX(ctx context.Context, domain string) ([]string, error) {
+	lookupHost := q.LookupHost
+	if lookupHost == nil {
+		lookupHost = net.DefaultResolver.LookupHost
+	}
+	addrs, err := lookupHost(ctx, domain)
+	var dnsErr *net.DNSError
+	if (errors.As(err, &dnsErr) && dnsErr.IsNotFound) || (err == nil && len(addrs) == 0) {
+		return nil, errNoSuchDomain
+	} else if err != nil {
+		return nil, err
+	}
+	return []string{domain}, nil
+}
+
+// mailOptions returns the MAIL FROM options to send to c. DSN and MT-PRIORITY
+// parameters are dropped if c doesn't support them, as allowed by RFC 3461
+// section 4 and RFC 6710 section 5. The BY parameter is dropped as well: the
+// deadline can't be enforced past a hop which doesn't support DELIVERBY.
+func mailOptions(c *smtp.Client, opts *smtp.MailOptions) *smtp.MailOptions {
+	if opts == nil {
+		return nil
+	}
+	out := *opts
+	out.Auth = nil
+	if ok, _ := c.Extension("DSN"); !ok {
+		out.Return, out.EnvelopeID = "", ""
+	}
+	if ok, _ := c.Extension("DELIVERBY"); !ok {
+		out.DeliverBy = nil
+	}
+	if ok, _ := c.Extension("MT-PRIORITY"); !ok {
+		out.MTPriority = nil
+	}
+	// Custom parameters are only meaningful to the server they were sent to
+	out.Extensions = nil
+	return &out
+}
+
+// rcptOptions returns the RCPT TO options to send to c. DSN and MT-PRIORITY
+// parameters are dropped if c doesn't support them.
+func rcptOptions(c *smtp.Client, opts *smtp.RcptOptions) *smtp.RcptOptions {
+	if opts == nil {
+		return nil
+	}
+	out := *opts
+	if ok, _ := c.Extension("DSN"); !ok {
+		out.Notify, out.OriginalRecipientType, out.OriginalRecipient = nil, "", ""
+	}
+	if ok, _ := c.Extension("MT-PRIORITY"); !ok {
+		out.MTPriority = nil
+	}
+	out.Extensions = nil
+	return &out
+}
+
+type permanentError struct {
+	err error
+}
+
+func (err permanentError) Error() string {
+	return err.err.Error()
+}
+
+func (err permanentError) Unwrap() error {
+	return err.err
+}
+
+// suppressedError is returned for recipients in Queue.Suppressions.
+type suppressedError struct {
+	sup *Suppression
+}
+
+func (err suppressedError) Error() string {
+	if err.sup.Error == "" {
+		return "recipient address suppressed"
+	}
+	return "recipient address suppressed after a previous failure: " + err.sup.Error
+}
+
+// isPermanent reports whether a delivery error is permanent.
+func isPermanent(err error) bool {
+	var smtpErr *smtp.SMTPError
+	var extErr *smtp.UnsupportedExtensionError
+	var sizeErr *smtp.MessageTooLargeError
+	var permErr permanentError
+	var supErr suppressedError
+	switch {
+	case errors.As(err, &smtpErr):
+		return smtpErr.Code/100 == 5
+	case errors.As(err, &extErr), errors.As(err, &sizeErr), errors.As(err, &permErr), errors.As(err, &supErr):
+		return true
+	default:
+		return false
+	}
+}
+
+// errorStatus returns the reply code, enhanced code and text describing a
+// delivery error.
+func errorStatus(err error) (int, smtp.EnhancedCode, string) {
+	var smtpErr *smtp.SMTPError
+	var extErr *smtp.UnsupportedExtensionError
+	var sizeErr *smtp.MessageTooLargeError
+	var supErr suppressedError
+	switch {
+	case errors.As(err, &smtpErr):
+		code := smtpErr.EnhancedCode
+		if code == smtp.EnhancedCodeNotSet || code == smtp.NoEnhancedCode {
+			code = smtp.EnhancedCode{smtpErr.Code / 100, 0, 0}
+		}
+		return smtpErr.Code, code, smtpErr.Message
+	case errors.As(err, &extErr):
+		return 0, smtp.EnhancedCode{5, 5, 4}, err.Error()
+	case errors.As(err, &sizeErr):
+		return 0, smtp.EnhancedCode{5, 3, 4}, err.Error()
+	case errors.As(err, &supErr):
+		code := supErr.sup.EnhancedCode
+		if !code.IsPermanent() {
+			code = smtp.EnhancedCode{5, 1, 1}
+		}
+		return 0, code, err.Error()
+	case isPermanent(err):
+		return 0, smtp.EnhancedCode{5, 4, 4}, err.Error()
+	default:
+		return 0, smtp.EnhancedCode{4, 4, 1}, err.Error()
+	}
+}
@@ -0,0 +1,205 @@
+package smtpqueue
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Maximum size of the header of the original message included in delivery
+// status notifications.
+const maxDSNHeaderBytes = 64 * 1024
+
+// wantsFailureDSN reports whether the sender asked to be notified of a
+// failed delivery to rcpt.
+func wantsFailureDSN(rcpt *Recipient) bool {
+	if rcpt.Options == nil || len(rcpt.Options.Notify) == 0 {
+		return true
+	}
+	for _, notify := range rcpt.Options.Notify {
+		if notify == smtp.DSNNotifyFailure {
+			return true
+		}
+	}
+	return false
+}
+
+// international reports whether notifications for msg must be
+// internationalized, as defined in RFC 6533: if it was sent with SMTPUTF8, or
+// has non-ASCII addresses. They must then be sent with SMTPUTF8 too.
+func (msg *Message) international() bool {
+	if msg.MailOptions != nil && msg.MailOptions.UTF8 || !isASCII(msg.From) {
+		return true
+	}
+	for _, rcpt := range msg.Recipients {
+		if !isASCII(rcpt.Addr) {
+			return true
+		}
+		if opts := rcpt.Options; opts != nil && !isASCII(opts.OriginalRecipient) {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// typedAddress formats an address field of a DSN, with its address type:
+// "rfc822" for ASCII addresses, and "utf-8" otherwise. In
+// message/global-delivery-status parts, UTF-8 addresses are left as is, as
+// required by RFC 6533 section 3.
+func typedAddress(addrType smtp.DSNAddressType, addr string, global bool) string {
+	if addrType == "" {
+		addrType = smtp.DSNAddressTypeRFC822
+		if !isASCII(addr) {
+			addrType = smtp.DSNAddressTypeUTF8
+		}
+	}
+	if addrType == smtp.DSNAddressTypeUTF8 && !global {
+		addr = smtp.EncodeUTF8AddrXtext(addr)
+	}
+	return strings.ToLower(string(addrType)) + "; " + addr
+}
+
+// dsn returns a delivery status notification reporting failed recipients of
+// msg to its sender, as defined in RFC 3464, internationalized as defined in
+// RFC 6533 if needed. It returns nil if no notification is to be sent. The
+// caller must hold q.mu.
+func (q *Queue) dsn(msg *Message, failed []*Recipient) []byte {
+	if msg.From == "" {
+		// Never reply to notifications
+		return nil
+	}
+	var rcpts []*Recipient
+	for _, rcpt := range failed {
+		if wantsFailureDSN(rcpt) {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	if len(rcpts) == 0 {
+		return nil
+	}
+
+	var envelopeID string
+	full := false
+	if msg.MailOptions != nil {
+		envelopeID = msg.MailOptions.EnvelopeID
+		full = msg.MailOptions.Return == smtp.DSNReturnFull
+	}
+
+	global := msg.international()
+
+	original, err := q.original(msg.ID, full)
+	if err != nil {
+		q.log(slog.LevelWarn, "failed to read message for notification", slog.String("id", msg.ID), slog.String("error", err.Error()))
+	}
+
+	hostname := q.hostname()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	id, _ := newID(q.Rand)
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%v>\r\n", hostname)
+	fmt.Fprintf(&buf, "To: <%v>\r\n", msg.From)
+	fmt.Fprintf(&buf, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&buf, "Date: %v\r\n", q.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%v@%v>\r\n", id, hostname)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprintf(&buf, "\r\n")
+
+	w, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	fmt.Fprintf(w, "This is the mail system at host %v.\r\n\r\n", hostname)
+	fmt.Fprintf(w, "Your message could not be delivered to the following recipients:\r\n\r\n")
+	for _, rcpt := range rcpts {
+		fmt.Fprintf(w, "<%v>: %v\r\n", rcpt.Addr, rcpt.Error)
+	}
+
+	statusType := "message/delivery-status"
+	if global {
+		statusType = "message/global-delivery-status"
+	}
+	w, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {statusType}})
+	if envelopeID != "" {
+		fmt.Fprintf(w, "Original-Envelope-Id: %v\r\n", envelopeID)
+	}
+	fmt.Fprintf(w, "Reporting-MTA: dns; %v\r\n", hostname)
+	fmt.Fprintf(w, "Arrival-Date: %v\r\n", msg.CreatedAt.Format(time.RFC1123Z))
+	for _, rcpt := range rcpts {
+		code := rcpt.EnhancedCode
+		if code.IsTransient() {
+			// Temporary errors only fail once the message expires
+			code = code.WithClass(5)
+		}
+		fmt.Fprintf(w, "\r\n")
+		if opts := rcpt.Options; opts != nil && opts.OriginalRecipient != "" {
+			fmt.Fprintf(w, "Original-Recipient: %v\r\n", typedAddress(opts.OriginalRecipientType, opts.OriginalRecipient, global))
+		}
+		fmt.Fprintf(w, "Final-Recipient: %v\r\n", typedAddress("", rcpt.Addr, global))
+		fmt.Fprintf(w, "Action: failed\r\n")
+		fmt.Fprintf(w, "Status: %v\r\n", code)
+		if rcpt.Code != 0 {
+			fmt.Fprintf(w, "Diagnostic-Code: smtp; %v %v %v\r\n", rcpt.Code, rcpt.EnhancedCode, rcpt.Error)
+		}
+	}
+
+	if original != nil {
+		contentType := "text/rfc822-headers"
+		if full && global {
+			contentType = "message/global"
+		} else if full {
+			contentType = "message/rfc822"
+		} else if global {
+			contentType = "message/global-headers"
+		}
+		w, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		w.Write(original)
+	}
+	mw.Close()
+	return buf.Bytes()
+}
+
+// original returns a queued message to include in a notification: the
+// whole message if full is true, as requested with RET=FULL, otherwise its
+// header section.
+func (q *Queue) original(id string, full bool) ([]byte, error) {
+	body, err := q.Store.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	if full {
+		return ioutil.ReadAll(body)
+	}
+
+	var header []byte
+	br := bufio.NewReader(io.LimitReader(body, maxDSNHeaderBytes))
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		header = append(header, line...)
+		if err != nil {
+			break
+		}
+	}
+	return header, nil
+}
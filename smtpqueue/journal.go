@@ -0,0 +1,157 @@
+package smtpqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// EventType is the type of a delivery event.
+type EventType string
+
+const (
+	// The message has been queued for the recipient.
+	EventAccepted EventType = "accepted"
+	// A delivery attempt to the recipient has started.
+	EventAttempt EventType = "attempt"
+	// A delivery attempt has failed temporarily, and will be retried.
+	EventDeferred EventType = "deferred"
+	// The message has been accepted by the destination server.
+	EventDelivered EventType = "delivered"
+	// Delivery has failed permanently, expired or has been cancelled. The
+	// sender is notified if they asked for it.
+	EventBounced EventType = "bounced"
+)
+
+// Event is a delivery event of a queued message, for a recipient.
+type Event struct {
+	Time      time.Time
+	Type      EventType
+	MessageID string
+	Recipient string
+
+	// Sender of the message, and ID of the server connection it was received
+	// on if any, for EventAccepted.
+	From   string `json:",omitempty"`
+	ConnID string `json:",omitempty"`
+
+	// Destination of the attempt, see Filter.Destination.
+	Destination string `json:",omitempty"`
+	// Address of the server the attempt connected to, if any.
+	Host string `json:",omitempty"`
+	// Number of the attempt, starting from 1.
+	Attempt int `json:",omitempty"`
+	// With Queue.TLSConfig, the mode of the verification of the server
+	// certificate, see smtp.TLSVerifyMode, the name it was found valid for,
+	// and why it wasn't.
+	TLSVerify       string `json:",omitempty"`
+	TLSVerifiedName string `json:",omitempty"`
+	TLSError        string `json:",omitempty"`
+
+	// Failure of the attempt, as in Recipient, for EventDeferred and
+	// EventBounced.
+	Code         int               `json:",omitempty"`
+	EnhancedCode smtp.EnhancedCode `json:",omitempty"`
+	Error        string            `json:",omitempty"`
+	// Time of the next attempt, for EventDeferred.
+	NextAttempt time.Time `json:",omitempty"`
+}
+
+// Journal records the delivery events of a Queue.
+type Journal interface {
+	// Record appends an event to the journal.
+	Record(ev *Event) error
+	// History returns the events of a message, in the order they were
+	// recorded.
+	History(id string) ([]*Event, error)
+}
+
+// FileJournal records events in a file, one JSON object per line. The file is
+// only appended to: it can be rotated by renaming it, and calling Close.
+type FileJournal struct {
+	Path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+var _ Journal = (*FileJournal)(nil)
+
+// Record implements Journal.
+func (j *FileJournal) Record(ev *Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		f, err := os.OpenFile(j.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		j.f = f
+	}
+	_, err = j.f.Write(b)
+	return err
+}
+
+// History implements Journal. It reads the whole file.
+func (j *FileJournal) History(id string) ([]*Event, error) {
+	f, err := os.Open(j.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []*Event
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		ev := new(Event)
+		if err := json.Unmarshal(scanner.Bytes(), ev); err != nil {
+			return nil, fmt.Errorf("smtpqueue: failed to read %v line %v: %v", j.Path, n, err)
+		}
+		if ev.MessageID == id {
+			events = append(events, ev)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// Close closes the file. It's reopened by the next call to Record.
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// recordEvent records a delivery event in q.Journal.
+func (q *Queue) recordEvent(ev *Event) {
+	if q.Journal == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = q.now()
+	}
+	if err := q.Journal.Record(ev); err != nil {
+		q.log(slog.LevelError, "failed to record delivery event", slog.String("id", ev.MessageID), slog.String("error", err.Error()))
+	}
+}
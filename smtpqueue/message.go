@@ -0,0 +1,123 @@
+package smtpqueue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// RecipientStatus is the delivery status of a recipient.
+type RecipientStatus string
+
+const (
+	// The message hasn't been delivered to the recipient yet.
+	StatusPending RecipientStatus = "pending"
+	// The message has been accepted by the destination server.
+	StatusDelivered RecipientStatus = "delivered"
+	// Delivery failed permanently, or for too long.
+	StatusFailed RecipientStatus = "failed"
+)
+
+// Message is a queued message. Its body is kept in the Store.
+type Message struct {
+	ID          string
+	From        string
+	MailOptions *smtp.MailOptions `json:",omitempty"`
+	Recipients  []*Recipient
+	// Time the message was queued at.
+	CreatedAt time.Time
+	// Delivery is suspended until the message is released, see Queue.Hold.
+	// Time spent on hold counts towards Queue.MaxAge.
+	Held bool `json:",omitempty"`
+}
+
+// Range of message priorities, as defined in RFC 6710 section 2.
+const (
+	minPriority = -9
+	maxPriority = 9
+)
+
+// Priority returns the priority of the message, from -9 to 9, set with the
+// MT-PRIORITY parameter or Queue.SetPriority. It's zero if unset.
+func (msg *Message) Priority() int {
+	if msg.MailOptions == nil || msg.MailOptions.MTPriority == nil {
+		return 0
+	}
+	return *msg.MailOptions.MTPriority
+}
+
+// Recipient is a recipient of a queued message, with its delivery state.
+type Recipient struct {
+	Addr    string
+	Options *smtp.RcptOptions `json:",omitempty"`
+
+	Status RecipientStatus
+	// Number of failed delivery attempts.
+	Attempts int
+	// Time of the next delivery attempt, if pending.
+	NextAttempt time.Time `json:",omitempty"`
+
+	// Reply of the destination server to the last attempt, if any. Code is
+	// zero if the server couldn't be reached.
+	Code         int               `json:",omitempty"`
+	EnhancedCode smtp.EnhancedCode `json:",omitempty"`
+	Error        string            `json:",omitempty"`
+}
+
+// Domain returns the domain of the recipient address, in lower case.
+func (rcpt *Recipient) Domain() string {
+	return domainOf(rcpt.Addr)
+}
+
+func domainOf(addr string) string {
+	return strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+}
+
+// pending returns the recipients of msg not delivered yet.
+func (msg *Message) pending() []*Recipient {
+	var l []*Recipient
+	for _, rcpt := range msg.Recipients {
+		if rcpt.Status == StatusPending {
+			l = append(l, rcpt)
+		}
+	}
+	return l
+}
+
+// failed reports whether delivery to a recipient of msg failed.
+func (msg *Message) failed() bool {
+	for _, rcpt := range msg.Recipients {
+		if rcpt.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+func newID(r io.Reader) (string, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+	var b [16]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// validID reports whether id is safe to use in a file name.
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,756 @@
+// Package smtpqueue implements an outbound mail queue, delivering messages
+// to their destination servers with go-smtp's Client.
+//
+// Messages are persisted in a Store before being acknowledged, and
+// delivery is retried with an exponential backoff. Recipients failing
+// permanently, or for longer than MaxAge, are reported to the sender with a
+// delivery status notification (RFC 3464). Queued messages can be
+// inspected with Queue.Messages, and managed with Retry, Hold, Release,
+// SetPriority and Cancel. The history of each message can be kept in a
+// Journal.
+//
+// Recipients rejected with a hard bounce can be kept in a SuppressionList,
+// so that they aren't attempted again for a while. Failed messages which
+// can't be reported, because they have a null sender, can be kept in a
+// dead letter Store.
+//
+// Messages are delivered by order of priority, as set with MT-PRIORITY
+// (RFC 6710). Messages with a negative priority are only given a share of
+// the connections, and the priority of due messages waiting for a connection
+// is raised over time so that they aren't delayed forever.
+//
+// A Queue can be used as the backend of a server accepting mail for relay:
+//
+//	q := &smtpqueue.Queue{
+//		Store:    &smtpqueue.FileStore{Dir: "/var/spool/smtp"},
+//		Hostname: "mx.example.org",
+//	}
+//	go q.Run(ctx)
+//	s := smtp.NewServer(q)
+//
+// Since a Queue accepts all recipients, such a server must only be reachable
+// by trusted clients, or wrap the queue sessions with recipient checks.
+package smtpqueue
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtptlsrpt"
+)
+
+const (
+	defaultMinRetryDelay         = time.Minute
+	defaultMaxRetryDelay         = 4 * time.Hour
+	defaultMaxAge                = 5 * 24 * time.Hour
+	defaultMaxConcurrency        = 16
+	defaultMaxPerDestination     = 4
+	defaultMaxMessagesPerSession = 100
+	defaultPriorityAging         = 10 * time.Minute
+	defaultDeliveryTimeout       = 10 * time.Minute
+)
+
+// Queue delivers queued messages.
+type Queue struct {
+	// Persists queued messages. Required.
+	Store Store
+
+	// Host name announced with EHLO, and used in delivery status
+	// notifications. An IP address is announced as an address literal. If
+	// empty, "localhost" is used.
+	Hostname string
+
+	// Address of a smart host all messages are relayed through, e.g.
+	// "relay.example.org:587". If empty, messages are delivered to the mail
+	// exchangers of the recipient domains.
+	Relay string
+	// Port of the mail exchangers. If empty, "25" is used.
+	Port string
+	// TLS configuration used with STARTTLS, which is then required. The
+	// server name is set to the destination host if empty. If nil, messages
+	// are delivered in plaintext.
+	TLSConfig *tls.Config
+	// How the certificates of the servers are verified with TLSConfig: for
+	// the host name of the mail exchanger (the default), for the recipient
+	// domain with smtp.TLSVerifyNames, or without failing the delivery with
+	// smtp.TLSVerifyInsecure. The relay, and the IP address of address
+	// literal domains, are verified by host name. The outcome is recorded in
+	// the delivery events.
+	TLSVerify smtp.TLSVerifyMode
+	// Receives the outcome of the STARTTLS negotiations with mail
+	// exchangers when TLSConfig is set, e.g. smtptlsrpt.Reporter.Report.
+	// Sessions with the relay aren't reported.
+	TLSReport func(s *smtptlsrpt.Session)
+	// Looks up the mail exchangers of domains. If nil,
+	// net.DefaultResolver.LookupMX is used.
+	LookupMX func(ctx context.Context, name string) ([]*net.MX, error)
+	// Looks up the addresses of domains without mail exchangers, which are
+	// their own implicit mail exchanger. If nil,
+	// net.DefaultResolver.LookupHost is used.
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+
+	// Delay before the first retry, doubled for each further attempt up to
+	// MaxRetryDelay. If zero, 1 minute and 4 hours are used.
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+	// Time after which undelivered recipients fail. If zero, 5 days is used.
+	MaxAge time.Duration
+	// Timeout of a delivery attempt. If zero, 10 minutes is used.
+	DeliveryTimeout time.Duration
+
+	// Maximum number of concurrent connections, in total and per
+	// destination domain (or relay). If zero, 16 and 4 are used.
+	MaxConcurrency    int
+	MaxPerDestination int
+	// Maximum number of messages sent over a connection. Once a delivery
+	// attempt ends, its connection is reused for other due messages to the
+	// same destination. If zero, 100 is used. If negative, connections
+	// aren't reused.
+	MaxMessagesPerSession int
+	// Maximum number of concurrent connections delivering messages with a
+	// negative priority, so that bulk messages leave room for the other
+	// ones. If zero, half of MaxConcurrency is used.
+	MaxLowPriorityConcurrency int
+	// Time after which the priority of a message waiting for a delivery
+	// attempt once it's due is raised by one. Time spent waiting for a
+	// retry doesn't count. If zero, 10 minutes is used. If negative,
+	// priorities aren't raised.
+	PriorityAging time.Duration
+
+	// Rewrites the sender of messages when they're delivered, e.g.
+	// smtpbatv.Signer.Sign to sign it with BATV. It isn't called for the
+	// null reverse-path. If nil, the sender is used as is.
+	SignSender func(from string) (string, error)
+
+	// Addresses not to deliver to. Suppressed recipients fail without a
+	// delivery attempt, and are rejected by the queue sessions. Recipients
+	// rejected with a hard bounce are added. If nil, all addresses are
+	// attempted.
+	Suppressions *SuppressionList
+	// Receives the failed messages which can't be reported to their sender,
+	// because they have a null sender, e.g. undeliverable notifications. If
+	// nil, they're deleted.
+	DeadLetter Store
+
+	// Receives delivery events. If nil, nothing is logged.
+	Logger *slog.Logger
+	// Records the delivery events of each message, see FileJournal. If
+	// nil, events are only logged.
+	Journal Journal
+
+	// Source of the current time and of the timers scheduling delivery
+	// attempts, e.g. to simulate retries in tests. If nil, smtp.SystemClock
+	// is used.
+	Clock smtp.Clock
+	// Source of the random message identifiers. If nil, crypto/rand is
+	// used.
+	Rand io.Reader
+
+	mu        sync.Mutex
+	msgs      map[string]*Message
+	inflight  map[string]bool // by message ID and destination
+	active    int
+	lowActive int // connections started for low priority messages
+	perDest   map[string]int
+	wake      chan struct{}
+	wg        sync.WaitGroup
+}
+
+var _ smtp.Backend = (*Queue)(nil)
+
+// init initializes the internal state. The caller must hold q.mu.
+func (q *Queue) init() {
+	if q.msgs != nil {
+		return
+	}
+	q.msgs = make(map[string]*Message)
+	q.inflight = make(map[string]bool)
+	q.perDest = make(map[string]int)
+	q.wake = make(chan struct{}, 1)
+}
+
+func (q *Queue) clock() smtp.Clock {
+	if q.Clock == nil {
+		return smtp.SystemClock
+	}
+	return q.Clock
+}
+
+func (q *Queue) now() time.Time {
+	return q.clock().Now()
+}
+
+func (q *Queue) hostname() string {
+	if q.Hostname == "" {
+		return "localhost"
+	}
+	return q.Hostname
+}
+
+func (q *Queue) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	if q.Logger != nil {
+		q.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+	}
+}
+
+// notify wakes up the scheduler.
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue stores a new message for delivery, and returns its ID. The message
+// is delivered once Run is called.
+func (q *Queue) Enqueue(from string, opts *smtp.MailOptions, rcpts []*Recipient, body io.Reader) (string, error) {
+	return q.enqueue(from, opts, rcpts, body, "")
+}
+
+// enqueue is like Enqueue, connID is the ID of the server connection the
+// message was received on, if any.
+func (q *Queue) enqueue(from string, opts *smtp.MailOptions, rcpts []*Recipient, body io.Reader, connID string) (string, error) {
+	if len(rcpts) == 0 {
+		return "", fmt.Errorf("smtpqueue: no recipients")
+	}
+	id, err := newID(q.Rand)
+	if err != nil {
+		return "", err
+	}
+
+	q.mu.Lock()
+	q.init()
+	now := q.now()
+	q.mu.Unlock()
+
+	msg := &Message{
+		ID:          id,
+		From:        from,
+		MailOptions: opts,
+		CreatedAt:   now,
+	}
+	for _, rcpt := range rcpts {
+		msg.Recipients = append(msg.Recipients, &Recipient{
+			Addr:        rcpt.Addr,
+			Options:     rcpt.Options,
+			Status:      StatusPending,
+			NextAttempt: now,
+		})
+	}
+	if err := q.Store.Put(msg, body); err != nil {
+		return "", err
+	}
+	q.log(slog.LevelInfo, "message queued",
+		slog.String("id", id),
+		slog.String("from", from),
+		slog.Int("recipients", len(rcpts)))
+	for _, rcpt := range msg.Recipients {
+		q.recordEvent(&Event{
+			Time:      now,
+			Type:      EventAccepted,
+			MessageID: id,
+			Recipient: rcpt.Addr,
+			From:      from,
+			ConnID:    connID,
+		})
+	}
+
+	q.mu.Lock()
+	q.msgs[id] = msg
+	q.mu.Unlock()
+	q.notify()
+	return id, nil
+}
+
+// Run loads the stored messages and delivers queued messages until ctx is
+// done. It then waits for running delivery attempts to end.
+func (q *Queue) Run(ctx context.Context) error {
+	msgs, err := q.Store.List()
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.init()
+	for _, msg := range msgs {
+		if _, ok := q.msgs[msg.ID]; !ok {
+			q.msgs[msg.ID] = msg
+		}
+	}
+	q.mu.Unlock()
+
+	defer q.wg.Wait()
+	for {
+		var timer smtp.Timer
+		var timerCh <-chan time.Time
+		if next := q.dispatch(ctx); !next.IsZero() {
+			timer = q.clock().NewTimer(next.Sub(q.now()))
+			timerCh = timer.C()
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-q.wake:
+		case <-timerCh:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// dispatch starts the due delivery attempts allowed by the concurrency
+// limits, and returns the time of the next attempt to wait for.
+func (q *Queue) dispatch(ctx context.Context) time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	var next time.Time
+	for _, msg := range q.sortedMessages(now) {
+		if msg.Held {
+			continue
+		}
+		low := q.priority(msg, now) < 0
+
+		// Group due recipients by destination
+		due := make(map[string][]*Recipient)
+		var dests []string
+		for _, rcpt := range msg.pending() {
+			if rcpt.NextAttempt.After(now) {
+				if next.IsZero() || rcpt.NextAttempt.Before(next) {
+					next = rcpt.NextAttempt
+				}
+				continue
+			}
+			dest := q.destination(rcpt)
+			if due[dest] == nil {
+				dests = append(dests, dest)
+			}
+			due[dest] = append(due[dest], rcpt)
+		}
+
+		for _, dest := range dests {
+			key := msg.ID + "\x00" + dest
+			if q.inflight[key] || !q.reserve(dest, low) {
+				// Woken up again when an attempt ends
+				continue
+			}
+			q.start(msg, dest, key, due[dest], now)
+			q.wg.Add(1)
+			go func(msg *Message, dest, key string, rcpts []*Recipient) {
+				defer q.wg.Done()
+				q.runSession(ctx, msg, dest, key, rcpts, low)
+
+				q.mu.Lock()
+				q.active--
+				if low {
+					q.lowActive--
+				}
+				q.perDest[dest]--
+				if q.perDest[dest] == 0 {
+					delete(q.perDest, dest)
+				}
+				q.mu.Unlock()
+				q.notify()
+			}(msg, dest, key, due[dest])
+		}
+	}
+	return next
+}
+
+// sortedMessages returns the queued messages by order of priority, oldest
+// first. The caller must hold q.mu.
+func (q *Queue) sortedMessages(now time.Time) []*Message {
+	msgs := make([]*Message, 0, len(q.msgs))
+	priorities := make(map[*Message]int, len(q.msgs))
+	for _, msg := range q.msgs {
+		msgs = append(msgs, msg)
+		priorities[msg] = q.priority(msg, now)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if pi, pj := priorities[msgs[i]], priorities[msgs[j]]; pi != pj {
+			return pi > pj
+		}
+		return msgs[i].CreatedAt.Before(msgs[j].CreatedAt)
+	})
+	return msgs
+}
+
+// priority returns the priority msg is scheduled with: its priority, raised
+// by one every PriorityAging since it's due. Time spent waiting for a retry
+// doesn't count, so that deferred messages don't outrank new ones.
+func (q *Queue) priority(msg *Message, now time.Time) int {
+	p := msg.Priority()
+	aging := q.PriorityAging
+	if aging == 0 {
+		aging = defaultPriorityAging
+	}
+	if aging > 0 {
+		if n := now.Sub(dueSince(msg, now)) / aging; n > 0 {
+			if n > maxPriority-minPriority {
+				n = maxPriority - minPriority
+			}
+			p += int(n)
+		}
+	}
+	if p > maxPriority {
+		p = maxPriority
+	}
+	return p
+}
+
+// dueSince returns the time since which delivery of msg to a pending
+// recipient is due, or now if none is.
+func dueSince(msg *Message, now time.Time) time.Time {
+	since := now
+	for _, rcpt := range msg.pending() {
+		t := rcpt.NextAttempt
+		if t.IsZero() {
+			t = msg.CreatedAt
+		}
+		if t.Before(since) {
+			since = t
+		}
+	}
+	return since
+}
+
+// start marks a delivery attempt of msg to rcpts as in progress. The caller
+// must hold q.mu.
+func (q *Queue) start(msg *Message, dest, key string, rcpts []*Recipient, now time.Time) {
+	q.inflight[key] = true
+	for _, rcpt := range rcpts {
+		q.recordEvent(&Event{
+			Time:        now,
+			Type:        EventAttempt,
+			MessageID:   msg.ID,
+			Recipient:   rcpt.Addr,
+			Destination: dest,
+			Attempt:     rcpt.Attempts + 1,
+		})
+	}
+}
+
+// nextDue starts the delivery attempt of the next message with due
+// recipients for dest, if any, to reuse a connection. Connections started
+// for messages with a non-negative priority aren't used for messages with a
+// negative one, which are limited by MaxLowPriorityConcurrency. The caller
+// must hold q.mu.
+func (q *Queue) nextDue(dest string, low bool) (msg *Message, key string, rcpts []*Recipient) {
+	now := q.now()
+	for _, msg := range q.sortedMessages(now) {
+		key := msg.ID + "\x00" + dest
+		if msg.Held || q.inflight[key] || (!low && q.priority(msg, now) < 0) {
+			continue
+		}
+		var due []*Recipient
+		for _, rcpt := range msg.pending() {
+			if !rcpt.NextAttempt.After(now) && q.destination(rcpt) == dest {
+				due = append(due, rcpt)
+			}
+		}
+		if len(due) > 0 {
+			q.start(msg, dest, key, due, now)
+			return msg, key, due
+		}
+	}
+	return nil, "", nil
+}
+
+// destination returns the destination a recipient is delivered to, which
+// concurrency limits apply to.
+func (q *Queue) destination(rcpt *Recipient) string {
+	if q.Relay != "" {
+		return q.Relay
+	}
+	return rcpt.Domain()
+}
+
+// reserve reserves a connection to dest, for messages with a negative
+// priority if low is set. The caller must hold q.mu.
+func (q *Queue) reserve(dest string, low bool) bool {
+	maxConcurrency := q.MaxConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultMaxConcurrency
+	}
+	maxPerDest := q.MaxPerDestination
+	if maxPerDest <= 0 {
+		maxPerDest = defaultMaxPerDestination
+	}
+	maxLow := q.MaxLowPriorityConcurrency
+	if maxLow <= 0 {
+		maxLow = (maxConcurrency + 1) / 2
+	}
+	if q.active >= maxConcurrency || q.perDest[dest] >= maxPerDest || (low && q.lowActive >= maxLow) {
+		return false
+	}
+	q.active++
+	if low {
+		q.lowActive++
+	}
+	q.perDest[dest]++
+	return true
+}
+
+// retryDelay returns the delay before the next attempt after the given
+// number of failed attempts.
+func (q *Queue) retryDelay(attempts int) time.Duration {
+	delay, max := q.MinRetryDelay, q.MaxRetryDelay
+	if delay <= 0 {
+		delay = defaultMinRetryDelay
+	}
+	if max <= 0 {
+		max = defaultMaxRetryDelay
+	}
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+func (q *Queue) maxAge() time.Duration {
+	if q.MaxAge <= 0 {
+		return defaultMaxAge
+	}
+	return q.MaxAge
+}
+
+// runSession makes a delivery attempt of msg to rcpts, then reuses the
+// connection for the other due messages to dest, up to
+// MaxMessagesPerSession. The caller must have reserved dest, for low
+// priority messages if low is set.
+func (q *Queue) runSession(ctx context.Context, msg *Message, dest, key string, rcpts []*Recipient, low bool) {
+	conn := &outbound{}
+	defer conn.quit()
+
+	maxMsgs := q.MaxMessagesPerSession
+	if maxMsgs == 0 {
+		maxMsgs = defaultMaxMessagesPerSession
+	}
+	for {
+		q.deliver(ctx, conn, msg, dest, rcpts)
+
+		q.mu.Lock()
+		delete(q.inflight, key)
+		if conn.c == nil || conn.msgs >= maxMsgs || ctx.Err() != nil {
+			q.mu.Unlock()
+			return
+		}
+		msg, key, rcpts = q.nextDue(dest, low)
+		q.mu.Unlock()
+		if msg == nil {
+			return
+		}
+	}
+}
+
+// deliver makes a delivery attempt of msg to rcpts over conn, and records
+// the outcome.
+func (q *Queue) deliver(ctx context.Context, conn *outbound, msg *Message, dest string, rcpts []*Recipient) {
+	timeout := q.DeliveryTimeout
+	if timeout <= 0 {
+		timeout = defaultDeliveryTimeout
+	}
+	errs := make([]error, len(rcpts))
+	var allowed []*Recipient
+	var indices []int
+	for i, rcpt := range rcpts {
+		if errs[i] = q.suppressed(msg, rcpt); errs[i] == nil {
+			allowed = append(allowed, rcpt)
+			indices = append(indices, i)
+		}
+	}
+
+	var host string
+	if len(allowed) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		var sendErrs []error
+		host, sendErrs = q.send(ctx, conn, msg, allowed)
+		cancel()
+		for j, i := range indices {
+			errs[i] = sendErrs[j]
+		}
+	}
+
+	q.sendDSN(msg, q.record(msg, dest, host, conn.tls, rcpts, errs))
+}
+
+// suppressed returns a permanent error if rcpt is in q.Suppressions.
+func (q *Queue) suppressed(msg *Message, rcpt *Recipient) error {
+	if q.Suppressions == nil {
+		return nil
+	}
+	sup, err := q.Suppressions.Lookup(rcpt.Addr)
+	if err != nil {
+		// Rather attempt the delivery than fail it
+		q.log(slog.LevelError, "failed to look up suppressed address", slog.String("id", msg.ID), slog.String("rcpt", rcpt.Addr), slog.String("error", err.Error()))
+		return nil
+	} else if sup == nil {
+		return nil
+	}
+	return suppressedError{sup}
+}
+
+// suppress adds rcpt to q.Suppressions if the destination server rejected
+// it with a hard bounce. Suppressed recipients fail without a reply, so their
+// suppression isn't extended. The caller must hold q.mu.
+func (q *Queue) suppress(msg *Message, rcpt *Recipient) {
+	if q.Suppressions == nil || rcpt.Code/100 != 5 || !isHardBounce(rcpt.EnhancedCode) {
+		return
+	}
+	err := q.Suppressions.Add(&Suppression{
+		Addr:         rcpt.Addr,
+		Code:         rcpt.Code,
+		EnhancedCode: rcpt.EnhancedCode,
+		Error:        rcpt.Error,
+	})
+	if err != nil {
+		q.log(slog.LevelError, "failed to suppress address", slog.String("id", msg.ID), slog.String("rcpt", rcpt.Addr), slog.String("error", err.Error()))
+	}
+}
+
+// sendDSN queues a delivery status notification for msg, if dsn isn't nil.
+func (q *Queue) sendDSN(msg *Message, dsn []byte) {
+	if dsn == nil {
+		return
+	}
+	var opts *smtp.MailOptions
+	if msg.international() {
+		opts = &smtp.MailOptions{UTF8: true, Body: smtp.Body8BitMIME}
+	}
+	_, err := q.Enqueue("", opts, []*Recipient{{Addr: msg.From}}, bytes.NewReader(dsn))
+	if err != nil {
+		q.log(slog.LevelError, "failed to queue delivery status notification", slog.String("id", msg.ID), slog.String("error", err.Error()))
+	}
+}
+
+// record records the outcome of a delivery attempt to host, with the outcome
+// v of the verification of its certificate if any, and returns the delivery
+// status notification to send to the sender, if any.
+func (q *Queue) record(msg *Message, dest, host string, v *smtp.TLSVerification, rcpts []*Recipient, errs []error) []byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	var failed []*Recipient
+	for i, rcpt := range rcpts {
+		err := errs[i]
+		attrs := []slog.Attr{
+			slog.String("id", msg.ID),
+			slog.String("rcpt", rcpt.Addr),
+			slog.String("destination", dest),
+		}
+		ev := &Event{
+			Time:        now,
+			MessageID:   msg.ID,
+			Recipient:   rcpt.Addr,
+			Destination: dest,
+			Host:        host,
+			Attempt:     rcpt.Attempts + 1,
+		}
+		if q.TLSConfig != nil && !q.TLSConfig.InsecureSkipVerify {
+			ev.TLSVerify = q.TLSVerify.String()
+			if v != nil {
+				ev.TLSVerifiedName = v.Name
+				if v.Err != nil {
+					ev.TLSError = v.Err.Error()
+				}
+			}
+		}
+		if err == nil {
+			rcpt.Status = StatusDelivered
+			rcpt.Code, rcpt.EnhancedCode, rcpt.Error = 0, smtp.EnhancedCode{}, ""
+			rcpt.NextAttempt = time.Time{}
+			q.log(slog.LevelInfo, "message delivered", attrs...)
+			ev.Type = EventDelivered
+			q.recordEvent(ev)
+			continue
+		}
+
+		rcpt.Attempts++
+		rcpt.Code, rcpt.EnhancedCode, rcpt.Error = errorStatus(err)
+		attrs = append(attrs, slog.String("error", rcpt.Error))
+		ev.Code, ev.EnhancedCode = rcpt.Code, rcpt.EnhancedCode
+		switch {
+		case isPermanent(err):
+			rcpt.Status = StatusFailed
+			q.suppress(msg, rcpt)
+		case now.Sub(msg.CreatedAt) >= q.maxAge():
+			rcpt.Status = StatusFailed
+			rcpt.EnhancedCode = smtp.EnhancedCode{4, 4, 7}
+			rcpt.Error = "delivery time expired: " + rcpt.Error
+		default:
+			rcpt.NextAttempt = now.Add(q.retryDelay(rcpt.Attempts))
+			attrs = append(attrs, slog.Time("next_attempt", rcpt.NextAttempt))
+			q.log(slog.LevelWarn, "delivery deferred", attrs...)
+			ev.Type, ev.Error, ev.NextAttempt = EventDeferred, rcpt.Error, rcpt.NextAttempt
+			q.recordEvent(ev)
+			continue
+		}
+		rcpt.NextAttempt = time.Time{}
+		failed = append(failed, rcpt)
+		q.log(slog.LevelWarn, "delivery failed", attrs...)
+		ev.Type, ev.EnhancedCode, ev.Error = EventBounced, rcpt.EnhancedCode, rcpt.Error
+		q.recordEvent(ev)
+	}
+
+	return q.commit(msg, failed)
+}
+
+// commit persists the delivery state of msg, and removes it once no
+// recipient is pending. It returns the delivery status notification to send
+// for the newly failed recipients, if any. The caller must hold q.mu.
+func (q *Queue) commit(msg *Message, failed []*Recipient) []byte {
+	// The DSN includes the message, which may be deleted below
+	var dsn []byte
+	if len(failed) > 0 {
+		dsn = q.dsn(msg, failed)
+	}
+
+	if len(msg.pending()) > 0 {
+		if err := q.Store.Update(msg); err != nil {
+			q.log(slog.LevelError, "failed to update queued message", slog.String("id", msg.ID), slog.String("error", err.Error()))
+		}
+	} else {
+		delete(q.msgs, msg.ID)
+		if msg.From == "" && msg.failed() && q.DeadLetter != nil {
+			q.moveToDeadLetter(msg)
+		}
+		if err := q.Store.Delete(msg.ID); err != nil {
+			q.log(slog.LevelError, "failed to delete queued message", slog.String("id", msg.ID), slog.String("error", err.Error()))
+		}
+	}
+	return dsn
+}
+
+// moveToDeadLetter copies msg to q.DeadLetter. The caller must hold q.mu.
+func (q *Queue) moveToDeadLetter(msg *Message) {
+	err := func() error {
+		body, err := q.Store.Open(msg.ID)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return q.DeadLetter.Put(copyMessage(msg), body)
+	}()
+	if err != nil {
+		q.log(slog.LevelError, "failed to move message to dead letter store", slog.String("id", msg.ID), slog.String("error", err.Error()))
+		return
+	}
+	q.log(slog.LevelWarn, "message moved to dead letter store", slog.String("id", msg.ID))
+}
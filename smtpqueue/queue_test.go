@@ -0,0 +1,1266 @@
+package smtpqueue_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtpbatv"
+	"github.com/emersion/go-smtp/smtpqueue"
+	"github.com/emersion/go-smtp/smtptest"
+	"github.com/emersion/go-smtp/smtptlsrpt"
+)
+
+type message struct {
+	from     string
+	to       []string
+	data     string
+	mailOpts *smtp.MailOptions
+	rcptOpts []*smtp.RcptOptions
+}
+
+type backend struct {
+	mu        sync.Mutex
+	tempFails int // number of temporary failures left for "later@"
+	sessions  int
+	helo      string // of the last session
+	msgs      chan *message
+}
+
+func (be *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	be.mu.Lock()
+	be.sessions++
+	be.helo = c.Hostname()
+	be.mu.Unlock()
+	return &session{be: be}, nil
+}
+
+type session struct {
+	be  *backend
+	msg *message
+}
+
+func (s *session) Reset()        {}
+func (s *session) Logout() error { return nil }
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.msg = &message{from: from, mailOpts: opts}
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	switch to {
+	case "nobody@example.org":
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	case "later@example.org":
+		s.be.mu.Lock()
+		defer s.be.mu.Unlock()
+		if s.be.tempFails > 0 {
+			s.be.tempFails--
+			return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "Try again later"}
+		}
+	}
+	s.msg.to = append(s.msg.to, to)
+	s.msg.rcptOpts = append(s.msg.rcptOpts, opts)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.data = string(b)
+	s.be.msgs <- s.msg
+	return nil
+}
+
+func serve(t *testing.T, be *backend) (addr string, close func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(be)
+	s.EnableDSN = true
+	s.EnableMTPRIORITY = true
+	s.EnableSMTPUTF8 = true
+	go s.Serve(l)
+	return l.Addr().String(), func() { s.Close() }
+}
+
+// run runs q until the returned function is called.
+func run(t *testing.T, q *smtpqueue.Queue) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Run(ctx)
+	}()
+	return func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	}
+}
+
+func testQueue(t *testing.T, be *backend) (q *smtpqueue.Queue, cleanup func()) {
+	addr, closeServer := serve(t, be)
+
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q = &smtpqueue.Queue{
+		Store:         &smtpqueue.FileStore{Dir: dir},
+		Hostname:      "mx.example.org",
+		Relay:         addr,
+		MinRetryDelay: 10 * time.Millisecond,
+	}
+	stop := run(t, q)
+
+	return q, func() {
+		stop()
+		closeServer()
+		os.RemoveAll(dir)
+	}
+}
+
+func receive(t *testing.T, msgs <-chan *message) *message {
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a delivery")
+		return nil
+	}
+}
+
+// waitEmpty waits for the store to be emptied.
+func waitEmpty(t *testing.T, store smtpqueue.Store) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msgs, err := store.List()
+		if err != nil {
+			t.Fatalf("List() = %v", err)
+		}
+		if len(msgs) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("store still has %v messages", len(msgs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 1)}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	rcpts := []*smtpqueue.Recipient{{Addr: "root@example.org"}}
+	body := "Subject: Hey\r\n\r\nHey <3\r\n"
+	if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader(body)); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	msg := receive(t, be.msgs)
+	if msg.from != "alice@example.com" {
+		t.Errorf("from = %q, want %q", msg.from, "alice@example.com")
+	}
+	if len(msg.to) != 1 || msg.to[0] != "root@example.org" {
+		t.Errorf("to = %v, want [root@example.org]", msg.to)
+	}
+	if msg.data != body {
+		t.Errorf("data = %q, want %q", msg.data, body)
+	}
+	waitEmpty(t, q.Store)
+}
+
+func TestQueue_retry(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 1), tempFails: 2}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	rcpts := []*smtpqueue.Recipient{{Addr: "later@example.org"}}
+	if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	msg := receive(t, be.msgs)
+	if len(msg.to) != 1 || msg.to[0] != "later@example.org" {
+		t.Errorf("to = %v, want [later@example.org]", msg.to)
+	}
+	be.mu.Lock()
+	if be.tempFails != 0 {
+		t.Errorf("delivered with %v temporary failures left", be.tempFails)
+	}
+	be.mu.Unlock()
+	waitEmpty(t, q.Store)
+}
+
+func TestQueue_retryClock(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 1), tempFails: 1}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := smtptest.NewFakeClock(time.Now())
+	q := &smtpqueue.Queue{
+		Store:         &smtpqueue.FileStore{Dir: dir},
+		Relay:         addr,
+		MinRetryDelay: time.Hour,
+		Clock:         clock,
+	}
+	stop := run(t, q)
+	defer stop()
+
+	rcpts := []*smtpqueue.Recipient{{Addr: "later@example.org"}}
+	if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	// Wait for the first attempt to fail, and the retry to be scheduled
+	deadline := time.Now().Add(5 * time.Second)
+	for clock.Timers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the retry to be scheduled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Hour - time.Second)
+	select {
+	case <-be.msgs:
+		t.Fatal("message retried before the retry delay")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	receive(t, be.msgs)
+	waitEmpty(t, q.Store)
+}
+
+func TestQueue_bounce(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 2)}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	rcpts := []*smtpqueue.Recipient{
+		{Addr: "root@example.org"},
+		{Addr: "nobody@example.org"},
+	}
+	body := "Subject: Hey\r\nMessage-ID: <42@example.com>\r\n\r\nHey <3\r\n"
+	if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader(body)); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	msg := receive(t, be.msgs)
+	if len(msg.to) != 1 || msg.to[0] != "root@example.org" {
+		t.Errorf("to = %v, want [root@example.org]", msg.to)
+	}
+
+	dsn := receive(t, be.msgs)
+	if dsn.from != "" {
+		t.Errorf("DSN from = %q, want the null sender", dsn.from)
+	}
+	if len(dsn.to) != 1 || dsn.to[0] != "alice@example.com" {
+		t.Errorf("DSN to = %v, want [alice@example.com]", dsn.to)
+	}
+	for _, s := range []string{
+		"report-type=delivery-status",
+		"Final-Recipient: rfc822; nobody@example.org",
+		"Status: 5.1.1",
+		"Diagnostic-Code: smtp; 550 5.1.1 No such user",
+		"Message-ID: <42@example.com>",
+	} {
+		if !strings.Contains(dsn.data, s) {
+			t.Errorf("DSN doesn't contain %q:\n%v", s, dsn.data)
+		}
+	}
+	if strings.Contains(dsn.data, "root@example.org") {
+		t.Errorf("DSN reports a delivered recipient:\n%v", dsn.data)
+	}
+	waitEmpty(t, q.Store)
+}
+
+func TestQueue_bounceInternational(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 1)}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	opts := &smtp.MailOptions{UTF8: true}
+	rcpts := []*smtpqueue.Recipient{{
+		Addr: "nobody@example.org",
+		Options: &smtp.RcptOptions{
+			OriginalRecipientType: smtp.DSNAddressTypeUTF8,
+			OriginalRecipient:     "bøb@example.com",
+		},
+	}}
+	body := "Subject: Hej\r\n\r\nHej <3\r\n"
+	if _, err := q.Enqueue("ålice@example.com", opts, rcpts, strings.NewReader(body)); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	dsn := receive(t, be.msgs)
+	if len(dsn.to) != 1 || dsn.to[0] != "ålice@example.com" {
+		t.Errorf("DSN to = %v, want [ålice@example.com]", dsn.to)
+	}
+	if dsn.mailOpts == nil || !dsn.mailOpts.UTF8 {
+		t.Errorf("DSN MAIL options = %+v, want SMTPUTF8", dsn.mailOpts)
+	}
+	for _, s := range []string{
+		"Content-Type: message/global-delivery-status",
+		"Original-Recipient: utf-8; bøb@example.com",
+		"Final-Recipient: rfc822; nobody@example.org",
+		"Content-Type: message/global-headers",
+		"Subject: Hej",
+	} {
+		if !strings.Contains(dsn.data, s) {
+			t.Errorf("DSN doesn't contain %q:\n%v", s, dsn.data)
+		}
+	}
+	waitEmpty(t, q.Store)
+}
+
+func TestQueue_recover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Queue a message without delivering it
+	store := &smtpqueue.FileStore{Dir: dir}
+	q := &smtpqueue.Queue{Store: store}
+	rcpts := []*smtpqueue.Recipient{{Addr: "root@example.org", Options: &smtp.RcptOptions{
+		Notify: []smtp.DSNNotify{smtp.DSNNotifyNever},
+	}}}
+	id, err := q.Enqueue("alice@example.com", &smtp.MailOptions{Size: 8}, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	msgs, err := store.List()
+	if err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("List() returned %v messages, want 1", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.ID != id || msg.From != "alice@example.com" || msg.MailOptions == nil || msg.MailOptions.Size != 8 {
+		t.Errorf("List() = %+v, want the queued message", msg)
+	}
+	if len(msg.Recipients) != 1 || msg.Recipients[0].Status != smtpqueue.StatusPending || msg.Recipients[0].Options == nil {
+		t.Fatalf("Recipients = %+v, want a single pending recipient", msg.Recipients)
+	}
+
+	// Deliver it with another queue
+	be := &backend{msgs: make(chan *message, 1)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+	stop := run(t, &smtpqueue.Queue{Store: store, Relay: addr})
+	defer stop()
+
+	delivered := receive(t, be.msgs)
+	if delivered.data != "Hey <3\r\n" {
+		t.Errorf("data = %q, want %q", delivered.data, "Hey <3\r\n")
+	}
+	waitEmpty(t, store)
+}
+
+func TestQueue_admin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	be := &backend{msgs: make(chan *message, 2)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+
+	q := &smtpqueue.Queue{Store: &smtpqueue.FileStore{Dir: dir}, Relay: addr}
+	held, err := q.Enqueue("alice@example.com", nil, []*smtpqueue.Recipient{{Addr: "root@example.org"}}, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	cancelled, err := q.Enqueue("alice@example.com", nil, []*smtpqueue.Recipient{{Addr: "bob@example.org"}}, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	if msgs := q.Messages(nil); len(msgs) != 2 || msgs[0].ID != held || msgs[1].ID != cancelled {
+		t.Errorf("Messages(nil) = %v, want both messages", msgs)
+	}
+	if msgs := q.Messages(&smtpqueue.Filter{Destination: addr, Status: smtpqueue.StatusPending}); len(msgs) != 2 {
+		t.Errorf("Messages() returned %v messages for the relay, want 2", len(msgs))
+	}
+	if msgs := q.Messages(&smtpqueue.Filter{Status: smtpqueue.StatusFailed}); len(msgs) != 0 {
+		t.Errorf("Messages() returned %v failed messages, want 0", len(msgs))
+	}
+	if msgs := q.Messages(&smtpqueue.Filter{MinAge: time.Hour}); len(msgs) != 0 {
+		t.Errorf("Messages() returned %v messages older than an hour, want 0", len(msgs))
+	}
+	if _, err := q.Message("unknown"); err != smtpqueue.ErrNotFound {
+		t.Errorf("Message() = %v, want ErrNotFound", err)
+	}
+
+	if err := q.Hold(held); err != nil {
+		t.Fatalf("Hold() = %v", err)
+	}
+	if msg, err := q.Message(held); err != nil || !msg.Held {
+		t.Errorf("Message() = %+v, %v, want a held message", msg, err)
+	}
+	if err := q.Cancel(cancelled); err != nil {
+		t.Fatalf("Cancel() = %v", err)
+	}
+	if _, err := q.Message(cancelled); err != smtpqueue.ErrNotFound {
+		t.Errorf("Message() = %v for a cancelled message, want ErrNotFound", err)
+	}
+
+	stop := run(t, q)
+	defer stop()
+
+	// Only the notification of the cancellation is delivered
+	dsn := receive(t, be.msgs)
+	if len(dsn.to) != 1 || dsn.to[0] != "alice@example.com" {
+		t.Errorf("DSN to = %v, want [alice@example.com]", dsn.to)
+	}
+	for _, s := range []string{"Final-Recipient: rfc822; bob@example.org", "Status: 5.0.0", "delivery cancelled"} {
+		if !strings.Contains(dsn.data, s) {
+			t.Errorf("DSN doesn't contain %q:\n%v", s, dsn.data)
+		}
+	}
+	select {
+	case msg := <-be.msgs:
+		t.Fatalf("held message delivered to %v", msg.to)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := q.Release(held); err != nil {
+		t.Fatalf("Release() = %v", err)
+	}
+	if msg := receive(t, be.msgs); len(msg.to) != 1 || msg.to[0] != "root@example.org" {
+		t.Errorf("to = %v, want [root@example.org]", msg.to)
+	}
+	waitEmpty(t, q.Store)
+}
+
+func TestQueue_forceRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	be := &backend{msgs: make(chan *message, 1), tempFails: 1}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+
+	q := &smtpqueue.Queue{
+		Store:         &smtpqueue.FileStore{Dir: dir},
+		Relay:         addr,
+		MinRetryDelay: time.Hour,
+	}
+	stop := run(t, q)
+	defer stop()
+
+	rcpts := []*smtpqueue.Recipient{{Addr: "later@example.org"}}
+	id, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	// Wait for the first attempt to fail
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		msg, err := q.Message(id)
+		if err != nil {
+			t.Fatalf("Message() = %v", err)
+		}
+		if rcpt := msg.Recipients[0]; rcpt.Attempts == 1 {
+			if rcpt.Code != 451 || rcpt.Status != smtpqueue.StatusPending {
+				t.Errorf("Recipient = %+v, want a deferred recipient", rcpt)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a delivery attempt")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := q.Retry(id); err != nil {
+		t.Fatalf("Retry() = %v", err)
+	}
+	receive(t, be.msgs)
+	waitEmpty(t, q.Store)
+}
+
+func TestQueue_journal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	be := &backend{msgs: make(chan *message, 2)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+
+	journal := &smtpqueue.FileJournal{Path: filepath.Join(dir, "journal.jsonl")}
+	defer journal.Close()
+	q := &smtpqueue.Queue{
+		Store:   &smtpqueue.FileStore{Dir: filepath.Join(dir, "spool")},
+		Relay:   addr,
+		Journal: journal,
+	}
+	stop := run(t, q)
+	defer stop()
+
+	rcpts := []*smtpqueue.Recipient{
+		{Addr: "root@example.org"},
+		{Addr: "nobody@example.org"},
+	}
+	id, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	receive(t, be.msgs)
+	receive(t, be.msgs) // DSN
+	waitEmpty(t, q.Store)
+
+	events, err := journal.History(id)
+	if err != nil {
+		t.Fatalf("History() = %v", err)
+	}
+	want := []struct {
+		typ  smtpqueue.EventType
+		rcpt string
+	}{
+		{smtpqueue.EventAccepted, "root@example.org"},
+		{smtpqueue.EventAccepted, "nobody@example.org"},
+		{smtpqueue.EventAttempt, "root@example.org"},
+		{smtpqueue.EventAttempt, "nobody@example.org"},
+		{smtpqueue.EventDelivered, "root@example.org"},
+		{smtpqueue.EventBounced, "nobody@example.org"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("History() returned %v events, want %v", len(events), len(want))
+	}
+	for i, ev := range events {
+		if ev.Type != want[i].typ || ev.Recipient != want[i].rcpt || ev.MessageID != id || ev.Time.IsZero() {
+			t.Errorf("event #%v = %+v, want %v for %v", i, ev, want[i].typ, want[i].rcpt)
+		}
+	}
+	if ev := events[0]; ev.From != "alice@example.com" {
+		t.Errorf("accepted event From = %q, want %q", ev.From, "alice@example.com")
+	}
+	if ev := events[4]; ev.Host != addr || ev.Attempt != 1 {
+		t.Errorf("delivered event = %+v, want the first attempt to %v", ev, addr)
+	}
+	if ev := events[5]; ev.Code != 550 || ev.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) || ev.Error != "No such user" {
+		t.Errorf("bounced event = %+v, want the 550 reply", ev)
+	}
+}
+
+func TestQueue_dsnParams(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 2)}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	// Submit the message to a server backed by the queue
+	s := smtp.NewServer(q)
+	s.Domain = "mx.example.org"
+	s.EnableDSN = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	body := "Subject: Hey\r\n\r\nHey <3\r\n"
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Mail("alice@example.com", &smtp.MailOptions{
+		Return:     smtp.DSNReturnFull,
+		EnvelopeID: "QQ314159",
+	})
+	if err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	err = c.Rcpt("root@example.org", &smtp.RcptOptions{
+		Notify:                []smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure},
+		OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+		OriginalRecipient:     "postmaster@example.com",
+	})
+	if err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	err = c.Rcpt("nobody@example.org", &smtp.RcptOptions{
+		Notify:                []smtp.DSNNotify{smtp.DSNNotifyFailure},
+		OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+		OriginalRecipient:     "bob@example.com",
+	})
+	if err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+	io.WriteString(w, body)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data().Close() = %v", err)
+	}
+
+	msg := receive(t, be.msgs)
+	if opts := msg.mailOpts; opts.Return != smtp.DSNReturnFull || opts.EnvelopeID != "QQ314159" {
+		t.Errorf("MAIL options = %+v, want RET and ENVID", opts)
+	}
+	if len(msg.rcptOpts) != 1 || len(msg.rcptOpts[0].Notify) != 2 || msg.rcptOpts[0].OriginalRecipient != "postmaster@example.com" {
+		t.Errorf("RCPT options = %+v, want NOTIFY and ORCPT", msg.rcptOpts)
+	}
+
+	dsn := receive(t, be.msgs)
+	for _, s := range []string{
+		"Original-Envelope-Id: QQ314159",
+		"Original-Recipient: rfc822; bob@example.com",
+		"Final-Recipient: rfc822; nobody@example.org",
+		"Content-Type: message/rfc822",
+		"Hey <3",
+	} {
+		if !strings.Contains(dsn.data, s) {
+			t.Errorf("DSN doesn't contain %q:\n%v", s, dsn.data)
+		}
+	}
+	waitEmpty(t, q.Store)
+}
+
+func TestQueue_tlsReport(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 1)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+	host, port, _ := net.SplitHostPort(addr)
+
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sessions := make(chan *smtptlsrpt.Session, 10)
+	q := &smtpqueue.Queue{
+		Store:    &smtpqueue.FileStore{Dir: dir},
+		Hostname: "mx.example.org",
+		Port:     port,
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return []*net.MX{{Host: host + ".", Pref: 10}}, nil
+		},
+		// The server doesn't support STARTTLS
+		TLSConfig:     &tls.Config{},
+		TLSReport:     func(s *smtptlsrpt.Session) { sessions <- s },
+		MinRetryDelay: time.Hour,
+	}
+	stop := run(t, q)
+	defer stop()
+
+	rcpts := []*smtpqueue.Recipient{{Addr: "root@example.org"}}
+	if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	select {
+	case s := <-sessions:
+		want := &smtptlsrpt.Session{
+			PolicyDomain:        "example.org",
+			PolicyType:          smtptlsrpt.PolicyNoPolicyFound,
+			ReceivingMXHostname: host,
+			ReceivingIP:         net.ParseIP(host),
+			Result:              smtptlsrpt.ResultSTARTTLSNotSupported,
+			FailureReason:       smtp.ErrStartTLSUnsupported.Error(),
+		}
+		if !reflect.DeepEqual(s, want) {
+			t.Errorf("session = %+v, want %+v", s, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a TLS session report")
+	}
+}
+
+// chanJournal sends recorded events to a channel.
+type chanJournal chan *smtpqueue.Event
+
+func (j chanJournal) Record(ev *smtpqueue.Event) error {
+	j <- ev
+	return nil
+}
+
+func (j chanJournal) History(id string) ([]*smtpqueue.Event, error) {
+	return nil, nil
+}
+
+func TestQueue_tlsVerify(t *testing.T) {
+	serverConfig, clientConfig, err := smtptest.NewTLSConfig("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.ServerName = ""
+
+	for _, tc := range []struct {
+		mode  smtp.TLSVerifyMode
+		typ   smtpqueue.EventType
+		name  string
+		error bool
+	}{
+		// The certificate isn't valid for the mail exchanger host name
+		{smtp.TLSVerifyHostname, smtpqueue.EventDeferred, "", true},
+		{smtp.TLSVerifyNames, smtpqueue.EventDelivered, "example.org", false},
+		{smtp.TLSVerifyInsecure, smtpqueue.EventDelivered, "", true},
+	} {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			be := &backend{msgs: make(chan *message, 1)}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := smtp.NewServer(be)
+			s.TLSConfig = serverConfig
+			go s.Serve(l)
+			defer s.Close()
+			host, port, _ := net.SplitHostPort(l.Addr().String())
+
+			dir, err := ioutil.TempDir("", "smtpqueue-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			journal := make(chanJournal, 10)
+			q := &smtpqueue.Queue{
+				Store: &smtpqueue.FileStore{Dir: dir},
+				Port:  port,
+				LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+					return []*net.MX{{Host: host + ".", Pref: 10}}, nil
+				},
+				TLSConfig:     clientConfig,
+				TLSVerify:     tc.mode,
+				Journal:       journal,
+				MinRetryDelay: time.Hour,
+			}
+			stop := run(t, q)
+			defer stop()
+
+			rcpts := []*smtpqueue.Recipient{{Addr: "root@example.org"}}
+			if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+				t.Fatalf("Enqueue() = %v", err)
+			}
+
+			for {
+				var ev *smtpqueue.Event
+				select {
+				case ev = <-journal:
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the outcome of the attempt")
+				}
+				if ev.Type == smtpqueue.EventAccepted || ev.Type == smtpqueue.EventAttempt {
+					continue
+				}
+				if ev.Type != tc.typ || ev.TLSVerify != tc.mode.String() || ev.TLSVerifiedName != tc.name || (ev.TLSError != "") != tc.error {
+					t.Errorf("event = %+v, want %v with verified name %q, error %v", ev, tc.typ, tc.name, tc.error)
+				}
+				break
+			}
+		})
+	}
+}
+
+func TestQueue_noSuchDomain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notFound := func(name string) error {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	journal := make(chanJournal, 10)
+	q := &smtpqueue.Queue{
+		Store: &smtpqueue.FileStore{Dir: dir},
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			return nil, notFound(name)
+		},
+		LookupHost: func(ctx context.Context, host string) ([]string, error) {
+			return nil, notFound(host)
+		},
+		Journal:       journal,
+		MinRetryDelay: time.Hour,
+	}
+	stop := run(t, q)
+	defer stop()
+
+	rcpts := []*smtpqueue.Recipient{{Addr: "root@nx.example.org"}}
+	if _, err := q.Enqueue("", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	for {
+		var ev *smtpqueue.Event
+		select {
+		case ev = <-journal:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the outcome of the attempt")
+		}
+		if ev.Type == smtpqueue.EventAccepted || ev.Type == smtpqueue.EventAttempt {
+			continue
+		}
+		if ev.Type != smtpqueue.EventBounced || ev.Code != 550 || ev.EnhancedCode != (smtp.EnhancedCode{5, 1, 2}) {
+			t.Errorf("event = %+v, want a 550 5.1.2 bounce", ev)
+		}
+		break
+	}
+}
+
+func TestQueue_addressLiteral(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 1)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+	host, port, _ := net.SplitHostPort(addr)
+
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := &smtpqueue.Queue{
+		Store:    &smtpqueue.FileStore{Dir: dir},
+		Hostname: "192.0.2.1",
+		Port:     port,
+		LookupMX: func(ctx context.Context, name string) ([]*net.MX, error) {
+			t.Errorf("LookupMX(%q) called for an address literal", name)
+			return nil, errors.New("unexpected lookup")
+		},
+	}
+	stop := run(t, q)
+	defer stop()
+
+	rcpt := "root@[" + host + "]"
+	rcpts := []*smtpqueue.Recipient{{Addr: rcpt}}
+	if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	msg := receive(t, be.msgs)
+	if len(msg.to) != 1 || msg.to[0] != rcpt {
+		t.Errorf("recipients = %v, want %v", msg.to, rcpt)
+	}
+	waitEmpty(t, q.Store)
+
+	be.mu.Lock()
+	helo := be.helo
+	be.mu.Unlock()
+	if helo != "[192.0.2.1]" {
+		t.Errorf("EHLO %v, want [192.0.2.1]", helo)
+	}
+}
+
+func TestQueue_reuse(t *testing.T) {
+	for _, tc := range []struct {
+		maxMsgs, sessions int
+	}{
+		{0, 1},
+		{2, 2},
+		{-1, 5},
+	} {
+		be := &backend{msgs: make(chan *message, 5)}
+		addr, closeServer := serve(t, be)
+
+		dir, err := ioutil.TempDir("", "smtpqueue-")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := &smtpqueue.Queue{
+			Store:                 &smtpqueue.FileStore{Dir: dir},
+			Hostname:              "mx.example.org",
+			Relay:                 addr,
+			MaxPerDestination:     1,
+			MaxMessagesPerSession: tc.maxMsgs,
+		}
+		// The rejected message leaves the connection usable
+		for _, to := range []string{"a@example.org", "nobody@example.org", "b@example.org", "c@example.net", "d@example.org"} {
+			rcpts := []*smtpqueue.Recipient{{Addr: to}}
+			if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+				t.Fatalf("Enqueue() = %v", err)
+			}
+		}
+		stop := run(t, q)
+
+		for i := 0; i < 4; i++ {
+			receive(t, be.msgs)
+		}
+		// Wait for the bounce of the rejected message
+		receive(t, be.msgs)
+		waitEmpty(t, q.Store)
+		stop()
+
+		be.mu.Lock()
+		// The bounce is sent over a new connection or a reused one
+		if be.sessions != tc.sessions && be.sessions != tc.sessions+1 {
+			t.Errorf("MaxMessagesPerSession = %v: got %v sessions, want %v", tc.maxMsgs, be.sessions, tc.sessions)
+		}
+		be.mu.Unlock()
+		closeServer()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQueue_priority(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name string
+		// Priorities of the messages, queued gap apart
+		priorities []int
+		gap        time.Duration
+		want       []int
+	}{
+		{"order", []int{-5, 0, 5, 0}, time.Minute, []int{5, 0, 0, -5}},
+		// After an hour, the first message is raised to 1
+		{"aging", []int{-5, 0}, time.Hour, []int{-5, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			be := &backend{msgs: make(chan *message, len(tc.priorities))}
+			addr, closeServer := serve(t, be)
+			defer closeServer()
+
+			dir, err := ioutil.TempDir("", "smtpqueue-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			clock := smtptest.NewFakeClock(start)
+			q := &smtpqueue.Queue{
+				Store:                 &smtpqueue.FileStore{Dir: dir},
+				Hostname:              "mx.example.org",
+				Relay:                 addr,
+				MaxConcurrency:        1,
+				MaxMessagesPerSession: -1,
+				Clock:                 clock,
+			}
+			for i, p := range tc.priorities {
+				if i > 0 {
+					clock.Advance(tc.gap)
+				}
+				p := p
+				opts := &smtp.MailOptions{MTPriority: &p}
+				rcpts := []*smtpqueue.Recipient{{Addr: "root@example.org"}}
+				if _, err := q.Enqueue("alice@example.com", opts, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+					t.Fatalf("Enqueue() = %v", err)
+				}
+			}
+			stop := run(t, q)
+			defer stop()
+
+			for i, want := range tc.want {
+				msg := receive(t, be.msgs)
+				if p := msg.mailOpts.MTPriority; p == nil {
+					t.Errorf("message #%v: no MT-PRIORITY, want %v", i, want)
+				} else if *p != want {
+					t.Errorf("message #%v: MT-PRIORITY = %v, want %v", i, *p, want)
+				}
+			}
+			waitEmpty(t, q.Store)
+		})
+	}
+}
+
+func TestQueue_priorityDeferred(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 2)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := smtptest.NewFakeClock(start)
+	store := &smtpqueue.FileStore{Dir: dir}
+	q := &smtpqueue.Queue{Store: store, Clock: clock}
+	rcpts := []*smtpqueue.Recipient{{Addr: "dead@example.org"}}
+	if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	// The first message has been deferred for hours, and is due again
+	msgs, err := store.List()
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("List() = %v, %v", msgs, err)
+	}
+	clock.Advance(3 * time.Hour)
+	msgs[0].Recipients[0].Attempts = 5
+	msgs[0].Recipients[0].NextAttempt = clock.Now()
+	if err := store.Update(msgs[0]); err != nil {
+		t.Fatalf("Update() = %v", err)
+	}
+
+	p := 1
+	rcpts = []*smtpqueue.Recipient{{Addr: "root@example.org"}}
+	if _, err := q.Enqueue("alice@example.com", &smtp.MailOptions{MTPriority: &p}, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	stop := run(t, &smtpqueue.Queue{
+		Store:                 store,
+		Relay:                 addr,
+		MaxConcurrency:        1,
+		MaxMessagesPerSession: -1,
+		Clock:                 clock,
+	})
+	defer stop()
+
+	for _, want := range []string{"root@example.org", "dead@example.org"} {
+		if msg := receive(t, be.msgs); len(msg.to) != 1 || msg.to[0] != want {
+			t.Errorf("delivered to %v, want %v", msg.to, want)
+		}
+	}
+	waitEmpty(t, store)
+}
+
+func TestQueue_SetPriority(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 2)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := &smtpqueue.Queue{
+		Store:                 &smtpqueue.FileStore{Dir: dir},
+		Hostname:              "mx.example.org",
+		Relay:                 addr,
+		MaxConcurrency:        1,
+		MaxMessagesPerSession: -1,
+	}
+	var ids []string
+	for _, to := range []string{"first@example.org", "second@example.org"} {
+		rcpts := []*smtpqueue.Recipient{{Addr: to}}
+		id, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n"))
+		if err != nil {
+			t.Fatalf("Enqueue() = %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := q.SetPriority(ids[1], 10); err == nil {
+		t.Errorf("SetPriority(10) = nil, want error")
+	}
+	if err := q.SetPriority(ids[1], 3); err != nil {
+		t.Fatalf("SetPriority() = %v", err)
+	}
+	if msg, err := q.Message(ids[1]); err != nil || msg.Priority() != 3 {
+		t.Fatalf("Message() = %v, %v, want priority 3", msg, err)
+	}
+
+	stop := run(t, q)
+	defer stop()
+
+	msg := receive(t, be.msgs)
+	if len(msg.to) != 1 || msg.to[0] != "second@example.org" {
+		t.Errorf("first delivery to %v, want second@example.org", msg.to)
+	}
+	if p := msg.mailOpts.MTPriority; p == nil || *p != 3 {
+		t.Errorf("MT-PRIORITY not propagated, want 3")
+	}
+	receive(t, be.msgs)
+	waitEmpty(t, q.Store)
+}
+
+func TestQueue_suppressions(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 2)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := &smtpqueue.Queue{
+		Store:    &smtpqueue.FileStore{Dir: filepath.Join(dir, "queue")},
+		Hostname: "mx.example.org",
+		Relay:    addr,
+		Suppressions: &smtpqueue.SuppressionList{
+			Store: &smtpqueue.FileSuppressionStore{Path: filepath.Join(dir, "suppressions.json")},
+		},
+	}
+	stop := run(t, q)
+	defer stop()
+
+	rcpts := []*smtpqueue.Recipient{{Addr: "nobody@example.org"}}
+	if _, err := q.Enqueue("", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	waitEmpty(t, q.Store)
+
+	sups, err := q.Suppressions.List()
+	if err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	if len(sups) != 1 || sups[0].Addr != "nobody@example.org" || sups[0].Code != 550 || sups[0].ExpiresAt.IsZero() {
+		t.Fatalf("List() = %+v, want nobody@example.org rejected with 550", sups)
+	}
+
+	be.mu.Lock()
+	sessions := be.sessions
+	be.mu.Unlock()
+
+	rcpts = []*smtpqueue.Recipient{{Addr: "Nobody@example.org"}}
+	if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	dsn := receive(t, be.msgs)
+	if len(dsn.to) != 1 || dsn.to[0] != "alice@example.com" {
+		t.Errorf("DSN to = %v, want [alice@example.com]", dsn.to)
+	}
+	for _, s := range []string{
+		"Final-Recipient: rfc822; Nobody@example.org",
+		"Status: 5.1.1",
+		"suppressed",
+	} {
+		if !strings.Contains(dsn.data, s) {
+			t.Errorf("DSN doesn't contain %q:\n%v", s, dsn.data)
+		}
+	}
+	waitEmpty(t, q.Store)
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	// Only the DSN was sent
+	if be.sessions != sessions+1 {
+		t.Errorf("%v sessions for a suppressed recipient, want none", be.sessions-sessions-1)
+	}
+}
+
+func TestQueue_deadLetter(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 1)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := &smtpqueue.Queue{
+		Store:      &smtpqueue.FileStore{Dir: filepath.Join(dir, "queue")},
+		DeadLetter: &smtpqueue.FileStore{Dir: filepath.Join(dir, "dead")},
+		Hostname:   "mx.example.org",
+		Relay:      addr,
+	}
+	stop := run(t, q)
+	defer stop()
+
+	rcpts := []*smtpqueue.Recipient{{Addr: "nobody@example.org"}}
+	body := "Subject: Undelivered Mail Returned to Sender\r\n\r\nOops\r\n"
+	id, err := q.Enqueue("", nil, rcpts, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	waitEmpty(t, q.Store)
+
+	msgs, err := q.DeadLetter.List()
+	if err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].ID != id || msgs[0].Recipients[0].Status != smtpqueue.StatusFailed {
+		t.Fatalf("dead letters = %+v, want message %v", msgs, id)
+	}
+	r, err := q.DeadLetter.Open(id)
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	defer r.Close()
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != body {
+		t.Errorf("dead letter body = %q, %v, want %q", b, err, body)
+	}
+
+	// Messages with a sender are reported instead
+	if _, err := q.Enqueue("alice@example.com", nil, rcpts, strings.NewReader(body)); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	receive(t, be.msgs)
+	waitEmpty(t, q.Store)
+	if msgs, err := q.DeadLetter.List(); err != nil || len(msgs) != 1 {
+		t.Errorf("List() = %v messages, %v, want 1", len(msgs), err)
+	}
+}
+
+func TestQueue_signSender(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 2)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	signer := &smtpbatv.Signer{Keys: [][]byte{[]byte("secret")}}
+	q := &smtpqueue.Queue{
+		Store:      &smtpqueue.FileStore{Dir: dir},
+		Hostname:   "mx.example.org",
+		Relay:      addr,
+		SignSender: signer.Sign,
+	}
+	stop := run(t, q)
+	defer stop()
+
+	rcpts := []*smtpqueue.Recipient{{Addr: "root@example.org"}}
+	for _, from := range []string{"alice@example.com", ""} {
+		if _, err := q.Enqueue(from, nil, rcpts, strings.NewReader("Hey <3\r\n")); err != nil {
+			t.Fatalf("Enqueue() = %v", err)
+		}
+		msg := receive(t, be.msgs)
+		if from == "" {
+			if msg.from != "" {
+				t.Errorf("from = %q, want the null sender", msg.from)
+			}
+			continue
+		}
+		if orig, err := signer.Verify(msg.from); err != nil || orig != from {
+			t.Errorf("Verify(%q) = %q, %v, want %q", msg.from, orig, err, from)
+		}
+	}
+	waitEmpty(t, q.Store)
+}
@@ -0,0 +1,61 @@
+package smtpqueue
+
+import (
+	"io"
+
+	"github.com/emersion/go-smtp"
+)
+
+// NewSession implements smtp.Backend. Sessions queue the messages they
+// receive for all recipients.
+func (q *Queue) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{queue: q, connID: c.ID()}, nil
+}
+
+type session struct {
+	queue  *Queue
+	connID string
+	from   string
+	opts   *smtp.MailOptions
+	rcpts  []*Recipient
+}
+
+var _ smtp.Session = (*session)(nil)
+
+func (s *session) Reset() {
+	s.from, s.opts, s.rcpts = "", nil, nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.from, s.opts = from, opts
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if l := s.queue.Suppressions; l != nil {
+		sup, err := l.Lookup(to)
+		if err != nil {
+			return smtp.TempError(err, 4, 3, 0, "Failed to look up recipient")
+		} else if sup != nil {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				Message:      "Recipient address suppressed after a previous failure",
+			}
+		}
+	}
+	s.rcpts = append(s.rcpts, &Recipient{Addr: to, Options: opts})
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	_, err := s.queue.enqueue(s.from, s.opts, s.rcpts, r, s.connID)
+	if err != nil {
+		return smtp.TempError(err, 4, 3, 0, "Failed to queue message")
+	}
+	return nil
+}
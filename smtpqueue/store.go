@@ -0,0 +1,146 @@
+package smtpqueue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Store persists queued messages.
+type Store interface {
+	// Put stores a new message and its body.
+	Put(msg *Message, body io.Reader) error
+	// Update stores the new delivery state of a message.
+	Update(msg *Message) error
+	// Open opens the body of a message.
+	Open(id string) (io.ReadCloser, error)
+	// Delete removes a message and its body.
+	Delete(id string) error
+	// List returns all stored messages.
+	List() ([]*Message, error)
+}
+
+// FileStore stores messages in a directory. Each message is kept in two
+// files: "<id>.json" with the envelope and delivery state, and "<id>.eml" with
+// the body. Files are replaced atomically.
+type FileStore struct {
+	Dir string
+}
+
+var _ Store = (*FileStore)(nil)
+
+func (s *FileStore) path(id, ext string) (string, error) {
+	if !validID(id) {
+		return "", fmt.Errorf("smtpqueue: invalid message ID %q", id)
+	}
+	return filepath.Join(s.Dir, id+ext), nil
+}
+
+// writeFile atomically replaces the file at path with the contents of r.
+func writeFile(path string, r io.Reader) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func (s *FileStore) writeMessage(msg *Message) error {
+	path, err := s.path(msg.ID, ".json")
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, bytes.NewReader(b))
+}
+
+// Put implements Store.
+func (s *FileStore) Put(msg *Message, body io.Reader) error {
+	path, err := s.path(msg.ID, ".eml")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	// The message only exists once its envelope is written
+	if err := writeFile(path, body); err != nil {
+		return err
+	}
+	if err := s.writeMessage(msg); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// Update implements Store.
+func (s *FileStore) Update(msg *Message) error {
+	return s.writeMessage(msg)
+}
+
+// Open implements Store.
+func (s *FileStore) Open(id string) (io.ReadCloser, error) {
+	path, err := s.path(id, ".eml")
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Delete implements Store.
+func (s *FileStore) Delete(id string) error {
+	jsonPath, err := s.path(id, ".json")
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(jsonPath); err != nil {
+		return err
+	}
+	emlPath, _ := s.path(id, ".eml")
+	if err := os.Remove(emlPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List implements Store.
+func (s *FileStore) List() ([]*Message, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*Message
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		msg := new(Message)
+		if err := json.Unmarshal(b, msg); err != nil {
+			return nil, fmt.Errorf("smtpqueue: failed to read %v: %v", path, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
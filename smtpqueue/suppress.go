@@ -0,0 +1,485 @@
+package smtpqueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+const defaultSuppressionTTL = 30 * 24 * time.Hour
+
+// ErrSuppressed is returned by SuppressionList.SendMail when all recipients
+// are suppressed.
+var ErrSuppressed = errors.New("smtpqueue: all recipients are suppressed")
+
+// Suppression is a recipient address mail isn't sent to anymore, because
+// it bounced.
+type Suppression struct {
+	// Address, in lower case.
+	Addr string
+	// Time the address was suppressed at.
+	CreatedAt time.Time
+	// Time after which the address isn't suppressed anymore. Zero if the
+	// suppression doesn't expire.
+	ExpiresAt time.Time `json:",omitempty"`
+
+	// Failure which caused the suppression, as in Recipient.
+	Code         int               `json:",omitempty"`
+	EnhancedCode smtp.EnhancedCode `json:",omitempty"`
+	Error        string            `json:",omitempty"`
+}
+
+func (s *Suppression) expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+// SuppressionStore persists suppressed addresses.
+type SuppressionStore interface {
+	// Get returns the suppression of an address, or nil if there is none.
+	Get(addr string) (*Suppression, error)
+	// Put adds or replaces the suppression of an address.
+	Put(s *Suppression) error
+	// Delete removes the suppression of an address, if any.
+	Delete(addr string) error
+	// List returns all stored suppressions.
+	List() ([]*Suppression, error)
+}
+
+// FileSuppressionStore stores suppressions in a JSON file. The file is read
+// once, and replaced atomically on each change.
+type FileSuppressionStore struct {
+	Path string
+
+	mu      sync.Mutex
+	entries map[string]*Suppression // nil until loaded
+}
+
+var _ SuppressionStore = (*FileSuppressionStore)(nil)
+
+// load reads the file. The caller must hold s.mu.
+func (s *FileSuppressionStore) load() error {
+	if s.entries != nil {
+		return nil
+	}
+	entries := make(map[string]*Suppression)
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		s.entries = entries
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var l []*Suppression
+	if err := json.Unmarshal(b, &l); err != nil {
+		return fmt.Errorf("smtpqueue: failed to read %v: %v", s.Path, err)
+	}
+	for _, sup := range l {
+		entries[sup.Addr] = sup
+	}
+	s.entries = entries
+	return nil
+}
+
+// save writes the file. The caller must hold s.mu.
+func (s *FileSuppressionStore) save() error {
+	l := s.list()
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(s.Path, bytes.NewReader(b)); err != nil {
+		// Reload the file on the next call
+		s.entries = nil
+		return err
+	}
+	return nil
+}
+
+// list returns copies of the entries, by address. The caller must hold s.mu.
+func (s *FileSuppressionStore) list() []*Suppression {
+	l := make([]*Suppression, 0, len(s.entries))
+	for _, sup := range s.entries {
+		supCopy := *sup
+		l = append(l, &supCopy)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Addr < l[j].Addr
+	})
+	return l
+}
+
+// Get implements SuppressionStore.
+func (s *FileSuppressionStore) Get(addr string) (*Suppression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	sup, ok := s.entries[addr]
+	if !ok {
+		return nil, nil
+	}
+	supCopy := *sup
+	return &supCopy, nil
+}
+
+// Put implements SuppressionStore.
+func (s *FileSuppressionStore) Put(sup *Suppression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	supCopy := *sup
+	s.entries[sup.Addr] = &supCopy
+	return s.save()
+}
+
+// Delete implements SuppressionStore.
+func (s *FileSuppressionStore) Delete(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if _, ok := s.entries[addr]; !ok {
+		return nil
+	}
+	delete(s.entries, addr)
+	return s.save()
+}
+
+// List implements SuppressionStore.
+func (s *FileSuppressionStore) List() ([]*Suppression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s.list(), nil
+}
+
+// SuppressionList keeps track of recipient addresses which hard-bounced, so
+// that mail isn't sent to them again for a while. Sending to invalid
+// addresses over and over hurts the reputation of the sender.
+//
+// A Queue with a SuppressionList fails suppressed recipients without
+// connecting to their destination, and suppresses the recipients rejected
+// with a hard bounce. Bounces received by the sender can be fed to
+// ProcessDSN.
+type SuppressionList struct {
+	// Persists suppressed addresses. Required.
+	Store SuppressionStore
+	// Time after which suppressions expire. If zero, 30 days is used. If
+	// negative, suppressions don't expire.
+	TTL time.Duration
+	// Source of the current time. If nil, smtp.SystemClock is used.
+	Clock smtp.Clock
+}
+
+func (l *SuppressionList) now() time.Time {
+	if l.Clock == nil {
+		return smtp.SystemClock.Now()
+	}
+	return l.Clock.Now()
+}
+
+func normalizeAddr(addr string) string {
+	return strings.ToLower(addr)
+}
+
+// isHardBounce reports whether a recipient failure with the enhanced status
+// code code means that the address doesn't exist or doesn't receive mail.
+// Other permanent failures, e.g. policy rejections, may not happen again.
+func isHardBounce(code smtp.EnhancedCode) bool {
+	switch code {
+	case smtp.EnhancedCode{5, 1, 1}, // Bad destination mailbox address
+		smtp.EnhancedCode{5, 1, 2},  // Bad destination system address
+		smtp.EnhancedCode{5, 1, 3},  // Bad destination mailbox address syntax
+		smtp.EnhancedCode{5, 1, 6},  // Destination mailbox has moved
+		smtp.EnhancedCode{5, 1, 10}, // Recipient address has null MX
+		smtp.EnhancedCode{5, 2, 1}:  // Mailbox disabled
+		return true
+	default:
+		return false
+	}
+}
+
+// Lookup returns the suppression of an address, or nil if it isn't
+// suppressed. Expired suppressions are removed.
+func (l *SuppressionList) Lookup(addr string) (*Suppression, error) {
+	addr = normalizeAddr(addr)
+	sup, err := l.Store.Get(addr)
+	if err != nil || sup == nil {
+		return nil, err
+	}
+	if sup.expired(l.now()) {
+		return nil, l.Store.Delete(addr)
+	}
+	return sup, nil
+}
+
+// Add suppresses an address. CreatedAt and ExpiresAt are set from TTL if
+// zero.
+func (l *SuppressionList) Add(sup *Suppression) error {
+	supCopy := *sup
+	supCopy.Addr = normalizeAddr(sup.Addr)
+	if supCopy.CreatedAt.IsZero() {
+		supCopy.CreatedAt = l.now()
+	}
+	if supCopy.ExpiresAt.IsZero() {
+		ttl := l.TTL
+		if ttl == 0 {
+			ttl = defaultSuppressionTTL
+		}
+		if ttl > 0 {
+			supCopy.ExpiresAt = supCopy.CreatedAt.Add(ttl)
+		}
+	}
+	return l.Store.Put(&supCopy)
+}
+
+// Remove lifts the suppression of an address, if any.
+func (l *SuppressionList) Remove(addr string) error {
+	return l.Store.Delete(normalizeAddr(addr))
+}
+
+// List returns the suppressions which haven't expired, by address.
+func (l *SuppressionList) List() ([]*Suppression, error) {
+	all, err := l.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	now := l.now()
+	var sups []*Suppression
+	for _, sup := range all {
+		if !sup.expired(now) {
+			sups = append(sups, sup)
+		}
+	}
+	sort.Slice(sups, func(i, j int) bool {
+		return sups[i].Addr < sups[j].Addr
+	})
+	return sups, nil
+}
+
+// Expire removes the expired suppressions from the store, and returns their
+// number.
+func (l *SuppressionList) Expire() (int, error) {
+	all, err := l.Store.List()
+	if err != nil {
+		return 0, err
+	}
+	now := l.now()
+	n := 0
+	for _, sup := range all {
+		if !sup.expired(now) {
+			continue
+		}
+		if err := l.Store.Delete(sup.Addr); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// filter returns the addresses of to which aren't suppressed.
+func (l *SuppressionList) filter(to []string) ([]string, error) {
+	var allowed []string
+	for _, addr := range to {
+		sup, err := l.Lookup(addr)
+		if err != nil {
+			return nil, err
+		}
+		if sup == nil {
+			allowed = append(allowed, addr)
+		}
+	}
+	return allowed, nil
+}
+
+// SendMail works like smtp.SendMail, but skips suppressed recipients.
+// ErrSuppressed is returned if all of them are.
+func (l *SuppressionList) SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader) error {
+	to, err := l.filter(to)
+	if err != nil {
+		return err
+	} else if len(to) == 0 {
+		return ErrSuppressed
+	}
+	return smtp.SendMail(addr, a, from, to, r)
+}
+
+// SendMailTLS works like SendMail, but with implicit TLS.
+func (l *SuppressionList) SendMailTLS(addr string, a sasl.Client, from string, to []string, r io.Reader) error {
+	to, err := l.filter(to)
+	if err != nil {
+		return err
+	} else if len(to) == 0 {
+		return ErrSuppressed
+	}
+	return smtp.SendMailTLS(addr, a, from, to, r)
+}
+
+// ProcessDSN reads a delivery status notification, as defined in RFC 3464,
+// and suppresses the recipients it reports as hard bounces. It returns the
+// number of suppressed recipients.
+//
+// It's meant to process the bounces received for the messages sent, e.g. by
+// the backend of the server receiving mail for the sender addresses.
+func (l *SuppressionList) ProcessDSN(r io.Reader) (int, error) {
+	rcpts, err := parseDSN(r)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, rcpt := range rcpts {
+		if rcpt.Status != StatusFailed || !isHardBounce(rcpt.EnhancedCode) {
+			continue
+		}
+		err := l.Add(&Suppression{
+			Addr:         rcpt.Addr,
+			Code:         rcpt.Code,
+			EnhancedCode: rcpt.EnhancedCode,
+			Error:        rcpt.Error,
+		})
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// parseDSN returns the recipients reported by a delivery status
+// notification. Only their address, status and failure are set.
+func parseDSN(r io.Reader) ([]*Recipient, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	header, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("smtpqueue: failed to read DSN header: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, errors.New("smtpqueue: not a multipart/report message")
+	}
+
+	mr := multipart.NewReader(tr.R, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("smtpqueue: missing delivery status in DSN")
+		} else if err != nil {
+			return nil, fmt.Errorf("smtpqueue: failed to read DSN: %v", err)
+		}
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if mediaType == "message/delivery-status" || mediaType == "message/global-delivery-status" {
+			return parseDeliveryStatus(p)
+		}
+	}
+}
+
+// parseDeliveryStatus parses the fields of a message/delivery-status part:
+// the per-message fields, followed by the fields of each recipient.
+func parseDeliveryStatus(r io.Reader) ([]*Recipient, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	if _, err := tr.ReadMIMEHeader(); err != nil {
+		return nil, fmt.Errorf("smtpqueue: failed to read DSN fields: %v", err)
+	}
+
+	var rcpts []*Recipient
+	for {
+		fields, err := tr.ReadMIMEHeader()
+		if len(fields) > 0 {
+			if rcpt := parseRecipientStatus(fields); rcpt != nil {
+				rcpts = append(rcpts, rcpt)
+			}
+		}
+		if err == io.EOF {
+			return rcpts, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("smtpqueue: failed to read DSN fields: %v", err)
+		}
+	}
+}
+
+// parseRecipientStatus parses the per-recipient fields of a DSN. It returns
+// nil if they don't include a valid address and status.
+func parseRecipientStatus(fields textproto.MIMEHeader) *Recipient {
+	addr := parseTypedAddress(fields.Get("Final-Recipient"))
+	code, err := smtp.ParseEnhancedCode(strings.TrimSpace(fields.Get("Status")))
+	if addr == "" || err != nil {
+		return nil
+	}
+
+	rcpt := &Recipient{Addr: addr, Status: StatusPending, EnhancedCode: code}
+	switch strings.ToLower(strings.TrimSpace(fields.Get("Action"))) {
+	case "failed":
+		rcpt.Status = StatusFailed
+	case "delivered", "relayed", "expanded":
+		rcpt.Status = StatusDelivered
+	}
+
+	// e.g. "smtp; 550 5.1.1 No such user"
+	diagType, diag, ok := strings.Cut(fields.Get("Diagnostic-Code"), ";")
+	if ok && strings.EqualFold(strings.TrimSpace(diagType), "smtp") {
+		diag = strings.TrimSpace(diag)
+		if s, rest, _ := strings.Cut(diag, " "); len(s) == 3 {
+			if n, err := strconv.Atoi(s); err == nil {
+				rcpt.Code, diag = n, rest
+				if s, rest, _ := strings.Cut(diag, " "); s == code.String() {
+					diag = rest
+				}
+			}
+		}
+		rcpt.Error = diag
+	}
+	return rcpt
+}
+
+// parseTypedAddress parses an address field of a DSN, of the "rfc822" or
+// "utf-8" type (RFC 6533). UTF-8 addresses may be encoded, e.g. in
+// message/delivery-status parts, or not, in
+// message/global-delivery-status parts. It returns an empty string for other
+// types.
+func parseTypedAddress(v string) string {
+	addrType, addr, ok := strings.Cut(v, ";")
+	if !ok {
+		return ""
+	}
+	addr = strings.Trim(strings.TrimSpace(addr), "<>")
+	switch smtp.DSNAddressType(strings.ToUpper(strings.TrimSpace(addrType))) {
+	case smtp.DSNAddressTypeRFC822:
+		return addr
+	case smtp.DSNAddressTypeUTF8:
+		if strings.Contains(addr, `\x{`) {
+			if decoded, err := smtp.DecodeUTF8AddrXtext(addr); err == nil {
+				return decoded
+			}
+		}
+		return addr
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,198 @@
+package smtpqueue_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtpqueue"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+func testSuppressionList(t *testing.T) (l *smtpqueue.SuppressionList, clock *smtptest.FakeClock, cleanup func()) {
+	dir, err := ioutil.TempDir("", "smtpqueue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock = smtptest.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l = &smtpqueue.SuppressionList{
+		Store: &smtpqueue.FileSuppressionStore{Path: filepath.Join(dir, "suppressions.json")},
+		TTL:   24 * time.Hour,
+		Clock: clock,
+	}
+	return l, clock, func() { os.RemoveAll(dir) }
+}
+
+func TestSuppressionList(t *testing.T) {
+	l, clock, cleanup := testSuppressionList(t)
+	defer cleanup()
+
+	if err := l.Add(&smtpqueue.Suppression{Addr: "Nobody@example.org", Code: 550}); err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+	clock.Advance(time.Hour)
+	if err := l.Add(&smtpqueue.Suppression{Addr: "gone@example.org"}); err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+
+	sup, err := l.Lookup("nobody@EXAMPLE.org")
+	if err != nil || sup == nil || sup.Code != 550 {
+		t.Fatalf("Lookup() = %+v, %v, want a suppression", sup, err)
+	}
+	if sup, err := l.Lookup("root@example.org"); err != nil || sup != nil {
+		t.Errorf("Lookup() = %+v, %v, want nil", sup, err)
+	}
+
+	// The store is persisted
+	store := &smtpqueue.FileSuppressionStore{Path: l.Store.(*smtpqueue.FileSuppressionStore).Path}
+	if all, err := store.List(); err != nil || len(all) != 2 {
+		t.Fatalf("FileSuppressionStore.List() = %v entries, %v, want 2", len(all), err)
+	}
+
+	clock.Advance(23 * time.Hour)
+	if sup, err := l.Lookup("nobody@example.org"); err != nil || sup != nil {
+		t.Errorf("Lookup() after expiry = %+v, %v, want nil", sup, err)
+	}
+	if sups, err := l.List(); err != nil || len(sups) != 1 || sups[0].Addr != "gone@example.org" {
+		t.Errorf("List() = %+v, %v, want gone@example.org", sups, err)
+	}
+
+	clock.Advance(time.Hour)
+	if n, err := l.Expire(); err != nil || n != 1 {
+		t.Errorf("Expire() = %v, %v, want 1", n, err)
+	}
+	if all, err := l.Store.List(); err != nil || len(all) != 0 {
+		t.Errorf("Store.List() = %v entries, %v, want none", len(all), err)
+	}
+
+	if err := l.Add(&smtpqueue.Suppression{Addr: "gone@example.org"}); err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+	if err := l.Remove("GONE@example.org"); err != nil {
+		t.Fatalf("Remove() = %v", err)
+	}
+	if sup, err := l.Lookup("gone@example.org"); err != nil || sup != nil {
+		t.Errorf("Lookup() after Remove() = %+v, %v, want nil", sup, err)
+	}
+}
+
+const testDSN = "From: Mail Delivery System <MAILER-DAEMON@mx.example.org>\r\n" +
+	"To: <alice@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b\"\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; nobody@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 No such user\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; spam@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.7.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.7.1 Message refused\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; full@example.org\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.2.2\r\n" +
+	"--b--\r\n"
+
+func TestSuppressionList_ProcessDSN(t *testing.T) {
+	l, _, cleanup := testSuppressionList(t)
+	defer cleanup()
+
+	n, err := l.ProcessDSN(strings.NewReader(testDSN))
+	if err != nil || n != 1 {
+		t.Fatalf("ProcessDSN() = %v, %v, want 1", n, err)
+	}
+	sups, err := l.List()
+	if err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	want := smtpqueue.Suppression{
+		Addr:         "nobody@example.org",
+		CreatedAt:    sups[0].CreatedAt,
+		ExpiresAt:    sups[0].CreatedAt.Add(24 * time.Hour),
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Error:        "No such user",
+	}
+	if len(sups) != 1 || *sups[0] != want {
+		t.Errorf("List() = %+v, want %+v", sups, want)
+	}
+
+	if _, err := l.ProcessDSN(strings.NewReader("Subject: Hey\r\n\r\nHey <3\r\n")); err == nil {
+		t.Errorf("ProcessDSN() = nil for a regular message, want error")
+	}
+}
+
+func TestSuppressionList_ProcessDSN_international(t *testing.T) {
+	l, _, cleanup := testSuppressionList(t)
+	defer cleanup()
+
+	dsn := "MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: message/global-delivery-status\r\n" +
+		"\r\n" +
+		"Reporting-MTA: dns; mx.example.org\r\n" +
+		"\r\n" +
+		"Final-Recipient: utf-8; δοκιμή@example.org\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"\r\n" +
+		"Final-Recipient: utf-8; b\\x{F8}b@example.org\r\n" +
+		"Action: failed\r\n" +
+		"Status: 5.1.1\r\n" +
+		"--b--\r\n"
+	n, err := l.ProcessDSN(strings.NewReader(dsn))
+	if err != nil || n != 2 {
+		t.Fatalf("ProcessDSN() = %v, %v, want 2", n, err)
+	}
+	for _, addr := range []string{"δοκιμή@example.org", "bøb@example.org"} {
+		if sup, err := l.Lookup(addr); err != nil || sup == nil {
+			t.Errorf("Lookup(%q) = %v, %v, want a suppression", addr, sup, err)
+		}
+	}
+}
+
+func TestSuppressionList_SendMail(t *testing.T) {
+	be := &backend{msgs: make(chan *message, 1)}
+	addr, closeServer := serve(t, be)
+	defer closeServer()
+
+	l, _, cleanup := testSuppressionList(t)
+	defer cleanup()
+	if err := l.Add(&smtpqueue.Suppression{Addr: "nobody@example.org"}); err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+
+	to := []string{"nobody@example.org"}
+	if err := l.SendMail(addr, nil, "alice@example.com", to, strings.NewReader("Hey <3\r\n")); err != smtpqueue.ErrSuppressed {
+		t.Errorf("SendMail() = %v, want ErrSuppressed", err)
+	}
+	be.mu.Lock()
+	if be.sessions != 0 {
+		t.Errorf("SendMail() connected for suppressed recipients")
+	}
+	be.mu.Unlock()
+
+	// The test server doesn't support STARTTLS, which SendMail requires
+	to = []string{"nobody@example.org", "root@example.org"}
+	if err := l.SendMail(addr, nil, "alice@example.com", to, strings.NewReader("Hey <3\r\n")); err != smtp.ErrStartTLSUnsupported {
+		t.Errorf("SendMail() = %v, want %v", err, smtp.ErrStartTLSUnsupported)
+	}
+}
@@ -0,0 +1,684 @@
+// Package smtpspf evaluates SPF policies, as defined in RFC 7208.
+//
+// A Checker implements smtp.SPFChecker:
+//
+//	s.SPFChecker = &smtpspf.Checker{}
+//	s.ReceivedSPFHeader = true
+package smtpspf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	// Maximum number of mechanisms and modifiers causing DNS lookups, see
+	// RFC 7208 section 4.6.4.
+	maxLookups = 10
+	// Maximum number of DNS lookups returning no records.
+	maxVoidLookups = 2
+	// Maximum number of names looked up per MX and PTR lookup.
+	maxNameLookups = 10
+)
+
+// Resolver looks up DNS records. *net.Resolver implements Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Checker evaluates the SPF policy of sender domains.
+type Checker struct {
+	// Looks up DNS records. If nil, net.DefaultResolver is used.
+	Resolver Resolver
+
+	// Timeout for all lookups of a check. If zero, 20 seconds is used.
+	Timeout time.Duration
+}
+
+var _ smtp.SPFChecker = (*Checker)(nil)
+
+// CheckSPF implements smtp.SPFChecker. The MAIL FROM identity is checked, or
+// the HELO identity if sender is empty.
+func (c *Checker) CheckSPF(ctx context.Context, ip net.IP, helo, sender string) (smtp.SPFResult, error) {
+	if sender == "" {
+		if helo == "" {
+			return smtp.SPFNone, nil
+		}
+		sender = "postmaster@" + helo
+	}
+	domain := sender
+	if i := strings.LastIndexByte(sender, '@'); i >= 0 {
+		domain = sender[i+1:]
+	}
+	return c.CheckHost(ctx, ip, domain, sender, helo)
+}
+
+// CheckHost implements the check_host() function of RFC 7208 section 4: it
+// evaluates the SPF policy of domain for the client IP address.
+func (c *Checker) CheckHost(ctx context.Context, ip net.IP, domain, sender, helo string) (smtp.SPFResult, error) {
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 20 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	e := &evaluation{
+		ctx:      ctx,
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+	return e.checkHost(domain)
+}
+
+// evaluation holds the state of a check across included policies.
+type evaluation struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+
+	lookups int
+	voids   int
+}
+
+func permError(format string, v ...interface{}) (smtp.SPFResult, error) {
+	return smtp.SPFPermError, fmt.Errorf(format, v...)
+}
+
+func tempError(err error) (smtp.SPFResult, error) {
+	return smtp.SPFTempError, err
+}
+
+func (e *evaluation) checkHost(domain string) (smtp.SPFResult, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !validDomain(domain) {
+		return smtp.SPFNone, nil
+	}
+
+	record, err := e.lookupRecord(domain)
+	if errors.Is(err, errMultipleRecords) {
+		return permError("%v: %v", domain, err)
+	} else if err != nil {
+		return tempError(err)
+	} else if record == "" {
+		return smtp.SPFNone, nil
+	}
+
+	directives, redirect, err := parseRecord(record)
+	if err != nil {
+		return permError("invalid SPF record for %v: %v", domain, err)
+	}
+
+	for _, d := range directives {
+		match, result, err := e.match(domain, d)
+		if result != "" {
+			return result, err
+		}
+		if match {
+			return d.result(), nil
+		}
+	}
+
+	if redirect == "" {
+		return smtp.SPFNeutral, nil
+	}
+	if err := e.countLookup(); err != nil {
+		return permError("%v", err)
+	}
+	target, err := e.expandDomain(redirect, domain)
+	if err != nil {
+		return permError("%v", err)
+	}
+	result, err := e.checkHost(target)
+	if result == smtp.SPFNone {
+		return permError("no SPF record for redirect target %v", target)
+	}
+	return result, err
+}
+
+// lookupRecord returns the SPF record of domain, or an empty string if
+// there is none.
+func (e *evaluation) lookupRecord(domain string) (string, error) {
+	txts, err := e.resolver.LookupTXT(e.ctx, domain)
+	if isNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if len(txt) >= 6 && strings.EqualFold(txt[:6], "v=spf1") && (len(txt) == 6 || txt[6] == ' ') {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", nil
+	case 1:
+		return records[0], nil
+	default:
+		return "", errMultipleRecords
+	}
+}
+
+var errMultipleRecords = errors.New("multiple SPF records")
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func validDomain(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+type directive struct {
+	qualifier byte
+	name      string
+	arg       string
+	hasArg    bool
+	cidr4     int
+	cidr6     int
+	network   *net.IPNet // for ip4 and ip6
+}
+
+func (d *directive) result() smtp.SPFResult {
+	switch d.qualifier {
+	case '-':
+		return smtp.SPFFail
+	case '~':
+		return smtp.SPFSoftFail
+	case '?':
+		return smtp.SPFNeutral
+	default:
+		return smtp.SPFPass
+	}
+}
+
+var (
+	modifierRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*=`)
+	cidrRegexp     = regexp.MustCompile(`^(.*?)(?:/(\d+))?(?://(\d+))?$`)
+)
+
+// parseRecord parses the terms of an SPF record. It returns the
+// mechanisms and the value of the redirect modifier, if any.
+func parseRecord(record string) ([]directive, string, error) {
+	var (
+		directives   []directive
+		redirect     string
+		seenRedirect bool
+		seenExp      bool
+		hasAll       bool
+	)
+	for _, term := range strings.Fields(record[6:]) {
+		if modifierRegexp.MatchString(term) {
+			i := strings.IndexByte(term, '=')
+			switch strings.ToLower(term[:i]) {
+			case "redirect":
+				if seenRedirect {
+					return nil, "", errors.New("duplicate redirect modifier")
+				} else if term[i+1:] == "" {
+					return nil, "", errors.New("empty redirect modifier")
+				}
+				seenRedirect = true
+				redirect = term[i+1:]
+			case "exp":
+				if seenExp {
+					return nil, "", errors.New("duplicate exp modifier")
+				}
+				seenExp = true
+			}
+			continue
+		}
+
+		d, err := parseDirective(term)
+		if err != nil {
+			return nil, "", err
+		}
+		if d.name == "all" {
+			hasAll = true
+		}
+		directives = append(directives, d)
+	}
+	if hasAll {
+		// redirect is ignored if the record has an all mechanism
+		redirect = ""
+	}
+	return directives, redirect, nil
+}
+
+func parseDirective(term string) (directive, error) {
+	d := directive{qualifier: '+', cidr4: 32, cidr6: 128}
+	if strings.IndexByte("+-~?", term[0]) >= 0 {
+		d.qualifier = term[0]
+		term = term[1:]
+	}
+
+	name := term
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name = term[:i]
+		term = term[i:]
+	} else {
+		term = ""
+	}
+	d.name = strings.ToLower(name)
+
+	switch d.name {
+	case "all":
+		if term != "" {
+			return d, fmt.Errorf("unexpected argument for %v mechanism", d.name)
+		}
+	case "include", "exists":
+		if !strings.HasPrefix(term, ":") || len(term) == 1 {
+			return d, fmt.Errorf("missing domain for %v mechanism", d.name)
+		}
+		d.arg, d.hasArg = term[1:], true
+	case "ptr":
+		if term != "" {
+			if !strings.HasPrefix(term, ":") || len(term) == 1 {
+				return d, fmt.Errorf("invalid argument for %v mechanism", d.name)
+			}
+			d.arg, d.hasArg = term[1:], true
+		}
+	case "a", "mx":
+		m := cidrRegexp.FindStringSubmatch(term)
+		if m == nil {
+			return d, fmt.Errorf("invalid argument for %v mechanism", d.name)
+		}
+		if m[1] != "" {
+			if !strings.HasPrefix(m[1], ":") || len(m[1]) == 1 {
+				return d, fmt.Errorf("invalid argument for %v mechanism", d.name)
+			}
+			d.arg, d.hasArg = m[1][1:], true
+		}
+		var err error
+		if m[2] != "" {
+			if d.cidr4, err = parseCIDRLength(m[2], 32); err != nil {
+				return d, err
+			}
+		}
+		if m[3] != "" {
+			if d.cidr6, err = parseCIDRLength(m[3], 128); err != nil {
+				return d, err
+			}
+		}
+	case "ip4", "ip6":
+		if !strings.HasPrefix(term, ":") {
+			return d, fmt.Errorf("missing network for %v mechanism", d.name)
+		}
+		network := term[1:]
+		if !strings.Contains(network, "/") {
+			if d.name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		ip, ipNet, err := net.ParseCIDR(network)
+		if err != nil || (d.name == "ip4") != (ip.To4() != nil) {
+			return d, fmt.Errorf("invalid network %q for %v mechanism", term[1:], d.name)
+		}
+		d.network = ipNet
+	default:
+		return d, fmt.Errorf("unknown mechanism %q", name)
+	}
+	return d, nil
+}
+
+func parseCIDRLength(s string, max int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n > max || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid CIDR length %q", s)
+	}
+	return n, nil
+}
+
+// match evaluates a mechanism. If the evaluation fails, a non-empty result
+// is returned.
+func (e *evaluation) match(domain string, d directive) (bool, smtp.SPFResult, error) {
+	switch d.name {
+	case "all":
+		return true, "", nil
+	case "ip4", "ip6":
+		return d.network.Contains(e.ip), "", nil
+	}
+
+	if err := e.countLookup(); err != nil {
+		result, err := permError("%v", err)
+		return false, result, err
+	}
+	target := domain
+	if d.hasArg {
+		var err error
+		if target, err = e.expandDomain(d.arg, domain); err != nil {
+			result, err := permError("%v", err)
+			return false, result, err
+		}
+	}
+
+	var (
+		match bool
+		err   error
+	)
+	switch d.name {
+	case "include":
+		var result smtp.SPFResult
+		result, err = e.checkHost(target)
+		switch result {
+		case smtp.SPFPass:
+			return true, "", nil
+		case smtp.SPFFail, smtp.SPFSoftFail, smtp.SPFNeutral:
+			return false, "", nil
+		case smtp.SPFNone:
+			result, err := permError("no SPF record for include target %v", target)
+			return false, result, err
+		default:
+			return false, result, err
+		}
+	case "a":
+		match, err = e.matchHost(target, d)
+	case "mx":
+		match, err = e.matchMX(target, d)
+	case "ptr":
+		match, err = e.matchPTR(target)
+	case "exists":
+		var addrs []net.IP
+		addrs, err = e.lookupIP(target)
+		for _, addr := range addrs {
+			if addr.To4() != nil {
+				match = true
+			}
+		}
+	}
+	if err != nil {
+		var limitErr limitError
+		if errors.As(err, &limitErr) {
+			result, err := permError("%v", err)
+			return false, result, err
+		}
+		result, err := tempError(err)
+		return false, result, err
+	}
+	return match, "", nil
+}
+
+type limitError string
+
+func (err limitError) Error() string {
+	return string(err)
+}
+
+func (e *evaluation) countLookup() error {
+	e.lookups++
+	if e.lookups > maxLookups {
+		return limitError("too many DNS lookups")
+	}
+	return nil
+}
+
+func (e *evaluation) countVoid() error {
+	e.voids++
+	if e.voids > maxVoidLookups {
+		return limitError("too many void DNS lookups")
+	}
+	return nil
+}
+
+// lookupIP looks up the addresses of host. Void lookups are counted.
+func (e *evaluation) lookupIP(host string) ([]net.IP, error) {
+	addrs, err := e.resolver.LookupIPAddr(e.ctx, host)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, e.countVoid()
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// matchHost reports whether an address of host is in the client network
+// given by the CIDR lengths of d.
+func (e *evaluation) matchHost(host string, d directive) (bool, error) {
+	addrs, err := e.lookupIP(host)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if e.matchAddr(addr, d) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (e *evaluation) matchAddr(addr net.IP, d directive) bool {
+	if ip4 := e.ip.To4(); ip4 != nil {
+		addr = addr.To4()
+		return addr != nil && addr.Mask(net.CIDRMask(d.cidr4, 32)).Equal(ip4.Mask(net.CIDRMask(d.cidr4, 32)))
+	}
+	if addr.To4() != nil {
+		return false
+	}
+	return addr.Mask(net.CIDRMask(d.cidr6, 128)).Equal(e.ip.Mask(net.CIDRMask(d.cidr6, 128)))
+}
+
+func (e *evaluation) matchMX(domain string, d directive) (bool, error) {
+	mxs, err := e.resolver.LookupMX(e.ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+	if len(mxs) == 0 {
+		return false, e.countVoid()
+	}
+	if len(mxs) > maxNameLookups {
+		return false, limitError("too many MX records")
+	}
+	for _, mx := range mxs {
+		if match, err := e.matchHost(strings.TrimSuffix(mx.Host, "."), d); err != nil || match {
+			return match, err
+		}
+	}
+	return false, nil
+}
+
+func (e *evaluation) matchPTR(domain string) (bool, error) {
+	names, err := e.resolver.LookupAddr(e.ctx, e.ip.String())
+	if err != nil && !isNotFound(err) {
+		// Failures are treated as a non-match, see RFC 7208 section 5.5
+		return false, nil
+	}
+	if len(names) == 0 {
+		return false, e.countVoid()
+	}
+	if len(names) > maxNameLookups {
+		names = names[:maxNameLookups]
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			continue
+		}
+		addrs, err := e.resolver.LookupIPAddr(e.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(e.ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// expandDomain expands the macros of a domain-spec, and shortens the result
+// to a valid domain name length.
+func (e *evaluation) expandDomain(spec, domain string) (string, error) {
+	s, err := e.expand(spec, domain)
+	if err != nil {
+		return "", err
+	}
+	s = strings.TrimSuffix(s, ".")
+	for len(s) > 253 {
+		i := strings.IndexByte(s, '.')
+		if i < 0 {
+			break
+		}
+		s = s[i+1:]
+	}
+	return s, nil
+}
+
+// expand expands the macros of a macro-string, as defined in RFC 7208
+// section 7.
+func (e *evaluation) expand(spec, domain string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			sb.WriteByte(spec[i])
+			continue
+		}
+		i++
+		if i >= len(spec) {
+			return "", errors.New("invalid macro: trailing %")
+		}
+		switch spec[i] {
+		case '%':
+			sb.WriteByte('%')
+			continue
+		case '_':
+			sb.WriteByte(' ')
+			continue
+		case '-':
+			sb.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("invalid macro: %%%c", spec[i])
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 0 {
+			return "", errors.New("invalid macro: missing }")
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+		value, err := e.expandMacro(macro, domain)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(value)
+	}
+	return sb.String(), nil
+}
+
+var macroRegexp = regexp.MustCompile(`^([a-zA-Z])(\d*)(r?)([.\-+,/_=]*)$`)
+
+func (e *evaluation) expandMacro(macro, domain string) (string, error) {
+	m := macroRegexp.FindStringSubmatch(macro)
+	if m == nil {
+		return "", fmt.Errorf("invalid macro: %%{%v}", macro)
+	}
+
+	localPart, senderDomain := e.sender, ""
+	if i := strings.LastIndexByte(e.sender, '@'); i >= 0 {
+		localPart, senderDomain = e.sender[:i], e.sender[i+1:]
+	}
+
+	var value string
+	switch strings.ToLower(m[1]) {
+	case "s":
+		value = e.sender
+	case "l":
+		value = localPart
+	case "o":
+		value = senderDomain
+	case "d":
+		value = domain
+	case "i":
+		value = dottedIP(e.ip)
+	case "p":
+		value = "unknown"
+	case "v":
+		if e.ip.To4() != nil {
+			value = "in-addr"
+		} else {
+			value = "ip6"
+		}
+	case "h":
+		value = e.helo
+	default:
+		return "", fmt.Errorf("invalid macro letter %q", m[1])
+	}
+
+	delimiters := m[4]
+	if delimiters == "" {
+		delimiters = "."
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if m[3] != "" {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if m[2] != "" {
+		n, err := strconv.Atoi(m[2])
+		if err != nil || n == 0 {
+			return "", fmt.Errorf("invalid macro: %%{%v}", macro)
+		}
+		if n < len(parts) {
+			parts = parts[len(parts)-n:]
+		}
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// dottedIP formats ip for the "i" macro: dotted-quad for IPv4, and dotted
+// nibbles for IPv6.
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	var parts []string
+	for _, b := range ip.To16() {
+		parts = append(parts, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,150 @@
+package smtpspf_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtpspf"
+)
+
+// fakeResolver answers lookups from static records. Names missing from all
+// maps don't exist, and names in fail fail with a temporary error.
+type fakeResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	fail map[string]bool
+}
+
+func (r *fakeResolver) lookup(name string, records map[string][]string) ([]string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if r.fail[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if rs, ok := records[name]; ok {
+		return rs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.lookup(name, r.txt)
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	rs, err := r.lookup(host, r.ip)
+	var addrs []net.IPAddr
+	for _, s := range rs {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(s)})
+	}
+	return addrs, err
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	rs, err := r.lookup(name, r.mx)
+	var mxs []*net.MX
+	for _, s := range rs {
+		mxs = append(mxs, &net.MX{Host: s + "."})
+	}
+	return mxs, err
+}
+
+func (r *fakeResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.lookup(addr, r.ptr)
+}
+
+var resolver = &fakeResolver{
+	txt: map[string][]string{
+		"example.org":          {"v=spf1 ip4:192.0.2.0/24 a mx include:_spf.example.net -all", "google-site-verification=abc"},
+		"_spf.example.net":     {"v=spf1 ip6:2001:db8::/32 a:relay.example.net/28 ~all"},
+		"redirect.example.org": {"v=spf1 redirect=example.org"},
+		"softfail.example.org": {"v=spf1 ~all"},
+		"neutral.example.org":  {"v=spf1 ip4:198.51.100.1"},
+		"multiple.example.org": {"v=spf1 -all", "v=spf1 +all"},
+		"invalid.example.org":  {"v=spf1 foo:bar -all"},
+		"macro.example.org":    {"v=spf1 exists:%{ir}.%{l1r-}.rbl.example.org -all"},
+		"broken.example.org":   {"v=spf1 include:fail.example.org -all"},
+		"ptr.example.org":      {"v=spf1 ptr -all"},
+		"loop.example.org":     {"v=spf1 include:loop.example.org -all"},
+		"void.example.org":     {"v=spf1 a:a.void.example.org a:b.void.example.org a:c.void.example.org -all"},
+		"helo.example.org":     {"v=spf1 a -all"},
+	},
+	ip: map[string][]string{
+		"example.org":                     {"203.0.113.10"},
+		"mx.example.org":                  {"203.0.113.25", "2001:db8:1::25"},
+		"relay.example.net":               {"198.51.100.16"},
+		"mail.ptr.example.org":            {"203.0.113.80"},
+		"helo.example.org":                {"203.0.113.90"},
+		"1.113.0.203.foo.rbl.example.org": {"127.0.0.2"},
+	},
+	mx: map[string][]string{
+		"example.org": {"mx.example.org"},
+	},
+	ptr: map[string][]string{
+		"203.0.113.80": {"mail.ptr.example.org."},
+	},
+	fail: map[string]bool{
+		"fail.example.org": true,
+	},
+}
+
+func TestChecker_CheckSPF(t *testing.T) {
+	tests := []struct {
+		ip, helo, sender string
+		want             smtp.SPFResult
+	}{
+		{"192.0.2.1", "mx.example.com", "user@example.org", smtp.SPFPass},
+		{"203.0.113.10", "mx.example.com", "user@example.org", smtp.SPFPass},
+		{"203.0.113.25", "mx.example.com", "user@example.org", smtp.SPFPass},
+		{"2001:db8:1::25", "mx.example.com", "user@example.org", smtp.SPFPass},
+		{"198.51.100.20", "mx.example.com", "user@example.org", smtp.SPFPass},
+		{"198.51.100.32", "mx.example.com", "user@example.org", smtp.SPFFail},
+		{"2001:db8::1", "mx.example.com", "user@Example.ORG", smtp.SPFPass},
+		{"2001:db9::1", "mx.example.com", "user@example.org", smtp.SPFFail},
+		{"192.0.2.1", "mx.example.com", "user@redirect.example.org", smtp.SPFPass},
+		{"198.51.100.32", "mx.example.com", "user@redirect.example.org", smtp.SPFFail},
+		{"192.0.2.1", "mx.example.com", "user@softfail.example.org", smtp.SPFSoftFail},
+		{"192.0.2.1", "mx.example.com", "user@neutral.example.org", smtp.SPFNeutral},
+		{"198.51.100.1", "mx.example.com", "user@neutral.example.org", smtp.SPFPass},
+		{"192.0.2.1", "mx.example.com", "user@none.example.org", smtp.SPFNone},
+		{"192.0.2.1", "mx.example.com", "user@localhost", smtp.SPFNone},
+		{"192.0.2.1", "mx.example.com", "user@multiple.example.org", smtp.SPFPermError},
+		{"192.0.2.1", "mx.example.com", "user@invalid.example.org", smtp.SPFPermError},
+		{"203.0.113.1", "mx.example.com", "foo-bar@macro.example.org", smtp.SPFPass},
+		{"203.0.113.1", "mx.example.com", "baz@macro.example.org", smtp.SPFFail},
+		{"192.0.2.1", "mx.example.com", "user@broken.example.org", smtp.SPFTempError},
+		{"203.0.113.80", "mx.example.com", "user@ptr.example.org", smtp.SPFPass},
+		{"203.0.113.81", "mx.example.com", "user@ptr.example.org", smtp.SPFFail},
+		{"192.0.2.1", "mx.example.com", "user@loop.example.org", smtp.SPFPermError},
+		{"192.0.2.1", "mx.example.com", "user@void.example.org", smtp.SPFPermError},
+		{"203.0.113.90", "helo.example.org", "", smtp.SPFPass},
+		{"203.0.113.91", "helo.example.org", "", smtp.SPFFail},
+	}
+	c := &smtpspf.Checker{Resolver: resolver}
+	for _, tc := range tests {
+		result, err := c.CheckSPF(context.Background(), net.ParseIP(tc.ip), tc.helo, tc.sender)
+		if result != tc.want {
+			t.Errorf("CheckSPF(%v, %q, %q) = %v (%v), want %v", tc.ip, tc.helo, tc.sender, result, err, tc.want)
+		}
+		switch result {
+		case smtp.SPFTempError, smtp.SPFPermError:
+			if err == nil {
+				t.Errorf("CheckSPF(%v, %q, %q) = %v without error", tc.ip, tc.helo, tc.sender, result)
+			}
+		}
+	}
+}
+
+func TestChecker_CheckSPF_temporaryError(t *testing.T) {
+	c := &smtpspf.Checker{Resolver: resolver}
+	result, err := c.CheckSPF(context.Background(), net.ParseIP("192.0.2.1"), "", "user@fail.example.org")
+	var dnsErr *net.DNSError
+	if result != smtp.SPFTempError || !errors.As(err, &dnsErr) {
+		t.Errorf("CheckSPF() = %v, %v, want temperror with a DNS error", result, err)
+	}
+}
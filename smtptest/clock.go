@@ -0,0 +1,120 @@
+package smtptest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// FakeClock is a smtp.Clock whose time only changes with Advance, to test
+// time-dependent behavior deterministically and without waiting:
+//
+//	clock := smtptest.NewFakeClock(time.Now())
+//	s.Clock = clock
+//	s.IdleTimeout = time.Minute
+//	// ...
+//	clock.Advance(time.Minute)
+//
+// It is safe for concurrent use.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ smtp.Clock = (*FakeClock)(nil)
+
+// NewFakeClock creates a fake clock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements smtp.Clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer implements smtp.Clock.
+func (c *FakeClock) NewTimer(d time.Duration) smtp.Timer {
+	return c.addTimer(d, make(chan time.Time, 1), nil)
+}
+
+// AfterFunc implements smtp.Clock.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) smtp.Timer {
+	return c.addTimer(d, nil, f)
+}
+
+func (c *FakeClock) addTimer(d time.Duration, ch chan time.Time, f func()) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), c: ch, f: f}
+	if d <= 0 {
+		t.fire(c.now)
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return t
+}
+
+// Advance moves the time forward by d, and fires the timers expiring until
+// then, in order.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].when.Before(c.timers[j].when)
+	})
+	n := 0
+	for n < len(c.timers) && !c.timers[n].when.After(c.now) {
+		c.timers[n].fire(c.now)
+		n++
+	}
+	c.timers = c.timers[n:]
+}
+
+// Timers returns the number of pending timers. Tests can wait for it to grow
+// to know a goroutine started waiting, before calling Advance.
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	c     chan time.Time
+	f     func()
+}
+
+// fire is called with the clock mutex held.
+func (t *fakeTimer) fire(now time.Time) {
+	if t.f != nil {
+		go t.f()
+	} else {
+		t.c <- now
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package smtptest_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := smtptest.NewFakeClock(start)
+
+	late := clock.NewTimer(2 * time.Minute)
+	early := clock.NewTimer(time.Minute)
+	stopped := clock.NewTimer(time.Minute)
+	called := make(chan struct{})
+	clock.AfterFunc(time.Minute, func() { close(called) })
+
+	if !stopped.Stop() {
+		t.Errorf("Stop() = false for a pending timer")
+	}
+	if n := clock.Timers(); n != 3 {
+		t.Errorf("Timers() = %v, want 3", n)
+	}
+
+	clock.Advance(time.Minute)
+	if now := clock.Now(); !now.Equal(start.Add(time.Minute)) {
+		t.Errorf("Now() = %v, want %v", now, start.Add(time.Minute))
+	}
+	if got := <-early.C(); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("timer fired at %v, want %v", got, start.Add(time.Minute))
+	}
+	<-called
+	select {
+	case <-late.C():
+		t.Errorf("timer fired early")
+	case <-stopped.C():
+		t.Errorf("stopped timer fired")
+	default:
+	}
+	if early.Stop() {
+		t.Errorf("Stop() = true for a fired timer")
+	}
+
+	clock.Advance(time.Hour)
+	<-late.C()
+	if n := clock.Timers(); n != 0 {
+		t.Errorf("Timers() = %v, want 0", n)
+	}
+}
+
+func TestFakeClock_server(t *testing.T) {
+	clock := smtptest.NewFakeClock(time.Now())
+	conns := make(chan *smtp.Conn, 1)
+	s := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		conns <- c
+		return session{}, nil
+	}))
+	s.Domain = "localhost"
+	s.Clock = clock
+	s.Rand = bytes.NewReader(bytes.Repeat([]byte{0x2a}, 8))
+	s.IdleTimeout = time.Minute
+	s.OnIdle = func(c *smtp.Conn) error {
+		return errors.New("idle")
+	}
+	l := smtptest.NewPipeListener()
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Scan()
+	io.WriteString(conn, "HELO localhost\r\n")
+	scanner.Scan()
+	c := <-conns
+	if id := c.ID(); id != "2a2a2a2a2a2a2a2a" {
+		t.Errorf("ID() = %q, want 2a2a2a2a2a2a2a2a", id)
+	}
+
+	// Wait for the server to read the next command
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Minute)
+	scanner.Scan()
+	if want := "421 4.4.2 Idle timeout, bye bye"; scanner.Text() != want {
+		t.Errorf("got %q, want %q", scanner.Text(), want)
+	}
+}
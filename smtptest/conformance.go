@@ -0,0 +1,268 @@
+// Package smtptest provides utilities for testing SMTP servers and backends.
+package smtptest
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Addresses used by the conformance suite. Backends given to
+// RunServerConformance must accept messages from ConformanceSender, or the
+// null sender, to ConformanceRecipient.
+const (
+	ConformanceSender    = "sender@example.org"
+	ConformanceRecipient = "recipient@example.com"
+)
+
+// Maximum message size configured by the conformance suite.
+const conformanceMaxMessageBytes = 1024 * 1024
+
+// step is a command sent to the server, and the expected reply.
+type step struct {
+	// Sent followed by CRLF if not empty. Several pipelined commands can be
+	// separated by CRLF, the replies are then read by the next steps. The CRLF
+	// appended to BDAT commands is part of the chunk.
+	cmd string
+	// Expected reply code, and enhanced status code if not empty.
+	code         int
+	enhancedCode string
+}
+
+var conformanceTests = []struct {
+	name  string
+	steps []step
+}{
+	{"HELO", []step{
+		{"HELO localhost", 250, ""},
+		{"QUIT", 221, "2.0.0"},
+	}},
+	{"HELOWithoutDomain", []step{
+		{"HELO", 501, "5.5.2"},
+	}},
+	{"TransactionDATA", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 250, "2.0.0"},
+		{"DATA", 354, ""},
+		{"Subject: Conformance\r\n\r\nHey <3\r\n..dot-stuffed\r\n.", 250, "2.0.0"},
+		{"QUIT", 221, "2.0.0"},
+	}},
+	{"TransactionBDAT", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 250, "2.0.0"},
+		{"BDAT 14\r\nSubject: Hey", 250, "2.0.0"},
+		{"BDAT 8 LAST\r\nHey <3", 250, "2.0.0"},
+	}},
+	{"NullSender", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<>", 250, "2.0.0"},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 250, "2.0.0"},
+	}},
+	{"TransactionsInSession", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 250, "2.0.0"},
+		{"DATA", 354, ""},
+		{"Hey <3\r\n.", 250, "2.0.0"},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 250, "2.0.0"},
+		{"DATA", 354, ""},
+		{"Hey again <3\r\n.", 250, "2.0.0"},
+	}},
+	{"Pipelining", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">\r\nRCPT TO:<" + ConformanceRecipient + ">\r\nDATA", 250, "2.0.0"},
+		{"", 250, "2.0.0"},
+		{"", 354, ""},
+		{"Hey <3\r\n.\r\nNOOP", 250, "2.0.0"},
+		{"", 250, "2.0.0"},
+	}},
+	{"MailBeforeHELO", []step{
+		{"MAIL FROM:<" + ConformanceSender + ">", 502, "5.5.1"},
+	}},
+	{"RcptBeforeMail", []step{
+		{"EHLO localhost", 250, ""},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 502, "5.5.1"},
+	}},
+	{"DataBeforeRcpt", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"DATA", 502, "5.5.1"},
+	}},
+	{"BDATBeforeRcpt", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"BDAT 0 LAST", 502, "5.5.1"},
+	}},
+	{"DataWithArgument", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 250, "2.0.0"},
+		{"DATA now", 501, "5.5.4"},
+	}},
+	{"DataDuringBDAT", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 250, "2.0.0"},
+		{"BDAT 5\r\nHey", 250, "2.0.0"},
+		{"DATA", 502, "5.5.1"},
+		{"MAIL FROM:<" + ConformanceSender + ">", 502, "5.5.1"},
+		{"BDAT 0 LAST", 250, "2.0.0"},
+	}},
+	{"RSETClearsTransaction", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"RSET", 250, "2.0.0"},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 502, "5.5.1"},
+	}},
+	{"EHLOClearsTransaction", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"EHLO localhost", 250, ""},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 502, "5.5.1"},
+	}},
+	{"MailSyntax", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL TO:<" + ConformanceSender + ">", 501, "5.5.2"},
+		{"MAIL FROM:<" + ConformanceSender, 501, "5.5.2"},
+		{"MAIL FROM:<" + ConformanceSender + "> FOO=bar", 500, "5.5.4"},
+	}},
+	{"MailSize", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + "> SIZE=big", 501, "5.5.4"},
+		{"MAIL FROM:<" + ConformanceSender + "> SIZE=1048577", 552, "5.3.4"},
+		{"MAIL FROM:<" + ConformanceSender + "> SIZE=1048576", 250, "2.0.0"},
+	}},
+	{"BDATSize", []step{
+		{"EHLO localhost", 250, ""},
+		{"MAIL FROM:<" + ConformanceSender + ">", 250, "2.0.0"},
+		{"RCPT TO:<" + ConformanceRecipient + ">", 250, "2.0.0"},
+		{"BDAT big", 501, "5.5.4"},
+		{"BDAT 1048577 LAST", 552, "5.3.4"},
+	}},
+	{"UnknownCommand", []step{
+		{"EHLO localhost", 250, ""},
+		{"HACK the planet", 500, "5.5.2"},
+	}},
+	{"UnimplementedCommands", []step{
+		{"EHLO localhost", 250, ""},
+		{"EXPN staff", 502, "5.5.1"},
+		{"TURN", 502, "5.5.1"},
+	}},
+	{"NOOPAndVRFY", []step{
+		{"NOOP", 250, "2.0.0"},
+		{"EHLO localhost", 250, ""},
+		{"VRFY " + ConformanceRecipient, 252, "2.5.0"},
+	}},
+	{"STARTTLSWithoutTLS", []step{
+		{"EHLO localhost", 250, ""},
+		{"STARTTLS", 502, "5.5.1"},
+	}},
+}
+
+// RunServerConformance runs a suite of protocol conformance tests against a
+// server using backends returned by newBackend, which is called once per
+// test. The suite covers command ordering rules, reply codes and extension
+// interactions, such as pipelining and CHUNKING.
+//
+// The server is configured with its default settings, and a maximum message
+// size of 1 MiB. Backends must accept the messages sent by the suite, see
+// ConformanceSender.
+func RunServerConformance(t *testing.T, newBackend func() smtp.Backend) {
+	for _, tc := range conformanceTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			text, cleanup := startServer(t, newBackend())
+			defer cleanup()
+			for _, step := range tc.steps {
+				if step.cmd != "" {
+					if err := text.PrintfLine("%s", step.cmd); err != nil {
+						t.Fatalf("failed to send %q: %v", step.cmd, err)
+					}
+				}
+				checkReply(t, text, step)
+			}
+		})
+	}
+
+	t.Run("EHLOCapabilities", func(t *testing.T) {
+		text, cleanup := startServer(t, newBackend())
+		defer cleanup()
+		text.PrintfLine("EHLO localhost")
+		_, msg, err := text.ReadResponse(250)
+		if err != nil {
+			t.Fatalf("EHLO failed: %v", err)
+		}
+		lines := strings.Split(msg, "\n")
+		if lines[0] != "Hello localhost" {
+			t.Errorf("first EHLO reply line = %q, want %q", lines[0], "Hello localhost")
+		}
+		caps := make(map[string]bool)
+		for _, line := range lines[1:] {
+			caps[line] = true
+		}
+		for _, cap := range []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "CHUNKING", "SIZE 1048576"} {
+			if !caps[cap] {
+				t.Errorf("capability %q not advertised, got %v", cap, lines[1:])
+			}
+		}
+	})
+
+	t.Run("QUITClosesConnection", func(t *testing.T) {
+		text, cleanup := startServer(t, newBackend())
+		defer cleanup()
+		text.PrintfLine("QUIT")
+		checkReply(t, text, step{code: 221, enhancedCode: "2.0.0"})
+		if line, err := text.ReadLine(); err == nil {
+			t.Errorf("connection not closed after QUIT, read %q", line)
+		}
+	})
+}
+
+// startServer starts a server with the conformance suite settings, and
+// returns a connection to it, after reading the greeting.
+func startServer(t *testing.T, be smtp.Backend) (text *textproto.Conn, cleanup func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.MaxMessageBytes = conformanceMaxMessageBytes
+	go s.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		s.Close()
+		t.Fatalf("failed to connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	text = textproto.NewConn(conn)
+	cleanup = func() {
+		text.Close()
+		s.Close()
+	}
+
+	checkReply(t, text, step{code: 220})
+	return text, cleanup
+}
+
+func checkReply(t *testing.T, text *textproto.Conn, step step) {
+	t.Helper()
+	code, msg, err := text.ReadResponse(0)
+	if err != nil && code == 0 {
+		t.Fatalf("failed to read reply to %q: %v", step.cmd, err)
+	}
+	if code != step.code {
+		t.Fatalf("reply to %q = %v %v, want code %v", step.cmd, code, msg, step.code)
+	}
+	if step.enhancedCode != "" && !strings.HasPrefix(msg, step.enhancedCode+" ") {
+		t.Fatalf("reply to %q = %v %v, want enhanced code %v", step.cmd, code, msg, step.enhancedCode)
+	}
+}
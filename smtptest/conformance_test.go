@@ -0,0 +1,36 @@
+package smtptest_test
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+type session struct{}
+
+func (session) Reset()        {}
+func (session) Logout() error { return nil }
+
+func (session) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return nil
+}
+
+func (session) Data(r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func TestRunServerConformance(t *testing.T) {
+	smtptest.RunServerConformance(t, func() smtp.Backend {
+		return smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			return session{}, nil
+		})
+	})
+}
@@ -0,0 +1,197 @@
+package smtptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PipeListener is a net.Listener of in-memory connections created with
+// net.Pipe, to test servers without binding sockets:
+//
+//	l := smtptest.NewPipeListener()
+//	go s.Serve(l)
+//	conn, err := l.Dial()
+//
+// net.Pipe connections are synchronous: writes block until the peer reads
+// them. Clients must read replies before pipelining more commands than the
+// server buffers.
+type PipeListener struct {
+	// Address reported as the remote address of accepted connections, e.g.
+	// to test Server.XCLIENTTrustedNets. If nil, the net.Pipe address is
+	// used, which doesn't belong to any network.
+	RemoteAddr net.Addr
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPipeListener creates a listener of in-memory connections.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Accept waits for a connection to be dialed with Dial.
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Err: net.ErrClosed}
+	}
+}
+
+// Close closes the listener. Connections already accepted are kept open.
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial connects to the listener. It blocks until the connection is accepted.
+func (l *PipeListener) Dial() (net.Conn, error) {
+	server, client := net.Pipe()
+	if l.RemoteAddr != nil {
+		server = &remoteAddrConn{server, l.RemoteAddr}
+	}
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		server.Close()
+		client.Close()
+		return nil, &net.OpError{Op: "dial", Net: "pipe", Err: net.ErrClosed}
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// remoteAddrConn overrides the remote address of a connection.
+type remoteAddrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// NewTLSConfig generates a self-signed certificate for hosts, which must not
+// be empty. It returns a server TLS configuration using the certificate, e.g.
+// for Server.TLSConfig, and a client configuration trusting it, with the
+// server name set to the first host.
+func NewTLSConfig(hosts ...string) (server, client *tls.Config, err error) {
+	if len(hosts) == 0 {
+		return nil, nil, fmt.Errorf("smtptest: no host")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}},
+	}
+	client = &tls.Config{
+		RootCAs:    roots,
+		ServerName: hosts[0],
+	}
+	return server, client, nil
+}
+
+// StartTLS issues STARTTLS on a raw connection to a server, and performs the
+// TLS handshake with config. The replies to previous commands must have been
+// read, and conn must not be read through a buffer, since the reply to
+// STARTTLS is read byte by byte to leave the handshake untouched.
+//
+// This is useful to test servers at the protocol level, smtp.Client users
+// should call Client.StartTLS instead.
+func StartTLS(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	if _, err := conn.Write([]byte("STARTTLS\r\n")); err != nil {
+		return nil, err
+	}
+
+	// The reply may span several lines
+	for {
+		line, err := readLine(conn)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "220") {
+			return nil, fmt.Errorf("smtptest: STARTTLS failed: %v", line)
+		}
+		if len(line) < 4 || line[3] != '-' {
+			break
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// readLine reads a CRLF-terminated line from conn byte by byte, and returns it
+// without the line ending.
+func readLine(conn net.Conn) (string, error) {
+	var sb strings.Builder
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(sb.String(), "\r"), nil
+		}
+		sb.WriteByte(b[0])
+	}
+}
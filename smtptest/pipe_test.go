@@ -0,0 +1,97 @@
+package smtptest_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtptest"
+)
+
+func TestPipeListener_startTLS(t *testing.T) {
+	serverConfig, clientConfig, err := smtptest.NewTLSConfig("mx.example.org")
+	if err != nil {
+		t.Fatalf("NewTLSConfig() = %v", err)
+	}
+
+	states := make(chan tls.ConnectionState, 1)
+	s := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		if state, ok := c.TLSConnectionState(); ok {
+			states <- state
+		}
+		return session{}, nil
+	}))
+	s.Domain = "mx.example.org"
+	s.TLSConfig = serverConfig
+	l := smtptest.NewPipeListener()
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	c := smtp.NewClient(conn)
+	defer c.Close()
+	if err := c.StartTLS(clientConfig); err != nil {
+		t.Fatalf("StartTLS() = %v", err)
+	}
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if state := <-states; !state.HandshakeComplete || state.ServerName != "mx.example.org" {
+		t.Errorf("session TLS state = %+v, want a handshake for mx.example.org", state)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit() = %v", err)
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	serverConfig, clientConfig, err := smtptest.NewTLSConfig("mx.example.org")
+	if err != nil {
+		t.Fatalf("NewTLSConfig() = %v", err)
+	}
+
+	s := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return session{}, nil
+	}))
+	s.Domain = "mx.example.org"
+	s.TLSConfig = serverConfig
+	s.TLSRequiredNets, _ = smtp.ParseTrustedNets("192.0.2.0/24")
+	l := smtptest.NewPipeListener()
+	l.RemoteAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer conn.Close()
+
+	// Read the greeting without buffering, to leave the handshake untouched
+	b := make([]byte, len("220 mx.example.org ESMTP Service Ready\r\n"))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("failed to read greeting: %v", err)
+	}
+
+	tlsConn, err := smtptest.StartTLS(conn, clientConfig)
+	if err != nil {
+		t.Fatalf("StartTLS() = %v", err)
+	}
+
+	// Commands are accepted from the client once it uses TLS
+	io.WriteString(tlsConn, "EHLO localhost\r\nMAIL FROM:<root@nsa.gov>\r\n")
+	scanner := bufio.NewScanner(tlsConn)
+	for scanner.Scan() && strings.HasPrefix(scanner.Text(), "250-") {
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Errorf("Invalid MAIL response: %v", scanner.Text())
+	}
+}
@@ -0,0 +1,452 @@
+package smtptlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Media type of gzipped reports, as defined in RFC 8460 section 6.
+const reportMediaType = "application/tlsrpt+gzip"
+
+// Reporter collects sessions and periodically sends reports to the
+// addresses of the TLSRPT records of policy domains, as defined in RFC 8460
+// section 5. Its Report method is a Queue.TLSReport hook.
+//
+// Reports are sent by email with the Send function for mailto: URIs, and
+// posted for https: URIs. Collected data is kept in memory: it's lost if the
+// process stops before it's sent.
+type Reporter struct {
+	// Name of the organization sending reports, and contact address, also
+	// used as the sender of reports. Required.
+	OrgName string
+	Email   string
+
+	// Interval between reports. If zero, 24 hours is used.
+	Interval time.Duration
+
+	// Sends a report message to recipients. Required.
+	Send func(ctx context.Context, from string, to []string, msg []byte) error
+	// Posts reports to https: URIs. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Looks up the TLSRPT records of policy domains. If nil,
+	// net.DefaultResolver.LookupTXT is used.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	// Logs report failures. If nil, they're not logged.
+	Logger *slog.Logger
+
+	// Source of the current time. If nil, smtp.SystemClock is used.
+	Clock smtp.Clock
+	// Source of randomness for report IDs. If nil, crypto/rand is used.
+	Rand io.Reader
+
+	mu      sync.Mutex
+	begin   time.Time
+	reports map[string]*pendingReport // by policy domain
+}
+
+type pendingReport struct {
+	policies map[string]*pendingPolicy // by policy type and strings
+}
+
+type pendingPolicy struct {
+	result   PolicyResult
+	failures map[failureKey]*FailureDetails
+}
+
+// failureKey identifies the failed sessions counted in a single failure
+// details entry.
+type failureKey struct {
+	result                                ResultType
+	sendingIP, receivingIP, receivingHost string
+	reason                                string
+}
+
+func (r *Reporter) now() time.Time {
+	if r.Clock == nil {
+		return smtp.SystemClock.Now()
+	}
+	return r.Clock.Now()
+}
+
+// Report collects a session.
+func (r *Reporter) Report(s *Session) {
+	if s.PolicyDomain == "" {
+		return
+	}
+	domain := strings.ToLower(s.PolicyDomain)
+	policyType := s.PolicyType
+	if policyType == "" {
+		policyType = PolicyNoPolicyFound
+	}
+	policyKey := string(policyType) + "\n" + strings.Join(s.PolicyString, "\n") + "\n" + strings.Join(s.PolicyMXHost, "\n")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reports == nil {
+		r.reports = make(map[string]*pendingReport)
+	}
+	if r.begin.IsZero() {
+		r.begin = r.now()
+	}
+	report := r.reports[domain]
+	if report == nil {
+		report = &pendingReport{policies: make(map[string]*pendingPolicy)}
+		r.reports[domain] = report
+	}
+
+	policy := report.policies[policyKey]
+	if policy == nil {
+		policy = &pendingPolicy{
+			result: PolicyResult{
+				Policy: PolicyDescriptor{
+					Type:   policyType,
+					String: s.PolicyString,
+					Domain: domain,
+					MXHost: s.PolicyMXHost,
+				},
+			},
+			failures: make(map[failureKey]*FailureDetails),
+		}
+		report.policies[policyKey] = policy
+	}
+	if s.Result == "" {
+		policy.result.Summary.TotalSuccessfulSessionCount++
+		return
+	}
+	policy.result.Summary.TotalFailureSessionCount++
+
+	key := failureKey{
+		result:        s.Result,
+		receivingHost: s.ReceivingMXHostname,
+		reason:        s.FailureReason,
+	}
+	if s.SendingMTAIP != nil {
+		key.sendingIP = s.SendingMTAIP.String()
+	}
+	if s.ReceivingIP != nil {
+		key.receivingIP = s.ReceivingIP.String()
+	}
+	failure := policy.failures[key]
+	if failure == nil {
+		failure = &FailureDetails{
+			ResultType:          s.Result,
+			SendingMTAIP:        key.sendingIP,
+			ReceivingMXHostname: s.ReceivingMXHostname,
+			ReceivingIP:         key.receivingIP,
+			FailureReasonCode:   s.FailureReason,
+		}
+		policy.failures[key] = failure
+	}
+	failure.FailedSessionCount++
+}
+
+// Run sends reports every Interval until ctx is done. Reports collected
+// since the last interval are then sent.
+func (r *Reporter) Run(ctx context.Context) {
+	interval := r.Interval
+	if interval == 0 {
+		interval = 24 * time.Hour
+	}
+	clock := r.Clock
+	if clock == nil {
+		clock = smtp.SystemClock
+	}
+	for {
+		timer := clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			// Don't lose the collected data, but don't wait forever
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			r.flush(ctx)
+			cancel()
+			return
+		case <-timer.C():
+			r.flush(ctx)
+		}
+	}
+}
+
+func (r *Reporter) flush(ctx context.Context) {
+	if err := r.Flush(ctx); err != nil && r.Logger != nil {
+		r.Logger.LogAttrs(ctx, slog.LevelError, "failed to send TLS reports", slog.String("error", err.Error()))
+	}
+}
+
+// Flush sends the reports collected so far, and starts a new reporting
+// period. Reports for domains without a TLSRPT record are dropped. It
+// returns the errors of the reports which couldn't be sent. They aren't
+// retried.
+func (r *Reporter) Flush(ctx context.Context) error {
+	r.mu.Lock()
+	reports, begin := r.reports, r.begin
+	r.reports, r.begin = nil, time.Time{}
+	end := r.now()
+	r.mu.Unlock()
+
+	domains := make([]string, 0, len(reports))
+	for domain := range reports {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	var errs []error
+	for _, domain := range domains {
+		if err := r.send(ctx, domain, reports[domain], begin, end); err != nil {
+			errs = append(errs, fmt.Errorf("report for %v: %v", domain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lookupRecord looks up the TLSRPT record of a domain. It returns nil if
+// there is none.
+func (r *Reporter) lookupRecord(ctx context.Context, domain string) (*Record, error) {
+	lookupTXT := r.LookupTXT
+	if lookupTXT == nil {
+		lookupTXT = net.DefaultResolver.LookupTXT
+	}
+	txts, err := lookupTXT(ctx, "_smtp._tls."+domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Records other than TLSRPT ones are ignored, and several records are
+	// treated as none
+	var rec *Record
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=TLSRPTv1") {
+			continue
+		}
+		if rec != nil {
+			return nil, nil
+		}
+		if rec, err = ParseRecord(txt); err != nil {
+			return nil, nil
+		}
+	}
+	return rec, nil
+}
+
+func (r *Reporter) send(ctx context.Context, domain string, pending *pendingReport, begin, end time.Time) error {
+	rec, err := r.lookupRecord(ctx, domain)
+	if err != nil {
+		return err
+	} else if rec == nil {
+		return nil
+	}
+
+	id, err := r.newID()
+	if err != nil {
+		return err
+	}
+
+	report := &Report{
+		OrganizationName: r.OrgName,
+		DateRange: DateRange{
+			StartDatetime: begin.UTC(),
+			EndDatetime:   end.UTC(),
+		},
+		ContactInfo: r.Email,
+		ReportID:    id,
+	}
+	for _, policy := range pending.policies {
+		result := policy.result
+		for _, failure := range policy.failures {
+			result.FailureDetails = append(result.FailureDetails, *failure)
+		}
+		sort.Slice(result.FailureDetails, func(i, j int) bool {
+			a, b := &result.FailureDetails[i], &result.FailureDetails[j]
+			if a.FailedSessionCount != b.FailedSessionCount {
+				return a.FailedSessionCount > b.FailedSessionCount
+			}
+			return a.ResultType < b.ResultType
+		})
+		report.Policies = append(report.Policies, result)
+	}
+	sort.Slice(report.Policies, func(i, j int) bool {
+		a, b := &report.Policies[i].Policy, &report.Policies[j].Policy
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return strings.Join(a.String, "\n") < strings.Join(b.String, "\n")
+	})
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if err := json.NewEncoder(zw).Encode(report); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	var to []string
+	var errs []error
+	for _, uri := range rec.ReportURIs {
+		switch {
+		case hasPrefixFold(uri, "mailto:"):
+			if addr := uri[len("mailto:"):]; strings.Contains(addr, "@") {
+				to = append(to, addr)
+			}
+		case hasPrefixFold(uri, "https:"):
+			if err := r.post(ctx, uri, gz.Bytes()); err != nil {
+				errs = append(errs, fmt.Errorf("failed to post to %v: %v", uri, err))
+			}
+		}
+	}
+	if len(to) > 0 {
+		msg := r.formatMessage(report, domain, gz.Bytes())
+		if err := r.Send(ctx, r.Email, to, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Reporter) newID() (string, error) {
+	rnd := r.Rand
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(rnd, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// post submits a report with HTTPS, as defined in RFC 8460 section 5.4.
+func (r *Reporter) post(ctx context.Context, uri string, report []byte) error {
+	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewReader(report))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", reportMediaType)
+
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %v", resp.Status)
+	}
+	return nil
+}
+
+// formatMessage formats a report message, as defined in RFC 8460 section
+// 5.3.
+func (r *Reporter) formatMessage(report *Report, domain string, gz []byte) []byte {
+	begin, end := report.DateRange.StartDatetime.Unix(), report.DateRange.EndDatetime.Unix()
+	filename := fmt.Sprintf("%v!%v!%v!%v!%v.json.gz", r.OrgName, domain, begin, end, report.ReportID)
+	emailDomain := r.Email
+	if i := strings.LastIndexByte(emailDomain, '@'); i >= 0 {
+		emailDomain = emailDomain[i+1:]
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: <%v>\r\n", r.Email)
+	fmt.Fprintf(&buf, "Subject: Report Domain: %v Submitter: %v Report-ID: <%v@%v>\r\n", domain, r.OrgName, report.ReportID, emailDomain)
+	fmt.Fprintf(&buf, "Date: %v\r\n", r.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%v@%v>\r\n", report.ReportID, emailDomain)
+	fmt.Fprintf(&buf, "TLS-Report-Domain: %v\r\n", domain)
+	fmt.Fprintf(&buf, "TLS-Report-Submitter: %v\r\n", r.OrgName)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=\"tlsrpt\"; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprintf(&buf, "\r\n")
+
+	w, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	fmt.Fprintf(w, "This is an aggregate TLS report for %v from %v.\r\n", domain, r.OrgName)
+
+	w, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {reportMediaType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", filename)},
+	})
+	b64 := base64.StdEncoding.EncodeToString(gz)
+	for len(b64) > 76 {
+		fmt.Fprintf(w, "%v\r\n", b64[:76])
+		b64 = b64[76:]
+	}
+	fmt.Fprintf(w, "%v\r\n", b64)
+	mw.Close()
+	return buf.Bytes()
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// Report is a TLS report, as defined in RFC 8460 section 4.
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+}
+
+type DateRange struct {
+	StartDatetime time.Time `json:"start-datetime"`
+	EndDatetime   time.Time `json:"end-datetime"`
+}
+
+// PolicyResult holds the sessions a policy was applied to.
+type PolicyResult struct {
+	Policy         PolicyDescriptor `json:"policy"`
+	Summary        Summary          `json:"summary"`
+	FailureDetails []FailureDetails `json:"failure-details,omitempty"`
+}
+
+type PolicyDescriptor struct {
+	Type   PolicyType `json:"policy-type"`
+	String []string   `json:"policy-string,omitempty"`
+	Domain string     `json:"policy-domain"`
+	MXHost []string   `json:"mx-host,omitempty"`
+}
+
+type Summary struct {
+	TotalSuccessfulSessionCount int `json:"total-successful-session-count"`
+	TotalFailureSessionCount    int `json:"total-failure-session-count"`
+}
+
+type FailureDetails struct {
+	ResultType          ResultType `json:"result-type"`
+	SendingMTAIP        string     `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname string     `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP         string     `json:"receiving-ip,omitempty"`
+	FailedSessionCount  int        `json:"failed-session-count"`
+	FailureReasonCode   string     `json:"failure-reason-code,omitempty"`
+}
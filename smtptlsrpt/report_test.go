@@ -0,0 +1,205 @@
+package smtptlsrpt_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp/smtptest"
+	"github.com/emersion/go-smtp/smtptlsrpt"
+)
+
+func decodeReport(t *testing.T, r io.Reader) *smtptlsrpt.Report {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() = %v", err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	var report smtptlsrpt.Report
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatalf("json.Unmarshal() = %v", err)
+	}
+	return &report
+}
+
+// parseReport extracts the report attached to a report message.
+func parseReport(t *testing.T, msg []byte) (*mail.Message, *smtptlsrpt.Report) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatalf("ReadMessage() = %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("ParseMediaType() = %v", err)
+	}
+	if mediaType != "multipart/report" || params["report-type"] != "tlsrpt" {
+		t.Errorf("Content-Type = %q", m.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("NextPart() = %v", err)
+		}
+		if p.Header.Get("Content-Type") != "application/tlsrpt+gzip" {
+			continue
+		}
+		return m, decodeReport(t, base64.NewDecoder(base64.StdEncoding, p))
+	}
+}
+
+func TestReporter(t *testing.T) {
+	posted := make(chan *smtptlsrpt.Report, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ct := req.Header.Get("Content-Type"); ct != "application/tlsrpt+gzip" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		posted <- decodeReport(t, req.Body)
+	}))
+	defer srv.Close()
+
+	records := map[string][]string{
+		"_smtp._tls.example.org": {
+			"v=spf1 -all",
+			"v=TLSRPTv1; rua=mailto:tlsrpt@example.org," + srv.URL + "/tlsrpt",
+		},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := smtptest.NewFakeClock(start)
+	var sent [][]byte
+	r := &smtptlsrpt.Reporter{
+		OrgName: "mx.example.com",
+		Email:   "tlsrpt@example.com",
+		LookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			if txts, ok := records[name]; ok {
+				return txts, nil
+			}
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		},
+		HTTPClient: srv.Client(),
+		Clock:      clock,
+		Rand:       bytes.NewReader(bytes.Repeat([]byte{0x2a}, 64)),
+		Send: func(ctx context.Context, from string, to []string, msg []byte) error {
+			if from != "tlsrpt@example.com" {
+				t.Errorf("from = %q", from)
+			}
+			if !reflect.DeepEqual(to, []string{"tlsrpt@example.org"}) {
+				t.Errorf("to = %q", to)
+			}
+			sent = append(sent, msg)
+			return nil
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		r.Report(&smtptlsrpt.Session{PolicyDomain: "Example.org", ReceivingMXHostname: "mx1.example.org"})
+	}
+	for i := 0; i < 2; i++ {
+		r.Report(&smtptlsrpt.Session{
+			PolicyDomain:        "example.org",
+			ReceivingMXHostname: "mx2.example.org",
+			ReceivingIP:         net.IPv4(192, 0, 2, 1),
+			Result:              smtptlsrpt.ResultSTARTTLSNotSupported,
+		})
+	}
+	r.Report(&smtptlsrpt.Session{
+		PolicyDomain: "example.org",
+		PolicyType:   smtptlsrpt.PolicySTS,
+		PolicyString: []string{"version: STSv1", "mode: enforce"},
+		PolicyMXHost: []string{"*.example.org"},
+		Result:       smtptlsrpt.ResultCertificateExpired,
+	})
+	// No TLSRPT record
+	r.Report(&smtptlsrpt.Session{PolicyDomain: "example.net"})
+
+	clock.Advance(24 * time.Hour)
+	if err := r.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+
+	if len(sent) != 1 {
+		t.Fatalf("sent %v reports, want 1", len(sent))
+	}
+	m, report := parseReport(t, sent[0])
+	if got := m.Header.Get("TLS-Report-Domain"); got != "example.org" {
+		t.Errorf("TLS-Report-Domain = %q", got)
+	}
+	if got := m.Header.Get("TLS-Report-Submitter"); got != "mx.example.com" {
+		t.Errorf("TLS-Report-Submitter = %q", got)
+	}
+
+	want := &smtptlsrpt.Report{
+		OrganizationName: "mx.example.com",
+		DateRange: smtptlsrpt.DateRange{
+			StartDatetime: start,
+			EndDatetime:   start.Add(24 * time.Hour),
+		},
+		ContactInfo: "tlsrpt@example.com",
+		ReportID:    "2a2a2a2a2a2a2a2a",
+		Policies: []smtptlsrpt.PolicyResult{
+			{
+				Policy: smtptlsrpt.PolicyDescriptor{
+					Type:   smtptlsrpt.PolicyNoPolicyFound,
+					Domain: "example.org",
+				},
+				Summary: smtptlsrpt.Summary{
+					TotalSuccessfulSessionCount: 3,
+					TotalFailureSessionCount:    2,
+				},
+				FailureDetails: []smtptlsrpt.FailureDetails{{
+					ResultType:          smtptlsrpt.ResultSTARTTLSNotSupported,
+					ReceivingMXHostname: "mx2.example.org",
+					ReceivingIP:         "192.0.2.1",
+					FailedSessionCount:  2,
+				}},
+			},
+			{
+				Policy: smtptlsrpt.PolicyDescriptor{
+					Type:   smtptlsrpt.PolicySTS,
+					String: []string{"version: STSv1", "mode: enforce"},
+					Domain: "example.org",
+					MXHost: []string{"*.example.org"},
+				},
+				Summary: smtptlsrpt.Summary{TotalFailureSessionCount: 1},
+				FailureDetails: []smtptlsrpt.FailureDetails{{
+					ResultType:         smtptlsrpt.ResultCertificateExpired,
+					FailedSessionCount: 1,
+				}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report = %+v, want %+v", report, want)
+	}
+
+	select {
+	case report := <-posted:
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("posted report = %+v, want %+v", report, want)
+		}
+	default:
+		t.Errorf("report wasn't posted")
+	}
+
+	// A new reporting period starts
+	sent = nil
+	if err := r.Flush(context.Background()); err != nil || len(sent) != 0 {
+		t.Errorf("Flush() = %v, sent %v reports, want none", err, len(sent))
+	}
+}
@@ -0,0 +1,142 @@
+// Package smtptlsrpt generates SMTP TLS reports, as defined in RFC 8460.
+//
+// Senders collect the outcome of the TLS negotiations with the mail
+// exchangers of recipient domains, and a Reporter periodically sends daily
+// reports to the addresses published by these domains:
+//
+//	r := &smtptlsrpt.Reporter{
+//		OrgName: "example.org",
+//		Email:   "tlsrpt@example.org",
+//		Send:    send,
+//	}
+//	go r.Run(ctx)
+//	q.TLSReport = r.Report
+//
+// A Queue with a TLSConfig reports its STARTTLS sessions. Without MTA-STS or
+// DANE support, they're reported with the no-policy-found policy type.
+package smtptlsrpt
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// PolicyType is the type of the policy applied to a session, as defined in
+// RFC 8460 section 4.4.
+type PolicyType string
+
+const (
+	PolicySTS           PolicyType = "sts"
+	PolicyTLSA          PolicyType = "tlsa"
+	PolicyNoPolicyFound PolicyType = "no-policy-found"
+)
+
+// ResultType is the reason of a session failure, as defined in RFC 8460
+// section 4.3.
+type ResultType string
+
+const (
+	// Negotiation failures
+	ResultSTARTTLSNotSupported    ResultType = "starttls-not-supported"
+	ResultCertificateHostMismatch ResultType = "certificate-host-mismatch"
+	ResultCertificateExpired      ResultType = "certificate-expired"
+	ResultCertificateNotTrusted   ResultType = "certificate-not-trusted"
+	ResultValidationFailure       ResultType = "validation-failure"
+
+	// Policy failures
+	ResultTLSAInvalid         ResultType = "tlsa-invalid"
+	ResultDNSSECInvalid       ResultType = "dnssec-invalid"
+	ResultDANERequired        ResultType = "dane-required"
+	ResultSTSPolicyFetchError ResultType = "sts-policy-fetch-error"
+	ResultSTSPolicyInvalid    ResultType = "sts-policy-invalid"
+	ResultSTSWebPKIInvalid    ResultType = "sts-webpki-invalid"
+)
+
+// Session is the outcome of a TLS negotiation with a mail exchanger.
+type Session struct {
+	// Recipient domain the policy applies to. Required.
+	PolicyDomain string
+	// Policy applied to the session. If empty, PolicyNoPolicyFound is used.
+	PolicyType PolicyType
+	// Policy as published, e.g. the lines of an MTA-STS policy or the TLSA
+	// records, and the MX host patterns of an MTA-STS policy.
+	PolicyString []string
+	PolicyMXHost []string
+
+	// Mail exchanger, as found in the MX records, and the address connected
+	// to. The addresses are optional.
+	ReceivingMXHostname string
+	ReceivingIP         net.IP
+	SendingMTAIP        net.IP
+
+	// Reason of the failure, empty if the session succeeded.
+	Result ResultType
+	// Additional details about the failure, e.g. the error message.
+	FailureReason string
+}
+
+// ClassifyError returns the result type of a failed TLS negotiation.
+func ClassifyError(err error) ResultType {
+	var hostErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var authorityErr x509.UnknownAuthorityError
+	switch {
+	case errors.Is(err, smtp.ErrStartTLSUnsupported):
+		return ResultSTARTTLSNotSupported
+	case errors.As(err, &hostErr):
+		return ResultCertificateHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return ResultCertificateExpired
+	case errors.As(err, &authorityErr):
+		return ResultCertificateNotTrusted
+	default:
+		return ResultValidationFailure
+	}
+}
+
+// Record is a TLSRPT record, as defined in RFC 8460 section 3.
+type Record struct {
+	// Addresses to send reports to: mailto: and https: URIs.
+	ReportURIs []string
+}
+
+// ParseRecord parses a TLSRPT record.
+func ParseRecord(txt string) (*Record, error) {
+	var rec Record
+	versioned := false
+	for _, field := range strings.Split(txt, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("smtptlsrpt: malformed field %q", field)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !versioned {
+			if k != "v" || v != "TLSRPTv1" {
+				return nil, errors.New("smtptlsrpt: record doesn't start with v=TLSRPTv1")
+			}
+			versioned = true
+			continue
+		}
+		if k != "rua" {
+			continue
+		}
+		for _, uri := range strings.Split(v, ",") {
+			if uri = strings.TrimSpace(uri); uri != "" {
+				rec.ReportURIs = append(rec.ReportURIs, uri)
+			}
+		}
+	}
+	if len(rec.ReportURIs) == 0 {
+		return nil, errors.New("smtptlsrpt: missing rua field")
+	}
+	return &rec, nil
+}
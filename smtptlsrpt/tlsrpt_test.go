@@ -0,0 +1,60 @@
+package smtptlsrpt_test
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/smtptlsrpt"
+)
+
+func TestParseRecord(t *testing.T) {
+	tests := []struct {
+		txt  string
+		want []string
+	}{
+		{"v=TLSRPTv1; rua=mailto:tlsrpt@example.org", []string{"mailto:tlsrpt@example.org"}},
+		{"v=TLSRPTv1;rua=mailto:a@example.org, https://example.org/tlsrpt;", []string{"mailto:a@example.org", "https://example.org/tlsrpt"}},
+		{"v=TLSRPTv1; ext=1; rua=https://example.org/tlsrpt", []string{"https://example.org/tlsrpt"}},
+		{"v=TLSRPTv1", nil},
+		{"rua=mailto:tlsrpt@example.org; v=TLSRPTv1", nil},
+		{"v=TLSRPTv2; rua=mailto:tlsrpt@example.org", nil},
+		{"v=TLSRPTv1; rua", nil},
+	}
+	for _, tc := range tests {
+		rec, err := smtptlsrpt.ParseRecord(tc.txt)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("ParseRecord(%q) = %v, want error", tc.txt, rec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRecord(%q) = %v", tc.txt, err)
+		} else if !reflect.DeepEqual(rec.ReportURIs, tc.want) {
+			t.Errorf("ParseRecord(%q).ReportURIs = %q, want %q", tc.txt, rec.ReportURIs, tc.want)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want smtptlsrpt.ResultType
+	}{
+		{smtp.ErrStartTLSUnsupported, smtptlsrpt.ResultSTARTTLSNotSupported},
+		{x509.HostnameError{Host: "mx.example.org"}, smtptlsrpt.ResultCertificateHostMismatch},
+		{fmt.Errorf("tls: %w", x509.CertificateInvalidError{Reason: x509.Expired}), smtptlsrpt.ResultCertificateExpired},
+		{x509.CertificateInvalidError{Reason: x509.NotAuthorizedToSign}, smtptlsrpt.ResultValidationFailure},
+		{fmt.Errorf("tls: %w", x509.UnknownAuthorityError{}), smtptlsrpt.ResultCertificateNotTrusted},
+		{errors.New("remote error: tls: handshake failure"), smtptlsrpt.ResultValidationFailure},
+	}
+	for _, tc := range tests {
+		if got := smtptlsrpt.ClassifyError(tc.err); got != tc.want {
+			t.Errorf("ClassifyError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
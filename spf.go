@@ -0,0 +1,141 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-smtp/smtplog"
+)
+
+// SPFResult is the result of an SPF check, as defined in RFC 7208 section
+// 2.6.
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// SPFChecker checks whether a client is authorized to send mail for the
+// sender domain with SPF. See Server.SPFChecker and the smtpspf package.
+type SPFChecker interface {
+	// CheckSPF evaluates the SPF policy of the sender domain for the client
+	// IP address. sender is the MAIL FROM address, empty for the null
+	// reverse-path, in which case the HELO domain is checked instead.
+	//
+	// A non-nil error explains temperror and permerror results. If the
+	// result is empty, temperror is assumed.
+	CheckSPF(ctx context.Context, ip net.IP, helo, sender string) (SPFResult, error)
+}
+
+// SPFCheckerFunc is an adapter to allow the use of an ordinary function as an
+// SPFChecker.
+type SPFCheckerFunc func(ctx context.Context, ip net.IP, helo, sender string) (SPFResult, error)
+
+var _ SPFChecker = (SPFCheckerFunc)(nil)
+
+// CheckSPF calls f(ctx, ip, helo, sender).
+func (f SPFCheckerFunc) CheckSPF(ctx context.Context, ip net.IP, helo, sender string) (SPFResult, error) {
+	return f(ctx, ip, helo, sender)
+}
+
+// SPF returns the result of the SPF check of the current transaction, or an
+// empty string if there is none. See Server.SPFChecker.
+func (c *Conn) SPF() SPFResult {
+	return c.spf
+}
+
+// checkSPF runs Server.SPFChecker for the sender of a new transaction, and
+// prepares the Received-SPF header field.
+func (c *Conn) checkSPF(from string) SPFResult {
+	c.spf, c.spfFrom, c.spfHeader = "", "", ""
+	checker := c.server.SPFChecker
+	if checker == nil {
+		return ""
+	}
+	ip := clientIP(c.ClientAddr())
+	if ip == nil {
+		return ""
+	}
+
+	result, err := checker.CheckSPF(c.ctx, ip, c.Hostname(), from)
+	if result == "" {
+		result = SPFTempError
+	}
+	attrs := []slog.Attr{slog.String("result", string(result)), slog.String("from", from)}
+	if err != nil {
+		attrs = append(attrs, slog.String(smtplog.ErrorKey, err.Error()))
+	}
+	c.log(slog.LevelInfo, "spf", "SPF check", attrs...)
+
+	c.spf, c.spfFrom = result, from
+	if c.server.ReceivedSPFHeader {
+		c.spfHeader = receivedSPFHeader(result, err, c.server.Domain, ip, c.Hostname(), from)
+	}
+	return result
+}
+
+// receivedSPFHeader formats a Received-SPF header field, as defined in
+// RFC 7208 section 9.1.
+func receivedSPFHeader(result SPFResult, err error, receiver string, ip net.IP, helo, from string) string {
+	identity := "mailfrom"
+	sender := from
+	if sender == "" {
+		identity = "helo"
+		sender = "postmaster@" + helo
+	}
+
+	var comment string
+	switch result {
+	case SPFPass:
+		comment = fmt.Sprintf("domain of %v designates %v as permitted sender", sender, ip)
+	case SPFFail, SPFSoftFail:
+		comment = fmt.Sprintf("domain of %v does not designate %v as permitted sender", sender, ip)
+	case SPFNeutral, SPFNone:
+		comment = fmt.Sprintf("%v is neither permitted nor denied by domain of %v", ip, sender)
+	default:
+		comment = fmt.Sprintf("error in processing during lookup of %v", sender)
+		if err != nil {
+			comment += ": " + err.Error()
+		}
+	}
+	if receiver != "" {
+		comment = receiver + ": " + comment
+	}
+	comment = strings.NewReplacer("(", "", ")", "", "\r", "", "\n", "").Replace(comment)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Received-SPF: %v (%v)\r\n", result, comment)
+	fmt.Fprintf(&sb, "\tclient-ip=%v; envelope-from=%q; helo=%v;", ip, from, spfHeaderValue(helo))
+	if receiver != "" {
+		fmt.Fprintf(&sb, " receiver=%v;", spfHeaderValue(receiver))
+	}
+	fmt.Fprintf(&sb, " identity=%v;\r\n", identity)
+	return sb.String()
+}
+
+// spfHeaderValue quotes s unless it is a dot-atom.
+func spfHeaderValue(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-_[]:") == "" {
+		return s
+	}
+	return fmt.Sprintf("%q", s)
+}
+
+// withReceivedSPF prepends the Received-SPF header field of the current
+// transaction to the message, if any.
+func (c *Conn) withReceivedSPF(r io.Reader) io.Reader {
+	if c.spfHeader == "" {
+		return r
+	}
+	return io.MultiReader(strings.NewReader(c.spfHeader), r)
+}
@@ -0,0 +1,280 @@
+package smtp
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ServeSTDIO handles a single session over a pair of streams, e.g. the
+// standard input and output of a process started by inetd, or by an SSH
+// server. It returns once the session ends, or when ctx is done, in which
+// case the session is interrupted as when the server is closed.
+//
+// If stdin is a socket, as with inetd, the connection is handled directly,
+// and the client address is known. Otherwise, the read and write timeouts
+// are emulated. The streams aren't closed.
+func (s *Server) ServeSTDIO(ctx context.Context, stdin io.Reader, stdout io.Writer) error {
+	select {
+	case <-s.done:
+		return ErrServerClosed
+	default:
+	}
+
+	var c net.Conn
+	if f, ok := stdin.(*os.File); ok && isSameFile(f, stdout) {
+		// net.FileConn duplicates the file descriptor
+		if fc, err := net.FileConn(f); err == nil {
+			c = fc
+		}
+	}
+	if c == nil {
+		c = newStdioConn(stdin, stdout)
+	}
+
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	conn := newConn(c, s)
+	conn.listenerAddr = c.LocalAddr()
+	conn.setProfilerState("connect")
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err := s.handleConn(conn)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// isSameFile reports whether w is the same file as f, e.g. the socket of an
+// inetd connection, passed as both the standard input and output.
+func isSameFile(f *os.File, w io.Writer) bool {
+	wf, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	wfi, err := wf.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, wfi)
+}
+
+// stdioAddr is the address of both ends of a stdioConn.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+// stdioConn is a net.Conn over a pair of streams. The input stream is read
+// in the background, so that reads can be interrupted by deadlines. Writes
+// are interrupted by deadlines too, but carry on in the background: the
+// connection is then unusable.
+type stdioConn struct {
+	r io.Reader
+	w io.Writer
+
+	readOnce sync.Once
+	reads    chan stdioRead // results of background reads
+	pending  []byte         // data read but not returned yet
+	readErr  error          // sticky read error
+
+	writeMu sync.Mutex
+
+	readDeadline, writeDeadline *stdioDeadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type stdioRead struct {
+	b   []byte
+	err error
+}
+
+func newStdioConn(r io.Reader, w io.Writer) *stdioConn {
+	return &stdioConn{
+		r:             r,
+		w:             w,
+		reads:         make(chan stdioRead),
+		readDeadline:  newStdioDeadline(),
+		writeDeadline: newStdioDeadline(),
+		closed:        make(chan struct{}),
+	}
+}
+
+// readLoop reads the input stream, until it fails or the connection is
+// closed.
+func (c *stdioConn) readLoop() {
+	for {
+		b := make([]byte, 4096)
+		n, err := c.r.Read(b)
+		select {
+		case c.reads <- stdioRead{b[:n], err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *stdioConn) Read(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	if len(c.pending) == 0 && c.readErr == nil {
+		c.readOnce.Do(func() {
+			go c.readLoop()
+		})
+		select {
+		case res := <-c.reads:
+			c.pending, c.readErr = res.b, res.err
+		case <-c.readDeadline.wait():
+			// The background read carries on, its result is returned by
+			// the next call
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return 0, c.readErr
+}
+
+func (c *stdioConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		n, err := c.w.Write(b)
+		done <- result{n, err}
+	}()
+	select {
+	case res := <-done:
+		return res.n, res.err
+	case <-c.writeDeadline.wait():
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *stdioConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *stdioConn) LocalAddr() net.Addr  { return stdioAddr{} }
+func (c *stdioConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *stdioConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// stdioDeadline is a deadline, whose channel is closed once it's exceeded.
+type stdioDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newStdioDeadline() *stdioDeadline {
+	return &stdioDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline. The zero time means no deadline.
+func (d *stdioDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired and closed the channel
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.cancel:
+		closed = true
+	default:
+	}
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed once the deadline is exceeded.
+func (d *stdioDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
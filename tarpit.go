@@ -0,0 +1,94 @@
+package smtp
+
+import (
+	"log/slog"
+	"time"
+)
+
+const defaultTarpitMaxDelay = time.Minute
+
+// TarpitPolicy slows down clients which accumulate errors, such as syntax
+// errors, unknown commands and rejected recipients. See Server.Tarpit.
+type TarpitPolicy struct {
+	// Number of errors replied to without delay.
+	FreeErrors int
+	// Delay before the reply to the first error above FreeErrors. It doubles
+	// with each further error, up to MaxDelay (one minute if zero).
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Number of errors after which the connection is closed with a 421
+	// reply. Zero means unlimited.
+	MaxErrors int
+
+	// Mode is PolicyMonitor to only log delays and disconnections.
+	Mode PolicyMode
+}
+
+var _ Policy = (*TarpitPolicy)(nil)
+
+// PolicyMode implements Policy.
+func (p *TarpitPolicy) PolicyMode() PolicyMode {
+	return p.Mode
+}
+
+// delay returns the delay before the reply to the n-th error.
+func (p *TarpitPolicy) delay(n int) time.Duration {
+	if n <= p.FreeErrors || p.Delay <= 0 {
+		return 0
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = defaultTarpitMaxDelay
+	}
+	d := p.Delay
+	for i := p.FreeErrors + 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// tarpit records an error and applies Server.Tarpit before the error reply is
+// sent. It returns false if the connection has been closed instead.
+func (c *Conn) tarpit() bool {
+	p := c.server.Tarpit
+	if p == nil {
+		return true
+	}
+	c.tarpitErrors++
+
+	if p.MaxErrors > 0 && c.tarpitErrors >= p.MaxErrors {
+		if c.monitored(p, "tarpit", 421, "Too many errors, closing connection") {
+			return true
+		}
+		c.log(slog.LevelWarn, "tarpit", "too many errors, closing connection", slog.Int("errors", c.tarpitErrors))
+		c.Kick(421, EnhancedCode{4, 7, 0}, "Too many errors, closing connection")
+		return false
+	}
+
+	d := p.delay(c.tarpitErrors)
+	if d <= 0 {
+		return true
+	}
+	if p.Mode == PolicyMonitor {
+		c.log(slog.LevelDebug, "tarpit", "error reply not delayed in monitor mode", slog.Int("errors", c.tarpitErrors), slog.Duration("delay", d), slog.Bool(logKeyMonitor, true))
+		return true
+	}
+	c.log(slog.LevelDebug, "tarpit", "delaying error reply", slog.Int("errors", c.tarpitErrors), slog.Duration("delay", d))
+	return c.sleep(d)
+}
+
+// sleep waits for d. It returns false if the connection has been closed in
+// the meantime.
+func (c *Conn) sleep(d time.Duration) bool {
+	t := c.server.clock().NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
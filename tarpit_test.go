@@ -0,0 +1,21 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTarpitPolicy_delay(t *testing.T) {
+	p := &TarpitPolicy{FreeErrors: 2, Delay: time.Second, MaxDelay: 5 * time.Second}
+	want := []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for n, d := range want {
+		if got := p.delay(n); got != d {
+			t.Errorf("delay(%v) = %v, want %v", n, got, d)
+		}
+	}
+
+	p = &TarpitPolicy{Delay: time.Second}
+	if got := p.delay(1000); got != defaultTarpitMaxDelay {
+		t.Errorf("delay(1000) = %v, want %v", got, defaultTarpitMaxDelay)
+	}
+}
@@ -0,0 +1,92 @@
+package smtp
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Timing holds timing data about a connection and its last transaction,
+// which can help telling bulk senders apart. See Conn.Timing.
+type Timing struct {
+	// Time the connection was accepted.
+	Connected time.Time
+	// Time the MAIL command of the last transaction was accepted, zero if
+	// there is none.
+	Mail time.Time
+	// Time the transfer of the message started, with DATA or the first BDAT
+	// command, and ended. Zero until then.
+	DataStart, DataEnd time.Time
+	// Size of the message, once received.
+	DataBytes int64
+}
+
+// MailToData returns the time elapsed between the MAIL command and the start
+// of the message transfer, zero if the transfer hasn't started.
+func (t *Timing) MailToData() time.Duration {
+	if t.Mail.IsZero() || t.DataStart.IsZero() {
+		return 0
+	}
+	return t.DataStart.Sub(t.Mail)
+}
+
+// DataDuration returns the time taken to transfer the message, zero if it
+// hasn't been received entirely.
+func (t *Timing) DataDuration() time.Duration {
+	if t.DataStart.IsZero() || t.DataEnd.IsZero() {
+		return 0
+	}
+	return t.DataEnd.Sub(t.DataStart)
+}
+
+// DataRate returns the message transfer throughput, in bytes per second, zero
+// if the message hasn't been received entirely.
+func (t *Timing) DataRate() float64 {
+	d := t.DataDuration()
+	if d <= 0 {
+		return 0
+	}
+	return float64(t.DataBytes) / d.Seconds()
+}
+
+// Timing returns timing data about the connection and its last transaction.
+// The message timing is available once the message has been read in
+// Session.Data, and in Session.Logout.
+func (c *Conn) Timing() Timing {
+	c.timingLocker.Lock()
+	defer c.timingLocker.Unlock()
+	return c.timing
+}
+
+// startTransactionTiming records the start of a transaction.
+func (c *Conn) startTransactionTiming() {
+	c.timingLocker.Lock()
+	defer c.timingLocker.Unlock()
+	c.timing = Timing{Connected: c.timing.Connected, Mail: c.server.clock().Now()}
+}
+
+func (c *Conn) startDataTiming() {
+	c.timingLocker.Lock()
+	defer c.timingLocker.Unlock()
+	c.timing.DataStart = c.server.clock().Now()
+}
+
+func (c *Conn) endDataTiming(size int64) {
+	c.timingLocker.Lock()
+	defer c.timingLocker.Unlock()
+	c.timing.DataEnd = c.server.clock().Now()
+	c.timing.DataBytes = size
+}
+
+// timingAttrs returns the log attributes describing the timing of the last
+// message.
+func (c *Conn) timingAttrs() []slog.Attr {
+	t := c.Timing()
+	if t.DataEnd.IsZero() {
+		return nil
+	}
+	return []slog.Attr{
+		slog.Int64("size", t.DataBytes),
+		slog.Duration("mail_to_data", t.MailToData()),
+		slog.Duration("data_duration", t.DataDuration()),
+	}
+}
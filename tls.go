@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+
+	"github.com/emersion/go-smtp/smtplog"
+)
+
+type tlsConfigValue struct {
+	config *tls.Config
+}
+
+// ReloadTLS replaces Server.TLSConfig for new handshakes, e.g. after
+// certificates are renewed, and can be called while the server is running.
+// Established TLS sessions are unaffected. A nil config stops offering
+// STARTTLS.
+//
+// Implicit TLS listeners created by ListenAndServeTLS use the new
+// configuration too, but not the ones created by the caller.
+func (s *Server) ReloadTLS(config *tls.Config) {
+	s.reloadedTLS.Store(tlsConfigValue{config})
+}
+
+// tlsConfig returns the current TLS configuration, see ReloadTLS.
+func (s *Server) tlsConfig() *tls.Config {
+	if v, ok := s.reloadedTLS.Load().(tlsConfigValue); ok {
+		return v.config
+	}
+	return s.TLSConfig
+}
+
+// implicitTLSConfig returns the TLS configuration of implicit TLS
+// listeners, using the current configuration for each handshake.
+func (s *Server) implicitTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			config := s.tlsConfig()
+			if config == nil {
+				return nil, errors.New("smtp: missing TLS configuration")
+			}
+			// The callback of the returned configuration isn't called
+			if config.GetConfigForClient != nil {
+				if c, err := config.GetConfigForClient(hello); c != nil || err != nil {
+					return c, err
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// startTLSConfig returns the TLS configuration of a STARTTLS handshake,
+// calling Server.OnTLSClientHello if set, and recording the ClientHello in
+// the fingerprint if Server.EnableFingerprinting is set.
+func (c *Conn) startTLSConfig() *tls.Config {
+	config := c.server.tlsConfig()
+	if config == nil {
+		// Reloaded since STARTTLS was accepted, the handshake fails
+		return &tls.Config{}
+	}
+	hook := c.server.OnTLSClientHello
+	if hook == nil && !c.server.EnableFingerprinting {
+		return config
+	}
+
+	config = config.Clone()
+	getConfigForClient := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if c.server.EnableFingerprinting {
+			c.fingerprintTLS(hello)
+		}
+		if hook != nil {
+			if err := hook(c, hello); err != nil {
+				c.log(slog.LevelWarn, "tls", "TLS client hello rejected",
+					slog.String(logKeyTLSServerName, hello.ServerName),
+					slog.String(smtplog.ErrorKey, err.Error()))
+				return nil, err
+			}
+		}
+		if getConfigForClient != nil {
+			return getConfigForClient(hello)
+		}
+		return nil, nil
+	}
+	return config
+}
+
+// checkTLSHandshake logs a completed TLS handshake, and calls
+// Server.OnTLSHandshake if set.
+func (c *Conn) checkTLSHandshake() error {
+	state, _ := c.TLSConnectionState()
+	var err error
+	if c.server.OnTLSHandshake != nil {
+		err = c.server.OnTLSHandshake(c, state)
+	}
+	c.logResult("tls", "TLS handshake", err,
+		slog.String(logKeyTLSVersion, tls.VersionName(state.Version)),
+		slog.String(logKeyTLSCipherSuite, tls.CipherSuiteName(state.CipherSuite)),
+		slog.String(logKeyTLSServerName, state.ServerName))
+	return err
+}
+
+// writeTLSRejection replies to a client whose TLS handshake was rejected by
+// Server.OnTLSHandshake, and closes the connection.
+func (c *Conn) writeTLSRejection(code int, enhCode EnhancedCode, err error) {
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		c.Kick(smtpErr.Code, smtpErr.EnhancedCode, c.scrub(smtpErr.Message))
+	} else {
+		c.Kick(code, enhCode, "TLS not available due to temporary reason")
+	}
+}
@@ -0,0 +1,154 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TLSVerifyMode is how a Client verifies the certificate of a server after
+// STARTTLS. The certificate chain is always verified against
+// tls.Config.RootCAs: the modes differ by the names the certificate must be
+// valid for, and whether the connection fails if it isn't valid.
+type TLSVerifyMode int
+
+const (
+	// The certificate must be valid for the host name of the server, e.g.
+	// the mail exchanger host name: tls.Config.ServerName, or the host
+	// dialed.
+	TLSVerifyHostname TLSVerifyMode = iota
+	// The certificate must be valid for one of Client.TLSVerifyNames, e.g.
+	// the recipient domain, or the mx patterns of an MTA-STS policy, as
+	// defined in RFC 8461 section 4.1: a leading "*." matches a single
+	// label.
+	TLSVerifyNames
+	// The certificate is verified as with TLSVerifyHostname, but the
+	// connection is established even if it isn't valid, e.g. for
+	// opportunistic TLS. The outcome is reported by Client.TLSVerification.
+	TLSVerifyInsecure
+)
+
+// String returns the name of the mode: "hostname", "names" or "insecure".
+func (mode TLSVerifyMode) String() string {
+	switch mode {
+	case TLSVerifyHostname:
+		return "hostname"
+	case TLSVerifyNames:
+		return "names"
+	case TLSVerifyInsecure:
+		return "insecure"
+	default:
+		return fmt.Sprintf("TLSVerifyMode(%d)", int(mode))
+	}
+}
+
+// TLSVerification is the outcome of the verification of a server
+// certificate, see Client.TLSVerification.
+type TLSVerification struct {
+	Mode TLSVerifyMode
+	// Name the certificate is valid for, empty if it isn't valid.
+	Name string
+	// Reason why the certificate isn't valid, nil if it is. The TLS
+	// handshake fails with this error, unless Mode is TLSVerifyInsecure.
+	Err error
+}
+
+// TLSVerification returns the outcome of the verification of the server
+// certificate. It's nil until the TLS handshake following STARTTLS has
+// completed, or if tls.Config.InsecureSkipVerify is set.
+func (c *Client) TLSVerification() *TLSVerification {
+	if c.tlsVerification == nil {
+		return nil
+	}
+	v := *c.tlsVerification
+	return &v
+}
+
+// verifyingConfig returns config, verifying certificates according to
+// c.TLSVerify and recording the outcome in c.tlsVerification.
+func (c *Client) verifyingConfig(config *tls.Config) *tls.Config {
+	c.tlsVerification = nil
+	if config.InsecureSkipVerify {
+		return config
+	}
+
+	mode := c.TLSVerify
+	names := []string{config.ServerName}
+	if mode == TLSVerifyNames {
+		names = c.TLSVerifyNames
+	}
+	next := config.VerifyConnection
+
+	config = config.Clone()
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		v := &TLSVerification{Mode: mode}
+		v.Name, v.Err = verifyCertificate(config, cs, names)
+		c.tlsVerification = v
+		if v.Err != nil && mode != TLSVerifyInsecure {
+			return v.Err
+		}
+		if next != nil {
+			return next(cs)
+		}
+		return nil
+	}
+	return config
+}
+
+// verifyCertificate verifies the certificate chain of a connection, and
+// returns the first of names the certificate is valid for.
+func verifyCertificate(config *tls.Config, cs tls.ConnectionState, names []string) (string, error) {
+	if len(cs.PeerCertificates) == 0 {
+		return "", errors.New("smtp: server didn't send a certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	opts := x509.VerifyOptions{
+		Roots:         config.RootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	if config.Time != nil {
+		opts.CurrentTime = config.Time()
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return "", err
+	}
+
+	var err error
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") {
+			if matchWildcard(leaf, name) {
+				return name, nil
+			}
+			err = fmt.Errorf("smtp: certificate isn't valid for %v", name)
+		} else if err = leaf.VerifyHostname(name); err == nil {
+			return name, nil
+		}
+	}
+	if err == nil {
+		err = errors.New("smtp: no name to verify the certificate against")
+	}
+	return "", err
+}
+
+// matchWildcard reports whether the certificate is valid for a host name
+// matching pattern, "*." followed by a domain.
+func matchWildcard(cert *x509.Certificate, pattern string) bool {
+	parent := strings.ToLower(strings.TrimSuffix(pattern[2:], "."))
+	for _, name := range cert.DNSNames {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name == "*."+parent {
+			return true
+		}
+		label, rest, ok := strings.Cut(name, ".")
+		if ok && rest == parent && label != "" && !strings.Contains(label, "*") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// TrustedNets is a list of networks used by policies granting privileges to
+// some clients based on their address.
+//
+// The zero value trusts no one. A TrustedNets must not be modified while in
+// use by a running Server.
+type TrustedNets struct {
+	prefixes []netip.Prefix
+}
+
+// ParseTrustedNets creates a TrustedNets from a list of entries, as accepted
+// by TrustedNets.Add.
+func ParseTrustedNets(entries ...string) (*TrustedNets, error) {
+	tn := &TrustedNets{}
+	for _, entry := range entries {
+		if err := tn.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return tn, nil
+}
+
+// Add adds an entry to the list. An entry can be:
+//
+//   - A network in CIDR notation, e.g. "192.0.2.0/24" or "2001:db8::/32"
+//   - A single host address, e.g. "192.0.2.1" or "2001:db8::1"
+//   - The "localhost" keyword, for loopback addresses
+//   - The "link-local" keyword, for link-local unicast addresses
+//
+// IPv4-mapped IPv6 addresses, such as "::ffff:192.0.2.1", are normalized to
+// their IPv4 form.
+func (tn *TrustedNets) Add(entry string) error {
+	entry = strings.TrimSpace(entry)
+	switch strings.ToLower(entry) {
+	case "localhost":
+		tn.prefixes = append(tn.prefixes,
+			netip.MustParsePrefix("127.0.0.0/8"),
+			netip.MustParsePrefix("::1/128"))
+		return nil
+	case "link-local":
+		tn.prefixes = append(tn.prefixes,
+			netip.MustParsePrefix("169.254.0.0/16"),
+			netip.MustParsePrefix("fe80::/10"))
+		return nil
+	}
+
+	if !strings.Contains(entry, "/") {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return fmt.Errorf("smtp: invalid trusted network %q: %v", entry, err)
+		}
+		addr = addr.Unmap()
+		tn.prefixes = append(tn.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		return nil
+	}
+
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return fmt.Errorf("smtp: invalid trusted network %q: %v", entry, err)
+	}
+	if addr := prefix.Addr(); addr.Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			return fmt.Errorf("smtp: invalid trusted network %q: IPv4-mapped prefix too short", entry)
+		}
+		prefix = netip.PrefixFrom(addr.Unmap(), bits)
+	}
+	tn.prefixes = append(tn.prefixes, prefix.Masked())
+	return nil
+}
+
+// AddNet adds a network to the list.
+func (tn *TrustedNets) AddNet(ipnet *net.IPNet) error {
+	return tn.Add(ipnet.String())
+}
+
+// ContainsAddr reports whether addr is part of a trusted network.
+func (tn *TrustedNets) ContainsAddr(addr netip.Addr) bool {
+	if tn == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range tn.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsIP reports whether ip is part of a trusted network.
+func (tn *TrustedNets) ContainsIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	return ok && tn.ContainsAddr(addr)
+}
+
+// Contains reports whether the network address addr is part of a trusted
+// network. Addresses of other types than *net.TCPAddr, *net.UDPAddr and
+// *net.IPAddr are never trusted.
+func (tn *TrustedNets) Contains(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip != nil && tn.ContainsIP(ip)
+}
+
+// String returns the list of networks, separated by commas.
+func (tn *TrustedNets) String() string {
+	if tn == nil {
+		return ""
+	}
+	l := make([]string, len(tn.prefixes))
+	for i, prefix := range tn.prefixes {
+		l[i] = prefix.String()
+	}
+	return strings.Join(l, ",")
+}
+
+// addrIP returns the IP address of a network address, or nil if it doesn't
+// have one.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
+// NormalizeIP converts IPv4-mapped IPv6 addresses to their 4-byte IPv4 form.
+// Other addresses are returned unchanged.
+func NormalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
@@ -0,0 +1,67 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTrustedNets(t *testing.T) {
+	tn, err := ParseTrustedNets(
+		"192.0.2.0/24",
+		"2001:db8::/32",
+		"198.51.100.7",
+		"::ffff:203.0.113.0/120",
+		"localhost",
+		"link-local",
+	)
+	if err != nil {
+		t.Fatalf("ParseTrustedNets() = %v", err)
+	}
+
+	tests := []struct {
+		ip      string
+		trusted bool
+	}{
+		{"192.0.2.1", true},
+		{"::ffff:192.0.2.1", true},
+		{"192.0.3.1", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"198.51.100.7", true},
+		{"::ffff:198.51.100.7", true},
+		{"198.51.100.8", false},
+		{"203.0.113.42", true},
+		{"127.0.0.1", true},
+		{"127.1.2.3", true},
+		{"::1", true},
+		{"169.254.1.1", true},
+		{"fe80::1", true},
+		{"10.0.0.1", false},
+	}
+	for _, tc := range tests {
+		ip := net.ParseIP(tc.ip)
+		if got := tn.ContainsIP(ip); got != tc.trusted {
+			t.Errorf("ContainsIP(%v) = %v, want %v", tc.ip, got, tc.trusted)
+		}
+		if got := tn.Contains(&net.TCPAddr{IP: ip, Port: 25}); got != tc.trusted {
+			t.Errorf("Contains(%v) = %v, want %v", tc.ip, got, tc.trusted)
+		}
+	}
+
+	if tn.Contains(&net.UnixAddr{Name: "/run/smtp.sock", Net: "unix"}) {
+		t.Errorf("Contains(unix address) = true, want false")
+	}
+
+	var empty *TrustedNets
+	if empty.ContainsIP(net.ParseIP("127.0.0.1")) {
+		t.Errorf("nil TrustedNets contains 127.0.0.1")
+	}
+}
+
+func TestTrustedNets_invalid(t *testing.T) {
+	for _, entry := range []string{"", "example.org", "192.0.2.0/33", "::ffff:0:0/64"} {
+		if _, err := ParseTrustedNets(entry); err == nil {
+			t.Errorf("ParseTrustedNets(%q) = nil, want error", entry)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// UnixSocketOptions configures the socket file of a Unix listener, see
+// ListenUnix.
+type UnixSocketOptions struct {
+	// File mode of the socket, e.g. 0660 to restrict connections to the
+	// owner and group. Zero keeps the mode given by the umask.
+	Mode os.FileMode
+	// Owner and group of the socket, as names or numeric IDs. Empty values
+	// keep the ones of the process. Changing the owner requires privileges.
+	User, Group string
+}
+
+// ListenUnix listens on the Unix socket path, e.g. for LMTP deliveries from
+// another process on the same host.
+//
+// A stale socket left at path by a server which didn't exit cleanly, which
+// refuses connections, is removed. If another server is listening on path,
+// or if the socket can't be checked, an error is returned. The socket is
+// removed when the listener is closed.
+//
+// With opts, the socket is only accessible by the owner of the process until
+// they're applied: on Unix, the umask of the process is restricted while the
+// socket is created.
+//
+// On Linux, a path starting with "@" is a socket in the abstract namespace,
+// which has no file: opts must be nil.
+func ListenUnix(path string, opts *UnixSocketOptions) (*net.UnixListener, error) {
+	abstract := (runtime.GOOS == "linux" || runtime.GOOS == "android") && strings.HasPrefix(path, "@")
+	if abstract && opts != nil {
+		return nil, errors.New("smtp: abstract Unix socket can't have file options")
+	}
+
+	if !abstract {
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, umaskMode, err := listenUnix(path, opts != nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil {
+		if err := opts.apply(path, umaskMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket at path if no server listens on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("smtp: %v exists and isn't a socket", path)
+	}
+
+	c, err := net.Dial("unix", path)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("smtp: %v is used by a running server", path)
+	} else if !isConnRefused(err) {
+		// e.g. EACCES: the socket may be used by a server we can't reach
+		return fmt.Errorf("smtp: failed to check socket %v: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+// apply sets the options of the socket at path. umaskMode is the mode to set
+// if Mode is zero, if any.
+func (opts *UnixSocketOptions) apply(path string, umaskMode os.FileMode) error {
+	uid, gid := -1, -1
+	if opts.User != "" {
+		u, err := lookupID(opts.User, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("smtp: socket owner: %v", err)
+		}
+		uid = u
+	}
+	if opts.Group != "" {
+		g, err := lookupID(opts.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("smtp: socket group: %v", err)
+		}
+		gid = g
+	}
+	if uid >= 0 || gid >= 0 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	mode := opts.Mode
+	if mode == 0 {
+		mode = umaskMode
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupID returns the numeric user or group ID s, or looks it up by name.
+func lookupID(s string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
@@ -0,0 +1,25 @@
+//go:build !unix && !windows
+
+package smtp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+// listenUnix creates the socket at path. There's no umask to restrict it
+// with until its options are applied.
+func listenUnix(path string, restrict bool) (*net.UnixListener, os.FileMode, error) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	return l, 0, err
+}
+
+// isConnRefused matches the error message, since not all platforms define
+// syscall.ECONNREFUSED.
+func isConnRefused(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Err != nil &&
+		strings.Contains(opErr.Err.Error(), "connection refused")
+}
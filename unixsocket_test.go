@@ -0,0 +1,170 @@
+//go:build unix
+
+package smtp_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestServer_LMTP_unixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lmtp.sock")
+
+	// Leave a stale socket behind
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := smtp.NewServer(new(backend))
+	s.Domain = "localhost"
+	s.LMTP = true
+	s.Addr = path
+	s.UnixSocket = &smtp.UnixSocketOptions{
+		Mode:  0660,
+		Group: strconv.Itoa(os.Getgid()),
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ListenAndServe()
+	}()
+	defer s.Close()
+
+	var c net.Conn
+	for i := 0; i < 100; i++ {
+		if c, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 {
+		t.Errorf("Invalid socket mode: %v", fi.Mode())
+	}
+
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+	if scanner.Text() != "220 localhost LMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+	sendLHLO(t, scanner, c)
+
+	// The socket of a running server isn't removed
+	if _, err := smtp.ListenUnix(path, nil); err == nil {
+		t.Error("ListenUnix() succeeded on the socket of a running server")
+	}
+
+	s.Close()
+	if err := <-done; err != nil {
+		t.Fatal("ListenAndServe() =", err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Error("Socket not removed after the server is closed")
+	}
+}
+
+func TestListenUnix_umask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lmtp.sock")
+
+	// The mode given by the umask is kept
+	l, err := smtp.ListenUnix(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fi.Mode().Perm()
+
+	l, err = smtp.ListenUnix(path, &smtp.UnixSocketOptions{Group: strconv.Itoa(os.Getgid())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if fi, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != want {
+		t.Errorf("Socket mode = %v, want %v", fi.Mode().Perm(), want)
+	}
+}
+
+func TestListenUnix_inaccessible(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions aren't checked for root")
+	}
+
+	dir, err := ioutil.TempDir("", "go-smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lmtp.sock")
+
+	l, err := smtp.ListenUnix(path, &smtp.UnixSocketOptions{Mode: 0400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Connections fail with EACCES, the socket may be in use
+	if _, err := smtp.ListenUnix(path, nil); err == nil {
+		t.Error("ListenUnix() succeeded on an inaccessible socket")
+	}
+	if _, err := os.Lstat(path); err != nil {
+		t.Errorf("Inaccessible socket removed: %v", err)
+	}
+}
+
+func TestListenUnix_abstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract Unix sockets are only supported on Linux")
+	}
+
+	path := "@go-smtp-test-" + strconv.Itoa(os.Getpid())
+	if _, err := smtp.ListenUnix(path, &smtp.UnixSocketOptions{Mode: 0660}); err == nil {
+		t.Error("ListenUnix() succeeded with file options")
+	}
+
+	l, err := smtp.ListenUnix(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package smtp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenUnix creates the socket at path. With restrict, the socket is only
+// accessible by the owner of the process until its options are applied, and
+// the mode it would have had with the umask is returned.
+func listenUnix(path string, restrict bool) (*net.UnixListener, os.FileMode, error) {
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	if !restrict {
+		l, err := net.ListenUnix("unix", addr)
+		return l, 0, err
+	}
+
+	// The umask is per-process: files created by other goroutines meanwhile
+	// get the restrictive one too, which errs on the safe side
+	mask := syscall.Umask(0177)
+	l, err := net.ListenUnix("unix", addr)
+	syscall.Umask(mask)
+	return l, os.ModePerm &^ os.FileMode(mask), err
+}
+
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
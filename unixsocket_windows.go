@@ -0,0 +1,24 @@
+//go:build windows
+
+package smtp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// wsaECONNREFUSED is the Windows Sockets error for refused connections.
+const wsaECONNREFUSED = syscall.Errno(10061)
+
+// listenUnix creates the socket at path. There's no umask to restrict it
+// with until its options are applied.
+func listenUnix(path string, restrict bool) (*net.UnixListener, os.FileMode, error) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	return l, 0, err
+}
+
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, wsaECONNREFUSED)
+}
@@ -0,0 +1,193 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+)
+
+// HELOCheck is the validation applied to the HELO and EHLO argument.
+type HELOCheck int
+
+const (
+	// Accept any argument.
+	HELOCheckNone HELOCheck = iota
+	// Require a syntactically valid domain or address literal.
+	HELOCheckSyntax
+	// Require a fully-qualified domain or an address literal.
+	HELOCheckFQDN
+)
+
+// ValidationProfile bundles envelope validation settings. See
+// Server.Validation.
+type ValidationProfile struct {
+	// Reject addresses which aren't valid RFC 5321 mailboxes: local-parts
+	// longer than 64 octets or containing control characters, and domains
+	// which aren't valid domain names or address literals.
+	StrictAddresses bool
+	// Validation applied to the HELO and EHLO argument.
+	HELOCheck HELOCheck
+	// Reject messages sent with DATA which contain a bare CR or LF, instead
+	// of passing them to the backend as is.
+	RejectBareLineEndings bool
+
+	// Limits used when the corresponding Server field is zero. Zero means
+	// unlimited.
+	MaxMessageBytes int64
+	MaxRecipients   int
+
+	// Mode is PolicyMonitor to only log the addresses, HELO arguments and
+	// messages failing validation. Limits are always enforced.
+	Mode PolicyMode
+}
+
+var _ Policy = (*ValidationProfile)(nil)
+
+// PolicyMode implements Policy.
+func (p *ValidationProfile) PolicyMode() PolicyMode {
+	return p.Mode
+}
+
+// Validation profiles for common deployments. They must not be modified.
+var (
+	// ValidationStrictRFC enforces RFC 5321 syntax for addresses, HELO
+	// arguments and line endings.
+	ValidationStrictRFC = &ValidationProfile{
+		StrictAddresses:       true,
+		HELOCheck:             HELOCheckFQDN,
+		RejectBareLineEndings: true,
+		MaxMessageBytes:       25 * 1024 * 1024,
+		MaxRecipients:         100,
+	}
+	// ValidationPermissiveInternet accepts the common deviations of clients
+	// on the Internet, but rejects HELO arguments which aren't domains or
+	// address literals.
+	ValidationPermissiveInternet = &ValidationProfile{
+		HELOCheck:       HELOCheckSyntax,
+		MaxMessageBytes: 50 * 1024 * 1024,
+		MaxRecipients:   1000,
+	}
+	// ValidationInternalOnly is suitable for trusted clients, such as
+	// applications submitting messages on a private network.
+	ValidationInternalOnly = &ValidationProfile{
+		MaxMessageBytes: 100 * 1024 * 1024,
+	}
+)
+
+// ErrBareLineEnding is returned by the Reader passed to Session.Data when the
+// message contains a bare CR or LF, and Server.Validation rejects them. The
+// client is sent this error.
+var ErrBareLineEnding = &SMTPError{
+	Code:         550,
+	EnhancedCode: EnhancedCode{5, 5, 2},
+	Message:      "Message contains a bare CR or LF",
+}
+
+// maxMessageBytes returns the effective maximum message size.
+func (s *Server) maxMessageBytes() int64 {
+	if s.MaxMessageBytes == 0 && s.Validation != nil {
+		return s.Validation.MaxMessageBytes
+	}
+	return s.MaxMessageBytes
+}
+
+// maxRecipients returns the effective maximum number of recipients.
+func (s *Server) maxRecipients() int {
+	if s.MaxRecipients == 0 && s.Validation != nil {
+		return s.Validation.MaxRecipients
+	}
+	return s.MaxRecipients
+}
+
+func (s *Server) strictAddresses() bool {
+	return s.Validation != nil && s.Validation.StrictAddresses
+}
+
+func (s *Server) rejectBareLineEndings() bool {
+	return s.Validation != nil && s.Validation.RejectBareLineEndings
+}
+
+// checkHELO validates the HELO or EHLO argument domain.
+func (s *Server) checkHELO(domain string) *SMTPError {
+	if s.Validation == nil {
+		return nil
+	}
+	switch s.Validation.HELOCheck {
+	case HELOCheckSyntax:
+		if !validDomain(domain) && !validAddressLiteral(domain) {
+			return &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 2}, Message: "Invalid domain/address argument"}
+		}
+	case HELOCheckFQDN:
+		if validAddressLiteral(domain) {
+			break
+		}
+		if !validDomain(domain) {
+			return &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 2}, Message: "Invalid domain/address argument"}
+		}
+		if !strings.Contains(strings.TrimSuffix(domain, "."), ".") {
+			return &SMTPError{Code: 504, EnhancedCode: EnhancedCode{5, 5, 2}, Message: "Fully-qualified domain required"}
+		}
+	}
+	return nil
+}
+
+// validMailbox reports whether addr is a valid RFC 5321 mailbox, as returned
+// by parser.parseMailbox.
+func validMailbox(addr string) bool {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return false
+	}
+	localPart, domain := addr[:i], addr[i+1:]
+	if len(localPart) > 64 {
+		return false
+	}
+	for i := 0; i < len(localPart); i++ {
+		if ch := localPart[i]; ch < ' ' || ch == 0x7f {
+			return false
+		}
+	}
+	return validDomain(domain) || validAddressLiteral(domain)
+}
+
+// validDomain reports whether s is a valid domain name, as defined in RFC
+// 5321 section 4.1.2. Labels may contain UTF-8 characters, as allowed by
+// SMTPUTF8.
+func validDomain(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			ch := label[i]
+			if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-' || ch >= 0x80) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validAddressLiteral reports whether s is an IPv4 or IPv6 address literal,
+// as defined in RFC 5321 section 4.1.3.
+func validAddressLiteral(s string) bool {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return false
+	}
+	s = s[1 : len(s)-1]
+	if v6, ok := cutPrefixFold(s, "IPv6:"); ok {
+		ip := net.ParseIP(v6)
+		return ip != nil && strings.Contains(v6, ":")
+	}
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() != nil && !strings.Contains(s, ":")
+}
+
+// isBareLineEnding reports whether ch, read after prev, is part of a bare CR
+// or LF.
+func isBareLineEnding(prev, ch byte) bool {
+	return (ch == '\n' && prev != '\r') || (prev == '\r' && ch != '\n')
+}
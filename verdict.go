@@ -0,0 +1,102 @@
+package smtp
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+)
+
+// deferRejection records the rejection of a MAIL or RCPT command by the
+// session, if it's a policy rejection and Server.DeferPolicyRejections is
+// set. It reports whether the rejection has been deferred.
+func (c *Conn) deferRejection(err error) bool {
+	if !c.server.DeferPolicyRejections {
+		return false
+	}
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || !isPolicyRejection(smtpErr) {
+		return false
+	}
+	c.log(slog.LevelDebug, "defer", "rejection deferred to the end of the message", slog.Int(logKeyCode, smtpErr.Code))
+	c.verdicts = append(c.verdicts, smtpErr)
+	return true
+}
+
+// isPolicyRejection reports whether err has a security or policy enhanced
+// status code, as defined in RFC 3463 section 3.8.
+func isPolicyRejection(err *SMTPError) bool {
+	return err.Code >= 400 && err.Code < 600 && err.EnhancedCode.Class() == err.Code/100 && err.EnhancedCode.Subject() == SubjectSecurity
+}
+
+// verdict returns the reply to the message when rejections have been
+// deferred: the first permanent rejection, or the first temporary one if
+// there is none. It returns nil if no rejection has been deferred.
+func (c *Conn) verdict() *SMTPError {
+	var verdict *SMTPError
+	for _, err := range c.verdicts {
+		if verdict == nil || (err.Code >= 500 && verdict.Code < 500) {
+			verdict = err
+		}
+	}
+	return verdict
+}
+
+// writeVerdict replies to the message with verdict, once per recipient with
+// LMTP.
+func (c *Conn) writeVerdict(verdict *SMTPError) {
+	var err error = verdict
+	if c.dataAborted() {
+		err = ErrServerShutdown
+	}
+	if !c.server.LMTP {
+		c.logResult("data", "message", err, c.timingAttrs()...)
+		c.messageResult(err)
+		c.writeResponse(c.dataErrorToStatus(err))
+		return
+	}
+	for _, rcpt := range c.recipients {
+		c.messageResult(err)
+		code, enchCode, msg := c.dataErrorToStatus(err)
+		c.writeResponse(code, enchCode, "<"+rcpt+"> "+msg)
+	}
+}
+
+// handleDataVerdict discards a message sent with DATA, and rejects it with
+// verdict.
+func (c *Conn) handleDataVerdict(verdict *SMTPError) {
+	c.writeResponse(354, NoEnhancedCode, "Go ahead. End your data with <CR><LF>.<CR><LF>")
+	c.startDataTiming()
+
+	defer c.reset()
+
+	c.setReadingData(true)
+	defer c.closeIfAborted()
+
+	newDataReader(c).drain()
+	c.setReadingData(false)
+	c.writeVerdict(verdict)
+}
+
+// handleBdatVerdict discards a chunk sent with BDAT, and rejects the message
+// with verdict after the last one.
+func (c *Conn) handleBdatVerdict(verdict *SMTPError, size uint64, last bool) {
+	if c.bytesReceived == 0 {
+		c.startDataTiming()
+	}
+	c.lineLimitReader.LineLimit = 0
+	c.setReadingData(true)
+	io.Copy(ioutil.Discard, io.LimitReader(c.text.R, int64(size)))
+	c.setReadingData(false)
+	c.lineLimitReader.LineLimit = c.server.MaxLineLength
+	c.bytesReceived += int64(size)
+	defer c.closeIfAborted()
+
+	if !last {
+		c.writeResponse(250, EnhancedCode{2, 0, 0}, "Continue")
+		return
+	}
+	c.endDataTiming(c.bytesReceived)
+	c.writeVerdict(verdict)
+	c.reset()
+}
@@ -0,0 +1,215 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp/smtplog"
+)
+
+// XCLIENT attributes supported by the server, as defined in
+// https://www.postfix.org/XCLIENT_README.html. TLS and CIPHER are extensions
+// describing the TLS connection of the original client.
+var xclientAttrs = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN", "DESTADDR", "DESTPORT", "TLS", "CIPHER"}
+
+// XCLIENTData contains the client attributes overridden by a trusted proxy
+// with XCLIENT. Empty fields are unavailable.
+type XCLIENTData struct {
+	// Host name of the original client.
+	Name string
+	// Network address of the original client.
+	Addr net.Addr
+	// Host name the original client introduced itself with.
+	HELO string
+	// User name the original client authenticated as with the proxy.
+	Login string
+	// Network address the original client connected to.
+	DestAddr net.Addr
+	// TLS version and cipher suite of the connection of the original client
+	// to the proxy, as formatted by tls.VersionName and
+	// tls.CipherSuiteName. Empty if the connection didn't use TLS.
+	TLSVersion, TLSCipher string
+}
+
+// XCLIENTData returns the client attributes overridden with XCLIENT, or nil if
+// XCLIENT wasn't used. Attributes of successive XCLIENT commands accumulate.
+//
+// Note that TLSConnectionState still describes the connection to the proxy.
+func (c *Conn) XCLIENTData() *XCLIENTData {
+	if c.xclient == nil {
+		return nil
+	}
+	data := *c.xclient
+	return &data
+}
+
+// xclientAllowed reports whether the peer may use XCLIENT. The address of the
+// hop connected to the server is checked, not the one given with a previous
+// XCLIENT, so that a proxy can issue XCLIENT again.
+func (c *Conn) xclientAllowed() bool {
+	return c.server.XCLIENTTrustedNets.Contains(c.proxyPeerAddr())
+}
+
+// isXCLIENTUnavailable reports whether an attribute value means that the
+// information is unavailable.
+func isXCLIENTUnavailable(v string) bool {
+	return strings.EqualFold(v, "[UNAVAILABLE]") || strings.EqualFold(v, "[TEMPUNAVAIL]")
+}
+
+// parseAttrArgs parses the arguments of a XCLIENT or XFORWARD command, and
+// decodes their values. Attributes must be in supported.
+func parseAttrArgs(arg string, supported []string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, field := range strings.Fields(arg) {
+		i := strings.IndexByte(field, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("malformed attribute %q", field)
+		}
+		name := strings.ToUpper(field[:i])
+		known := false
+		for _, attr := range supported {
+			known = known || attr == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unsupported attribute %q", name)
+		}
+		value, err := DecodeXtext(field[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed %v attribute value: %v", name, err)
+		}
+		attrs[name] = value
+	}
+	if len(attrs) == 0 {
+		return nil, fmt.Errorf("missing attributes")
+	}
+	return attrs, nil
+}
+
+// attrsAddr returns the address prev overridden by the ADDR and PORT
+// attributes of a XCLIENT or XFORWARD command, with their names prefixed by
+// prefix.
+func attrsAddr(attrs map[string]string, prefix string, prev net.Addr) (net.Addr, error) {
+	addr, hasAddr := attrs[prefix+"ADDR"]
+	port, hasPort := attrs[prefix+"PORT"]
+	if hasAddr && isXCLIENTUnavailable(addr) {
+		hasAddr = false
+	}
+	if hasPort && isXCLIENTUnavailable(port) {
+		hasPort = false
+	}
+	if !hasAddr && !hasPort {
+		return prev, nil
+	}
+
+	tcpAddr := &net.TCPAddr{}
+	if prev, ok := prev.(*net.TCPAddr); ok {
+		*tcpAddr = *prev
+	}
+	if hasAddr {
+		if s, ok := cutPrefixFold(addr, "IPV6:"); ok {
+			addr = s
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("malformed %vADDR attribute value %q", prefix, addr)
+		}
+		tcpAddr.IP = NormalizeIP(ip)
+		tcpAddr.Zone = ""
+	}
+	if hasPort {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("malformed %vPORT attribute value %q", prefix, port)
+		}
+		tcpAddr.Port = int(n)
+	}
+	return tcpAddr, nil
+}
+
+func (c *Conn) handleXCLIENT(arg string) {
+	if !c.xclientAllowed() {
+		c.writeResponse(550, EnhancedCode{5, 7, 0}, "Insufficient authorization")
+		return
+	}
+	if c.fromReceived || c.bdatPipe != nil {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "Mail transaction in progress")
+		return
+	}
+
+	var data XCLIENTData
+	if c.xclient != nil {
+		data = *c.xclient
+	}
+	attrs, err := parseAttrArgs(arg, xclientAttrs)
+	if err == nil {
+		data.Addr, err = attrsAddr(attrs, "", c.ClientAddr())
+	}
+	if err == nil {
+		data.DestAddr, err = attrsAddr(attrs, "DEST", data.DestAddr)
+	}
+	if err != nil {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Bad XCLIENT syntax: "+err.Error())
+		return
+	}
+	if policy := c.server.XCLIENTPolicy; policy != nil {
+		if err := policy(c, attrs); err != nil {
+			c.log(slog.LevelWarn, "xclient", "client attributes rejected", slog.String(smtplog.ErrorKey, err.Error()))
+			var smtpErr *SMTPError
+			if errors.As(err, &smtpErr) {
+				c.writeResponse(smtpErr.Code, smtpErr.EnhancedCode, c.scrub(smtpErr.Message))
+			} else {
+				c.writeResponse(550, EnhancedCode{5, 7, 0}, "Insufficient authorization")
+			}
+			return
+		}
+	}
+
+	// The session starts over, as if the client had just connected
+	c.locker.Lock()
+	if c.session != nil {
+		c.session.Reset()
+		c.session.Logout()
+		c.session = nil
+	}
+	c.locker.Unlock()
+	c.helo = ""
+	c.didAuth = false
+	c.fromReceived = false
+	c.recipients = nil
+	c.rcptErrors = nil
+
+	for name, value := range attrs {
+		if isXCLIENTUnavailable(value) {
+			value = ""
+		}
+		switch name {
+		case "NAME":
+			data.Name = value
+		case "HELO":
+			data.HELO = value
+		case "LOGIN":
+			data.Login = value
+		case "TLS":
+			data.TLSVersion = value
+		case "CIPHER":
+			data.TLSCipher = value
+		}
+	}
+	c.xclient = &data
+	c.resetFingerprint()
+	c.log(slog.LevelInfo, "xclient", "client attributes overridden")
+
+	if !c.server.rekeyConnLimit(c) {
+		c.log(slog.LevelWarn, "conn_limit", "connection limit reached")
+		c.Kick(421, EnhancedCode{4, 7, 0}, "Too many connections, try again later")
+		return
+	}
+	if !c.checkConnection() {
+		return
+	}
+	c.greet()
+}
@@ -0,0 +1,95 @@
+package smtp
+
+import (
+	"log/slog"
+	"net"
+)
+
+// XFORWARD attributes supported by the server, as defined in
+// https://www.postfix.org/XFORWARD_README.html.
+var xforwardAttrs = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE"}
+
+// XFORWARDData contains the client attributes forwarded by a trusted proxy or
+// content filter with XFORWARD. Empty fields are unavailable.
+type XFORWARDData struct {
+	// Host name of the original client.
+	Name string
+	// Network address of the original client.
+	Addr net.Addr
+	// Protocol used by the original client, "SMTP" or "ESMTP".
+	Proto string
+	// Host name the original client introduced itself with.
+	HELO string
+	// Identifier of the message on the proxy, for logging.
+	Ident string
+	// Whether the original client is "LOCAL" or "REMOTE".
+	Source string
+}
+
+// XFORWARDData returns the client attributes forwarded with XFORWARD for the
+// current transaction, or nil if none were forwarded. They're cleared at the
+// end of the transaction.
+func (c *Conn) XFORWARDData() *XFORWARDData {
+	if c.xforward == nil {
+		return nil
+	}
+	data := *c.xforward
+	return &data
+}
+
+// xforwardAllowed reports whether the peer may use XFORWARD. The client
+// address is checked, so that a hop given with a PROXY header or XCLIENT
+// must be trusted to forward the attributes of its own clients.
+func (c *Conn) xforwardAllowed() bool {
+	return c.server.XFORWARDTrustedNets.Contains(c.ClientAddr())
+}
+
+func (c *Conn) handleXFORWARD(arg string) {
+	if !c.xforwardAllowed() {
+		c.writeResponse(550, EnhancedCode{5, 7, 0}, "Insufficient authorization")
+		return
+	}
+	if c.fromReceived || c.bdatPipe != nil {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "Mail transaction in progress")
+		return
+	}
+
+	// Attributes accumulate until the end of the transaction
+	var data XFORWARDData
+	if c.xforward != nil {
+		data = *c.xforward
+	}
+	attrs, err := parseAttrArgs(arg, xforwardAttrs)
+	if err == nil {
+		if addr, ok := attrs["ADDR"]; ok && isXCLIENTUnavailable(addr) {
+			data.Addr = nil
+		}
+		data.Addr, err = attrsAddr(attrs, "", data.Addr)
+	}
+	if err != nil {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Bad XFORWARD syntax: "+err.Error())
+		return
+	}
+
+	for name, value := range attrs {
+		if isXCLIENTUnavailable(value) {
+			value = ""
+		}
+		switch name {
+		case "NAME":
+			data.Name = value
+		case "PROTO":
+			data.Proto = value
+		case "HELO":
+			data.HELO = value
+		case "IDENT":
+			data.Ident = value
+		case "SOURCE":
+			data.Source = value
+		}
+	}
+	c.xforward = &data
+
+	c.log(slog.LevelDebug, "xforward", "client attributes forwarded")
+	c.writeResponse(250, EnhancedCode{2, 0, 0}, "Ok")
+}
@@ -0,0 +1,172 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// xrcptforwardParam is the name of the RCPT parameter used by Dovecot to
+// forward recipient fields between proxies and backends.
+const xrcptforwardParam = "XRCPTFORWARD"
+
+// maxXRCPTFORWARDLength is the maximum length of an encoded XRCPTFORWARD
+// value, so that it fits in a RCPT command with an address of the maximum
+// length (RFC 5321 section 4.5.3.1.3).
+const maxXRCPTFORWARDLength = maxParamsCommandLength - len("RCPT TO:<> XRCPTFORWARD=\r\n") - 256
+
+var xrcptforwardEscaper = strings.NewReplacer(
+	"\x01", "\x011",
+	"\t", "\x01t",
+	"\r", "\x01r",
+	"\n", "\x01n",
+)
+
+var xrcptforwardUnescaper = strings.NewReplacer(
+	"\x011", "\x01",
+	"\x01t", "\t",
+	"\x01r", "\r",
+	"\x01n", "\n",
+)
+
+// EncodeXRCPTFORWARD encodes the value of the XRCPTFORWARD RCPT parameter
+// supported by Dovecot: base64-encoded tab-separated "key=value" fields,
+// sorted by key, with special characters escaped. The base64 padding is
+// omitted, since "=" isn't allowed in parameter values.
+//
+// Keys must be non-empty and can't contain "=". An error is returned if the
+// encoded value doesn't fit in a RCPT command.
+func EncodeXRCPTFORWARD(fields map[string]string) (string, error) {
+	if len(fields) == 0 {
+		return "", errors.New("smtp: No XRCPTFORWARD fields")
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if k == "" || strings.Contains(k, "=") {
+			return "", fmt.Errorf("smtp: Invalid XRCPTFORWARD field name %q", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte('\t')
+		}
+		sb.WriteString(xrcptforwardEscaper.Replace(k))
+		sb.WriteByte('=')
+		sb.WriteString(xrcptforwardEscaper.Replace(fields[k]))
+	}
+
+	enc := base64.RawStdEncoding.EncodeToString([]byte(sb.String()))
+	if len(enc) > maxXRCPTFORWARDLength {
+		return "", fmt.Errorf("smtp: XRCPTFORWARD value too long (%v bytes, max %v)", len(enc), maxXRCPTFORWARDLength)
+	}
+	return enc, nil
+}
+
+// ParseXRCPTFORWARD decodes the value of the XRCPTFORWARD RCPT parameter, see
+// EncodeXRCPTFORWARD. The base64 padding is optional.
+func ParseXRCPTFORWARD(value string) (map[string]string, error) {
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, fmt.Errorf("smtp: Malformed XRCPTFORWARD value: %v", err)
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(string(b), "\t") {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("smtp: Malformed XRCPTFORWARD field %q", field)
+		}
+		fields[xrcptforwardUnescaper.Replace(k)] = xrcptforwardUnescaper.Replace(v)
+	}
+	return fields, nil
+}
+
+// SetXRCPTFORWARD encodes fields with EncodeXRCPTFORWARD, and adds the
+// XRCPTFORWARD parameter to opts.Extensions, to be sent by Client.Rcpt.
+func (opts *RcptOptions) SetXRCPTFORWARD(fields map[string]string) error {
+	value, err := EncodeXRCPTFORWARD(fields)
+	if err != nil {
+		return err
+	}
+	if opts.Extensions == nil {
+		opts.Extensions = make(map[string]string)
+	}
+	opts.Extensions[xrcptforwardParam] = value
+	return nil
+}
+
+// defaultMaxXRCPTFORWARDLength is the default value of
+// XRCPTFORWARDPolicy.MaxLength.
+const defaultMaxXRCPTFORWARDLength = 900
+
+// XRCPTFORWARDPolicy configures the validation of the XRCPTFORWARD RCPT
+// parameter. See Server.XRCPTFORWARDPolicy.
+type XRCPTFORWARDPolicy struct {
+	// Clients allowed to send XRCPTFORWARD without authenticating, by
+	// client address. If nil, only authenticated clients may.
+	TrustedNets *TrustedNets
+	// Maximum length of the encoded value. If zero, 900 bytes is used.
+	MaxLength int
+	// Field names accepted, case-sensitive. If empty, all fields are.
+	AllowedKeys []string
+	// Field names which must be present.
+	RequiredKeys []string
+	// Called with the fields after the checks above, if not nil. Returning
+	// an error rejects the recipient with a 501 reply, or the error if it's
+	// an *SMTPError.
+	Check func(conn *Conn, fields map[string]string) error
+}
+
+func (p *XRCPTFORWARDPolicy) maxLength() int {
+	if p.MaxLength == 0 {
+		return defaultMaxXRCPTFORWARDLength
+	}
+	return p.MaxLength
+}
+
+// xrcptforwardAllowed reports whether the client may send XRCPTFORWARD: it
+// must be authenticated, or part of XRCPTFORWARDPolicy.TrustedNets.
+func (c *Conn) xrcptforwardAllowed() bool {
+	p := c.server.XRCPTFORWARDPolicy
+	return p != nil && (c.didAuth || p.TrustedNets.Contains(c.ClientAddr()))
+}
+
+// checkXRCPTFORWARD validates a XRCPTFORWARD value against
+// Server.XRCPTFORWARDPolicy.
+func (c *Conn) checkXRCPTFORWARD(value string) *SMTPError {
+	p := c.server.XRCPTFORWARDPolicy
+	if len(value) > p.maxLength() {
+		return &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "XRCPTFORWARD parameter value too long"}
+	}
+	fields, err := ParseXRCPTFORWARD(value)
+	if err != nil {
+		return &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Malformed XRCPTFORWARD parameter value"}
+	}
+	if len(p.AllowedKeys) > 0 {
+		for k := range fields {
+			if !contains(p.AllowedKeys, k) {
+				return &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: fmt.Sprintf("XRCPTFORWARD field %q not allowed", k)}
+			}
+		}
+	}
+	for _, k := range p.RequiredKeys {
+		if _, ok := fields[k]; !ok {
+			return &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: fmt.Sprintf("Missing XRCPTFORWARD field %q", k)}
+		}
+	}
+	if p.Check != nil {
+		if err := p.Check(c, fields); err != nil {
+			var smtpErr *SMTPError
+			if errors.As(err, &smtpErr) {
+				return smtpErr
+			}
+			return &SMTPError{Code: 501, EnhancedCode: EnhancedCode{5, 5, 4}, Message: "Invalid XRCPTFORWARD parameter value"}
+		}
+	}
+	return nil
+}
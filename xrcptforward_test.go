@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestXRCPTFORWARD(t *testing.T) {
+	fields := map[string]string{
+		"user":  "root",
+		"ip":    "192.0.2.1",
+		"note":  "tab\there\r\n\x01",
+		"empty": "",
+	}
+	enc, err := EncodeXRCPTFORWARD(fields)
+	if err != nil {
+		t.Fatalf("EncodeXRCPTFORWARD() = %v", err)
+	}
+	raw := "empty=\tip=192.0.2.1\tnote=tab\x01there\x01r\x01n\x011\tuser=root"
+	if want := base64.RawStdEncoding.EncodeToString([]byte(raw)); enc != want {
+		t.Errorf("EncodeXRCPTFORWARD() = %q, want %q", enc, want)
+	}
+
+	got, err := ParseXRCPTFORWARD(enc)
+	if err != nil {
+		t.Fatalf("ParseXRCPTFORWARD() = %v", err)
+	}
+	if !reflect.DeepEqual(got, fields) {
+		t.Errorf("ParseXRCPTFORWARD() = %v, want %v", got, fields)
+	}
+
+	padded := base64.StdEncoding.EncodeToString([]byte("user=root\tip=192.0.2.1"))
+	got, err = ParseXRCPTFORWARD(padded)
+	if want := map[string]string{"user": "root", "ip": "192.0.2.1"}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseXRCPTFORWARD(%q) = %v, %v, want %v", padded, got, err, want)
+	}
+}
+
+func TestXRCPTFORWARD_invalid(t *testing.T) {
+	for _, fields := range []map[string]string{
+		nil,
+		{"": "value"},
+		{"a=b": "value"},
+		{"key": strings.Repeat("a", 512)},
+	} {
+		if _, err := EncodeXRCPTFORWARD(fields); err == nil {
+			t.Errorf("EncodeXRCPTFORWARD(%q) succeeded", fields)
+		}
+	}
+
+	for _, value := range []string{
+		"not base64!",
+		base64.StdEncoding.EncodeToString([]byte("novalue")),
+		base64.StdEncoding.EncodeToString([]byte("=value")),
+	} {
+		if _, err := ParseXRCPTFORWARD(value); err == nil {
+			t.Errorf("ParseXRCPTFORWARD(%q) succeeded", value)
+		}
+	}
+}
+
+func TestRcptOptions_SetXRCPTFORWARD(t *testing.T) {
+	opts := &RcptOptions{}
+	if err := opts.SetXRCPTFORWARD(map[string]string{"user": "root"}); err != nil {
+		t.Fatalf("SetXRCPTFORWARD() = %v", err)
+	}
+	if got, want := opts.Extensions["XRCPTFORWARD"], "dXNlcj1yb290"; got != want {
+		t.Errorf("Extensions[XRCPTFORWARD] = %q, want %q", got, want)
+	}
+}